@@ -5,7 +5,12 @@
 // Package apitype contains types for the Tailscale local API and control plane API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
 
 // WhoIsResponse is the JSON type returned by tailscaled debug server's /whois?ip=$IP handler.
 type WhoIsResponse struct {
@@ -30,3 +35,80 @@ type WaitingFile struct {
 	Name string
 	Size int64
 }
+
+// PresignedNodeKey is the JSON type accepted by the local API's
+// /set-presigned-node-key handler: a node key, and the serialized
+// tka.NodeKeySignature authorizing it, to log in with.
+type PresignedNodeKey struct {
+	NodeKey   key.NodePrivate
+	Signature []byte
+}
+
+// KeyBackupRequest is the JSON type accepted by the local API's
+// /export-keys and /import-keys handlers.
+type KeyBackupRequest struct {
+	// Passphrase is what the key.Backup is, or is to be, sealed with.
+	Passphrase string
+
+	// Sealed is the sealed key.Backup to import. It's empty on export.
+	Sealed []byte `json:",omitempty"`
+}
+
+// PrefApproval is a pref change on a node that's waiting for another
+// device to approve it, as listed by the node's peer API.
+type PrefApproval struct {
+	ID      string
+	Summary string    // what the change does, such as "turn off shields-up"
+	Digest  string    // of exactly what the change sets, to approve it by
+	Created time.Time // when the change was attempted
+	Expires time.Time // when the request lapses if not approved
+}
+
+// WakeOnLANResponse is the response from a node's peer API after it's
+// asked to send a Wake-on-LAN packet.
+type WakeOnLANResponse struct {
+	SentTo []string // names of the interfaces the packet was sent on
+	Errors []string // errors sending on other interfaces
+}
+
+// SupportBundle is the diagnostic bundle that "tailscale feedback"
+// uploads to a support endpoint, sealed in a SealedSupportBundle.
+type SupportBundle struct {
+	// Marker is the bugreport log marker, which locates the
+	// node's logs around the time of the report.
+	Marker string
+	// Ticket is the user-provided support ticket reference, if any.
+	Ticket string `json:",omitempty"`
+	// Note is the user-provided description of the problem, if any.
+	Note string `json:",omitempty"`
+
+	Time    time.Time
+	Version string // of the CLI that made the bundle
+
+	// Status is tailscaled's ipnstate.Status, as JSON.
+	Status []byte `json:",omitempty"`
+	// Netcheck is the netcheck.Report from the CLI's machine, as JSON.
+	Netcheck []byte `json:",omitempty"`
+	// Logs are tailscaled's most recent log lines, oldest first.
+	Logs []string `json:",omitempty"`
+	// Errors are the problems collecting parts of the bundle.
+	Errors []string `json:",omitempty"`
+}
+
+// SealedSupportBundle is the JSON body that "tailscale feedback" POSTs
+// to a support endpoint. The endpoint opens Sealed with its private
+// key's OpenFrom(Key, Sealed) to get the JSON SupportBundle.
+//
+// The endpoint's public key is fetched from its "/key" path.
+type SealedSupportBundle struct {
+	// Key is the single-use key the bundle was sealed with.
+	Key    key.MachinePublic
+	Sealed []byte
+}
+
+// SupportBundleResponse is the JSON response of a support endpoint to
+// an uploaded SealedSupportBundle.
+type SupportBundleResponse struct {
+	// ID is the reference to give support for the bundle.
+	ID string
+}
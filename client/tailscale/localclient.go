@@ -11,6 +11,7 @@
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -36,6 +37,8 @@
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/crashreport"
 )
 
 // defaultLocalClient is the default LocalClient when using the legacy
@@ -152,7 +155,8 @@ func (lc *LocalClient) doLocalRequestNiceError(req *http.Request) (*http.Respons
 }
 
 type errorJSON struct {
-	Error string
+	Error      string
+	Validation []ipn.PrefsFieldError // from the prefs endpoints
 }
 
 // AccessDeniedError is an error due to permissions.
@@ -174,6 +178,9 @@ func IsAccessDeniedError(err error) bool {
 func bestError(err error, body []byte) error {
 	var j errorJSON
 	if err := json.Unmarshal(body, &j); err == nil && j.Error != "" {
+		if len(j.Validation) > 0 {
+			return &ipn.PrefsValidationError{Errors: j.Validation}
+		}
 		return errors.New(j.Error)
 	}
 	return err
@@ -276,6 +283,251 @@ func (lc *LocalClient) BugReport(ctx context.Context, note string) (string, erro
 	return strings.TrimSpace(string(body)), nil
 }
 
+// CrashReports returns the reports of crashes of previous runs of
+// tailscaled, newest first.
+func (lc *LocalClient) CrashReports(ctx context.Context) ([]*crashreport.Report, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/crashes", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var reports []*crashreport.Report
+	if err := json.Unmarshal(res, &reports); err != nil {
+		return nil, fmt.Errorf("invalid crash reports json: %w", err)
+	}
+	return reports, nil
+}
+
+// RecentLogs returns tailscaled's most recent log lines, oldest first.
+// Each line starts with the UTC time it was logged.
+func (lc *LocalClient) RecentLogs(ctx context.Context) ([]string, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/recent-logs", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	if err := json.Unmarshal(res, &lines); err != nil {
+		return nil, fmt.Errorf("invalid recent logs json: %w", err)
+	}
+	return lines, nil
+}
+
+// RouteStatus reports whether tailscaled's OS routes and firewall rules
+// for its current configuration are all in place.
+func (lc *LocalClient) RouteStatus(ctx context.Context) (*ipnstate.RouteStatus, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/routes-converged", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	rs := new(ipnstate.RouteStatus)
+	if err := json.Unmarshal(res, rs); err != nil {
+		return nil, fmt.Errorf("invalid route status json: %w", err)
+	}
+	return rs, nil
+}
+
+// FlowStats returns the traffic of each recent flow through tailscaled's
+// packet filter. tailscaled only counts flows while FlowStats is being
+// called regularly, so the first call returns nothing.
+func (lc *LocalClient) FlowStats(ctx context.Context) ([]ipnstate.FlowStat, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/flows", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var flows []ipnstate.FlowStat
+	if err := json.Unmarshal(res, &flows); err != nil {
+		return nil, fmt.Errorf("invalid flows json: %w", err)
+	}
+	return flows, nil
+}
+
+// ShadowDiffs returns the recent network map and config changes
+// recorded by tailscaled's shadow engine, oldest first. It's empty
+// unless tailscaled was started with TS_SHADOW_ENGINE=1.
+func (lc *LocalClient) ShadowDiffs(ctx context.Context) ([]ipnstate.ShadowDiff, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/shadow-diffs", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []ipnstate.ShadowDiff
+	if err := json.Unmarshal(res, &diffs); err != nil {
+		return nil, fmt.Errorf("invalid shadow-diffs json: %w", err)
+	}
+	return diffs, nil
+}
+
+// LogLevels returns the level ("info", "debug" or "trace") of each of
+// tailscaled's log components, by name.
+func (lc *LocalClient) LogLevels(ctx context.Context) (map[string]string, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/loglevel", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var levels map[string]string
+	if err := json.Unmarshal(res, &levels); err != nil {
+		return nil, fmt.Errorf("invalid loglevel json: %w", err)
+	}
+	return levels, nil
+}
+
+// SetLogLevel sets the level of tailscaled's log component to level:
+// "info", "debug", "trace", or "default" for its starting level. If
+// persist is true, the level is saved in prefs and applied again when
+// tailscaled restarts.
+func (lc *LocalClient) SetLogLevel(ctx context.Context, component, level string, persist bool) error {
+	v := url.Values{
+		"component": {component},
+		"level":     {level},
+		"persist":   {strconv.FormatBool(persist)},
+	}
+	_, err := lc.send(ctx, "POST", "/localapi/v0/loglevel?"+v.Encode(), http.StatusNoContent, nil)
+	return err
+}
+
+// PrefApprovals returns the pref changes waiting for this node's
+// approval on the peer with Tailscale IP peer.
+func (lc *LocalClient) PrefApprovals(ctx context.Context, peer netaddr.IP) ([]apitype.PrefApproval, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/pref-approvals?peer="+url.QueryEscape(peer.String()), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var pas []apitype.PrefApproval
+	if err := json.Unmarshal(res, &pas); err != nil {
+		return nil, fmt.Errorf("invalid pref-approvals json: %w", err)
+	}
+	return pas, nil
+}
+
+// ApprovePrefChange approves the pending pref change id on the peer
+// with Tailscale IP peer. If digest is non-empty, it must be the
+// change's apitype.PrefApproval.Digest.
+func (lc *LocalClient) ApprovePrefChange(ctx context.Context, peer netaddr.IP, id, digest string) error {
+	v := url.Values{
+		"peer": {peer.String()},
+		"id":   {id},
+	}
+	if digest != "" {
+		v.Set("digest", digest)
+	}
+	_, err := lc.send(ctx, "POST", "/localapi/v0/pref-approvals?"+v.Encode(), http.StatusNoContent, nil)
+	return err
+}
+
+// WaitReady blocks until tailscaled is ready for what: "peers", once
+// it's running with the tailnet's peers configured; "routes", once peers
+// offer subnet routes too; or "exitnode", once the exit node is online
+// too. A positive timeout bounds the wait.
+func (lc *LocalClient) WaitReady(ctx context.Context, what string, timeout time.Duration) error {
+	v := url.Values{"for": {what}}
+	if timeout > 0 {
+		v.Set("timeout", timeout.String())
+	}
+	_, err := lc.send(ctx, "GET", "/localapi/v0/wait-ready?"+v.Encode(), 200, nil)
+	return err
+}
+
+// WakeOnLAN asks the peer with Tailscale IP peer, typically a subnet
+// router, to send a Wake-on-LAN packet for mac on its local networks.
+func (lc *LocalClient) WakeOnLAN(ctx context.Context, peer netaddr.IP, mac net.HardwareAddr) (*apitype.WakeOnLANResponse, error) {
+	v := url.Values{
+		"peer": {peer.String()},
+		"mac":  {mac.String()},
+	}
+	res, err := lc.send(ctx, "POST", "/localapi/v0/wake-on-lan?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	wr := new(apitype.WakeOnLANResponse)
+	if err := json.Unmarshal(res, wr); err != nil {
+		return nil, fmt.Errorf("invalid wake-on-lan json: %w", err)
+	}
+	return wr, nil
+}
+
+// ExplainUnreachable returns tailscaled's explanation of why ip, a
+// Tailscale IP or an address behind a subnet router or exit node, may be
+// unreachable from this node.
+func (lc *LocalClient) ExplainUnreachable(ctx context.Context, ip netaddr.IP) (*ipnstate.UnreachableReport, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/explain-unreachable?ip="+url.QueryEscape(ip.String()), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	rep := new(ipnstate.UnreachableReport)
+	if err := json.Unmarshal(res, rep); err != nil {
+		return nil, fmt.Errorf("invalid explain-unreachable json: %w", err)
+	}
+	return rep, nil
+}
+
+// Exposure returns which peers can reach this node's listening ports.
+func (lc *LocalClient) Exposure(ctx context.Context) (*ipnstate.ExposureReport, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/exposure", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	rep := new(ipnstate.ExposureReport)
+	if err := json.Unmarshal(res, rep); err != nil {
+		return nil, fmt.Errorf("invalid exposure json: %w", err)
+	}
+	return rep, nil
+}
+
+// NodeGroups returns the locally defined node groups.
+func (lc *LocalClient) NodeGroups(ctx context.Context) ([]ipn.NodeGroup, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/node-groups", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var gs []ipn.NodeGroup
+	if err := json.Unmarshal(res, &gs); err != nil {
+		return nil, fmt.Errorf("invalid node-groups json: %w", err)
+	}
+	return gs, nil
+}
+
+// SetNodeGroup defines the node group g, replacing any group of the
+// same name.
+func (lc *LocalClient) SetNodeGroup(ctx context.Context, g ipn.NodeGroup) error {
+	j, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	_, err = lc.send(ctx, "POST", "/localapi/v0/node-groups", http.StatusNoContent, bytes.NewReader(j))
+	return err
+}
+
+// DeleteNodeGroup deletes the node group name.
+func (lc *LocalClient) DeleteNodeGroup(ctx context.Context, name string) error {
+	_, err := lc.send(ctx, "DELETE", "/localapi/v0/node-groups?name="+url.QueryEscape(name), http.StatusNoContent, nil)
+	return err
+}
+
+// NodeGroupMembers returns the current members of the node group name.
+func (lc *LocalClient) NodeGroupMembers(ctx context.Context, name string) (*ipnstate.NodeGroupMembers, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/node-group-members?name="+url.QueryEscape(name), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	ms := new(ipnstate.NodeGroupMembers)
+	if err := json.Unmarshal(res, ms); err != nil {
+		return nil, fmt.Errorf("invalid node-group-members json: %w", err)
+	}
+	return ms, nil
+}
+
+// Stamp writes a marker, with an optional note, to tailscaled's logs and
+// bumps a client metric, returning the marker. If upload is false, the
+// marker is only written to tailscaled's local log and not uploaded.
+func (lc *LocalClient) Stamp(ctx context.Context, note string, upload bool) (string, error) {
+	v := url.Values{}
+	v.Set("note", note)
+	v.Set("upload", fmt.Sprint(upload))
+	body, err := lc.send(ctx, "POST", "/localapi/v0/stamp?"+v.Encode(), 200, nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
 // DebugAction invokes a debug action, such as "rebind" or "restun".
 // These are development tools and subject to change or removal over time.
 func (lc *LocalClient) DebugAction(ctx context.Context, action string) error {
@@ -286,6 +538,46 @@ func (lc *LocalClient) DebugAction(ctx context.Context, action string) error {
 	return nil
 }
 
+// DebugSetCPU restricts tailscaled to the CPUs in affinity (a CPU list
+// such as "0-3,6"), if non-empty, and sets its GOMAXPROCS to maxProcs,
+// if positive. CPU affinity is only supported on Linux.
+func (lc *LocalClient) DebugSetCPU(ctx context.Context, affinity string, maxProcs int) error {
+	v := url.Values{"action": {"cpu"}}
+	if affinity != "" {
+		v.Set("affinity", affinity)
+	}
+	if maxProcs > 0 {
+		v.Set("gomaxprocs", strconv.Itoa(maxProcs))
+	}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug?"+v.Encode(), 200, nil)
+	if err != nil {
+		return fmt.Errorf("error %w: %s", err, body)
+	}
+	return nil
+}
+
+// DebugImpair makes tailscaled drop the fraction loss of packets to and
+// from peer, or all peers if peer is the zero IP, and delay the rest by
+// latency plus up to jitter, with random choices seeded by seed. With
+// zero loss, latency and jitter, it removes the impairment.
+func (lc *LocalClient) DebugImpair(ctx context.Context, peer netaddr.IP, loss float64, latency, jitter time.Duration, seed int64) error {
+	v := url.Values{
+		"action":  {"impair"},
+		"loss":    {strconv.FormatFloat(loss, 'g', -1, 64)},
+		"latency": {latency.String()},
+		"jitter":  {jitter.String()},
+		"seed":    {strconv.FormatInt(seed, 10)},
+	}
+	if !peer.IsZero() {
+		v.Set("peer", peer.String())
+	}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug?"+v.Encode(), 200, nil)
+	if err != nil {
+		return fmt.Errorf("error %w: %s", err, body)
+	}
+	return nil
+}
+
 // Status returns the Tailscale daemon's status.
 func Status(ctx context.Context) (*ipnstate.Status, error) {
 	return defaultLocalClient.Status(ctx)
@@ -442,6 +734,39 @@ func (lc *LocalClient) CheckPrefs(ctx context.Context, p *ipn.Prefs) error {
 	return err
 }
 
+// SetPresignedNodeKey makes tailscaled log in with nodeKey, and send
+// sig, its serialized tka.NodeKeySignature, to control with it, the next
+// time it starts logging in. It fails if tailscaled is logged in.
+func (lc *LocalClient) SetPresignedNodeKey(ctx context.Context, nodeKey key.NodePrivate, sig []byte) error {
+	j, err := json.Marshal(apitype.PresignedNodeKey{NodeKey: nodeKey, Signature: sig})
+	if err != nil {
+		return err
+	}
+	_, err = lc.send(ctx, "POST", "/localapi/v0/set-presigned-node-key", http.StatusNoContent, bytes.NewReader(j))
+	return err
+}
+
+// ExportKeys returns tailscaled's machine and node keys as a key.Backup
+// sealed with passphrase, which can be restored with ImportKeys.
+func (lc *LocalClient) ExportKeys(ctx context.Context, passphrase string) ([]byte, error) {
+	j, err := json.Marshal(apitype.KeyBackupRequest{Passphrase: passphrase})
+	if err != nil {
+		return nil, err
+	}
+	return lc.send(ctx, "POST", "/localapi/v0/export-keys", http.StatusOK, bytes.NewReader(j))
+}
+
+// ImportKeys replaces tailscaled's machine and node keys with those in
+// sealed, as returned by ExportKeys. It fails if tailscaled is logged in.
+func (lc *LocalClient) ImportKeys(ctx context.Context, sealed []byte, passphrase string) error {
+	j, err := json.Marshal(apitype.KeyBackupRequest{Passphrase: passphrase, Sealed: sealed})
+	if err != nil {
+		return err
+	}
+	_, err = lc.send(ctx, "POST", "/localapi/v0/import-keys", http.StatusNoContent, bytes.NewReader(j))
+	return err
+}
+
 func (lc *LocalClient) GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
 	body, err := lc.get200(ctx, "/localapi/v0/prefs")
 	if err != nil {
@@ -470,6 +795,26 @@ func (lc *LocalClient) EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn
 	return &p, nil
 }
 
+// EditPrefsTransaction applies the edits in tx all-or-nothing, returning
+// the resulting prefs. If the combined edits are invalid, nothing is
+// applied and the error is an *ipn.PrefsValidationError describing each
+// problem.
+func (lc *LocalClient) EditPrefsTransaction(ctx context.Context, tx *ipn.PrefsTransaction) (*ipn.Prefs, error) {
+	txj, err := json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/prefs-transaction", http.StatusOK, bytes.NewReader(txj))
+	if err != nil {
+		return nil, err
+	}
+	var p ipn.Prefs
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid prefs JSON: %w", err)
+	}
+	return &p, nil
+}
+
 func (lc *LocalClient) Logout(ctx context.Context) error {
 	_, err := lc.send(ctx, "POST", "/localapi/v0/logout", http.StatusNoContent, nil)
 	return err
@@ -565,6 +910,46 @@ func (lc *LocalClient) CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, er
 	return &derpMap, nil
 }
 
+// DERPRegions returns the state of tailscaled's connection to each DERP
+// region.
+func (lc *LocalClient) DERPRegions(ctx context.Context) ([]*ipnstate.DERPRegionStatus, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/derp-regions", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var regions []*ipnstate.DERPRegionStatus
+	if err := json.Unmarshal(res, &regions); err != nil {
+		return nil, fmt.Errorf("invalid derp regions json: %w", err)
+	}
+	return regions, nil
+}
+
+// DERPHealth returns the latency and availability history tailscaled
+// has kept for each DERP region.
+func (lc *LocalClient) DERPHealth(ctx context.Context) ([]ipnstate.DERPRegionHealth, error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/derp-health", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var regions []ipnstate.DERPRegionHealth
+	if err := json.Unmarshal(res, &regions); err != nil {
+		return nil, fmt.Errorf("invalid derp health json: %w", err)
+	}
+	return regions, nil
+}
+
+// DebugDERPSwitch forces tailscaled's home DERP region to regionID, or
+// returns it to automatic selection if regionID is zero. It's a
+// development tool for exercising DERP failover.
+func (lc *LocalClient) DebugDERPSwitch(ctx context.Context, regionID int) error {
+	v := url.Values{"action": {"derp-switch"}, "region": {strconv.Itoa(regionID)}}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug?"+v.Encode(), 200, nil)
+	if err != nil {
+		return fmt.Errorf("error %w: %s", err, body)
+	}
+	return nil
+}
+
 // CertPair returns a cert and private key for the provided DNS domain.
 //
 // It returns a cached certificate from disk if it's still valid.
@@ -586,6 +971,12 @@ func (lc *LocalClient) CertPair(ctx context.Context, domain string) (certPEM, ke
 	}
 	// with ?type=pair, the response PEM is first the one private
 	// key PEM block, then the cert PEM blocks.
+	return splitKeyPairPEM(res)
+}
+
+// splitKeyPairPEM splits res, one private key PEM block followed by
+// cert PEM blocks, into the certs and the key.
+func splitKeyPairPEM(res []byte) (certPEM, keyPEM []byte, err error) {
 	i := mem.Index(mem.B(res), mem.S("--\n--"))
 	if i == -1 {
 		return nil, nil, fmt.Errorf("unexpected output: no delimiter")
@@ -663,6 +1054,126 @@ func (lc *LocalClient) ExpandSNIName(ctx context.Context, name string) (fqdn str
 	return "", false
 }
 
+// NodeCertPair returns this node's short-lived identity cert chain
+// and private key, for mutual TLS with other tailnet services. The
+// certs are issued by the tailnet's private CA (see NodeCAPool), not a
+// public one, and are renewed well before they expire, so callers
+// should fetch the pair again for each new TLS connection or use
+// GetNodeCertificate and GetNodeClientCertificate.
+func (lc *LocalClient) NodeCertPair(ctx context.Context) (certPEM, keyPEM []byte, err error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/node-cert", 200, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return splitKeyPairPEM(res)
+}
+
+func (lc *LocalClient) nodeCertificate() (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	certPEM, keyPEM, err := lc.NodeCertPair(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// GetNodeCertificate returns this node's identity cert. It's the right
+// signature to use as the value of tls.Config.GetCertificate for a
+// tailnet service doing mutual TLS.
+func (lc *LocalClient) GetNodeCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return lc.nodeCertificate()
+}
+
+// GetNodeClientCertificate returns this node's identity cert. It's the
+// right signature to use as the value of tls.Config.GetClientCertificate
+// for a client of a tailnet service doing mutual TLS.
+func (lc *LocalClient) GetNodeClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return lc.nodeCertificate()
+}
+
+// NodeCARoots returns the PEM-encoded roots of the tailnet's private CA
+// for node identity certs. The control server rotates the CA
+// periodically, so callers should not cache the result for long.
+func (lc *LocalClient) NodeCARoots(ctx context.Context) ([]byte, error) {
+	return lc.get200(ctx, "/localapi/v0/node-ca")
+}
+
+// NodeCAPool returns a cert pool of the tailnet's private CA roots for
+// node identity certs, for use as tls.Config.ClientCAs or RootCAs.
+func (lc *LocalClient) NodeCAPool(ctx context.Context) (*x509.CertPool, error) {
+	roots, err := lc.NodeCARoots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(roots) {
+		return nil, errors.New("no node CA roots")
+	}
+	return pool, nil
+}
+
+// VerifyNodeCert verifies that the peer of a TLS connection from or to
+// remoteAddr (an "ip:port") presented a valid node identity cert for
+// the tailnet node at that address, and returns who that node is.
+//
+// It can be used from tls.Config.VerifyConnection, with
+// InsecureSkipVerify on the client side or ClientAuth set to
+// tls.RequireAnyClientCert on the server side.
+func (lc *LocalClient) VerifyNodeCert(ctx context.Context, cs tls.ConnectionState, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, errors.New("no peer certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	roots, err := lc.NodeCAPool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inter := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, err
+	}
+	ipp, err := netaddr.ParseIPPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	ipMatch := false
+	for _, ip := range leaf.IPAddresses {
+		if nip, ok := netaddr.FromStdIP(ip); ok && nip == ipp.IP() {
+			ipMatch = true
+			break
+		}
+	}
+	if !ipMatch {
+		return nil, fmt.Errorf("node cert is not for %v", ipp.IP())
+	}
+	who, err := lc.WhoIs(ctx, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if who.Node == nil {
+		return nil, fmt.Errorf("no node for %v", remoteAddr)
+	}
+	wantURI := tailcfg.NodeCertURIPrefix + string(who.Node.StableID)
+	for _, u := range leaf.URIs {
+		if u.String() == wantURI {
+			return who, nil
+		}
+	}
+	return nil, fmt.Errorf("node cert is not for node %v", who.Node.StableID)
+}
+
 // Ping sends a ping of the provided type to the provided IP and waits
 // for its response.
 func (lc *LocalClient) Ping(ctx context.Context, ip netaddr.IP, pingtype tailcfg.PingType) (*ipnstate.PingResult, error) {
@@ -31,6 +31,7 @@
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/logpolicy"
 	"tailscale.com/metrics"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/stun"
 	"tailscale.com/tsweb"
 	"tailscale.com/types/key"
@@ -55,6 +56,14 @@
 
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
+
+	clientRateLimit = flag.Int("client-rate-limit", 0, "if non-zero, per-client rate limit in bytes per second of packets sent through this server; excess packets are dropped")
+	clientRateBurst = flag.Int("client-rate-burst", 0, "per-client burst size in bytes when --client-rate-limit is set; values smaller than the maximum packet size are raised to it")
+
+	lowBandwidthRateLimit = flag.Int("low-bandwidth-rate-limit", 0, "if non-zero, rate in bytes per second at which packets are relayed to each client that says it's on a low bandwidth link; excess packets are queued")
+	lowBandwidthRateBurst = flag.Int("low-bandwidth-rate-burst", 0, "burst size in bytes when --low-bandwidth-rate-limit is set; values smaller than the maximum packet size are raised to it")
+
+	minClientVersion = flag.String("min-client-version", "", "if non-empty, the oldest Tailscale version (such as \"1.30.0\") of clients to accept; older clients are told to upgrade and disconnected")
 )
 
 var (
@@ -158,6 +167,18 @@ func main() {
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
 	s.SetVerifyClient(*verifyClients)
+	if *clientRateLimit != 0 {
+		s.SetClientRateLimit(*clientRateLimit, *clientRateBurst)
+		log.Printf("DERP per-client rate limit: %d bytes/s", *clientRateLimit)
+	}
+	if *lowBandwidthRateLimit != 0 {
+		s.SetLowBandwidthRateLimit(*lowBandwidthRateLimit, *lowBandwidthRateBurst)
+		log.Printf("DERP low bandwidth client rate limit: %d bytes/s", *lowBandwidthRateLimit)
+	}
+	if *minClientVersion != "" {
+		s.SetMinClientVersion(*minClientVersion)
+		log.Printf("DERP minimum client version: %s", *minClientVersion)
+	}
 
 	if *meshPSKFile != "" {
 		b, err := ioutil.ReadFile(*meshPSKFile)
@@ -211,6 +232,8 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
+	debug.Handle("clients", "Per-client traffic and rate limiting stats (JSON)", http.HandlerFunc(s.ServeDebugClients))
+	debug.Handle("client-versions", "Client version census (JSON)", http.HandlerFunc(s.ServeDebugClientVersions))
 
 	if *runSTUN {
 		go serveSTUN(listenHost, *stunPort)
@@ -333,14 +356,22 @@ func serveSTUN(host string, port int) {
 }
 
 func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
+	// Where possible, tell clients the TOS byte their requests
+	// arrived with, so they can tell whether the path preserves DSCP
+	// markings.
+	if err := dscp.EnableReceiveTOS(pc); err != nil && dscp.Supported() {
+		log.Printf("STUN: not reporting TOS: %v", err)
+	}
 	var buf [64 << 10]byte
 	var (
-		n   int
-		ua  *net.UDPAddr
-		err error
+		n       int
+		ua      *net.UDPAddr
+		tos     byte
+		haveTOS bool
+		err     error
 	)
 	for {
-		n, ua, err = pc.ReadFromUDP(buf[:])
+		n, ua, tos, haveTOS, err = dscp.ReadFrom(pc, buf[:])
 		if err != nil {
 			if ctx.Err() != nil {
 				return
@@ -365,7 +396,12 @@ func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
 		} else {
 			stunIPv6.Add(1)
 		}
-		res := stun.Response(txid, ua.IP, uint16(ua.Port))
+		var res []byte
+		if haveTOS {
+			res = stun.ResponseWithReceivedTOS(txid, ua.IP, uint16(ua.Port), tos)
+		} else {
+			res = stun.Response(txid, ua.IP, uint16(ua.Port))
+		}
 		_, err = pc.WriteTo(res, ua)
 		if err != nil {
 			stunWriteError.Add(1)
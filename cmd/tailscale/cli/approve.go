@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
+)
+
+var approveCmd = &ffcli.Command{
+	Name:       "approve",
+	Exec:       runApprove,
+	ShortHelp:  "Approve a sensitive settings change on another device",
+	ShortUsage: "approve <hostname-or-IP> [id]",
+	LongHelp: strings.TrimSpace(`
+On a device that the tailnet policy marks as needing approval, changes
+to sensitive settings, such as turning off shields-up or changing the
+exit node, aren't made until another device that the policy allows to
+approve them does so.
+
+'tailscale approve <device>' lists the changes waiting for approval on
+that device, and 'tailscale approve <device> <id>' approves one.
+`),
+}
+
+func runApprove(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: approve <hostname-or-IP> [id]")
+	}
+	ipStr, self, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if self {
+		return errors.New("changes must be approved from another device")
+	}
+	ip, err := netaddr.ParseIP(ipStr)
+	if err != nil {
+		return err
+	}
+	pas, err := localClient.PrefApprovals(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		// Approve the change as listed here, so it can't be swapped
+		// for another between showing it and approving it.
+		for _, pa := range pas {
+			if pa.ID != args[1] {
+				continue
+			}
+			if err := localClient.ApprovePrefChange(ctx, ip, pa.ID, pa.Digest); err != nil {
+				return err
+			}
+			printf("Approved change %s on %s: %s.\n", pa.ID, args[0], pa.Summary)
+			return nil
+		}
+		return fmt.Errorf("no change %s waiting for approval on %s", args[1], args[0])
+	}
+	if len(pas) == 0 {
+		printf("No changes waiting for approval on %s.\n", args[0])
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "ID\tChange\tExpires\n")
+	for _, pa := range pas {
+		fmt.Fprintf(w, "%s\t%s\tin %v\n", pa.ID, pa.Summary, time.Until(pa.Expires).Round(time.Second))
+	}
+	return nil
+}
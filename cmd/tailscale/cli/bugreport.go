@@ -7,6 +7,9 @@
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 )
@@ -16,6 +19,19 @@
 	Exec:       runBugReport,
 	ShortHelp:  "Print a shareable identifier to help diagnose issues",
 	ShortUsage: "bugreport [note]",
+	LongHelp: `Print a shareable identifier to help diagnose issues.
+
+Recent crashes of tailscaled, which are kept on this machine, are listed
+on stderr after the identifier.`,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("bugreport")
+		fs.BoolVar(&bugReportArgs.showCrashes, "show-crashes", false, "print the full reports of recent crashes, instead of a summary")
+		return fs
+	})(),
+}
+
+var bugReportArgs struct {
+	showCrashes bool
 }
 
 func runBugReport(ctx context.Context, args []string) error {
@@ -32,5 +48,21 @@ func runBugReport(ctx context.Context, args []string) error {
 		return err
 	}
 	outln(logMarker)
+
+	crashes, err := localClient.CrashReports(ctx)
+	if err != nil {
+		// Older tailscaled, or no access; the marker is what matters.
+		return nil
+	}
+	if len(crashes) == 0 {
+		return nil
+	}
+	fmt.Fprintf(Stderr, "\nRecent tailscaled crashes:\n")
+	for _, c := range crashes {
+		fmt.Fprintf(Stderr, "  %s  %s  v%s  %s\n", c.Time.Local().Format(time.RFC3339), c.ID, c.Version, c.Reason)
+		if bugReportArgs.showCrashes {
+			fmt.Fprintf(Stderr, "\n%s\n", c.Stack)
+		}
+	}
 	return nil
 }
@@ -8,6 +8,7 @@
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -25,12 +26,14 @@
 	Name:       "cert",
 	Exec:       runCert,
 	ShortHelp:  "get TLS certs",
-	ShortUsage: "cert [flags] <domain>",
+	ShortUsage: "cert [flags] <domain | --node>",
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("cert")
 		fs.StringVar(&certArgs.certFile, "cert-file", "", "output cert file or \"-\" for stdout; defaults to DOMAIN.crt if --cert-file and --key-file are both unset")
 		fs.StringVar(&certArgs.keyFile, "key-file", "", "output cert file or \"-\" for stdout; defaults to DOMAIN.key if --cert-file and --key-file are both unset")
 		fs.BoolVar(&certArgs.serve, "serve-demo", false, "if true, serve on port :443 using the cert as a demo, instead of writing out the files to disk")
+		fs.BoolVar(&certArgs.node, "node", false, "get a short-lived node identity cert from your tailnet's private CA, for mutual TLS between tailnet services, instead of a public cert for a domain; defaults to node.crt and node.key")
+		fs.StringVar(&certArgs.caFile, "ca-file", "", "with --node, also write the tailnet's private CA roots to this file or \"-\" for stdout")
 		return fs
 	})(),
 }
@@ -39,6 +42,8 @@
 	certFile string
 	keyFile  string
 	serve    bool
+	node     bool
+	caFile   string
 }
 
 func runCert(ctx context.Context, args []string) error {
@@ -61,7 +66,16 @@ func runCert(ctx context.Context, args []string) error {
 		return s.ListenAndServeTLS("", "")
 	}
 
-	if len(args) != 1 {
+	var domain string
+	switch {
+	case certArgs.node:
+		if len(args) != 0 {
+			return errors.New("Usage: tailscale cert --node [flags]")
+		}
+		domain = "node" // for the default file names
+	case certArgs.caFile != "":
+		return errors.New("--ca-file requires --node")
+	case len(args) != 1:
 		var hint bytes.Buffer
 		if st, err := localClient.Status(ctx); err == nil {
 			if st.BackendState != ipn.Running.String() {
@@ -75,13 +89,14 @@ func runCert(ctx context.Context, args []string) error {
 			}
 		}
 		return fmt.Errorf("Usage: tailscale cert [flags] <domain>%s", hint.Bytes())
+	default:
+		domain = args[0]
 	}
-	domain := args[0]
 
 	printf := func(format string, a ...any) {
 		printf(format, a...)
 	}
-	if certArgs.certFile == "-" || certArgs.keyFile == "-" {
+	if certArgs.certFile == "-" || certArgs.keyFile == "-" || certArgs.caFile == "-" {
 		printf = log.Printf
 		log.SetFlags(0)
 	}
@@ -89,7 +104,13 @@ func runCert(ctx context.Context, args []string) error {
 		certArgs.certFile = domain + ".crt"
 		certArgs.keyFile = domain + ".key"
 	}
-	certPEM, keyPEM, err := localClient.CertPair(ctx, domain)
+	var certPEM, keyPEM []byte
+	var err error
+	if certArgs.node {
+		certPEM, keyPEM, err = localClient.NodeCertPair(ctx)
+	} else {
+		certPEM, keyPEM, err = localClient.CertPair(ctx, domain)
+	}
 	if err != nil {
 		return err
 	}
@@ -133,6 +154,24 @@ func runCert(ctx context.Context, args []string) error {
 			}
 		}
 	}
+	if certArgs.caFile != "" {
+		roots, err := localClient.NodeCARoots(ctx)
+		if err != nil {
+			return err
+		}
+		caChanged, err := writeIfChanged(certArgs.caFile, roots, 0644)
+		if err != nil {
+			return err
+		}
+		if certArgs.caFile != "-" {
+			macWarn()
+			if caChanged {
+				printf("Wrote node CA roots to %v\n", certArgs.caFile)
+			} else {
+				printf("Node CA roots unchanged at %v\n", certArgs.caFile)
+			}
+		}
+	}
 	return nil
 }
 
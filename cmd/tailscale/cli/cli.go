@@ -158,6 +158,7 @@ func Run(args []string) (err error) {
 		Subcommands: []*ffcli.Command{
 			upCmd,
 			downCmd,
+			setCmd,
 			logoutCmd,
 			netcheckCmd,
 			ipCmd,
@@ -169,7 +170,18 @@ func Run(args []string) (err error) {
 			webCmd,
 			fileCmd,
 			bugReportCmd,
+			feedbackCmd,
+			stampCmd,
 			certCmd,
+			dnsCmd,
+			diagCmd,
+			topCmd,
+			lockCmd,
+			approveCmd,
+			wakeCmd,
+			keysCmd,
+			peersCmd,
+			groupCmd,
 		},
 		FlagSet:   rootfs,
 		Exec:      func(context.Context, []string) error { return flag.ErrHelp },
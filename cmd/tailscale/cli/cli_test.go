@@ -9,9 +9,11 @@
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/google/go-cmp/cmp"
@@ -19,8 +21,10 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tstest"
+	"tailscale.com/types/key"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
+	"tailscale.com/types/views"
 	"tailscale.com/version/distro"
 )
 
@@ -762,6 +766,12 @@ func TestPrefFlagMapping(t *testing.T) {
 		case "NotepadURLs":
 			// TODO(bradfitz): https://github.com/tailscale/tailscale/issues/1830
 			continue
+		case "StaticDNSRecords":
+			// Managed by "tailscale dns" and kept by applyImplicitPrefs.
+			continue
+		case "LogLevels":
+			// Managed by "tailscale debug loglevel" and kept by applyImplicitPrefs.
+			continue
 		}
 		t.Errorf("unexpected new ipn.Pref field %q is not handled by up.go (see addPrefFlagMapping and checkForAccidentalSettingReverts)", prefName)
 	}
@@ -844,12 +854,17 @@ func TestUpdatePrefs(t *testing.T) {
 				ExitNodeIDSet:             true,
 				ExitNodeIPSet:             true,
 				HostnameSet:               true,
+				LogoutAtSet:               true,
 				NetfilterModeSet:          true,
 				NoSNATSet:                 true,
+				NodeKeyRotationSet:        true,
 				OperatorUserSet:           true,
 				RouteAllSet:               true,
 				RunSSHSet:                 true,
 				ShieldsUpSet:              true,
+				TelemetrySet:              true,
+				TrustedNetworksSet:        true,
+				TrustedNetworksIdleSet:    true,
 				WantRunningSet:            true,
 			},
 		},
@@ -913,6 +928,48 @@ func TestUpdatePrefs(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:  "duration_kept",
+			flags: []string{"--hostname=foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       "https://login.tailscale.com",
+				CorpDNS:          true,
+				AllowSingleHosts: true,
+				NetfilterMode:    preftype.NetfilterOn,
+				LogoutAt:         timePtr(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)),
+			},
+			env: upCheckEnv{backendState: "Running"},
+			wantJustEditMP: &ipn.MaskedPrefs{
+				HostnameSet:    true,
+				WantRunningSet: true,
+			},
+			checkUpdatePrefsMutations: func(t *testing.T, prefs *ipn.Prefs) {
+				if want := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC); prefs.LogoutAt == nil || !prefs.LogoutAt.Equal(want) {
+					t.Errorf("LogoutAt = %v; want %v", prefs.LogoutAt, want)
+				}
+			},
+		},
+		{
+			name:  "duration_cleared",
+			flags: []string{"--duration=0"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       "https://login.tailscale.com",
+				CorpDNS:          true,
+				AllowSingleHosts: true,
+				NetfilterMode:    preftype.NetfilterOn,
+				LogoutAt:         timePtr(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)),
+			},
+			env: upCheckEnv{backendState: "Running"},
+			wantJustEditMP: &ipn.MaskedPrefs{
+				LogoutAtSet:    true,
+				WantRunningSet: true,
+			},
+			checkUpdatePrefsMutations: func(t *testing.T, prefs *ipn.Prefs) {
+				if prefs.LogoutAt != nil {
+					t.Errorf("LogoutAt = %v; want nil", prefs.LogoutAt)
+				}
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -985,3 +1042,223 @@ func TestCleanUpArgs(t *testing.T) {
 		c.Assert(got, qt.DeepEquals, tt.want)
 	}
 }
+
+func TestParseMyAddrTXT(t *testing.T) {
+	tests := []struct {
+		in         []string
+		wantIP     string
+		wantSubnet string
+	}{
+		{in: nil},
+		{in: []string{"garbage"}},
+		{in: []string{"74.125.18.1"}, wantIP: "74.125.18.1"},
+		{in: []string{"edns0-client-subnet 203.0.113.0/24", "74.125.18.1"}, wantIP: "74.125.18.1", wantSubnet: "203.0.113.0/24"},
+		{in: []string{"2404:6800:4003::1"}, wantIP: "2404:6800:4003::1"},
+	}
+	for _, tt := range tests {
+		ip, subnet := parseMyAddrTXT(tt.in)
+		var gotIP, gotSubnet string
+		if ip.IsValid() {
+			gotIP = ip.String()
+		}
+		if subnet.IsValid() {
+			gotSubnet = subnet.String()
+		}
+		if gotIP != tt.wantIP || gotSubnet != tt.wantSubnet {
+			t.Errorf("parseMyAddrTXT(%q) = %q, %q; want %q, %q", tt.in, gotIP, gotSubnet, tt.wantIP, tt.wantSubnet)
+		}
+	}
+}
+
+func TestFormatTopBytes(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want string
+	}{
+		{0, "0B"},
+		{999, "999B"},
+		{1000, "1.0kB"},
+		{1500000, "1.5MB"},
+		{2e15, "2.0PB"},
+		{3e18, "3000.0PB"},
+	}
+	for _, tt := range tests {
+		if got := formatTopBytes(tt.in); got != tt.want {
+			t.Errorf("formatTopBytes(%v) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCalcSetPrefs(t *testing.T) {
+	curPrefs := &ipn.Prefs{
+		ControlURL:      ipn.DefaultControlURL,
+		WantRunning:     true,
+		CorpDNS:         true,
+		Hostname:        "foo",
+		ShieldsUp:       true,
+		AdvertiseRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")},
+		ExitNodeIP:      netaddr.MustParseIP("100.64.1.1"),
+	}
+	exitRoutes := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("0.0.0.0/0"),
+		netaddr.MustParseIPPrefix("::/0"),
+		netaddr.MustParseIPPrefix("10.0.0.0/8"),
+	}
+	tests := []struct {
+		name    string
+		flags   []string
+		want    *ipn.MaskedPrefs
+		wantErr string
+	}{
+		{
+			name:  "one_setting",
+			flags: []string{"--shields-up=false"},
+			want: &ipn.MaskedPrefs{
+				Prefs:        ipn.Prefs{ShieldsUp: false},
+				ShieldsUpSet: true,
+			},
+		},
+		{
+			name:  "reset",
+			flags: []string{"--reset=hostname,exit-node", "--accept-dns=false"},
+			want: &ipn.MaskedPrefs{
+				Prefs:         ipn.Prefs{Hostname: "", CorpDNS: false},
+				HostnameSet:   true,
+				ExitNodeIPSet: true,
+				ExitNodeIDSet: true,
+				CorpDNSSet:    true,
+			},
+		},
+		{
+			name:  "exit_node_keeps_routes",
+			flags: []string{"--advertise-exit-node"},
+			want: &ipn.MaskedPrefs{
+				Prefs:              ipn.Prefs{AdvertiseRoutes: exitRoutes},
+				AdvertiseRoutesSet: true,
+			},
+		},
+		{
+			name:    "set_and_reset",
+			flags:   []string{"--hostname=bar", "--reset=hostname"},
+			wantErr: `--reset: can't both set and reset "hostname"`,
+		},
+		{
+			name:    "reset_unknown",
+			flags:   []string{"--reset=json"},
+			wantErr: `--reset: unknown setting "json"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args setArgsT
+			fs := newSetFlagSet("linux", &args)
+			if err := fs.Parse(tt.flags); err != nil {
+				t.Fatal(err)
+			}
+			mp, err := calcSetPrefs(fs, &args, curPrefs, new(ipnstate.Status))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only compare the prefs being changed.
+			got := &ipn.MaskedPrefs{}
+			gotV, mpV := reflect.ValueOf(got).Elem(), reflect.ValueOf(mp).Elem()
+			for i := 0; i < mpV.NumField(); i++ {
+				name := mpV.Type().Field(i).Name
+				if name == "Prefs" || !mpV.Field(i).Bool() {
+					continue
+				}
+				gotV.Field(i).SetBool(true)
+				pref := strings.TrimSuffix(name, "Set")
+				gotV.FieldByName("Prefs").FieldByName(pref).Set(mpV.FieldByName("Prefs").FieldByName(pref))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v\nwant %v", got.Pretty(), tt.want.Pretty())
+			}
+		})
+	}
+}
+
+func TestPeersExport(t *testing.T) {
+	tags := func(tt ...string) *views.Slice[string] {
+		v := views.SliceOf(tt)
+		return &v
+	}
+	st := &ipnstate.Status{
+		MagicDNSSuffix: "example.ts.net",
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "web.example.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2"), netaddr.MustParseIP("fd7a:115c:a1e0::2")},
+				Tags:         tags("tag:prod", "tag:web-server"),
+				Online:       true,
+			},
+			key.NewNode().Public(): {
+				DNSName:      "db.example.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.3")},
+				Tags:         tags("tag:prod"),
+			},
+			key.NewNode().Public(): {
+				DNSName:      "laptop.example.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.4")},
+				Online:       true,
+			},
+			key.NewNode().Public(): {
+				DNSName:      "shared.other.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.5")},
+				ShareeNode:   true,
+			},
+		},
+	}
+	render := func(f func(io.Writer, []exportPeer), peers []exportPeer) string {
+		var buf bytes.Buffer
+		f(&buf, peers)
+		return strings.TrimPrefix(buf.String(), peersExportHeader)
+	}
+
+	all := exportPeers(st, nil, false)
+	if got, want := render(renderPeersHosts, all), `100.64.0.3	db.example.ts.net db
+100.64.0.4	laptop.example.ts.net laptop
+100.64.0.2	web.example.ts.net web
+fd7a:115c:a1e0::2	web.example.ts.net web
+`; got != want {
+		t.Errorf("hosts:\n%s\nwant:\n%s", got, want)
+	}
+
+	prod := exportPeers(st, []string{"tag:prod"}, false)
+	if got, want := render(renderPeersSSH, prod), `
+Host db
+	HostName 100.64.0.3
+
+Host web
+	HostName 100.64.0.2
+`; got != want {
+		t.Errorf("ssh:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := render(renderPeersAnsible, prod), `
+[tailscale]
+db ansible_host=100.64.0.3
+web ansible_host=100.64.0.2
+
+[tag_prod]
+db
+web
+
+[tag_web_server]
+web
+`; got != want {
+		t.Errorf("ansible:\n%s\nwant:\n%s", got, want)
+	}
+
+	online := exportPeers(st, []string{"tag:prod"}, true)
+	if len(online) != 1 || online[0].name != "web" {
+		t.Errorf("online prod peers = %v; want just web", online)
+	}
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
@@ -19,8 +19,10 @@
 	"net/http"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -28,6 +30,7 @@
 	"tailscale.com/control/controlhttp"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
@@ -53,6 +56,43 @@
 			Exec:      runDERPMap,
 			ShortHelp: "print DERP map",
 		},
+		{
+			Name:      "derp",
+			Exec:      runDebugDERP,
+			ShortHelp: "print the state of each DERP region's connection",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("derp")
+				fs.BoolVar(&debugDERPArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+			Subcommands: []*ffcli.Command{
+				{
+					Name:       "switch",
+					Exec:       runDebugDERPSwitch,
+					ShortUsage: "switch <region id or code | auto>",
+					ShortHelp:  "force the home DERP region, to exercise failover",
+					LongHelp:   `Makes the given region tailscaled's home DERP region, regardless of latency, until "switch auto" or tailscaled restarts.`,
+				},
+			},
+		},
+		{
+			Name:      "derp-health",
+			Exec:      runDebugDERPHealth,
+			ShortHelp: "print the latency and availability history of each DERP region",
+			LongHelp: strings.TrimSpace(`
+Prints how often each DERP region answered netcheck's probes, and its
+mean latency, over the last 3 hours, 24 hours and 7 days, and whether
+the last 3 hours are worse or better than before.
+
+If most regions got worse at once, the problem is more likely this
+device's network or ISP; if only a few did, those regions.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("derp-health")
+				fs.BoolVar(&debugDERPHealthArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
 		{
 			Name:      "daemon-goroutines",
 			Exec:      runDaemonGoroutines,
@@ -98,6 +138,45 @@
 			Exec:      localAPIAction("rebind"),
 			ShortHelp: "force a magicsock rebind",
 		},
+		{
+			Name:      "cpu",
+			Exec:      runDebugCPU,
+			ShortHelp: "tune how tailscaled schedules packet encryption",
+			LongHelp:  "Sets tailscaled's CPU affinity (Linux only) and GOMAXPROCS until it restarts. The number of WireGuard crypto workers is fixed at startup; to size it, start tailscaled with $TS_CPU_AFFINITY instead. See /debug/magicsock for the current values.",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("cpu")
+				fs.StringVar(&debugCPUArgs.affinity, "affinity", "", "CPUs to restrict tailscaled to, such as \"0-3,6\"")
+				fs.IntVar(&debugCPUArgs.gomaxprocs, "gomaxprocs", 0, "maximum number of CPUs to run Go code on concurrently")
+				return fs
+			})(),
+		},
+		{
+			Name:       "antiflap",
+			Exec:       runDebugAntiflap,
+			ShortUsage: "antiflap [--peer=<hostname-or-IP>] [--loss=<fraction>] [--latency=<duration>] [--jitter=<duration>] [--seed=<n>]",
+			ShortHelp:  "simulate a bad network by dropping and delaying tunnel packets",
+			LongHelp: strings.TrimSpace(`
+'tailscale debug antiflap' makes tailscaled drop and delay the packets it
+tunnels to and from a peer, in both directions, to reproduce problems
+that only happen on lossy or slow networks, as in:
+
+  tailscale debug antiflap --peer=myserver --loss=0.05 --latency=200ms --jitter=50ms
+
+Without --peer, it applies to all peers that don't have their own
+settings. The same --seed drops and delays the same packets, so a
+problem can be reproduced exactly. Run it with no --loss, --latency or
+--jitter to stop. Settings last until tailscaled restarts.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("antiflap")
+				fs.StringVar(&antiflapArgs.peer, "peer", "", "hostname or IP of the peer whose packets to impair; default all peers")
+				fs.Float64Var(&antiflapArgs.loss, "loss", 0, "fraction of packets to drop, from 0 to 1")
+				fs.DurationVar(&antiflapArgs.latency, "latency", 0, "delay to add to each packet")
+				fs.DurationVar(&antiflapArgs.jitter, "jitter", 0, "maximum random extra delay to add to each packet")
+				fs.Int64Var(&antiflapArgs.seed, "seed", 0, "seed for the random drops and delays")
+				return fs
+			})(),
+		},
 		{
 			Name:      "prefs",
 			Exec:      runPrefs,
@@ -123,6 +202,35 @@
 			Exec:      runVia,
 			ShortHelp: "convert between site-specific IPv4 CIDRs and IPv6 'via' routes",
 		},
+		{
+			Name:       "loglevel",
+			Exec:       runLogLevel,
+			ShortUsage: "loglevel [--persist] [component=level ...]",
+			ShortHelp:  "print or set the log levels of tailscaled's components",
+			LongHelp: strings.TrimSpace(`
+With no arguments, 'tailscale debug loglevel' prints the level of each of
+tailscaled's log components. Otherwise it sets the named components'
+levels, one of info, debug or trace, or default for the level the
+component started at, as in 'tailscale debug loglevel magicsock=debug'.
+
+Levels last until tailscaled exits, unless --persist is given.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("loglevel")
+				fs.BoolVar(&logLevelArgs.persist, "persist", false, "save the levels in prefs, to apply them again when tailscaled restarts")
+				return fs
+			})(),
+		},
+		{
+			Name:      "shadow-diffs",
+			Exec:      runShadowDiffs,
+			ShortHelp: "print the recent netmap changes seen by the shadow engine (TS_SHADOW_ENGINE=1)",
+		},
+		{
+			Name:      "shadow-release",
+			Exec:      localAPIAction("shadow-release"),
+			ShortHelp: "apply the netmap held back by the shadow engine (TS_SHADOW_HOLD=1)",
+		},
 		{
 			Name:      "ts2021",
 			Exec:      runTS2021,
@@ -288,6 +396,55 @@ func runDERPMap(ctx context.Context, args []string) error {
 	return nil
 }
 
+var logLevelArgs struct {
+	persist bool
+}
+
+func runLogLevel(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		if logLevelArgs.persist {
+			return errors.New("--persist requires component=level arguments")
+		}
+		levels, err := localClient.LogLevels(ctx)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(levels))
+		for name := range levels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			printf("%s=%s\n", name, levels[name])
+		}
+		return nil
+	}
+	for _, arg := range args {
+		component, level, ok := strings.Cut(arg, "=")
+		if !ok || component == "" || level == "" {
+			return fmt.Errorf("invalid argument %q; want component=level", arg)
+		}
+		if err := localClient.SetLogLevel(ctx, component, level, logLevelArgs.persist); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runShadowDiffs(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	diffs, err := localClient.ShadowDiffs(ctx)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(Stdout)
+	enc.SetIndent("", "\t")
+	enc.Encode(diffs)
+	return nil
+}
+
 func localAPIAction(action string) func(context.Context, []string) error {
 	return func(ctx context.Context, args []string) error {
 		if len(args) > 0 {
@@ -297,6 +454,209 @@ func localAPIAction(action string) func(context.Context, []string) error {
 	}
 }
 
+var antiflapArgs struct {
+	peer    string
+	loss    float64
+	latency time.Duration
+	jitter  time.Duration
+	seed    int64
+}
+
+func runDebugAntiflap(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	var peer netaddr.IP
+	who := "all peers"
+	if antiflapArgs.peer != "" {
+		ipStr, self, err := tailscaleIPFromArg(ctx, antiflapArgs.peer)
+		if err != nil {
+			return err
+		}
+		if self {
+			return errors.New("--peer must be another device")
+		}
+		if peer, err = netaddr.ParseIP(ipStr); err != nil {
+			return err
+		}
+		who = antiflapArgs.peer
+	}
+	a := antiflapArgs
+	if err := localClient.DebugImpair(ctx, peer, a.loss, a.latency, a.jitter, a.seed); err != nil {
+		return err
+	}
+	if a.loss == 0 && a.latency == 0 && a.jitter == 0 {
+		printf("Stopped impairing packets for %s.\n", who)
+		return nil
+	}
+	printf("Impairing packets for %s: loss=%g latency=%v jitter=%v seed=%d\n", who, a.loss, a.latency, a.jitter, a.seed)
+	return nil
+}
+
+var debugCPUArgs struct {
+	affinity   string
+	gomaxprocs int
+}
+
+func runDebugCPU(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	if debugCPUArgs.affinity == "" && debugCPUArgs.gomaxprocs <= 0 {
+		return errors.New("one of --affinity or --gomaxprocs is required")
+	}
+	return localClient.DebugSetCPU(ctx, debugCPUArgs.affinity, debugCPUArgs.gomaxprocs)
+}
+
+var debugDERPArgs struct {
+	json bool
+}
+
+func runDebugDERP(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	regions, err := localClient.DERPRegions(ctx)
+	if err != nil {
+		return err
+	}
+	if debugDERPArgs.json {
+		j, err := json.MarshalIndent(regions, "", "\t")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(w, "REGION\tHOME\tSTATE\tLATENCY\tLAST ERROR\n")
+	for _, r := range regions {
+		home := ""
+		if r.Home {
+			home = "yes"
+			if r.Forced {
+				home = "forced"
+			}
+		}
+		state := "-"
+		switch {
+		case r.Connected:
+			state = "connected " + time.Since(r.ConnectedSince).Round(time.Second).String()
+		case r.Active:
+			state = "connecting"
+		}
+		if r.Problem != "" {
+			state += " (" + r.Problem + ")"
+		}
+		latency := "-"
+		if r.Latency > 0 {
+			latency = r.Latency.Round(time.Millisecond / 10).String()
+		}
+		lastErr := "-"
+		if r.LastError != "" {
+			lastErr = fmt.Sprintf("%s ago: %s", time.Since(r.LastErrorTime).Round(time.Second), r.LastError)
+		}
+		fmt.Fprintf(w, "%d/%s\t%s\t%s\t%s\t%s\n", r.RegionID, r.RegionCode, home, state, latency, lastErr)
+	}
+	return w.Flush()
+}
+
+var debugDERPHealthArgs struct {
+	json bool
+}
+
+func runDebugDERPHealth(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	regions, err := localClient.DERPHealth(ctx)
+	if err != nil {
+		return err
+	}
+	if debugDERPHealthArgs.json {
+		j, err := json.MarshalIndent(regions, "", "\t")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	window := func(w ipnstate.DERPHealthWindow) string {
+		if w.Checks == 0 && w.Latency == 0 {
+			return "-"
+		}
+		avail := "-"
+		if w.Checks > 0 {
+			avail = fmt.Sprintf("%.0f%%", w.Availability*100)
+		}
+		latency := "-"
+		if w.Latency > 0 {
+			latency = w.Latency.Round(time.Millisecond / 10).String()
+		}
+		return avail + " " + latency
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(w, "REGION\tLAST 3H\tLAST 24H\tLAST 7D\tTREND\n")
+	var worse []string
+	var withTrend int
+	for _, r := range regions {
+		trend := r.Trend
+		switch trend {
+		case "":
+			trend = "-"
+		case "worse":
+			worse = append(worse, r.RegionCode)
+		}
+		if r.Trend != "" {
+			withTrend++
+		}
+		fmt.Fprintf(w, "%d/%s\t%s\t%s\t%s\t%s\n", r.RegionID, r.RegionCode, window(r.Recent), window(r.Day), window(r.Week), trend)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	outln()
+	switch {
+	case withTrend == 0:
+		outln("Not enough history yet to show trends; tailscaled needs to have run for over 3 hours.")
+	case len(worse) == 0:
+		outln("No region has got noticeably worse in the last 3 hours.")
+	case len(worse) >= 2 && len(worse)*2 >= withTrend:
+		outln("Most regions got worse in the last 3 hours, which suggests a problem with this device's network or ISP rather than with the DERP relays.")
+	default:
+		printf("Only %s got worse in the last 3 hours, which suggests a problem with those DERP regions (or the route to them) rather than with this device's network.\n", strings.Join(worse, ", "))
+	}
+	return nil
+}
+
+func runDebugDERPSwitch(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: switch <region id or code | auto>")
+	}
+	if args[0] == "auto" {
+		return localClient.DebugDERPSwitch(ctx, 0)
+	}
+	regionID, err := strconv.Atoi(args[0])
+	if err != nil {
+		dm, err := localClient.CurrentDERPMap(ctx)
+		if err != nil {
+			return err
+		}
+		for id, r := range dm.Regions {
+			if strings.EqualFold(r.RegionCode, args[0]) {
+				regionID = id
+				break
+			}
+		}
+		if regionID == 0 {
+			return fmt.Errorf("no DERP region with code %q", args[0])
+		}
+	} else if regionID <= 0 {
+		return fmt.Errorf("invalid region ID %d", regionID)
+	}
+	return localClient.DebugDERPSwitch(ctx, regionID)
+}
+
 func runEnv(ctx context.Context, args []string) error {
 	for _, e := range os.Environ() {
 		outln(e)
@@ -0,0 +1,401 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/stun"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+var diagCmd = &ffcli.Command{
+	Name:       "diag",
+	ShortUsage: "diag <dns-leak|ip-leak|unreachable>",
+	ShortHelp:  "Diagnose connectivity problems",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale diag' commands diagnose connectivity problems.
+
+'tailscale diag unreachable <hostname-or-IP>' explains why a peer, or an
+address behind a subnet router or exit node, may not be reachable: it
+checks the network map, key expiry, routes, ACLs and the state of the
+connection to the peer, and lists what it found, most likely cause first.
+
+The leak tests check this device's use of an exit node.
+
+'tailscale diag ip-leak' asks public STUN servers (Tailscale's DERP
+servers) which IP address they see this device's IPv4 and IPv6 traffic
+come from, and compares it with the public addresses of this device and
+of the exit node.
+
+'tailscale diag dns-leak' checks that the system resolver uses Tailscale's
+resolver (100.100.100.100), which sends queries through the exit node,
+and asks Google's "o-o.myaddr.l.google.com" which resolver and client
+subnet its authoritative servers see the queries from.
+
+Both exit with an error if they find a leak.
+`),
+	Subcommands: []*ffcli.Command{
+		diagDNSLeakCmd,
+		diagIPLeakCmd,
+		diagUnreachableCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("diag subcommand required; run 'tailscale diag -h' for details")
+	},
+}
+
+var diagDNSLeakCmd = &ffcli.Command{
+	Name:       "dns-leak",
+	ShortUsage: "diag dns-leak",
+	ShortHelp:  "Check that DNS queries go through the exit node",
+	Exec:       runDiagDNSLeak,
+}
+
+var diagIPLeakCmd = &ffcli.Command{
+	Name:       "ip-leak",
+	ShortUsage: "diag ip-leak",
+	ShortHelp:  "Check that IPv4 and IPv6 traffic egress through the exit node",
+	Exec:       runDiagIPLeak,
+}
+
+var diagUnreachableCmd = &ffcli.Command{
+	Name:       "unreachable",
+	ShortUsage: "diag unreachable [--json] <hostname-or-IP>",
+	ShortHelp:  "Explain why a peer or address may be unreachable",
+	Exec:       runDiagUnreachable,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("unreachable")
+		fs.BoolVar(&diagUnreachableArgs.json, "json", false, "output in JSON format (WARNING: format subject to change)")
+		return fs
+	})(),
+}
+
+var diagUnreachableArgs struct {
+	json bool
+}
+
+// diagTimeout is how long each probe of the leak tests waits for a reply.
+const diagTimeout = 3 * time.Second
+
+// diagExitNode returns the status and the exit node in use, or an error
+// if none is.
+func diagExitNode(ctx context.Context) (*ipnstate.Status, *ipnstate.PeerStatus, error) {
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return nil, nil, fixTailscaledConnectError(err)
+	}
+	if description, ok := isRunningOrStarting(st); !ok {
+		return nil, nil, errors.New(description)
+	}
+	for _, ps := range st.Peer {
+		if ps.ExitNode {
+			return st, ps, nil
+		}
+	}
+	return nil, nil, errors.New("no exit node in use; see 'tailscale up --exit-node'")
+}
+
+// publicIPs returns the public IPs of the endpoints addrs, as in
+// ipnstate.PeerStatus.Addrs.
+func publicIPs(addrs []string) []netaddr.IP {
+	var ret []netaddr.IP
+	for _, a := range addrs {
+		ipp, err := netaddr.ParseIPPort(a)
+		if err != nil {
+			continue
+		}
+		ip := ipp.IP()
+		if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || tsaddr.IsTailscaleIP(ip) {
+			continue
+		}
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+func containsIP(ips []netaddr.IP, ip netaddr.IP) bool {
+	for _, v := range ips {
+		if v == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func runDiagIPLeak(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	st, exit, err := diagExitNode(ctx)
+	if err != nil {
+		return err
+	}
+	dm, err := localClient.CurrentDERPMap(ctx)
+	if err != nil {
+		return err
+	}
+	selfIPs := publicIPs(st.Self.Addrs)
+	exitIPs := publicIPs(exit.Addrs)
+	printf("exit node %s, public IPs %v\n", dnsOrQuoteHostname(st, exit), exitIPs)
+	printf("this device's public IPs %v\n", selfIPs)
+
+	leaks := 0
+	for _, network := range []string{"udp4", "udp6"} {
+		ip, err := stunEgressIP(ctx, dm, network)
+		switch {
+		case err != nil:
+			printf("%s: no reply, so no leak (%v)\n", network, err)
+		case containsIP(selfIPs, ip):
+			printf("%s: LEAK: egresses from this device's own public IP %v\n", network, ip)
+			leaks++
+		case containsIP(exitIPs, ip):
+			printf("%s: ok, egresses from the exit node's public IP %v\n", network, ip)
+		default:
+			printf("%s: egresses from %v, which isn't a known public IP of the exit node or this device\n", network, ip)
+		}
+	}
+	if leaks > 0 {
+		return fmt.Errorf("found %d leak(s)", leaks)
+	}
+	return nil
+}
+
+// stunEgressIP returns the IP that DERP STUN servers see STUN requests
+// from this process over network ("udp4" or "udp6") come from.
+func stunEgressIP(ctx context.Context, dm *tailcfg.DERPMap, network string) (netaddr.IP, error) {
+	pc, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return netaddr.IP{}, err
+	}
+	defer pc.Close()
+
+	const maxTries = 3
+	tries := 0
+	lastErr := errors.New("no STUN servers")
+	for _, rid := range dm.RegionIDs() {
+		for _, n := range dm.Regions[rid].Nodes {
+			if tries == maxTries {
+				return netaddr.IP{}, lastErr
+			}
+			addr, ok := stunAddr(n, network)
+			if !ok {
+				continue
+			}
+			tries++
+			ip, err := stunRequest(ctx, pc, network, addr)
+			if err == nil {
+				return ip, nil
+			}
+			lastErr = err
+			break // next region
+		}
+	}
+	return netaddr.IP{}, lastErr
+}
+
+// stunAddr returns the "host:port" of DERP node n's STUN server for
+// network, if it has one.
+func stunAddr(n *tailcfg.DERPNode, network string) (string, bool) {
+	if n.STUNPort < 0 {
+		return "", false
+	}
+	port := n.STUNPort
+	if port == 0 {
+		port = 3478
+	}
+	host := n.IPv4
+	if network == "udp6" {
+		host = n.IPv6
+	}
+	switch host {
+	case "none":
+		return "", false
+	case "":
+		host = n.HostName
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), true
+}
+
+func stunRequest(ctx context.Context, pc net.PacketConn, network, addr string) (netaddr.IP, error) {
+	ua, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return netaddr.IP{}, err
+	}
+	txID := stun.NewTxID()
+	if _, err := pc.WriteTo(stun.Request(txID), ua); err != nil {
+		return netaddr.IP{}, err
+	}
+	deadline := time.Now().Add(diagTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	pc.SetReadDeadline(deadline)
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return netaddr.IP{}, err
+		}
+		tid, ipb, _, err := stun.ParseResponse(buf[:n])
+		if err != nil || tid != txID {
+			continue
+		}
+		ip, ok := netaddr.FromStdIP(net.IP(ipb))
+		if !ok {
+			return netaddr.IP{}, fmt.Errorf("bad STUN response address %v", ipb)
+		}
+		return ip, nil
+	}
+}
+
+// myAddrName is a name whose TXT records are the IP of the resolver
+// that queried Google's authoritative servers for it and, if the
+// resolver sent one, the EDNS client subnet.
+const myAddrName = "o-o.myaddr.l.google.com"
+
+// parseMyAddrTXT parses the TXT records of myAddrName.
+func parseMyAddrTXT(txts []string) (resolver netaddr.IP, clientSubnet netaddr.IPPrefix) {
+	for _, txt := range txts {
+		if v := strings.TrimPrefix(txt, "edns0-client-subnet "); v != txt {
+			clientSubnet, _ = netaddr.ParseIPPrefix(v)
+			continue
+		}
+		if ip, err := netaddr.ParseIP(txt); err == nil {
+			resolver = ip
+		}
+	}
+	return resolver, clientSubnet
+}
+
+func runDiagDNSLeak(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	st, exit, err := diagExitNode(ctx)
+	if err != nil {
+		return err
+	}
+	prefs, err := localClient.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	printf("exit node %s\n", dnsOrQuoteHostname(st, exit))
+
+	leaks := 0
+	if !prefs.CorpDNS {
+		printf("LEAK: Tailscale DNS is off (--accept-dns=false), so DNS queries go to this device's own resolvers\n")
+		leaks++
+	} else if st.CurrentTailnet != nil && st.CurrentTailnet.MagicDNSEnabled && st.Self.DNSName != "" {
+		// Only Tailscale's resolver answers for MagicDNS names, so
+		// resolving our own tells whether the system uses it.
+		name := strings.TrimSuffix(st.Self.DNSName, ".")
+		lctx, cancel := context.WithTimeout(ctx, diagTimeout)
+		_, err := net.DefaultResolver.LookupHost(lctx, name)
+		cancel()
+		if err != nil {
+			printf("LEAK: the system resolver doesn't use Tailscale's resolver (looking up %s: %v)\n", name, err)
+			leaks++
+		} else {
+			printf("ok, the system resolver uses Tailscale's resolver\n")
+		}
+	} else {
+		printf("MagicDNS is off, so can't check whether the system resolver uses Tailscale's resolver\n")
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, diagTimeout)
+	txts, err := net.DefaultResolver.LookupTXT(lctx, myAddrName)
+	cancel()
+	if err != nil {
+		printf("looking up %s: %v\n", myAddrName, err)
+	} else {
+		resolver, subnet := parseMyAddrTXT(txts)
+		if !resolver.IsValid() {
+			return fmt.Errorf("unexpected %s TXT records %q", myAddrName, txts)
+		}
+		desc := "resolver " + resolver.String()
+		if subnet.IsValid() {
+			desc += ", client subnet " + subnet.String()
+		}
+		onNetwork := func(ips []netaddr.IP) bool {
+			for _, ip := range ips {
+				if ip == resolver || subnet.IsValid() && subnet.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+		switch {
+		case onNetwork(publicIPs(st.Self.Addrs)):
+			printf("LEAK: queries reach DNS servers from this device's own network (%s)\n", desc)
+			leaks++
+		case onNetwork(publicIPs(exit.Addrs)):
+			printf("ok, queries reach DNS servers from the exit node's network (%s)\n", desc)
+		default:
+			printf("queries reach DNS servers from %s, which isn't on a known network of the exit node or this device\n", desc)
+		}
+	}
+
+	if leaks > 0 {
+		return fmt.Errorf("found %d leak(s)", leaks)
+	}
+	return nil
+}
+
+func runDiagUnreachable(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale diag unreachable <hostname-or-IP>")
+	}
+	ipStr, _, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	ip, err := netaddr.ParseIP(ipStr)
+	if err != nil {
+		return err
+	}
+	rep, err := localClient.ExplainUnreachable(ctx, ip)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	if diagUnreachableArgs.json {
+		j, err := json.MarshalIndent(rep, "", "\t")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	target := ip.String()
+	if rep.PeerName != "" {
+		target = fmt.Sprintf("%v (%s)", ip, rep.PeerName)
+	}
+	if len(rep.Reasons) == 0 {
+		printf("Found nothing that would stop this device reaching %s.\n", target)
+		printf("Try 'tailscale ping %v' to test the connection itself.\n", ip)
+		return nil
+	}
+	printf("Possible reasons %s is unreachable, most likely first:\n\n", target)
+	for i, re := range rep.Reasons {
+		mark := ""
+		if re.Blocking {
+			mark = " [blocking]"
+		}
+		printf("%d. %s%s\n   %s\n", i+1, re.Code, mark, re.Message)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+)
+
+var dnsCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "dns <add|remove|list> ...",
+	ShortHelp:  "Manage static DNS records served by MagicDNS",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale dns' commands manage static DNS records on this device.
+MagicDNS answers queries for a name with a static record using only the
+static records for that name, in preference to peers' MagicDNS names,
+records from the admin panel, and upstream resolvers, much like an
+/etc/hosts entry.
+
+Static records apply to queries handled by MagicDNS (100.100.100.100).
+For names outside your tailnet's domains, that depends on your device
+sending all of its DNS queries to MagicDNS.
+`),
+	Subcommands: []*ffcli.Command{
+		dnsAddCmd,
+		dnsRemoveCmd,
+		dnsListCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("dns subcommand required; run 'tailscale dns -h' for details")
+	},
+}
+
+var dnsAddCmd = &ffcli.Command{
+	Name:       "add",
+	ShortUsage: "dns add <name> <ip>",
+	ShortHelp:  "Add a static DNS record",
+	Exec:       runDNSAdd,
+}
+
+var dnsRemoveCmd = &ffcli.Command{
+	Name:       "remove",
+	ShortUsage: "dns remove <name> [<ip>]",
+	ShortHelp:  "Remove a name's static DNS records, or just the one for ip",
+	Exec:       runDNSRemove,
+}
+
+var dnsListCmd = &ffcli.Command{
+	Name:       "list",
+	ShortUsage: "dns list",
+	ShortHelp:  "List static DNS records",
+	Exec:       runDNSList,
+}
+
+func runDNSAdd(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: tailscale dns add <name> <ip>")
+	}
+	rec := tailcfg.DNSRecord{Name: normalizeDNSRecordName(args[0]), Value: args[1]}
+	if err := ipn.ValidateStaticDNSRecord(rec); err != nil {
+		return err
+	}
+	prefs, err := localClient.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range prefs.StaticDNSRecords {
+		if r == rec {
+			return nil
+		}
+	}
+	return setStaticDNSRecords(ctx, append(prefs.StaticDNSRecords, rec))
+}
+
+func runDNSRemove(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: tailscale dns remove <name> [<ip>]")
+	}
+	name := normalizeDNSRecordName(args[0])
+	prefs, err := localClient.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	var keep []tailcfg.DNSRecord
+	for _, r := range prefs.StaticDNSRecords {
+		if normalizeDNSRecordName(r.Name) == name && (len(args) == 1 || r.Value == args[1]) {
+			continue
+		}
+		keep = append(keep, r)
+	}
+	if len(keep) == len(prefs.StaticDNSRecords) {
+		return fmt.Errorf("no static DNS record for %s", strings.Join(args, " "))
+	}
+	return setStaticDNSRecords(ctx, keep)
+}
+
+func runDNSList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	prefs, err := localClient.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	if len(prefs.StaticDNSRecords) == 0 {
+		printf("No static DNS records.\n")
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	for _, r := range prefs.StaticDNSRecords {
+		fmt.Fprintf(w, "%s\t%s\n", r.Name, r.Value)
+	}
+	return w.Flush()
+}
+
+func setStaticDNSRecords(ctx context.Context, recs []tailcfg.DNSRecord) error {
+	_, err := localClient.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs:               ipn.Prefs{StaticDNSRecords: recs},
+		StaticDNSRecordsSet: true,
+	})
+	return err
+}
+
+// normalizeDNSRecordName returns name in the form stored in prefs: lower
+// case, without a trailing dot.
+func normalizeDNSRecordName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
+	"tailscale.com/types/key"
+	"tailscale.com/version"
+)
+
+// defaultFeedbackURL is the support endpoint that bundles are uploaded
+// to, unless --upload-url or $TS_FEEDBACK_URL says otherwise.
+const defaultFeedbackURL = "https://log.tailscale.io/feedback"
+
+var feedbackCmd = &ffcli.Command{
+	Name:       "feedback",
+	Exec:       runFeedback,
+	ShortHelp:  "Upload a diagnostic bundle for support",
+	ShortUsage: "feedback [flags] [note]",
+	LongHelp: strings.TrimSpace(`
+Collect a bug report marker, tailscaled's recent logs, a netcheck report
+and the current status into a bundle, encrypt it to the support
+endpoint's key, and upload it. The printed reference ID identifies the
+bundle to support.
+
+Self-hosted fleets can collect bundles with their own endpoint, set with
+--upload-url or $TS_FEEDBACK_URL. The endpoint must use https; it serves
+its public key at /key and accepts POSTed bundles; see
+apitype.SealedSupportBundle.
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("feedback")
+		fs.StringVar(&feedbackArgs.ticket, "ticket", "", "support ticket reference to attach to the bundle")
+		fs.StringVar(&feedbackArgs.uploadURL, "upload-url", "", "support endpoint to upload to; defaults to $TS_FEEDBACK_URL or "+defaultFeedbackURL)
+		fs.BoolVar(&feedbackArgs.noLogs, "no-logs", false, "leave tailscaled's recent logs out of the bundle")
+		return fs
+	})(),
+}
+
+var feedbackArgs struct {
+	ticket    string
+	uploadURL string
+	noLogs    bool
+}
+
+func runFeedback(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: tailscale feedback [flags] [note]")
+	}
+	b := &apitype.SupportBundle{
+		Ticket:  feedbackArgs.ticket,
+		Time:    time.Now().UTC(),
+		Version: version.Long,
+	}
+	if len(args) == 1 {
+		b.Note = args[0]
+	}
+	endpoint := feedbackArgs.uploadURL
+	if endpoint == "" {
+		endpoint = envknob.String("TS_FEEDBACK_URL")
+	}
+	if endpoint == "" {
+		endpoint = defaultFeedbackURL
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	// The endpoint's key is fetched from the endpoint itself, so only
+	// TLS stops someone on the path from substituting their own and
+	// reading the bundle.
+	if u, err := url.Parse(endpoint); err != nil {
+		return fmt.Errorf("invalid support endpoint: %w", err)
+	} else if u.Scheme != "https" {
+		return fmt.Errorf("support endpoint %q must use https", endpoint)
+	}
+
+	// Fetch the key first, so an unreachable endpoint fails fast.
+	endpointKey, err := feedbackEndpointKey(ctx, endpoint)
+	if err != nil {
+		return err
+	}
+
+	note := b.Note
+	if b.Ticket != "" {
+		note = strings.TrimSpace("ticket " + b.Ticket + ": " + note)
+	}
+	b.Marker, err = localClient.BugReport(ctx, note)
+	if err != nil {
+		return err
+	}
+	addErr := func(what string, err error) {
+		b.Errors = append(b.Errors, fmt.Sprintf("%s: %v", what, err))
+	}
+	if st, err := localClient.Status(ctx); err != nil {
+		addErr("status", err)
+	} else if b.Status, err = json.Marshal(st); err != nil {
+		addErr("status", err)
+	}
+	if !feedbackArgs.noLogs {
+		if b.Logs, err = localClient.RecentLogs(ctx); err != nil {
+			addErr("logs", err)
+		}
+	}
+	printf("Running netcheck...\n")
+	if dm, err := netcheckDERPMap(ctx); err != nil {
+		addErr("netcheck", err)
+	} else if report, err := newNetcheckClient(false).GetReport(ctx, dm); err != nil {
+		addErr("netcheck", err)
+	} else if b.Netcheck, err = json.Marshal(report); err != nil {
+		addErr("netcheck", err)
+	}
+	for _, e := range b.Errors {
+		printf("warning: %s\n", e)
+	}
+
+	bundle, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	ephemeral := key.NewMachine()
+	body, err := json.Marshal(&apitype.SealedSupportBundle{
+		Key:    ephemeral.Public(),
+		Sealed: ephemeral.SealTo(endpointKey, bundle),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("uploading bundle: %w", err)
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("uploading bundle: %w", err)
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("uploading bundle: %v: %s", res.Status, bytes.TrimSpace(resBody))
+	}
+	var resp apitype.SupportBundleResponse
+	if err := json.Unmarshal(resBody, &resp); err != nil || resp.ID == "" {
+		return fmt.Errorf("uploading bundle: unexpected response %q", resBody)
+	}
+	printf("Uploaded. Reference ID: %s\n", resp.ID)
+	if b.Ticket != "" {
+		printf("Attached to ticket %s.\n", b.Ticket)
+	}
+	return nil
+}
+
+// feedbackEndpointKey fetches the public key that bundles for the
+// support endpoint must be sealed to. The endpoint must be https.
+func feedbackEndpointKey(ctx context.Context, endpoint string) (key.MachinePublic, error) {
+	var k key.MachinePublic
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/key", nil)
+	if err != nil {
+		return k, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return k, fmt.Errorf("fetching support endpoint key: %w", err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+	if err != nil {
+		return k, fmt.Errorf("fetching support endpoint key: %w", err)
+	}
+	if res.StatusCode != 200 {
+		return k, fmt.Errorf("fetching support endpoint key: %v", res.Status)
+	}
+	if err := k.UnmarshalText(bytes.TrimSpace(b)); err != nil {
+		return k, fmt.Errorf("fetching support endpoint key: %w", err)
+	}
+	return k, nil
+}
@@ -50,7 +50,7 @@
 
 var fileCpCmd = &ffcli.Command{
 	Name:       "cp",
-	ShortUsage: "file cp <files...> <target>:",
+	ShortUsage: "file cp <files...> <target|@group>:",
 	ShortHelp:  "Copy file(s) to a host",
 	Exec:       runCp,
 	FlagSet: (func() *flag.FlagSet {
@@ -80,6 +80,9 @@ func runCp(ctx context.Context, args []string) error {
 		return fmt.Errorf("final argument to 'tailscale file cp' must end in colon")
 	}
 	target = strings.TrimSuffix(target, ":")
+	if isNodeGroupArg(target) {
+		return runGroupCp(ctx, files, target)
+	}
 	hadBrackets := false
 	if strings.HasPrefix(target, "[") && strings.HasSuffix(target, "]") {
 		hadBrackets = true
@@ -102,7 +105,49 @@ func runCp(ctx context.Context, args []string) error {
 	if isOffline {
 		fmt.Fprintf(Stderr, "# warning: %s is offline\n", target)
 	}
+	return sendFiles(ctx, files, target, ip, stableID)
+}
+
+// runGroupCp sends files to each member of the node group arg
+// ("@name") in turn, carrying on past failures.
+func runGroupCp(ctx context.Context, files []string, arg string) error {
+	ms, err := nodeGroupMembers(ctx, arg)
+	if err != nil {
+		return err
+	}
+	if len(ms) > 1 {
+		for _, fileArg := range files {
+			if fileArg == "-" {
+				return fmt.Errorf("can't send STDIN to the %d peers in %s", len(ms), arg)
+			}
+		}
+	}
+	var failed []string
+	for _, m := range ms {
+		ip := m.TailscaleIPs[0].String()
+		stableID, isOffline, err := getTargetStableID(ctx, ip)
+		if err == nil {
+			if isOffline {
+				fmt.Fprintf(Stderr, "# warning: %s is offline\n", m.Name)
+			}
+			err = sendFiles(ctx, files, m.Name, ip, stableID)
+		}
+		if err != nil {
+			fmt.Fprintf(Stderr, "# can't send to %s: %v\n", m.Name, err)
+			failed = append(failed, m.Name)
+			continue
+		}
+		printf("sent to %s\n", m.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d peers in %s failed: %s", len(failed), len(ms), arg, strings.Join(failed, ", "))
+	}
+	return nil
+}
 
+// sendFiles sends files to target, the peer with Tailscale IP ip and
+// ID stableID.
+func sendFiles(ctx context.Context, files []string, target, ip string, stableID tailcfg.StableNodeID) error {
 	if len(files) > 1 {
 		if cpArgs.name != "" {
 			return errors.New("can't use --name= with multiple files")
@@ -121,6 +166,7 @@ func runCp(ctx context.Context, args []string) error {
 		if fileArg == "-" {
 			fileContents = os.Stdin
 			if name == "" {
+				var err error
 				name, fileContents, err = pickStdinFilename()
 				if err != nil {
 					return err
@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var groupCmd = &ffcli.Command{
+	Name:       "group",
+	ShortUsage: "group <list|set|delete|show> ...",
+	ShortHelp:  "Manage local groups of peers, for use as @name",
+	LongHelp: strings.TrimSpace(`
+'tailscale group' manages node groups: named groups of peers, defined
+on this device only, that 'tailscale ping' and 'tailscale file cp'
+accept as "@name" in place of a single peer:
+
+  tailscale group set builders --tag=tag:ci --name='build-*'
+  tailscale ping @builders
+  tailscale file cp report.pdf @nas:
+
+A peer is in a group if it has any of the group's tags, its MagicDNS
+name matches any of the group's name patterns, or it's one of the
+group's explicit peers. Members are looked up in the current network
+map each time the group is used.
+`),
+	Subcommands: []*ffcli.Command{
+		groupListCmd,
+		groupSetCmd,
+		groupDeleteCmd,
+		groupShowCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("group subcommand required; run 'tailscale group -h' for details")
+	},
+}
+
+var groupListCmd = &ffcli.Command{
+	Name:       "list",
+	ShortUsage: "group list",
+	ShortHelp:  "List the node groups",
+	Exec:       runGroupList,
+}
+
+var groupSetCmd = &ffcli.Command{
+	Name:       "set",
+	ShortUsage: "group set <name> [--tag=tag:a,tag:b] [--name=pattern,...] [--peer=host-or-IP,...]",
+	ShortHelp:  "Define a node group, replacing any of the same name",
+	Exec:       runGroupSet,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("set")
+		fs.StringVar(&groupSetArgs.tags, "tag", "", `comma-separated ACL tags; peers with any of them are members (e.g. "tag:ci")`)
+		fs.StringVar(&groupSetArgs.names, "name", "", `comma-separated MagicDNS name glob patterns (e.g. "build-*"); patterns with a dot match the full name`)
+		fs.StringVar(&groupSetArgs.peers, "peer", "", "comma-separated peers, by MagicDNS name or Tailscale IP")
+		return fs
+	})(),
+}
+
+var groupSetArgs struct {
+	tags  string
+	names string
+	peers string
+}
+
+var groupDeleteCmd = &ffcli.Command{
+	Name:       "delete",
+	ShortUsage: "group delete <name>",
+	ShortHelp:  "Delete a node group",
+	Exec:       runGroupDelete,
+}
+
+var groupShowCmd = &ffcli.Command{
+	Name:       "show",
+	ShortUsage: "group show <name>",
+	ShortHelp:  "Show a node group's current members",
+	Exec:       runGroupShow,
+}
+
+func runGroupList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale group list'")
+	}
+	gs, err := localClient.NodeGroups(ctx)
+	if err != nil {
+		return err
+	}
+	if len(gs) == 0 {
+		outln("No node groups; define one with 'tailscale group set'.")
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(w, "GROUP\tTAGS\tNAMES\tPEERS\n")
+	for _, g := range gs {
+		fmt.Fprintf(w, "@%s\t%s\t%s\t%s\n", g.Name, joinOrDash(g.Tags), joinOrDash(g.Names), joinOrDash(g.Peers))
+	}
+	return w.Flush()
+}
+
+func joinOrDash(v []string) string {
+	if len(v) == 0 {
+		return "-"
+	}
+	return strings.Join(v, ",")
+}
+
+// splitList splits the comma-separated flag value s, dropping empty
+// elements.
+func splitList(s string) []string {
+	var ret []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func runGroupSet(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale group set <name> [flags]")
+	}
+	g := ipn.NodeGroup{
+		Name:  strings.TrimPrefix(args[0], "@"),
+		Tags:  splitList(groupSetArgs.tags),
+		Names: splitList(groupSetArgs.names),
+		Peers: splitList(groupSetArgs.peers),
+	}
+	if err := g.Check(); err != nil {
+		return err
+	}
+	return localClient.SetNodeGroup(ctx, g)
+}
+
+func runGroupDelete(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale group delete <name>")
+	}
+	return localClient.DeleteNodeGroup(ctx, strings.TrimPrefix(args[0], "@"))
+}
+
+func runGroupShow(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale group show <name>")
+	}
+	ms, err := localClient.NodeGroupMembers(ctx, strings.TrimPrefix(args[0], "@"))
+	if err != nil {
+		return err
+	}
+	for _, p := range ms.Unresolved {
+		printf("# warning: peer %q of @%s isn't in the network map\n", p, ms.Name)
+	}
+	if len(ms.Members) == 0 {
+		printf("@%s has no members.\n", ms.Name)
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	for _, m := range ms.Members {
+		status := "online"
+		if !m.Online {
+			status = "offline"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", firstIPString(m.TailscaleIPs), m.Name, status)
+	}
+	return w.Flush()
+}
+
+// isNodeGroupArg reports whether the host argument arg refers to a
+// node group, as "@name".
+func isNodeGroupArg(arg string) bool {
+	return strings.HasPrefix(arg, "@")
+}
+
+// nodeGroupMembers returns the members of the node group that arg,
+// "@name", refers to, warning on Stderr about any of its explicit
+// peers that aren't in the network map. It's an error for the group
+// to have no members with a Tailscale IP.
+func nodeGroupMembers(ctx context.Context, arg string) ([]ipnstate.NodeGroupMember, error) {
+	ms, err := localClient.NodeGroupMembers(ctx, strings.TrimPrefix(arg, "@"))
+	if err != nil {
+		return nil, fmt.Errorf("node group %s: %w", arg, err)
+	}
+	for _, p := range ms.Unresolved {
+		fmt.Fprintf(Stderr, "# warning: peer %q of %s isn't in the network map\n", p, arg)
+	}
+	var ret []ipnstate.NodeGroupMember
+	for _, m := range ms.Members {
+		if len(m.TailscaleIPs) > 0 {
+			ret = append(ret, m)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("node group %s has no members", arg)
+	}
+	return ret, nil
+}
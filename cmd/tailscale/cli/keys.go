@@ -0,0 +1,128 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/atomicfile"
+)
+
+var keysCmd = &ffcli.Command{
+	Name:       "keys",
+	ShortUsage: "keys <export|import>",
+	ShortHelp:  "Back up or restore this device's private keys",
+	LongHelp: strings.TrimSpace(`
+'tailscale keys export' writes this device's machine and node keys to a
+backup file encrypted with a passphrase, and 'tailscale keys import'
+restores them, on this device after it's lost its state or on a
+machine replacing it, which then connects as the same device.
+
+Use these rather than copying tailscaled's state file, which holds
+more than the keys and may be in use. Whoever has the backup and its
+passphrase can impersonate this device, so keep both safe. Both
+commands must be run as root, or by an administrator on Windows.
+`),
+	Subcommands: []*ffcli.Command{
+		keysExportCmd,
+		keysImportCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("keys subcommand required; run 'tailscale keys -h' for details")
+	},
+}
+
+var keysExportCmd = &ffcli.Command{
+	Name:       "export",
+	ShortUsage: "keys export --passphrase=<secret> [--out=<file>]",
+	ShortHelp:  "Write this device's private keys to an encrypted backup",
+	Exec:       runKeysExport,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("export")
+		fs.StringVar(&keysArgs.passphrase, "passphrase", "", `passphrase to encrypt the backup with; if it begins with "file:", then it's a path to a file containing the passphrase`)
+		fs.StringVar(&keysArgs.out, "out", "-", `output backup file, or "-" for stdout`)
+		return fs
+	})(),
+}
+
+var keysImportCmd = &ffcli.Command{
+	Name:       "import",
+	ShortUsage: "keys import --passphrase=<secret> <file>",
+	ShortHelp:  "Restore private keys from a backup, before logging in",
+	LongHelp: strings.TrimSpace(`
+'tailscale keys import' replaces this device's machine and node keys
+with those in a backup made by 'tailscale keys export'. The device must
+be logged out. Run 'tailscale up' afterwards to connect with them.
+`),
+	Exec: runKeysImport,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("import")
+		fs.StringVar(&keysArgs.passphrase, "passphrase", "", `passphrase the backup is encrypted with; if it begins with "file:", then it's a path to a file containing the passphrase`)
+		return fs
+	})(),
+}
+
+var keysArgs struct {
+	passphrase string
+	out        string
+}
+
+func keysPassphrase() (string, error) {
+	passphrase, err := readSecretOrFile(keysArgs.passphrase)
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("--passphrase is required")
+	}
+	return passphrase, nil
+}
+
+func runKeysExport(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale keys export'")
+	}
+	passphrase, err := keysPassphrase()
+	if err != nil {
+		return err
+	}
+	sealed, err := localClient.ExportKeys(ctx, passphrase)
+	if err != nil {
+		return err
+	}
+	if keysArgs.out == "-" {
+		Stdout.Write(sealed)
+		return nil
+	}
+	if err := atomicfile.WriteFile(keysArgs.out, sealed, 0600); err != nil {
+		return err
+	}
+	printf("Wrote key backup to %s\n", keysArgs.out)
+	return nil
+}
+
+func runKeysImport(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: keys import --passphrase=<secret> <file>")
+	}
+	passphrase, err := keysPassphrase()
+	if err != nil {
+		return err
+	}
+	sealed, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if err := localClient.ImportKeys(ctx, sealed, passphrase); err != nil {
+		return err
+	}
+	printf("Imported keys from %s; run 'tailscale up' to connect with them.\n", args[0])
+	return nil
+}
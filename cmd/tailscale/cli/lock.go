@@ -0,0 +1,141 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/atomicfile"
+	"tailscale.com/tka"
+)
+
+var lockCmd = &ffcli.Command{
+	Name:       "lock",
+	ShortUsage: "lock <presign>",
+	ShortHelp:  "Manage network-lock (tailnet key authority) signatures",
+	Subcommands: []*ffcli.Command{
+		lockPresignCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("lock subcommand required; run 'tailscale lock -h' for details")
+	},
+}
+
+var lockPresignCmd = &ffcli.Command{
+	Name:       "presign",
+	ShortUsage: "lock presign --signing-key=<file> --passphrase=<secret> [--out=<file>]",
+	ShortHelp:  "Pre-sign a node key for a machine to join a locked tailnet offline",
+	LongHelp: strings.TrimSpace(`
+'tailscale lock presign' generates a new node key and signs it with a key
+trusted by the tailnet's network-lock authority, for a machine that
+can't get its own node key signed, such as one that can reach the
+coordination server but no signing node.
+
+The key and signature are written as an enrollment file, encrypted with
+the passphrase. Copy it to the machine and pass it to 'tailscale up
+--enrollment=<file> --enrollment-passphrase=<secret>' when it first logs
+in.
+
+It doesn't need tailscaled, so it can run on an offline admin
+workstation. The signing key file holds the hex-encoded ed25519 private
+key (or its 32-byte seed) of a trusted key.
+`),
+	Exec: runLockPresign,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("presign")
+		fs.StringVar(&lockPresignArgs.signingKey, "signing-key", "", "file containing the hex-encoded ed25519 private key to sign with")
+		fs.StringVar(&lockPresignArgs.passphrase, "passphrase", "", `passphrase to encrypt the enrollment with; if it begins with "file:", then it's a path to a file containing the passphrase`)
+		fs.StringVar(&lockPresignArgs.out, "out", "-", `output enrollment file, or "-" for stdout`)
+		return fs
+	})(),
+}
+
+var lockPresignArgs struct {
+	signingKey string
+	passphrase string
+	out        string
+}
+
+func runLockPresign(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale lock presign'")
+	}
+	if lockPresignArgs.signingKey == "" {
+		return errors.New("--signing-key is required")
+	}
+	signer, err := readSigningKey(lockPresignArgs.signingKey)
+	if err != nil {
+		return err
+	}
+	passphrase, err := readSecretOrFile(lockPresignArgs.passphrase)
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return errors.New("--passphrase is required")
+	}
+	e := tka.NewEnrollment(signer)
+	sealed, err := e.Seal([]byte(passphrase))
+	if err != nil {
+		return err
+	}
+	if lockPresignArgs.out == "-" {
+		Stdout.Write(sealed)
+		return nil
+	}
+	if err := atomicfile.WriteFile(lockPresignArgs.out, sealed, 0600); err != nil {
+		return err
+	}
+	printf("Wrote enrollment for node key %v to %s\n", e.NodeKey.Public(), lockPresignArgs.out)
+	return nil
+}
+
+// readSigningKey reads the hex-encoded ed25519 private key, or its seed,
+// in file.
+func readSigningKey(file string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("signing key %s: %v", file, err)
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("signing key %s: got %d bytes, want %d or %d", file, len(raw), ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// openEnrollment opens the sealed enrollment in file for 'tailscale up'.
+func openEnrollment(file, passphraseOrFile string) (*tka.Enrollment, error) {
+	sealed, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readSecretOrFile(passphraseOrFile)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, errors.New("--enrollment-passphrase is required with --enrollment")
+	}
+	e, err := tka.OpenEnrollment(sealed, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("enrollment %s: %w", file, err)
+	}
+	return e, nil
+}
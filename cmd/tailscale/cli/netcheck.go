@@ -20,6 +20,7 @@
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/portmapper"
 	"tailscale.com/tailcfg"
@@ -47,31 +48,15 @@
 }
 
 func runNetcheck(ctx context.Context, args []string) error {
-	c := &netcheck.Client{
-		UDPBindAddr: envknob.String("TS_DEBUG_NETCHECK_UDP_BIND"),
-		PortMapper:  portmapper.NewClient(logger.WithPrefix(log.Printf, "portmap: "), nil),
-	}
-	if netcheckArgs.verbose {
-		c.Logf = logger.WithPrefix(log.Printf, "netcheck: ")
-		c.Verbose = true
-	} else {
-		c.Logf = logger.Discard
-	}
+	c := newNetcheckClient(netcheckArgs.verbose)
 
 	if strings.HasPrefix(netcheckArgs.format, "json") {
 		fmt.Fprintln(Stderr, "# Warning: this JSON format is not yet considered a stable interface")
 	}
 
-	dm, err := localClient.CurrentDERPMap(ctx)
-	noRegions := dm != nil && len(dm.Regions) == 0
-	if noRegions {
-		log.Printf("No DERP map from tailscaled; using default.")
-	}
-	if err != nil || noRegions {
-		dm, err = prodDERPMap(ctx, http.DefaultClient)
-		if err != nil {
-			return err
-		}
+	dm, err := netcheckDERPMap(ctx)
+	if err != nil {
+		return err
 	}
 	for {
 		t0 := time.Now()
@@ -93,6 +78,38 @@ func runNetcheck(ctx context.Context, args []string) error {
 	}
 }
 
+// newNetcheckClient returns a netcheck client that logs only if verbose.
+func newNetcheckClient(verbose bool) *netcheck.Client {
+	c := &netcheck.Client{
+		UDPBindAddr: envknob.String("TS_DEBUG_NETCHECK_UDP_BIND"),
+		PortMapper:  portmapper.NewClient(logger.WithPrefix(log.Printf, "portmap: "), nil),
+	}
+	if dscp.Supported() {
+		c.DSCP = dscp.AF41
+	}
+	if verbose {
+		c.Logf = logger.WithPrefix(log.Printf, "netcheck: ")
+		c.Verbose = true
+	} else {
+		c.Logf = logger.Discard
+	}
+	return c
+}
+
+// netcheckDERPMap returns tailscaled's DERP map, or the default one if
+// tailscaled doesn't have one.
+func netcheckDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	dm, err := localClient.CurrentDERPMap(ctx)
+	noRegions := dm != nil && len(dm.Regions) == 0
+	if noRegions {
+		log.Printf("No DERP map from tailscaled; using default.")
+	}
+	if err != nil || noRegions {
+		return prodDERPMap(ctx, http.DefaultClient)
+	}
+	return dm, nil
+}
+
 func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	var j []byte
 	var err error
@@ -134,6 +151,9 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	printf("\t* MappingVariesByDestIP: %v\n", report.MappingVariesByDestIP)
 	printf("\t* HairPinning: %v\n", report.HairPinning)
 	printf("\t* PortMapping: %v\n", portMapping(report))
+	if report.DSCPPreserved != "" {
+		printf("\t* DSCPPreserved: %v\n", report.DSCPPreserved)
+	}
 
 	// When DERP latency checking failed,
 	// magicsock will try to pick the DERP server that
@@ -0,0 +1,227 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+var peersCmd = &ffcli.Command{
+	Name:       "peers",
+	ShortUsage: "peers <export>",
+	ShortHelp:  "Work with the list of peers",
+	Subcommands: []*ffcli.Command{
+		peersExportCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("peers subcommand required; run 'tailscale peers -h' for details")
+	},
+}
+
+var peersExportCmd = &ffcli.Command{
+	Name:       "export",
+	ShortUsage: "peers export [--format=hosts|ssh|ansible] [--tag=tag:a,tag:b] [--out=<file>]",
+	ShortHelp:  "Write the peer list as a hosts file, ssh_config or Ansible inventory",
+	LongHelp: strings.TrimSpace(`
+'tailscale peers export' renders this device's current peers for
+existing tooling:
+
+  hosts    an /etc/hosts fragment mapping each peer's Tailscale IPs
+           to its MagicDNS name and short name
+  ssh      ssh_config Host entries, one per peer, by short name
+  ansible  an Ansible INI inventory: every peer is in the "tailscale"
+           group, and in a "tag_<name>" group for each of its ACL tags
+
+Peers shared in from other tailnets are left out, as in 'tailscale
+status'. The output reflects the network map at the time it's run;
+re-run it to pick up changes.
+`),
+	Exec: runPeersExport,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("export")
+		fs.StringVar(&peersExportArgs.format, "format", "hosts", `output format: "hosts", "ssh" or "ansible"`)
+		fs.StringVar(&peersExportArgs.tags, "tag", "", `comma-separated ACL tags; if non-empty, only peers with at least one of them are exported (e.g. "tag:prod,tag:db")`)
+		fs.BoolVar(&peersExportArgs.online, "online", false, "only export peers that are currently online")
+		fs.StringVar(&peersExportArgs.out, "out", "-", `output file, or "-" for stdout`)
+		return fs
+	})(),
+}
+
+var peersExportArgs struct {
+	format string
+	tags   string
+	online bool
+	out    string
+}
+
+func runPeersExport(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale peers export'")
+	}
+	var render func(io.Writer, []exportPeer)
+	switch peersExportArgs.format {
+	case "hosts":
+		render = renderPeersHosts
+	case "ssh":
+		render = renderPeersSSH
+	case "ansible":
+		render = renderPeersAnsible
+	default:
+		return fmt.Errorf("unknown --format %q; want hosts, ssh or ansible", peersExportArgs.format)
+	}
+	var tags []string
+	if peersExportArgs.tags != "" {
+		tags = strings.Split(peersExportArgs.tags, ",")
+		for _, tag := range tags {
+			if !strings.HasPrefix(tag, "tag:") {
+				return fmt.Errorf("tag %q must start with \"tag:\"", tag)
+			}
+		}
+	}
+
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	if description, ok := isRunningOrStarting(st); !ok {
+		outln(description)
+		os.Exit(1)
+	}
+	peers := exportPeers(st, tags, peersExportArgs.online)
+
+	var buf bytes.Buffer
+	render(&buf, peers)
+	if peersExportArgs.out == "-" {
+		_, err = Stdout.Write(buf.Bytes())
+		return err
+	}
+	return atomicfile.WriteFile(peersExportArgs.out, buf.Bytes(), 0644)
+}
+
+// exportPeer is a peer, as 'tailscale peers export' writes it.
+type exportPeer struct {
+	name string // short name: the MagicDNS name without the tailnet suffix
+	fqdn string // MagicDNS name, without the trailing dot; may be empty
+	ps   *ipnstate.PeerStatus
+}
+
+// exportPeers returns the peers in st to export, sorted by name: those
+// with at least one of tags, if tags is non-empty, and that are online,
+// if onlineOnly.
+func exportPeers(st *ipnstate.Status, tags []string, onlineOnly bool) []exportPeer {
+	var ret []exportPeer
+	for _, ps := range st.Peer {
+		if ps.ShareeNode || len(ps.TailscaleIPs) == 0 {
+			continue
+		}
+		if onlineOnly && !ps.Online {
+			continue
+		}
+		if len(tags) > 0 && !peerHasAnyTag(ps, tags) {
+			continue
+		}
+		name := dnsname.TrimSuffix(ps.DNSName, st.MagicDNSSuffix)
+		if name == "" {
+			name = dnsname.SanitizeHostname(ps.HostName)
+		}
+		ret = append(ret, exportPeer{
+			name: name,
+			fqdn: strings.TrimSuffix(ps.DNSName, "."),
+			ps:   ps,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+func peerHasAnyTag(ps *ipnstate.PeerStatus, tags []string) bool {
+	if ps.Tags == nil {
+		return false
+	}
+	for _, tag := range tags {
+		for i := 0; i < ps.Tags.Len(); i++ {
+			if ps.Tags.At(i) == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const peersExportHeader = "# Tailscale peers, generated by 'tailscale peers export'.\n"
+
+func renderPeersHosts(w io.Writer, peers []exportPeer) {
+	io.WriteString(w, peersExportHeader)
+	for _, p := range peers {
+		names := p.name
+		if p.fqdn != "" && p.fqdn != p.name {
+			names = p.fqdn + " " + p.name
+		}
+		for _, ip := range p.ps.TailscaleIPs {
+			fmt.Fprintf(w, "%s\t%s\n", ip, names)
+		}
+	}
+}
+
+func renderPeersSSH(w io.Writer, peers []exportPeer) {
+	io.WriteString(w, peersExportHeader)
+	for _, p := range peers {
+		// The first Tailscale IP is the IPv4 one, which works
+		// even where IPv6 doesn't.
+		fmt.Fprintf(w, "\nHost %s\n\tHostName %s\n", p.name, p.ps.TailscaleIPs[0])
+	}
+}
+
+func renderPeersAnsible(w io.Writer, peers []exportPeer) {
+	io.WriteString(w, peersExportHeader)
+	io.WriteString(w, "\n[tailscale]\n")
+	groups := map[string][]string{}
+	for _, p := range peers {
+		fmt.Fprintf(w, "%s ansible_host=%s\n", p.name, p.ps.TailscaleIPs[0])
+		if p.ps.Tags == nil {
+			continue
+		}
+		for i := 0; i < p.ps.Tags.Len(); i++ {
+			g := ansibleGroupName(p.ps.Tags.At(i))
+			groups[g] = append(groups[g], p.name)
+		}
+	}
+	var names []string
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	for _, g := range names {
+		fmt.Fprintf(w, "\n[%s]\n", g)
+		for _, host := range groups[g] {
+			fmt.Fprintln(w, host)
+		}
+	}
+}
+
+// ansibleGroupName returns the Ansible group for ACL tag, such as
+// "tag_prod_db" for "tag:prod-db". Ansible group names may only
+// contain letters, digits and underscores.
+func ansibleGroupName(tag string) string {
+	return "tag_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.TrimPrefix(tag, "tag:"))
+}
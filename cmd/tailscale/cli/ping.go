@@ -12,18 +12,20 @@
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"inet.af/netaddr"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/ping"
 	"tailscale.com/tailcfg"
 )
 
 var pingCmd = &ffcli.Command{
 	Name:       "ping",
-	ShortUsage: "ping <hostname-or-IP>",
+	ShortUsage: "ping <hostname-or-IP|@group>",
 	ShortHelp:  "Ping a host at the Tailscale layer, see how it routed",
 	LongHelp: strings.TrimSpace(`
 
@@ -39,9 +41,21 @@
 By default, 'tailscale ping' stops after 10 pings or once a direct
 (non-DERP) path has been established, whichever comes first.
 
+With --verify-relay, 'tailscale ping' instead sends an authenticated
+echo to the peer through its DERP relay and checks that it comes back
+intact, reporting the relay path's round-trip time separately from the
+time the peer took to reply.
+
+With --tcp=<port> or --https, 'tailscale ping' instead connects through
+the tunnel to a service on the peer and times it: the TCP connection,
+and for --https (to port 443, or the --tcp port) the TLS handshake and
+the server's first response byte. A slow connect points at the network
+path; a slow first byte points at the server application.
+
 The provided hostname must resolve to or be a Tailscale IP
 (e.g. 100.x.y.z) or a subnet IP advertised by a Tailscale
-relay node.
+relay node. Given a node group as "@name" (see 'tailscale group'),
+'tailscale ping' pings each of its members in turn.
 
 `),
 	Exec: runPing,
@@ -52,6 +66,9 @@
 		fs.BoolVar(&pingArgs.tsmp, "tsmp", false, "do a TSMP-level ping (through WireGuard, but not either host OS stack)")
 		fs.BoolVar(&pingArgs.icmp, "icmp", false, "do a ICMP-level ping (through WireGuard, but not the local host OS stack)")
 		fs.BoolVar(&pingArgs.peerAPI, "peerapi", false, "try hitting the peer's peerapi HTTP server")
+		fs.BoolVar(&pingArgs.verifyRelay, "verify-relay", false, "verify the peer's DERP relay path end-to-end and time it")
+		fs.IntVar(&pingArgs.tcpPort, "tcp", 0, "time TCP connections through the tunnel to this port on the peer")
+		fs.BoolVar(&pingArgs.https, "https", false, "time HTTPS requests through the tunnel to the peer (port 443, or the --tcp port)")
 		fs.IntVar(&pingArgs.num, "c", 10, "max number of pings to send")
 		fs.DurationVar(&pingArgs.timeout, "timeout", 5*time.Second, "timeout before giving up on a ping")
 		return fs
@@ -65,6 +82,9 @@
 	tsmp        bool
 	icmp        bool
 	peerAPI     bool
+	verifyRelay bool
+	tcpPort     int
+	https       bool
 	timeout     time.Duration
 }
 
@@ -78,6 +98,9 @@ func pingType() tailcfg.PingType {
 	if pingArgs.peerAPI {
 		return tailcfg.PingPeerAPI
 	}
+	if pingArgs.verifyRelay {
+		return tailcfg.PingRelay
+	}
 	return tailcfg.PingDisco
 }
 
@@ -95,9 +118,38 @@ func runPing(ctx context.Context, args []string) error {
 	if len(args) != 1 || args[0] == "" {
 		return errors.New("usage: ping <hostname-or-IP>")
 	}
-	var ip string
+	if isNodeGroupArg(args[0]) {
+		return runGroupPing(ctx, st, args[0])
+	}
+	return pingHost(ctx, st, args[0])
+}
+
+// runGroupPing pings each member of the node group arg ("@name") in
+// turn, carrying on past failures.
+func runGroupPing(ctx context.Context, st *ipnstate.Status, arg string) error {
+	ms, err := nodeGroupMembers(ctx, arg)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for i, m := range ms {
+		if i > 0 {
+			outln()
+		}
+		printf("# %s (%v)\n", m.Name, m.TailscaleIPs[0])
+		if err := pingHost(ctx, st, m.TailscaleIPs[0].String()); err != nil {
+			printf("# %s: %v\n", m.Name, err)
+			failed = append(failed, m.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d peers in %s failed: %s", len(failed), len(ms), arg, strings.Join(failed, ", "))
+	}
+	return nil
+}
 
-	hostOrIP := args[0]
+// pingHost pings hostOrIP as the flags say.
+func pingHost(ctx context.Context, st *ipnstate.Status, hostOrIP string) error {
 	ip, self, err := tailscaleIPFromArg(ctx, hostOrIP)
 	if err != nil {
 		return err
@@ -111,6 +163,10 @@ func runPing(ctx context.Context, args []string) error {
 		log.Printf("lookup %q => %q", hostOrIP, ip)
 	}
 
+	if pingArgs.tcpPort != 0 || pingArgs.https {
+		return runServicePing(ctx, st, hostOrIP, ip)
+	}
+
 	n := 0
 	anyPong := false
 	for {
@@ -152,6 +208,14 @@ func runPing(ctx context.Context, args []string) error {
 			printf("hit peerapi of %s (%s) at %s in %s\n", pr.NodeIP, pr.NodeName, pr.PeerAPIURL, latency)
 			return nil
 		}
+		if pingArgs.verifyRelay {
+			peerTime := time.Duration(pr.PeerProcessingSeconds * float64(time.Second))
+			printf("relay to %s (%s) via %v verified in %v (relay path %v, peer %v)\n",
+				pr.NodeName, pr.NodeIP, via, latency,
+				(time.Duration(pr.LatencySeconds*float64(time.Second)) - peerTime).Round(time.Millisecond),
+				peerTime.Round(time.Microsecond))
+			return nil
+		}
 		anyPong = true
 		extra := ""
 		if pr.PeerAPIPort != 0 {
@@ -178,6 +242,81 @@ func runPing(ctx context.Context, args []string) error {
 	}
 }
 
+// runServicePing does the --tcp and --https pings of the service on the
+// peer at ip, through tailscaled, so it follows the tunnel whether
+// tailscaled uses a TUN device or userspace networking.
+func runServicePing(ctx context.Context, st *ipnstate.Status, hostOrIP, ip string) error {
+	port := pingArgs.tcpPort
+	if port == 0 {
+		port = 443
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid --tcp port %d", port)
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return localClient.DialTCP(ctx, ip, uint16(port))
+	}
+	name := peerServerName(st, hostOrIP, ip)
+
+	anyOK := false
+	for n := 1; ; n++ {
+		ctx, cancel := context.WithTimeout(ctx, pingArgs.timeout)
+		var res *ping.Result
+		var err error
+		if pingArgs.https {
+			res, err = ping.HTTPS(ctx, dial, addr, name)
+		} else {
+			res, err = ping.TCP(ctx, dial, addr)
+		}
+		cancel()
+		switch {
+		case err != nil:
+			printf("ping %s (%s) failed: %v\n", name, addr, err)
+		case pingArgs.https:
+			anyOK = true
+			printf("https to %s (%s): connect %v, tls %v, first byte %v, total %v; HTTP %d\n",
+				name, addr, roundPingTime(res.Connect), roundPingTime(res.TLSHandshake),
+				roundPingTime(res.FirstByte), roundPingTime(res.Total), res.StatusCode)
+			if res.CertErr != nil && n == 1 {
+				printf("warning: certificate not valid for %s: %v\n", name, res.CertErr)
+			}
+		default:
+			anyOK = true
+			printf("tcp connect to %s (%s) in %v\n", name, addr, roundPingTime(res.Connect))
+		}
+		if n >= pingArgs.num {
+			if !anyOK {
+				return errors.New("no reply")
+			}
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// peerServerName returns the name to use for the peer at ip in HTTPS
+// pings: its MagicDNS name if known, else what the user typed.
+func peerServerName(st *ipnstate.Status, hostOrIP, ip string) string {
+	for _, ps := range st.Peer {
+		for _, pip := range ps.TailscaleIPs {
+			if pip.String() == ip && ps.DNSName != "" {
+				return strings.TrimSuffix(ps.DNSName, ".")
+			}
+		}
+	}
+	return strings.TrimSuffix(hostOrIP, ".")
+}
+
+// roundPingTime rounds d for display, keeping sub-millisecond times on
+// LANs visible.
+func roundPingTime(d time.Duration) time.Duration {
+	if d < 10*time.Millisecond {
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
+
 func tailscaleIPFromArg(ctx context.Context, hostOrIP string) (ip string, self bool, err error) {
 	// If the argument is an IP address, use it directly without any resolution.
 	if net.ParseIP(hostOrIP) != nil {
@@ -0,0 +1,259 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/safesocket"
+	"tailscale.com/types/preftype"
+)
+
+var setCmd = &ffcli.Command{
+	Name:       "set",
+	ShortUsage: "set [flags]",
+	ShortHelp:  "Change specified settings",
+	LongHelp: strings.TrimSpace(`
+'tailscale set' changes the settings named by its flags, leaving all
+others as they are. Unlike 'tailscale up', you don't need to repeat
+settings you've already made, and it never logs in or brings Tailscale
+up or down.
+
+To put a setting back to its default, name it in --reset, as in
+'tailscale set --reset=exit-node,hostname'.
+
+With --json, it prints the resulting settings as JSON; 'tailscale set
+--json' on its own prints the current ones.
+`),
+	FlagSet: setFlagSet,
+	Exec:    runSet,
+}
+
+var setFlagSet = newSetFlagSet(effectiveGOOS(), &setArgs)
+
+type setArgsT struct {
+	reset                  string
+	json                   bool
+	acceptRoutes           bool
+	acceptDNS              bool
+	exitNodeIP             string
+	exitNodeAllowLANAccess bool
+	shieldsUp              bool
+	runSSH                 bool
+	hostname               string
+	advertiseRoutes        string
+	advertiseDefaultRoute  bool
+	opUser                 string
+	snat                   bool
+	netfilterMode          string
+	forceDaemon            bool
+}
+
+var setArgs setArgsT
+
+// newSetFlagSet returns the flags of 'tailscale set'. Each one, other
+// than --reset and --json, sets the same prefs as the 'tailscale up'
+// flag of the same name, and has the same default.
+func newSetFlagSet(goos string, setArgs *setArgsT) *flag.FlagSet {
+	setf := newFlagSet("set")
+
+	setf.StringVar(&setArgs.reset, "reset", "", `comma-separated settings to reset to their default values (e.g. "exit-node,hostname")`)
+	setf.BoolVar(&setArgs.json, "json", false, "output the resulting settings in JSON format (WARNING: format subject to change)")
+
+	setf.BoolVar(&setArgs.acceptRoutes, "accept-routes", acceptRouteDefault(goos), "accept routes advertised by other Tailscale nodes")
+	setf.BoolVar(&setArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
+	setf.StringVar(&setArgs.exitNodeIP, "exit-node", "", "Tailscale exit node (IP or base name) for internet traffic, or empty string to not use an exit node")
+	setf.BoolVar(&setArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
+	setf.BoolVar(&setArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
+	setf.BoolVar(&setArgs.runSSH, "ssh", false, "run an SSH server, permitting access per tailnet admin's declared policy")
+	setf.StringVar(&setArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
+	setf.StringVar(&setArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
+	setf.BoolVar(&setArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+	if safesocket.GOOSUsesPeerCreds(goos) {
+		setf.StringVar(&setArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
+	}
+	switch goos {
+	case "linux":
+		setf.BoolVar(&setArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes")
+		setf.StringVar(&setArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off); off is routes-only mode, leaving all firewalling and NAT to the system's firewall")
+	case "windows":
+		setf.BoolVar(&setArgs.forceDaemon, "unattended", false, "run in \"Unattended Mode\" where Tailscale keeps running even after the current GUI user logs out (Windows-only)")
+	}
+	return setf
+}
+
+func runSet(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	if setFlagSet.NFlag() == 0 {
+		return flag.ErrHelp
+	}
+
+	curPrefs, err := localClient.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return err
+	}
+	mp, err := calcSetPrefs(setFlagSet, &setArgs, curPrefs, st)
+	if err != nil {
+		return err
+	}
+
+	edit := setArgs.reset != ""
+	setFlagSet.Visit(func(f *flag.Flag) {
+		edit = edit || !preflessFlag(f.Name)
+	})
+	prefs := curPrefs
+	if edit {
+		if prefs, err = localClient.EditPrefs(ctx, mp); err != nil {
+			return err
+		}
+		if mp.RunSSHSet && prefs.RunSSH {
+			checkSSHUpWarnings(ctx)
+		}
+	}
+	if setArgs.json {
+		p := prefs.Clone()
+		p.Persist = nil // don't print private keys
+		j, err := json.MarshalIndent(p, "", "\t")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+	}
+	return nil
+}
+
+// calcSetPrefs returns the prefs edit made by the 'tailscale set' flags
+// in fs, whose values are in setArgs, given the current prefs and
+// status. Settings named by --reset are set to their flags' defaults.
+//
+// It makes no LocalAPI calls, so it can be tested.
+func calcSetPrefs(fs *flag.FlagSet, setArgs *setArgsT, curPrefs *ipn.Prefs, st *ipnstate.Status) (*ipn.MaskedPrefs, error) {
+	flagIsSet := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		flagIsSet[f.Name] = true
+	})
+	if setArgs.reset != "" {
+		for _, name := range strings.Split(setArgs.reset, ",") {
+			name = strings.TrimSpace(name)
+			f := fs.Lookup(name)
+			if f == nil || preflessFlag(name) {
+				return nil, fmt.Errorf("--reset: unknown setting %q", name)
+			}
+			if flagIsSet[name] {
+				return nil, fmt.Errorf("--reset: can't both set and reset %q", name)
+			}
+			if err := f.Value.Set(f.DefValue); err != nil {
+				return nil, err
+			}
+			flagIsSet[name] = true
+		}
+	}
+
+	mp := &ipn.MaskedPrefs{Prefs: *curPrefs.Clone()}
+	p := &mp.Prefs
+	for name := range flagIsSet {
+		if preflessFlag(name) {
+			continue
+		}
+		updateMaskedPrefsFromUpFlag(mp, name)
+		switch name {
+		case "accept-routes":
+			p.RouteAll = setArgs.acceptRoutes
+		case "accept-dns":
+			p.CorpDNS = setArgs.acceptDNS
+		case "exit-node":
+			p.ClearExitNode()
+			if setArgs.exitNodeIP != "" {
+				if err := p.SetExitNodeIP(setArgs.exitNodeIP, st); err != nil {
+					var e ipn.ExitNodeLocalIPError
+					if errors.As(err, &e) {
+						return nil, fmt.Errorf("%w; did you mean --advertise-exit-node?", err)
+					}
+					return nil, err
+				}
+			}
+		case "exit-node-allow-lan-access":
+			p.ExitNodeAllowLANAccess = setArgs.exitNodeAllowLANAccess
+		case "shields-up":
+			p.ShieldsUp = setArgs.shieldsUp
+		case "ssh":
+			p.RunSSH = setArgs.runSSH
+		case "hostname":
+			if len(setArgs.hostname) > 256 {
+				return nil, fmt.Errorf("hostname too long: %d bytes (max 256)", len(setArgs.hostname))
+			}
+			p.Hostname = setArgs.hostname
+		case "advertise-routes", "advertise-exit-node":
+			// Both flags set AdvertiseRoutes; keep the current
+			// value of whichever isn't being changed.
+			routes := setArgs.advertiseRoutes
+			if !flagIsSet["advertise-routes"] {
+				routes = joinPrefixes(withoutExitNodes(curPrefs.AdvertiseRoutes))
+			}
+			exit := setArgs.advertiseDefaultRoute
+			if !flagIsSet["advertise-exit-node"] {
+				exit = hasExitNodeRoutes(curPrefs.AdvertiseRoutes)
+			}
+			rr, err := calcAdvertiseRoutes(routes, exit)
+			if err != nil {
+				return nil, err
+			}
+			p.AdvertiseRoutes = rr
+		case "operator":
+			p.OperatorUser = setArgs.opUser
+		case "snat-subnet-routes":
+			p.NoSNAT = !setArgs.snat
+		case "netfilter-mode":
+			switch setArgs.netfilterMode {
+			case "on":
+				p.NetfilterMode = preftype.NetfilterOn
+			case "nodivert":
+				p.NetfilterMode = preftype.NetfilterNoDivert
+				warnf("netfilter=nodivert; add iptables calls to ts-* chains manually.")
+			case "off":
+				p.NetfilterMode = preftype.NetfilterOff
+			default:
+				return nil, fmt.Errorf("invalid value --netfilter-mode=%q", setArgs.netfilterMode)
+			}
+		case "unattended":
+			p.ForceDaemon = setArgs.forceDaemon
+		default:
+			panic(fmt.Sprintf("internal error: unhandled set flag %q", name))
+		}
+	}
+
+	if p.ExitNodeAllowLANAccess && mp.ExitNodeAllowLANAccessSet && p.ExitNodeIP.IsZero() && p.ExitNodeID.IsZero() {
+		return nil, errors.New("--exit-node-allow-lan-access can only be used with an exit node")
+	}
+	return mp, nil
+}
+
+// joinPrefixes returns rr as a comma-separated list, as taken by
+// --advertise-routes.
+func joinPrefixes(rr []netaddr.IPPrefix) string {
+	var sb strings.Builder
+	for i, r := range rr {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(r.String())
+	}
+	return sb.String()
+}
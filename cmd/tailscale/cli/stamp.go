@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+var stampCmd = &ffcli.Command{
+	Name:       "stamp",
+	Exec:       runStamp,
+	ShortHelp:  "Mark the current moment in tailscaled's logs and metrics",
+	ShortUsage: "stamp [--upload=false] [note...]",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale stamp' command writes a marker, along with an optional note,
+to tailscaled's logs and bumps a client metric. It prints the marker, which
+you can then give to Tailscale support to say when the problem you're
+reproducing happened ("right after STAMP-...").
+
+With --upload=false, the marker is only written to tailscaled's local log.
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("stamp")
+		fs.BoolVar(&stampArgs.upload, "upload", true, "upload the marker to Tailscale along with the rest of the logs")
+		return fs
+	})(),
+}
+
+var stampArgs struct {
+	upload bool
+}
+
+func runStamp(ctx context.Context, args []string) error {
+	marker, err := localClient.Stamp(ctx, strings.Join(args, " "), stampArgs.upload)
+	if err != nil {
+		return err
+	}
+	outln(marker)
+	return nil
+}
@@ -11,10 +11,13 @@
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"github.com/toqueteos/webbrowser"
@@ -27,7 +30,7 @@
 
 var statusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "status [--active] [--web] [--json]",
+	ShortUsage: "status [--active] [--web] [--json] [--listening]",
 	ShortHelp:  "Show state of tailscaled and its connections",
 	LongHelp: strings.TrimSpace(`
 
@@ -54,6 +57,8 @@
 		fs.BoolVar(&statusArgs.peers, "peers", true, "show status of peers")
 		fs.StringVar(&statusArgs.listen, "listen", "127.0.0.1:8384", "listen address for web mode; use port 0 for automatic")
 		fs.BoolVar(&statusArgs.browser, "browser", true, "Open a browser in web mode")
+		fs.BoolVar(&statusArgs.verboseRelay, "verbose-relay", false, "show how many bytes DERP servers have relayed to each peer")
+		fs.BoolVar(&statusArgs.listening, "listening", false, "instead of peers, show this machine's listening ports and which peers can reach them")
 		return fs
 	})(),
 }
@@ -66,6 +71,9 @@
 	active  bool   // in CLI mode, filter output to only peers with active sessions
 	self    bool   // in CLI mode, show status of local machine
 	peers   bool   // in CLI mode, show status of peer machines
+
+	verboseRelay bool // in CLI mode, show bytes relayed through DERP per peer
+	listening    bool // show listening ports and who can reach them
 }
 
 func runStatus(ctx context.Context, args []string) error {
@@ -80,6 +88,18 @@ func runStatus(ctx context.Context, args []string) error {
 	if err != nil {
 		return fixTailscaledConnectError(err)
 	}
+	if statusArgs.json && statusArgs.listening {
+		rep, err := localClient.Exposure(ctx)
+		if err != nil {
+			return err
+		}
+		j, err := json.MarshalIndent(rep, "", "  ")
+		if err != nil {
+			return err
+		}
+		printf("%s", j)
+		return nil
+	}
 	if statusArgs.json {
 		if statusArgs.active {
 			for peer, ps := range st.Peer {
@@ -137,12 +157,31 @@ func runStatus(ctx context.Context, args []string) error {
 		}
 		outln()
 	}
+	if st.Telemetry != "" && st.Telemetry != "full" {
+		how := "by preferences"
+		if st.TelemetryRestricted {
+			how = "by tailscaled flag or environment"
+		}
+		printf("# Telemetry: %s (set %s); Tailscale support may be unable to help debug this node.\n", st.Telemetry, how)
+		outln()
+	}
+	if st.TrustedNetwork != "" {
+		printf("# On trusted network %q (see \"tailscale up --trusted-networks\").\n", st.TrustedNetwork)
+		outln()
+	}
+	if st.DSCP == "stripped" {
+		printf("# This network strips DSCP (QoS) markings; not marking interactive traffic.\n")
+		outln()
+	}
 
 	description, ok := isRunningOrStarting(st)
 	if !ok {
 		outln(description)
 		os.Exit(1)
 	}
+	if statusArgs.listening {
+		return runStatusListening(ctx)
+	}
 
 	var buf bytes.Buffer
 	f := func(format string, a ...any) { fmt.Fprintf(&buf, format, a...) }
@@ -190,6 +229,9 @@ func runStatus(ctx context.Context, args []string) error {
 		if anyTraffic {
 			f(", tx %d rx %d", ps.TxBytes, ps.RxBytes)
 		}
+		if statusArgs.verboseRelay && ps.DERPRelayedBytes != 0 {
+			f(", derp relayed %d", ps.DERPRelayedBytes)
+		}
 		f("\n")
 	}
 
@@ -212,11 +254,99 @@ func runStatus(ctx context.Context, args []string) error {
 			}
 			printPS(ps)
 		}
+		if statusArgs.verboseRelay {
+			printRelaySummary(&buf, peers)
+		}
 	}
 	Stdout.Write(buf.Bytes())
 	return nil
 }
 
+// printRelaySummary writes to w the total bytes DERP servers have
+// relayed to peers, and the peers they've relayed the most to.
+func printRelaySummary(w io.Writer, peers []*ipnstate.PeerStatus) {
+	var relayed []*ipnstate.PeerStatus
+	var total int64
+	for _, ps := range peers {
+		if ps.DERPRelayedBytes != 0 {
+			relayed = append(relayed, ps)
+			total += ps.DERPRelayedBytes
+		}
+	}
+	fmt.Fprintln(w)
+	if len(relayed) == 0 {
+		fmt.Fprintln(w, "# No traffic relayed through DERP.")
+		return
+	}
+	sort.SliceStable(relayed, func(i, j int) bool {
+		return relayed[i].DERPRelayedBytes > relayed[j].DERPRelayedBytes
+	})
+	fmt.Fprintf(w, "# DERP relayed %d bytes to %d peers:\n", total, len(relayed))
+	for _, ps := range relayed {
+		var direct string
+		if ps.CurAddr != "" {
+			direct = " (now direct)"
+		}
+		fmt.Fprintf(w, "#   %-20s %12d bytes, %.1f%%%s\n",
+			strings.TrimSuffix(ps.DNSName, "."), ps.DERPRelayedBytes,
+			100*float64(ps.DERPRelayedBytes)/float64(total), direct)
+	}
+}
+
+// runStatusListening prints this machine's listening ports and which
+// peers can reach them through its packet filter.
+func runStatusListening(ctx context.Context) error {
+	rep, err := localClient.Exposure(ctx)
+	if err != nil {
+		return err
+	}
+	if rep.ShieldsUp {
+		printf("# Shields up: incoming connections from peers are blocked; showing who could reach each port otherwise.\n")
+		outln()
+	}
+	if len(rep.Ports) == 0 {
+		outln("No listening ports found.")
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(w, "PORT\tPROCESS\tREACHABLE FROM\n")
+	for _, pe := range rep.Ports {
+		process := pe.Process
+		if process == "" {
+			process = "-"
+		}
+		fmt.Fprintf(w, "%s/%d\t%s\t%s\n", pe.Proto, pe.Port, process, exposureSummary(pe))
+	}
+	return w.Flush()
+}
+
+// exposureSummary describes who can reach the port of pe: its ACL tags
+// and peers, or, if no peer can, its sources.
+func exposureSummary(pe ipnstate.PortExposure) string {
+	if len(pe.Srcs) == 0 {
+		return "nobody"
+	}
+	var s string
+	switch {
+	case len(pe.Peers) == 0:
+		srcs := make([]string, len(pe.Srcs))
+		for i, src := range pe.Srcs {
+			srcs[i] = src.String()
+		}
+		s = strings.Join(srcs, ", ")
+	case len(pe.Tags) > 0:
+		s = fmt.Sprintf("%d peers (%s)", len(pe.Peers), strings.Join(pe.Tags, ", "))
+	case len(pe.Peers) <= 3:
+		s = strings.Join(pe.Peers, ", ")
+	default:
+		s = fmt.Sprintf("%d peers", len(pe.Peers))
+	}
+	if pe.Broad {
+		s += " [broad]"
+	}
+	return s
+}
+
 // isRunningOrStarting reports whether st is in state Running or Starting.
 // It also returns a description of the status suitable to display to a user.
 func isRunningOrStarting(st *ipnstate.Status) (description string, ok bool) {
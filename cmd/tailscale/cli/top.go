@@ -0,0 +1,272 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/key"
+)
+
+var topCmd = &ffcli.Command{
+	Name:       "top",
+	ShortUsage: "top [--flows] [--interval=2s] [--batch] [--json]",
+	ShortHelp:  "Show the peers and flows using the most bandwidth",
+	LongHelp: strings.TrimSpace(`
+'tailscale top' shows the bandwidth to and from each peer, or with
+--flows each TCP/UDP flow, over the last interval, busiest first,
+refreshed every interval until interrupted.
+
+tailscaled only counts traffic while a 'tailscale top' (or another
+LocalAPI client) is watching, so nothing is shown until the first
+interval has passed.
+
+With --batch, each interval is printed below the previous one instead
+of redrawing the screen, for logging. With --json, each interval is
+printed as a JSON object of the form:
+
+  {"Time": "...", "Interval": 2.0, "RxPerSec": 1.5, "TxPerSec": 3,
+   "Peers": [{"Name": "...", "RxPerSec": ..., "TxPerSec": ...,
+              "RxTotal": ..., "TxTotal": ...}, ...]}
+
+where rates are in bytes per second and totals in bytes (with --flows,
+"Flows" replaces "Peers").
+`),
+	Exec: runTop,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("top")
+		fs.DurationVar(&topArgs.interval, "interval", 2*time.Second, "how often to refresh")
+		fs.BoolVar(&topArgs.flows, "flows", false, "show individual flows instead of peers")
+		fs.IntVar(&topArgs.limit, "limit", 20, "maximum number of rows to show; 0 means unlimited")
+		fs.IntVar(&topArgs.count, "n", 0, "number of intervals to show before exiting; 0 means until interrupted")
+		fs.BoolVar(&topArgs.batch, "batch", false, "print each interval below the last instead of redrawing the screen")
+		fs.BoolVar(&topArgs.json, "json", false, "output in JSON format, one object per interval (WARNING: format subject to change)")
+		return fs
+	})(),
+}
+
+var topArgs struct {
+	interval time.Duration
+	flows    bool
+	limit    int
+	count    int
+	batch    bool
+	json     bool
+}
+
+// topFlowKey identifies a flow across FlowStats calls.
+type topFlowKey struct {
+	proto  ipproto.Proto
+	local  netaddr.IPPort
+	remote netaddr.IPPort
+}
+
+// topRate is the traffic of a peer or flow over an interval, and in
+// total since 'tailscale top' started.
+type topRate struct {
+	Name     string  // peer name, or flow description
+	RxPerSec float64 // bytes per second received by this node
+	TxPerSec float64 // bytes per second sent by this node
+	RxTotal  uint64
+	TxTotal  uint64
+}
+
+// topSample is one interval of 'tailscale top' output.
+type topSample struct {
+	Time     time.Time
+	Interval float64 // seconds
+	RxPerSec float64 // all traffic, including rows beyond --limit
+	TxPerSec float64
+	Peers    []topRate `json:",omitempty"`
+	Flows    []topRate `json:",omitempty"`
+}
+
+func runTop(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale top'")
+	}
+	if topArgs.interval < 100*time.Millisecond {
+		return errors.New("--interval must be at least 100ms")
+	}
+	// The first call starts tailscaled's flow accounting, unless
+	// another client already did.
+	flows, err := localClient.FlowStats(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	base := map[topFlowKey]ipnstate.FlowStat{} // at start, for totals
+	for _, f := range flows {
+		base[topFlowKey{f.Proto, f.Local, f.Remote}] = f
+	}
+	last := base // at previous interval, for rates
+	lastTime := time.Now()
+
+	ticker := time.NewTicker(topArgs.interval)
+	defer ticker.Stop()
+	for i := 0; topArgs.count == 0 || i < topArgs.count; i++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		flows, err := localClient.FlowStats(ctx)
+		if err != nil {
+			return err
+		}
+		st, err := localClient.Status(ctx)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		sample := topSample{Time: now, Interval: now.Sub(lastTime).Seconds()}
+		cur := make(map[topFlowKey]ipnstate.FlowStat, len(flows))
+		peers := map[key.NodePublic]*topRate{}
+		for _, f := range flows {
+			k := topFlowKey{f.Proto, f.Local, f.Remote}
+			cur[k] = f
+			r := topFlowRate(f, last[k], base[k], sample.Interval)
+			r.Name = fmt.Sprintf("%v %v => %v", f.Proto, f.Local, f.Remote)
+			if ps, ok := st.Peer[f.Peer]; ok {
+				r.Name += " (" + dnsOrQuoteHostname(st, ps) + ")"
+			}
+			sample.Flows = append(sample.Flows, r)
+			sample.RxPerSec += r.RxPerSec
+			sample.TxPerSec += r.TxPerSec
+
+			pr := peers[f.Peer]
+			if pr == nil {
+				pr = &topRate{Name: topPeerName(st, f.Peer)}
+				peers[f.Peer] = pr
+			}
+			pr.RxPerSec += r.RxPerSec
+			pr.TxPerSec += r.TxPerSec
+			pr.RxTotal += r.RxTotal
+			pr.TxTotal += r.TxTotal
+		}
+		for _, pr := range peers {
+			sample.Peers = append(sample.Peers, *pr)
+		}
+		sortTopRates(sample.Peers)
+		sortTopRates(sample.Flows)
+		if topArgs.flows {
+			sample.Peers = nil
+			sample.Flows = limitTopRates(sample.Flows)
+		} else {
+			sample.Flows = nil
+			sample.Peers = limitTopRates(sample.Peers)
+		}
+		last, lastTime = cur, now
+
+		if topArgs.json {
+			j, err := json.Marshal(sample)
+			if err != nil {
+				return err
+			}
+			outln(string(j))
+			continue
+		}
+		printTopSample(sample)
+	}
+	return nil
+}
+
+// topFlowRate returns the rates of flow f over an interval of secs
+// seconds since prev, and its totals since base.
+func topFlowRate(f, prev, base ipnstate.FlowStat, secs float64) topRate {
+	// tailscaled may have forgotten the flow and started it again
+	// from zero.
+	if f.RxBytes < prev.RxBytes || f.TxBytes < prev.TxBytes {
+		prev = ipnstate.FlowStat{}
+	}
+	if f.RxBytes < base.RxBytes || f.TxBytes < base.TxBytes {
+		base = ipnstate.FlowStat{}
+	}
+	return topRate{
+		RxPerSec: float64(f.RxBytes-prev.RxBytes) / secs,
+		TxPerSec: float64(f.TxBytes-prev.TxBytes) / secs,
+		RxTotal:  f.RxBytes - base.RxBytes,
+		TxTotal:  f.TxBytes - base.TxBytes,
+	}
+}
+
+func topPeerName(st *ipnstate.Status, k key.NodePublic) string {
+	if ps, ok := st.Peer[k]; ok {
+		return dnsOrQuoteHostname(st, ps)
+	}
+	return "(unknown peer)"
+}
+
+// sortTopRates sorts rs busiest first over the last interval, then over
+// the whole run.
+func sortTopRates(rs []topRate) {
+	sort.Slice(rs, func(i, j int) bool {
+		ri, rj := rs[i].RxPerSec+rs[i].TxPerSec, rs[j].RxPerSec+rs[j].TxPerSec
+		if ri != rj {
+			return ri > rj
+		}
+		ti, tj := rs[i].RxTotal+rs[i].TxTotal, rs[j].RxTotal+rs[j].TxTotal
+		if ti != tj {
+			return ti > tj
+		}
+		return rs[i].Name < rs[j].Name
+	})
+}
+
+func limitTopRates(rs []topRate) []topRate {
+	if topArgs.limit > 0 && len(rs) > topArgs.limit {
+		return rs[:topArgs.limit]
+	}
+	return rs
+}
+
+func printTopSample(s topSample) {
+	if !topArgs.batch {
+		printf("\x1b[H\x1b[2J") // home cursor and clear screen
+	} else {
+		outln()
+	}
+	rows, what := s.Peers, "PEER"
+	if topArgs.flows {
+		rows, what = s.Flows, "FLOW"
+	}
+	printf("%s  every %v  in %s/s  out %s/s\n\n", s.Time.Format("15:04:05"), topArgs.interval, formatTopBytes(s.RxPerSec), formatTopBytes(s.TxPerSec))
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "IN/s\tOUT/s\tIN TOTAL\tOUT TOTAL\t  %s\n", what)
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t  %s\n",
+			formatTopBytes(r.RxPerSec),
+			formatTopBytes(r.TxPerSec),
+			formatTopBytes(float64(r.RxTotal)),
+			formatTopBytes(float64(r.TxTotal)),
+			r.Name)
+	}
+	w.Flush()
+}
+
+// formatTopBytes formats n bytes with a decimal unit suffix.
+func formatTopBytes(n float64) string {
+	const units = "kMGTP"
+	if n < 1000 {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	i := -1
+	for n >= 1000 && i < len(units)-1 {
+		n /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f%cB", n, units[i])
+}
@@ -27,6 +27,7 @@
 	"inet.af/netaddr"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/trustednet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
@@ -52,9 +53,9 @@
 If flags are specified, the flags must be the complete set of desired
 settings. An error is returned if any setting would be changed as a
 result of an unspecified flag's default value, unless the --reset flag
-is also used. (The flags --auth-key, --force-reauth, and --qr are not
-considered settings that need to be re-specified when modifying
-settings.)
+is also used. (The flags --auth-key, --force-reauth, --qr and
+--enrollment are not considered settings that need to be re-specified
+when modifying settings.)
 `),
 	FlagSet: upFlagSet,
 	Exec:    runUp,
@@ -102,20 +103,28 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.BoolVar(&upArgs.runSSH, "ssh", false, "run an SSH server, permitting access per tailnet admin's declared policy")
 	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
 	upf.StringVar(&upArgs.authKeyOrFile, "auth-key", "", `node authorization key; if it begins with "file:", then it's a path to a file containing the authkey`)
+	upf.StringVar(&upArgs.enrollment, "enrollment", "", "file containing a pre-signed node key from 'tailscale lock presign' to log in with, for joining a tailnet with network-lock enabled")
+	upf.StringVar(&upArgs.enrollmentPassphrase, "enrollment-passphrase", "", `passphrase of the --enrollment file; if it begins with "file:", then it's a path to a file containing the passphrase`)
 	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
 	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
 	upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+	upf.StringVar(&upArgs.trustedNetworks, "trusted-networks", "", `comma-separated networks on which not to use the exit node, each "ssid:<Wi-Fi name>", "dns:<search domain>" or "gateway:<MAC address>"`)
+	upf.BoolVar(&upArgs.trustedNetworksIdle, "trusted-networks-idle", false, "on a network listed in --trusted-networks, don't route any traffic over Tailscale")
+	upf.DurationVar(&upArgs.nodeKeyRotation, "node-key-rotation", 0, "how often to rotate the node key, without logging in again (e.g. \"720h\"); default (0s) rotates it only when it expires")
+	upf.StringVar(&upArgs.telemetry, "telemetry", "full", "telemetry to upload to Tailscale (one of full, health-only, none); Tailscale support can't help debug nodes that don't upload logs")
 	if safesocket.GOOSUsesPeerCreds(goos) {
 		upf.StringVar(&upArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
 	}
 	switch goos {
 	case "linux":
 		upf.BoolVar(&upArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes")
-		upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off)")
+		upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off); off is routes-only mode, leaving all firewalling and NAT to the system's firewall")
 	case "windows":
 		upf.BoolVar(&upArgs.forceDaemon, "unattended", false, "run in \"Unattended Mode\" where Tailscale keeps running even after the current GUI user logs out (Windows-only)")
 	}
-	upf.DurationVar(&upArgs.timeout, "timeout", 0, "maximum amount of time to wait for tailscaled to enter a Running state; default (0s) blocks forever")
+	upf.DurationVar(&upArgs.duration, "duration", 0, "log out automatically after this long (e.g. \"2h\"), even if tailscaled restarts meanwhile; default (0s) stays logged in")
+	upf.DurationVar(&upArgs.timeout, "timeout", 0, "maximum amount of time to wait for tailscaled to enter a Running state, and then for --wait-for; default (0s) blocks forever")
+	upf.StringVar(&upArgs.waitFor, "wait-for", "", `after starting, also wait until the tailnet is ready: "peers" once peers are configured, "routes" once subnet routes are too, or "exitnode" once the exit node is online`)
 	registerAcceptRiskFlag(upf)
 	return upf
 }
@@ -146,14 +155,27 @@ type upArgsT struct {
 	snat                   bool
 	netfilterMode          string
 	authKeyOrFile          string // "secret" or "file:/path/to/secret"
+	enrollment             string // path to sealed tka.Enrollment
+	enrollmentPassphrase   string // "secret" or "file:/path/to/secret"
 	hostname               string
 	opUser                 string
+	telemetry              string
+	trustedNetworks        string
+	trustedNetworksIdle    bool
+	nodeKeyRotation        time.Duration
+	duration               time.Duration
 	json                   bool
 	timeout                time.Duration
+	waitFor                string
 }
 
 func (a upArgsT) getAuthKey() (string, error) {
-	v := a.authKeyOrFile
+	return readSecretOrFile(a.authKeyOrFile)
+}
+
+// readSecretOrFile returns v, or if it begins with "file:", the contents
+// of the file it names, without surrounding whitespace.
+func readSecretOrFile(v string) (string, error) {
 	if strings.HasPrefix(v, "file:") {
 		file := strings.TrimPrefix(v, "file:")
 		b, err := os.ReadFile(file)
@@ -328,6 +350,36 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	prefs.ForceDaemon = upArgs.forceDaemon
 	prefs.OperatorUser = upArgs.opUser
 
+	if upArgs.trustedNetworks != "" {
+		prefs.TrustedNetworks = strings.Split(upArgs.trustedNetworks, ",")
+		for _, r := range prefs.TrustedNetworks {
+			if err := trustednet.ParseRule(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	prefs.TrustedNetworksIdle = upArgs.trustedNetworksIdle
+
+	if upArgs.nodeKeyRotation < 0 || (upArgs.nodeKeyRotation > 0 && upArgs.nodeKeyRotation < ipn.MinNodeKeyRotation) {
+		return nil, fmt.Errorf("--node-key-rotation must be 0 or at least %v", ipn.MinNodeKeyRotation)
+	}
+	prefs.NodeKeyRotation = upArgs.nodeKeyRotation
+
+	if upArgs.duration < 0 {
+		return nil, fmt.Errorf("invalid --duration %v", upArgs.duration)
+	}
+	if upArgs.duration > 0 {
+		at := time.Now().Add(upArgs.duration).Round(time.Second)
+		prefs.LogoutAt = &at
+	}
+
+	if upArgs.telemetry != "" {
+		prefs.Telemetry, err = preftype.ParseTelemetryLevel(upArgs.telemetry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if goos == "linux" {
 		prefs.NoSNAT = !upArgs.snat
 
@@ -385,6 +437,7 @@ func updatePrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) (simpleUp bool, jus
 	justEdit := env.backendState == ipn.Running.String() &&
 		!env.upArgs.forceReauth &&
 		env.upArgs.authKeyOrFile == "" &&
+		env.upArgs.enrollment == "" &&
 		!controlURLChanged &&
 		!tagsChanged
 
@@ -408,6 +461,17 @@ func runUp(ctx context.Context, args []string) (retErr error) {
 	if len(args) > 0 {
 		fatalf("too many non-flag arguments: %q", args)
 	}
+	switch upArgs.waitFor {
+	case "":
+	case "peers", "routes", "exitnode":
+		defer func() {
+			if retErr == nil {
+				retErr = waitForReady(ctx, upArgs.waitFor, upArgs.timeout)
+			}
+		}()
+	default:
+		return fmt.Errorf("invalid --wait-for value %q; want peers, routes or exitnode", upArgs.waitFor)
+	}
 
 	st, err := localClient.Status(ctx)
 	if err != nil {
@@ -496,6 +560,16 @@ func runUp(ctx context.Context, args []string) (retErr error) {
 		return err
 	}
 
+	if upArgs.enrollment != "" {
+		e, err := openEnrollment(upArgs.enrollment, upArgs.enrollmentPassphrase)
+		if err != nil {
+			return err
+		}
+		if err := localClient.SetPresignedNodeKey(ctx, e.NodeKey, e.Signature); err != nil {
+			return err
+		}
+	}
+
 	// At this point we need to subscribe to the IPN bus to watch
 	// for state transitions and possible need to authenticate.
 	c, bc, pumpCtx, cancel := connect(ctx)
@@ -682,6 +756,15 @@ func runUp(ctx context.Context, args []string) (retErr error) {
 	}
 }
 
+// waitForReady waits, for up to timeout if positive, until tailscaled
+// is ready for what, per 'tailscale up --wait-for'.
+func waitForReady(ctx context.Context, what string, timeout time.Duration) error {
+	if err := localClient.WaitReady(ctx, what, timeout); err != nil {
+		return fmt.Errorf("--wait-for=%s: %w", what, err)
+	}
+	return nil
+}
+
 func checkSSHUpWarnings(ctx context.Context) {
 	if !upArgs.runSSH {
 		return
@@ -740,6 +823,11 @@ func init() {
 	addPrefFlagMapping("unattended", "ForceDaemon")
 	addPrefFlagMapping("operator", "OperatorUser")
 	addPrefFlagMapping("ssh", "RunSSH")
+	addPrefFlagMapping("telemetry", "Telemetry")
+	addPrefFlagMapping("trusted-networks", "TrustedNetworks")
+	addPrefFlagMapping("trusted-networks-idle", "TrustedNetworksIdle")
+	addPrefFlagMapping("node-key-rotation", "NodeKeyRotation")
+	addPrefFlagMapping("duration", "LogoutAt")
 }
 
 func addPrefFlagMapping(flagName string, prefNames ...string) {
@@ -757,7 +845,7 @@ func addPrefFlagMapping(flagName string, prefNames ...string) {
 // correspond to an ipn.Pref.
 func preflessFlag(flagName string) bool {
 	switch flagName {
-	case "auth-key", "force-reauth", "reset", "qr", "json", "timeout", "accept-risk":
+	case "auth-key", "force-reauth", "reset", "qr", "json", "timeout", "wait-for", "accept-risk", "enrollment", "enrollment-passphrase":
 		return true
 	}
 	return false
@@ -888,15 +976,31 @@ type isBool interface {
 // curUser is os.Getenv("USER"). It's pulled out for testability.
 func applyImplicitPrefs(prefs, oldPrefs *ipn.Prefs, env upCheckEnv) {
 	explicitOperator := false
+	explicitDuration := false
 	env.flagSet.Visit(func(f *flag.Flag) {
-		if f.Name == "operator" {
+		switch f.Name {
+		case "operator":
 			explicitOperator = true
+		case "duration":
+			explicitDuration = true
 		}
 	})
 
 	if prefs.OperatorUser == "" && oldPrefs.OperatorUser == env.user && !explicitOperator {
 		prefs.OperatorUser = oldPrefs.OperatorUser
 	}
+
+	// Static DNS records are managed by "tailscale dns", not by up flags.
+	prefs.StaticDNSRecords = oldPrefs.StaticDNSRecords
+
+	// Likewise persisted log levels, by "tailscale debug loglevel".
+	prefs.LogLevels = oldPrefs.LogLevels
+
+	// A time-boxed access period keeps running unless --duration
+	// (or --reset) is given again; other flags don't lift it.
+	if !explicitDuration {
+		prefs.LogoutAt = oldPrefs.LogoutAt
+	}
 }
 
 func flagAppliesToOS(flag, goos string) bool {
@@ -976,6 +1080,20 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(prefs.NetfilterMode.String())
 		case "unattended":
 			set(prefs.ForceDaemon)
+		case "telemetry":
+			set(prefs.Telemetry.String())
+		case "trusted-networks":
+			set(strings.Join(prefs.TrustedNetworks, ","))
+		case "trusted-networks-idle":
+			set(prefs.TrustedNetworksIdle)
+		case "node-key-rotation":
+			set(prefs.NodeKeyRotation)
+		case "duration":
+			var at time.Time
+			if prefs.LogoutAt != nil {
+				at = *prefs.LogoutAt
+			}
+			set(at)
 		}
 	})
 	return ret
@@ -0,0 +1,157 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+var wakeCmd = &ffcli.Command{
+	Name:       "wake",
+	Exec:       runWake,
+	ShortHelp:  "Wake a machine on a subnet router's LAN",
+	ShortUsage: "wake [--via=<router>] <hostname-or-IP|MAC>",
+	LongHelp: strings.TrimSpace(`
+'tailscale wake' asks a subnet router to send a Wake-on-LAN packet on
+its local networks, waking a machine there from anywhere on the
+tailnet. The router must grant this device the Wake-on-LAN capability.
+
+The machine can be given by its MAC address, or as a Tailscale device
+that advertises its MAC addresses (by running tailscaled with
+TS_WAKE_MAC set to "auto" or to a comma-separated list of MACs).
+
+Without --via, the router is the online subnet router that routes the
+device's LAN addresses, or for a MAC address, the only online subnet
+router.
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("wake")
+		fs.StringVar(&wakeArgs.via, "via", "", "hostname or IP of the subnet router to send the Wake-on-LAN packet from")
+		return fs
+	})(),
+}
+
+var wakeArgs struct {
+	via string
+}
+
+func runWake(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: wake [--via=<router>] <hostname-or-IP|MAC>")
+	}
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	var macs []net.HardwareAddr
+	var target *tailcfg.Node // or nil if waking a bare MAC
+	if mac, err := net.ParseMAC(args[0]); err == nil {
+		macs = append(macs, mac)
+	} else {
+		ipStr, self, err := tailscaleIPFromArg(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if self {
+			return errors.New("this device is already awake")
+		}
+		ip, err := netaddr.ParseIP(ipStr)
+		if err != nil {
+			return err
+		}
+		who, err := localClient.WhoIs(ctx, netaddr.IPPortFrom(ip, 0).String())
+		if err != nil {
+			return err
+		}
+		target = who.Node
+		for _, s := range target.Hostinfo.WoLMACs().AsSlice() {
+			if mac, err := net.ParseMAC(s); err == nil {
+				macs = append(macs, mac)
+			}
+		}
+		if len(macs) == 0 {
+			return fmt.Errorf("%s doesn't advertise any MAC addresses to wake; give its MAC address instead", args[0])
+		}
+	}
+
+	var via netaddr.IP
+	if wakeArgs.via != "" {
+		ipStr, self, err := tailscaleIPFromArg(ctx, wakeArgs.via)
+		if err != nil {
+			return err
+		}
+		if self {
+			return errors.New("--via must be another device")
+		}
+		if via, err = netaddr.ParseIP(ipStr); err != nil {
+			return err
+		}
+	} else {
+		router, err := wakeRouter(st, target)
+		if err != nil {
+			return err
+		}
+		via = router.TailscaleIPs[0]
+	}
+
+	for _, mac := range macs {
+		res, err := localClient.WakeOnLAN(ctx, via, mac)
+		if err != nil {
+			return err
+		}
+		for _, e := range res.Errors {
+			printf("error sending Wake-on-LAN packet for %v: %s\n", mac, e)
+		}
+		if len(res.SentTo) == 0 {
+			return fmt.Errorf("no Wake-on-LAN packet sent for %v", mac)
+		}
+		printf("Sent Wake-on-LAN packet for %v via %v on %s\n", mac, via, strings.Join(res.SentTo, ", "))
+	}
+	return nil
+}
+
+// wakeRouter picks the subnet router to wake target from: the online
+// one whose routes cover one of target's endpoints, or if target is nil
+// (or none do), the only online subnet router.
+func wakeRouter(st *ipnstate.Status, target *tailcfg.Node) (*ipnstate.PeerStatus, error) {
+	var routers []*ipnstate.PeerStatus
+	for _, ps := range st.Peer {
+		if ps.Online && ps.PrimaryRoutes != nil && ps.PrimaryRoutes.Len() > 0 && len(ps.TailscaleIPs) > 0 {
+			routers = append(routers, ps)
+		}
+	}
+	if target != nil {
+		for _, ep := range target.Endpoints {
+			ipp, err := netaddr.ParseIPPort(ep)
+			if err != nil {
+				continue
+			}
+			for _, ps := range routers {
+				if ps.PrimaryRoutes.ContainsFunc(func(r netaddr.IPPrefix) bool {
+					return r.Bits() > 0 && r.Contains(ipp.IP()) // not via an exit route
+				}) {
+					return ps, nil
+				}
+			}
+		}
+	}
+	switch len(routers) {
+	case 0:
+		return nil, errors.New("no online subnet router found; use --via to pick the device to send the Wake-on-LAN packet from")
+	case 1:
+		return routers[0], nil
+	}
+	return nil, errors.New("more than one online subnet router found; use --via to pick one")
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// loadConfigFile sets tailscaled's flags from the JSON object in the
+// file at path, which maps flag names to values, as in:
+//
+//	{"statedir": "/var/lib/tailscale", "port": 41641, "no-logs-no-support": true}
+//
+// Flags set on fs's command line take precedence over the file. The
+// file is only ever read, so it can live on a read-only filesystem
+// such as NixOS's /nix/store or an appliance image.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var conf map[string]any
+	if err := d.Decode(&conf); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	onCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+	names := make([]string, 0, len(conf))
+	for name := range conf {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+		if onCommandLine[name] {
+			continue
+		}
+		var s string
+		switch v := conf[name].(type) {
+		case string:
+			s = v
+		case json.Number:
+			s = v.String()
+		case bool:
+			s = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("config file %s: setting %q: want string, number or bool, got %T", path, name, v)
+		}
+		if err := f.Value.Set(s); err != nil {
+			return fmt.Errorf("config file %s: setting %q: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// checkStateSeparation checks that, with the config file at
+// configPath, mutable state is kept apart from config: all of it in
+// statedir, and none of it with the config.
+func checkStateSeparation(configPath, statedir, statepath string) error {
+	if statedir == "" {
+		return errors.New("with --config, --statedir is required, to hold all mutable state")
+	}
+	if !filepath.IsAbs(statedir) {
+		return fmt.Errorf("--statedir %q must be an absolute path", statedir)
+	}
+	in := func(dir, p string) bool {
+		rel, err := filepath.Rel(dir, p)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	if abs, err := filepath.Abs(configPath); err == nil && in(statedir, abs) {
+		return fmt.Errorf("config file %s must not be in --statedir %s", configPath, statedir)
+	}
+	if filepath.IsAbs(statepath) && !in(statedir, statepath) {
+		return fmt.Errorf("with --config, --state %s must be in --statedir %s", statepath, statedir)
+	}
+	return nil
+}
+
+// checkDirWritable reports an error if files can't be created in dir,
+// creating it first if needed.
+func checkDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".writable-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -20,6 +20,7 @@
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/osshare"
+	"tailscale.com/util/winutil"
 )
 
 func init() {
@@ -79,6 +80,10 @@ func installSystemDaemonWindows(args []string) (err error) {
 		return fmt.Errorf("failed to set service recovery actions: %v", err)
 	}
 
+	if err := winutil.InstallEventSource(); err != nil {
+		return fmt.Errorf("failed to register %q event log source: %v", winutil.EventSource, err)
+	}
+
 	return nil
 }
 
@@ -110,6 +115,7 @@ func uninstallSystemDaemonWindows(args []string) (ret error) {
 	if err != nil {
 		return fmt.Errorf("failed to delete service: %v", err)
 	}
+	winutil.RemoveEventSource() // best effort
 
 	bo := backoff.NewBackoff("uninstall", logger.Discard, 30*time.Second)
 	end := time.Now().Add(15 * time.Second)
@@ -0,0 +1,183 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+// Kubernetes Service exposure for the sidecar mode.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/kube"
+	"tailscale.com/types/logger"
+)
+
+// kubeExposeAnnotation is the annotation on a Kubernetes Service that
+// requests that tailscaled running with --kube-services advertise the
+// Service's ClusterIP to the tailnet.
+const kubeExposeAnnotation = "tailscale.com/expose"
+
+const kubeServicesPollInterval = 30 * time.Second
+
+// kubeServicesStateKey is the state key under which the routes
+// watchKubeServices advertised are saved, so that after a restart it
+// still knows which advertised routes are its to withdraw.
+const kubeServicesStateKey = ipn.StateKey("_kube-services")
+
+var errNoPrefs = errors.New("no prefs loaded yet")
+
+// watchKubeServices polls the Kubernetes API for Services in the pod's
+// namespace annotated with kubeExposeAnnotation and keeps lb's advertised
+// routes in sync with their ClusterIPs, until ctx is done.
+//
+// Routes advertised by other means (such as "tailscale up
+// --advertise-routes") are left alone. The routes it manages are
+// saved in store, so those for Services that went away while
+// tailscaled wasn't running are withdrawn after it restarts.
+func watchKubeServices(ctx context.Context, logf logger.Logf, lb *ipnlocal.LocalBackend, store ipn.StateStore) {
+	logf = logger.WithPrefix(logf, "kube-services: ")
+	kc, err := kube.New()
+	if err != nil {
+		logf("not running in a Kubernetes cluster: %v", err)
+		return
+	}
+	managed, err := loadManagedRoutes(store) // routes we advertised last time
+	if err != nil {
+		logf("loading previously advertised routes: %v", err)
+	}
+	t := time.NewTicker(kubeServicesPollInterval)
+	defer t.Stop()
+	for {
+		svcs, err := kc.ListServices(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logf("listing services: %v", err)
+		} else if want := exposedServiceRoutes(svcs); !prefixesEqual(want, managed) {
+			if err := updateManagedRoutes(lb, store, managed, want); err != nil {
+				logf("updating advertised routes: %v", err)
+			} else {
+				logf("advertising %v", want)
+				managed = want
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// exposedServiceRoutes returns the sorted single-IP routes for the
+// ClusterIPs of the services in svcs annotated with kubeExposeAnnotation.
+// Headless services, which have no ClusterIP, are skipped.
+func exposedServiceRoutes(svcs []kube.Service) []netaddr.IPPrefix {
+	var ret []netaddr.IPPrefix
+	for _, svc := range svcs {
+		if !strings.EqualFold(svc.Annotations[kubeExposeAnnotation], "true") {
+			continue
+		}
+		ip, err := netaddr.ParseIP(svc.Spec.ClusterIP)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, netaddr.IPPrefixFrom(ip, ip.BitLen()))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].IP().Less(ret[j].IP()) })
+	return ret
+}
+
+// updateManagedRoutes replaces the managed routes old with want in
+// lb's advertised routes, saving the managed set in store.
+//
+// Before editing the prefs, it saves both old and want, so that if
+// tailscaled dies in between, no route it added is left unmanaged.
+func updateManagedRoutes(lb *ipnlocal.LocalBackend, store ipn.StateStore, old, want []netaddr.IPPrefix) error {
+	if err := saveManagedRoutes(store, append(append([]netaddr.IPPrefix(nil), old...), want...)); err != nil {
+		return err
+	}
+	if err := replaceAdvertisedRoutes(lb, old, want); err != nil {
+		return err
+	}
+	return saveManagedRoutes(store, want)
+}
+
+// loadManagedRoutes returns the managed routes saved in store, if any.
+func loadManagedRoutes(store ipn.StateStore) ([]netaddr.IPPrefix, error) {
+	bs, err := store.ReadState(kubeServicesStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var routes []netaddr.IPPrefix
+	if err := json.Unmarshal(bs, &routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+func saveManagedRoutes(store ipn.StateStore, routes []netaddr.IPPrefix) error {
+	bs, err := json.Marshal(routes)
+	if err != nil {
+		return err
+	}
+	return store.WriteState(kubeServicesStateKey, bs)
+}
+
+// replaceAdvertisedRoutes edits lb's prefs to advertise add instead of
+// remove, keeping any other advertised routes.
+func replaceAdvertisedRoutes(lb *ipnlocal.LocalBackend, remove, add []netaddr.IPPrefix) error {
+	p := lb.Prefs()
+	if p == nil {
+		return errNoPrefs
+	}
+	drop := map[netaddr.IPPrefix]bool{}
+	for _, r := range remove {
+		drop[r] = true
+	}
+	var routes []netaddr.IPPrefix
+	for _, r := range p.AdvertiseRoutes {
+		if !drop[r] {
+			routes = append(routes, r)
+			drop[r] = true // dedup against add
+		}
+	}
+	for _, r := range add {
+		if !drop[r] {
+			routes = append(routes, r)
+		}
+	}
+	_, err := lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:              ipn.Prefs{AdvertiseRoutes: routes},
+		AdvertiseRoutesSet: true,
+	})
+	return err
+}
+
+func prefixesEqual(a, b []netaddr.IPPrefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -11,11 +11,19 @@
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/control/controlproxy"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/types/logger"
 )
 
 // httpProxyHandler returns an HTTP proxy http.Handler using the
@@ -80,3 +88,44 @@ func httpProxyHandler(dialer func(ctx context.Context, netw, addr string) (net.C
 		<-errc
 	})
 }
+
+// startControlProxy starts a controlproxy.Server on addr that lets
+// nodes without direct internet access reach lb's control server,
+// dialed with dial. allow is the comma-separated IP prefixes of the
+// nodes allowed to use it; there must be at least one.
+func startControlProxy(logf logger.Logf, addr, allow string, dial controlproxy.DialFunc, lb *ipnlocal.LocalBackend) error {
+	var allowFrom []netaddr.IPPrefix
+	for _, s := range strings.Split(allow, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			return fmt.Errorf("--control-proxy-allow: %w", err)
+		}
+		allowFrom = append(allowFrom, p)
+	}
+	if len(allowFrom) == 0 {
+		return errors.New("--control-proxy-listen requires --control-proxy-allow, to say which nodes may use it")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logf("control proxy listening on %v for %v", ln.Addr(), allowFrom)
+	hs := &http.Server{Handler: &controlproxy.Server{
+		Logf: logger.WithPrefix(logf, "control-proxy: "),
+		ControlURL: func() string {
+			if p := lb.Prefs(); p != nil {
+				return p.ControlURLOrDefault()
+			}
+			return ""
+		},
+		Dial:      dial,
+		AllowFrom: allowFrom,
+	}}
+	go func() {
+		log.Fatalf("control proxy exited: %v", hs.Serve(ln))
+	}()
+	return nil
+}
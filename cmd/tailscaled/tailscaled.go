@@ -49,12 +49,14 @@
 	"tailscale.com/tsweb"
 	"tailscale.com/types/flagtype"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/preftype"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/multierr"
 	"tailscale.com/util/osshare"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/netstack"
 	"tailscale.com/wgengine/router"
@@ -113,8 +115,20 @@ func defaultTunName() string {
 	verbose        int
 	socksAddr      string // listen address for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
+	controlProxy   string // address of another node's control proxy to reach control through
+	controlProxyLn string // listen address for control proxy server
+	controlProxyOK string // comma-separated prefixes of clients allowed to use the control proxy
+	noLogs         bool   // disable all log and telemetry uploads
+	uploadCrashes  bool   // upload crash reports from previous runs
+	kubeServices   bool   // advertise annotated Kubernetes Services
+	config         string // path of read-only JSON config file of flag values
+	readOnlyState  bool   // keep state in memory if it can't be written
 }
 
+// recentLogLines is how many of tailscaled's most recent log lines
+// are kept in memory for support bundles.
+const recentLogLines = 2000
+
 var (
 	installSystemDaemon   func([]string) error                      // non-nil on some platforms
 	uninstallSystemDaemon func([]string) error                      // non-nil on some platforms
@@ -135,13 +149,21 @@ func main() {
 	flag.StringVar(&args.debug, "debug", "", "listen address ([ip]:port) of optional debug server")
 	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCK5 server (e.g. "localhost:1080")`)
 	flag.StringVar(&args.httpProxyAddr, "outbound-http-proxy-listen", "", `optional [ip]:port to run an outbound HTTP proxy (e.g. "localhost:8080")`)
+	flag.StringVar(&args.controlProxy, "control-proxy", "", `optional [ip]:port of another node's --control-proxy-listen server to reach the control server through, for nodes without direct internet access`)
+	flag.StringVar(&args.controlProxyLn, "control-proxy-listen", "", `optional [ip]:port to run a proxy that lets nodes without direct internet access reach this node's control server (e.g. "192.168.1.2:8081"); requires --control-proxy-allow`)
+	flag.StringVar(&args.controlProxyOK, "control-proxy-allow", "", `comma-separated IP prefixes of the nodes allowed to use the --control-proxy-listen proxy (e.g. "192.168.1.0/24")`)
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
 	flag.Var(flagtype.PortValue(&args.port, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
 	flag.StringVar(&args.statepath, "state", "", "absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM; use 'mem:' to not store state and register as an emphemeral node. If empty and --statedir is provided, the default is <statedir>/tailscaled.state. Default: "+paths.DefaultTailscaledStateFile())
 	flag.StringVar(&args.statedir, "statedir", "", "path to directory for storage of config state, TLS certs, temporary incoming Taildrop files, etc. If empty, it's derived from --state when possible.")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
 	flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
+	flag.BoolVar(&args.kubeServices, "kube-services", false, `advertise the ClusterIPs of Kubernetes Services in the pod's namespace annotated with "tailscale.com/expose: true" as subnet routes`)
+	flag.StringVar(&args.config, "config", envknob.String("TS_CONFIG_FILE"), `path of a JSON file of flag values to start with (e.g. {"statedir": "/var/lib/tailscale"}), never written to; command-line flags take precedence. With it, all mutable state must be in --statedir`)
+	flag.BoolVar(&args.readOnlyState, "allow-readonly-state", envknob.Bool("TS_ALLOW_READONLY_STATE"), "if the state file or --statedir can't be written, as on a read-only root filesystem, keep state in memory with a health warning instead of failing")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
+	flag.BoolVar(&args.noLogs, "no-logs-no-support", envknob.Bool("TS_NO_LOGS_NO_SUPPORT"), "disable all log, client metric, and crash report uploads for the lifetime of the process; Tailscale support will be unable to help debug this node")
+	flag.BoolVar(&args.uploadCrashes, "upload-crash-reports", envknob.Bool("TS_UPLOAD_CRASH_REPORTS"), "upload reports of crashes found in the logs of previous runs, if the node's telemetry level allows; reports are always kept locally")
 
 	if len(os.Args) > 1 {
 		sub := os.Args[1]
@@ -171,6 +193,21 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := magicsock.ExecWithCPUAffinity(); err != nil {
+		log.Printf("not resizing WireGuard worker pools: %v", err)
+	}
+
+	if args.config != "" {
+		if err := loadConfigFile(flag.CommandLine, args.config); err != nil {
+			log.SetFlags(0)
+			log.Fatal(err)
+		}
+		if err := checkStateSeparation(args.config, args.statedir, args.statepath); err != nil {
+			log.SetFlags(0)
+			log.Fatal(err)
+		}
+	}
+
 	if runtime.GOOS == "darwin" && os.Getuid() != 0 && !strings.Contains(args.tunname, "userspace-networking") && !args.cleanup {
 		log.SetFlags(0)
 		log.Fatalf("tailscaled requires root; use sudo tailscaled (or use --tun=userspace-networking)")
@@ -253,6 +290,7 @@ func ipnServerOpts() (o ipnserver.Options) {
 	}
 
 	o.VarRoot = args.statedir
+	o.UploadCrashReports = args.uploadCrashes
 
 	// If an absolute --state is provided but not --statedir, try to derive
 	// a state directory.
@@ -286,6 +324,12 @@ func ipnServerOpts() (o ipnserver.Options) {
 func run() error {
 	var err error
 
+	if args.noLogs {
+		logtail.RestrictTelemetry(preftype.TelemetryNone)
+	}
+	// Hold logs until the node's prefs have been read, as they may
+	// not allow uploading them. LocalBackend sets the level from there.
+	logtail.HoldTelemetry()
 	pol := logpolicy.New(logtail.CollectionNode)
 	pol.SetVerbosityLevel(args.verbose)
 	defer func() {
@@ -305,7 +349,10 @@ func run() error {
 		return nil
 	}
 
-	var logf logger.Logf = log.Printf
+	// recentLogs keeps what's logged after rate limiting, for
+	// "tailscale feedback" bundles.
+	recentLogs := logger.NewRing(recentLogLines)
+	var logf logger.Logf = recentLogs.Wrap(log.Printf)
 	if envknob.Bool("TS_DEBUG_MEMORY") {
 		logf = logger.RusagePrefixLog(logf)
 	}
@@ -414,8 +461,20 @@ func run() error {
 	}()
 
 	opts := ipnServerOpts()
-
-	store, err := store.New(logf, statePathOrDefault())
+	opts.CrashDir = pol.CrashDir
+	opts.RecentLogs = recentLogs
+
+	newStore := store.New
+	if args.readOnlyState {
+		newStore = store.NewOrMemory
+		if opts.VarRoot != "" {
+			if err := checkDirWritable(opts.VarRoot); err != nil {
+				logf("state directory %s not writable; running without Taildrop and TLS cert storage: %v", opts.VarRoot, err)
+				opts.VarRoot = ""
+			}
+		}
+	}
+	store, err := newStore(logf, statePathOrDefault())
 	if err != nil {
 		return fmt.Errorf("store.New: %w", err)
 	}
@@ -424,6 +483,12 @@ func run() error {
 		return fmt.Errorf("ipnserver.New: %w", err)
 	}
 	ns.SetLocalBackend(srv.LocalBackend())
+	srv.LocalBackend().SetControlProxy(args.controlProxy)
+	if args.controlProxyLn != "" {
+		if err := startControlProxy(logf, args.controlProxyLn, args.controlProxyOK, dialer.SystemDial, srv.LocalBackend()); err != nil {
+			return fmt.Errorf("control proxy: %w", err)
+		}
+	}
 	if err := ns.Start(); err != nil {
 		log.Fatalf("failed to start netstack: %v", err)
 	}
@@ -431,6 +496,9 @@ func run() error {
 	if debugMux != nil {
 		debugMux.HandleFunc("/debug/ipn", srv.ServeHTMLStatus)
 	}
+	if args.kubeServices {
+		go watchKubeServices(ctx, logf, srv.LocalBackend(), store)
+	}
 
 	ln, _, err := safesocket.Listen(args.socketpath, safesocket.WindowsLocalPort)
 	if err != nil {
@@ -487,6 +555,14 @@ func tryEngine(logf logger.Logf, linkMon *monitor.Mon, dialer *tsdial.Dialer, na
 		ListenPort:  args.port,
 		LinkMonitor: linkMon,
 		Dialer:      dialer,
+		Shadow:      envknob.Bool("TS_SHADOW_ENGINE"),
+		ShadowHold:  envknob.Bool("TS_SHADOW_HOLD"),
+	}
+	if v := envknob.String("TS_DERP_IDLE_TIMEOUT"); v != "" {
+		conf.DERPIdleTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid TS_DERP_IDLE_TIMEOUT %q: %w", v, err)
+		}
 	}
 
 	useNetstack = name == "userspace-networking"
@@ -4,10 +4,133 @@
 
 package main // import "tailscale.com/cmd/tailscaled"
 
-import "testing"
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/kube"
+)
 
 func TestNothing(t *testing.T) {
 	// This test does nothing on purpose, so we can run
 	// GODEBUG=memprofilerate=1 go test -v -run=Nothing -memprofile=prof.mem
 	// without any errors about no matching tests.
 }
+
+func TestExposedServiceRoutes(t *testing.T) {
+	svc := func(name, clusterIP, expose string) kube.Service {
+		s := kube.Service{}
+		s.Name = name
+		s.Spec.ClusterIP = clusterIP
+		if expose != "" {
+			s.Annotations = map[string]string{kubeExposeAnnotation: expose}
+		}
+		return s
+	}
+	got := exposedServiceRoutes([]kube.Service{
+		svc("b", "10.0.0.2", "true"),
+		svc("a", "10.0.0.1", "True"),
+		svc("unannotated", "10.0.0.3", ""),
+		svc("disabled", "10.0.0.4", "false"),
+		svc("headless", "None", "true"),
+		svc("v6", "fd00::1", "true"),
+	})
+	want := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.1/32"),
+		netaddr.MustParseIPPrefix("10.0.0.2/32"),
+		netaddr.MustParseIPPrefix("fd00::1/128"),
+	}
+	if !prefixesEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestManagedRoutesState(t *testing.T) {
+	store := new(mem.Store)
+	got, err := loadManagedRoutes(store)
+	if err != nil || got != nil {
+		t.Fatalf("empty store: got %v, %v; want nil, nil", got, err)
+	}
+	want := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.1/32"),
+		netaddr.MustParseIPPrefix("fd00::1/128"),
+	}
+	if err := saveManagedRoutes(store, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err = loadManagedRoutes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prefixesEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *string, *uint, *bool) {
+		fs := flag.NewFlagSet("tailscaled", flag.ContinueOnError)
+		statedir := fs.String("statedir", "", "")
+		port := fs.Uint("port", 0, "")
+		noLogs := fs.Bool("no-logs-no-support", false, "")
+		fs.String("config", "", "")
+		return fs, statedir, port, noLogs
+	}
+	path := filepath.Join(t.TempDir(), "tailscaled.json")
+	if err := os.WriteFile(path, []byte(`{"statedir": "/var/lib/tailscale", "port": 41641, "no-logs-no-support": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, statedir, port, noLogs := newFlags()
+	if err := fs.Parse([]string{"--port=1234"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(fs, path); err != nil {
+		t.Fatalf("loadConfigFile: %v", err)
+	}
+	if *statedir != "/var/lib/tailscale" || *port != 1234 || !*noLogs {
+		t.Errorf("got statedir=%q port=%v no-logs=%v; want /var/lib/tailscale, 1234 (from command line), true", *statedir, *port, *noLogs)
+	}
+
+	for _, bad := range []string{
+		`{"bogus": "x"}`,
+		`{"config": "/etc/other.json"}`,
+		`{"port": "not-a-number"}`,
+		`{"statedir": ["/a"]}`,
+		`not json`,
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fs, _, _, _ := newFlags()
+		if err := loadConfigFile(fs, path); err == nil {
+			t.Errorf("loadConfigFile(%s) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestCheckStateSeparation(t *testing.T) {
+	tests := []struct {
+		config, statedir, statepath string
+		ok                          bool
+	}{
+		{"/etc/tailscaled.json", "/var/lib/tailscale", "", true},
+		{"/etc/tailscaled.json", "/var/lib/tailscale", "/var/lib/tailscale/tailscaled.state", true},
+		{"/etc/tailscaled.json", "/var/lib/tailscale", "mem:", true},
+		{"/etc/tailscaled.json", "", "/var/lib/tailscale/tailscaled.state", false},
+		{"/etc/tailscaled.json", "var/lib/tailscale", "", false},
+		{"/etc/tailscaled.json", "/var/lib/tailscale", "/etc/tailscaled.state", false},
+		{"/etc/tailscaled.json", "/var/lib/tailscale", "/var/lib/tailscale-other/tailscaled.state", false},
+		{"/var/lib/tailscale/tailscaled.json", "/var/lib/tailscale", "", false},
+	}
+	for _, tt := range tests {
+		err := checkStateSeparation(tt.config, tt.statedir, tt.statepath)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkStateSeparation(%q, %q, %q) = %v; want ok=%v", tt.config, tt.statedir, tt.statepath, err, tt.ok)
+		}
+	}
+}
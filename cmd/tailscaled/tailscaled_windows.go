@@ -122,6 +122,8 @@ func (service *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, ch
 
 	changes <- svc.Status{State: svc.Running, Accepts: svcAccepts}
 	syslogf("Service running")
+	winutil.LogEvent(winutil.EventServiceStart, "The Tailscale service started.", "Version", version.Long)
+	defer winutil.LogEvent(winutil.EventServiceStop, "The Tailscale service stopped.", "Version", version.Long)
 
 	for {
 		select {
@@ -290,6 +292,8 @@ func startIPNServer(ctx context.Context, logid string) error {
 			ListenPort:  41641,
 			LinkMonitor: linkMon,
 			Dialer:      dialer,
+			Shadow:      envknob.Bool("TS_SHADOW_ENGINE"),
+			ShadowHold:  envknob.Bool("TS_SHADOW_HOLD"),
 		})
 		if err != nil {
 			r.Close()
@@ -52,8 +52,9 @@ type Auto struct {
 	logf       logger.Logf
 	expiry     *time.Time
 	closed     bool
-	newMapCh   chan struct{} // readable when we must restart a map request
-	statusFunc func(Status)  // called to update Client status; always non-nil
+	newMapCh   chan struct{}  // readable when we must restart a map request
+	statusFunc func(Status)   // called to update Client status; always non-nil
+	updates    *updateBatcher // batches endpoint and NetInfo changes
 
 	unregisterHealthWatch func()
 
@@ -112,6 +113,7 @@ func NewNoStart(opts Options) (*Auto, error) {
 		mapDone:    make(chan struct{}),
 		statusFunc: opts.Status,
 	}
+	c.updates = newUpdateBatcher(opts.Logf, c.sendNewMapRequest)
 	c.authCtx, c.authCancel = context.WithCancel(context.Background())
 	c.mapCtx, c.mapCancel = context.WithCancel(context.Background())
 	c.unregisterHealthWatch = health.RegisterWatcher(c.onHealthChange)
@@ -559,8 +561,9 @@ func (c *Auto) SetNetInfo(ni *tailcfg.NetInfo) {
 		return
 	}
 
-	// Send new NetInfo to server
-	c.sendNewMapRequest()
+	// Send new NetInfo to server, along with any other changes
+	// in the batch.
+	c.updates.changed()
 }
 
 func (c *Auto) sendStatus(who string, err error, url string, nm *netmap.NetworkMap) {
@@ -664,13 +667,14 @@ func (c *Auto) SetExpirySooner(ctx context.Context, expiry time.Time) error {
 }
 
 // UpdateEndpoints sets the client's discovered endpoints and sends
-// them to the control server if they've changed.
+// them to the control server if they've changed. Changes are batched
+// and rate limited; see updateBatcher.
 //
 // It does not retain the provided slice.
 func (c *Auto) UpdateEndpoints(endpoints []tailcfg.Endpoint) {
 	changed := c.direct.SetEndpoints(endpoints)
 	if changed {
-		c.sendNewMapRequest()
+		c.updates.changed()
 	}
 }
 
@@ -689,6 +693,7 @@ func (c *Auto) Shutdown() {
 	c.logf("client.Shutdown: inSendStatus=%v", inSendStatus)
 	if !closed {
 		c.unregisterHealthWatch()
+		c.updates.close()
 		close(c.quit)
 		c.cancelAuth()
 		<-c.authDone
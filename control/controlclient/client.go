@@ -18,9 +18,10 @@
 type LoginFlags int
 
 const (
-	LoginDefault     = LoginFlags(0)
-	LoginInteractive = LoginFlags(1 << iota) // force user login and key refresh
-	LoginEphemeral                           // set RegisterRequest.Ephemeral
+	LoginDefault       = LoginFlags(0)
+	LoginInteractive   = LoginFlags(1 << iota) // force user login and key refresh
+	LoginEphemeral                             // set RegisterRequest.Ephemeral
+	LoginRotateNodeKey                         // non-interactively replace a still-valid node key
 )
 
 // Client represents a client connection to the control server.
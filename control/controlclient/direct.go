@@ -28,6 +28,7 @@
 	"go4.org/mem"
 	"inet.af/netaddr"
 	"tailscale.com/control/controlknobs"
+	"tailscale.com/control/controlproxy"
 	"tailscale.com/envknob"
 	"tailscale.com/health"
 	"tailscale.com/hostinfo"
@@ -57,8 +58,7 @@
 // Direct is the client that connects to a tailcontrol server for a node.
 type Direct struct {
 	httpc                  *http.Client // HTTP client used to talk to tailcontrol
-	dialer                 *tsdial.Dialer
-	serverURL              string // URL of the tailcontrol server
+	serverURL              string       // URL of the tailcontrol server
 	timeNow                func() time.Time
 	lastPrintMap           time.Time
 	newDecompressor        func() (Decompressor, error)
@@ -73,6 +73,11 @@ type Direct struct {
 	pinger                 Pinger
 	popBrowser             func(url string) // or nil
 
+	// controlDial dials tailcontrol, through Options.ControlProxy
+	// if set, in which case controlProxied is true.
+	controlDial    dnscache.DialContextFunc
+	controlProxied bool
+
 	mu             sync.Mutex        // mutex guards the following fields
 	serverKey      key.MachinePublic // original ("legacy") nacl crypto_box-based public key
 	serverNoiseKey key.MachinePublic
@@ -108,6 +113,12 @@ type Options struct {
 	PopBrowserURL        func(url string) // optional func to open browser
 	Dialer               *tsdial.Dialer   // non-nil
 
+	// ControlProxy optionally specifies the "host:port" of a
+	// controlproxy.Server, typically run by another node of the
+	// tailnet, to reach the control server through, for nodes
+	// without direct internet access.
+	ControlProxy string
+
 	// Status is called when there's a change in status.
 	Status func(Status)
 
@@ -167,6 +178,10 @@ func NewDirect(opts Options) (*Direct, error) {
 		// etc set).
 		httpc = http.DefaultClient
 	}
+	controlDial := dnscache.DialContextFunc(opts.Dialer.SystemDial)
+	if opts.ControlProxy != "" {
+		controlDial = dnscache.DialContextFunc(controlproxy.Dialer(opts.ControlProxy, opts.Dialer.SystemDial))
+	}
 	if httpc == nil {
 		dnsCache := &dnscache.Resolver{
 			Forward:          dnscache.Get().Forward, // use default cache's forwarder
@@ -174,11 +189,20 @@ func NewDirect(opts Options) (*Direct, error) {
 			LookupIPFallback: dnsfallback.Lookup,
 		}
 		tr := http.DefaultTransport.(*http.Transport).Clone()
-		tr.Proxy = tshttpproxy.ProxyFromEnvironment
-		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
 		tr.TLSClientConfig = tlsdial.Config(serverURL.Hostname(), tr.TLSClientConfig)
-		tr.DialContext = dnscache.Dialer(opts.Dialer.SystemDial, dnsCache)
-		tr.DialTLSContext = dnscache.TLSDialer(opts.Dialer.SystemDial, dnsCache, tr.TLSClientConfig)
+		if opts.ControlProxy == "" {
+			tr.Proxy = tshttpproxy.ProxyFromEnvironment
+			tr.DialContext = dnscache.Dialer(controlDial, dnsCache)
+			tr.DialTLSContext = dnscache.TLSDialer(controlDial, dnsCache, tr.TLSClientConfig)
+		} else {
+			// controlDial goes through the control proxy, which
+			// resolves the control server's name, as this node
+			// may not be able to. tr does the TLS handshake over
+			// the tunnel.
+			tr.Proxy = nil
+			tr.DialContext = controlDial
+		}
+		tshttpproxy.SetTransportConnectAuth(tr, logger.WithPrefix(opts.Logf, "proxy: "))
 		tr.ForceAttemptHTTP2 = true
 		// Disable implicit gzip compression; the various
 		// handlers (register, map, set-dns, etc) do their own
@@ -204,7 +228,8 @@ func NewDirect(opts Options) (*Direct, error) {
 		skipIPForwardingCheck:  opts.SkipIPForwardingCheck,
 		pinger:                 opts.Pinger,
 		popBrowser:             opts.PopBrowserURL,
-		dialer:                 opts.Dialer,
+		controlDial:            controlDial,
+		controlProxied:         opts.ControlProxy != "",
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(hostinfo.New())
@@ -348,6 +373,17 @@ func (c *Direct) hostInfoLocked() *tailcfg.Hostinfo {
 	return hi
 }
 
+// nodeKeyRotationOverlap is how long control is asked to keep accepting
+// the old node key after a LoginRotateNodeKey rotation.
+//
+// The overlap only affects control's view of the node, letting a
+// rotation whose response was lost be retried with the old key. The
+// node itself can hold only one WireGuard private key, so it switches
+// to the new key as soon as control accepts it; WireGuard sessions
+// with peers still using the old key end, and resume once the peers'
+// netmaps have the new key and they re-handshake.
+const nodeKeyRotationOverlap = 24 * time.Hour
+
 func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, newURL string, err error) {
 	c.mu.Lock()
 	persist := c.persist
@@ -382,6 +418,12 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 			regen = true
 		}
 	}
+	rotate := (opt.Flags&LoginRotateNodeKey) != 0 && !opt.Logout && !regen &&
+		opt.URL == "" && !persist.PrivateNodeKey.IsZero()
+	if rotate {
+		c.logf("LoginRotateNodeKey -> regen=true")
+		regen = true
+	}
 
 	c.logf("doLogin(regen=%v, hasUrl=%v)", regen, opt.URL != "")
 	if serverKey.IsZero() {
@@ -412,6 +454,11 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 		tryingNewKey = persist.PrivateNodeKey
 	case opt.URL != "":
 		// Nothing.
+	case len(persist.NodeKeySignature) > 0 && persist.NodeKeyCreated.IsZero() && !rotate:
+		// A pre-signed key control hasn't accepted yet. Log in
+		// with it rather than a new key, which network-lock
+		// wouldn't authorize.
+		tryingNewKey = persist.PrivateNodeKey
 	case regen || persist.PrivateNodeKey.IsZero():
 		c.logf("Generating a new nodekey.")
 		persist.OldPrivateNodeKey = persist.PrivateNodeKey
@@ -449,6 +496,13 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	} else if opt.Expiry != nil {
 		request.Expiry = *opt.Expiry
 	}
+	if rotate {
+		retire := now.Add(nodeKeyRotationOverlap)
+		request.RetireOldNodeKeyAt = &retire
+	}
+	if tryingNewKey.Equal(persist.PrivateNodeKey) {
+		request.NodeKeySignature = persist.NodeKeySignature
+	}
 	c.logf("RegisterReq: onode=%v node=%v fup=%v",
 		request.OldNodeKey.ShortString(),
 		request.NodeKey.ShortString(), opt.URL != "")
@@ -470,8 +524,17 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 			c.logf("RegisterReq sign error: %v", err)
 		}
 	}
-	if debugRegister {
-		j, _ := json.MarshalIndent(request, "", "\t")
+	if debugRegister() {
+		// The component's level can be raised at runtime, so keep
+		// credentials out of the logs.
+		logged := request
+		if logged.Auth.AuthKey != "" {
+			logged.Auth.AuthKey = "redacted"
+		}
+		if logged.Auth.Oauth2Token != nil {
+			logged.Auth.Oauth2Token = &tailcfg.Oauth2Token{AccessToken: "redacted"}
+		}
+		j, _ := json.MarshalIndent(logged, "", "\t")
 		c.logf("RegisterRequest: %s", j)
 	}
 
@@ -513,7 +576,7 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 		c.logf("error decoding RegisterResponse with server key %s and machine key %s: %v", serverKey, machinePrivKey.Public(), err)
 		return regen, opt.URL, fmt.Errorf("register request: %v", err)
 	}
-	if debugRegister {
+	if debugRegister() {
 		j, _ := json.MarshalIndent(resp, "", "\t")
 		c.logf("RegisterResponse: %s", j)
 	}
@@ -546,6 +609,12 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	//	- machine key no longer supported
 	//	- user is disabled
 
+	if resp.AuthURL != "" && rotate {
+		// The current key is still good; don't log the node out
+		// over a rotation nobody asked for interactively.
+		c.logf("control server wants interactive login to rotate node key; keeping current key")
+		return false, "", nil
+	}
 	if resp.AuthURL != "" {
 		c.logf("AuthURL is %v", resp.AuthURL)
 	} else {
@@ -555,6 +624,13 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	c.mu.Lock()
 	if resp.AuthURL == "" {
 		// key rotation is complete
+		if !persist.PrivateNodeKey.Equal(tryingNewKey) || persist.NodeKeyCreated.IsZero() {
+			persist.NodeKeyCreated = c.timeNow()
+		}
+		if !persist.PrivateNodeKey.Equal(tryingNewKey) {
+			// The signature was for the old key.
+			persist.NodeKeySignature = nil
+		}
 		persist.PrivateNodeKey = tryingNewKey
 	} else {
 		// save it for the retry-with-URL
@@ -987,10 +1063,22 @@ func decode(res *http.Response, v any, serverKey, serverNoiseKey key.MachinePubl
 	return decodeMsg(msg, v, serverKey, mkey)
 }
 
-var (
-	debugMap      = envknob.Bool("TS_DEBUG_MAP")
-	debugRegister = envknob.Bool("TS_DEBUG_REGISTER")
-)
+// logComponent is the "control" component of "tailscale debug
+// loglevel". At LevelDebug it logs register requests, and at
+// LevelTrace, every map request and response in full. TS_DEBUG_REGISTER
+// and TS_DEBUG_MAP set its starting level.
+var logComponent = logger.NewComponent("control", func() logger.Level {
+	switch {
+	case envknob.Bool("TS_DEBUG_MAP"):
+		return logger.LevelTrace
+	case envknob.Bool("TS_DEBUG_REGISTER"):
+		return logger.LevelDebug
+	}
+	return logger.LevelInfo
+}())
+
+func debugMap() bool      { return logComponent.Enabled(logger.LevelTrace) }
+func debugRegister() bool { return logComponent.Enabled(logger.LevelDebug) }
 
 var jsonEscapedZero = []byte(`\u0000`)
 
@@ -1027,7 +1115,7 @@ func (c *Direct) decodeMsg(msg []byte, v any, mkey key.MachinePrivate) error {
 			return err
 		}
 	}
-	if debugMap {
+	if debugMap() {
 		var buf bytes.Buffer
 		json.Indent(&buf, b, "", "    ")
 		log.Printf("MapResponse: %s", buf.Bytes())
@@ -1064,7 +1152,7 @@ func encode(v any, serverKey, serverNoiseKey key.MachinePublic, mkey key.Machine
 	if err != nil {
 		return nil, err
 	}
-	if debugMap {
+	if debugMap() {
 		if _, ok := v.(*tailcfg.MapRequest); ok {
 			log.Printf("MapRequest: %s", b)
 		}
@@ -1285,7 +1373,7 @@ func (c *Direct) getNoiseClient() (*noiseClient, error) {
 		if err != nil {
 			return nil, err
 		}
-		nc, err := newNoiseClient(k, serverNoiseKey, c.serverURL, c.dialer)
+		nc, err := newNoiseClient(k, serverNoiseKey, c.serverURL, c.controlDial, c.controlProxied)
 		if err != nil {
 			return nil, err
 		}
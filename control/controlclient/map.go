@@ -41,6 +41,7 @@ type mapSession struct {
 	lastUserProfile        map[tailcfg.UserID]tailcfg.UserProfile
 	lastParsedPacketFilter []filter.Match
 	lastSSHPolicy          *tailcfg.SSHPolicy
+	lastNodeCA             *tailcfg.NodeCA
 	collectServices        bool
 	previousPeers          []*tailcfg.Node // for delta-purposes
 	lastDomain             string
@@ -103,6 +104,9 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 	if p := resp.SSHPolicy; p != nil {
 		ms.lastSSHPolicy = p
 	}
+	if ca := resp.NodeCA; ca != nil {
+		ms.lastNodeCA = ca
+	}
 
 	if v, ok := resp.CollectServices.Get(); ok {
 		ms.collectServices = v
@@ -124,6 +128,7 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 		DNS:             *ms.lastDNSConfig,
 		PacketFilter:    ms.lastParsedPacketFilter,
 		SSHPolicy:       ms.lastSSHPolicy,
+		NodeCA:          ms.lastNodeCA,
 		CollectServices: ms.collectServices,
 		DERPMap:         ms.lastDERPMap,
 		Debug:           resp.Debug,
@@ -0,0 +1,136 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"sync"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
+)
+
+// Defaults for batching endpoint and NetInfo updates to control.
+// They can be tuned with $TS_CONTROL_UPDATE_BATCH_DELAY and
+// $TS_CONTROL_UPDATE_MIN_INTERVAL (as time.ParseDuration strings);
+// setting both to 0 sends every change right away.
+const (
+	// defaultUpdateBatchDelay is how long to wait after a change for
+	// more changes to send along with it. Interface flaps change the
+	// endpoints several times within a second or so.
+	defaultUpdateBatchDelay = time.Second
+
+	// defaultUpdateMinInterval is the minimum time between sends, so
+	// a link that keeps flapping costs at most a dozen map requests
+	// a minute.
+	defaultUpdateMinInterval = 5 * time.Second
+)
+
+// updateBatcher coalesces bursts of endpoint and NetInfo changes
+// into fewer sends to control, and rate limits the sends.
+//
+// Each send reports the latest state, as Direct keeps it, so no
+// change is lost by coalescing.
+type updateBatcher struct {
+	logf        logger.Logf
+	delay       time.Duration // wait after a change for more changes
+	minInterval time.Duration // minimum time between sends
+	send        func()
+
+	mu       sync.Mutex
+	timer    *time.Timer // non-nil while a send is pending
+	lastSend time.Time
+	closed   bool
+}
+
+func newUpdateBatcher(logf logger.Logf, send func()) *updateBatcher {
+	return &updateBatcher{
+		logf:        logf,
+		delay:       envDuration(logf, "TS_CONTROL_UPDATE_BATCH_DELAY", defaultUpdateBatchDelay),
+		minInterval: envDuration(logf, "TS_CONTROL_UPDATE_MIN_INTERVAL", defaultUpdateMinInterval),
+		send:        send,
+	}
+}
+
+// envDuration returns the duration in environment variable envVar, or
+// def if it's unset or invalid.
+func envDuration(logf logger.Logf, envVar string, def time.Duration) time.Duration {
+	s := envknob.String(envVar)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		logf("controlclient: ignoring invalid $%s %q", envVar, s)
+		return def
+	}
+	return d
+}
+
+// changed notes that there's a change to send, and schedules a send
+// if one isn't already pending.
+func (b *updateBatcher) changed() {
+	metricUpdates.Add(1)
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	if b.timer != nil {
+		b.mu.Unlock()
+		metricUpdatesCoalesced.Add(1)
+		return
+	}
+	d := b.delay
+	if !b.lastSend.IsZero() {
+		if wait := time.Until(b.lastSend.Add(b.minInterval)); wait > d {
+			d = wait
+			metricUpdatesDeferred.Add(1)
+			b.logf("[v1] controlclient: deferring update to control by %v", d.Round(time.Millisecond))
+		}
+	}
+	if d <= 0 {
+		b.lastSend = time.Now()
+		b.mu.Unlock()
+		b.fire()
+		return
+	}
+	b.timer = time.AfterFunc(d, func() {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+		b.timer = nil
+		b.lastSend = time.Now()
+		b.mu.Unlock()
+		b.fire()
+	})
+	b.mu.Unlock()
+}
+
+func (b *updateBatcher) fire() {
+	metricUpdatesSent.Add(1)
+	b.send()
+}
+
+// close cancels any pending send; later changes are ignored.
+func (b *updateBatcher) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+var (
+	metricUpdates          = clientmetric.NewCounter("controlclient_update_changes")
+	metricUpdatesCoalesced = clientmetric.NewCounter("controlclient_update_changes_coalesced") // folded into a pending send
+	metricUpdatesDeferred  = clientmetric.NewCounter("controlclient_update_sends_deferred")    // delayed by the minimum interval
+	metricUpdatesSent      = clientmetric.NewCounter("controlclient_update_sends")
+)
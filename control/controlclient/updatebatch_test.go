@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateBatcher(t *testing.T) {
+	sent := make(chan time.Time, 10)
+	b := &updateBatcher{
+		logf:        t.Logf,
+		delay:       20 * time.Millisecond,
+		minInterval: 200 * time.Millisecond,
+		send:        func() { sent <- time.Now() },
+	}
+	defer b.close()
+
+	// A burst of changes is one send, after the batch delay.
+	t0 := time.Now()
+	for i := 0; i < 10; i++ {
+		b.changed()
+	}
+	t1 := <-sent
+	if d := t1.Sub(t0); d < b.delay {
+		t.Errorf("first send after %v; want at least %v", d, b.delay)
+	}
+	select {
+	case <-sent:
+		t.Fatal("burst of changes was sent more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The next change waits out the minimum interval.
+	b.changed()
+	b.changed()
+	t2 := <-sent
+	if d := t2.Sub(t1); d < b.minInterval-10*time.Millisecond {
+		t.Errorf("second send %v after first; want at least %v", d, b.minInterval)
+	}
+
+	// Close cancels a pending send.
+	b.changed()
+	b.close()
+	select {
+	case <-sent:
+		t.Fatal("send after close")
+	case <-time.After(b.minInterval + 50*time.Millisecond):
+	}
+}
+
+func TestUpdateBatcherUnbatched(t *testing.T) {
+	n := 0
+	b := &updateBatcher{logf: t.Logf, send: func() { n++ }}
+	for i := 0; i < 3; i++ {
+		b.changed()
+	}
+	if n != 3 {
+		t.Errorf("with no delay or interval, sent %d times; want 3", n)
+	}
+}
@@ -41,6 +41,7 @@
 	"tailscale.com/net/tlsdial"
 	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
 )
 
 // Dial connects to the HTTP server at addr, requests to switch to the
@@ -70,6 +71,28 @@ func Dial(ctx context.Context, addr string, machineKey key.MachinePrivate, contr
 	return a.dial(ctx)
 }
 
+// DialProxied is like Dial, for a dialer that reaches the control server
+// through a proxy that resolves its name, such as a controlproxy.Dialer.
+// The dialer is passed addr's host unresolved, and no HTTP proxy from
+// the environment is used.
+func DialProxied(ctx context.Context, addr string, machineKey key.MachinePrivate, controlKey key.MachinePublic, protocolVersion uint16, dialer dnscache.DialContextFunc) (*controlbase.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	a := &dialParams{
+		host:       host,
+		httpPort:   port,
+		httpsPort:  "443",
+		machineKey: machineKey,
+		controlKey: controlKey,
+		version:    protocolVersion,
+		dialer:     dialer,
+		dialHost:   true,
+	}
+	return a.dial(ctx)
+}
+
 type dialParams struct {
 	host       string
 	httpPort   string
@@ -79,6 +102,7 @@ type dialParams struct {
 	version    uint16
 	proxyFunc  func(*http.Request) (*url.URL, error) // or nil
 	dialer     dnscache.DialContextFunc
+	dialHost   bool // dialer resolves host itself; see DialProxied
 
 	// For tests only
 	insecureTLS       bool
@@ -202,8 +226,11 @@ func (a *dialParams) tryURLUpgrade(ctx context.Context, u *url.URL, init []byte)
 	tr := http.DefaultTransport.(*http.Transport).Clone()
 	defer tr.CloseIdleConnections()
 	tr.Proxy = a.proxyFunc
-	tshttpproxy.SetTransportGetProxyConnectHeader(tr)
-	tr.DialContext = dnscache.Dialer(a.dialer, dns)
+	if a.dialHost {
+		tr.DialContext = a.dialer
+	} else {
+		tr.DialContext = dnscache.Dialer(a.dialer, dns)
+	}
 	// Disable HTTP2, since h2 can't do protocol switching.
 	tr.TLSClientConfig.NextProtos = []string{}
 	tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
@@ -212,7 +239,11 @@ func (a *dialParams) tryURLUpgrade(ctx context.Context, u *url.URL, init []byte)
 		tr.TLSClientConfig.InsecureSkipVerify = true
 		tr.TLSClientConfig.VerifyConnection = nil
 	}
-	tr.DialTLSContext = dnscache.TLSDialer(a.dialer, dns, tr.TLSClientConfig)
+	if !a.dialHost {
+		// Otherwise tr does the TLS handshake over tr.DialContext.
+		tr.DialTLSContext = dnscache.TLSDialer(a.dialer, dns, tr.TLSClientConfig)
+	}
+	tshttpproxy.SetTransportConnectAuth(tr, logger.Discard)
 	tr.DisableCompression = true
 
 	// (mis)use httptrace to extract the underlying net.Conn from the
@@ -0,0 +1,221 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package controlproxy lets a node without direct internet access reach
+// the coordination server through another node that has it, such as a
+// subnet router on the isolated node's network segment.
+//
+// The proxying node runs a Server, an HTTP CONNECT proxy that only
+// permits connections to its own control server, and only from the
+// addresses it's told to allow. The isolated node dials its control
+// connections with Dialer, which sends the control server's name to the
+// proxy unresolved, so the isolated node needs no DNS for it.
+package controlproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// DialFunc dials a connection to addr, a "host:port".
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Server is an HTTP CONNECT proxy to a control server.
+type Server struct {
+	// Logf, if non-nil, logs proxied connections.
+	Logf logger.Logf
+
+	// ControlURL returns the URL of the control server to permit
+	// connections to. It's called for each request, so it may
+	// change. If it returns the empty string, all requests are denied.
+	ControlURL func() string
+
+	// Dial dials the control server.
+	Dial DialFunc
+
+	// AllowFrom is the client addresses permitted to use the proxy.
+	// Requests from other addresses are denied, as are all requests
+	// if it's empty.
+	AllowFrom []netaddr.IPPrefix
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// clientAllowed reports whether remoteAddr, a request's RemoteAddr, is
+// in s.AllowFrom.
+func (s *Server) clientAllowed(remoteAddr string) bool {
+	ipp, err := netaddr.ParseIPPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := ipp.IP().Unmap()
+	for _, p := range s.AllowFrom {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether hostPort, the target of a CONNECT request, is
+// the control server. Dialer sends the control server's name, but
+// clients that resolve it themselves may send one of its IPs instead,
+// so those are permitted too.
+func (s *Server) allowed(ctx context.Context, hostPort string) bool {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(s.ControlURL())
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	// The ts2021 protocol dials port 80 with a fallback to 443,
+	// whatever the control URL's scheme.
+	if port != "80" && port != "443" && port != u.Port() {
+		return false
+	}
+	if host == u.Hostname() {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.clientAllowed(r.RemoteAddr) {
+		s.logf("denied CONNECT from %v: not an allowed client", r.RemoteAddr)
+		http.Error(w, "client not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method != "CONNECT" {
+		http.Error(w, "only CONNECT to the control server is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	dst := r.RequestURI
+	if !s.allowed(r.Context(), dst) {
+		s.logf("denied CONNECT from %v to %q", r.RemoteAddr, dst)
+		http.Error(w, "destination is not the control server", http.StatusForbidden)
+		return
+	}
+	c, err := s.Dial(r.Context(), "tcp", dst)
+	if err != nil {
+		s.logf("dialing %v for %v: %v", dst, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer c.Close()
+
+	cc, ccbuf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cc.Close()
+	s.logf("proxying %v to %v", r.RemoteAddr, dst)
+
+	io.WriteString(cc, "HTTP/1.1 200 OK\r\n\r\n")
+
+	var clientSrc io.Reader = ccbuf
+	if ccbuf.Reader.Buffered() == 0 {
+		clientSrc = cc
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(cc, c)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(c, clientSrc)
+		errc <- err
+	}()
+	<-errc
+}
+
+// connectTimeout bounds the CONNECT handshake with the proxy when the
+// context passed to the Dialer has no deadline.
+const connectTimeout = 30 * time.Second
+
+// Dialer returns a DialFunc that tunnels TCP connections through the
+// Server listening at proxyAddr, itself dialed with dial. The addresses
+// it's given to dial are passed to the Server as they are, so should
+// name the control server by its hostname, for the Server to resolve.
+func Dialer(proxyAddr string, dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return nil, fmt.Errorf("controlproxy: unsupported network %q", network)
+		}
+		c, err := dial(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, fmt.Errorf("controlproxy: dialing proxy: %w", err)
+		}
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(connectTimeout)
+		}
+		c.SetDeadline(deadline)
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if err := req.Write(c); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("controlproxy: writing CONNECT: %w", err)
+		}
+		br := bufio.NewReader(c)
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("controlproxy: reading CONNECT response: %w", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			c.Close()
+			return nil, fmt.Errorf("controlproxy: proxy %s refused CONNECT to %s: %s", proxyAddr, addr, res.Status)
+		}
+		c.SetDeadline(time.Time{})
+		if br.Buffered() > 0 {
+			return &bufferedConn{c, br}, nil
+		}
+		return c, nil
+	}
+}
+
+// bufferedConn is a net.Conn whose first reads come from r, holding
+// bytes read past the end of the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestDialThroughServer(t *testing.T) {
+	// An echo server standing in for the control server.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var d net.Dialer
+	srv := &Server{
+		Logf:       t.Logf,
+		ControlURL: func() string { return "http://localhost:" + port },
+		Dial:       d.DialContext,
+		AllowFrom:  []netaddr.IPPrefix{netaddr.MustParseIPPrefix("127.0.0.0/8")},
+	}
+	ps := httptest.NewServer(srv)
+	defer ps.Close()
+	proxyAddr := strings.TrimPrefix(ps.URL, "http://")
+	dial := Dialer(proxyAddr, d.DialContext)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// By name, for the proxy to resolve.
+	c, err := dial(ctx, "tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q; want hello", buf)
+	}
+
+	for _, addr := range []string{
+		"127.0.0.2:" + port, // not the control host
+		"localhost:22",      // not a control port
+		"garbage",
+	} {
+		if c, err := dial(ctx, "tcp", addr); err == nil {
+			c.Close()
+			t.Errorf("dial %q through proxy succeeded; want error", addr)
+		}
+	}
+
+	// Only clients in AllowFrom may use the proxy.
+	other := *srv
+	other.AllowFrom = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.0.0/16")}
+	ps2 := httptest.NewServer(&other)
+	defer ps2.Close()
+	dial2 := Dialer(strings.TrimPrefix(ps2.URL, "http://"), d.DialContext)
+	if c, err := dial2(ctx, "tcp", "localhost:"+port); err == nil {
+		c.Close()
+		t.Error("dial through proxy from a client not in AllowFrom succeeded; want error")
+	}
+}
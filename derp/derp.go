@@ -115,6 +115,22 @@
 	// and how long to try total. See ServerRestartingMessage docs for
 	// more details on how the client should interpret them.
 	frameRestarting = frameType(0x15)
+
+	// frameRelayUsage is sent from server to client to report how
+	// many bytes the server has relayed from the client to each of
+	// its destinations since the previous report. The payload is a
+	// series of 40 byte entries: a 32B destination public key and a
+	// big endian uint64 byte count. It's only sent when the client
+	// has sent something through the server.
+	frameRelayUsage = frameType(0x16)
+
+	// frameNoteLowBandwidth is sent from client to server to say
+	// whether the client is on a constrained (e.g. metered cellular)
+	// link. The 1 byte payload is 0x01 or 0x00. While it's set, the
+	// server may pace the packets it relays to the client, queueing
+	// those over a rate limit, and drops bursts of disco packets
+	// toward it.
+	frameNoteLowBandwidth = frameType(0x17)
 )
 
 var bin = binary.BigEndian
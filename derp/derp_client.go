@@ -20,6 +20,7 @@
 	"inet.af/netaddr"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/version"
 )
 
 // Client is a DERP client.
@@ -172,6 +173,11 @@ type clientInfo struct {
 
 	// IsProber is whether this client is a prober.
 	IsProber bool `json:",omitempty"`
+
+	// ClientVersion is the Tailscale version of the client, such as
+	// "1.30.0". Servers use it for their version census and minimum
+	// client version; clients that predate it don't send it.
+	ClientVersion string `json:",omitempty"`
 }
 
 func (c *Client) sendClientKey() error {
@@ -180,6 +186,8 @@ func (c *Client) sendClientKey() error {
 		MeshKey:     c.meshKey,
 		CanAckPings: c.canAckPings,
 		IsProber:    c.isProber,
+
+		ClientVersion: version.Short,
 	})
 	if err != nil {
 		return err
@@ -311,6 +319,32 @@ func (c *Client) NotePreferred(preferred bool) (err error) {
 	return c.bw.Flush()
 }
 
+// NoteLowBandwidth sends a frame telling the server whether the client
+// is on a constrained link, so it should pace the packets it relays to
+// the client and drop bursts of disco packets.
+func (c *Client) NoteLowBandwidth(v bool) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("derp.NoteLowBandwidth: %v", err)
+		}
+	}()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := writeFrameHeader(c.bw, frameNoteLowBandwidth, 1); err != nil {
+		return err
+	}
+	var b byte = 0x00
+	if v {
+		b = 0x01
+	}
+	if err := c.bw.WriteByte(b); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
 // WatchConnectionChanges sends a request to subscribe to the peer's connection list.
 // It's a fatal error if the client wasn't created using MeshKey.
 func (c *Client) WatchConnectionChanges() error {
@@ -434,6 +468,22 @@ type ServerRestartingMessage struct {
 
 func (ServerRestartingMessage) msg() {}
 
+// RelayUsageMessage is a one-way message from server to client,
+// reporting the bytes the server has relayed from the client to each
+// destination since its previous RelayUsageMessage.
+type RelayUsageMessage []RelayUsage
+
+func (RelayUsageMessage) msg() {}
+
+// RelayUsage is the number of bytes a DERP server relayed to Dst.
+type RelayUsage struct {
+	Dst   key.NodePublic
+	Bytes int64
+}
+
+// relayUsageLen is the length of a RelayUsage in a frameRelayUsage.
+const relayUsageLen = keyLen + 8
+
 // Recv reads a message from the DERP server.
 //
 // The returned message may alias memory owned by the Client; it
@@ -576,6 +626,20 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			m.ReconnectIn = time.Duration(binary.BigEndian.Uint32(b[0:4])) * time.Millisecond
 			m.TryFor = time.Duration(binary.BigEndian.Uint32(b[4:8])) * time.Millisecond
 			return m, nil
+
+		case frameRelayUsage:
+			if n%relayUsageLen != 0 {
+				c.logf("[unexpected] dropping malformed relay usage frame")
+				continue
+			}
+			m := make(RelayUsageMessage, 0, n/relayUsageLen)
+			for ; len(b) >= relayUsageLen; b = b[relayUsageLen:] {
+				m = append(m, RelayUsage{
+					Dst:   key.NodePublicFromRaw32(mem.B(b[:keyLen])),
+					Bytes: int64(binary.BigEndian.Uint64(b[keyLen:relayUsageLen])),
+				})
+			}
+			return m, nil
 		}
 	}
 }
@@ -27,6 +27,7 @@
 	"net/http"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -45,6 +46,7 @@
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/pad32"
+	"tailscale.com/util/cmpver"
 	"tailscale.com/version"
 )
 
@@ -76,8 +78,33 @@ func init() {
 const (
 	perClientSendQueueDepth = 32 // packets buffered for sending
 	writeTimeout            = 2 * time.Second
+
+	// maxRelayUsageEntries is the most destinations reported in
+	// one relay usage frame; any more wait for the next one.
+	maxRelayUsageEntries = 1024
 )
 
+// Limits on the disco packets relayed to clients that have said they're
+// on a low bandwidth link. See Server.SetLowBandwidthRateLimit for the
+// limit on other packets.
+const (
+	// lowBandwidthDiscoInterval and lowBandwidthDiscoBurst limit the
+	// disco packets relayed to a low bandwidth client from each
+	// source. Disco is latency sensitive but small, so it bypasses
+	// the byte limit; a peer pinging every candidate path at once
+	// is what gets dropped.
+	lowBandwidthDiscoInterval = 2 * time.Second
+	lowBandwidthDiscoBurst    = 4
+
+	// maxLowBandwidthDiscoSources is the most sources a low
+	// bandwidth client tracks disco limits for before starting over.
+	maxLowBandwidthDiscoSources = 256
+)
+
+// relayUsageInterval is how often a client is sent a report of
+// the bytes relayed on its behalf. It's a var for tests.
+var relayUsageInterval = time.Minute
+
 // dupPolicy is a temporary (2021-08-30) mechanism to change the policy
 // of how duplicate connection for the same key are handled.
 type dupPolicy int8
@@ -130,6 +157,7 @@ type Server struct {
 	accepts                      expvar.Int
 	curClients                   expvar.Int
 	curHomeClients               expvar.Int // ones with preferred
+	curLowBandwidthClients       expvar.Int // ones with lowBandwidth
 	dupClientKeys                expvar.Int // current number of public keys we have 2+ connections for
 	dupClientConns               expvar.Int // current number of connections sharing a public key
 	dupClientConnTotal           expvar.Int // total number of accepted connections when a dup key existed
@@ -139,12 +167,32 @@ type Server struct {
 	multiForwarderCreated        expvar.Int
 	multiForwarderDeleted        expvar.Int
 	removePktForwardOther        expvar.Int
+	clientsRejectedVersion       expvar.Int
 	avgQueueDuration             *uint64 // In milliseconds; accessed atomically
 
 	// verifyClients only accepts client connections to the DERP server if the clientKey is a
 	// known peer in the network, as specified by a running tailscaled's client's local api.
 	verifyClients bool
 
+	// clientBytesPerSecond and clientBytesBurst, if clientBytesPerSecond
+	// is non-zero, are the token bucket parameters applied to each
+	// non-mesh client's sent packets. They're also advertised to
+	// clients in the server info frame so well-behaved clients can
+	// pace themselves rather than having their packets dropped.
+	clientBytesPerSecond int
+	clientBytesBurst     int
+
+	// lowBandwidthBytesPerSecond and lowBandwidthBytesBurst, if
+	// lowBandwidthBytesPerSecond is non-zero, are the token bucket
+	// parameters pacing the non-disco packets relayed to each client
+	// that has said it's on a low bandwidth link.
+	lowBandwidthBytesPerSecond int
+	lowBandwidthBytesBurst     int
+
+	// minClientVersion, if non-empty, is the oldest Tailscale version
+	// of non-mesh clients that the server accepts.
+	minClientVersion string
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
@@ -315,6 +363,7 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		sentTo:               map[key.NodePublic]map[key.NodePublic]int64{},
 		avgQueueDuration:     new(uint64),
 		keyOfAddr:            map[netaddr.IPPort]key.NodePublic{},
+
 	}
 	s.initMetacert()
 	s.packetsRecvDisco = s.packetsRecvByKind.Get("disco")
@@ -326,6 +375,9 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		s.packetsDroppedReason.Get("queue_head"),
 		s.packetsDroppedReason.Get("queue_tail"),
 		s.packetsDroppedReason.Get("write_error"),
+		s.packetsDroppedReason.Get("dup_client"),
+		s.packetsDroppedReason.Get("rate_limited"),
+		s.packetsDroppedReason.Get("low_bandwidth"),
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -347,6 +399,54 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// SetClientRateLimit sets a per-client token bucket rate limit on the
+// packets each client sends through the server. bytesPerSecond is the
+// refill rate and burst is the bucket size, both in bytes. A
+// bytesPerSecond of zero means no limit. Packets above the limit are
+// dropped and counted as rate limited. Mesh peers are not limited.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientRateLimit(bytesPerSecond, burst int) {
+	if burst < MaxPacketSize {
+		// A bucket smaller than a packet would never admit
+		// that packet.
+		burst = MaxPacketSize
+	}
+	s.clientBytesPerSecond = bytesPerSecond
+	s.clientBytesBurst = burst
+}
+
+// SetLowBandwidthRateLimit sets the token bucket rate at which the
+// server relays packets to each client that has said it's on a low
+// bandwidth link, such as metered cellular. bytesPerSecond is the
+// refill rate and burst is the bucket size, both in bytes. The default
+// bytesPerSecond of zero means no limit; bursts of disco packets to
+// such clients are dropped regardless.
+//
+// Packets over the limit are paced: they wait in the client's send
+// queue, and are only dropped if that overflows, as for any client
+// that can't keep up.
+//
+// It must be called before serving begins.
+func (s *Server) SetLowBandwidthRateLimit(bytesPerSecond, burst int) {
+	if burst < MaxPacketSize {
+		burst = MaxPacketSize
+	}
+	s.lowBandwidthBytesPerSecond = bytesPerSecond
+	s.lowBandwidthBytesBurst = burst
+}
+
+// SetMinClientVersion sets the oldest Tailscale version, such as
+// "1.30.0", of the clients the server accepts. Older clients, and those
+// too old to report their version, are sent a health frame saying why
+// and disconnected. An empty v accepts all clients. Mesh peers are
+// always accepted.
+//
+// It must be called before serving begins.
+func (s *Server) SetMinClientVersion(v string) {
+	s.minClientVersion = v
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -587,6 +687,9 @@ func (s *Server) unregisterClient(c *sclient) {
 	if c.preferred {
 		s.curHomeClients.Add(-1)
 	}
+	if c.lowBandwidth.Get() {
+		s.curLowBandwidthClients.Add(-1)
+	}
 }
 
 // notePeerGoneFromRegionLocked sends peerGone frames to parties that
@@ -653,6 +756,12 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	if err != nil {
 		return fmt.Errorf("receive client key: %v", err)
 	}
+	if err := s.checkClientVersion(clientInfo); err != nil {
+		s.clientsRejectedVersion.Add(1)
+		// Tell the client why, so it can show its user.
+		s.sendHealth(bw, err.Error())
+		return fmt.Errorf("client %x rejected: %v", clientKey, err)
+	}
 	if err := s.verifyClient(clientKey, clientInfo); err != nil {
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
@@ -687,6 +796,12 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
 	}
+	if s.clientBytesPerSecond != 0 && !c.canMesh {
+		c.sendLimiter = rate.NewLimiter(rate.Limit(s.clientBytesPerSecond), s.clientBytesBurst)
+	}
+	if s.lowBandwidthBytesPerSecond != 0 {
+		c.lowBandwidthLimiter = rate.NewLimiter(rate.Limit(s.lowBandwidthBytesPerSecond), s.lowBandwidthBytesBurst)
+	}
 	if clientInfo != nil {
 		c.info = *clientInfo
 	}
@@ -739,6 +854,8 @@ func (c *sclient) run(ctx context.Context) error {
 		switch ft {
 		case frameNotePreferred:
 			err = c.handleFrameNotePreferred(ft, fl)
+		case frameNoteLowBandwidth:
+			err = c.handleFrameNoteLowBandwidth(ft, fl)
 		case frameSendPacket:
 			err = c.handleFrameSendPacket(ft, fl)
 		case frameForwardPacket:
@@ -775,6 +892,18 @@ func (c *sclient) handleFrameNotePreferred(ft frameType, fl uint32) error {
 	return nil
 }
 
+func (c *sclient) handleFrameNoteLowBandwidth(ft frameType, fl uint32) error {
+	if fl != 1 {
+		return fmt.Errorf("frameNoteLowBandwidth wrong size")
+	}
+	v, err := c.br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("frameNoteLowBandwidth ReadByte: %v", err)
+	}
+	c.setLowBandwidth(v != 0)
+	return nil
+}
+
 func (c *sclient) handleFrameWatchConns(ft frameType, fl uint32) error {
 	if fl != 0 {
 		return fmt.Errorf("handleFrameWatchConns wrong size")
@@ -908,6 +1037,14 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(int64(len(contents)))
+
+	if c.sendLimiter != nil && !c.sendLimiter.AllowN(time.Now(), len(contents)) {
+		c.packetsRateLimited.Add(1)
+		s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+		return nil
+	}
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -932,6 +1069,7 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 				// TODO:
 				return nil
 			}
+			c.noteRelayed(dstKey, len(contents))
 			return nil
 		}
 		reason := dropReasonUnknownDest
@@ -947,9 +1085,21 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 		enqueuedAt: time.Now(),
 		src:        c.key,
 	}
+	c.noteRelayed(dstKey, len(contents))
 	return c.sendPkt(dst, p)
 }
 
+// noteRelayed records that the server is relaying n bytes from c to
+// dst, for c's next relay usage frame.
+func (c *sclient) noteRelayed(dst key.NodePublic, n int) {
+	c.relayedMu.Lock()
+	defer c.relayedMu.Unlock()
+	if c.relayed == nil {
+		c.relayed = make(map[key.NodePublic]int64)
+	}
+	c.relayed[dst] += int64(n)
+}
+
 // dropReason is why we dropped a DERP frame.
 type dropReason int
 
@@ -963,6 +1113,8 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited                        // the sending client exceeded its configured rate limit
+	dropReasonLowBandwidth                       // the destination is on a low bandwidth link and the packet is part of a disco burst
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -993,8 +1145,14 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	// Attempt to queue for sending up to 3 times. On each attempt, if
 	// the queue is full, try to drop from queue head to prioritize
 	// fresher packets.
+	isDisco := disco.LooksLikeDiscoWrapper(p.bs)
+	if isDisco && dst.lowBandwidth.Get() && !dst.allowLowBandwidthDisco(p.src) {
+		s.recordDrop(p.bs, c.key, dstKey, dropReasonLowBandwidth)
+		return nil
+	}
+
 	sendQueue := dst.sendQueue
-	if disco.LooksLikeDiscoWrapper(p.bs) {
+	if isDisco {
 		sendQueue = dst.discoSendQueue
 	}
 	for attempt := 0; attempt < 3; attempt++ {
@@ -1063,6 +1221,32 @@ func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error
 	return nil
 }
 
+// checkClientVersion returns an error if the client described by info
+// is older than s.minClientVersion.
+func (s *Server) checkClientVersion(info *clientInfo) error {
+	if s.minClientVersion == "" {
+		return nil
+	}
+	if info.MeshKey != "" && info.MeshKey == s.meshKey {
+		return nil
+	}
+	if info.ClientVersion == "" {
+		return fmt.Errorf("this DERP server requires Tailscale %s or newer; please upgrade", s.minClientVersion)
+	}
+	if cmpver.Compare(info.ClientVersion, s.minClientVersion) < 0 {
+		return fmt.Errorf("this DERP server requires Tailscale %s or newer, but this is %s; please upgrade", s.minClientVersion, info.ClientVersion)
+	}
+	return nil
+}
+
+// sendHealth sends the client a frameHealth with the text of problem.
+func (s *Server) sendHealth(lw *lazyBufioWriter, problem string) error {
+	if err := writeFrame(lw.bw(), frameHealth, []byte(problem)); err != nil {
+		return err
+	}
+	return lw.Flush()
+}
+
 func (s *Server) sendServerKey(lw *lazyBufioWriter) error {
 	buf := make([]byte, 0, len(magic)+key.NodePublicRawLen)
 	buf = append(buf, magic...)
@@ -1131,7 +1315,12 @@ type serverInfo struct {
 }
 
 func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic) error {
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+	msg, err := json.Marshal(serverInfo{
+		Version: ProtocolVersion,
+
+		TokenBucketBytesPerSecond: s.clientBytesPerSecond,
+		TokenBucketBytesBurst:     s.clientBytesBurst,
+	})
 	if err != nil {
 		return err
 	}
@@ -1237,6 +1426,13 @@ func (s *Server) recvForwardPacket(br *bufio.Reader, frameLen uint32) (srcKey, d
 //
 // (The "s" prefix is to more explicitly distinguish it from Client in derp_client.go)
 type sclient struct {
+	// These are at the start of the struct to ensure 64-bit alignment
+	// on 32-bit architectures regardless of what other fields may
+	// exist in this struct.
+	packetsRecv, bytesRecv expvar.Int // sent by this client to the server
+	packetsSent, bytesSent expvar.Int // sent by the server to this client
+	packetsRateLimited     expvar.Int // dropped because sendLimiter said no
+
 	// Static after construction.
 	connNum        int64 // process-wide unique counter, incremented each Accept
 	s              *Server
@@ -1256,11 +1452,29 @@ type sclient struct {
 	isDup          syncs.AtomicBool    // whether more than 1 sclient for key is connected
 	isDisabled     syncs.AtomicBool    // whether sends to this peer are disabled due to active/active dups
 
+	// relayed is the number of bytes this client sent through the
+	// server to each destination since its last relay usage frame.
+	relayedMu sync.Mutex
+	relayed   map[key.NodePublic]int64
+
 	// replaceLimiter controls how quickly two connections with
 	// the same client key can kick each other off the server by
 	// taking over ownership of a key.
 	replaceLimiter *rate.Limiter
 
+	// sendLimiter, if non-nil, limits how many bytes of packets
+	// this client may send through the server.
+	// See Server.SetClientRateLimit.
+	sendLimiter *rate.Limiter
+
+	// lowBandwidth is whether the client has said it's on a low
+	// bandwidth link, in which case lowBandwidthLimiter, if non-nil,
+	// paces the non-disco packets sendLoop writes to it, and
+	// discoLimiters limits the disco packets from each source.
+	lowBandwidth        syncs.AtomicBool
+	lowBandwidthLimiter *rate.Limiter
+	discoLimitersMu     sync.Mutex
+	discoLimiters       map[key.NodePublic]*rate.Limiter // lazily created
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
 	connectedAt time.Time
@@ -1324,6 +1538,80 @@ func (c *sclient) setPreferred(v bool) {
 	}
 }
 
+func (c *sclient) setLowBandwidth(v bool) {
+	if c.lowBandwidth.Get() == v {
+		return
+	}
+	c.lowBandwidth.Set(v)
+	if v {
+		c.s.curLowBandwidthClients.Add(1)
+	} else {
+		c.s.curLowBandwidthClients.Add(-1)
+		c.discoLimitersMu.Lock()
+		c.discoLimiters = nil
+		c.discoLimitersMu.Unlock()
+	}
+}
+
+// allowLowBandwidthDisco reports whether a disco packet from src may be
+// relayed to c, a low bandwidth client, now. Disco is latency
+// sensitive but small, so it isn't paced; bursts of it, such as a peer
+// pinging every candidate path at once, are dropped instead.
+func (c *sclient) allowLowBandwidthDisco(src key.NodePublic) bool {
+	c.discoLimitersMu.Lock()
+	defer c.discoLimitersMu.Unlock()
+	lim, ok := c.discoLimiters[src]
+	if !ok {
+		if c.discoLimiters == nil || len(c.discoLimiters) >= maxLowBandwidthDiscoSources {
+			c.discoLimiters = make(map[key.NodePublic]*rate.Limiter)
+		}
+		lim = rate.NewLimiter(rate.Every(lowBandwidthDiscoInterval), lowBandwidthDiscoBurst)
+		c.discoLimiters[src] = lim
+	}
+	return lim.Allow()
+}
+
+// sendPacedPacket is sendPacket for a packet from c's sendQueue, which
+// paceLowBandwidth may hold back first.
+func (c *sclient) sendPacedPacket(ctx context.Context, msg pkt) error {
+	if err := c.paceLowBandwidth(ctx, len(msg.bs)); err != nil {
+		c.s.recordDrop(msg.bs, msg.src, c.key, dropReasonGone)
+		return err
+	}
+	return c.sendPacket(msg.src, msg.bs)
+}
+
+// paceLowBandwidth waits, if c is a low bandwidth client with a rate
+// limit, until n more bytes may be written to it, flushing what's
+// already been written first. Meanwhile, packets to c wait in its send
+// queue. It returns ctx's error if ctx is done first.
+func (c *sclient) paceLowBandwidth(ctx context.Context, n int) error {
+	if c.lowBandwidthLimiter == nil || !c.lowBandwidth.Get() {
+		return nil
+	}
+	r := c.lowBandwidthLimiter.ReserveN(time.Now(), n)
+	if !r.OK() {
+		// Bigger than the burst, which is at least MaxPacketSize.
+		return nil
+	}
+	d := r.Delay()
+	if d == 0 {
+		return nil
+	}
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
 // expMovingAverage returns the new moving average given the previous average,
 // a new value, and an alpha decay factor.
 // https://en.wikipedia.org/wiki/Moving_average#Exponential_moving_average
@@ -1365,6 +1653,8 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 	jitter := time.Duration(rand.Intn(5000)) * time.Millisecond
 	keepAliveTick := time.NewTicker(keepAlive + jitter)
 	defer keepAliveTick.Stop()
+	relayUsageTick := time.NewTicker(relayUsageInterval + jitter)
+	defer relayUsageTick.Stop()
 
 	var werr error // last write error
 	for {
@@ -1383,7 +1673,7 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			werr = c.sendMeshUpdates()
 			continue
 		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
+			werr = c.sendPacedPacket(ctx, msg)
 			c.recordQueueTime(msg.enqueuedAt)
 			continue
 		case msg := <-c.discoSendQueue:
@@ -1396,6 +1686,9 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
 			continue
+		case <-relayUsageTick.C:
+			werr = c.sendRelayUsage()
+			continue
 		default:
 			// Flush any writes from the 3 sends above, or from
 			// the blocking loop below.
@@ -1414,7 +1707,7 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			werr = c.sendMeshUpdates()
 			continue
 		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
+			werr = c.sendPacedPacket(ctx, msg)
 			c.recordQueueTime(msg.enqueuedAt)
 		case msg := <-c.discoSendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
@@ -1424,6 +1717,8 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			continue
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
+		case <-relayUsageTick.C:
+			werr = c.sendRelayUsage()
 		}
 	}
 }
@@ -1449,6 +1744,34 @@ func (c *sclient) sendPong(data [8]byte) error {
 	return err
 }
 
+// sendRelayUsage sends a relay usage frame reporting the bytes
+// relayed from c since the previous one, without flushing. It sends
+// nothing if there's nothing to report.
+func (c *sclient) sendRelayUsage() error {
+	c.relayedMu.Lock()
+	var buf []byte
+	for dst, n := range c.relayed {
+		if len(buf) == maxRelayUsageEntries*relayUsageLen {
+			break
+		}
+		var nb [8]byte
+		bin.PutUint64(nb[:], uint64(n))
+		buf = dst.AppendTo(buf)
+		buf = append(buf, nb[:]...)
+		delete(c.relayed, dst)
+	}
+	c.relayedMu.Unlock()
+	if len(buf) == 0 {
+		return nil
+	}
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), frameRelayUsage, uint32(len(buf))); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(buf)
+	return err
+}
+
 // sendPeerGone sends a peerGone frame, without flushing.
 func (c *sclient) sendPeerGone(peer key.NodePublic) error {
 	c.s.peerGoneFrames.Add(1)
@@ -1526,6 +1849,8 @@ func (c *sclient) sendPacket(srcKey key.NodePublic, contents []byte) (err error)
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.packetsSent.Add(1)
+			c.bytesSent.Add(int64(len(contents)))
 		}
 	}()
 
@@ -1672,6 +1997,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("gauge_current_file_descriptors", expvar.Func(func() any { return metrics.CurrentFDs() }))
 	m.Set("gauge_current_connections", &s.curClients)
 	m.Set("gauge_current_home_connections", &s.curHomeClients)
+	m.Set("gauge_current_low_bandwidth_connections", &s.curLowBandwidthClients)
 	m.Set("gauge_clients_total", expvar.Func(func() any { return len(s.clientsMesh) }))
 	m.Set("gauge_clients_local", expvar.Func(func() any { return len(s.clients) }))
 	m.Set("gauge_clients_remote", expvar.Func(func() any { return len(s.clientsMesh) - len(s.clients) }))
@@ -1698,6 +2024,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("counter_clients_rejected_version", &s.clientsRejectedVersion)
 	m.Set("average_queue_duration_ms", expvar.Func(func() any {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
@@ -1827,6 +2154,167 @@ func (s *Server) ServeDebugTraffic(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ClientStats are the traffic counters for a single client connection.
+type ClientStats struct {
+	Key          key.NodePublic
+	RemoteAddr   string
+	ConnectedAt  time.Time
+	Mesh         bool   // whether the client is a mesh peer
+	Dup          bool   // whether the key has more than one connection
+	Version      string // the client's Tailscale version, if reported
+	LowBandwidth bool   // whether the client said it's on a low bandwidth link
+
+	PacketsRecv        int64 // from the client
+	BytesRecv          int64 // from the client
+	PacketsSent        int64 // to the client
+	BytesSent          int64 // to the client
+	PacketsRateLimited int64 // from the client, dropped due to rate limiting
+}
+
+// ClientStatsSummary is the response of Server.ServeDebugClients.
+type ClientStatsSummary struct {
+	// CurrentConnections is the number of client connections to
+	// this server, including duplicates.
+	CurrentConnections int64
+	// HomeConnections is the number of connections for which this
+	// server is the client's home DERP.
+	HomeConnections int64
+	// ClientsLocal is the number of distinct keys connected to this
+	// server.
+	ClientsLocal int
+	// ClientsRemote is the number of distinct keys only connected to
+	// other servers in this server's region mesh.
+	ClientsRemote int
+
+	// RateLimitBytesPerSecond and RateLimitBytesBurst are the
+	// configured per-client limits. Zero means unlimited.
+	RateLimitBytesPerSecond int
+	RateLimitBytesBurst     int
+	// PacketsRateLimited is the total number of packets dropped
+	// due to per-client rate limits.
+	PacketsRateLimited int64
+
+	// TopTalkers are the connected clients, sorted by the number of
+	// bytes they've sent through the server, descending.
+	TopTalkers []ClientStats
+}
+
+// ClientStats returns the traffic counters of every current client
+// connection, in an unspecified order.
+func (s *Server) ClientStats() []ClientStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []ClientStats
+	for _, set := range s.clients {
+		set.ForeachClient(func(c *sclient) {
+			ret = append(ret, ClientStats{
+				Key:                c.key,
+				RemoteAddr:         c.remoteAddr,
+				ConnectedAt:        c.connectedAt,
+				Mesh:               c.canMesh,
+				Dup:                c.isDup.Get(),
+				Version:            c.info.ClientVersion,
+				LowBandwidth:       c.lowBandwidth.Get(),
+				PacketsRecv:        c.packetsRecv.Value(),
+				BytesRecv:          c.bytesRecv.Value(),
+				PacketsSent:        c.packetsSent.Value(),
+				BytesSent:          c.bytesSent.Value(),
+				PacketsRateLimited: c.packetsRateLimited.Value(),
+			})
+		})
+	}
+	return ret
+}
+
+// ServeDebugClients writes a JSON ClientStatsSummary describing the
+// server's current clients. The optional "n" query parameter limits
+// the number of top talkers returned; it defaults to 50.
+func (s *Server) ServeDebugClients(w http.ResponseWriter, r *http.Request) {
+	n := 50
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+	clients := s.ClientStats()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].BytesRecv > clients[j].BytesRecv
+	})
+	if len(clients) > n {
+		clients = clients[:n]
+	}
+
+	s.mu.Lock()
+	res := ClientStatsSummary{
+		ClientsLocal:  len(s.clients),
+		ClientsRemote: len(s.clientsMesh) - len(s.clients),
+	}
+	s.mu.Unlock()
+	res.CurrentConnections = s.curClients.Value()
+	res.HomeConnections = s.curHomeClients.Value()
+	res.RateLimitBytesPerSecond = s.clientBytesPerSecond
+	if res.RateLimitBytesPerSecond != 0 {
+		res.RateLimitBytesBurst = s.clientBytesBurst
+	}
+	res.PacketsRateLimited = s.packetsDroppedReasonCounters[dropReasonRateLimited].Value()
+	res.TopTalkers = clients
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(res)
+}
+
+// ClientVersions returns the number of the server's client connections
+// by the clients' Tailscale versions. Clients too old to report their
+// version are counted under "unknown".
+func (s *Server) ClientVersions() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := map[string]int{}
+	for _, set := range s.clients {
+		set.ForeachClient(func(c *sclient) {
+			v := c.info.ClientVersion
+			if v == "" {
+				v = "unknown"
+			}
+			ret[v]++
+		})
+	}
+	return ret
+}
+
+// ServeDebugClientVersions writes a JSON census of the server's client
+// connections by Tailscale version, newest version first, along with
+// the configured minimum version, if any.
+func (s *Server) ServeDebugClientVersions(w http.ResponseWriter, r *http.Request) {
+	type versionCount struct {
+		Version string
+		Clients int
+	}
+	var res struct {
+		MinClientVersion string `json:",omitempty"`
+		Rejected         int64
+		Versions         []versionCount
+	}
+	res.MinClientVersion = s.minClientVersion
+	res.Rejected = s.clientsRejectedVersion.Value()
+	for v, n := range s.ClientVersions() {
+		res.Versions = append(res.Versions, versionCount{v, n})
+	}
+	sort.Slice(res.Versions, func(i, j int) bool {
+		return cmpver.Compare(res.Versions[i].Version, res.Versions[j].Version) > 0
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(res)
+}
+
 var bufioWriterPool = &sync.Pool{
 	New: func() any {
 		return bufio.NewWriterSize(ioutil.Discard, 2<<10)
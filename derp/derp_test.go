@@ -19,6 +19,7 @@
 	"log"
 	"net"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -28,6 +29,7 @@
 	"tailscale.com/net/nettest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/version"
 )
 
 func TestClientInfoUnmarshal(t *testing.T) {
@@ -869,6 +871,15 @@ func TestClientRecv(t *testing.T) {
 				TryFor:      2 * time.Millisecond,
 			},
 		},
+		{
+			name: "relay_usage",
+			input: append(append([]byte{
+				byte(frameRelayUsage), 0, 0, 0, 40},
+				pubAll(7).AppendTo(nil)...),
+				0, 0, 0, 0, 0, 0, 1, 2,
+			),
+			want: RelayUsageMessage{{Dst: pubAll(7), Bytes: 258}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1395,3 +1406,209 @@ func TestServerRepliesToPing(t *testing.T) {
 		}
 	}
 }
+
+func TestServerClientRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetClientRateLimit(1, 0)
+
+	alice := newRegularClient(t, ts, "alice")
+	bob := newRegularClient(t, ts, "bob")
+
+	// Simulate a client that ignores the server's advertised
+	// limits.
+	alice.c.setSendRateLimiter(ServerInfoMessage{})
+
+	const numPkts = 100
+	pkt := make([]byte, 1000)
+	for i := 0; i < numPkts; i++ {
+		if err := alice.c.Send(bob.pub, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got ClientStats
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, st := range ts.s.ClientStats() {
+			if st.Key == alice.pub {
+				got = st
+			}
+		}
+		if got.PacketsRecv == numPkts {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got.PacketsRecv != numPkts {
+		t.Fatalf("PacketsRecv = %v; want %v", got.PacketsRecv, numPkts)
+	}
+	if got.BytesRecv != numPkts*int64(len(pkt)) {
+		t.Errorf("BytesRecv = %v; want %v", got.BytesRecv, numPkts*len(pkt))
+	}
+	// The burst is raised to MaxPacketSize, so about 65 packets
+	// fit in the bucket and the rest are dropped.
+	if got.PacketsRateLimited == 0 || got.PacketsRateLimited == numPkts {
+		t.Errorf("PacketsRateLimited = %v; want non-zero, less than %v", got.PacketsRateLimited, numPkts)
+	}
+	if v := ts.s.packetsDroppedReasonCounters[dropReasonRateLimited].Value(); v != got.PacketsRateLimited {
+		t.Errorf("rate_limited drops = %v; want %v", v, got.PacketsRateLimited)
+	}
+}
+
+func TestServerMinClientVersion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("too_old", func(t *testing.T) {
+		ts := newTestServer(t, ctx)
+		defer ts.close(t)
+		ts.s.SetMinClientVersion("999.0.0")
+
+		var msg ReceivedMessage
+		newTestClient(t, ts, "old", func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+			brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+			c, err := NewClient(priv, nc, brw, logf)
+			if err != nil {
+				return nil, err
+			}
+			msg, err = c.Recv()
+			if err != nil {
+				t.Fatalf("Recv: %v", err)
+			}
+			return c, nil
+		})
+		hm, ok := msg.(HealthMessage)
+		if !ok || !strings.Contains(hm.Problem, "requires Tailscale 999.0.0 or newer") {
+			t.Fatalf("got %#v; want HealthMessage to upgrade", msg)
+		}
+		if got := ts.s.clientsRejectedVersion.Value(); got != 1 {
+			t.Errorf("rejected = %v; want 1", got)
+		}
+	})
+
+	t.Run("new_enough", func(t *testing.T) {
+		ts := newTestServer(t, ctx)
+		defer ts.close(t)
+		ts.s.SetMinClientVersion("1.0")
+
+		newRegularClient(t, ts, "alice")
+		newRegularClient(t, ts, "bob")
+		want := map[string]int{version.Short: 2}
+		if got := ts.s.ClientVersions(); !reflect.DeepEqual(got, want) {
+			t.Errorf("ClientVersions = %v; want %v", got, want)
+		}
+	})
+}
+
+func TestServerRelayUsage(t *testing.T) {
+	defer func(d time.Duration) { relayUsageInterval = d }(relayUsageInterval)
+	relayUsageInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	alice := newRegularClient(t, ts, "alice")
+	bob := newRegularClient(t, ts, "bob")
+
+	pkt := make([]byte, 100)
+	for i := 0; i < 3; i++ {
+		if err := alice.c.Send(bob.pub, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got int64
+	for got < 3*int64(len(pkt)) {
+		m, err := alice.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatalf("got %d relayed bytes before error: %v", got, err)
+		}
+		if m, ok := m.(RelayUsageMessage); ok {
+			for _, u := range m {
+				if u.Dst != bob.pub {
+					t.Errorf("relay usage for %v; want %v", u.Dst, bob.pub)
+				}
+				got += u.Bytes
+			}
+		}
+	}
+	if got != 3*int64(len(pkt)) {
+		t.Errorf("relayed %d bytes; want %d", got, 3*len(pkt))
+	}
+}
+
+func TestServerLowBandwidth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	const bytesPerSecond = 100 << 10
+	ts.s.SetLowBandwidthRateLimit(bytesPerSecond, 0)
+
+	alice := newRegularClient(t, ts, "alice")
+	bob := newRegularClient(t, ts, "bob")
+	if err := bob.c.NoteLowBandwidth(true); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ts.s.curLowBandwidthClients.Value() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't note bob's low bandwidth frame")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The burst is raised to MaxPacketSize, so about 65 packets fit
+	// in the bucket and the rest are paced, not dropped. They fit in
+	// bob's send queue while they wait.
+	const numPkts = 80
+	pkt := make([]byte, 1000)
+	start := time.Now()
+	for i := 0; i < numPkts; i++ {
+		if err := alice.c.Send(bob.pub, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got int
+	for got < numPkts {
+		m, err := bob.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatalf("bob got %d packets before error: %v", got, err)
+		}
+		if _, ok := m.(ReceivedPacket); ok {
+			got++
+		}
+	}
+	over := numPkts*len(pkt) - MaxPacketSize
+	if d, min := time.Since(start), time.Duration(over)*time.Second/bytesPerSecond/2; d < min {
+		t.Errorf("relayed %d packets in %v; want paced to take at least %v", numPkts, d, min)
+	}
+	if v := ts.s.packetsDroppedReasonCounters[dropReasonLowBandwidth].Value(); v != 0 {
+		t.Errorf("low_bandwidth drops = %v; want 0", v)
+	}
+}
+
+func TestLowBandwidthDiscoLimit(t *testing.T) {
+	c := &sclient{}
+	alice := key.NewNode().Public()
+	bob := key.NewNode().Public()
+	for i := 0; i < lowBandwidthDiscoBurst; i++ {
+		if !c.allowLowBandwidthDisco(alice) {
+			t.Fatalf("disco packet %d from alice dropped; want burst of %d allowed", i, lowBandwidthDiscoBurst)
+		}
+	}
+	if c.allowLowBandwidthDisco(alice) {
+		t.Error("disco packet past the burst from alice allowed")
+	}
+	if !c.allowLowBandwidthDisco(bob) {
+		t.Error("disco packet from bob dropped; want per-source limits")
+	}
+}
@@ -73,6 +73,7 @@ type Client struct {
 
 	mu           sync.Mutex
 	preferred    bool
+	lowBandwidth bool
 	canAckPings  bool
 	closed       bool
 	netConn      io.Closer
@@ -320,6 +321,12 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 				return nil, 0, err
 			}
 		}
+		if c.lowBandwidth {
+			if err := derpClient.NoteLowBandwidth(true); err != nil {
+				go conn.Close()
+				return nil, 0, err
+			}
+		}
 		c.serverPubKey = derpClient.ServerPublicKey()
 		c.client = derpClient
 		c.netConn = tcpConn
@@ -452,6 +459,12 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 			return nil, 0, err
 		}
 	}
+	if c.lowBandwidth {
+		if err := derpClient.NoteLowBandwidth(true); err != nil {
+			go httpConn.Close()
+			return nil, 0, err
+		}
+	}
 
 	c.serverPubKey = derpClient.ServerPublicKey()
 	c.client = derpClient
@@ -709,46 +722,10 @@ func (c *Client) dialNodeUsingProxy(ctx context.Context, n *tailcfg.DERPNode, pr
 		return nil, err
 	}
 
-	done := make(chan struct{})
-	defer close(done)
-	go func() {
-		select {
-		case <-done:
-			return
-		case <-ctx.Done():
-			proxyConn.Close()
-		}
-	}()
-
 	target := net.JoinHostPort(n.HostName, "443")
-
-	var authHeader string
-	if v, err := tshttpproxy.GetAuthHeader(pu); err != nil {
-		c.logf("derphttp: error getting proxy auth header for %v: %v", proxyURL, err)
-	} else if v != "" {
-		authHeader = fmt.Sprintf("Proxy-Authorization: %s\r\n", v)
-	}
-
-	if _, err := fmt.Fprintf(proxyConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", target, pu.Hostname(), authHeader); err != nil {
-		if ctx.Err() != nil {
-			return nil, ctx.Err()
-		}
+	if err := tshttpproxy.Connect(ctx, proxyConn, pu, target, logger.WithPrefix(c.logf, "derphttp: ")); err != nil {
 		return nil, err
 	}
-
-	br := bufio.NewReader(proxyConn)
-	res, err := http.ReadResponse(br, nil)
-	if err != nil {
-		if ctx.Err() != nil {
-			return nil, ctx.Err()
-		}
-		c.logf("derphttp: CONNECT dial to %s: %v", target, err)
-		return nil, err
-	}
-	c.logf("derphttp: CONNECT dial to %s: %v", target, res.Status)
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("invalid response status from HTTP proxy %s on CONNECT to %s: %v", pu, target, res.Status)
-	}
 	return proxyConn, nil
 }
 
@@ -914,6 +891,27 @@ func (c *Client) NotePreferred(v bool) {
 	}
 }
 
+// SetLowBandwidth sets whether this Client tells the server that it's
+// on a low bandwidth link, so the server paces the packets it relays
+// to it. It applies to the current connection, if any, and future
+// ones.
+func (c *Client) SetLowBandwidth(v bool) {
+	c.mu.Lock()
+	if c.lowBandwidth == v {
+		c.mu.Unlock()
+		return
+	}
+	c.lowBandwidth = v
+	client := c.client
+	c.mu.Unlock()
+
+	if client != nil {
+		if err := client.NoteLowBandwidth(v); err != nil {
+			c.closeForReconnect(client)
+		}
+	}
+}
+
 // WatchConnectionChanges sends a request to subscribe to
 // notifications about clients connecting & disconnecting.
 //
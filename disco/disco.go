@@ -24,6 +24,7 @@
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"go4.org/mem"
 	"inet.af/netaddr"
@@ -44,6 +45,9 @@
 	TypePing        = MessageType(0x01)
 	TypePong        = MessageType(0x02)
 	TypeCallMeMaybe = MessageType(0x03)
+
+	TypeRelayEcho      = MessageType(0x04)
+	TypeRelayEchoReply = MessageType(0x05)
 )
 
 const v0 = byte(0)
@@ -83,6 +87,10 @@ func Parse(p []byte) (Message, error) {
 		return parsePong(ver, p)
 	case TypeCallMeMaybe:
 		return parseCallMeMaybe(ver, p)
+	case TypeRelayEcho:
+		return parseRelayEcho(ver, p)
+	case TypeRelayEchoReply:
+		return parseRelayEchoReply(ver, p)
 	default:
 		return nil, fmt.Errorf("unknown message type 0x%02x", byte(t))
 	}
@@ -240,6 +248,76 @@ func parsePong(ver uint8, p []byte) (m *Pong, err error) {
 	return m, nil
 }
 
+// RelayEcho is a message sent only over DERP asking the recipient to
+// immediately send its Payload back over DERP in a RelayEchoReply.
+//
+// Because the message is sealed to the recipient's disco key, and the
+// reply to the sender's, a relay can neither forge nor modify either
+// one; a reply that comes back intact shows that the relay path
+// delivers packets in both directions.
+type RelayEcho struct {
+	TxID    [12]byte
+	Payload []byte
+}
+
+func (m *RelayEcho) AppendMarshal(b []byte) []byte {
+	ret, d := appendMsgHeader(b, TypeRelayEcho, v0, 12+len(m.Payload))
+	d = d[copy(d, m.TxID[:]):]
+	copy(d, m.Payload)
+	return ret
+}
+
+func parseRelayEcho(ver uint8, p []byte) (m *RelayEcho, err error) {
+	if len(p) < 12 {
+		return nil, errShort
+	}
+	m = new(RelayEcho)
+	p = p[copy(m.TxID[:], p):]
+	m.Payload = append([]byte(nil), p...)
+	return m, nil
+}
+
+// RelayEchoReply is the response to a RelayEcho.
+type RelayEchoReply struct {
+	TxID [12]byte
+
+	// PeerTime is how long the replier held the RelayEcho between
+	// receiving it and sending this reply, so the sender can tell
+	// the time spent on the relay path from the time spent in the
+	// peer. It's sent with microsecond precision.
+	PeerTime time.Duration
+
+	// Payload is the RelayEcho's Payload.
+	Payload []byte
+}
+
+const relayEchoReplyHeaderLen = 12 + 4
+
+func (m *RelayEchoReply) AppendMarshal(b []byte) []byte {
+	ret, d := appendMsgHeader(b, TypeRelayEchoReply, v0, relayEchoReplyHeaderLen+len(m.Payload))
+	d = d[copy(d, m.TxID[:]):]
+	us := m.PeerTime / time.Microsecond
+	if us < 0 {
+		us = 0
+	} else if us > 1<<32-1 {
+		us = 1<<32 - 1
+	}
+	binary.BigEndian.PutUint32(d, uint32(us))
+	copy(d[4:], m.Payload)
+	return ret
+}
+
+func parseRelayEchoReply(ver uint8, p []byte) (m *RelayEchoReply, err error) {
+	if len(p) < relayEchoReplyHeaderLen {
+		return nil, errShort
+	}
+	m = new(RelayEchoReply)
+	p = p[copy(m.TxID[:], p):]
+	m.PeerTime = time.Duration(binary.BigEndian.Uint32(p)) * time.Microsecond
+	m.Payload = append([]byte(nil), p[4:]...)
+	return m, nil
+}
+
 // MessageSummary returns a short summary of m for logging purposes.
 func MessageSummary(m Message) string {
 	switch m := m.(type) {
@@ -249,6 +327,10 @@ func MessageSummary(m Message) string {
 		return fmt.Sprintf("pong tx=%x", m.TxID[:6])
 	case *CallMeMaybe:
 		return "call-me-maybe"
+	case *RelayEcho:
+		return fmt.Sprintf("relay-echo tx=%x", m.TxID[:6])
+	case *RelayEchoReply:
+		return fmt.Sprintf("relay-echo-reply tx=%x", m.TxID[:6])
 	default:
 		return fmt.Sprintf("%#v", m)
 	}
@@ -9,6 +9,7 @@
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"go4.org/mem"
 	"inet.af/netaddr"
@@ -67,6 +68,23 @@ func TestMarshalAndParse(t *testing.T) {
 			},
 			want: "03 00 00 00 00 00 00 00 00 00 00 00 ff ff 01 02 03 04 02 37 20 01 00 00 00 00 00 00 00 00 00 00 00 00 34 56 03 15",
 		},
+		{
+			name: "relay_echo",
+			m: &RelayEcho{
+				TxID:    [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				Payload: []byte{0xaa, 0xbb},
+			},
+			want: "04 00 01 02 03 04 05 06 07 08 09 0a 0b 0c aa bb",
+		},
+		{
+			name: "relay_echo_reply",
+			m: &RelayEchoReply{
+				TxID:     [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				PeerTime: 258 * time.Microsecond,
+				Payload:  []byte{0xaa, 0xbb},
+			},
+			want: "05 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 00 01 02 aa bb",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -12,12 +12,14 @@
 	"net/http"
 	"runtime"
 	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"tailscale.com/envknob"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/usermsg"
 	"tailscale.com/util/multierr"
 )
 
@@ -36,6 +38,7 @@
 	lastMapPollEndedAt      time.Time
 	lastStreamedMapResponse time.Time
 	derpHomeRegion          int
+	derpIdle                bool // magicsock disconnected from DERP while idle
 	derpRegionConnected     = map[int]bool{}
 	derpRegionHealthProblem = map[int]string{}
 	derpRegionLastFrame     = map[int]time.Time{}
@@ -59,6 +62,15 @@
 	// SysRouter is the name of the wgengine/router subsystem.
 	SysRouter = Subsystem("router")
 
+	// SysRouteConvergence is the name of the subsystem that checks
+	// the wgengine/router's routes and firewall rules stay in place.
+	SysRouteConvergence = Subsystem("route-convergence")
+
+	// SysNetfilter is the name of the subsystem that reports the
+	// Linux router falling back to routes-only mode because
+	// iptables isn't usable.
+	SysNetfilter = Subsystem("netfilter")
+
 	// SysDNS is the name of the net/dns subsystem.
 	SysDNS = Subsystem("dns")
 
@@ -72,6 +84,27 @@
 	// the Windows network adapter's "category" (public, private, domain).
 	// If it's unhealthy, the Windows firewall rules won't match.
 	SysNetworkCategory = Subsystem("network-category")
+
+	// SysRouteConflict is the name of the subsystem that checks
+	// whether other network adapters' routes (such as a full-tunnel
+	// corporate VPN's) take precedence over Tailscale's routes.
+	// This only applies on Windows.
+	SysRouteConflict = Subsystem("route-conflict")
+
+	// SysStateStore is the name of the subsystem that persists
+	// tailscaled's state, when it's allowed to fall back to keeping
+	// it in memory.
+	SysStateStore = Subsystem("state-store")
+
+	// SysStateRestore is the name of the subsystem that reports
+	// tailscaled's state file having been restored from a backup
+	// because it was corrupt.
+	SysStateRestore = Subsystem("state-restore")
+
+	// SysExposure is the name of the subsystem that warns about
+	// newly listening ports that broad groups on the tailnet can
+	// reach.
+	SysExposure = Subsystem("exposure")
 )
 
 type watchHandle byte
@@ -105,6 +138,18 @@ func SetRouterHealth(err error) { set(SysRouter, err) }
 // RouterHealth returns the wgengine/router.Router error state.
 func RouterHealth() error { return get(SysRouter) }
 
+// SetRouteConvergenceHealth sets the state of the periodic check that
+// the wgengine/router.Router's OS state is intact.
+func SetRouteConvergenceHealth(err error) { set(SysRouteConvergence, err) }
+
+// SetNetfilterHealth sets the state of the Linux router's netfilter
+// rules. A non-nil err means they're not being installed, whatever the
+// configured netfilter mode.
+func SetNetfilterHealth(err error) { set(SysNetfilter, err) }
+
+// NetfilterHealth returns the netfilter error state.
+func NetfilterHealth() error { return get(SysNetfilter) }
+
 // SetDNSHealth sets the state of the net/dns.Manager
 func SetDNSHealth(err error) { set(SysDNS, err) }
 
@@ -121,10 +166,33 @@ func SetDNSManagerHealth(err error) { set(SysDNSManager, err) }
 // DNSOSHealth returns the net/dns.OSConfigurator error state.
 func DNSOSHealth() error { return get(SysDNSOS) }
 
+// SetStateStoreHealth sets the state of the ipn.StateStore. A non-nil
+// err means state isn't being persisted.
+func SetStateStoreHealth(err error) { set(SysStateStore, err) }
+
+// StateStoreHealth returns the ipn.StateStore error state.
+func StateStoreHealth() error { return get(SysStateStore) }
+
+// SetStateRestoreHealth sets the state of restoring the state file from
+// a backup. A non-nil err describes the restore, so the user can check
+// that nothing was lost.
+func SetStateRestoreHealth(err error) { set(SysStateRestore, err) }
+
+// StateRestoreHealth returns the state file restore error state.
+func StateRestoreHealth() error { return get(SysStateRestore) }
+
+// SetExposureHealth sets the state of newly listening ports' exposure.
+// A non-nil err lists the ports that broad groups can reach.
+func SetExposureHealth(err error) { set(SysExposure, err) }
+
 // SetNetworkCategoryHealth sets the state of setting the network adaptor's category.
 // This only applies on Windows.
 func SetNetworkCategoryHealth(err error) { set(SysNetworkCategory, err) }
 
+// SetRouteConflictHealth sets the state of the check for other network
+// adapters' routes overriding Tailscale's. This only applies on Windows.
+func SetRouteConflictHealth(err error) { set(SysRouteConflict, err) }
+
 func NetworkCategoryHealth() error { return get(SysNetworkCategory) }
 
 func RegisterDebugHandler(typ string, h http.Handler) {
@@ -223,6 +291,16 @@ func SetMagicSockDERPHome(region int) {
 	selfCheckLocked()
 }
 
+// SetMagicSockDERPIdle notes whether magicsock has disconnected from
+// its home DERP because the node is idle, as is expected rather than a
+// problem. See magicsock.Options.DERPIdleTimeout.
+func SetMagicSockDERPIdle(idle bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	derpIdle = idle
+	selfCheckLocked()
+}
+
 // NoteMapRequestHeard notes whenever we successfully sent a map request
 // to control for which we received a 200 response.
 func NoteMapRequestHeard(mr *tailcfg.MapRequest) {
@@ -329,34 +407,37 @@ func OverallError() error {
 
 func overallErrorLocked() error {
 	if !anyInterfaceUp {
-		return errors.New("network down")
+		return usermsg.Errorf(usermsg.HealthNetworkDown)
 	}
 	if !ipnWantRunning {
-		return fmt.Errorf("state=%v, wantRunning=%v", ipnState, ipnWantRunning)
+		return usermsg.Errorf(usermsg.HealthNotRunning, "state", ipnState, "wantRunning", fmt.Sprint(ipnWantRunning))
 	}
 	if lastLoginErr != nil {
-		return fmt.Errorf("not logged in, last login error=%v", lastLoginErr)
+		return &usermsg.Error{
+			Message: usermsg.New(usermsg.HealthLoginError, "error", lastLoginErr.Error()),
+			Err:     lastLoginErr,
+		}
 	}
 	now := time.Now()
 	if !inMapPoll && (lastMapPollEndedAt.IsZero() || now.Sub(lastMapPollEndedAt) > 10*time.Second) {
-		return errors.New("not in map poll")
+		return usermsg.Errorf(usermsg.HealthNotInMapPoll)
 	}
 	const tooIdle = 2*time.Minute + 5*time.Second
 	if d := now.Sub(lastStreamedMapResponse).Round(time.Second); d > tooIdle {
-		return fmt.Errorf("no map response in %v", d)
+		return usermsg.Errorf(usermsg.HealthNoMapResponse, "duration", d.String())
 	}
 	rid := derpHomeRegion
 	if rid == 0 {
-		return errors.New("no DERP home")
+		return usermsg.Errorf(usermsg.HealthNoDERPHome)
 	}
-	if !derpRegionConnected[rid] {
-		return fmt.Errorf("not connected to home DERP region %v", rid)
+	if !derpRegionConnected[rid] && !derpIdle {
+		return usermsg.Errorf(usermsg.HealthDERPHomeDisconnected, "region", strconv.Itoa(rid))
 	}
-	if d := now.Sub(derpRegionLastFrame[rid]).Round(time.Second); d > tooIdle {
-		return fmt.Errorf("haven't heard from home DERP region %v in %v", rid, d)
+	if d := now.Sub(derpRegionLastFrame[rid]).Round(time.Second); d > tooIdle && !derpIdle {
+		return usermsg.Errorf(usermsg.HealthDERPHomeSilent, "region", strconv.Itoa(rid), "duration", d.String())
 	}
 	if udp4Unbound {
-		return errors.New("no udp4 bind")
+		return usermsg.Errorf(usermsg.HealthNoUDP4Bind)
 	}
 
 	// TODO: use
@@ -368,20 +449,23 @@ func overallErrorLocked() error {
 	var errs []error
 	for _, recv := range receiveFuncs {
 		if recv.missing {
-			errs = append(errs, fmt.Errorf("%s is not running", recv.name))
+			errs = append(errs, usermsg.Errorf(usermsg.HealthReceiveFuncStopped, "name", recv.name))
 		}
 	}
 	for sys, err := range sysErr {
 		if err == nil || sys == SysOverall {
 			continue
 		}
-		errs = append(errs, fmt.Errorf("%v: %w", sys, err))
+		errs = append(errs, &usermsg.Error{
+			Message: usermsg.New(usermsg.HealthSubsystem, "subsystem", string(sys), "error", err.Error()),
+			Err:     err,
+		})
 	}
 	for regionID, problem := range derpRegionHealthProblem {
-		errs = append(errs, fmt.Errorf("derp%d: %v", regionID, problem))
+		errs = append(errs, usermsg.Errorf(usermsg.HealthDERPRegionProblem, "region", strconv.Itoa(regionID), "problem", problem))
 	}
 	for _, s := range controlHealth {
-		errs = append(errs, errors.New(s))
+		errs = append(errs, usermsg.Errorf(usermsg.Text, "text", s))
 	}
 	if e := fakeErrForTesting; len(errs) == 0 && e != "" {
 		return errors.New(e)
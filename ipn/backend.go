@@ -15,6 +15,7 @@
 	"tailscale.com/types/key"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/structs"
+	"tailscale.com/types/usermsg"
 )
 
 type State int
@@ -61,10 +62,38 @@ type Notify struct {
 	_       structs.Incomparable
 	Version string // version number of IPN backend
 
+	// Seq is the sequence number of this notification. Each
+	// notification the backend sends has a Seq one larger than the
+	// previous one. Keep-alive notifications, which the backend
+	// sends periodically and which carry no other fields, repeat the
+	// Seq of the most recent notification so that idle frontends can
+	// also notice gaps. A frontend that sees Seq jump by more than
+	// one, or that reconnects to the backend, can send a Resume
+	// command to catch up.
+	//
+	// Seq values are only meaningful within a single backend
+	// process. They start at a time-derived value rather than zero
+	// so a frontend resuming against a restarted backend is seen as
+	// having missed notifications and is sent a full resync.
+	Seq uint64 `json:",omitempty"`
+
+	// Resync, if non-nil, means that this notification is a
+	// snapshot of all of the backend's current state, sent in
+	// response to a Resume command whose missed notifications
+	// were no longer available. Frontends should replace, rather
+	// than merge into, any state they derived from earlier
+	// notifications.
+	Resync *empty.Message `json:",omitempty"`
+
 	// ErrMessage, if non-nil, contains a critical error message.
 	// For State InUseOtherUser, ErrMessage is not critical and just contains the details.
 	ErrMessage *string
 
+	// Message, if non-nil, is ErrMessage in structured form, for
+	// frontends that show it in the user's language. It's set
+	// whenever ErrMessage is, though its English text may differ.
+	Message *usermsg.Message `json:",omitempty"`
+
 	LoginFinished *empty.Message     // non-nil when/if the login process succeeded
 	State         *State             // if non-nil, the new or current IPN state
 	Prefs         *Prefs             // if non-nil, the new or current preferences
@@ -97,9 +126,18 @@ type Notify struct {
 func (n Notify) String() string {
 	var sb strings.Builder
 	sb.WriteString("Notify{")
+	if n.Seq != 0 {
+		fmt.Fprintf(&sb, "seq=%v ", n.Seq)
+	}
+	if n.Resync != nil {
+		sb.WriteString("Resync ")
+	}
 	if n.ErrMessage != nil {
 		fmt.Fprintf(&sb, "err=%q ", *n.ErrMessage)
 	}
+	if n.Message != nil {
+		fmt.Fprintf(&sb, "msg=%s ", n.Message.ID)
+	}
 	if n.LoginFinished != nil {
 		sb.WriteString("LoginFinished ")
 	}
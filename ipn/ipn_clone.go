@@ -7,6 +7,8 @@
 package ipn
 
 import (
+	"time"
+
 	"inet.af/netaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
@@ -23,6 +25,18 @@ func (src *Prefs) Clone() *Prefs {
 	*dst = *src
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
+	dst.TrustedNetworks = append(src.TrustedNetworks[:0:0], src.TrustedNetworks...)
+	dst.StaticDNSRecords = append(src.StaticDNSRecords[:0:0], src.StaticDNSRecords...)
+	if dst.LogoutAt != nil {
+		dst.LogoutAt = new(time.Time)
+		*dst.LogoutAt = *src.LogoutAt
+	}
+	if dst.LogLevels != nil {
+		dst.LogLevels = map[string]string{}
+		for k, v := range src.LogLevels {
+			dst.LogLevels[k] = v
+		}
+	}
 	if dst.Persist != nil {
 		dst.Persist = new(persist.Persist)
 		*dst.Persist = *src.Persist
@@ -51,5 +65,12 @@ func (src *Prefs) Clone() *Prefs {
 	NoSNAT                 bool
 	NetfilterMode          preftype.NetfilterMode
 	OperatorUser           string
+	Telemetry              preftype.TelemetryLevel
+	TrustedNetworks        []string
+	TrustedNetworksIdle    bool
+	StaticDNSRecords       []tailcfg.DNSRecord
+	NodeKeyRotation        time.Duration
+	LogoutAt               *time.Time
+	LogLevels              map[string]string
 	Persist                *persist.Persist
 }{})
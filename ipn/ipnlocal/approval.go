@@ -0,0 +1,313 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// Sensitive pref changes on a node with tailcfg.CapabilityPrefApproval
+// aren't made when asked for locally. Instead they're held as a
+// pendingPrefApproval, listed on the node's peer API, until a device
+// with tailcfg.CapabilityApprovePrefs approves them there (with
+// 'tailscale approve'), giving critical nodes a two-person rule.
+const (
+	prefApprovalTimeout = 10 * time.Minute
+	maxPrefApprovals    = 10 // pending at once
+)
+
+// prefApprovalStateKey is the state key under which whether the last
+// netmap had tailcfg.CapabilityPrefApproval is saved, so that approval
+// is still required while there's no netmap, such as just after a
+// restart or while logged out.
+const prefApprovalStateKey = ipn.StateKey("_pref-approval")
+
+// pendingPrefApproval is a pref change waiting for approval.
+type pendingPrefApproval struct {
+	id      string
+	summary string // as returned by sensitivePrefChanges
+	digest  string // of edits, as returned by prefEditsDigest
+	edits   []*ipn.MaskedPrefs
+	created time.Time
+}
+
+func (pa *pendingPrefApproval) expires() time.Time {
+	return pa.created.Add(prefApprovalTimeout)
+}
+
+// sensitivePrefChanges describes the changes from p0 to p1 that need
+// approval on a node with tailcfg.CapabilityPrefApproval, or returns
+// the empty string if there are none.
+//
+// Turning shields-up on and clearing the exit node's ID once it's been
+// resolved from its IP only ever make the node less exposed or are
+// bookkeeping, so they don't count.
+//
+// Tailnet lock isn't covered: this node has no local way to disable
+// it, so there's no change to hold.
+func sensitivePrefChanges(p0, p1 *ipn.Prefs) string {
+	var changes []string
+	if p0.ShieldsUp && !p1.ShieldsUp {
+		changes = append(changes, "turn off shields-up")
+	}
+	if exit0, exit1 := exitNodeDesc(p0), exitNodeDesc(p1); exit0 != exit1 {
+		changes = append(changes, fmt.Sprintf("change exit node from %s to %s", exit0, exit1))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// exitNodeDesc describes p's exit node, for sensitivePrefChanges.
+func exitNodeDesc(p *ipn.Prefs) string {
+	switch {
+	case !p.ExitNodeIP.IsZero():
+		return p.ExitNodeIP.String()
+	case !p.ExitNodeID.IsZero():
+		return string(p.ExitNodeID)
+	}
+	return "none"
+}
+
+// prefEditsDigest returns a digest of what edits change, so that an
+// approval applies to exactly the change that was asked for.
+func prefEditsDigest(edits []*ipn.MaskedPrefs) string {
+	h := sha256.New()
+	for _, mp := range edits {
+		fmt.Fprintf(h, "%s\n", mp.Pretty())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadPrefApprovalCap reads whether approval was last required from the
+// state store. If that can't be read, it's assumed to be.
+func (b *LocalBackend) loadPrefApprovalCap() {
+	bs, err := b.store.ReadState(prefApprovalStateKey)
+	switch {
+	case errors.Is(err, ipn.ErrStateNotExist):
+	case err != nil:
+		b.logf("pref approval: %v; requiring approval until the netmap says otherwise", err)
+		b.capPrefApproval = true
+	default:
+		b.capPrefApproval = string(bs) != "0"
+	}
+}
+
+// updatePrefApprovalCapLocked records whether nm, a new non-nil
+// netmap, requires pref approval, saving it if that's changed.
+//
+// b.mu must be held.
+func (b *LocalBackend) updatePrefApprovalCapLocked(nm *netmap.NetworkMap) {
+	pa := hasCapability(nm, tailcfg.CapabilityPrefApproval)
+	if pa == b.capPrefApproval {
+		return
+	}
+	b.capPrefApproval = pa
+	v := "0"
+	if pa {
+		v = "1"
+	}
+	if err := b.store.WriteState(prefApprovalStateKey, []byte(v)); err != nil {
+		b.logf("pref approval: %v", err)
+	}
+}
+
+// prefApprovalRequiredLocked reports whether sensitive pref changes
+// need approval. Without a netmap it goes by the last one seen, so
+// that restarting or logging out isn't a way around approval.
+//
+// b.mu must be held.
+func (b *LocalBackend) prefApprovalRequiredLocked() bool {
+	if b.netMap == nil {
+		return b.capPrefApproval
+	}
+	return hasCapability(b.netMap, tailcfg.CapabilityPrefApproval)
+}
+
+// checkPrefApprovalLocked returns an error if the change from p0 to p1,
+// made by edits, needs approval, after recording it as pending.
+//
+// Asking again for the same change waits on the same approval, but
+// asking for a different one with the same effect is refused until
+// the first is approved or expires, as the approver may already have
+// seen the first.
+//
+// b.mu must be held.
+func (b *LocalBackend) checkPrefApprovalLocked(p0, p1 *ipn.Prefs, edits []*ipn.MaskedPrefs) error {
+	if !b.prefApprovalRequiredLocked() {
+		return nil
+	}
+	summary := sensitivePrefChanges(p0, p1)
+	if summary == "" {
+		return nil
+	}
+	b.expirePrefApprovalsLocked()
+	digest := prefEditsDigest(edits)
+	var pa *pendingPrefApproval
+	for _, x := range b.prefApprovals {
+		if x.summary == summary {
+			if x.digest != digest {
+				return fmt.Errorf("%s with different settings is already waiting for approval as %s; wait for it to be approved or to expire", summary, x.id)
+			}
+			pa = x // asked again; keep the same ID
+			break
+		}
+	}
+	if pa == nil {
+		if len(b.prefApprovals) >= maxPrefApprovals {
+			return fmt.Errorf("%s needs approval from another device, but too many changes are already waiting for approval", summary)
+		}
+		var buf [4]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return err
+		}
+		pa = &pendingPrefApproval{
+			id:      hex.EncodeToString(buf[:]),
+			summary: summary,
+			digest:  digest,
+			edits:   edits,
+			created: time.Now(),
+		}
+		b.prefApprovals = append(b.prefApprovals, pa)
+		b.logf("pref change %s waiting for approval: %s", pa.id, summary)
+	}
+	name := "<this device>"
+	if nm := b.netMap; nm != nil && nm.SelfNode != nil {
+		name = nm.SelfNode.ComputedName
+	}
+	return fmt.Errorf("%s needs approval from another device; run \"tailscale approve %s %s\" on one that's allowed to approve it within %v", summary, name, pa.id, prefApprovalTimeout)
+}
+
+// holdSensitivePrefsLocked is checkPrefApprovalLocked for callers that
+// replace the prefs wholesale (SetPrefs, and Start with UpdatePrefs)
+// rather than editing them. If the change from p0 to p1 needs approval,
+// it records the sensitive part as pending, reverts it in p1 so the
+// rest of the change still goes through, and returns the error.
+//
+// b.mu must be held.
+func (b *LocalBackend) holdSensitivePrefsLocked(p0, p1 *ipn.Prefs) error {
+	if p0 == nil {
+		return nil
+	}
+	edit := &ipn.MaskedPrefs{
+		Prefs:         *p1.Clone(),
+		ShieldsUpSet:  true,
+		ExitNodeIDSet: true,
+		ExitNodeIPSet: true,
+	}
+	if err := b.checkPrefApprovalLocked(p0, p1, []*ipn.MaskedPrefs{edit}); err != nil {
+		p1.ShieldsUp = p0.ShieldsUp
+		p1.ExitNodeID = p0.ExitNodeID
+		p1.ExitNodeIP = p0.ExitNodeIP
+		return err
+	}
+	return nil
+}
+
+// expirePrefApprovalsLocked drops pending approvals that have lapsed.
+//
+// b.mu must be held.
+func (b *LocalBackend) expirePrefApprovalsLocked() {
+	now := time.Now()
+	keep := b.prefApprovals[:0]
+	for _, pa := range b.prefApprovals {
+		if now.Before(pa.expires()) {
+			keep = append(keep, pa)
+		} else {
+			b.logf("pref change %s not approved in time", pa.id)
+		}
+	}
+	for i := len(keep); i < len(b.prefApprovals); i++ {
+		b.prefApprovals[i] = nil
+	}
+	b.prefApprovals = keep
+}
+
+// pendingPrefApprovals returns the pref changes waiting for approval.
+func (b *LocalBackend) pendingPrefApprovals() []apitype.PrefApproval {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expirePrefApprovalsLocked()
+	ret := []apitype.PrefApproval{}
+	for _, pa := range b.prefApprovals {
+		ret = append(ret, apitype.PrefApproval{
+			ID:      pa.id,
+			Summary: pa.summary,
+			Digest:  pa.digest,
+			Created: pa.created,
+			Expires: pa.expires(),
+		})
+	}
+	return ret
+}
+
+// approvePrefChange makes the pending pref change id, approved by
+// approver. If digest is non-empty, it must match the change's, as
+// listed by pendingPrefApprovals when the approver was shown it.
+func (b *LocalBackend) approvePrefChange(id, digest string, approver *tailcfg.Node) error {
+	b.mu.Lock()
+	b.expirePrefApprovalsLocked()
+	var pa *pendingPrefApproval
+	for i, x := range b.prefApprovals {
+		if x.id == id {
+			if digest != "" && digest != x.digest {
+				b.mu.Unlock()
+				return fmt.Errorf("pref change %q isn't the change that was shown", id)
+			}
+			pa = x
+			b.prefApprovals = append(b.prefApprovals[:i], b.prefApprovals[i+1:]...)
+			break
+		}
+	}
+	if pa == nil {
+		b.mu.Unlock()
+		return fmt.Errorf("no pref change %q waiting for approval", id)
+	}
+	b.logf("pref change %s (%s) approved by %v (%v)", pa.id, pa.summary, approver.ComputedName, approver.StableID)
+	_, err := b.editPrefsLockedOnEntry("ApprovedPrefs", pa.edits, false, true)
+	return err
+}
+
+// PrefApprovals returns the pref changes waiting for approval on the
+// peer with Tailscale IP ip.
+func (b *LocalBackend) PrefApprovals(ctx context.Context, ip netaddr.IP) ([]apitype.PrefApproval, error) {
+	body, err := b.doPeerAPIRequest(ctx, ip, "GET", "/v0/pref-approvals")
+	if err != nil {
+		return nil, err
+	}
+	var ret []apitype.PrefApproval
+	if err := json.Unmarshal(body, &ret); err != nil {
+		return nil, fmt.Errorf("invalid pref approvals JSON from peer: %w", err)
+	}
+	return ret, nil
+}
+
+// ApprovePrefChange approves the pending pref change id on the peer
+// with Tailscale IP ip. If digest is non-empty, the change must still
+// be the one PrefApprovals listed with that digest.
+func (b *LocalBackend) ApprovePrefChange(ctx context.Context, ip netaddr.IP, id, digest string) error {
+	if id == "" {
+		return errors.New("missing pref change ID")
+	}
+	v := url.Values{"id": {id}}
+	if digest != "" {
+		v.Set("digest", digest)
+	}
+	_, err := b.doPeerAPIRequest(ctx, ip, "POST", "/v0/pref-approvals?"+v.Encode())
+	return err
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+)
+
+func TestSensitivePrefChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		p0, p1 ipn.Prefs
+		want   string
+	}{
+		{
+			name: "none",
+			p0:   ipn.Prefs{Hostname: "a"},
+			p1:   ipn.Prefs{Hostname: "b"},
+		},
+		{
+			name: "shields_up",
+			p1:   ipn.Prefs{ShieldsUp: true},
+		},
+		{
+			name: "shields_down",
+			p0:   ipn.Prefs{ShieldsUp: true},
+			want: "turn off shields-up",
+		},
+		{
+			name: "exit_node",
+			p1:   ipn.Prefs{ExitNodeIP: netaddr.MustParseIP("100.64.0.1")},
+			want: "change exit node from none to 100.64.0.1",
+		},
+		{
+			name: "exit_node_resolved",
+			p0:   ipn.Prefs{ExitNodeIP: netaddr.MustParseIP("100.64.0.1")},
+			p1:   ipn.Prefs{ExitNodeIP: netaddr.MustParseIP("100.64.0.1"), ExitNodeID: "n1"},
+		},
+		{
+			name: "both",
+			p0:   ipn.Prefs{ShieldsUp: true, ExitNodeID: "n1"},
+			want: "turn off shields-up, change exit node from n1 to none",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sensitivePrefChanges(&tt.p0, &tt.p1); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefApproval(t *testing.T) {
+	var logf logger.Logf = logger.Discard
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	lb, err := NewLocalBackend(logf, "logid", new(mem.Store), nil, eng, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	if err := lb.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	shields := func(up bool) *ipn.MaskedPrefs {
+		return &ipn.MaskedPrefs{Prefs: ipn.Prefs{ShieldsUp: up}, ShieldsUpSet: true}
+	}
+	if _, err := lb.EditPrefs(shields(true)); err != nil {
+		t.Fatalf("shields up: %v", err)
+	}
+
+	lb.mu.Lock()
+	lb.netMap = &netmap.NetworkMap{SelfNode: &tailcfg.Node{
+		ComputedName: "critical",
+		Capabilities: []string{tailcfg.CapabilityPrefApproval},
+	}}
+	lb.mu.Unlock()
+
+	// Turning shields-up on again doesn't need approval; turning it
+	// off does, and every attempt waits on the same request.
+	if _, err := lb.EditPrefs(shields(true)); err != nil {
+		t.Fatalf("shields up with approval cap: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := lb.EditPrefs(shields(false))
+		if err == nil || !strings.Contains(err.Error(), "tailscale approve critical") {
+			t.Fatalf("shields down: got err %v; want approval needed", err)
+		}
+	}
+	if !lb.Prefs().ShieldsUp {
+		t.Fatal("shields-up turned off before approval")
+	}
+	pas := lb.pendingPrefApprovals()
+	if len(pas) != 1 || pas[0].Summary != "turn off shields-up" {
+		t.Fatalf("pending approvals = %+v; want one to turn off shields-up", pas)
+	}
+
+	// The same change with something else riding along can't replace
+	// the one waiting for approval.
+	sneaky := shields(false)
+	sneaky.Hostname = "sneaky"
+	sneaky.HostnameSet = true
+	if _, err := lb.EditPrefs(sneaky); err == nil || !strings.Contains(err.Error(), "different settings") {
+		t.Fatalf("shields down with other edits: got err %v; want different settings", err)
+	}
+
+	approver := &tailcfg.Node{ComputedName: "admin", StableID: "admin"}
+	if err := lb.approvePrefChange("bogus", "", approver); err == nil {
+		t.Error("approving unknown change succeeded")
+	}
+	if err := lb.approvePrefChange(pas[0].ID, "bogus", approver); err == nil {
+		t.Error("approving change with the wrong digest succeeded")
+	}
+	if err := lb.approvePrefChange(pas[0].ID, pas[0].Digest, approver); err != nil {
+		t.Fatalf("approvePrefChange: %v", err)
+	}
+	if p := lb.Prefs(); p.ShieldsUp || p.Hostname == "sneaky" {
+		t.Errorf("after approval: ShieldsUp=%v Hostname=%q; want false and unchanged", p.ShieldsUp, p.Hostname)
+	}
+	if pas := lb.pendingPrefApprovals(); len(pas) != 0 {
+		t.Errorf("pending approvals after approval = %+v; want none", pas)
+	}
+	if err := lb.approvePrefChange(pas[0].ID, "", approver); err == nil {
+		t.Error("approving the same change twice succeeded")
+	}
+}
+
+func TestPrefApprovalSetPrefs(t *testing.T) {
+	var logf logger.Logf = logger.Discard
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	lb, err := NewLocalBackend(logf, "logid", new(mem.Store), nil, eng, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	if err := lb.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	p := lb.Prefs()
+	p.ShieldsUp = true
+	lb.SetPrefs(p)
+
+	lb.mu.Lock()
+	lb.netMap = &netmap.NetworkMap{SelfNode: &tailcfg.Node{
+		ComputedName: "critical",
+		Capabilities: []string{tailcfg.CapabilityPrefApproval},
+	}}
+	lb.mu.Unlock()
+
+	// Replacing the prefs wholesale can't turn shields-up off either,
+	// but the rest of the change still applies.
+	p = lb.Prefs()
+	p.ShieldsUp = false
+	p.Hostname = "renamed"
+	lb.SetPrefs(p)
+	if got := lb.Prefs(); !got.ShieldsUp || got.Hostname != "renamed" {
+		t.Fatalf("after SetPrefs: ShieldsUp=%v Hostname=%q; want true, renamed", got.ShieldsUp, got.Hostname)
+	}
+
+	p = lb.Prefs()
+	p.ShieldsUp = false
+	if err := lb.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey, UpdatePrefs: p}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if !lb.Prefs().ShieldsUp {
+		t.Fatal("Start with UpdatePrefs turned shields-up off before approval")
+	}
+
+	pas := lb.pendingPrefApprovals()
+	if len(pas) != 1 || pas[0].Summary != "turn off shields-up" {
+		t.Fatalf("pending approvals = %+v; want one to turn off shields-up", pas)
+	}
+	if err := lb.approvePrefChange(pas[0].ID, "", &tailcfg.Node{ComputedName: "admin"}); err != nil {
+		t.Fatalf("approvePrefChange: %v", err)
+	}
+	if lb.Prefs().ShieldsUp {
+		t.Error("shields-up still on after approval")
+	}
+}
+
+func TestPrefApprovalWithoutNetmap(t *testing.T) {
+	var logf logger.Logf = logger.Discard
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	// The last netmap seen, before a restart, needed approval.
+	store := new(mem.Store)
+	if err := store.WriteState(prefApprovalStateKey, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLocalBackend(logf, "logid", store, nil, eng, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	if err := lb.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	exitNode := &ipn.MaskedPrefs{
+		Prefs:         ipn.Prefs{ExitNodeIP: netaddr.MustParseIP("100.64.0.1")},
+		ExitNodeIPSet: true,
+	}
+	if _, err := lb.EditPrefs(exitNode); err == nil {
+		t.Fatal("exit node changed without a netmap or approval")
+	}
+
+	// A netmap without the capability lifts the requirement, and
+	// that's saved too.
+	lb.mu.Lock()
+	lb.updatePrefApprovalCapLocked(&netmap.NetworkMap{SelfNode: &tailcfg.Node{}})
+	lb.mu.Unlock()
+	if _, err := lb.EditPrefs(exitNode); err != nil {
+		t.Fatalf("exit node change after the capability was dropped: %v", err)
+	}
+	if bs, err := store.ReadState(prefApprovalStateKey); err != nil || string(bs) != "0" {
+		t.Errorf("saved state = %q, %v; want \"0\"", bs, err)
+	}
+}
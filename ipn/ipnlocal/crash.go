@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"time"
+
+	"tailscale.com/logtail"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/preftype"
+	"tailscale.com/util/crashreport"
+)
+
+// maxCrashUploadStack is how much of a crash report's stack is uploaded.
+// The crashing goroutine comes first, and logtail truncates long entries
+// anyway.
+const maxCrashUploadStack = 12 << 10
+
+// SetCrashReports sets the directory of crash reports from previous runs,
+// and whether to upload those not yet uploaded once telemetry allows.
+//
+// It should only be called before the LocalBackend is used.
+func (b *LocalBackend) SetCrashReports(dir string, upload bool) {
+	b.crashDir = dir
+	b.uploadCrashes = upload
+}
+
+// SetRecentLogs sets the buffer of tailscaled's recent log lines, which
+// may be nil.
+//
+// It should only be called before the LocalBackend is used.
+func (b *LocalBackend) SetRecentLogs(r *logger.Ring) {
+	b.recentLogs = r
+}
+
+// RecentLogs returns tailscaled's most recent log lines, oldest first,
+// or nil if they're not kept.
+func (b *LocalBackend) RecentLogs() []string {
+	if b.recentLogs == nil {
+		return nil
+	}
+	return b.recentLogs.Lines()
+}
+
+// CrashReports returns the crash reports from previous runs, newest first.
+func (b *LocalBackend) CrashReports() ([]*crashreport.Report, error) {
+	if b.crashDir == "" {
+		return nil, nil
+	}
+	return crashreport.List(b.crashDir)
+}
+
+// maybeUploadCrashReportsLocked starts uploading the crash reports not yet
+// uploaded, if enabled and the node's telemetry level permits crash
+// reports. Reports are uploaded at most once per process; a later start
+// tries again for any it didn't get to.
+//
+// b.mu must be held.
+func (b *LocalBackend) maybeUploadCrashReportsLocked() {
+	if !b.uploadCrashes || b.crashDir == "" || b.crashUploadStarted {
+		return
+	}
+	if logtail.Telemetry() != preftype.TelemetryFull {
+		return
+	}
+	b.crashUploadStarted = true
+	go b.uploadCrashReports()
+}
+
+func (b *LocalBackend) uploadCrashReports() {
+	reports, err := crashreport.List(b.crashDir)
+	if err != nil {
+		b.logf("crash reports: %v", err)
+		return
+	}
+	uploaded := 0
+	for _, r := range reports {
+		if r.Uploaded {
+			continue
+		}
+		if uploaded > 0 {
+			// Stay under the log rate limit.
+			time.Sleep(time.Second)
+		}
+		stack := r.Stack
+		if len(stack) > maxCrashUploadStack {
+			stack = stack[:maxCrashUploadStack]
+		}
+		b.logf("crashreport %s: time=%v version=%q\n%s\n%s", r.ID, r.Time.UTC().Format(time.RFC3339), r.Version, r.Reason, stack)
+		if err := crashreport.MarkUploaded(b.crashDir, r.ID); err != nil {
+			b.logf("crash reports: %v", err)
+		}
+		uploaded++
+	}
+}
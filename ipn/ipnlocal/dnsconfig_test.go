@@ -146,6 +146,41 @@ func TestDNSConfigForNetmap(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "static_records",
+			nm: &netmap.NetworkMap{
+				Name:      "myname.net",
+				Addresses: ipps("100.101.101.101"),
+				Peers: []*tailcfg.Node{
+					{
+						Name:      "peera.net",
+						Addresses: ipps("100.102.0.1"),
+					},
+				},
+				DNS: tailcfg.DNSConfig{
+					ExtraRecords: []tailcfg.DNSRecord{
+						{Name: "foo.com", Value: "1.2.3.4"},
+					},
+				},
+			},
+			prefs: &ipn.Prefs{
+				StaticDNSRecords: []tailcfg.DNSRecord{
+					{Name: "peera.net", Value: "100.102.0.9"},
+					{Name: "foo.com.", Value: "5.6.7.8"},
+					{Name: "foo.com", Value: "1::7"},
+					{Name: "lab.example", Value: "192.168.1.10"},
+				},
+			},
+			want: &dns.Config{
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+				Hosts: map[dnsname.FQDN][]netaddr.IP{
+					"myname.net.":  ips("100.101.101.101"),
+					"peera.net.":   ips("100.102.0.9"),
+					"foo.com.":     ips("5.6.7.8", "1::7"),
+					"lab.example.": ips("192.168.1.10"),
+				},
+			},
+		},
 		{
 			name: "corp_dns_misc",
 			nm: &netmap.NetworkMap{
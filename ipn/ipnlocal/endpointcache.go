@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/types/key"
+	"tailscale.com/wgengine/magicsock"
+)
+
+// endpointCacheStateKey is the state key under which the peers' last
+// confirmed direct paths are saved, so that after a restart (such as
+// for an upgrade) magicsock tries them first.
+const endpointCacheStateKey = ipn.StateKey("_endpoint-cache")
+
+const (
+	// endpointCacheSaveInterval is how often, at most, the endpoint
+	// cache is saved while running, so it's fairly fresh even after a
+	// crash. Saving rewrites the whole state store (with the kube
+	// store, a Secret update), so it's only done when a peer's path
+	// has changed, and rarely.
+	endpointCacheSaveInterval = time.Hour
+
+	// endpointCacheMaxAge is how old a cached path can be and still
+	// be tried. NAT mappings rarely last longer.
+	endpointCacheMaxAge = 24 * time.Hour
+)
+
+// loadEndpointCacheLocked passes the saved endpoint cache to magicsock.
+//
+// b.mu must be held.
+func (b *LocalBackend) loadEndpointCacheLocked() {
+	mc, err := b.magicConn()
+	if err != nil {
+		return
+	}
+	bs, err := b.store.ReadState(endpointCacheStateKey)
+	if err != nil {
+		if !errors.Is(err, ipn.ErrStateNotExist) {
+			b.logf("endpoint cache: %v", err)
+		}
+		return
+	}
+	var hints map[key.NodePublic]magicsock.EndpointHint
+	if err := json.Unmarshal(bs, &hints); err != nil {
+		b.logf("endpoint cache: %v", err)
+		return
+	}
+	now := time.Now()
+	for k, h := range hints {
+		if now.Sub(h.At) > endpointCacheMaxAge {
+			delete(hints, k)
+		}
+	}
+	b.logf("endpoint cache: trying %d cached direct paths", len(hints))
+	b.endpointCacheAddrs = endpointHintAddrs(hints)
+	mc.SetEndpointHints(hints)
+}
+
+// maybeSaveEndpointCache saves the endpoint cache if it hasn't been
+// checked in endpointCacheSaveInterval and a peer's path has changed.
+func (b *LocalBackend) maybeSaveEndpointCache() {
+	b.mu.Lock()
+	due := time.Since(b.endpointCacheChecked) >= endpointCacheSaveInterval
+	if due {
+		b.endpointCacheChecked = time.Now()
+	}
+	b.mu.Unlock()
+	if due {
+		b.saveEndpointCache()
+	}
+}
+
+// saveEndpointCache writes the peers' direct paths, as magicsock
+// currently knows them, to the state store, unless they're the same
+// as those last saved or loaded. Paths that differ only in when they
+// were last confirmed aren't worth a write.
+func (b *LocalBackend) saveEndpointCache() {
+	mc, err := b.magicConn()
+	if err != nil {
+		return
+	}
+	hints := mc.EndpointHints()
+	if len(hints) == 0 {
+		return
+	}
+	addrs := endpointHintAddrs(hints)
+	b.mu.Lock()
+	changed := !reflect.DeepEqual(addrs, b.endpointCacheAddrs)
+	if changed {
+		b.endpointCacheAddrs = addrs
+	}
+	b.mu.Unlock()
+	if !changed {
+		return
+	}
+	bs, err := json.Marshal(hints)
+	if err != nil {
+		b.logf("endpoint cache: %v", err)
+		return
+	}
+	if err := b.store.WriteState(endpointCacheStateKey, bs); err != nil {
+		b.logf("endpoint cache: %v", err)
+		b.mu.Lock()
+		b.endpointCacheAddrs = nil // try again next time
+		b.mu.Unlock()
+	}
+}
+
+// endpointHintAddrs returns the peers' addresses in hints.
+func endpointHintAddrs(hints map[key.NodePublic]magicsock.EndpointHint) map[key.NodePublic]netaddr.IPPort {
+	ret := make(map[key.NodePublic]netaddr.IPPort, len(hints))
+	for k, h := range hints {
+		ret[k] = h.Addr
+	}
+	return ret
+}
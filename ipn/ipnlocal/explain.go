@@ -0,0 +1,177 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/filter"
+)
+
+// ExplainUnreachable inspects the local state that decides whether this
+// node can reach ip: the backend state, key expiry, the netmap, routes,
+// packet filter, and magicsock's view of the peer. It returns what it
+// found wrong, most likely cause first.
+func (b *LocalBackend) ExplainUnreachable(ip netaddr.IP) *ipnstate.UnreachableReport {
+	b.mu.Lock()
+	state := b.state
+	nm := b.netMap
+	prefs := b.prefs.Clone()
+	b.mu.Unlock()
+	if prefs == nil {
+		prefs = ipn.NewPrefs()
+	}
+	return explainUnreachable(ip, state, nm, prefs, b.Status(), time.Now())
+}
+
+// explainUnreachable is the implementation of ExplainUnreachable.
+// The checks are made in order from most to least common cause.
+func explainUnreachable(ip netaddr.IP, state ipn.State, nm *netmap.NetworkMap, prefs *ipn.Prefs, st *ipnstate.Status, now time.Time) *ipnstate.UnreachableReport {
+	rep := &ipnstate.UnreachableReport{IP: ip}
+	add := func(code string, blocking bool, format string, args ...any) {
+		rep.Reasons = append(rep.Reasons, ipnstate.UnreachableReason{
+			Code:     code,
+			Blocking: blocking,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+	defer func() {
+		sort.SliceStable(rep.Reasons, func(i, j int) bool {
+			return rep.Reasons[i].Blocking && !rep.Reasons[j].Blocking
+		})
+	}()
+
+	if state != ipn.Running {
+		add("not-running", true, "Tailscale isn't running on this device (state %v); run 'tailscale up'", state)
+	}
+	if nm == nil {
+		add("no-netmap", true, "this device hasn't received a network map from the coordination server yet")
+		return rep
+	}
+	if !nm.Expiry.IsZero() && nm.Expiry.Before(now) {
+		add("self-key-expired", true, "this device's node key expired at %v; run 'tailscale up --force-reauth' to log in again", nm.Expiry.Format(time.RFC3339))
+	}
+
+	peer, route := peerForUnreachable(ip, nm, prefs)
+	switch {
+	case peer == nil && tsaddr.IsTailscaleIP(ip):
+		if nm.SelfNode != nil && nodeHasAddr(nm.SelfNode, ip) {
+			add("self", false, "%v is this device's own address", ip)
+			return rep
+		}
+		add("not-in-netmap", true, "no peer with address %v is in this device's network map: it may not exist, it may have been removed from the tailnet, or the ACLs may not let this device reach it", ip)
+		return rep
+	case peer == nil:
+		add("no-route", true, "%v isn't a Tailscale address and no subnet router or exit node in use covers it", ip)
+		return rep
+	}
+	rep.Peer = peer.Key
+	rep.PeerName = peer.DisplayName(false)
+	name := rep.PeerName
+
+	if route.IsValid() && route.Bits() != 0 && !prefs.RouteAll {
+		add("routes-not-accepted", true, "%v is in the subnet route %v advertised by %s, but this device doesn't accept subnet routes; run 'tailscale up --accept-routes'", ip, route, name)
+	}
+	if !peer.KeyExpiry.IsZero() && peer.KeyExpiry.Before(now) {
+		add("peer-key-expired", true, "%s's node key expired at %v; it needs to log in again", name, peer.KeyExpiry.Format(time.RFC3339))
+	}
+	if peer.Online != nil && !*peer.Online {
+		if peer.LastSeen != nil && !peer.LastSeen.IsZero() {
+			add("peer-offline", true, "%s is offline (last seen %v)", name, peer.LastSeen.Format(time.RFC3339))
+		} else {
+			add("peer-offline", true, "%s is offline", name)
+		}
+	}
+	if peer.DERP == "" && len(peer.Endpoints) == 0 {
+		add("peer-no-path", true, "%s has no known endpoints or DERP home, so there's no path to it; it may not have connected to the coordination server recently", name)
+	}
+
+	if ps := st.Peer[peer.Key]; ps != nil {
+		switch {
+		case ps.LastHandshake.IsZero() && ps.TxBytes > 0:
+			add("no-handshake", false, "this device sent %d bytes to %s but no WireGuard handshake completed; it may be offline, or a firewall may be blocking UDP on both ends with no DERP fallback", ps.TxBytes, name)
+		case ps.CurAddr == "" && ps.Relay != "" && !ps.LastHandshake.IsZero():
+			add("relayed", false, "%s is only reachable through the DERP relay %q, not directly; traffic works but is slower", name, ps.Relay)
+		}
+	}
+	if st.Self != nil && st.Self.Relay == "" {
+		add("no-derp-home", false, "this device isn't connected to a DERP relay, so it can only reach peers it has a direct path to")
+	}
+
+	if prefs.ShieldsUp {
+		add("shields-up", false, "shields up is on, so %s can't open connections to this device; connections from this device still work", name)
+	} else if !filterAllowsFrom(nm.PacketFilter, peer, now) {
+		add("acl-no-inbound", false, "the ACLs don't let %s open connections to this device; connections from this device are only limited by the ACL rules %s enforces, which this device can't see", name, name)
+	}
+	return rep
+}
+
+// peerForUnreachable returns the peer in nm that traffic to ip goes to,
+// and the route of it that matched, if any. Exact address matches win
+// over subnet routes, longer routes over shorter ones, and the exit
+// node in use handles what nothing else does.
+func peerForUnreachable(ip netaddr.IP, nm *netmap.NetworkMap, prefs *ipn.Prefs) (peer *tailcfg.Node, route netaddr.IPPrefix) {
+	for _, p := range nm.Peers {
+		if nodeHasAddr(p, ip) {
+			return p, netaddr.IPPrefix{}
+		}
+	}
+	for _, p := range nm.Peers {
+		for _, r := range p.AllowedIPs {
+			if r.Bits() == 0 || !r.Contains(ip) || tsaddr.IsTailscaleIP(r.IP()) && r.IsSingleIP() {
+				continue
+			}
+			if peer == nil || r.Bits() > route.Bits() {
+				peer, route = p, r
+			}
+		}
+	}
+	if peer != nil || tsaddr.IsTailscaleIP(ip) {
+		return peer, route
+	}
+	for _, p := range nm.Peers {
+		if !prefs.ExitNodeID.IsZero() && p.StableID == prefs.ExitNodeID ||
+			prefs.ExitNodeIP.IsValid() && nodeHasAddr(p, prefs.ExitNodeIP) {
+			if ip.Is4() {
+				return p, netaddr.IPPrefixFrom(netaddr.IPv4(0, 0, 0, 0), 0)
+			}
+			return p, netaddr.IPPrefixFrom(netaddr.IPv6Unspecified(), 0)
+		}
+	}
+	return nil, netaddr.IPPrefix{}
+}
+
+func nodeHasAddr(n *tailcfg.Node, ip netaddr.IP) bool {
+	for _, a := range n.Addresses {
+		if a.IsSingleIP() && a.IP() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAllowsFrom reports whether any of the packet filter matches
+// active at now lets peer open connections to this node.
+func filterAllowsFrom(matches []filter.Match, peer *tailcfg.Node, now time.Time) bool {
+	active, _ := filter.ActiveMatches(matches, now)
+	for _, m := range active {
+		for _, src := range m.Srcs {
+			for _, a := range peer.Addresses {
+				if src.Contains(a.IP()) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
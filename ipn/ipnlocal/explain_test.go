@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestExplainUnreachable(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	offline := false
+	pfx := netaddr.MustParseIPPrefix
+
+	healthy := &tailcfg.Node{
+		Key:        key.NewNode().Public(),
+		Name:       "healthy.example.ts.net.",
+		Addresses:  []netaddr.IPPrefix{pfx("100.64.0.2/32")},
+		AllowedIPs: []netaddr.IPPrefix{pfx("100.64.0.2/32")},
+		DERP:       "127.3.3.40:1",
+	}
+	expired := &tailcfg.Node{
+		Key:        key.NewNode().Public(),
+		Name:       "expired.example.ts.net.",
+		Addresses:  []netaddr.IPPrefix{pfx("100.64.0.3/32")},
+		AllowedIPs: []netaddr.IPPrefix{pfx("100.64.0.3/32")},
+		KeyExpiry:  past,
+		Online:     &offline,
+		DERP:       "127.3.3.40:1",
+	}
+	router := &tailcfg.Node{
+		Key:        key.NewNode().Public(),
+		Name:       "router.example.ts.net.",
+		Addresses:  []netaddr.IPPrefix{pfx("100.64.0.4/32")},
+		AllowedIPs: []netaddr.IPPrefix{pfx("100.64.0.4/32"), pfx("192.168.0.0/24")},
+		DERP:       "127.3.3.40:1",
+	}
+	nm := &netmap.NetworkMap{
+		SelfNode: &tailcfg.Node{Addresses: []netaddr.IPPrefix{pfx("100.64.0.1/32")}},
+		Peers:    []*tailcfg.Node{healthy, expired, router},
+		PacketFilter: []filter.Match{{
+			Srcs: []netaddr.IPPrefix{pfx("100.64.0.2/32")},
+		}},
+	}
+	st := &ipnstate.Status{
+		Self: &ipnstate.PeerStatus{Relay: "nyc"},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{},
+	}
+
+	prefs := ipn.NewPrefs()
+	prefs.RouteAll = false
+
+	codes := func(r *ipnstate.UnreachableReport) []string {
+		var ret []string
+		for _, re := range r.Reasons {
+			ret = append(ret, re.Code)
+		}
+		return ret
+	}
+	tests := []struct {
+		name  string
+		ip    string
+		state ipn.State
+		nm    *netmap.NetworkMap
+		want  []string
+	}{
+		{"not-running", "100.64.0.2", ipn.Stopped, nil, []string{"not-running", "no-netmap"}},
+		{"healthy", "100.64.0.2", ipn.Running, nm, nil},
+		{"self", "100.64.0.1", ipn.Running, nm, []string{"self"}},
+		{"unknown-peer", "100.64.0.9", ipn.Running, nm, []string{"not-in-netmap"}},
+		{"expired-offline", "100.64.0.3", ipn.Running, nm, []string{"peer-key-expired", "peer-offline", "acl-no-inbound"}},
+		{"routes-not-accepted", "192.168.0.7", ipn.Running, nm, []string{"routes-not-accepted", "acl-no-inbound"}},
+		{"no-route", "8.8.8.8", ipn.Running, nm, []string{"no-route"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep := explainUnreachable(netaddr.MustParseIP(tt.ip), tt.state, tt.nm, prefs, st, now)
+			if got := codes(rep); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reasons = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/filter"
+)
+
+// exposureBroadMinPeers is the number of peers that, if more than half
+// of all peers can reach a port, makes it broadly exposed. Below it,
+// small tailnets where everything can reach everything don't count.
+const exposureBroadMinPeers = 5
+
+// servicePort identifies a listening port: a tailcfg.Service without
+// its description.
+type servicePort struct {
+	proto tailcfg.ServiceProto
+	port  uint16
+}
+
+// Exposure returns which peers can reach this node's listening ports,
+// according to its packet filter. The listening ports are those found
+// by the port poller, plus the ones tailscaled itself serves: peerapi
+// and, if enabled, Tailscale SSH.
+func (b *LocalBackend) Exposure() *ipnstate.ExposureReport {
+	b.mu.Lock()
+	nm := b.netMap
+	shieldsUp := b.prefs != nil && b.prefs.ShieldsUp
+	var services []tailcfg.Service
+	if b.hostinfo != nil {
+		services = append(services, b.hostinfo.Services...)
+	}
+	for _, pln := range b.peerAPIListeners {
+		services = append(services, tailcfg.Service{Proto: tailcfg.TCP, Port: uint16(pln.port), Description: "tailscaled (peerapi)"})
+	}
+	b.mu.Unlock()
+	if b.ShouldRunSSH() {
+		services = append(services, tailcfg.Service{Proto: tailcfg.TCP, Port: 22, Description: "tailscaled (Tailscale SSH)"})
+	}
+	return exposure(nm, services, shieldsUp, time.Now())
+}
+
+// exposure is the implementation of Exposure.
+func exposure(nm *netmap.NetworkMap, services []tailcfg.Service, shieldsUp bool, now time.Time) *ipnstate.ExposureReport {
+	rep := &ipnstate.ExposureReport{ShieldsUp: shieldsUp}
+	var active []filter.Match
+	if nm != nil {
+		active, _ = filter.ActiveMatches(nm.PacketFilter, now)
+	}
+	seen := map[servicePort]bool{}
+	for _, svc := range services {
+		var proto ipproto.Proto
+		switch svc.Proto {
+		case tailcfg.TCP:
+			proto = ipproto.TCP
+		case tailcfg.UDP:
+			proto = ipproto.UDP
+		default:
+			continue
+		}
+		key := servicePort{svc.Proto, svc.Port}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		pe := ipnstate.PortExposure{
+			Proto:   string(svc.Proto),
+			Port:    svc.Port,
+			Process: svc.Description,
+		}
+		if nm != nil {
+			pe.Srcs = filter.SourcesTo(active, nm.Addresses, proto, svc.Port)
+			exposurePeers(&pe, nm.Peers)
+		}
+		rep.Ports = append(rep.Ports, pe)
+	}
+	sort.Slice(rep.Ports, func(i, j int) bool {
+		a, b := rep.Ports[i], rep.Ports[j]
+		if a.Proto != b.Proto {
+			return a.Proto < b.Proto
+		}
+		return a.Port < b.Port
+	})
+	return rep
+}
+
+// exposurePeers fills in the peers, tags and breadth of pe from its
+// sources.
+func exposurePeers(pe *ipnstate.PortExposure, peers []*tailcfg.Node) {
+	for _, src := range pe.Srcs {
+		if coversRange(src, tsaddr.CGNATRange()) || coversRange(src, tsaddr.TailscaleULARange()) {
+			pe.Broad = true
+		}
+	}
+	tags := map[string]bool{}
+	for _, p := range peers {
+		if !nodeInPrefixes(p, pe.Srcs) {
+			continue
+		}
+		pe.Peers = append(pe.Peers, p.DisplayName(false))
+		for _, tag := range p.Tags {
+			tags[tag] = true
+		}
+	}
+	for tag := range tags {
+		pe.Tags = append(pe.Tags, tag)
+	}
+	sort.Strings(pe.Peers)
+	sort.Strings(pe.Tags)
+	if len(pe.Peers) >= exposureBroadMinPeers && 2*len(pe.Peers) > len(peers) {
+		pe.Broad = true
+	}
+}
+
+// coversRange reports whether p contains all of r.
+func coversRange(p, r netaddr.IPPrefix) bool {
+	return p.Bits() <= r.Bits() && p.Contains(r.IP())
+}
+
+func nodeInPrefixes(n *tailcfg.Node, pfxs []netaddr.IPPrefix) bool {
+	for _, a := range n.Addresses {
+		for _, p := range pfxs {
+			if p.Contains(a.IP()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkNewExposure is called by readPoller with each new list of
+// listening services. It warns, through package health, about ports
+// that started listening since the previous list and that broad
+// groups can reach, until they stop listening. The first list only
+// records what's listening, as nothing in it is new.
+func (b *LocalBackend) checkNewExposure(services []tailcfg.Service, first bool) {
+	cur := map[servicePort]bool{}
+	var fresh []tailcfg.Service
+	for _, svc := range services {
+		key := servicePort{svc.Proto, svc.Port}
+		cur[key] = true
+		if !first && !b.listeningPorts[key] {
+			fresh = append(fresh, svc)
+		}
+	}
+	b.listeningPorts = cur
+	for key := range b.exposureWarnings {
+		if !cur[key] {
+			delete(b.exposureWarnings, key)
+		}
+	}
+
+	if len(fresh) > 0 {
+		b.mu.Lock()
+		nm := b.netMap
+		shieldsUp := b.prefs != nil && b.prefs.ShieldsUp
+		b.mu.Unlock()
+		if !shieldsUp {
+			for _, pe := range exposure(nm, fresh, false, time.Now()).Ports {
+				if !pe.Broad {
+					continue
+				}
+				key := servicePort{tailcfg.ServiceProto(pe.Proto), pe.Port}
+				msg := fmt.Sprintf("%s/%d", pe.Proto, pe.Port)
+				if pe.Process != "" {
+					msg += fmt.Sprintf(" (%s)", pe.Process)
+				}
+				b.logf("warning: newly listening port %s is reachable from broad groups: %v", msg, pe.Srcs)
+				if b.exposureWarnings == nil {
+					b.exposureWarnings = map[servicePort]string{}
+				}
+				b.exposureWarnings[key] = msg
+			}
+		}
+	}
+
+	if len(b.exposureWarnings) == 0 {
+		health.SetExposureHealth(nil)
+		return
+	}
+	var ports []string
+	for _, msg := range b.exposureWarnings {
+		ports = append(ports, msg)
+	}
+	sort.Strings(ports)
+	health.SetExposureHealth(errors.New("newly listening ports are reachable from broad groups on the tailnet: " + strings.Join(ports, ", ") + "; see 'tailscale status --listening'"))
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestExposure(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	pfx := netaddr.MustParseIPPrefix
+	tcp := []ipproto.Proto{ipproto.TCP}
+
+	var peers []*tailcfg.Node
+	for i := 2; i <= 7; i++ {
+		n := &tailcfg.Node{
+			Name:         fmt.Sprintf("peer%d.example.ts.net.", i),
+			ComputedName: fmt.Sprintf("peer%d", i),
+			Addresses:    []netaddr.IPPrefix{pfx(fmt.Sprintf("100.64.0.%d/32", i))},
+		}
+		if i == 2 {
+			n.Tags = []string{"tag:web"}
+		}
+		peers = append(peers, n)
+	}
+	self := []netaddr.IPPrefix{pfx("100.64.0.1/32")}
+	nm := &netmap.NetworkMap{
+		Addresses: self,
+		Peers:     peers,
+		PacketFilter: []filter.Match{
+			{IPProto: tcp, Srcs: []netaddr.IPPrefix{pfx("100.64.0.0/10")}, Dsts: []filter.NetPortRange{{Net: self[0], Ports: filter.PortRange{First: 22, Last: 22}}}},
+			{IPProto: tcp, Srcs: []netaddr.IPPrefix{pfx("100.64.0.2/32")}, Dsts: []filter.NetPortRange{{Net: self[0], Ports: filter.PortRange{First: 8080, Last: 8080}}}},
+		},
+	}
+	services := []tailcfg.Service{
+		{Proto: tailcfg.TCP, Port: 8080, Description: "web"},
+		{Proto: tailcfg.TCP, Port: 22, Description: "sshd"},
+		{Proto: tailcfg.UDP, Port: 53},
+		{Proto: tailcfg.TCP, Port: 22, Description: "sshd"},
+		{Proto: tailcfg.PeerAPI4, Port: 1234},
+	}
+
+	got := exposure(nm, services, true, now)
+	want := &ipnstate.ExposureReport{
+		ShieldsUp: true,
+		Ports: []ipnstate.PortExposure{
+			{
+				Proto:   "tcp",
+				Port:    22,
+				Process: "sshd",
+				Srcs:    []netaddr.IPPrefix{pfx("100.64.0.0/10")},
+				Peers:   []string{"peer2", "peer3", "peer4", "peer5", "peer6", "peer7"},
+				Tags:    []string{"tag:web"},
+				Broad:   true,
+			},
+			{
+				Proto:   "tcp",
+				Port:    8080,
+				Process: "web",
+				Srcs:    []netaddr.IPPrefix{pfx("100.64.0.2/32")},
+				Peers:   []string{"peer2"},
+				Tags:    []string{"tag:web"},
+			},
+			{Proto: "udp", Port: 53},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("exposure:\n got %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/key"
+	"tailscale.com/types/persist"
+)
+
+// ExportKeys returns this node's machine and node keys as a key.Backup
+// sealed with passphrase.
+//
+// Every export is logged, with an "audit:" prefix, since whoever holds
+// the backup and its passphrase can impersonate this node.
+func (b *LocalBackend) ExportKeys(passphrase []byte) ([]byte, error) {
+	b.mu.Lock()
+	if b.prefs == nil {
+		b.mu.Unlock()
+		return nil, errors.New("not started")
+	}
+	if err := b.initMachineKeyLocked(); err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	p := b.prefs.Persist
+	if p == nil || p.PrivateNodeKey.IsZero() {
+		b.mu.Unlock()
+		return nil, errors.New("no node key to export; log in first")
+	}
+	kb := &key.Backup{
+		Machine:          b.machinePrivKey,
+		Node:             p.PrivateNodeKey,
+		OldNode:          p.OldPrivateNodeKey,
+		NodeKeySignature: append([]byte(nil), p.NodeKeySignature...),
+		Created:          time.Now().UTC(),
+	}
+	b.mu.Unlock()
+
+	sealed, err := kb.Seal(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	b.logf("audit: exported private keys for machine %v, node %v", kb.Machine.Public().ShortString(), kb.Node.Public().ShortString())
+	return sealed, nil
+}
+
+// ImportKeys replaces this node's machine and node keys with those in
+// sealed, a key.Backup sealed with passphrase by ExportKeys, so that at
+// the next Start it connects as the node they were exported from.
+//
+// It fails if the node is logged in, so a running node's identity
+// isn't swapped out from under it. Like ExportKeys, it's logged for
+// auditing.
+func (b *LocalBackend) ImportKeys(sealed, passphrase []byte) error {
+	kb, err := key.OpenBackup(sealed, passphrase)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap != nil || b.state == ipn.Running || b.state == ipn.Starting {
+		return errors.New("already logged in; log out first to import keys")
+	}
+	if b.prefs == nil {
+		return errors.New("not started")
+	}
+	keyText, err := kb.Machine.MarshalText()
+	if err != nil {
+		return err
+	}
+	if err := b.store.WriteState(ipn.MachineKeyStateKey, keyText); err != nil {
+		return fmt.Errorf("writing machine key: %w", err)
+	}
+	b.machinePrivKey = kb.Machine
+
+	prefs := b.prefs.Clone()
+	p := prefs.Persist
+	if p == nil {
+		p = new(persist.Persist)
+		prefs.Persist = p
+	}
+	p.LegacyFrontendPrivateMachineKey = key.MachinePrivate{}
+	p.PrivateNodeKey = kb.Node
+	p.OldPrivateNodeKey = kb.OldNode
+	p.NodeKeySignature = kb.NodeKeySignature
+	p.NodeKeyCreated = time.Time{} // unknown
+	b.prefs = prefs
+	b.presigned = nil
+	if b.stateKey != "" {
+		if err := b.store.WriteState(b.stateKey, prefs.ToBytes()); err != nil {
+			return fmt.Errorf("writing prefs: %w", err)
+		}
+	}
+	b.logf("audit: imported private keys for machine %v, node %v (backup made %v)", kb.Machine.Public().ShortString(), kb.Node.Public().ShortString(), kb.Created.Format(time.RFC3339))
+	return nil
+}
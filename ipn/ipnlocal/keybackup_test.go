@@ -0,0 +1,86 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+	"tailscale.com/wgengine"
+)
+
+func TestExportImportKeys(t *testing.T) {
+	newBackend := func() *LocalBackend {
+		var logf logger.Logf = logger.Discard
+		eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+		if err != nil {
+			t.Fatalf("NewFakeUserspaceEngine: %v", err)
+		}
+		t.Cleanup(eng.Close)
+		lb, err := NewLocalBackend(logf, "logid", new(mem.Store), nil, eng, 0)
+		if err != nil {
+			t.Fatalf("NewLocalBackend: %v", err)
+		}
+		lb.mu.Lock()
+		lb.prefs = ipn.NewPrefs()
+		lb.stateKey = "profile"
+		lb.mu.Unlock()
+		return lb
+	}
+	passphrase := []byte("correct horse")
+
+	src := newBackend()
+	if _, err := src.ExportKeys(passphrase); err == nil {
+		t.Fatal("exported keys before logging in")
+	}
+	nk := key.NewNode()
+	src.mu.Lock()
+	src.prefs.Persist = &persist.Persist{PrivateNodeKey: nk, NodeKeySignature: []byte("sig")}
+	src.mu.Unlock()
+	sealed, err := src.ExportKeys(passphrase)
+	if err != nil {
+		t.Fatalf("ExportKeys: %v", err)
+	}
+
+	dst := newBackend()
+	if err := dst.ImportKeys(sealed, []byte("wrong")); err == nil {
+		t.Fatal("imported keys with the wrong passphrase")
+	}
+	if err := dst.ImportKeys(sealed, passphrase); err != nil {
+		t.Fatalf("ImportKeys: %v", err)
+	}
+	if !dst.machinePrivKey.Equal(src.machinePrivKey) {
+		t.Error("machine key not imported")
+	}
+	var stored key.MachinePrivate
+	if mk, err := dst.store.ReadState(ipn.MachineKeyStateKey); err != nil {
+		t.Errorf("reading stored machine key: %v", err)
+	} else if err := stored.UnmarshalText(mk); err != nil || !stored.Equal(src.machinePrivKey) {
+		t.Errorf("stored machine key isn't the imported one (err %v)", err)
+	}
+	saved, err := dst.store.ReadState("profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ipn.PrefsFromBytes(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Persist.PrivateNodeKey.Equal(nk) || string(p.Persist.NodeKeySignature) != "sig" {
+		t.Errorf("saved persist = %+v; want imported node key and signature", p.Persist)
+	}
+
+	dst.mu.Lock()
+	dst.netMap = new(netmap.NetworkMap)
+	dst.mu.Unlock()
+	if err := dst.ImportKeys(sealed, passphrase); err == nil {
+		t.Error("imported keys while logged in")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/types/netmap"
+)
+
+const (
+	// keyRotationRecheckMax is the longest the node waits before
+	// re-checking whether its node key is due for rotation. As with
+	// filterRecheckMax, timers don't follow the wall clock across
+	// sleep, and rotation intervals are long.
+	keyRotationRecheckMax = time.Hour
+
+	// keyRotationRetry is how long after asking control for a new node
+	// key the node waits before asking again, if the rotation didn't
+	// take (such as when control wants an interactive login instead).
+	keyRotationRetry = 6 * time.Hour
+)
+
+// nodeKeyRotationTime returns when the node key in p is due to be
+// rotated, per p.NodeKeyRotation, given the node's netmap nm (which may
+// be nil) and when a rotation was last attempted. It reports false if
+// no rotation is scheduled: if rotation is off, the key's age isn't
+// known, or the key expires first, which needs a login anyway.
+func nodeKeyRotationTime(p *ipn.Prefs, nm *netmap.NetworkMap, lastAttempt time.Time) (time.Time, bool) {
+	if p == nil || p.NodeKeyRotation <= 0 || p.Persist == nil {
+		return time.Time{}, false
+	}
+	if p.Persist.PrivateNodeKey.IsZero() || p.Persist.NodeKeyCreated.IsZero() {
+		return time.Time{}, false
+	}
+	interval := p.NodeKeyRotation
+	if interval < ipn.MinNodeKeyRotation {
+		interval = ipn.MinNodeKeyRotation
+	}
+	at := p.Persist.NodeKeyCreated.Add(interval)
+	if nm != nil && !nm.Expiry.IsZero() && !at.Before(nm.Expiry) {
+		return time.Time{}, false
+	}
+	if !lastAttempt.IsZero() && !p.Persist.NodeKeyCreated.After(lastAttempt) {
+		// The last attempt didn't produce a new key.
+		if retry := lastAttempt.Add(keyRotationRetry); at.Before(retry) {
+			at = retry
+		}
+	}
+	return at, true
+}
+
+// scheduleNodeKeyRotationLocked arranges for rotateNodeKey to run when
+// the node key is due to be rotated, replacing any earlier schedule.
+//
+// b.mu must be held.
+func (b *LocalBackend) scheduleNodeKeyRotationLocked() {
+	if b.keyRotationTimer != nil {
+		b.keyRotationTimer.Stop()
+		b.keyRotationTimer = nil
+	}
+	if b.shutdownCalled || b.cc == nil {
+		return
+	}
+	at, ok := nodeKeyRotationTime(b.prefs, b.netMap, b.lastKeyRotation)
+	if !ok {
+		return
+	}
+	d := time.Until(at)
+	if d > keyRotationRecheckMax {
+		d = keyRotationRecheckMax
+	}
+	b.keyRotationTimer = time.AfterFunc(d, b.rotateNodeKey)
+}
+
+// rotateNodeKey asks control to replace the node key with a new one, if
+// it's due. The old key stays valid at control for an overlap window,
+// so peers can learn the new key before the old one is retired.
+func (b *LocalBackend) rotateNodeKey() {
+	b.mu.Lock()
+	b.keyRotationTimer = nil
+	if b.shutdownCalled || b.cc == nil {
+		b.mu.Unlock()
+		return
+	}
+	at, ok := nodeKeyRotationTime(b.prefs, b.netMap, b.lastKeyRotation)
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	if time.Now().Before(at) || b.state != ipn.Running {
+		// Not yet due, or not connected; check again later.
+		b.scheduleNodeKeyRotationLocked()
+		b.mu.Unlock()
+		return
+	}
+	b.lastKeyRotation = time.Now()
+	cc := b.cc
+	flags := b.loginFlags
+	interval := b.prefs.NodeKeyRotation
+	b.mu.Unlock()
+
+	b.logf("rotating node key; NodeKeyRotation=%v", interval)
+	cc.Login(nil, flags|controlclient.LoginRotateNodeKey)
+}
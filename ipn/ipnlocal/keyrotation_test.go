@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+)
+
+func TestNodeKeyRotationTime(t *testing.T) {
+	created := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	prefs := func(interval time.Duration, created time.Time) *ipn.Prefs {
+		return &ipn.Prefs{
+			NodeKeyRotation: interval,
+			Persist: &persist.Persist{
+				PrivateNodeKey: key.NewNode(),
+				NodeKeyCreated: created,
+			},
+		}
+	}
+	day := 24 * time.Hour
+	tests := []struct {
+		name        string
+		prefs       *ipn.Prefs
+		nm          *netmap.NetworkMap
+		lastAttempt time.Time
+		want        time.Time // zero if none
+	}{
+		{
+			name:  "off",
+			prefs: prefs(0, created),
+		},
+		{
+			name:  "no_persist",
+			prefs: &ipn.Prefs{NodeKeyRotation: day},
+		},
+		{
+			name:  "unknown_age",
+			prefs: prefs(day, time.Time{}),
+		},
+		{
+			name:  "due",
+			prefs: prefs(day, created),
+			nm:    &netmap.NetworkMap{Expiry: created.Add(180 * day)},
+			want:  created.Add(day),
+		},
+		{
+			name:  "below_min",
+			prefs: prefs(time.Minute, created),
+			want:  created.Add(ipn.MinNodeKeyRotation),
+		},
+		{
+			name:  "expires_first",
+			prefs: prefs(30*day, created),
+			nm:    &netmap.NetworkMap{Expiry: created.Add(7 * day)},
+		},
+		{
+			name:        "retry_after_failed_attempt",
+			prefs:       prefs(time.Hour, created),
+			lastAttempt: created.Add(time.Hour),
+			want:        created.Add(time.Hour + keyRotationRetry),
+		},
+		{
+			name:        "attempt_succeeded",
+			prefs:       prefs(time.Hour, created),
+			lastAttempt: created.Add(-time.Minute),
+			want:        created.Add(time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nodeKeyRotationTime(tt.prefs, tt.nm, tt.lastAttempt)
+			if ok != !tt.want.IsZero() || !got.Equal(tt.want) {
+				t.Errorf("got %v, %v; want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
@@ -14,6 +14,7 @@
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
@@ -31,11 +32,15 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
+	"tailscale.com/logtail"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/trustednet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/net/tstun"
 	"tailscale.com/paths"
 	"tailscale.com/portlist"
 	"tailscale.com/syncs"
@@ -47,12 +52,14 @@
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
+	"tailscale.com/types/usermsg"
 	"tailscale.com/types/views"
 	"tailscale.com/util/deephash"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/multierr"
 	"tailscale.com/util/osshare"
 	"tailscale.com/util/systemd"
+	"tailscale.com/util/winutil"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
@@ -123,17 +130,37 @@ type LocalBackend struct {
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
 	serverURL             string           // tailcontrol URL
 	newDecompressor       func() (controlclient.Decompressor, error)
-	varRoot               string // or empty if SetVarRoot never called
+	varRoot               string       // or empty if SetVarRoot never called
+	crashDir              string       // or empty if SetCrashReports never called
+	uploadCrashes         bool         // whether to upload crash reports
+	crashUploadStarted    bool         // if maybeUploadCrashReportsLocked has started an upload
+	recentLogs            *logger.Ring // or nil if SetRecentLogs never called
 	sshAtomicBool         syncs.AtomicBool
 	shutdownCalled        bool // if Shutdown has been called
 
+	// listeningPorts and exposureWarnings are owned by readPoller.
+	listeningPorts   map[servicePort]bool
+	exposureWarnings map[servicePort]string // broadly exposed new ports to their descriptions
+
 	filterAtomic            atomic.Value // of *filter.Filter
 	containsViaIPFuncAtomic atomic.Value // of func(netaddr.IP) bool
 
+	// trustedNetMu serializes updateTrustedNetwork calls.
+	trustedNetMu sync.Mutex
+
+	// nodeGroupsMu serializes node group edits.
+	nodeGroupsMu sync.Mutex
+
+	// nodeCertMu serializes NodeCertPair calls, so concurrent
+	// callers don't each request a cert. It's acquired before mu.
+	nodeCertMu sync.Mutex
+
 	// The mutex protects the following elements.
 	mu             sync.Mutex
 	filterHash     deephash.Sum
+	filterTimer    *time.Timer  // re-evaluates time-limited filter rules; nil if none
 	httpTestClient *http.Client // for controlclient. nil by default, used by tests.
+	controlProxy   string       // for controlclient; see SetControlProxy
 	ccGen          clientGen    // function for producing controlclient; lazily populated
 	sshServer      SSHServer    // or nil, initialized lazily.
 	notify         func(ipn.Notify)
@@ -145,11 +172,19 @@ type LocalBackend struct {
 	inServerMode   bool
 	machinePrivKey key.MachinePrivate
 	state          ipn.State
-	capFileSharing bool // whether netMap contains the file sharing capability
+	capFileSharing bool                   // whether netMap contains the file sharing capability
+	prefApprovals  []*pendingPrefApproval // oldest first
+	// capPrefApproval is whether the last non-nil netMap had the pref
+	// approval capability; see prefApprovalRequiredLocked.
+	capPrefApproval bool
+	// heldNetMap is the network map that the engine's shadow mode
+	// is holding back until ReleaseShadowHold, or nil.
+	heldNetMap *netmap.NetworkMap
 	// hostinfo is mutated in-place while mu is held.
 	hostinfo *tailcfg.Hostinfo
 	// netMap is not mutated in-place once set.
 	netMap           *netmap.NetworkMap
+	cfgNetMap        *netmap.NetworkMap // netMap last applied to the engine by authReconfig
 	nodeByAddr       map[netaddr.IP]*tailcfg.Node
 	activeLogin      string // last logged LoginName from netMap
 	engineStatus     ipn.EngineStatus
@@ -159,7 +194,12 @@ type LocalBackend struct {
 	authURL          string // cleared on Notify
 	authURLSticky    string // not cleared on Notify
 	interact         bool
+	keyRotationTimer *time.Timer // rotates the node key per prefs.NodeKeyRotation; nil if none
+	lastKeyRotation  time.Time   // when rotateNodeKey last asked control for a new key
+	logoutTimer      *time.Timer // logs out at prefs.LogoutAt; nil if none
+	loggingOutAt     bool        // logoutIfDue is logging out; don't reschedule
 	prevIfState      *interfaces.State
+	trustedNetwork   string         // matching prefs.TrustedNetworks rule, or empty if not on one
 	peerAPIServer    *peerAPIServer // or nil
 	peerAPIListeners []*peerAPIListener
 	loginFlags       controlclient.LoginFlags
@@ -180,6 +220,26 @@ type LocalBackend struct {
 	directFileRoot          string
 	directFileDoFinalRename bool // false on macOS, true on several NAS platforms
 
+	// presigned, if non-nil, holds the pre-signed node key and its
+	// signature to log in with at the next Start. See
+	// SetPresignedNodeKey.
+	presigned *persist.Persist
+
+	// appliedLogLevels is the prefs.LogLevels last applied to the
+	// log components. See applyLogLevelsLocked.
+	appliedLogLevels map[string]string
+
+	// endpointCacheChecked is when the endpoint cache was last
+	// checked for changes to save. See maybeSaveEndpointCache.
+	endpointCacheChecked time.Time
+	// endpointCacheAddrs are the peers' addresses in the endpoint
+	// cache as last saved or loaded.
+	endpointCacheAddrs map[key.NodePublic]netaddr.IPPort
+
+	// nodeCert is the cached node identity cert, if any.
+	// See NodeCertPair.
+	nodeCert *nodeCert
+
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
 	statusLock    sync.Mutex
@@ -230,6 +290,8 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, diale
 		loginFlags:     loginFlags,
 	}
 
+	b.loadPrefApprovalCap()
+
 	// Default filter blocks everything and logs nothing, until Start() is called.
 	b.setFilter(filter.NewAllowNone(logf, &netaddr.IPSet{}))
 
@@ -317,6 +379,11 @@ func (b *LocalBackend) linkChange(major bool, ifst *interfaces.State) {
 		}
 	}
 
+	// A major change may mean we've joined or left a trusted network.
+	if major && b.prefs != nil && len(b.prefs.TrustedNetworks) > 0 {
+		go b.updateTrustedNetwork()
+	}
+
 	// If the local network configuration has changed, our filter may
 	// need updating to tweak default routes.
 	b.updateFilterLocked(b.netMap, b.prefs)
@@ -330,6 +397,46 @@ func (b *LocalBackend) linkChange(major bool, ifst *interfaces.State) {
 	}
 }
 
+// updateTrustedNetwork checks whether the machine is on one of the
+// networks in prefs.TrustedNetworks and, if that changed, reconfigures the
+// engine to stop (or resume) using the exit node, or to go idle.
+func (b *LocalBackend) updateTrustedNetwork() {
+	b.trustedNetMu.Lock()
+	defer b.trustedNetMu.Unlock()
+
+	b.mu.Lock()
+	var rules []string
+	if b.prefs != nil {
+		rules = b.prefs.TrustedNetworks
+	}
+	b.mu.Unlock()
+
+	var matched string
+	if len(rules) > 0 {
+		matched, _ = trustednet.Match(rules, trustednet.Detect())
+	}
+
+	b.mu.Lock()
+	changed := matched != b.trustedNetwork
+	b.trustedNetwork = matched
+	state := b.state
+	b.mu.Unlock()
+	if !changed {
+		return
+	}
+	if matched != "" {
+		b.logf("on trusted network %q", matched)
+	} else {
+		b.logf("no longer on a trusted network")
+	}
+	switch state {
+	case ipn.NoState, ipn.Stopped:
+		// Do nothing.
+	default:
+		b.authReconfig()
+	}
+}
+
 func (b *LocalBackend) onHealthChange(sys health.Subsystem, err error) {
 	if err == nil {
 		b.logf("health(%q): ok", sys)
@@ -361,8 +468,21 @@ func (b *LocalBackend) Shutdown() {
 		b.sshServer = nil
 	}
 	b.closePeerAPIListenersLocked()
+	if b.filterTimer != nil {
+		b.filterTimer.Stop()
+		b.filterTimer = nil
+	}
+	if b.keyRotationTimer != nil {
+		b.keyRotationTimer.Stop()
+		b.keyRotationTimer = nil
+	}
+	if b.logoutTimer != nil {
+		b.logoutTimer.Stop()
+		b.logoutTimer = nil
+	}
 	b.mu.Unlock()
 
+	b.saveEndpointCache()
 	b.unregisterLinkMon()
 	b.unregisterHealthWatch()
 	if cc != nil {
@@ -418,19 +538,25 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 		s.Version = version.Long
 		s.BackendState = b.state.String()
 		s.AuthURL = b.authURLSticky
+		s.Telemetry = logtail.Telemetry().String()
+		s.TrustedNetwork = b.trustedNetwork
+		s.TelemetryRestricted = logtail.TelemetryRestricted()
 
 		if err := health.OverallError(); err != nil {
 			switch e := err.(type) {
 			case multierr.Error:
 				for _, err := range e.Errors() {
 					s.Health = append(s.Health, err.Error())
+					s.HealthMessages = append(s.HealthMessages, usermsg.FromError(err))
 				}
 			default:
 				s.Health = append(s.Health, err.Error())
+				s.HealthMessages = append(s.HealthMessages, usermsg.FromError(err))
 			}
 		}
-		if m := b.sshOnButUnusableHealthCheckMessageLocked(); m != "" {
-			s.Health = append(s.Health, m)
+		if m := b.sshOnButUnusableHealthCheckMessageLocked(); !m.IsZero() {
+			s.Health = append(s.Health, m.String())
+			s.HealthMessages = append(s.HealthMessages, m)
 		}
 		if b.netMap != nil {
 			s.CertDomains = append([]string(nil), b.netMap.DNS.CertDomains...)
@@ -612,11 +738,26 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		var uerr controlclient.UserVisibleError
 		if errors.As(st.Err, &uerr) {
 			s := uerr.UserVisibleError()
-			b.send(ipn.Notify{ErrMessage: &s})
+			m := usermsg.New(usermsg.Text, "text", s)
+			b.send(ipn.Notify{ErrMessage: &s, Message: &m})
 		}
 		return
 	}
 
+	if st.NetMap != nil && b.e.ShadowHold(st.NetMap) {
+		b.logf("shadow: holding network map changes until released")
+		b.mu.Lock()
+		b.heldNetMap = st.NetMap
+		b.mu.Unlock()
+		// Apply the rest of st; a nil NetMap means it's unchanged.
+		st.NetMap = nil
+	}
+	b.applyClientStatus(st)
+}
+
+// applyClientStatus applies st, a status from the control client that
+// isn't an error, whose network map (if any) isn't being held back.
+func (b *LocalBackend) applyClientStatus(st controlclient.Status) {
 	b.mu.Lock()
 	wasBlocked := b.blocked
 	keyExpiryExtended := false
@@ -651,7 +792,9 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		// Since we're logged out now, our netmap cache is invalid.
 		// Since st.NetMap==nil means "netmap is unchanged", there is
 		// no other way to represent this change.
+		winutil.LogEvent(winutil.EventLogout, "Logged out of Tailscale.", "User", b.activeLogin)
 		b.setNetMapLocked(nil)
+		b.heldNetMap = nil
 		b.e.SetNetworkMap(new(netmap.NetworkMap))
 	}
 
@@ -701,6 +844,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	}
 	if st.NetMap != nil {
 		b.updateFilterLocked(st.NetMap, prefs)
+		b.scheduleNodeKeyRotationLocked()
 	}
 	b.mu.Unlock()
 
@@ -813,6 +957,7 @@ func (b *LocalBackend) setWgengineStatus(s *wgengine.Status, err error) {
 		}
 		b.stateMachine()
 	}
+	b.maybeSaveEndpointCache()
 	b.broadcastStatusChanged()
 	b.send(ipn.Notify{Engine: &es})
 }
@@ -854,6 +999,60 @@ func (b *LocalBackend) SetHTTPTestClient(c *http.Client) {
 	b.httpTestClient = c
 }
 
+// SetControlProxy sets the "host:port" of a controlproxy.Server to
+// reach the control server through, for nodes without direct internet
+// access. The empty string means to dial the control server directly.
+// It takes effect at the next Start.
+func (b *LocalBackend) SetControlProxy(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.controlProxy = addr
+}
+
+// SetPresignedNodeKey makes k the node key to log in with at the next
+// Start, with sig, its serialized tka.NodeKeySignature, which is sent to
+// control with it. It's for joining a tailnet with network-lock enabled
+// using a node key signed ahead of time on another machine.
+//
+// It fails if the node is already logged in.
+func (b *LocalBackend) SetPresignedNodeKey(k key.NodePrivate, sig []byte) error {
+	if k.IsZero() || len(sig) == 0 {
+		return errors.New("missing node key or signature")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap != nil || b.state == ipn.Running || b.state == ipn.Starting {
+		return errors.New("already logged in; log out first to use a pre-signed node key")
+	}
+	b.presigned = &persist.Persist{
+		PrivateNodeKey:   k,
+		NodeKeySignature: append([]byte(nil), sig...),
+	}
+	return nil
+}
+
+// applyPresignedLocked replaces the node key in b.prefs with the one
+// set by SetPresignedNodeKey, if any, reporting whether it did.
+//
+// b.mu must be held.
+func (b *LocalBackend) applyPresignedLocked() bool {
+	if b.presigned == nil {
+		return false
+	}
+	p := b.prefs.Persist.Clone()
+	if p == nil {
+		p = new(persist.Persist)
+	}
+	p.PrivateNodeKey = b.presigned.PrivateNodeKey
+	p.NodeKeySignature = b.presigned.NodeKeySignature
+	p.OldPrivateNodeKey = key.NodePrivate{}
+	p.NodeKeyCreated = time.Time{}
+	b.prefs.Persist = p
+	b.presigned = nil
+	b.logf("using pre-signed node key %v", p.PrivateNodeKey.Public().ShortString())
+	return true
+}
+
 // SetControlClientGetterForTesting sets the func that creates a
 // control plane client. It can be called at most once, before Start.
 func (b *LocalBackend) SetControlClientGetterForTesting(newControlClient func(controlclient.Options) (controlclient.Client, error)) {
@@ -950,6 +1149,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	hostinfo := hostinfo.New()
 	hostinfo.BackendLogID = b.backendLogID
 	hostinfo.FrontendLogID = opts.FrontendLogID
+	hostinfo.WoLMACs = getWoLMACs(b.logf)
 
 	if b.cc != nil {
 		// TODO(apenwarr): avoid the need to reinit controlclient.
@@ -964,6 +1164,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		b.mu.Lock()
 	}
 	httpTestClient := b.httpTestClient
+	controlProxy := b.controlProxy
 
 	if b.hostinfo != nil {
 		hostinfo.Services = b.hostinfo.Services // keep any previous services
@@ -976,11 +1177,17 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		return fmt.Errorf("loading requested state: %v", err)
 	}
 
+	presigned := b.applyPresignedLocked()
+	var heldErr error // sensitive part of opts.UpdatePrefs awaiting approval
 	if opts.UpdatePrefs != nil {
 		newPrefs := opts.UpdatePrefs
+		if heldErr = b.holdSensitivePrefsLocked(b.prefs, newPrefs); heldErr != nil {
+			b.logf("Start: %v", heldErr)
+		}
 		newPrefs.Persist = b.prefs.Persist
 		b.prefs = newPrefs
-
+	}
+	if opts.UpdatePrefs != nil || presigned {
 		if opts.StateKey != "" {
 			if err := b.store.WriteState(opts.StateKey, b.prefs.ToBytes()); err != nil {
 				b.logf("failed to save UpdatePrefs state: %v", err)
@@ -988,6 +1195,9 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		}
 		b.setAtomicValuesFromPrefs(b.prefs)
 	}
+	b.maybeUploadCrashReportsLocked()
+	b.scheduleLogoutLocked()
+	b.loadEndpointCacheLocked()
 
 	wantRunning := b.prefs.WantRunning
 	if wantRunning {
@@ -1068,6 +1278,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		Pinger:               b,
 		PopBrowserURL:        b.tellClientToBrowseToURL,
 		Dialer:               b.Dialer(),
+		ControlProxy:         controlProxy,
 		Status:               b.setClientStatus,
 
 		// Don't warn about broken Linux IP forwarding when
@@ -1094,10 +1305,18 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	prefs := b.prefs.Clone()
 	b.mu.Unlock()
 
+	if len(prefs.TrustedNetworks) > 0 {
+		go b.updateTrustedNetwork()
+	}
+
 	blid := b.backendLogID
 	b.logf("Backend: logs: be:%v fe:%v", blid, opts.FrontendLogID)
 	b.send(ipn.Notify{BackendLogID: &blid})
 	b.send(ipn.Notify{Prefs: prefs})
+	if heldErr != nil {
+		msg := heldErr.Error()
+		b.send(ipn.Notify{ErrMessage: &msg})
+	}
 
 	if !loggedOut && b.hasNodeKey() {
 		// Even if !WantRunning, we should verify our key, if there
@@ -1136,7 +1355,11 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs *ipn.
 		for _, p := range addrs {
 			localNetsB.AddPrefix(p)
 		}
-		packetFilter = netMap.PacketFilter
+		var nextChange time.Time
+		packetFilter, nextChange = filter.ActiveMatches(netMap.PacketFilter, time.Now())
+		b.scheduleFilterRecheckLocked(nextChange)
+	} else {
+		b.scheduleFilterRecheckLocked(time.Time{})
 	}
 	if prefs != nil {
 		for _, r := range prefs.AdvertiseRoutes {
@@ -1194,11 +1417,54 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs *ipn.
 		b.setFilter(filter.New(packetFilter, localNets, logNets, oldFilter, b.logf))
 	}
 
+	winutil.LogEvent(winutil.EventPolicyApplied, "Applied a new access policy.",
+		"PacketFilterRules", strconv.Itoa(len(packetFilter)),
+		"SSHRules", strconv.Itoa(len(sshPol.Rules)),
+		"ShieldsUp", strconv.FormatBool(shieldsUp))
+
 	if b.sshServer != nil {
 		go b.sshServer.OnPolicyChange()
 	}
 }
 
+// filterRecheckMax is the longest the packet filter goes without being
+// re-evaluated while it has time-limited rules. Timers run on the
+// monotonic clock, which doesn't follow wall clock steps and (on some
+// platforms) stops during sleep, so a rule's deadline could otherwise be
+// overshot by however far the wall clock moved.
+const filterRecheckMax = time.Minute
+
+// scheduleFilterRecheckLocked arranges for the packet filter to be
+// re-evaluated at next, when the set of active time-limited rules
+// changes, or cancels any pending re-evaluation if next is zero.
+//
+// b.mu must be held.
+func (b *LocalBackend) scheduleFilterRecheckLocked(next time.Time) {
+	if b.filterTimer != nil {
+		b.filterTimer.Stop()
+		b.filterTimer = nil
+	}
+	if next.IsZero() || b.shutdownCalled {
+		return
+	}
+	d := time.Until(next)
+	if d > filterRecheckMax {
+		d = filterRecheckMax
+	}
+	b.filterTimer = time.AfterFunc(d, b.recheckFilter)
+}
+
+// recheckFilter re-evaluates the packet filter so that time-limited
+// rules take effect or expire.
+func (b *LocalBackend) recheckFilter() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.shutdownCalled {
+		return
+	}
+	b.updateFilterLocked(b.netMap, b.prefs)
+}
+
 func (b *LocalBackend) setFilter(f *filter.Filter) {
 	b.filterAtomic.Store(f)
 	b.e.SetFilter(f)
@@ -1408,6 +1674,7 @@ func (b *LocalBackend) readPoller() {
 		b.mu.Unlock()
 
 		b.doSetHostinfoFilterServices(hi)
+		b.checkNewExposure(sl, n == 0)
 
 		n++
 		if n == 1 {
@@ -1626,6 +1893,7 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 		// value instead of making up a new one.
 		b.logf("using frontend prefs: %s", prefs.Pretty())
 		b.prefs = prefs.Clone()
+		b.setAtomicValuesFromPrefs(b.prefs)
 		b.writeServerModeStartState(b.userID, b.prefs)
 		return nil
 	}
@@ -1645,6 +1913,7 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 		b.prefs = ipn.NewPrefs()
 		b.prefs.WantRunning = false
 		b.logf("using backend prefs; created empty state for %q: %s", key, b.prefs.Pretty())
+		b.setAtomicValuesFromPrefs(b.prefs)
 		return nil
 	case err != nil:
 		return fmt.Errorf("backend prefs: store.ReadState(%q): %v", key, err)
@@ -1674,10 +1943,18 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 	return nil
 }
 
-// setAtomicValuesFromPrefs populates sshAtomicBool and containsViaIPFuncAtomic
+// setAtomicValuesFromPrefs populates sshAtomicBool and containsViaIPFuncAtomic,
+// and the process-wide logtail telemetry level and log component levels,
 // from the prefs p, which may be nil.
+//
+// Without prefs, such as after ResetForClientDisconnect, the telemetry
+// level last set stays in effect.
 func (b *LocalBackend) setAtomicValuesFromPrefs(p *ipn.Prefs) {
 	b.sshAtomicBool.Set(p != nil && p.RunSSH && canSSH)
+	if p != nil {
+		logtail.SetTelemetryPref(p.Telemetry)
+	}
+	b.applyLogLevelsLocked(p)
 
 	if p == nil {
 		b.containsViaIPFuncAtomic.Store(tsaddr.NewContainsIPFunc(nil))
@@ -1906,30 +2183,30 @@ func (b *LocalBackend) checkSSHPrefsLocked(p *ipn.Prefs) error {
 	return nil
 }
 
-func (b *LocalBackend) sshOnButUnusableHealthCheckMessageLocked() (healthMessage string) {
+func (b *LocalBackend) sshOnButUnusableHealthCheckMessageLocked() (healthMessage usermsg.Message) {
 	if b.prefs == nil || !b.prefs.RunSSH {
-		return ""
+		return usermsg.Message{}
 	}
 	if envknob.SSHIgnoreTailnetPolicy() || envknob.SSHPolicyFile() != "" {
-		return "development SSH policy in use"
+		return usermsg.New(usermsg.HealthSSHDevPolicy)
 	}
 	nm := b.netMap
 	if nm == nil {
-		return ""
+		return usermsg.Message{}
 	}
 	if nm.SSHPolicy != nil && len(nm.SSHPolicy.Rules) > 0 {
-		return ""
+		return usermsg.Message{}
 	}
 	isDefault := b.isDefaultServerLocked()
 	isAdmin := hasCapability(nm, tailcfg.CapabilityAdmin)
 
 	if !isAdmin {
-		return "Tailscale SSH enabled, but access controls don't allow anyone to access this device. Ask your admin to update your tailnet's ACLs to allow access."
+		return usermsg.New(usermsg.HealthSSHNoAccess)
 	}
 	if !isDefault {
-		return "Tailscale SSH enabled, but access controls don't allow anyone to access this device. Update your tailnet's ACLs to allow access."
+		return usermsg.New(usermsg.HealthSSHNoAccessAdmin)
 	}
-	return "Tailscale SSH enabled, but access controls don't allow anyone to access this device. Update your tailnet's ACLs at https://tailscale.com/s/ssh-policy"
+	return usermsg.New(usermsg.HealthSSHNoAccessAdminURL)
 }
 
 func (b *LocalBackend) isDefaultServerLocked() bool {
@@ -1941,25 +2218,69 @@ func (b *LocalBackend) isDefaultServerLocked() bool {
 
 func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
 	b.mu.Lock()
+	return b.editPrefsLockedOnEntry("EditPrefs", []*ipn.MaskedPrefs{mp}, false, false)
+}
+
+// EditPrefsTransaction applies the edits in tx in order, all-or-nothing.
+// The combined result is validated as a whole, so edits that are only
+// valid together (such as clearing the exit node and advertising as one)
+// can be made at once. If validation fails, the returned error is a
+// *ipn.PrefsValidationError where possible, and no edits are applied.
+func (b *LocalBackend) EditPrefsTransaction(tx *ipn.PrefsTransaction) (*ipn.Prefs, error) {
+	if len(tx.Edits) == 0 {
+		return nil, errors.New("empty prefs transaction")
+	}
+	for i, mp := range tx.Edits {
+		if mp == nil {
+			return nil, fmt.Errorf("prefs transaction edit %d is null", i)
+		}
+	}
+	b.mu.Lock()
+	return b.editPrefsLockedOnEntry("EditPrefsTransaction", tx.Edits, tx.DryRun, false)
+}
+
+// editPrefsLockedOnEntry applies edits to a copy of the current prefs,
+// validates the result, and unless dryRun, sets it as the new prefs.
+// Unless approved, changes that need another device's approval are
+// held for it instead; see checkPrefApprovalLocked.
+//
+// b.mu must be held on entry. It's released before returning.
+func (b *LocalBackend) editPrefsLockedOnEntry(caller string, edits []*ipn.MaskedPrefs, dryRun, approved bool) (*ipn.Prefs, error) {
 	p0 := b.prefs.Clone()
 	p1 := b.prefs.Clone()
-	p1.ApplyEdits(mp)
+	for _, mp := range edits {
+		p1.ApplyEdits(mp)
+	}
+	if err := newPrefsProblems(p0, p1); err != nil {
+		b.mu.Unlock()
+		b.logf("%s validation error: %v", caller, err)
+		return nil, err
+	}
 	if err := b.checkPrefsLocked(p1); err != nil {
 		b.mu.Unlock()
-		b.logf("EditPrefs check error: %v", err)
+		b.logf("%s check error: %v", caller, err)
 		return nil, err
 	}
 	if p1.RunSSH && !canSSH {
 		b.mu.Unlock()
-		b.logf("EditPrefs requests SSH, but disabled by envknob; returning error")
+		b.logf("%s requests SSH, but disabled by envknob; returning error", caller)
 		return nil, errors.New("Tailscale SSH server administratively disabled.")
 	}
-	if p1.Equals(p0) {
+	if dryRun || p1.Equals(p0) {
 		b.mu.Unlock()
 		return p1, nil
 	}
-	b.logf("EditPrefs: %v", mp.Pretty())
-	b.setPrefsLockedOnEntry("EditPrefs", p1) // does a b.mu.Unlock
+	if !approved {
+		if err := b.checkPrefApprovalLocked(p0, p1, edits); err != nil {
+			b.mu.Unlock()
+			b.logf("%s: %v", caller, err)
+			return nil, err
+		}
+	}
+	for _, mp := range edits {
+		b.logf("%s: %v", caller, mp.Pretty())
+	}
+	b.setPrefsLockedOnEntry(caller, p1) // does a b.mu.Unlock
 
 	// Note: don't perform any actions for the new prefs here. Not
 	// every prefs change goes through EditPrefs. Put your actions
@@ -1967,6 +2288,32 @@ func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
 	return p1, nil
 }
 
+// newPrefsProblems returns a *ipn.PrefsValidationError for the problems
+// that p1 has but p0 didn't, or nil if there are none. Problems already
+// present in p0 don't stop unrelated edits.
+func newPrefsProblems(p0, p1 *ipn.Prefs) error {
+	ve1, ok := p1.Validate().(*ipn.PrefsValidationError)
+	if !ok {
+		return nil
+	}
+	old := map[ipn.PrefsFieldError]bool{}
+	if ve0, ok := p0.Validate().(*ipn.PrefsValidationError); ok {
+		for _, fe := range ve0.Errors {
+			old[fe] = true
+		}
+	}
+	var errs []ipn.PrefsFieldError
+	for _, fe := range ve1.Errors {
+		if !old[fe] {
+			errs = append(errs, fe)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ipn.PrefsValidationError{Errors: errs}
+}
+
 // SetPrefs saves new user preferences and propagates them throughout
 // the system. Implements Backend.
 func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
@@ -1974,7 +2321,17 @@ func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
 		panic("SetPrefs got nil prefs")
 	}
 	b.mu.Lock()
+	// Changes that need another device's approval are held back, as
+	// in EditPrefs, while the rest of newp is applied.
+	heldErr := b.holdSensitivePrefsLocked(b.prefs, newp)
+	if heldErr != nil {
+		b.logf("SetPrefs: %v", heldErr)
+	}
 	b.setPrefsLockedOnEntry("SetPrefs", newp)
+	if heldErr != nil {
+		msg := heldErr.Error()
+		b.send(ipn.Notify{ErrMessage: &msg})
+	}
 }
 
 // setPrefsLockedOnEntry requires b.mu be held to call it, but it
@@ -1984,6 +2341,7 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	stateKey := b.stateKey
 
 	b.setAtomicValuesFromPrefs(newp)
+	b.maybeUploadCrashReportsLocked()
 
 	oldp := b.prefs
 	newp.Persist = oldp.Persist // caller isn't allowed to override this
@@ -1992,6 +2350,8 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	// everything in this function treats b.prefs as completely new
 	// anyway. No-op if no exit node resolution is needed.
 	b.findExitNodeIDLocked(netMap)
+	b.scheduleNodeKeyRotationLocked()
+	b.scheduleLogoutLocked()
 	b.inServerMode = newp.ForceDaemon
 	// We do this to avoid holding the lock while doing everything else.
 	newp = b.prefs.Clone()
@@ -2053,6 +2413,10 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 		cc.Login(nil, controlclient.LoginDefault)
 	}
 
+	if !reflect.DeepEqual(oldp.TrustedNetworks, newp.TrustedNetworks) {
+		go b.updateTrustedNetwork()
+	}
+
 	if oldp.WantRunning != newp.WantRunning {
 		b.stateMachine()
 	} else {
@@ -2187,6 +2551,7 @@ func (b *LocalBackend) authReconfig() {
 	nm := b.netMap
 	hasPAC := b.prevIfState.HasPAC()
 	disableSubnetsIfPAC := nm != nil && nm.Debug != nil && nm.Debug.DisableSubnetsIfPAC.EqualBool(true)
+	trustedNet := b.trustedNetwork
 	b.mu.Unlock()
 
 	if blocked {
@@ -2201,6 +2566,22 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("[v1] authReconfig: skipping because !WantRunning.")
 		return
 	}
+	if trustedNet != "" {
+		if prefs.TrustedNetworksIdle {
+			b.mu.Lock()
+			b.cfgNetMap = nil
+			b.mu.Unlock()
+			err := b.e.Reconfig(&wgcfg.Config{}, &router.Config{}, &dns.Config{}, nil)
+			if err != wgengine.ErrNoChanges {
+				b.logf("[v1] authReconfig: idle on trusted network %q: %v", trustedNet, err)
+			}
+			return
+		}
+		// Don't use the exit node on a trusted network.
+		prefs = prefs.Clone()
+		prefs.ExitNodeID = ""
+		prefs.ExitNodeIP = netaddr.IP{}
+	}
 
 	var flags netmap.WGConfigFlags
 	if prefs.RouteAll {
@@ -2236,6 +2617,11 @@ func (b *LocalBackend) authReconfig() {
 	dcfg := dnsConfigForNetmap(nm, prefs, b.logf, version.OS())
 
 	err = b.e.Reconfig(cfg, rcfg, dcfg, nm.Debug)
+	if err == nil || err == wgengine.ErrNoChanges {
+		b.mu.Lock()
+		b.cfgNetMap = nm
+		b.mu.Unlock()
+	}
 	if err == wgengine.ErrNoChanges {
 		return
 	}
@@ -2352,6 +2738,23 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 		}
 		dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
 	}
+	// Static records from prefs replace any of the above for the same
+	// name, like an /etc/hosts entry would.
+	static := map[dnsname.FQDN][]netaddr.IP{}
+	for _, rec := range prefs.StaticDNSRecords {
+		ip, err := netaddr.ParseIP(rec.Value)
+		if err != nil {
+			continue
+		}
+		fqdn, err := dnsname.ToFQDN(rec.Name)
+		if err != nil {
+			continue
+		}
+		static[fqdn] = append(static[fqdn], ip)
+	}
+	for fqdn, ips := range static {
+		dcfg.Hosts[fqdn] = ips
+	}
 
 	if !prefs.CorpDNS {
 		return dcfg
@@ -2438,6 +2841,12 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 // It should only be called before the LocalBackend is used.
 func (b *LocalBackend) SetVarRoot(dir string) {
 	b.varRoot = dir
+	if dir == "" {
+		return
+	}
+	if mc, err := b.magicConn(); err == nil {
+		mc.SetDERPHealthPath(filepath.Join(dir, "derp-health.json"))
+	}
 }
 
 // TailscaleVarRoot returns the root directory of Tailscale's writable
@@ -2807,6 +3216,7 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 	switch newState {
 	case ipn.NeedsLogin:
 		systemd.Status("Needs login: %s", authURL)
+		winutil.LogEvent(winutil.EventNeedsLogin, "Tailscale needs to log in.")
 		b.blockEngineUpdates(true)
 		fallthrough
 	case ipn.Stopped:
@@ -2818,6 +3228,9 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 		if authURL == "" {
 			systemd.Status("Stopped; run 'tailscale up' to log in")
 		}
+		if newState == ipn.Stopped {
+			winutil.LogEvent(winutil.EventStopped, "Tailscale was stopped.")
+		}
 	case ipn.Starting, ipn.NeedsMachineAuth:
 		b.authReconfig()
 		// Needed so that UpdateEndpoints can run
@@ -2828,6 +3241,9 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 			addrs = append(addrs, addr.IP().String())
 		}
 		systemd.Status("Connected; %s; %s", activeLogin, strings.Join(addrs, " "))
+		winutil.LogEvent(winutil.EventConnected, "Connected to Tailscale.",
+			"User", activeLogin,
+			"Addresses", strings.Join(addrs, " "))
 	default:
 		b.logf("[unexpected] unknown newState %#v", newState)
 	}
@@ -3078,12 +3494,16 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 	b.netMap = nm
 	if login != b.activeLogin {
 		b.logf("active login: %v", login)
+		if login != "" {
+			winutil.LogEvent(winutil.EventLogin, "Logged in to Tailscale.", "User", login)
+		}
 		b.activeLogin = login
 	}
 	b.maybePauseControlClientLocked()
 
 	if nm != nil {
 		health.SetControlHealth(nm.ControlHealth)
+		b.updatePrefApprovalCapLocked(nm)
 	} else {
 		health.SetControlHealth(nil)
 	}
@@ -3343,6 +3763,41 @@ func (b *LocalBackend) CheckIPForwarding() error {
 	return warn
 }
 
+// RouteStatus reports whether the OS routes and firewall rules for the
+// current configuration are all in place.
+func (b *LocalBackend) RouteStatus() *ipnstate.RouteStatus {
+	return b.e.RouteStatus()
+}
+
+// FlowStats returns the traffic of each recent flow through the packet
+// filter, counted since FlowStats was first called. See
+// wgengine.Engine.FlowStats.
+func (b *LocalBackend) FlowStats() []ipnstate.FlowStat {
+	return b.e.FlowStats()
+}
+
+// ShadowDiffs returns the recent changes recorded by the engine's
+// shadow mode. See wgengine.Engine.ShadowDiffs.
+func (b *LocalBackend) ShadowDiffs() []ipnstate.ShadowDiff {
+	return b.e.ShadowDiffs()
+}
+
+// ReleaseShadowHold applies the network map that the engine's shadow
+// mode is holding back (see wgengine.Config.ShadowHold). It's an
+// error if none is held.
+func (b *LocalBackend) ReleaseShadowHold() error {
+	b.mu.Lock()
+	nm := b.heldNetMap
+	b.heldNetMap = nil
+	b.mu.Unlock()
+	if nm == nil {
+		return errors.New("no network map is held")
+	}
+	b.logf("shadow: releasing held network map")
+	b.applyClientStatus(controlclient.Status{NetMap: nm})
+	return nil
+}
+
 // DERPMap returns the current DERPMap in use, or nil if not connected.
 func (b *LocalBackend) DERPMap() *tailcfg.DERPMap {
 	b.mu.Lock()
@@ -3462,6 +3917,96 @@ func (b *LocalBackend) DebugReSTUN() error {
 	return nil
 }
 
+// DERPRegionStatus returns the state of the node's connection to each
+// DERP region.
+func (b *LocalBackend) DERPRegionStatus() ([]*ipnstate.DERPRegionStatus, error) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	return mc.DERPRegionStatus(), nil
+}
+
+// DERPHealth returns the history of netcheck's latency and availability
+// measurements of each DERP region.
+func (b *LocalBackend) DERPHealth() ([]ipnstate.DERPRegionHealth, error) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	regions := mc.DERPHealth()
+	ret := make([]ipnstate.DERPRegionHealth, len(regions))
+	for i, r := range regions {
+		ret[i] = ipnstate.DERPRegionHealth{
+			RegionID:   r.RegionID,
+			RegionCode: r.RegionCode,
+			RegionName: r.RegionName,
+			Recent:     derpHealthWindow(r.Recent),
+			Day:        derpHealthWindow(r.Day),
+			Week:       derpHealthWindow(r.Week),
+			Trend:      r.Trend,
+		}
+	}
+	return ret, nil
+}
+
+func derpHealthWindow(w netcheck.HealthWindow) ipnstate.DERPHealthWindow {
+	return ipnstate.DERPHealthWindow{
+		Checks:       w.Checks,
+		Availability: w.Availability,
+		Latency:      w.Latency,
+	}
+}
+
+// DebugForceDERPHome forces the home DERP region to regionID, or returns
+// to automatic selection if regionID is zero.
+func (b *LocalBackend) DebugForceDERPHome(regionID int) error {
+	mc, err := b.magicConn()
+	if err != nil {
+		return err
+	}
+	return mc.SetDERPHomeOverride(regionID)
+}
+
+// DebugImpair makes the tunnel impair packets to and from peer, or all
+// peers without their own impairment if peer is the zero IP, until
+// tailscaled restarts. A zero im removes the impairment.
+func (b *LocalBackend) DebugImpair(peer netaddr.IP, im tstun.Impairment) error {
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return errors.New("engine isn't InternalsGetter")
+	}
+	tw, _, _, ok := ig.GetInternals()
+	if !ok {
+		return errors.New("failed to get internals")
+	}
+	if err := tw.SetImpairment(peer, im); err != nil {
+		return err
+	}
+	who := "all peers"
+	if !peer.IsZero() {
+		who = peer.String()
+	}
+	b.logf("debug: impairing packets for %s: %v (seed %d)", who, im, im.Seed)
+	return nil
+}
+
+// DebugSetCPU restricts the process to the given CPUs, if non-empty,
+// and then sets GOMAXPROCS to maxProcs, if positive.
+func (b *LocalBackend) DebugSetCPU(cpus []int, maxProcs int) error {
+	if len(cpus) > 0 {
+		if err := magicsock.SetCPUAffinity(cpus); err != nil {
+			return err
+		}
+	}
+	if maxProcs > 0 {
+		magicsock.SetMaxProcs(maxProcs)
+	}
+	ci := magicsock.GetCPUInfo()
+	b.logf("debug: CPU affinity %v, GOMAXPROCS=%d, NumCPU=%d", ci.Affinity, ci.GOMAXPROCS, ci.NumCPU)
+	return nil
+}
+
 func (b *LocalBackend) magicConn() (*magicsock.Conn, error) {
 	ig, ok := b.e.(wgengine.InternalsGetter)
 	if !ok {
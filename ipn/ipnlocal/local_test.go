@@ -5,6 +5,7 @@
 package ipnlocal
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -15,11 +16,13 @@
 	"inet.af/netaddr"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
+	"tailscale.com/logtail"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/preftype"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/wgcfg"
 )
@@ -508,6 +511,79 @@ func TestLazyMachineKeyGeneration(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 }
 
+func TestEditPrefsTransaction(t *testing.T) {
+	var logf logger.Logf = logger.Discard
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	lb, err := NewLocalBackend(logf, "logid", new(mem.Store), nil, eng, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	if err := lb.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	useExitNode := &ipn.MaskedPrefs{
+		Prefs:         ipn.Prefs{ExitNodeID: "foo"},
+		ExitNodeIDSet: true,
+	}
+	advertiseExitNode := &ipn.MaskedPrefs{AdvertiseRoutesSet: true}
+	advertiseExitNode.SetAdvertiseExitNode(true)
+	shieldsUp := &ipn.MaskedPrefs{
+		Prefs:        ipn.Prefs{ShieldsUp: true},
+		ShieldsUpSet: true,
+	}
+
+	// Conflicting edits: nothing is applied.
+	_, err = lb.EditPrefsTransaction(&ipn.PrefsTransaction{
+		Edits: []*ipn.MaskedPrefs{shieldsUp, useExitNode, advertiseExitNode},
+	})
+	var ve *ipn.PrefsValidationError
+	if !errors.As(err, &ve) || len(ve.Errors) != 1 || ve.Errors[0].Field != "ExitNodeID" {
+		t.Fatalf("conflicting edits: got err %v; want ExitNodeID validation error", err)
+	}
+	if p := lb.Prefs(); p.ShieldsUp || !p.ExitNodeID.IsZero() || p.AdvertisesExitNode() {
+		t.Fatalf("conflicting edits were partially applied: %v", p.Pretty())
+	}
+
+	// A null edit is rejected without taking the backend down.
+	if _, err := lb.EditPrefsTransaction(&ipn.PrefsTransaction{
+		Edits: []*ipn.MaskedPrefs{shieldsUp, nil},
+	}); err == nil {
+		t.Fatal("null edit: got nil error")
+	}
+	if p := lb.Prefs(); p.ShieldsUp {
+		t.Fatalf("edits before a null edit were applied: %v", p.Pretty())
+	}
+
+	// Dry run: validated but not applied.
+	p, err := lb.EditPrefsTransaction(&ipn.PrefsTransaction{
+		Edits:  []*ipn.MaskedPrefs{shieldsUp, advertiseExitNode},
+		DryRun: true,
+	})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !p.ShieldsUp || !p.AdvertisesExitNode() {
+		t.Errorf("dry run returned %v; want edits applied", p.Pretty())
+	}
+	if p := lb.Prefs(); p.ShieldsUp || p.AdvertisesExitNode() {
+		t.Fatalf("dry run applied edits: %v", p.Pretty())
+	}
+
+	if _, err := lb.EditPrefsTransaction(&ipn.PrefsTransaction{
+		Edits: []*ipn.MaskedPrefs{shieldsUp, advertiseExitNode},
+	}); err != nil {
+		t.Fatalf("EditPrefsTransaction: %v", err)
+	}
+	if p := lb.Prefs(); !p.ShieldsUp || !p.AdvertisesExitNode() {
+		t.Fatalf("edits not applied: %v", p.Pretty())
+	}
+}
+
 func TestFileTargets(t *testing.T) {
 	b := new(LocalBackend)
 	_, err := b.FileTargets()
@@ -637,3 +713,41 @@ type interfacePrefix struct {
 		})
 	}
 }
+
+func TestTelemetryBeforePrefs(t *testing.T) {
+	defer logtail.SetTelemetryPref(preftype.TelemetryFull)
+	logtail.SetTelemetryPref(preftype.TelemetryNone)
+
+	var logf logger.Logf = logger.Discard
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	lb, err := NewLocalBackend(logf, "logid", new(mem.Store), nil, eng, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	// A new node's default prefs allow full telemetry.
+	if err := lb.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if got := logtail.Telemetry(); got != preftype.TelemetryFull {
+		t.Errorf("telemetry after Start = %v; want full", got)
+	}
+	if _, err := lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:        ipn.Prefs{Telemetry: preftype.TelemetryHealthOnly},
+		TelemetrySet: true,
+	}); err != nil {
+		t.Fatalf("EditPrefs: %v", err)
+	}
+	if got := logtail.Telemetry(); got != preftype.TelemetryHealthOnly {
+		t.Errorf("telemetry after EditPrefs = %v; want health-only", got)
+	}
+	// Without prefs, the last level stays in effect rather than
+	// dropping the logs of a node that allows them.
+	lb.ResetForClientDisconnect()
+	if got := logtail.Telemetry(); got != preftype.TelemetryHealthOnly {
+		t.Errorf("telemetry after reset = %v; want health-only", got)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"reflect"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+// LogLevels returns the current level of each log component, by name.
+func (b *LocalBackend) LogLevels() map[string]string {
+	ret := map[string]string{}
+	for name, l := range logger.ComponentLevels() {
+		ret[name] = l.String()
+	}
+	return ret
+}
+
+// SetLogLevel sets the level of the log component named component.
+// The level "default" puts it back to its starting level.
+//
+// If persist is true, the level is also saved in prefs.LogLevels, to
+// be applied again each time tailscaled starts. Otherwise it lasts
+// until tailscaled exits, or until prefs.LogLevels next changes.
+func (b *LocalBackend) SetLogLevel(component, level string, persist bool) error {
+	c := logger.LookupComponent(component)
+	if c == nil {
+		return fmt.Errorf("unknown log component %q", component)
+	}
+	l := c.DefaultLevel()
+	if level != "default" {
+		var err error
+		if l, err = logger.ParseLevel(level); err != nil {
+			return err
+		}
+	}
+	if !persist {
+		c.SetLevel(l)
+		b.logf("log level of %s set to %v", component, l)
+		return nil
+	}
+
+	b.mu.Lock()
+	levels := map[string]string{}
+	for name, v := range b.prefs.LogLevels {
+		levels[name] = v
+	}
+	b.mu.Unlock()
+	if l == c.DefaultLevel() {
+		delete(levels, component)
+	} else {
+		levels[component] = l.String()
+	}
+	if len(levels) == 0 {
+		levels = nil
+	}
+	_, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:        ipn.Prefs{LogLevels: levels},
+		LogLevelsSet: true,
+	})
+	if err != nil {
+		return err
+	}
+	// Set it directly too: if prefs.LogLevels didn't change, because
+	// it was already persisted, applyLogLevelsLocked did nothing.
+	c.SetLevel(l)
+	return nil
+}
+
+// applyLogLevelsLocked sets the levels of the log components listed in
+// p.LogLevels, if they've changed since last applied, and puts any no
+// longer listed back to their default levels. p may be nil.
+//
+// b.mu must be held.
+func (b *LocalBackend) applyLogLevelsLocked(p *ipn.Prefs) {
+	var levels map[string]string
+	if p != nil {
+		levels = p.LogLevels
+	}
+	if reflect.DeepEqual(levels, b.appliedLogLevels) {
+		return
+	}
+	for name := range b.appliedLogLevels {
+		if _, ok := levels[name]; !ok {
+			if c := logger.LookupComponent(name); c != nil {
+				c.SetLevel(c.DefaultLevel())
+			}
+		}
+	}
+	for name, v := range levels {
+		c := logger.LookupComponent(name)
+		if c == nil {
+			b.logf("prefs: unknown log component %q", name)
+			continue
+		}
+		l, err := logger.ParseLevel(v)
+		if err != nil {
+			b.logf("prefs: log component %s: %v", name, err)
+			continue
+		}
+		c.SetLevel(l)
+		b.logf("log level of %s set to %v by prefs", name, l)
+	}
+	b.appliedLogLevels = levels
+}
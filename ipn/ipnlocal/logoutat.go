@@ -0,0 +1,86 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/winutil"
+)
+
+// logoutRecheckMax is the longest the node goes without checking
+// whether prefs.LogoutAt has passed. Time-boxed access should end on
+// time, and timers don't follow the wall clock across sleep.
+const logoutRecheckMax = time.Minute
+
+// scheduleLogoutLocked arranges for the node to log out at
+// prefs.LogoutAt, replacing any earlier schedule.
+//
+// b.mu must be held.
+func (b *LocalBackend) scheduleLogoutLocked() {
+	if b.logoutTimer != nil {
+		b.logoutTimer.Stop()
+		b.logoutTimer = nil
+	}
+	if b.shutdownCalled || b.loggingOutAt || b.prefs == nil || b.prefs.LogoutAt == nil || b.prefs.LogoutAt.IsZero() {
+		return
+	}
+	d := time.Until(*b.prefs.LogoutAt)
+	if d > logoutRecheckMax {
+		d = logoutRecheckMax
+	}
+	b.logoutTimer = time.AfterFunc(d, b.logoutIfDue)
+}
+
+// logoutIfDue logs the node out if prefs.LogoutAt has passed, and
+// otherwise checks again later.
+//
+// LogoutAt is only cleared once the logout has gone through, so that
+// a failed logout is retried, including after a restart.
+func (b *LocalBackend) logoutIfDue() {
+	b.mu.Lock()
+	b.logoutTimer = nil
+	if b.shutdownCalled || b.loggingOutAt || b.prefs == nil || b.prefs.LogoutAt == nil || b.prefs.LogoutAt.IsZero() {
+		b.mu.Unlock()
+		return
+	}
+	at := *b.prefs.LogoutAt
+	if time.Now().Before(at) {
+		b.scheduleLogoutLocked()
+		b.mu.Unlock()
+		return
+	}
+	haveClient := b.cc != nil
+	b.loggingOutAt = true
+	b.mu.Unlock()
+
+	b.logf("access period ended at %v; logging out", at.UTC().Format(time.RFC3339))
+	winutil.LogEvent(winutil.EventAccessExpired, "The Tailscale access period ended; logging out.",
+		"LogoutAt", at.UTC().Format(time.RFC3339))
+
+	// logout turns off WantRunning and marks the node logged out
+	// even without a control client, which is all there is to do
+	// then; it only fails for the lack of one.
+	ctx, cancel := context.WithTimeout(context.Background(), logoutRecheckMax)
+	err := b.logout(ctx, true)
+	cancel()
+
+	b.mu.Lock()
+	b.loggingOutAt = false
+	if err != nil && haveClient {
+		b.logf("logout at end of access period failed, retrying in %v: %v", logoutRecheckMax, err)
+		if !b.shutdownCalled && b.logoutTimer == nil {
+			b.logoutTimer = time.AfterFunc(logoutRecheckMax, b.logoutIfDue)
+		}
+		b.mu.Unlock()
+		return
+	}
+	b.mu.Unlock()
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{LogoutAtSet: true}); err != nil {
+		b.logf("clearing LogoutAt after logout: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+// errNoNodeCA is returned when the tailnet's control server doesn't
+// issue node identity certs.
+var errNoNodeCA = errors.New("node identity certs are not enabled for this tailnet")
+
+// nodeCert is a node identity cert issued by the tailnet's NodeCA,
+// along with its private key. Only the node holds the key; it's
+// regenerated with each cert and never written to disk.
+type nodeCert struct {
+	nodeKey key.NodePublic      // node key the cert was issued for
+	chain   []*x509.Certificate // leaf first
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// nodeCertUsable reports whether c can still be handed out at now,
+// given the node's current netmap nm. A cert stops being usable two
+// thirds of the way through its lifetime, so that peers never see one
+// about to expire, and as soon as its CA is rotated out of the netmap,
+// the node key changes or the cert no longer names the node (such as
+// after its Tailscale IPs or MagicDNS name change).
+func nodeCertUsable(c *nodeCert, nm *netmap.NetworkMap, now time.Time) bool {
+	if c == nil || nm == nil || nm.NodeCA == nil || c.nodeKey != nm.NodeKey {
+		return false
+	}
+	leaf := c.chain[0]
+	renewAt := leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+	if now.After(renewAt) {
+		return false
+	}
+	return verifyNodeCertChain(c.chain, nm.NodeCA, now) == nil &&
+		verifyNodeCertNames(leaf, nm) == nil
+}
+
+// verifyNodeCertChain verifies that chain (leaf first) chains to one
+// of ca's roots at now.
+func verifyNodeCertChain(chain []*x509.Certificate, ca *tailcfg.NodeCA, now time.Time) error {
+	roots := x509.NewCertPool()
+	for _, r := range ca.Roots {
+		roots.AppendCertsFromPEM([]byte(r))
+	}
+	inter := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		inter.AddCert(c)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inter,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// verifyNodeCertNames verifies that leaf names the node in nm, as
+// described at tailcfg.NodeCertResponse: its URI SAN is the node's
+// StableNodeID, its IP SANs are exactly the node's Tailscale IPs, and
+// its DNS SAN, if any, is the node's MagicDNS name.
+func verifyNodeCertNames(leaf *x509.Certificate, nm *netmap.NetworkMap) error {
+	if nm.SelfNode == nil {
+		return errors.New("no self node in netmap")
+	}
+	wantURI := tailcfg.NodeCertURIPrefix + string(nm.SelfNode.StableID)
+	if len(leaf.URIs) != 1 || leaf.URIs[0].String() != wantURI {
+		return fmt.Errorf("cert URIs %v don't name node %v", leaf.URIs, nm.SelfNode.StableID)
+	}
+	want := map[netaddr.IP]bool{}
+	for _, pfx := range nm.Addresses {
+		want[pfx.IP()] = true
+	}
+	got := map[netaddr.IP]bool{}
+	for _, std := range leaf.IPAddresses {
+		ip, ok := netaddr.FromStdIP(std)
+		if !ok || !want[ip] {
+			return fmt.Errorf("cert IP %v isn't one of the node's", std)
+		}
+		got[ip] = true
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("cert IPs %v aren't all of the node's", leaf.IPAddresses)
+	}
+	name := strings.TrimSuffix(nm.SelfNode.Name, ".")
+	for _, dns := range leaf.DNSNames {
+		if name == "" || dns != name {
+			return fmt.Errorf("cert name %q isn't the node's", dns)
+		}
+	}
+	return nil
+}
+
+// NodeCertPair returns a PEM-encoded node identity cert chain and
+// its private key, for mutual TLS with other tailnet services. The
+// cert is cached in memory and a new one is requested from the
+// control server when the cached one is no longer usable.
+//
+// The NodeCA itself, including rotating it, is run by the control
+// server; the node only follows the roots in its netmap.
+func (b *LocalBackend) NodeCertPair(ctx context.Context) (certPEM, keyPEM []byte, err error) {
+	b.nodeCertMu.Lock()
+	defer b.nodeCertMu.Unlock()
+
+	b.mu.Lock()
+	nm := b.netMap
+	c := b.nodeCert
+	b.mu.Unlock()
+	if nm == nil {
+		return nil, nil, errors.New("no netmap")
+	}
+	if nm.NodeCA == nil {
+		return nil, nil, errNoNodeCA
+	}
+	if nodeCertUsable(c, nm, time.Now()) {
+		return c.certPEM, c.keyPEM, nil
+	}
+	c, err = b.fetchNodeCert(ctx, nm)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.logf("node cert: got cert valid until %v", c.chain[0].NotAfter.UTC().Format(time.RFC3339))
+
+	b.mu.Lock()
+	b.nodeCert = c
+	b.mu.Unlock()
+	return c.certPEM, c.keyPEM, nil
+}
+
+// NodeCARoots returns the PEM-encoded roots of the tailnet's NodeCA,
+// which peers' node identity certs chain to.
+func (b *LocalBackend) NodeCARoots() ([]byte, error) {
+	nm := b.NetMap()
+	if nm == nil {
+		return nil, errors.New("no netmap")
+	}
+	if nm.NodeCA == nil {
+		return nil, errNoNodeCA
+	}
+	var buf bytes.Buffer
+	for _, r := range nm.NodeCA.Roots {
+		buf.WriteString(r)
+		if r != "" && r[len(r)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// fetchNodeCert generates a new key and asks the control server to
+// certify it.
+func (b *LocalBackend) fetchNodeCert(ctx context.Context, nm *netmap.NetworkMap) (*nodeCert, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, priv)
+	if err != nil {
+		return nil, err
+	}
+	reqBody, err := json.Marshal(&tailcfg.NodeCertRequest{
+		CapVersion: tailcfg.CurrentCapabilityVersion,
+		NodeKey:    nm.NodeKey,
+		CSR:        csr,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://unused/machine/node-cert", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.DoNoiseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("node cert request: %v: %s", res.Status, bytes.TrimSpace(body))
+	}
+	var resp tailcfg.NodeCertResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("node cert response: %w", err)
+	}
+
+	c := &nodeCert{
+		nodeKey: nm.NodeKey,
+		certPEM: []byte(resp.CertPEM),
+	}
+	for rest := c.certPEM; ; {
+		var blk *pem.Block
+		blk, rest = pem.Decode(rest)
+		if blk == nil {
+			break
+		}
+		if blk.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("node cert response: %w", err)
+		}
+		c.chain = append(c.chain, cert)
+	}
+	if len(c.chain) == 0 {
+		return nil, errors.New("node cert response: no certificate")
+	}
+	if pub, ok := c.chain[0].PublicKey.(*ecdsa.PublicKey); !ok || !pub.Equal(&priv.PublicKey) {
+		return nil, errors.New("node cert response: cert is for a different key")
+	}
+	if err := verifyNodeCertChain(c.chain, nm.NodeCA, time.Now()); err != nil {
+		return nil, fmt.Errorf("node cert response: %w", err)
+	}
+	if err := verifyNodeCertNames(c.chain[0], nm); err != nil {
+		return nil, fmt.Errorf("node cert response: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	c.keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return c, nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+func TestNodeCertUsable(t *testing.T) {
+	start := time.Date(2022, 8, 10, 0, 0, 0, 0, time.UTC)
+	newCA := func(name string) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             start.Add(-24 * time.Hour),
+			NotAfter:              start.Add(365 * 24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, priv, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	ca1, ca1Priv, ca1PEM := newCA("ca1")
+	_, _, ca2PEM := newCA("ca2")
+
+	leafPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeURI, err := url.Parse(tailcfg.NodeCertURIPrefix + "nABC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    start,
+		NotAfter:     start.Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"foo.example.ts.net"},
+		IPAddresses:  []net.IP{net.ParseIP("100.64.1.2"), net.ParseIP("fd7a:115c:a1e0::1")},
+		URIs:         []*url.URL{nodeURI},
+	}, ca1, &leafPriv.PublicKey, ca1Priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeKey := key.NewNode().Public()
+	c := &nodeCert{nodeKey: nodeKey, chain: []*x509.Certificate{leaf}}
+	self := &tailcfg.Node{StableID: "nABC", Name: "foo.example.ts.net."}
+	addrs := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("100.64.1.2/32"),
+		netaddr.MustParseIPPrefix("fd7a:115c:a1e0::1/128"),
+	}
+	nm := func(roots ...string) *netmap.NetworkMap {
+		return &netmap.NetworkMap{
+			NodeKey:   nodeKey,
+			SelfNode:  self,
+			Addresses: addrs,
+			NodeCA:    &tailcfg.NodeCA{Roots: roots},
+		}
+	}
+	// nmWith returns nm(ca1PEM) modified by f.
+	nmWith := func(f func(*netmap.NetworkMap)) *netmap.NetworkMap {
+		m := nm(ca1PEM)
+		f(m)
+		return m
+	}
+
+	tests := []struct {
+		name string
+		c    *nodeCert
+		nm   *netmap.NetworkMap
+		now  time.Time
+		want bool
+	}{
+		{"fresh", c, nm(ca1PEM), start.Add(time.Hour), true},
+		{"rotating_ca", c, nm(ca1PEM, ca2PEM), start.Add(time.Hour), true},
+		{"ca_rotated_out", c, nm(ca2PEM), start.Add(time.Hour), false},
+		{"due_for_renewal", c, nm(ca1PEM), start.Add(17 * time.Hour), false},
+		{"expired", c, nm(ca1PEM), start.Add(25 * time.Hour), false},
+		{"new_node_key", c, &netmap.NetworkMap{NodeKey: key.NewNode().Public(), NodeCA: &tailcfg.NodeCA{Roots: []string{ca1PEM}}}, start.Add(time.Hour), false},
+		{"no_ca", c, &netmap.NetworkMap{NodeKey: nodeKey}, start.Add(time.Hour), false},
+		{"no_cert", nil, nm(ca1PEM), start.Add(time.Hour), false},
+		{"other_node", c, nmWith(func(m *netmap.NetworkMap) {
+			m.SelfNode = &tailcfg.Node{StableID: "nXYZ", Name: self.Name}
+		}), start.Add(time.Hour), false},
+		{"ip_added", c, nmWith(func(m *netmap.NetworkMap) {
+			m.Addresses = append(m.Addresses, netaddr.MustParseIPPrefix("100.64.1.3/32"))
+		}), start.Add(time.Hour), false},
+		{"ip_changed", c, nmWith(func(m *netmap.NetworkMap) {
+			m.Addresses = addrs[:1:1]
+			m.Addresses = append(m.Addresses, netaddr.MustParseIPPrefix("fd7a:115c:a1e0::2/128"))
+		}), start.Add(time.Hour), false},
+		{"renamed", c, nmWith(func(m *netmap.NetworkMap) {
+			m.SelfNode = &tailcfg.Node{StableID: self.StableID, Name: "bar.example.ts.net."}
+		}), start.Add(time.Hour), false},
+		{"no_self_node", c, nmWith(func(m *netmap.NetworkMap) {
+			m.SelfNode = nil
+		}), start.Add(time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nodeCertUsable(tt.c, tt.nm, tt.now); got != tt.want {
+				t.Errorf("nodeCertUsable = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/dnsname"
+)
+
+// ErrNodeGroupNotFound is returned for a node group that isn't defined.
+var ErrNodeGroupNotFound = errors.New("no such node group")
+
+// NodeGroups returns the locally defined node groups, sorted by name.
+func (b *LocalBackend) NodeGroups() ([]ipn.NodeGroup, error) {
+	return b.readNodeGroups()
+}
+
+func (b *LocalBackend) readNodeGroups() ([]ipn.NodeGroup, error) {
+	bs, err := b.store.ReadState(ipn.NodeGroupsStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var gs []ipn.NodeGroup
+	if err := json.Unmarshal(bs, &gs); err != nil {
+		return nil, fmt.Errorf("node groups: %w", err)
+	}
+	return gs, nil
+}
+
+func (b *LocalBackend) writeNodeGroups(gs []ipn.NodeGroup) error {
+	sort.Slice(gs, func(i, j int) bool { return gs[i].Name < gs[j].Name })
+	bs, err := json.Marshal(gs)
+	if err != nil {
+		return err
+	}
+	return b.store.WriteState(ipn.NodeGroupsStateKey, bs)
+}
+
+// SetNodeGroup defines the node group g, replacing any group of the
+// same name.
+func (b *LocalBackend) SetNodeGroup(g ipn.NodeGroup) error {
+	if err := g.Check(); err != nil {
+		return err
+	}
+	b.nodeGroupsMu.Lock()
+	defer b.nodeGroupsMu.Unlock()
+	gs, err := b.readNodeGroups()
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range gs {
+		if gs[i].Name == g.Name {
+			gs[i] = g
+			replaced = true
+		}
+	}
+	if !replaced {
+		gs = append(gs, g)
+	}
+	return b.writeNodeGroups(gs)
+}
+
+// DeleteNodeGroup deletes the node group name.
+func (b *LocalBackend) DeleteNodeGroup(name string) error {
+	b.nodeGroupsMu.Lock()
+	defer b.nodeGroupsMu.Unlock()
+	gs, err := b.readNodeGroups()
+	if err != nil {
+		return err
+	}
+	for i := range gs {
+		if gs[i].Name == name {
+			return b.writeNodeGroups(append(gs[:i], gs[i+1:]...))
+		}
+	}
+	return ErrNodeGroupNotFound
+}
+
+// NodeGroupMembers resolves the node group name against the current
+// network map.
+func (b *LocalBackend) NodeGroupMembers(name string) (*ipnstate.NodeGroupMembers, error) {
+	gs, err := b.readNodeGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gs {
+		if g.Name != name {
+			continue
+		}
+		b.mu.Lock()
+		nm := b.netMap
+		b.mu.Unlock()
+		if nm == nil {
+			return nil, errors.New("no network map; is Tailscale running?")
+		}
+		return nodeGroupMembers(g, nm), nil
+	}
+	return nil, ErrNodeGroupNotFound
+}
+
+// nodeGroupMembers is the implementation of NodeGroupMembers.
+func nodeGroupMembers(g ipn.NodeGroup, nm *netmap.NetworkMap) *ipnstate.NodeGroupMembers {
+	ret := &ipnstate.NodeGroupMembers{Name: g.Name}
+	suffix := nm.MagicDNSSuffix()
+	found := map[string]bool{} // of g.Peers
+	for _, p := range nm.Peers {
+		if p.Hostinfo.Valid() && p.Hostinfo.ShareeNode() {
+			continue
+		}
+		fqdn := strings.TrimSuffix(p.Name, ".")
+		short := dnsname.TrimSuffix(p.Name, suffix)
+		if short == "" && p.Hostinfo.Valid() {
+			short = dnsname.SanitizeHostname(p.Hostinfo.Hostname())
+		}
+		member := nodeHasAnyTag(p, g.Tags)
+		for _, pat := range g.Names {
+			name := short
+			if strings.Contains(pat, ".") {
+				name = fqdn
+			}
+			if ok, _ := path.Match(pat, name); ok {
+				member = true
+			}
+		}
+		for _, want := range g.Peers {
+			if nodeIsPeer(p, want, short, fqdn) {
+				found[want] = true
+				member = true
+			}
+		}
+		if !member {
+			continue
+		}
+		m := ipnstate.NodeGroupMember{
+			Name:    short,
+			DNSName: fqdn,
+			Online:  p.Online != nil && *p.Online,
+		}
+		for _, a := range p.Addresses {
+			if a.IsSingleIP() {
+				m.TailscaleIPs = append(m.TailscaleIPs, a.IP())
+			}
+		}
+		ret.Members = append(ret.Members, m)
+	}
+	for _, want := range g.Peers {
+		if !found[want] {
+			ret.Unresolved = append(ret.Unresolved, want)
+		}
+	}
+	sort.Slice(ret.Members, func(i, j int) bool { return ret.Members[i].Name < ret.Members[j].Name })
+	return ret
+}
+
+func nodeHasAnyTag(n *tailcfg.Node, tags []string) bool {
+	for _, want := range tags {
+		for _, tag := range n.Tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nodeIsPeer reports whether n, with MagicDNS short name short and full
+// name fqdn, is the explicit node group peer want: one of its names or
+// Tailscale IPs.
+func nodeIsPeer(n *tailcfg.Node, want, short, fqdn string) bool {
+	want = strings.TrimSuffix(want, ".")
+	if strings.EqualFold(want, short) || strings.EqualFold(want, fqdn) {
+		return true
+	}
+	for _, a := range n.Addresses {
+		if a.IsSingleIP() && a.IP().String() == want {
+			return true
+		}
+	}
+	return false
+}
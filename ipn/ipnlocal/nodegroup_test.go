@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestNodeGroupMembers(t *testing.T) {
+	online := true
+	node := func(name, ip string, tags ...string) *tailcfg.Node {
+		return &tailcfg.Node{
+			Name:      name + ".example.ts.net.",
+			Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix(ip + "/32")},
+			Tags:      tags,
+			Online:    &online,
+		}
+	}
+	nm := &netmap.NetworkMap{
+		Name: "self.example.ts.net.",
+		Peers: []*tailcfg.Node{
+			node("build-1", "100.64.0.1"),
+			node("build-2", "100.64.0.2"),
+			node("ci", "100.64.0.3", "tag:ci"),
+			node("nas", "100.64.0.4"),
+			node("laptop", "100.64.0.5"),
+		},
+	}
+	names := func(g ipn.NodeGroup) (members, unresolved []string) {
+		ms := nodeGroupMembers(g, nm)
+		for _, m := range ms.Members {
+			members = append(members, m.Name)
+		}
+		return members, ms.Unresolved
+	}
+
+	tests := []struct {
+		name           string
+		g              ipn.NodeGroup
+		want           []string
+		wantUnresolved []string
+	}{
+		{"tag", ipn.NodeGroup{Tags: []string{"tag:ci"}}, []string{"ci"}, nil},
+		{"short-glob", ipn.NodeGroup{Names: []string{"build-*"}}, []string{"build-1", "build-2"}, nil},
+		{"fqdn-glob", ipn.NodeGroup{Names: []string{"*.example.ts.net"}}, []string{"build-1", "build-2", "ci", "laptop", "nas"}, nil},
+		{"peers", ipn.NodeGroup{Peers: []string{"NAS", "100.64.0.5", "gone"}}, []string{"laptop", "nas"}, []string{"gone"}},
+		{"union", ipn.NodeGroup{Tags: []string{"tag:ci"}, Names: []string{"build-1"}, Peers: []string{"ci.example.ts.net."}}, []string{"build-1", "ci"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, unresolved := names(tt.g)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("members = %q; want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(unresolved, tt.wantUnresolved) {
+				t.Errorf("unresolved = %q; want %q", unresolved, tt.wantUnresolved)
+			}
+		})
+	}
+
+	ms := nodeGroupMembers(ipn.NodeGroup{Peers: []string{"nas"}}, nm)
+	want := []netaddr.IP{netaddr.MustParseIP("100.64.0.4")}
+	if m := ms.Members[0]; m.DNSName != "nas.example.ts.net" || !m.Online || !reflect.DeepEqual(m.TailscaleIPs, want) {
+		t.Errorf("member = %+v; want nas.example.ts.net, online, at %v", m, want)
+	}
+}
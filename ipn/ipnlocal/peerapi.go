@@ -570,6 +570,9 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "/v0/interfaces":
 		h.handleServeInterfaces(w, r)
 		return
+	case "/v0/pref-approvals":
+		h.handlePrefApprovals(w, r)
+		return
 	}
 	who := h.peerUser.DisplayName
 	fmt.Fprintf(w, `<html>
@@ -692,6 +695,13 @@ func (h *peerAPIHandler) canWakeOnLAN() bool {
 	return h.isSelf || h.peerHasCap(tailcfg.CapabilityWakeOnLAN)
 }
 
+// canApprovePrefs reports whether h can approve this node's pending
+// sensitive pref changes. Unlike the other capabilities, it's not
+// implied by h.isSelf: the point is a second person's approval.
+func (h *peerAPIHandler) canApprovePrefs() bool {
+	return h.peerNode.StableID != h.ps.selfNode.StableID && h.peerHasCap(tailcfg.CapabilityApprovePrefs)
+}
+
 func (h *peerAPIHandler) peerHasCap(wantCap string) bool {
 	for _, hasCap := range h.ps.b.PeerCaps(h.remoteAddr.IP()) {
 		if hasCap == wantCap {
@@ -894,6 +904,33 @@ func (h *peerAPIHandler) handleServeDNSFwd(w http.ResponseWriter, r *http.Reques
 	dh.ServeHTTP(w, r)
 }
 
+// handlePrefApprovals lists the pref changes waiting for approval on
+// GET, and approves the one named by the "id" parameter on POST.
+func (h *peerAPIHandler) handlePrefApprovals(w http.ResponseWriter, r *http.Request) {
+	if !h.canApprovePrefs() {
+		http.Error(w, "denied; no pref approval access", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.ps.b.pendingPrefApprovals())
+	case "POST":
+		id := r.FormValue("id")
+		if id == "" {
+			http.Error(w, "missing 'id' param", http.StatusBadRequest)
+			return
+		}
+		if err := h.ps.b.approvePrefChange(id, r.FormValue("digest"), h.peerNode); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "approved\n")
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
 func (h *peerAPIHandler) handleWakeOnLAN(w http.ResponseWriter, r *http.Request) {
 	if !h.canWakeOnLAN() {
 		http.Error(w, "no WoL access", http.StatusForbidden)
@@ -919,10 +956,7 @@ func (h *peerAPIHandler) handleWakeOnLAN(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "failed to get interfaces state", http.StatusInternalServerError)
 		return
 	}
-	var res struct {
-		SentTo []string
-		Errors []string
-	}
+	var res apitype.WakeOnLANResponse
 	for ifName, ips := range st.InterfaceIPs {
 		for _, ip := range ips {
 			if ip.IP().IsLoopback() || ip.IP().Is6() {
@@ -1210,3 +1244,40 @@ func (fl *fakePeerAPIListener) Accept() (net.Conn, error) {
 }
 
 func (fl *fakePeerAPIListener) Addr() net.Addr { return fl.addr }
+
+// doPeerAPIRequest makes a method request for pathAndQuery on the peer
+// API of the peer with Tailscale IP ip, returning the body of its 200
+// OK response.
+func (b *LocalBackend) doPeerAPIRequest(ctx context.Context, ip netaddr.IP, method, pathAndQuery string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	nm := b.NetMap()
+	if nm == nil {
+		return nil, errors.New("no netmap")
+	}
+	peer, ok := nm.PeerByTailscaleIP(ip)
+	if !ok {
+		return nil, fmt.Errorf("no peer found with Tailscale IP %v", ip)
+	}
+	base := peerAPIBase(nm, peer)
+	if base == "" {
+		return nil, fmt.Errorf("no peer API base found for peer %v (%v)", peer.ID, ip)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+pathAndQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.Dialer().PeerAPITransport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// What WaitReady can wait for.
+const (
+	ReadyPeers    = "peers"    // running, with the netmap's peers configured
+	ReadyRoutes   = "routes"   // as ReadyPeers, plus peers' subnet routes
+	ReadyExitNode = "exitnode" // as ReadyPeers, with the exit node online
+)
+
+// readyPollInterval is how often WaitReady checks readiness.
+const readyPollInterval = 250 * time.Millisecond
+
+// errNotReady wraps the reasons readyLocked returns for conditions
+// that may yet become true.
+var errNotReady = errors.New("not ready")
+
+// WaitReady blocks until this node is ready for what, one of
+// ReadyPeers, ReadyRoutes or ReadyExitNode, or ctx is done. It returns
+// an error right away if what can't become ready with the current prefs,
+// and on ctx expiring, one saying what it was still waiting for.
+func (b *LocalBackend) WaitReady(ctx context.Context, what string) error {
+	switch what {
+	case ReadyPeers, ReadyRoutes, ReadyExitNode:
+	default:
+		return fmt.Errorf("unknown readiness %q; want %s, %s or %s", what, ReadyPeers, ReadyRoutes, ReadyExitNode)
+	}
+	t := time.NewTicker(readyPollInterval)
+	defer t.Stop()
+	for {
+		b.mu.Lock()
+		err := b.readyLocked(what)
+		b.mu.Unlock()
+		if err == nil || !errors.Is(err, errNotReady) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s: %w", what, err)
+		case <-t.C:
+		}
+	}
+}
+
+// readyLocked reports whether this node is ready for what, returning
+// an error wrapping errNotReady if it's not yet, or another if it
+// can't be.
+//
+// b.mu must be held.
+func (b *LocalBackend) readyLocked(what string) error {
+	notReady := func(format string, args ...any) error {
+		return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), errNotReady)
+	}
+	prefs := b.prefs
+	if prefs == nil {
+		return notReady("not started")
+	}
+	switch what {
+	case ReadyRoutes:
+		if !prefs.RouteAll {
+			return errors.New("not accepting subnet routes; use --accept-routes")
+		}
+	case ReadyExitNode:
+		if prefs.ExitNodeID.IsZero() && prefs.ExitNodeIP.IsZero() {
+			return errors.New("no exit node set; use --exit-node")
+		}
+	}
+	if b.state != ipn.Running {
+		return notReady("state is %v", b.state)
+	}
+	nm := b.netMap
+	if nm == nil || b.cfgNetMap != nm {
+		return notReady("network map not yet applied")
+	}
+	switch what {
+	case ReadyRoutes:
+		for _, p := range nm.Peers {
+			for _, r := range p.PrimaryRoutes {
+				if r.Bits() != 0 { // not an exit route
+					return nil
+				}
+			}
+		}
+		return notReady("no peer offers subnet routes")
+	case ReadyExitNode:
+		if prefs.ExitNodeID.IsZero() {
+			return notReady("exit node %v not found", prefs.ExitNodeIP)
+		}
+		if b.trustedNetwork != "" {
+			return fmt.Errorf("exit node not used on trusted network %q", b.trustedNetwork)
+		}
+		p, ok := nm.PeerWithStableID(prefs.ExitNodeID)
+		if !ok {
+			return notReady("exit node %v not in network map", prefs.ExitNodeID)
+		}
+		if p.Online == nil || !*p.Online {
+			return notReady("exit node %v offline", p.ComputedName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestReadyLocked(t *testing.T) {
+	online := true
+	exit := &tailcfg.Node{
+		StableID:      "exit",
+		ComputedName:  "exit",
+		Online:        &online,
+		PrimaryRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("0.0.0.0/0")},
+	}
+	router := &tailcfg.Node{
+		StableID:      "router",
+		PrimaryRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/24")},
+	}
+	offline := &tailcfg.Node{StableID: "offline"}
+	tests := []struct {
+		name    string
+		what    string
+		prefs   ipn.Prefs
+		state   ipn.State
+		peers   []*tailcfg.Node
+		applied bool
+		want    string // "" for ready, "wait" for not yet, "fail" for never
+	}{
+		{name: "peers_ready", what: ReadyPeers, state: ipn.Running, applied: true},
+		{name: "peers_starting", what: ReadyPeers, state: ipn.Starting, applied: true, want: "wait"},
+		{name: "peers_unapplied", what: ReadyPeers, state: ipn.Running, want: "wait"},
+		{name: "routes_not_accepted", what: ReadyRoutes, state: ipn.Running, applied: true, want: "fail"},
+		{name: "routes_exit_only", what: ReadyRoutes, prefs: ipn.Prefs{RouteAll: true}, state: ipn.Running, peers: []*tailcfg.Node{exit}, applied: true, want: "wait"},
+		{name: "routes_ready", what: ReadyRoutes, prefs: ipn.Prefs{RouteAll: true}, state: ipn.Running, peers: []*tailcfg.Node{exit, router}, applied: true},
+		{name: "exit_unset", what: ReadyExitNode, state: ipn.Running, applied: true, want: "fail"},
+		{name: "exit_offline", what: ReadyExitNode, prefs: ipn.Prefs{ExitNodeID: "offline"}, state: ipn.Running, peers: []*tailcfg.Node{offline}, applied: true, want: "wait"},
+		{name: "exit_ready", what: ReadyExitNode, prefs: ipn.Prefs{ExitNodeID: "exit"}, state: ipn.Running, peers: []*tailcfg.Node{exit}, applied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := &netmap.NetworkMap{Peers: tt.peers}
+			b := &LocalBackend{
+				prefs:  &tt.prefs,
+				state:  tt.state,
+				netMap: nm,
+			}
+			if tt.applied {
+				b.cfgNetMap = nm
+			}
+			err := b.readyLocked(tt.what)
+			got := ""
+			if err != nil {
+				got = "fail"
+				if errors.Is(err, errNotReady) {
+					got = "wait"
+				}
+			}
+			if got != tt.want {
+				t.Errorf("readyLocked = %v; want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	b := &LocalBackend{prefs: ipn.NewPrefs(), state: ipn.Starting}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.WaitReady(ctx, ReadyPeers); err == nil {
+		t.Error("WaitReady succeeded while starting")
+	}
+	if err := b.WaitReady(context.Background(), "bogus"); err == nil {
+		t.Error("WaitReady succeeded for unknown readiness")
+	}
+}
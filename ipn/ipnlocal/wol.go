@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/types/logger"
+)
+
+// maxWoLMACs is the most MAC addresses a node advertises in
+// Hostinfo.WoLMACs.
+const maxWoLMACs = 10
+
+// getWoLMACs returns the MAC addresses to advertise in Hostinfo.WoLMACs,
+// so subnet routers on the same LAN can wake this node.
+//
+// They're only advertised if TS_WAKE_MAC says so: either "auto", for the
+// MACs of the node's up Ethernet-like interfaces, or a comma-separated
+// list of MACs.
+func getWoLMACs(logf logger.Logf) []string {
+	v := envknob.String("TS_WAKE_MAC")
+	if v == "" {
+		return nil
+	}
+	if v == "auto" {
+		return autoWoLMACs()
+	}
+	macs, err := parseWoLMACs(v)
+	if err != nil {
+		logf("ignoring TS_WAKE_MAC: %v", err)
+		return nil
+	}
+	return macs
+}
+
+// parseWoLMACs parses a comma-separated list of MACs into their
+// canonical form.
+func parseWoLMACs(s string) ([]string, error) {
+	var ret []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(f)
+		if err != nil {
+			return nil, err
+		}
+		if len(mac) != 6 {
+			return nil, fmt.Errorf("%q isn't an Ethernet MAC address", f)
+		}
+		ret = append(ret, mac.String())
+	}
+	if len(ret) > maxWoLMACs {
+		return nil, fmt.Errorf("too many MAC addresses; max %d", maxWoLMACs)
+	}
+	return ret, nil
+}
+
+func autoWoLMACs() []string {
+	var ret []string
+	interfaces.ForeachInterface(func(i interfaces.Interface, _ []netaddr.IPPrefix) {
+		if len(ret) >= maxWoLMACs {
+			return
+		}
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 || i.Flags&net.FlagBroadcast == 0 {
+			return
+		}
+		if len(i.HardwareAddr) != 6 {
+			return
+		}
+		ret = append(ret, i.HardwareAddr.String())
+	})
+	return ret
+}
+
+// WakeOnLAN asks the peer with Tailscale IP ip, typically a subnet
+// router, to send a Wake-on-LAN packet for mac on its local networks.
+// The peer must grant this node tailcfg.CapabilityWakeOnLAN.
+func (b *LocalBackend) WakeOnLAN(ctx context.Context, ip netaddr.IP, mac net.HardwareAddr) (*apitype.WakeOnLANResponse, error) {
+	body, err := b.doPeerAPIRequest(ctx, ip, "POST", "/v0/wol?mac="+url.QueryEscape(mac.String()))
+	if err != nil {
+		return nil, err
+	}
+	res := new(apitype.WakeOnLANResponse)
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, fmt.Errorf("invalid Wake-on-LAN JSON from peer: %w", err)
+	}
+	return res, nil
+}
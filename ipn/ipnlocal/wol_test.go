@@ -0,0 +1,34 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseWoLMACs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "00:11:22:AA:BB:CC", want: []string{"00:11:22:aa:bb:cc"}},
+		{in: " 00-11-22-33-44-55 ,, 66:77:88:99:aa:bb", want: []string{"00:11:22:33:44:55", "66:77:88:99:aa:bb"}},
+		{in: "bogus", wantErr: true},
+		{in: "00:00:5e:00:53:01:02:03", wantErr: true}, // EUI-64
+	}
+	for _, tt := range tests {
+		got, err := parseWoLMACs(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseWoLMACs(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseWoLMACs(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
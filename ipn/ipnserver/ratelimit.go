@@ -0,0 +1,184 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/tstime/rate"
+	"tailscale.com/util/clientmetric"
+)
+
+// Per-user limits on read-only LocalAPI requests. They're generous
+// enough for a GUI polling status a few times a second, plus the odd
+// CLI command, but stop a client calling status endpoints in a tight
+// loop from keeping the backend busy.
+const (
+	localAPIReadRate  = 20 // requests per second
+	localAPIReadBurst = 40
+
+	// localAPISharedReadRate and localAPISharedReadBurst bound the
+	// read-only requests of all users together, so that many
+	// clients (or one spread over many users) can't do collectively
+	// what one client can't.
+	localAPISharedReadRate  = 50
+	localAPISharedReadBurst = 100
+
+	// localAPILimiterIdle is how long a user's limiter is kept
+	// after its last request. By then it's refilled, so forgetting
+	// it changes nothing.
+	localAPILimiterIdle = 10 * time.Second
+
+	// localAPIWriteWait is the longest a read-only request waits
+	// for in-flight pref edits before being served anyway.
+	localAPIWriteWait = time.Second
+)
+
+var metricLocalAPIThrottled = clientmetric.NewCounter("localapi_throttled")
+
+// localAPILimiter rate limits read-only LocalAPI requests by user and
+// in total, and gives pref edits priority over them.
+//
+// Requests that change state are never limited. While a pref edit is
+// in flight, new read-only requests wait for it (up to
+// localAPIWriteWait), so an edit doesn't queue behind a client
+// hammering status endpoints.
+type localAPILimiter struct {
+	mu      sync.Mutex
+	clients map[string]*localAPIClientLimiter // keyed by localAPIClientKey
+	pruned  time.Time                         // when clients was last pruned
+	shared  *rate.Limiter                     // or nil until first use
+
+	edits     int           // number of in-flight pref edits
+	editsDone chan struct{} // closed when edits drops to zero; nil if edits == 0
+}
+
+type localAPIClientLimiter struct {
+	lim  *rate.Limiter
+	last time.Time // of the most recent request
+}
+
+// allow reports whether the user identified by key may make another
+// read-only request now.
+func (l *localAPILimiter) allow(key string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.pruned) > localAPILimiterIdle {
+		for k, c := range l.clients {
+			if now.Sub(c.last) > localAPILimiterIdle {
+				delete(l.clients, k)
+			}
+		}
+		l.pruned = now
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		if l.clients == nil {
+			l.clients = map[string]*localAPIClientLimiter{}
+		}
+		c = &localAPIClientLimiter{lim: rate.NewLimiter(localAPIReadRate, localAPIReadBurst)}
+		l.clients[key] = c
+	}
+	c.last = now
+	if l.shared == nil {
+		l.shared = rate.NewLimiter(localAPISharedReadRate, localAPISharedReadBurst)
+	}
+	shared := l.shared
+	l.mu.Unlock()
+	// Check the user's own budget first, so a throttled user
+	// doesn't also use up the shared one.
+	return c.lim.Allow() && shared.Allow()
+}
+
+// startEdit records that a pref edit is in flight. The caller must
+// call the returned func when it's done.
+func (l *localAPILimiter) startEdit() (done func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.edits == 0 {
+		l.editsDone = make(chan struct{})
+	}
+	l.edits++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.edits--
+		if l.edits == 0 {
+			close(l.editsDone)
+			l.editsDone = nil
+		}
+	}
+}
+
+// waitForEdits waits until no pref edits are in flight, ctx is done,
+// or localAPIWriteWait has passed, whichever is first.
+func (l *localAPILimiter) waitForEdits(ctx context.Context) {
+	l.mu.Lock()
+	done := l.editsDone
+	l.mu.Unlock()
+	if done == nil {
+		return
+	}
+	t := time.NewTimer(localAPIWriteWait)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// localAPIClientKey returns the key that ci's LocalAPI requests are
+// limited by: the user (uid, or SID on Windows) on the other end of
+// the socket, if known.
+//
+// It's the user rather than the process so that a client can't get a
+// fresh budget by starting new processes.
+func localAPIClientKey(ci connIdentity) string {
+	if ci.Creds != nil {
+		if uid, ok := ci.Creds.UserID(); ok {
+			return "uid:" + uid
+		}
+	}
+	if ci.UserID != "" {
+		return "sid:" + ci.UserID
+	}
+	// Without a user, each connection gets its own limit. The
+	// shared limit still applies.
+	return fmt.Sprintf("conn:%p", ci.Conn)
+}
+
+// isPrefEditRequest reports whether r edits prefs, and so takes
+// priority over read-only requests.
+func isPrefEditRequest(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/localapi/v0/prefs":
+		return r.Method == "PATCH"
+	case "/localapi/v0/prefs-transaction":
+		return r.Method == "POST"
+	}
+	return false
+}
+
+// isLimitedLocalAPIRequest reports whether r is a read-only LocalAPI
+// request subject to localAPILimiter.
+func isLimitedLocalAPIRequest(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	switch r.URL.Path {
+	case "/localapi/v0/whois":
+		// Called once per incoming request by proxies and servers
+		// authenticating tailnet users, so its rate is set by
+		// their traffic, not by a misbehaving client.
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, "/localapi/")
+}
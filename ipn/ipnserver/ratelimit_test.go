@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLocalAPILimiter(t *testing.T) {
+	var l localAPILimiter
+	for i := 0; i < localAPIReadBurst; i++ {
+		if !l.allow("uid:1000") {
+			t.Fatalf("request %d throttled within burst", i)
+		}
+	}
+	if l.allow("uid:1000") {
+		t.Error("request past burst allowed")
+	}
+	if !l.allow("uid:1001") {
+		t.Error("another user throttled by the first's requests")
+	}
+}
+
+func TestLocalAPILimiterShared(t *testing.T) {
+	var l localAPILimiter
+	allowed := 0
+	for i := 0; i < 2*localAPISharedReadBurst; i++ {
+		if l.allow(fmt.Sprintf("conn:%d", i)) {
+			allowed++
+		}
+	}
+	if allowed != localAPISharedReadBurst {
+		t.Errorf("allowed %d requests from distinct clients; want shared burst of %d", allowed, localAPISharedReadBurst)
+	}
+}
+
+func TestLocalAPILimiterEdits(t *testing.T) {
+	var l localAPILimiter
+	l.waitForEdits(context.Background()) // returns at once with no edits
+
+	done := l.startEdit()
+	waited := make(chan struct{})
+	go func() {
+		l.waitForEdits(context.Background())
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("read didn't wait for in-flight edit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	select {
+	case <-waited:
+	case <-time.After(localAPIWriteWait / 2):
+		t.Fatal("read still waiting after edit finished")
+	}
+}
+
+func TestLocalAPILimiterPrune(t *testing.T) {
+	var l localAPILimiter
+	l.allow("uid:1000")
+	l.mu.Lock()
+	l.clients["uid:1000"].last = time.Now().Add(-2 * localAPILimiterIdle)
+	l.pruned = time.Time{}
+	l.mu.Unlock()
+	l.allow("uid:1001")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.clients["uid:1000"]; ok {
+		t.Error("idle client's limiter not pruned")
+	}
+	if _, ok := l.clients["uid:1001"]; !ok {
+		t.Error("active client's limiter missing")
+	}
+}
+
+func TestIsLimitedLocalAPIRequest(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/localapi/v0/status", true},
+		{"GET", "/localapi/v0/prefs", true},
+		{"PATCH", "/localapi/v0/prefs", false},
+		{"POST", "/localapi/v0/logout", false},
+		{"GET", "/localapi/v0/whois?addr=100.101.102.103:1234", false},
+		{"GET", "/", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := isLimitedLocalAPIRequest(r); got != tt.want {
+			t.Errorf("%s %s: got %v; want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIsPrefEditRequest(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"PATCH", "/localapi/v0/prefs", true},
+		{"GET", "/localapi/v0/prefs", false},
+		{"POST", "/localapi/v0/prefs-transaction", true},
+		{"POST", "/localapi/v0/logout", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := isPrefEditRequest(r); got != tt.want {
+			t.Errorf("%s %s: got %v; want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
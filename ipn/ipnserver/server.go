@@ -43,6 +43,7 @@
 	"tailscale.com/safesocket"
 	"tailscale.com/smallzstd"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/usermsg"
 	"tailscale.com/util/groupmember"
 	"tailscale.com/util/pidowner"
 	"tailscale.com/util/systemd"
@@ -64,6 +65,18 @@ type Options struct {
 	// If empty, Taildrop and TLS certs don't function.
 	VarRoot string
 
+	// CrashDir is the directory of crash reports from previous runs
+	// (see package crashreport), or empty if there isn't one.
+	CrashDir string
+
+	// UploadCrashReports is whether to upload the crash reports in
+	// CrashDir, when the node's telemetry level permits.
+	UploadCrashReports bool
+
+	// RecentLogs, if non-nil, holds tailscaled's most recent log
+	// lines, for inclusion in support bundles.
+	RecentLogs *logger.Ring
+
 	// AutostartStateKey, if non-empty, immediately starts the agent
 	// using the given StateKey. If empty, the agent stays idle and
 	// waits for a frontend to start it.
@@ -112,6 +125,8 @@ type Server struct {
 	allClients     map[net.Conn]connIdentity    // HTTP or IPN
 	clients        map[net.Conn]bool            // subset of allClients; only IPN protocol
 	disconnectSub  map[chan<- struct{}]struct{} // keys are subscribers of disconnects
+
+	apiLimiter localAPILimiter
 }
 
 // LocalBackend returns the server's LocalBackend.
@@ -286,10 +301,10 @@ func (s *Server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 		bs := ipn.NewBackendServer(logf, nil, jsonNotifier(c, s.logf))
 		_, occupied := err.(inUseOtherUserError)
 		if occupied {
-			bs.SendInUseOtherUserErrorMessage(err.Error())
+			bs.SendInUseOtherUserError(err)
 			s.blockWhileInUse(c, ci)
 		} else {
-			bs.SendErrorMessage(err.Error())
+			bs.SendError(err)
 			time.Sleep(time.Second)
 		}
 		return
@@ -321,6 +336,10 @@ func (s *Server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 	if isReadonlyConn(ci, s.b.OperatorUserID(), logf) {
 		ctx = ipn.ReadonlyContextOf(ctx)
 	}
+	// Replies are written by the BackendServer while it holds the
+	// same lock it holds when broadcasting via writeToClients, so
+	// they don't interleave with other writes to c.
+	ctx = ipn.ReplyContextOf(ctx, jsonNotifier(c, s.logf))
 
 	for ctx.Err() == nil {
 		msg, err := ipn.ReadMsg(br)
@@ -426,11 +445,11 @@ func (s *Server) checkConnIdentityLocked(ci connIdentity) error {
 			break
 		}
 		if ci.UserID != active.UserID {
-			return inUseOtherUserError{fmt.Errorf("Tailscale already in use by %s, pid %d", active.User.Username, active.Pid)}
+			return inUseOtherUserError{usermsg.Errorf(usermsg.InUseByUserPID, "user", active.User.Username, "pid", strconv.Itoa(active.Pid))}
 		}
 	}
 	if su := s.serverModeUser; su != nil && ci.UserID != su.Uid {
-		return inUseOtherUserError{fmt.Errorf("Tailscale already in use by %s", su.Username)}
+		return inUseOtherUserError{usermsg.Errorf(usermsg.InUseByUser, "user", su.Username)}
 	}
 	return nil
 }
@@ -500,6 +519,45 @@ func (s *Server) connCanFetchCerts(ci connIdentity) bool {
 	return false
 }
 
+// windowsAdministratorsSID is the SID of the BUILTIN\Administrators group.
+const windowsAdministratorsSID = "S-1-5-32-544"
+
+// connCanManageKeys reports whether ci may export or import the node's
+// private keys. PermitWrite isn't enough: the --operator user, and on
+// Windows whoever is using the GUI, may control tailscaled but mustn't
+// be able to copy its identity or replace it with another node's.
+//
+// It's only allowed to root (or the user tailscaled runs as) on Unix,
+// and to members of the Administrators group on Windows.
+func (s *Server) connCanManageKeys(ci connIdentity) bool {
+	switch runtime.GOOS {
+	case "windows":
+		if ci.User == nil {
+			return false
+		}
+		gids, err := ci.User.GroupIds()
+		if err != nil {
+			return false
+		}
+		for _, gid := range gids {
+			if gid == windowsAdministratorsSID {
+				return true
+			}
+		}
+		return false
+	case "js":
+		return true
+	}
+	if !ci.IsUnixSock || ci.Creds == nil {
+		return false
+	}
+	uid, ok := ci.Creds.UserID()
+	if !ok {
+		return false
+	}
+	return uid == "0" || uid == strconv.Itoa(os.Getuid())
+}
+
 // registerDisconnectSub adds ch as a subscribe to connection disconnect
 // events. If add is false, the subscriber is removed.
 func (s *Server) registerDisconnectSub(ch chan<- struct{}, add bool) {
@@ -766,6 +824,8 @@ func New(logf logger.Logf, logid string, store ipn.StateStore, eng wgengine.Engi
 		return nil, fmt.Errorf("NewLocalBackend: %v", err)
 	}
 	b.SetVarRoot(opts.VarRoot)
+	b.SetCrashReports(opts.CrashDir, opts.UploadCrashReports)
+	b.SetRecentLogs(opts.RecentLogs)
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
@@ -846,6 +906,8 @@ func (s *Server) Run(ctx context.Context, ln net.Listener) error {
 		})
 	}
 
+	go s.keepAliveLoop(ctx)
+
 	systemd.Ready()
 	bo := backoff.NewBackoff("ipnserver", s.logf, 30*time.Second)
 	var connNum int
@@ -867,6 +929,25 @@ func (s *Server) Run(ctx context.Context, ln net.Listener) error {
 	}
 }
 
+// ipnKeepAliveInterval is how often connected IPN frontends are sent
+// a keep-alive notification.
+const ipnKeepAliveInterval = 30 * time.Second
+
+// keepAliveLoop periodically sends keep-alive notifications to the
+// connected IPN frontends until ctx is done.
+func (s *Server) keepAliveLoop(ctx context.Context) {
+	t := time.NewTicker(ipnKeepAliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.bs.SendKeepAlive()
+		}
+	}
+}
+
 // BabysitProc runs the current executable as a child process with the
 // provided args, capturing its output, writing it to files, and
 // restarting the process on any crashes.
@@ -1044,9 +1125,22 @@ func (s *Server) localhostHandler(ci connIdentity) http.Handler {
 	lah := localapi.NewHandler(s.b, s.logf, s.backendLogID)
 	lah.PermitRead, lah.PermitWrite = s.localAPIPermissions(ci)
 	lah.PermitCert = s.connCanFetchCerts(ci)
+	lah.PermitKeys = s.connCanManageKeys(ci)
+	clientKey := localAPIClientKey(ci)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/localapi/") {
+			if isLimitedLocalAPIRequest(r) {
+				if !s.apiLimiter.allow(clientKey) {
+					metricLocalAPIThrottled.Add(1)
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, "too many LocalAPI requests; slow down", http.StatusTooManyRequests)
+					return
+				}
+				s.apiLimiter.waitForEdits(r.Context())
+			} else if isPrefEditRequest(r) {
+				defer s.apiLimiter.startEdit()()
+			}
 			lah.ServeHTTP(w, r)
 			return
 		}
@@ -19,7 +19,9 @@
 
 	"inet.af/netaddr"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
+	"tailscale.com/types/usermsg"
 	"tailscale.com/types/views"
 	"tailscale.com/util/dnsname"
 )
@@ -47,6 +49,35 @@ type Status struct {
 	// problems are detected)
 	Health []string
 
+	// HealthMessages is Health in structured form, one element per
+	// Health element, for frontends that show them in the user's
+	// language. See package usermsg.
+	HealthMessages []usermsg.Message `json:",omitempty"`
+
+	// Telemetry is the effective telemetry level (a
+	// preftype.TelemetryLevel string value): "full", "health-only",
+	// or "none".
+	Telemetry string `json:",omitempty"`
+
+	// TelemetryRestricted is whether tailscaled was started with
+	// telemetry restricted (e.g. with --no-logs-no-support), in which
+	// case the Telemetry pref can't raise the level.
+	TelemetryRestricted bool `json:",omitempty"`
+
+	// TrustedNetwork is the ipn.Prefs.TrustedNetworks rule matching the
+	// network the machine is on, if any. While on it, the node doesn't
+	// use its exit node, or goes idle if TrustedNetworksIdle is set.
+	TrustedNetwork string `json:",omitempty"`
+
+	// DSCP is whether tailscaled marks its disco and interactive
+	// packets with DSCP (QoS) values on the current network:
+	// "marking"; "unchecked" if no probe has found the network
+	// preserving the markings yet; or "stripped" if the network was
+	// found to strip them. It only marks packets in the first case.
+	// It's empty if marking isn't supported on this platform or is
+	// disabled.
+	DSCP string `json:",omitempty"`
+
 	// This field is the legacy name of CurrentTailnet.MagicDNSSuffix.
 	//
 	// Deprecated: use CurrentTailnet.MagicDNSSuffix instead.
@@ -97,6 +128,72 @@ type ExitNodeStatus struct {
 	TailscaleIPs []netaddr.IPPrefix
 }
 
+// DERPRegionStatus describes the node's connection to a DERP region.
+type DERPRegionStatus struct {
+	RegionID   int
+	RegionCode string
+	RegionName string
+
+	// Home is whether this is the node's home region, where peers
+	// send it packets.
+	Home bool
+
+	// Forced is whether Home was forced with "tailscale debug derp
+	// switch" rather than picked by latency.
+	Forced bool `json:",omitempty"`
+
+	// Active is whether the node has a connection to the region open,
+	// and Connected whether that connection is up.
+	Active    bool
+	Connected bool
+
+	// ConnectedSince is when the current connection came up, if
+	// Connected.
+	ConnectedSince time.Time
+
+	// Latency is the region's latency from the most recent netcheck,
+	// or zero if unknown.
+	Latency time.Duration
+
+	// LastError is the most recent connection error, if any, and
+	// LastErrorTime when it happened.
+	LastError     string `json:",omitempty"`
+	LastErrorTime time.Time
+
+	// Problem is the health problem the region's server reported, if any.
+	Problem string `json:",omitempty"`
+}
+
+// DERPRegionHealth summarizes the history of netcheck's results for a
+// DERP region, as kept by tailscaled across restarts.
+type DERPRegionHealth struct {
+	RegionID   int
+	RegionCode string
+	RegionName string
+
+	// Recent, Day and Week summarize the last 3 hours, 24 hours and 7
+	// days.
+	Recent DERPHealthWindow
+	Day    DERPHealthWindow
+	Week   DERPHealthWindow
+
+	// Trend is how Recent compares with the rest of the week: "worse",
+	// "better" or "stable", or empty if there isn't enough history.
+	Trend string `json:",omitempty"`
+}
+
+// DERPHealthWindow summarizes netcheck's results for a DERP region over
+// a period.
+type DERPHealthWindow struct {
+	// Checks is the number of full netchecks run, and Availability the
+	// fraction of them that heard back from the region.
+	Checks       int
+	Availability float64
+
+	// Latency is the mean latency to the region, or zero if unknown.
+	Latency time.Duration
+}
+
 func (s *Status) Peers() []key.NodePublic {
 	kk := make([]key.NodePublic, 0, len(s.Peer))
 	for k := range s.Peer {
@@ -151,6 +248,11 @@ type PeerStatus struct {
 	ExitNode       bool // true if this is the currently selected exit node.
 	ExitNodeOption bool // true if this node can be an exit node (offered && approved)
 
+	// DERPRelayedBytes is the number of bytes DERP servers have
+	// reported relaying from this node to the peer: how much of
+	// TxBytes didn't go direct.
+	DERPRelayedBytes int64 `json:",omitempty"`
+
 	// Active is whether the node was recently active. The
 	// definition is somewhat undefined but has historically and
 	// currently means that there was some packet sent to this
@@ -318,6 +420,9 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.TxBytes; v != 0 {
 		e.TxBytes = v
 	}
+	if v := st.DERPRelayedBytes; v != 0 {
+		e.DERPRelayedBytes = v
+	}
 	if v := st.LastHandshake; !v.IsZero() {
 		e.LastHandshake = v
 	}
@@ -532,6 +637,16 @@ type PingResult struct {
 	// a ping to the local node.
 	IsLocalIP bool `json:",omitempty"`
 
+	// RelayVerified is set for pings of type "relay"
+	// (tailcfg.PingRelay) whose echo came back through DERP intact.
+	RelayVerified bool `json:",omitempty"`
+
+	// PeerProcessingSeconds is, for pings of type "relay", how long
+	// the peer reported holding the echo before replying.
+	// LatencySeconds minus PeerProcessingSeconds is the round-trip
+	// time of the relay path itself.
+	PeerProcessingSeconds float64 `json:",omitempty"`
+
 	// TODO(bradfitz): details like whether port mapping was used on either side? (Once supported)
 }
 
@@ -569,3 +684,198 @@ func sortKey(ps *PeerStatus) string {
 	raw := ps.PublicKey.Raw32()
 	return string(raw[:])
 }
+
+// RouteStatus is whether the OS routes and firewall rules for the
+// node's current configuration are all in place. It's returned by the
+// LocalAPI "routes-converged" endpoint.
+type RouteStatus struct {
+	// Converged is whether the last router configuration was applied
+	// without error and, if Verified, found intact at LastCheck.
+	Converged bool
+
+	// Verified is whether the platform's router can check its OS
+	// state. If false, Converged only means the configuration was
+	// applied without error.
+	Verified bool
+
+	// LastChange is when the router configuration was last applied.
+	LastChange time.Time
+
+	// LastCheck is when the OS state was last verified, if Verified.
+	LastCheck time.Time
+
+	// Problem describes why the routes aren't converged, if not.
+	Problem string `json:",omitempty"`
+
+	// Repairs is how many times routes or firewall rules were found
+	// missing and reprogrammed since the configuration last changed.
+	Repairs int `json:",omitempty"`
+}
+
+// FlowStat is the traffic of a flow between this node and a peer, or a
+// host reached through a peer, since tailscaled started counting it.
+// It's returned by the LocalAPI "flows" endpoint.
+type FlowStat struct {
+	Proto  ipproto.Proto
+	Local  netaddr.IPPort
+	Remote netaddr.IPPort
+
+	// Peer is the node key of the peer that Remote is reached
+	// through (such as an exit node or subnet router), or the zero
+	// key if unknown.
+	Peer key.NodePublic
+
+	TxPackets uint64 // sent by this node
+	TxBytes   uint64
+	RxPackets uint64 // received by this node
+	RxBytes   uint64
+}
+
+// ShadowDiff is how a network map or config given to the engine
+// differs from the one before it, as recorded by the engine's shadow
+// mode. It's returned by the LocalAPI "shadow-diffs" endpoint.
+type ShadowDiff struct {
+	When time.Time
+
+	// Peers are listed by name.
+	PeersAdded   []string `json:",omitempty"`
+	PeersRemoved []string `json:",omitempty"`
+	PeersChanged []string `json:",omitempty"` // AllowedIPs differ
+
+	RoutesAdded   []netaddr.IPPrefix `json:",omitempty"`
+	RoutesRemoved []netaddr.IPPrefix `json:",omitempty"`
+	AddrsAdded    []netaddr.IPPrefix `json:",omitempty"`
+	AddrsRemoved  []netaddr.IPPrefix `json:",omitempty"`
+
+	// FilterChanged is whether the packet filter changed, in which
+	// case FilterRules is its new number of rules.
+	FilterChanged bool `json:",omitempty"`
+	FilterRules   int  `json:",omitempty"`
+
+	DNSChanged bool `json:",omitempty"`
+
+	// Held is whether the network map was held back rather than
+	// applied, until it's released with "tailscale debug
+	// shadow-release".
+	Held bool `json:",omitempty"`
+}
+
+// IsEmpty reports whether d records no changes.
+func (d ShadowDiff) IsEmpty() bool {
+	return len(d.PeersAdded) == 0 && len(d.PeersRemoved) == 0 && len(d.PeersChanged) == 0 &&
+		len(d.RoutesAdded) == 0 && len(d.RoutesRemoved) == 0 &&
+		len(d.AddrsAdded) == 0 && len(d.AddrsRemoved) == 0 &&
+		!d.FilterChanged && !d.DNSChanged
+}
+
+func (d ShadowDiff) String() string {
+	var sb strings.Builder
+	add := func(what string, n int, v any) {
+		if n > 0 {
+			fmt.Fprintf(&sb, " %s=%v", what, v)
+		}
+	}
+	add("peers+", len(d.PeersAdded), d.PeersAdded)
+	add("peers-", len(d.PeersRemoved), d.PeersRemoved)
+	add("peers~", len(d.PeersChanged), d.PeersChanged)
+	add("routes+", len(d.RoutesAdded), d.RoutesAdded)
+	add("routes-", len(d.RoutesRemoved), d.RoutesRemoved)
+	add("addrs+", len(d.AddrsAdded), d.AddrsAdded)
+	add("addrs-", len(d.AddrsRemoved), d.AddrsRemoved)
+	if d.FilterChanged {
+		fmt.Fprintf(&sb, " filter=%d rules", d.FilterRules)
+	}
+	if d.DNSChanged {
+		sb.WriteString(" dns")
+	}
+	if d.Held {
+		sb.WriteString(" (held)")
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// UnreachableReport lists the reasons this node might fail to reach an
+// IP, as found by the LocalAPI "explain-unreachable" endpoint.
+type UnreachableReport struct {
+	IP netaddr.IP
+
+	// Peer is the node key of the peer that handles IP (directly,
+	// as a subnet router, or as the exit node in use), or the zero
+	// key if none does.
+	Peer key.NodePublic
+
+	// PeerName is the peer's name, if Peer is non-zero.
+	PeerName string `json:",omitempty"`
+
+	// Reasons are the problems found, most likely cause first:
+	// those that certainly block connectivity come before those
+	// that might. It's empty if nothing wrong was found.
+	Reasons []UnreachableReason
+}
+
+// UnreachableReason is a reason this node might fail to reach a peer.
+type UnreachableReason struct {
+	// Code identifies the check that found this problem, like
+	// "peer-key-expired". Codes don't change between releases.
+	Code string
+
+	// Blocking is whether the problem certainly prevents
+	// connectivity, rather than possibly.
+	Blocking bool `json:",omitempty"`
+
+	// Message describes the problem and, when there is one, the fix.
+	Message string
+}
+
+// ExposureReport summarizes which peers can reach this node's
+// listening ports according to its packet filter, as found by the
+// LocalAPI "exposure" endpoint.
+type ExposureReport struct {
+	// ShieldsUp is whether shields up is on, which blocks incoming
+	// connections to all of Ports.
+	ShieldsUp bool `json:",omitempty"`
+
+	// Ports are the listening ports, sorted by protocol and port.
+	Ports []PortExposure
+}
+
+// PortExposure is who can reach one of this node's listening ports.
+type PortExposure struct {
+	Proto   string // "tcp" or "udp"
+	Port    uint16
+	Process string `json:",omitempty"` // what's listening, if known
+
+	// Srcs are the packet filter's source prefixes that can reach
+	// the port. It's empty if nothing can.
+	Srcs []netaddr.IPPrefix `json:",omitempty"`
+
+	// Peers are the names of the peers in the network map that
+	// can reach the port, and Tags the ACL tags among them.
+	Peers []string `json:",omitempty"`
+	Tags  []string `json:",omitempty"`
+
+	// Broad is whether broad groups can reach the port: a source
+	// covers all Tailscale IPs, or most of the peers can reach it.
+	Broad bool `json:",omitempty"`
+}
+
+// NodeGroupMembers is a node group's members, as resolved against the
+// current network map by the LocalAPI "node-group-members" endpoint.
+type NodeGroupMembers struct {
+	Name string // of the group
+
+	// Members are the peers in the group, sorted by name.
+	Members []NodeGroupMember
+
+	// Unresolved are the group's explicit peers that aren't in the
+	// network map.
+	Unresolved []string `json:",omitempty"`
+}
+
+// NodeGroupMember is a peer in a node group.
+type NodeGroupMember struct {
+	Name         string // MagicDNS short name, or the host name if none
+	DNSName      string // MagicDNS FQDN, without the trailing dot; may be empty
+	TailscaleIPs []netaddr.IP
+	Online       bool
+}
@@ -7,6 +7,7 @@
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -17,6 +18,7 @@
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"reflect"
 	"runtime"
 	"strconv"
@@ -30,10 +32,12 @@
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/magicsock"
 )
 
 func randHex(n int) string {
@@ -52,6 +56,8 @@ func randHex(n int) string {
 	metrics   = map[string]*clientmetric.Metric{}
 )
 
+var metricStamp = clientmetric.NewCounter("localapi_stamp")
+
 func NewHandler(b *ipnlocal.LocalBackend, logf logger.Logf, logID string) *Handler {
 	return &Handler{b: b, logf: logf, backendLogID: logID}
 }
@@ -75,6 +81,10 @@ type Handler struct {
 	// cert fetching access.
 	PermitCert bool
 
+	// PermitKeys is whether the client may export or import the
+	// node's private keys, which PermitWrite doesn't imply.
+	PermitKeys bool
+
 	b            *ipnlocal.LocalBackend
 	logf         logger.Logf
 	backendLogID string
@@ -110,6 +120,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	switch r.URL.Path {
+	case "/localapi/v0/stamp":
+		h.serveStamp(w, r)
 	case "/localapi/v0/whois":
 		h.serveWhoIs(w, r)
 	case "/localapi/v0/goroutines":
@@ -124,18 +136,56 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveLoginInteractive(w, r)
 	case "/localapi/v0/prefs":
 		h.servePrefs(w, r)
+	case "/localapi/v0/prefs-transaction":
+		h.servePrefsTransaction(w, r)
 	case "/localapi/v0/ping":
 		h.servePing(w, r)
 	case "/localapi/v0/check-prefs":
 		h.serveCheckPrefs(w, r)
+	case "/localapi/v0/set-presigned-node-key":
+		h.serveSetPresignedNodeKey(w, r)
+	case "/localapi/v0/export-keys":
+		h.serveExportKeys(w, r)
+	case "/localapi/v0/import-keys":
+		h.serveImportKeys(w, r)
 	case "/localapi/v0/check-ip-forwarding":
 		h.serveCheckIPForwarding(w, r)
 	case "/localapi/v0/bugreport":
 		h.serveBugReport(w, r)
+	case "/localapi/v0/crashes":
+		h.serveCrashes(w, r)
+	case "/localapi/v0/recent-logs":
+		h.serveRecentLogs(w, r)
+	case "/localapi/v0/routes-converged":
+		h.serveRoutesConverged(w, r)
+	case "/localapi/v0/flows":
+		h.serveFlows(w, r)
+	case "/localapi/v0/shadow-diffs":
+		h.serveShadowDiffs(w, r)
+	case "/localapi/v0/loglevel":
+		h.serveLogLevel(w, r)
+	case "/localapi/v0/explain-unreachable":
+		h.serveExplainUnreachable(w, r)
+	case "/localapi/v0/exposure":
+		h.serveExposure(w, r)
+	case "/localapi/v0/node-groups":
+		h.serveNodeGroups(w, r)
+	case "/localapi/v0/node-group-members":
+		h.serveNodeGroupMembers(w, r)
+	case "/localapi/v0/pref-approvals":
+		h.servePrefApprovals(w, r)
+	case "/localapi/v0/wait-ready":
+		h.serveWaitReady(w, r)
+	case "/localapi/v0/wake-on-lan":
+		h.serveWakeOnLAN(w, r)
 	case "/localapi/v0/file-targets":
 		h.serveFileTargets(w, r)
 	case "/localapi/v0/set-dns":
 		h.serveSetDNS(w, r)
+	case "/localapi/v0/derp-regions":
+		h.serveDERPRegions(w, r)
+	case "/localapi/v0/derp-health":
+		h.serveDERPHealth(w, r)
 	case "/localapi/v0/derpmap":
 		h.serveDERPMap(w, r)
 	case "/localapi/v0/metrics":
@@ -148,6 +198,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveDial(w, r)
 	case "/localapi/v0/id-token":
 		h.serveIDToken(w, r)
+	case "/localapi/v0/node-cert":
+		h.serveNodeCert(w, r)
+	case "/localapi/v0/node-ca":
+		h.serveNodeCA(w, r)
 	case "/localapi/v0/upload-client-metrics":
 		h.serveUploadClientMetrics(w, r)
 	case "/":
@@ -212,10 +266,397 @@ func (h *Handler) serveBugReport(w http.ResponseWriter, r *http.Request) {
 	if note := r.FormValue("note"); len(note) > 0 {
 		h.logf("user bugreport note: %s", note)
 	}
+	if crashes, _ := h.b.CrashReports(); len(crashes) > 0 {
+		ids := make([]string, len(crashes))
+		for i, c := range crashes {
+			ids[i] = c.ID
+		}
+		h.logf("user bugreport crashes: %s", strings.Join(ids, ", "))
+	}
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintln(w, logMarker)
 }
 
+// serveCrashes returns the reports of crashes of previous runs of
+// tailscaled, newest first. Only callers with write access get the
+// log lines from before each crash.
+func (h *Handler) serveCrashes(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "crash report access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	reports, err := h.b.CrashReports()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !h.PermitWrite {
+		// The logs from before a crash are as sensitive as those
+		// from serveRecentLogs, so read-only callers don't get them.
+		for _, r := range reports {
+			r.RecentLogs = nil
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(reports)
+}
+
+// serveRecentLogs returns tailscaled's most recent log lines, oldest
+// first, as a JSON array.
+func (h *Handler) serveRecentLogs(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "recent logs access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.RecentLogs())
+}
+
+// serveRoutesConverged reports whether the OS routes and firewall rules
+// for the current configuration are all in place and verified, for
+// orchestration that wants to wait for the data plane before sending
+// traffic this way.
+func (h *Handler) serveRoutesConverged(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "routes-converged access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.RouteStatus())
+}
+
+// serveFlows returns the traffic of each recent flow, for "tailscale
+// top". Flow accounting runs only while this is being polled.
+func (h *Handler) serveFlows(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "flows access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.FlowStats())
+}
+
+// serveShadowDiffs returns the recent changes recorded by the
+// engine's shadow mode.
+func (h *Handler) serveShadowDiffs(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "shadow-diffs access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.ShadowDiffs())
+}
+
+// serveLogLevel returns the level of each log component for a GET,
+// and for a POST, sets the level of the "component" parameter to
+// "level", persisting it in prefs if "persist" is true.
+func (h *Handler) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "loglevel access denied", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		e.Encode(h.b.LogLevels())
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "loglevel access denied", http.StatusForbidden)
+			return
+		}
+		persist, _ := strconv.ParseBool(r.FormValue("persist"))
+		if err := h.b.SetLogLevel(r.FormValue("component"), r.FormValue("level"), persist); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// servePrefApprovals returns the pref changes waiting for approval on
+// the peer with Tailscale IP "peer" for a GET, and for a POST, approves
+// the one named by "id".
+func (h *Handler) servePrefApprovals(w http.ResponseWriter, r *http.Request) {
+	ip, err := netaddr.ParseIP(r.FormValue("peer"))
+	if err != nil {
+		http.Error(w, "invalid 'peer' parameter", 400)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "pref-approvals access denied", http.StatusForbidden)
+			return
+		}
+		pas, err := h.b.PrefApprovals(r.Context(), ip)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		e.Encode(pas)
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "pref-approvals access denied", http.StatusForbidden)
+			return
+		}
+		if err := h.b.ApprovePrefChange(r.Context(), ip, r.FormValue("id"), r.FormValue("digest")); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveWaitReady blocks until the node is ready for "for" (one of
+// peers, routes or exitnode), or "timeout" passes, if given.
+func (h *Handler) serveWaitReady(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "wait-ready access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	ctx := r.Context()
+	if v := r.FormValue("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid 'timeout' parameter", 400)
+			return
+		}
+		if d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+	}
+	if err := h.b.WaitReady(ctx, r.FormValue("for")); err != nil {
+		code := http.StatusPreconditionFailed
+		if ctx.Err() != nil {
+			code = http.StatusGatewayTimeout
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	io.WriteString(w, "ready\n")
+}
+
+// serveWakeOnLAN asks the peer with Tailscale IP "peer" to send a
+// Wake-on-LAN packet for "mac" on its local networks.
+func (h *Handler) serveWakeOnLAN(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "wake-on-lan access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("peer"))
+	if err != nil {
+		http.Error(w, "invalid 'peer' parameter", 400)
+		return
+	}
+	mac, err := net.ParseMAC(r.FormValue("mac"))
+	if err != nil {
+		http.Error(w, "invalid 'mac' parameter", 400)
+		return
+	}
+	res, err := h.b.WakeOnLAN(r.Context(), ip, mac)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) serveExplainUnreachable(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "explain-unreachable access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid 'ip' parameter", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.ExplainUnreachable(ip))
+}
+
+func (h *Handler) serveExposure(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "exposure access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.Exposure())
+}
+
+// serveNodeGroups lists (GET), defines (POST, with a JSON ipn.NodeGroup
+// body) or deletes (DELETE, with a "name" parameter) node groups.
+func (h *Handler) serveNodeGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "node-groups access denied", http.StatusForbidden)
+			return
+		}
+		gs, err := h.b.NodeGroups()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		e.Encode(gs)
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "node-groups access denied", http.StatusForbidden)
+			return
+		}
+		var g ipn.NodeGroup
+		if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := g.Check(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := h.b.SetNodeGroup(g); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if !h.PermitWrite {
+			http.Error(w, "node-groups access denied", http.StatusForbidden)
+			return
+		}
+		err := h.b.DeleteNodeGroup(r.FormValue("name"))
+		if errors.Is(err, ipnlocal.ErrNodeGroupNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) serveNodeGroupMembers(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "node-group-members access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	res, err := h.b.NodeGroupMembers(r.FormValue("name"))
+	if errors.Is(err, ipnlocal.ErrNodeGroupNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(res)
+}
+
+// serveStamp writes a user-supplied marker to the logs and bumps the
+// localapi_stamp client metric, so a user reproducing a problem can point
+// support at the moment it happened.
+//
+// The marker is uploaded to logtail along with the rest of the logs,
+// unless the "upload" form value is "false", in which case it's only
+// written to tailscaled's local stderr log.
+func (h *Handler) serveStamp(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "stamp access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+
+	marker := fmt.Sprintf("STAMP-%v-%v", time.Now().UTC().Format("20060102150405Z"), randHex(4))
+	line := "user stamp: " + marker
+	if note := r.FormValue("note"); note != "" {
+		line += " " + strconv.Quote(note)
+	}
+	if r.FormValue("upload") != "false" {
+		h.logf("%s", line)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s\n", line)
+	}
+	metricStamp.Add(1)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, marker)
+}
+
 func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "whois access denied", http.StatusForbidden)
@@ -293,6 +734,20 @@ func (h *Handler) serveDebug(w http.ResponseWriter, r *http.Request) {
 		err = h.b.DebugRebind()
 	case "restun":
 		err = h.b.DebugReSTUN()
+	case "cpu":
+		err = h.serveDebugCPU(r)
+	case "impair":
+		err = h.serveDebugImpair(r)
+	case "derp-switch":
+		var region int
+		region, err = strconv.Atoi(r.FormValue("region"))
+		if err != nil {
+			err = fmt.Errorf("invalid 'region' parameter: %w", err)
+			break
+		}
+		err = h.b.DebugForceDERPHome(region)
+	case "shadow-release":
+		err = h.b.ReleaseShadowHold()
 	case "":
 		err = fmt.Errorf("missing parameter 'action'")
 	default:
@@ -306,6 +761,69 @@ func (h *Handler) serveDebug(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "done\n")
 }
 
+// serveDebugImpair handles the "impair" debug action, which impairs
+// packets to and from "peer" (or all peers, if empty) with the given
+// "loss" (a fraction), "latency" and "jitter" (durations), and "seed".
+// With none of those, it removes the peer's impairment.
+func (h *Handler) serveDebugImpair(r *http.Request) error {
+	var peer netaddr.IP
+	if v := r.FormValue("peer"); v != "" {
+		var err error
+		if peer, err = netaddr.ParseIP(v); err != nil {
+			return fmt.Errorf("invalid 'peer' parameter: %w", err)
+		}
+	}
+	var im tstun.Impairment
+	var err error
+	if v := r.FormValue("loss"); v != "" {
+		if im.Loss, err = strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("invalid 'loss' parameter: %w", err)
+		}
+	}
+	if v := r.FormValue("latency"); v != "" {
+		if im.Latency, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid 'latency' parameter: %w", err)
+		}
+	}
+	if v := r.FormValue("jitter"); v != "" {
+		if im.Jitter, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid 'jitter' parameter: %w", err)
+		}
+	}
+	if v := r.FormValue("seed"); v != "" {
+		if im.Seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("invalid 'seed' parameter: %w", err)
+		}
+	}
+	return h.b.DebugImpair(peer, im)
+}
+
+// serveDebugCPU handles the "cpu" debug action, whose optional
+// "affinity" (a CPU list such as "0-3,6") and "gomaxprocs" parameters
+// tune how the crypto pipeline is scheduled.
+func (h *Handler) serveDebugCPU(r *http.Request) error {
+	var cpus []int
+	if v := r.FormValue("affinity"); v != "" {
+		var err error
+		cpus, err = magicsock.ParseCPUList(v)
+		if err != nil {
+			return err
+		}
+	}
+	var maxProcs int
+	if v := r.FormValue("gomaxprocs"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid gomaxprocs %q", v)
+		}
+		maxProcs = n
+	}
+	if cpus == nil && maxProcs == 0 {
+		return errors.New("one of 'affinity' or 'gomaxprocs' is required")
+	}
+	return h.b.DebugSetCPU(cpus, maxProcs)
+}
+
 // serveProfileFunc is the implementation of Handler.serveProfile, after auth,
 // for platforms where we want to link it in.
 var serveProfileFunc func(http.ResponseWriter, *http.Request)
@@ -409,9 +927,7 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 		var err error
 		prefs, err = h.b.EditPrefs(mp)
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(resJSON{Error: err.Error()})
+			writePrefsError(w, err)
 			return
 		}
 	case "GET", "HEAD":
@@ -428,6 +944,114 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 
 type resJSON struct {
 	Error string `json:",omitempty"`
+
+	// Validation, if non-empty, lists the prefs fields that failed
+	// validation. It's only set by the prefs endpoints.
+	Validation []ipn.PrefsFieldError `json:",omitempty"`
+}
+
+// writePrefsError writes err from editing prefs to w as a 400 resJSON.
+func writePrefsError(w http.ResponseWriter, err error) {
+	res := resJSON{Error: err.Error()}
+	var ve *ipn.PrefsValidationError
+	if errors.As(err, &ve) {
+		res.Validation = ve.Errors
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(res)
+}
+
+// servePrefsTransaction applies an ipn.PrefsTransaction, writing the
+// resulting prefs on success.
+func (h *Handler) servePrefsTransaction(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "prefs write access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	tx := new(ipn.PrefsTransaction)
+	if err := json.NewDecoder(r.Body).Decode(tx); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	prefs, err := h.b.EditPrefsTransaction(tx)
+	if err != nil {
+		writePrefsError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(prefs)
+}
+
+func (h *Handler) serveSetPresignedNodeKey(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "presigned node key access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	var pk apitype.PresignedNodeKey
+	if err := json.NewDecoder(r.Body).Decode(&pk); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+	if err := h.b.SetPresignedNodeKey(pk.NodeKey, pk.Signature); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveExportKeys(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitKeys {
+		http.Error(w, "export-keys access denied; requires root or an administrator", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	var req apitype.KeyBackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+	sealed, err := h.b.ExportKeys([]byte(req.Passphrase))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(sealed)
+}
+
+func (h *Handler) serveImportKeys(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitKeys {
+		http.Error(w, "import-keys access denied; requires root or an administrator", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	var req apitype.KeyBackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+	if err := h.b.ImportKeys(req.Sealed, []byte(req.Passphrase)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *Handler) serveCheckPrefs(w http.ResponseWriter, r *http.Request) {
@@ -627,6 +1251,46 @@ func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	e.Encode(h.b.DERPMap())
 }
 
+// serveDERPRegions returns the state of the connection to each DERP
+// region, as a JSON array of ipnstate.DERPRegionStatus.
+func (h *Handler) serveDERPRegions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	regions, err := h.b.DERPRegionStatus()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(regions)
+}
+
+// serveDERPHealth returns the latency and availability history of each
+// DERP region, as a JSON array of ipnstate.DERPRegionHealth.
+func (h *Handler) serveDERPHealth(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "derp-health access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	regions, err := h.b.DERPHealth()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(regions)
+}
+
 // serveSetExpirySooner sets the expiry date on the current machine, specified
 // by an `expiry` unix timestamp as POST or query param.
 func (h *Handler) serveSetExpirySooner(w http.ResponseWriter, r *http.Request) {
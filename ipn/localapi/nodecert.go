@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"net/http"
+)
+
+// serveNodeCert returns the node's identity cert for mutual TLS
+// within the tailnet, as the PEM private key followed by the PEM
+// cert chain.
+func (h *Handler) serveNodeCert(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite && !h.PermitCert {
+		http.Error(w, "cert access denied", http.StatusForbidden)
+		return
+	}
+	certPEM, keyPEM, err := h.b.NodeCertPair(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(keyPEM)
+	w.Write(certPEM)
+}
+
+// serveNodeCA returns the PEM roots of the tailnet's CA for node
+// identity certs.
+func (h *Handler) serveNodeCA(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "node-ca access denied", http.StatusForbidden)
+		return
+	}
+	roots, err := h.b.NodeCARoots()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(roots)
+}
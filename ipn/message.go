@@ -13,11 +13,15 @@
 	"fmt"
 	"io"
 	"log"
+	"sync"
+	"time"
 
 	"tailscale.com/envknob"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/empty"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/structs"
+	"tailscale.com/types/usermsg"
 	"tailscale.com/version"
 )
 
@@ -39,6 +43,27 @@ func ReadonlyContextOf(ctx context.Context) context.Context {
 	return context.WithValue(ctx, readOnlyContextKey{}, readOnlyContextKey{})
 }
 
+type replyContextKey struct{}
+
+// ReplyContextOf returns ctx wrapped with a context value holding
+// reply, a func that sends a Notify to only the frontend whose
+// command is being handled, rather than to all connected frontends.
+// It's used by commands like Resume whose responses are of no
+// interest to other frontends.
+//
+// reply must not be called concurrently with the BackendServer's
+// notification callback for the same connection; BackendServer
+// guarantees this when it's the only caller of both.
+func ReplyContextOf(ctx context.Context, reply func(Notify)) context.Context {
+	return context.WithValue(ctx, replyContextKey{}, reply)
+}
+
+// replyFuncOf returns the reply func set by ReplyContextOf, if any.
+func replyFuncOf(ctx context.Context) func(Notify) {
+	f, _ := ctx.Value(replyContextKey{}).(func(Notify))
+	return f
+}
+
 var jsonEscapedZero = []byte(`\u0000`)
 
 type NoArgs struct{}
@@ -51,6 +76,22 @@ type SetPrefsArgs struct {
 	New *Prefs
 }
 
+// ResumeArgs are the arguments to the Resume command.
+//
+// Frontends reconnecting to the backend should send Resume as their
+// first command. The backend responds, to only that frontend, with
+// either the notifications sent since LastSeq, in order, or (if those
+// are no longer available) a single Notify with Resync set. Because
+// the connection receives new notifications as soon as it's
+// established, some replayed notifications may already have been
+// seen; frontends should ignore non-Resync notifications whose Seq is
+// not larger than the last one they processed.
+type ResumeArgs struct {
+	// LastSeq is the Notify.Seq of the last notification the
+	// frontend processed, typically on a previous connection.
+	LastSeq uint64
+}
+
 // Command is a command message that is JSON encoded and sent by a
 // frontend to a backend.
 type Command struct {
@@ -73,13 +114,25 @@ type Command struct {
 	SetPrefs              *SetPrefsArgs
 	RequestEngineStatus   *NoArgs
 	RequestStatus         *NoArgs
+	Resume                *ResumeArgs
 }
 
+// notifyReplayLen is the number of recent notifications a
+// BackendServer retains for replay to resuming frontends.
+const notifyReplayLen = 32
+
 type BackendServer struct {
 	logf          logger.Logf
 	b             Backend      // the Backend we are serving up
 	sendNotifyMsg func(Notify) // send a notification message
 	GotQuit       bool         // a Quit command was received
+
+	// mu guards the following fields. It's also held while calling
+	// sendNotifyMsg so notifications are delivered in Seq order.
+	mu      sync.Mutex
+	seq     uint64   // Seq of the most recently sent Notify
+	recent  []Notify // up to notifyReplayLen most recent, oldest first
+	current Notify   // accumulated state fields of all sent notifications
 }
 
 // NewBackendServer creates a new BackendServer using b.
@@ -92,6 +145,7 @@ func NewBackendServer(logf logger.Logf, b Backend, sendNotifyMsg func(Notify)) *
 		logf:          logf,
 		b:             b,
 		sendNotifyMsg: sendNotifyMsg,
+		seq:           uint64(time.Now().UnixMicro()),
 	}
 	// b may be nil if the BackendServer is being created just to
 	// encapsulate and send an error message.
@@ -106,22 +160,118 @@ func (bs *BackendServer) send(n Notify) {
 		return
 	}
 	n.Version = ipcVersion
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.seq++
+	n.Seq = bs.seq
+	bs.noteSentLocked(n)
 	bs.sendNotifyMsg(n)
 }
 
+// noteSentLocked records n for later replay and merges its state
+// fields into bs.current.
+//
+// bs.mu must be held.
+func (bs *BackendServer) noteSentLocked(n Notify) {
+	if len(bs.recent) == notifyReplayLen {
+		copy(bs.recent, bs.recent[1:])
+		bs.recent = bs.recent[:len(bs.recent)-1]
+	}
+	bs.recent = append(bs.recent, n)
+
+	// Only fields describing ongoing state belong in a resync;
+	// one-shot events like LoginFinished, BrowseToURL, or
+	// ErrMessage don't.
+	c := &bs.current
+	if n.State != nil {
+		c.State = n.State
+	}
+	if n.Prefs != nil {
+		c.Prefs = n.Prefs
+	}
+	if n.NetMap != nil {
+		c.NetMap = n.NetMap
+	}
+	if n.Engine != nil {
+		c.Engine = n.Engine
+	}
+	if n.BackendLogID != nil {
+		c.BackendLogID = n.BackendLogID
+	}
+	if n.IncomingFiles != nil {
+		c.IncomingFiles = n.IncomingFiles
+	}
+	if n.LocalTCPPort != nil {
+		c.LocalTCPPort = n.LocalTCPPort
+	}
+	c.FilesWaiting = n.FilesWaiting
+}
+
+// SendKeepAlive sends all frontends a notification with no fields
+// other than Version and the Seq of the most recently sent
+// notification. It lets frontends detect both dead connections and
+// missed notifications while the backend is otherwise idle.
+func (bs *BackendServer) SendKeepAlive() {
+	if bs.sendNotifyMsg == nil {
+		return
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.sendNotifyMsg(Notify{Version: ipcVersion, Seq: bs.seq})
+}
+
+// resume handles a Resume command, sending the notifications after
+// lastSeq to reply, or a full resync if they're no longer retained.
+func (bs *BackendServer) resume(lastSeq uint64, reply func(Notify)) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if lastSeq == bs.seq {
+		// Nothing missed.
+		return
+	}
+	if lastSeq < bs.seq && len(bs.recent) > 0 && bs.recent[0].Seq <= lastSeq+1 {
+		for _, n := range bs.recent {
+			if n.Seq > lastSeq {
+				reply(n)
+			}
+		}
+		return
+	}
+	bs.logf("resume from seq %v not possible (now %v); sending resync", lastSeq, bs.seq)
+	n := bs.current
+	n.Version = ipcVersion
+	n.Seq = bs.seq
+	n.Resync = new(empty.Message)
+	reply(n)
+}
+
 func (bs *BackendServer) SendErrorMessage(msg string) {
-	bs.send(Notify{ErrMessage: &msg})
+	bs.send(errNotify(usermsg.New(usermsg.Text, "text", msg)))
+}
+
+// SendError sends a Notify message to the client with err as its
+// ErrMessage and, if err carries one, its usermsg.Message.
+func (bs *BackendServer) SendError(err error) {
+	bs.send(errNotify(usermsg.FromError(err)))
 }
 
-// SendInUseOtherUserErrorMessage sends a Notify message to the client that
+// SendInUseOtherUserError sends a Notify message to the client that
 // both sets the state to 'InUseOtherUser' and sets the associated reason
-// to msg.
-func (bs *BackendServer) SendInUseOtherUserErrorMessage(msg string) {
+// to err.
+func (bs *BackendServer) SendInUseOtherUserError(err error) {
 	inUse := InUseOtherUser
-	bs.send(Notify{
-		State:      &inUse,
-		ErrMessage: &msg,
-	})
+	n := errNotify(usermsg.FromError(err))
+	n.State = &inUse
+	bs.send(n)
+}
+
+// errNotify returns a Notify with m as its Message and m's English text
+// as its ErrMessage.
+func errNotify(m usermsg.Message) Notify {
+	s := m.String()
+	return Notify{ErrMessage: &s, Message: &m}
 }
 
 // GotCommandMsg parses the incoming message b as a JSON Command and
@@ -150,8 +300,11 @@ func (bs *BackendServer) GotCommand(ctx context.Context, cmd *Command) error {
 		// caller so it can realize the version mismatch too.
 		// We don't want to exit because it might cause a crash
 		// loop, and restarting won't fix the problem.
+		m := usermsg.New(usermsg.VersionMismatch,
+			"frontend", cmd.Version, "backend", ipcVersion)
 		bs.send(Notify{
 			ErrMessage: &vs,
+			Message:    &m,
 		})
 		return nil
 	}
@@ -165,10 +318,21 @@ func (bs *BackendServer) GotCommand(ctx context.Context, cmd *Command) error {
 		bs.b.RequestEngineStatus()
 		return nil
 	}
+	if c := cmd.Resume; c != nil {
+		// Read-only frontends already receive every notification,
+		// so replaying them reveals nothing new.
+		reply := replyFuncOf(ctx)
+		if reply == nil {
+			reply = bs.sendNotifyMsg
+		}
+		if reply != nil {
+			bs.resume(c.LastSeq, reply)
+		}
+		return nil
+	}
 
 	if IsReadonlyContext(ctx) {
-		msg := ErrMsgPermissionDenied
-		bs.send(Notify{ErrMessage: &msg})
+		bs.send(errNotify(usermsg.New(usermsg.PermissionDenied)))
 		return nil
 	}
 
@@ -198,6 +362,7 @@ type BackendClient struct {
 	logf           logger.Logf
 	sendCommandMsg func(jsonb []byte)
 	notify         func(Notify)
+	lastSeq        uint64 // Seq of the last notification received
 
 	// AllowVersionSkew controls whether to allow mismatched
 	// frontend & backend versions.
@@ -242,16 +407,31 @@ func (bc *BackendClient) GotNotifyMsg(b []byte) {
 		bc.logf("%s", vs)
 		// delete anything in the notification except the version,
 		// to prevent incorrect operation.
+		m := usermsg.New(usermsg.VersionMismatch,
+			"frontend", ipcVersion, "backend", n.Version)
 		n = Notify{
 			Version:    n.Version,
 			ErrMessage: &vs,
+			Message:    &m,
 		}
 	}
+	if n.Seq != 0 {
+		bc.lastSeq = n.Seq
+	}
 	if bc.notify != nil {
 		bc.notify(n)
 	}
 }
 
+// LastSeq returns the Seq of the most recent notification passed to
+// GotNotifyMsg, or zero if none has been. It's meant to be saved and
+// passed to Resume after reconnecting to the backend.
+//
+// It must not be called concurrently with GotNotifyMsg.
+func (bc *BackendClient) LastSeq() uint64 {
+	return bc.lastSeq
+}
+
 func (bc *BackendClient) send(cmd Command) {
 	cmd.Version = ipcVersion
 	b, err := json.Marshal(cmd)
@@ -302,6 +482,13 @@ func (bc *BackendClient) RequestStatus() {
 	bc.send(Command{AllowVersionSkew: true, RequestStatus: &NoArgs{}})
 }
 
+// Resume asks the backend to resend the notifications sent after the
+// one with the provided Seq, or a full resync if they're unavailable.
+// See ResumeArgs.
+func (bc *BackendClient) Resume(lastSeq uint64) {
+	bc.send(Command{Resume: &ResumeArgs{LastSeq: lastSeq}})
+}
+
 // MaxMessageSize is the maximum message size, in bytes.
 const MaxMessageSize = 10 << 20
 
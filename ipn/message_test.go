@@ -13,6 +13,7 @@
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
+	"tailscale.com/types/empty"
 )
 
 func TestReadWrite(t *testing.T) {
@@ -200,4 +201,80 @@ func TestNilBackend(t *testing.T) {
 	if called.ErrMessage == nil || *called.ErrMessage != "Danger, Will Robinson!" {
 		t.Errorf("callback got wrong error: %v", called.ErrMessage)
 	}
+	if called.Message == nil || called.Message.String() != "Danger, Will Robinson!" {
+		t.Errorf("callback got wrong message: %v", called.Message)
+	}
+}
+
+func TestBackendServerResume(t *testing.T) {
+	var broadcast []Notify
+	bs := NewBackendServer(t.Logf, nil, func(n Notify) {
+		broadcast = append(broadcast, n)
+	})
+	var replies []Notify
+	ctx := ReplyContextOf(context.Background(), func(n Notify) {
+		replies = append(replies, n)
+	})
+	resume := func(lastSeq uint64) []Notify {
+		t.Helper()
+		replies = nil
+		if err := bs.GotCommand(ctx, &Command{Version: ipcVersion, Resume: &ResumeArgs{LastSeq: lastSeq}}); err != nil {
+			t.Fatal(err)
+		}
+		return replies
+	}
+
+	running := Running
+	bs.send(Notify{State: &running})
+	bs.send(Notify{Prefs: &Prefs{Hostname: "foo"}})
+	bs.send(Notify{LoginFinished: new(empty.Message)})
+	if len(broadcast) != 3 {
+		t.Fatalf("sent %d notifications; want 3", len(broadcast))
+	}
+	for i := 1; i < len(broadcast); i++ {
+		if broadcast[i].Seq != broadcast[i-1].Seq+1 {
+			t.Errorf("Seq[%d] = %v; want %v", i, broadcast[i].Seq, broadcast[i-1].Seq+1)
+		}
+	}
+	first, last := broadcast[0].Seq, broadcast[2].Seq
+
+	if got := resume(last); len(got) != 0 {
+		t.Errorf("resume from last: got %d replies; want none", len(got))
+	}
+	if got := resume(first); len(got) != 2 || got[0].Seq != first+1 || got[1].LoginFinished == nil {
+		t.Errorf("resume from first: got %v; want last two notifications", got)
+	}
+	if len(broadcast) != 3 {
+		t.Errorf("resume replies were broadcast")
+	}
+
+	// Resuming from before anything retained, or from a seq the
+	// backend hasn't reached (a previous process), gets a resync.
+	for _, from := range []uint64{first - 10, last + 10} {
+		got := resume(from)
+		if len(got) != 1 || got[0].Resync == nil {
+			t.Fatalf("resume from %v: got %v; want one resync", from, got)
+		}
+		n := got[0]
+		if n.Seq != last || n.State == nil || *n.State != Running || n.Prefs == nil || n.Prefs.Hostname != "foo" {
+			t.Errorf("resume from %v: unexpected resync %v", from, n)
+		}
+		if n.LoginFinished != nil {
+			t.Errorf("resume from %v: resync includes LoginFinished event", from)
+		}
+	}
+
+	// Overflow the replay buffer.
+	for i := 0; i < notifyReplayLen; i++ {
+		bs.send(Notify{Engine: &EngineStatus{NumLive: i}})
+	}
+	if got := resume(first); len(got) != 1 || got[0].Resync == nil {
+		t.Errorf("resume after overflow: got %v; want one resync", got)
+	}
+
+	bs.SendKeepAlive()
+	ka := broadcast[len(broadcast)-1]
+	if ka.Seq != last+notifyReplayLen || ka.Engine != nil {
+		t.Errorf("keep-alive = %v; want empty with seq %v", ka, last+notifyReplayLen)
+	}
 }
@@ -0,0 +1,81 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// NodeGroupsStateKey is the key under which the locally defined node
+// groups are stored, as a JSON array of NodeGroup.
+const NodeGroupsStateKey = StateKey("_node-groups")
+
+// NodeGroup is a locally defined, named group of peers, which CLI
+// commands accept as "@name" in place of a single peer.
+//
+// A peer is a member if it matches any of Tags, Names or Peers. The
+// members are resolved against the current network map each time the
+// group is used, so they follow peers as they come, go and are
+// retagged.
+type NodeGroup struct {
+	// Name is the group's name, used as "@Name".
+	Name string
+
+	// Tags are ACL tags, such as "tag:ci"; peers with any of them
+	// are members.
+	Tags []string `json:",omitempty"`
+
+	// Names are glob patterns, in path.Match syntax, matched against
+	// peers' MagicDNS names, such as "build-*". A pattern without a
+	// dot matches the short name; one with a dot, the full name.
+	Names []string `json:",omitempty"`
+
+	// Peers are explicit members, by MagicDNS name or Tailscale IP.
+	Peers []string `json:",omitempty"`
+}
+
+// CheckNodeGroupName returns an error if name can't be the name of a
+// NodeGroup. Names are letters, digits, '-' and '_', so "@name" is
+// never taken for a host or a flag.
+func CheckNodeGroupName(name string) error {
+	if name == "" {
+		return errors.New("node group name is empty")
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid node group name %q: only letters, digits, '-' and '_' are allowed", name)
+		}
+	}
+	return nil
+}
+
+// Check returns an error if g is invalid.
+func (g *NodeGroup) Check() error {
+	if err := CheckNodeGroupName(g.Name); err != nil {
+		return err
+	}
+	if len(g.Tags) == 0 && len(g.Names) == 0 && len(g.Peers) == 0 {
+		return fmt.Errorf("node group %q has no tags, names or peers", g.Name)
+	}
+	for _, tag := range g.Tags {
+		if !strings.HasPrefix(tag, "tag:") || tag == "tag:" {
+			return fmt.Errorf("node group %q: tag %q must start with \"tag:\"", g.Name, tag)
+		}
+	}
+	for _, pat := range g.Names {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("node group %q: invalid name pattern %q", g.Name, pat)
+		}
+	}
+	for _, p := range g.Peers {
+		if p == "" {
+			return fmt.Errorf("node group %q has an empty peer", g.Name)
+		}
+	}
+	return nil
+}
@@ -16,10 +16,12 @@
 	"reflect"
 	"runtime"
 	"strings"
+	"time"
 
 	"inet.af/netaddr"
 	"tailscale.com/atomicfile"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/trustednet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
@@ -34,6 +36,10 @@
 // The default control plane is the hosted version run by Tailscale.com.
 const DefaultControlURL = "https://controlplane.tailscale.com"
 
+// MinNodeKeyRotation is the shortest Prefs.NodeKeyRotation interval
+// allowed. Each rotation makes every peer re-handshake with the node.
+const MinNodeKeyRotation = time.Hour
+
 var (
 	// ErrExitNodeIDAlreadySet is returned from (*Prefs).SetExitNodeIP when the
 	// Prefs.ExitNodeID field is already set.
@@ -189,6 +195,49 @@ type Prefs struct {
 	// operate tailscaled without being root or using sudo.
 	OperatorUser string `json:",omitempty"`
 
+	// Telemetry is how much telemetry (logs, client metrics and
+	// crash reports) the node uploads to Tailscale. tailscaled's
+	// --no-logs-no-support flag can restrict it further, but not
+	// raise it.
+	Telemetry preftype.TelemetryLevel `json:",omitempty"`
+
+	// TrustedNetworks lists networks, identified by a Wi-Fi SSID
+	// ("ssid:Office"), DNS search domain ("dns:corp.example.com") or
+	// default gateway MAC address ("gateway:00:11:22:33:44:55"), on
+	// which the node doesn't route traffic through its exit node.
+	TrustedNetworks []string `json:",omitempty"`
+
+	// TrustedNetworksIdle specifies that on a network listed in
+	// TrustedNetworks, the node goes idle, routing no traffic over
+	// Tailscale at all, rather than just not using its exit node.
+	TrustedNetworksIdle bool `json:",omitempty"`
+
+	// StaticDNSRecords are A and AAAA records, configured on this node
+	// with "tailscale dns", that MagicDNS answers with in preference to
+	// anything else: peers' MagicDNS names, records from control, and
+	// upstream resolvers. Like an /etc/hosts file, a name listed here
+	// only resolves to the records listed for it.
+	StaticDNSRecords []tailcfg.DNSRecord `json:",omitempty"`
+
+	// NodeKeyRotation, if non-zero, is how often the node
+	// proactively rotates its node key, rather than only when the key
+	// expires. Rotations are non-interactive, but the node switches to
+	// the new key at once, so its connections to peers stall until
+	// they get the new key from control and re-handshake.
+	NodeKeyRotation time.Duration `json:",omitempty"`
+
+	// LogoutAt, if non-nil, is when the node automatically logs out,
+	// as set by "tailscale up --duration". It's for kiosks and
+	// temporary access that must end on time even if the machine was
+	// off or tailscaled restarted meanwhile.
+	LogoutAt *time.Time `json:",omitempty"`
+
+	// LogLevels are the levels ("info", "debug" or "trace") of named
+	// log components, as set with "tailscale debug loglevel
+	// --persist", that tailscaled applies on start. Components not
+	// listed stay at their default level.
+	LogLevels map[string]string `json:",omitempty"`
+
 	// The Persist field is named 'Config' in the file for backward
 	// compatibility with earlier versions.
 	// TODO(apenwarr): We should move this out of here, it's not a pref.
@@ -220,6 +269,13 @@ type MaskedPrefs struct {
 	NoSNATSet                 bool `json:",omitempty"`
 	NetfilterModeSet          bool `json:",omitempty"`
 	OperatorUserSet           bool `json:",omitempty"`
+	TelemetrySet              bool `json:",omitempty"`
+	TrustedNetworksSet        bool `json:",omitempty"`
+	TrustedNetworksIdleSet    bool `json:",omitempty"`
+	StaticDNSRecordsSet       bool `json:",omitempty"`
+	NodeKeyRotationSet        bool `json:",omitempty"`
+	LogoutAtSet               bool `json:",omitempty"`
+	LogLevelsSet              bool `json:",omitempty"`
 }
 
 // ApplyEdits mutates p, assigning fields from m.Prefs for each MaskedPrefs
@@ -334,6 +390,27 @@ func (p *Prefs) pretty(goos string) string {
 	if p.OperatorUser != "" {
 		fmt.Fprintf(&sb, "op=%q ", p.OperatorUser)
 	}
+	if p.Telemetry != preftype.TelemetryFull {
+		fmt.Fprintf(&sb, "telemetry=%v ", p.Telemetry)
+	}
+	if len(p.TrustedNetworks) > 0 {
+		fmt.Fprintf(&sb, "trusted=%q ", p.TrustedNetworks)
+		if p.TrustedNetworksIdle {
+			sb.WriteString("trusted-idle ")
+		}
+	}
+	if len(p.StaticDNSRecords) > 0 {
+		fmt.Fprintf(&sb, "dnsrecords=%d ", len(p.StaticDNSRecords))
+	}
+	if p.NodeKeyRotation != 0 {
+		fmt.Fprintf(&sb, "keyrotation=%v ", p.NodeKeyRotation)
+	}
+	if p.LogoutAt != nil {
+		fmt.Fprintf(&sb, "logout-at=%v ", p.LogoutAt.UTC().Format(time.RFC3339))
+	}
+	if len(p.LogLevels) > 0 {
+		fmt.Fprintf(&sb, "loglevels=%v ", p.LogLevels)
+	}
 	if p.Persist != nil {
 		sb.WriteString(p.Persist.Pretty())
 	} else {
@@ -375,10 +452,17 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.NoSNAT == p2.NoSNAT &&
 		p.NetfilterMode == p2.NetfilterMode &&
 		p.OperatorUser == p2.OperatorUser &&
+		p.Telemetry == p2.Telemetry &&
+		p.TrustedNetworksIdle == p2.TrustedNetworksIdle &&
+		p.NodeKeyRotation == p2.NodeKeyRotation &&
+		compareTimePtrs(p.LogoutAt, p2.LogoutAt) &&
+		compareStringMaps(p.LogLevels, p2.LogLevels) &&
 		p.Hostname == p2.Hostname &&
 		p.ForceDaemon == p2.ForceDaemon &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
+		compareStrings(p.TrustedNetworks, p2.TrustedNetworks) &&
+		compareDNSRecords(p.StaticDNSRecords, p2.StaticDNSRecords) &&
 		p.Persist.Equals(p2.Persist)
 }
 
@@ -394,6 +478,25 @@ func compareIPNets(a, b []netaddr.IPPrefix) bool {
 	return true
 }
 
+func compareTimePtrs(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func compareStringMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if v2, ok := b[k]; !ok || v != v2 {
+			return false
+		}
+	}
+	return true
+}
+
 func compareStrings(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -406,6 +509,18 @@ func compareStrings(a, b []string) bool {
 	return true
 }
 
+func compareDNSRecords(a, b []tailcfg.DNSRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // NewPrefs returns the default preferences to use.
 func NewPrefs() *Prefs {
 	// Provide default values for options which might be missing
@@ -460,6 +575,119 @@ func (p *Prefs) AdvertisesExitNode() bool {
 	return tsaddr.ContainsExitRoutes(p.AdvertiseRoutes)
 }
 
+// PrefsFieldError describes a problem with the value of one Prefs field,
+// often in combination with others.
+type PrefsFieldError struct {
+	Field   string // Prefs field name, such as "ExitNodeID"
+	Message string
+}
+
+// PrefsValidationError is returned by Prefs.Validate, and by
+// LocalBackend.EditPrefs and EditPrefsTransaction when the edits would
+// leave prefs in an invalid state.
+type PrefsValidationError struct {
+	Errors []PrefsFieldError
+}
+
+func (e *PrefsValidationError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("invalid prefs: ")
+	for i, fe := range e.Errors {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "%s: %s", fe.Field, fe.Message)
+	}
+	return sb.String()
+}
+
+// Validate reports whether the fields of p are consistent with each
+// other. If not, it returns a *PrefsValidationError listing every
+// problem found.
+func (p *Prefs) Validate() error {
+	var errs []PrefsFieldError
+	add := func(field, format string, a ...any) {
+		errs = append(errs, PrefsFieldError{Field: field, Message: fmt.Sprintf(format, a...)})
+	}
+	var v4Default, v6Default bool
+	for _, r := range p.AdvertiseRoutes {
+		switch {
+		case !r.IsValid():
+			add("AdvertiseRoutes", "invalid route %v", r)
+		case r != r.Masked():
+			add("AdvertiseRoutes", "%s has non-address bits set; expected %s", r, r.Masked())
+		case r.Bits() == 0 && r.IP().Is4():
+			v4Default = true
+		case r.Bits() == 0 && r.IP().Is6():
+			v6Default = true
+		}
+	}
+	if v4Default != v6Default {
+		add("AdvertiseRoutes", "exit node routes must include both 0.0.0.0/0 and ::/0")
+	}
+	if v4Default && v6Default {
+		if !p.ExitNodeID.IsZero() {
+			add("ExitNodeID", "can't use an exit node while advertising as an exit node")
+		} else if !p.ExitNodeIP.IsZero() {
+			add("ExitNodeIP", "can't use an exit node while advertising as an exit node")
+		}
+	}
+	if len(p.Hostname) > 256 {
+		add("Hostname", "too long: %d bytes (max 256)", len(p.Hostname))
+	}
+	for _, r := range p.TrustedNetworks {
+		if err := trustednet.ParseRule(r); err != nil {
+			add("TrustedNetworks", "%v", err)
+		}
+	}
+	for _, rec := range p.StaticDNSRecords {
+		if err := ValidateStaticDNSRecord(rec); err != nil {
+			add("StaticDNSRecords", "%v", err)
+		}
+	}
+	if p.NodeKeyRotation < 0 || (p.NodeKeyRotation > 0 && p.NodeKeyRotation < MinNodeKeyRotation) {
+		add("NodeKeyRotation", "interval %v is less than the minimum of %v", p.NodeKeyRotation, MinNodeKeyRotation)
+	}
+	if len(errs) > 0 {
+		return &PrefsValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// ValidateStaticDNSRecord reports whether rec can be used in
+// Prefs.StaticDNSRecords: an A or AAAA record (or an untyped one, whose
+// type is inferred from its value) for a valid DNS name.
+func ValidateStaticDNSRecord(rec tailcfg.DNSRecord) error {
+	if _, err := dnsname.ToFQDN(rec.Name); err != nil || rec.Name == "" || rec.Name == "." {
+		return fmt.Errorf("invalid DNS name %q", rec.Name)
+	}
+	ip, err := netaddr.ParseIP(rec.Value)
+	if err != nil {
+		return fmt.Errorf("%s: invalid IP address %q", rec.Name, rec.Value)
+	}
+	switch {
+	case rec.Type == "":
+	case rec.Type == "A" && ip.Is4():
+	case rec.Type == "AAAA" && ip.Is6():
+	case rec.Type == "A" || rec.Type == "AAAA":
+		return fmt.Errorf("%s: %s record with value %v", rec.Name, rec.Type, ip)
+	default:
+		return fmt.Errorf("%s: unsupported record type %q", rec.Name, rec.Type)
+	}
+	return nil
+}
+
+// PrefsTransaction is a set of pref edits that LocalBackend applies
+// all-or-nothing: the edits are applied in order and the combined result
+// is validated before any of it takes effect.
+type PrefsTransaction struct {
+	Edits []*MaskedPrefs
+
+	// DryRun, if true, validates the edits and returns the resulting
+	// prefs without applying them.
+	DryRun bool `json:",omitempty"`
+}
+
 // SetAdvertiseExitNode mutates p (if non-nil) to add or remove the two
 // /0 exit node routes.
 func (p *Prefs) SetAdvertiseExitNode(runExit bool) {
@@ -55,6 +55,13 @@ func TestPrefsEqual(t *testing.T) {
 		"NoSNAT",
 		"NetfilterMode",
 		"OperatorUser",
+		"Telemetry",
+		"TrustedNetworks",
+		"TrustedNetworksIdle",
+		"StaticDNSRecords",
+		"NodeKeyRotation",
+		"LogoutAt",
+		"LogLevels",
 		"Persist",
 	}
 	if have := fieldsOf(reflect.TypeOf(Prefs{})); !reflect.DeepEqual(have, prefsHandles) {
@@ -261,6 +268,81 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{Telemetry: preftype.TelemetryFull},
+			&Prefs{Telemetry: preftype.TelemetryNone},
+			false,
+		},
+		{
+			&Prefs{Telemetry: preftype.TelemetryNone},
+			&Prefs{Telemetry: preftype.TelemetryNone},
+			true,
+		},
+
+		{
+			&Prefs{TrustedNetworks: []string{"ssid:Office"}},
+			&Prefs{TrustedNetworks: []string{"ssid:Home"}},
+			false,
+		},
+		{
+			&Prefs{TrustedNetworks: []string{"ssid:Office"}},
+			&Prefs{TrustedNetworks: []string{"ssid:Office"}},
+			true,
+		},
+		{
+			&Prefs{TrustedNetworksIdle: true},
+			&Prefs{TrustedNetworksIdle: false},
+			false,
+		},
+		{
+			&Prefs{StaticDNSRecords: []tailcfg.DNSRecord{{Name: "lab.example.com", Value: "100.64.0.1"}}},
+			&Prefs{StaticDNSRecords: []tailcfg.DNSRecord{{Name: "lab.example.com", Value: "100.64.0.2"}}},
+			false,
+		},
+		{
+			&Prefs{StaticDNSRecords: []tailcfg.DNSRecord{{Name: "lab.example.com", Value: "100.64.0.1"}}},
+			&Prefs{StaticDNSRecords: []tailcfg.DNSRecord{{Name: "lab.example.com", Value: "100.64.0.1"}}},
+			true,
+		},
+
+		{
+			&Prefs{NodeKeyRotation: 24 * time.Hour},
+			&Prefs{NodeKeyRotation: 0},
+			false,
+		},
+		{
+			&Prefs{NodeKeyRotation: 24 * time.Hour},
+			&Prefs{NodeKeyRotation: 24 * time.Hour},
+			true,
+		},
+
+		{
+			&Prefs{LogoutAt: timePtr(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))},
+			&Prefs{},
+			false,
+		},
+		{
+			&Prefs{LogoutAt: timePtr(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC))},
+			&Prefs{LogoutAt: timePtr(time.Date(2022, 8, 1, 14, 0, 0, 0, time.FixedZone("", 2*3600)))},
+			true,
+		},
+
+		{
+			&Prefs{LogLevels: map[string]string{"magicsock": "debug"}},
+			&Prefs{},
+			false,
+		},
+		{
+			&Prefs{LogLevels: map[string]string{"magicsock": "debug"}},
+			&Prefs{LogLevels: map[string]string{"magicsock": "trace"}},
+			false,
+		},
+		{
+			&Prefs{LogLevels: map[string]string{"magicsock": "debug", "dns": "trace"}},
+			&Prefs{LogLevels: map[string]string{"dns": "trace", "magicsock": "debug"}},
+			true,
+		},
+
 		{
 			&Prefs{Persist: &persist.Persist{}},
 			&Prefs{Persist: &persist.Persist{LoginName: "dave"}},
@@ -449,6 +531,49 @@ func TestPrefsPretty(t *testing.T) {
 			"linux",
 			`Prefs{ra=false mesh=false dns=false want=false routes=[] nf=off host="foo" Persist=nil}`,
 		},
+		{
+			Prefs{
+				Telemetry: preftype.TelemetryHealthOnly,
+			},
+			"windows",
+			`Prefs{ra=false mesh=false dns=false want=false telemetry=health-only Persist=nil}`,
+		},
+		{
+			Prefs{
+				TrustedNetworks:     []string{"ssid:Office", "dns:corp.example.com"},
+				TrustedNetworksIdle: true,
+			},
+			"windows",
+			`Prefs{ra=false mesh=false dns=false want=false trusted=["ssid:Office" "dns:corp.example.com"] trusted-idle Persist=nil}`,
+		},
+		{
+			Prefs{
+				StaticDNSRecords: []tailcfg.DNSRecord{{Name: "lab.example.com", Value: "100.64.0.1"}},
+			},
+			"linux",
+			`Prefs{ra=false mesh=false dns=false want=false routes=[] nf=off dnsrecords=1 Persist=nil}`,
+		},
+		{
+			Prefs{
+				NodeKeyRotation: 720 * time.Hour,
+			},
+			"windows",
+			`Prefs{ra=false mesh=false dns=false want=false keyrotation=720h0m0s Persist=nil}`,
+		},
+		{
+			Prefs{
+				LogoutAt: timePtr(time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)),
+			},
+			"windows",
+			`Prefs{ra=false mesh=false dns=false want=false logout-at=2022-08-01T12:00:00Z Persist=nil}`,
+		},
+		{
+			Prefs{
+				LogLevels: map[string]string{"magicsock": "debug", "dns": "trace"},
+			},
+			"windows",
+			`Prefs{ra=false mesh=false dns=false want=false loglevels=map[dns:trace magicsock:debug] Persist=nil}`,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.p.pretty(tt.os)
@@ -681,6 +806,93 @@ func TestPrefsExitNode(t *testing.T) {
 	}
 }
 
+func TestPrefsValidate(t *testing.T) {
+	exitRoutes := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("0.0.0.0/0"),
+		netaddr.MustParseIPPrefix("::/0"),
+	}
+	tests := []struct {
+		name string
+		p    *Prefs
+		want []PrefsFieldError
+	}{
+		{
+			name: "default",
+			p:    NewPrefs(),
+		},
+		{
+			name: "exit_node_and_subnet",
+			p: &Prefs{
+				ExitNodeID:      "foo",
+				AdvertiseRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")},
+			},
+		},
+		{
+			name: "use_and_advertise_exit_node",
+			p: &Prefs{
+				ExitNodeID:      "foo",
+				AdvertiseRoutes: exitRoutes,
+			},
+			want: []PrefsFieldError{{"ExitNodeID", "can't use an exit node while advertising as an exit node"}},
+		},
+		{
+			name: "half_exit_node_and_unmasked",
+			p: &Prefs{
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("0.0.0.0/0"),
+					netaddr.MustParseIPPrefix("10.1.2.3/8"),
+				},
+				Hostname: strings.Repeat("a", 257),
+			},
+			want: []PrefsFieldError{
+				{"AdvertiseRoutes", "10.1.2.3/8 has non-address bits set; expected 10.0.0.0/8"},
+				{"AdvertiseRoutes", "exit node routes must include both 0.0.0.0/0 and ::/0"},
+				{"Hostname", "too long: 257 bytes (max 256)"},
+			},
+		},
+		{
+			name: "static_dns_records",
+			p: &Prefs{
+				StaticDNSRecords: []tailcfg.DNSRecord{
+					{Name: "lab.example.com", Value: "192.168.1.10"},
+					{Name: "lab.example.com", Type: "AAAA", Value: "fd7a:115c:a1e0::1"},
+					{Name: "", Value: "192.168.1.10"},
+					{Name: "v6.example.com", Type: "A", Value: "fd7a:115c:a1e0::1"},
+					{Name: "txt.example.com", Type: "TXT", Value: "1.2.3.4"},
+					{Name: "bad.example.com", Value: "not-an-ip"},
+				},
+			},
+			want: []PrefsFieldError{
+				{"StaticDNSRecords", `invalid DNS name ""`},
+				{"StaticDNSRecords", "v6.example.com: A record with value fd7a:115c:a1e0::1"},
+				{"StaticDNSRecords", `txt.example.com: unsupported record type "TXT"`},
+				{"StaticDNSRecords", `bad.example.com: invalid IP address "not-an-ip"`},
+			},
+		},
+		{
+			name: "node_key_rotation",
+			p:    &Prefs{NodeKeyRotation: time.Minute},
+			want: []PrefsFieldError{
+				{"NodeKeyRotation", "interval 1m0s is less than the minimum of 1h0m0s"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.p.Validate()
+			var got []PrefsFieldError
+			if ve, ok := err.(*PrefsValidationError); ok {
+				got = ve.Errors
+			} else if err != nil {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestExitNodeIPOfArg(t *testing.T) {
 	mustIP := netaddr.MustParseIP
 	tests := []struct {
@@ -825,3 +1037,5 @@ func TestControlURLOrDefault(t *testing.T) {
 		t.Errorf("got %q; want %q", got, want)
 	}
 }
+
+func timePtr(t time.Time) *time.Time { return &t }
@@ -0,0 +1,232 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+)
+
+// stateBackups is the number of backups that FileStore keeps of its
+// state file, as path.bak1 (the newest) through path.bak3.
+//
+// A corrupt state file would otherwise log the node out, as
+// tailscaled would start from scratch, so FileStore restores the
+// newest good backup instead.
+const stateBackups = 3
+
+// stateBackupInterval is how often a running FileStore rotates its
+// backups. Writes in between don't touch them, so the backups span
+// more than the last few writes, which can come seconds apart.
+const stateBackupInterval = time.Hour
+
+// stateBackup is the format of a state file backup.
+type stateBackup struct {
+	Saved  time.Time
+	SHA256 string // hex SHA-256 of State
+	State  []byte // the state file's contents
+}
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.bak%d", path, n)
+}
+
+// checksumPath returns the path of the file that holds the checksum
+// of the state file at path.
+func checksumPath(path string) string {
+	return path + ".sha256"
+}
+
+func checksum(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeChecksumLocked saves the checksum of bs, the state file's
+// contents, next to it.
+func (s *FileStore) writeChecksumLocked(bs []byte) error {
+	return writeFile(checksumPath(s.path), []byte(checksum(bs)), 0600)
+}
+
+// verifyChecksum reports whether bs, the contents of s's state file,
+// matches the checksum saved next to it. A missing checksum matches,
+// as does one older than the state file: the file predates checksums
+// or was last written by an older version that doesn't keep them.
+func (s *FileStore) verifyChecksum(bs []byte) error {
+	want, err := os.ReadFile(checksumPath(s.path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if string(bytes.TrimSpace(want)) == checksum(bs) {
+		return nil
+	}
+	sfi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	cfi, err := os.Stat(checksumPath(s.path))
+	if err != nil {
+		return err
+	}
+	if sfi.ModTime().After(cfi.ModTime()) {
+		s.logf("store: state file %q changed without its checksum; assuming an older version wrote it", s.path)
+		return nil
+	}
+	return errors.New("checksum mismatch")
+}
+
+// readBackup reads and verifies backup n of the state file at path.
+func readBackup(path string, n int) (*stateBackup, error) {
+	j, err := os.ReadFile(backupPath(path, n))
+	if err != nil {
+		return nil, err
+	}
+	b := new(stateBackup)
+	if err := json.Unmarshal(j, b); err != nil {
+		return nil, err
+	}
+	if checksum(b.State) != b.SHA256 {
+		return nil, errors.New("checksum mismatch")
+	}
+	return b, nil
+}
+
+// maybeBackupLocked backs up bs, the state file's contents, if it's
+// been stateBackupInterval since s last rotated its backups.
+func (s *FileStore) maybeBackupLocked(bs []byte) {
+	if !s.lastBackup.IsZero() && time.Since(s.lastBackup) < stateBackupInterval {
+		return
+	}
+	if err := s.writeBackupLocked(bs); err != nil {
+		s.logf("store: backing up state file %q: %v", s.path, err)
+	}
+}
+
+// writeBackupLocked rotates s's state file backups, dropping the
+// oldest, and saves bs, the state file's contents, as the newest.
+func (s *FileStore) writeBackupLocked(bs []byte) error {
+	for n := stateBackups - 1; n >= 1; n-- {
+		if err := os.Rename(backupPath(s.path, n), backupPath(s.path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	j, err := json.Marshal(&stateBackup{
+		Saved:  time.Now().UTC(),
+		SHA256: checksum(bs),
+		State:  bs,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(backupPath(s.path, 1), j, 0600); err != nil {
+		return err
+	}
+	s.lastBackup = time.Now()
+	return nil
+}
+
+// load parses bs, the contents of s's state file, into s.cache.
+//
+// If bs is corrupt (or empty, when there are backups, which means
+// the state file was written before), load uses the newest backup
+// that verifies instead and returns it. If no backup verifies, it
+// returns an error: os.ErrNotExist for an empty file, else why bs is
+// corrupt. The exception is a file that parses but doesn't match its
+// checksum, which is used anyway if there's no backup.
+func (s *FileStore) load(bs []byte) (restored *stateBackup, err error) {
+	var corruptErr error
+	var parsed map[ipn.StateKey][]byte // if bs parses but doesn't verify
+	if len(bs) == 0 {
+		corruptErr = errors.New("file empty")
+	} else if err := json.Unmarshal(bs, &s.cache); err != nil {
+		corruptErr = err
+	} else if err := s.verifyChecksum(bs); err != nil {
+		corruptErr = err
+		parsed = s.cache
+	} else {
+		return nil, nil
+	}
+
+	for n := 1; n <= stateBackups; n++ {
+		b, err := readBackup(s.path, n)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.logf("store: state file backup %q is unusable: %v", backupPath(s.path, n), err)
+			}
+			continue
+		}
+		cache := map[ipn.StateKey][]byte{}
+		if err := json.Unmarshal(b.State, &cache); err != nil {
+			s.logf("store: state file backup %q is unusable: %v", backupPath(s.path, n), err)
+			continue
+		}
+		s.logf("store: state file %q is corrupt (%v); restoring backup %q saved %v", s.path, corruptErr, backupPath(s.path, n), b.Saved.Format(time.RFC3339))
+		s.cache = cache
+		return b, nil
+	}
+	if parsed != nil {
+		s.logf("store: state file %q doesn't verify (%v) and there's no backup; using it anyway", s.path, corruptErr)
+		s.cache = parsed
+		return nil, nil
+	}
+	s.cache = map[ipn.StateKey][]byte{}
+	if len(bs) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return nil, corruptErr
+}
+
+// restored finishes restoring s's state file from backup b, after
+// load: it keeps the corrupt file as path.corrupt for inspection,
+// rewrites the state file from b, and reports the restore through
+// package health.
+func (s *FileStore) restored(b *stateBackup) error {
+	if err := os.Rename(s.path, s.path+".corrupt"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := writeFile(s.path, b.State, 0600); err != nil {
+		return err
+	}
+	if err := s.writeChecksumLocked(b.State); err != nil {
+		return err
+	}
+	reportRestore(s.path, b)
+	return nil
+}
+
+// reportRestore reports through package health that the state file at
+// path was restored from backup b, prompting the user to check for
+// lost changes.
+func reportRestore(path string, b *stateBackup) {
+	health.SetStateRestoreHealth(fmt.Errorf("state file %q was corrupt and was restored from a backup saved %v; changes since then, such as to preferences, were lost. Check them with 'tailscale status' and 'tailscale up'", path, b.Saved.Format(time.RFC3339)))
+}
+
+// verifyBackupLocked makes sure, at startup, that the newest backup
+// of s's state file and its checksum match bs, its contents, rotating
+// the backups if not.
+func (s *FileStore) verifyBackupLocked(bs []byte) {
+	if err := s.writeChecksumLocked(bs); err != nil {
+		s.logf("store: saving state file %q checksum: %v", s.path, err)
+	}
+	if b, err := readBackup(s.path, 1); err == nil && bytes.Equal(b.State, bs) {
+		s.lastBackup = time.Now()
+		return
+	}
+	if err := s.writeBackupLocked(bs); err != nil {
+		s.logf("store: backing up state file %q: %v", s.path, err)
+	}
+}
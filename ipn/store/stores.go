@@ -8,15 +8,20 @@
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"tailscale.com/atomicfile"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/paths"
@@ -57,6 +62,17 @@ func registerDefaultStores() {
 //     the suffix is a Kubernetes secret name
 //   * In all other cases, the path is treated as a filepath.
 func New(logf logger.Logf, path string) (ipn.StateStore, error) {
+	return newStore(logf, path, NewFileStore)
+}
+
+// NewOrMemory is like New, but file paths get a store from
+// NewFileStoreOrMemory, which keeps state in memory if it can't be
+// written.
+func NewOrMemory(logf logger.Logf, path string) (ipn.StateStore, error) {
+	return newStore(logf, path, NewFileStoreOrMemory)
+}
+
+func newStore(logf logger.Logf, path string, newFileStore Provider) (ipn.StateStore, error) {
 	regOnce.Do(registerDefaultStores)
 	for prefix, sf := range knownStores {
 		if strings.HasPrefix(path, prefix) {
@@ -68,7 +84,7 @@ func New(logf logger.Logf, path string) (ipn.StateStore, error) {
 	if runtime.GOOS == "windows" {
 		path = TryWindowsAppDataMigration(logf, path)
 	}
-	return NewFileStore(logf, path)
+	return newFileStore(logf, path)
 }
 
 // Register registers a prefix to be used for
@@ -108,12 +124,20 @@ func TryWindowsAppDataMigration(logf logger.Logf, path string) string {
 	return paths.TryConfigFileMigration(logf, oldFile, path)
 }
 
+// writeFile writes FileStore files. It's a var for tests.
+var writeFile = atomicfile.WriteFile
+
 // FileStore is a StateStore that uses a JSON file for persistence.
 type FileStore struct {
-	path string
+	path     string
+	logf     logger.Logf
+	tolerant bool // from NewFileStoreOrMemory
 
-	mu    sync.RWMutex
-	cache map[ipn.StateKey][]byte
+	mu      sync.RWMutex
+	cache   map[ipn.StateKey][]byte
+	memOnly bool // the file can't be written; changes are only in cache
+
+	lastBackup time.Time // when the backups were last rotated
 }
 
 // Path returns the path that NewFileStore was called with.
@@ -128,39 +152,100 @@ func NewFileStore(logf logger.Logf, path string) (ipn.StateStore, error) {
 		return nil, fmt.Errorf("creating state directory: %w", err)
 	}
 
+	if logf == nil {
+		logf = logger.Discard
+	}
+	ret := &FileStore{
+		path:  path,
+		logf:  logf,
+		cache: map[ipn.StateKey][]byte{},
+	}
 	bs, err := ioutil.ReadFile(path)
+	var restored *stateBackup
+	if err == nil {
+		restored, err = ret.load(bs)
+	}
 
-	// Treat an empty file as a missing file.
+	// Treat an empty file (with no backup) as a missing file.
 	// (https://github.com/tailscale/tailscale/issues/895#issuecomment-723255589)
-	if err == nil && len(bs) == 0 {
+	if err == os.ErrNotExist {
 		logf("store.NewFileStore(%q): file empty; treating it like a missing file [warning]", path)
-		err = os.ErrNotExist
 	}
 
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Write out an initial file, to verify that we can write
 			// to the path.
-			if err = atomicfile.WriteFile(path, []byte("{}"), 0600); err != nil {
+			if err = writeFile(path, []byte("{}"), 0600); err != nil {
 				return nil, err
 			}
-			return &FileStore{
-				path:  path,
-				cache: map[ipn.StateKey][]byte{},
-			}, nil
+			return ret, nil
 		}
 		return nil, err
 	}
+	if restored != nil {
+		if err := ret.restored(restored); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+	ret.verifyBackupLocked(bs)
+	return ret, nil
+}
 
-	ret := &FileStore{
-		path:  path,
-		cache: map[ipn.StateKey][]byte{},
+// NewFileStoreOrMemory is like NewFileStore, but tolerates path being
+// on a read-only filesystem, as on immutable distros and appliance
+// images: rather than failing, it serves what's in the file, if
+// anything, and keeps changes in memory only, reporting that through
+// package health. If writing fails that way later, it does the same.
+func NewFileStoreOrMemory(logf logger.Logf, path string) (ipn.StateStore, error) {
+	if logf == nil {
+		logf = logger.Discard
 	}
-	if err := json.Unmarshal(bs, &ret.cache); err != nil {
+	st, err := NewFileStore(logf, path)
+	if err == nil {
+		s := st.(*FileStore)
+		s.logf, s.tolerant = logf, true
+		return s, nil
+	}
+	if !isReadOnlyError(err) {
 		return nil, err
 	}
+	s := &FileStore{
+		path:     path,
+		logf:     logf,
+		tolerant: true,
+		cache:    map[ipn.StateKey][]byte{},
+	}
+	if bs, rerr := ioutil.ReadFile(path); rerr == nil {
+		// A backup can't be written back here, but serving it
+		// beats starting logged out.
+		b, lerr := s.load(bs)
+		if lerr != nil && lerr != os.ErrNotExist {
+			return nil, lerr
+		}
+		if b != nil {
+			reportRestore(s.path, b)
+		}
+	}
+	s.setMemOnlyLocked(err)
+	return s, nil
+}
 
-	return ret, nil
+// isReadOnlyError reports whether err is from writing to a read-only
+// filesystem or one we don't have permission to write to.
+func isReadOnlyError(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, fs.ErrPermission)
+}
+
+// setMemOnlyLocked switches s to keeping state in memory, after
+// failing to write its file with err.
+func (s *FileStore) setMemOnlyLocked(err error) {
+	s.memOnly = true
+	if s.logf != nil {
+		s.logf("store: can't write state file %q; keeping state in memory only: %v", s.path, err)
+	}
+	health.SetStateStoreHealth(fmt.Errorf("state file %q can't be written (%v); state is kept in memory and will be lost on restart", s.path, err))
 }
 
 // ReadState implements the StateStore interface.
@@ -182,9 +267,24 @@ func (s *FileStore) WriteState(id ipn.StateKey, bs []byte) error {
 		return nil
 	}
 	s.cache[id] = append([]byte(nil), bs...)
+	if s.memOnly {
+		return nil
+	}
 	bs, err := json.MarshalIndent(s.cache, "", "  ")
 	if err != nil {
 		return err
 	}
-	return atomicfile.WriteFile(s.path, bs, 0600)
+	err = writeFile(s.path, bs, 0600)
+	if err != nil && s.tolerant && isReadOnlyError(err) {
+		s.setMemOnlyLocked(err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.writeChecksumLocked(bs); err != nil {
+		return err
+	}
+	s.maybeBackupLocked(bs)
+	return nil
 }
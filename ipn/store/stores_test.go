@@ -5,9 +5,16 @@
 package store
 
 import (
+	"bytes"
+	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"tailscale.com/atomicfile"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/tstest"
@@ -178,3 +185,205 @@ func TestFileStore(t *testing.T) {
 		}
 	}
 }
+
+func TestFileStoreOrMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	if err := os.WriteFile(path, []byte(`{"foo":"YmFy"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	readOnly := func(string, []byte, os.FileMode) error {
+		return &os.PathError{Op: "open", Path: path, Err: syscall.EROFS}
+	}
+	defer func(old func(string, []byte, os.FileMode) error) { writeFile = old }(writeFile)
+	writeFile = readOnly
+
+	if _, err := NewFileStore(nil, filepath.Join(t.TempDir(), "new.state")); err == nil {
+		t.Fatal("NewFileStore on read-only filesystem succeeded")
+	}
+
+	store, err := NewFileStoreOrMemory(t.Logf, filepath.Join(t.TempDir(), "new.state"))
+	if err != nil {
+		t.Fatalf("NewFileStoreOrMemory of new file: %v", err)
+	}
+	testStoreSemantics(t, store)
+	health.SetStateStoreHealth(nil)
+
+	// An existing file is read, and written to until writes fail.
+	writeFile = atomicfile.WriteFile
+	store, err = NewFileStoreOrMemory(t.Logf, path)
+	if err != nil {
+		t.Fatalf("NewFileStoreOrMemory of existing file: %v", err)
+	}
+	if bs, err := store.ReadState("foo"); err != nil || string(bs) != "bar" {
+		t.Fatalf("ReadState(foo) = %q, %v; want bar", bs, err)
+	}
+	writeFile = readOnly
+	if err := store.WriteState("foo", []byte("baz")); err != nil {
+		t.Fatalf("WriteState to read-only file: %v", err)
+	}
+	if bs, _ := store.ReadState("foo"); string(bs) != "baz" {
+		t.Errorf("ReadState(foo) after failed write = %q; want baz from memory", bs)
+	}
+	if err := health.StateStoreHealth(); err == nil || !strings.Contains(err.Error(), "kept in memory") {
+		t.Errorf("health after falling back to memory = %v; want state store warning", err)
+	}
+	health.SetStateStoreHealth(nil)
+	if bs, _ := os.ReadFile(path); string(bs) != `{"foo":"YmFy"}` {
+		t.Errorf("file changed to %q", bs)
+	}
+}
+
+func TestFileStoreRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	store, err := NewFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"bar", "baz"} {
+		if err := store.WriteState("foo", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { health.SetStateRestoreHealth(nil) })
+
+	check := func(want string) {
+		t.Helper()
+		store, err := NewFileStore(t.Logf, path)
+		if err != nil {
+			t.Fatalf("NewFileStore: %v", err)
+		}
+		if bs, err := store.ReadState("foo"); err != nil || string(bs) != want {
+			t.Errorf("ReadState(foo) = %q, %v; want %q", bs, err, want)
+		}
+	}
+
+	// A good file doesn't need restoring.
+	check("baz")
+	if err := health.StateRestoreHealth(); err != nil {
+		t.Errorf("health after good start = %v; want nil", err)
+	}
+
+	// A corrupt or empty file gets the newest backup.
+	for _, corrupt := range []string{`{"foo":"Ym`, "", "\x00\x00\x00\x00"} {
+		if err := os.WriteFile(path, []byte(corrupt), 0600); err != nil {
+			t.Fatal(err)
+		}
+		check("baz")
+		if err := health.StateRestoreHealth(); err == nil || !strings.Contains(err.Error(), "restored from a backup") {
+			t.Errorf("health after restoring %q = %v; want restore warning", corrupt, err)
+		}
+		health.SetStateRestoreHealth(nil)
+		if bs, err := os.ReadFile(path + ".corrupt"); err != nil || string(bs) != corrupt {
+			t.Errorf("corrupt file kept as %q, %v; want %q", bs, err, corrupt)
+		}
+	}
+
+	// A backup that doesn't verify is skipped for an older one.
+	bak1 := backupPath(path, 1)
+	j, err := os.ReadFile(bak1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bak1, []byte(strings.Replace(string(j), `"SHA256":"`, `"SHA256":"00`, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	check("bar")
+
+	// With no good backup, a corrupt file is still an error.
+	for n := 1; n <= stateBackups; n++ {
+		os.Remove(backupPath(path, n))
+	}
+	if err := os.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(t.Logf, path); err == nil {
+		t.Error("NewFileStore of corrupt file with no backups succeeded")
+	}
+}
+
+func TestFileStoreBackupInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	store, err := NewFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"a", "b", "c", "d"} {
+		if err := store.WriteState("foo", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the first write rotated the backups.
+	if _, err := os.Stat(backupPath(path, 2)); !os.IsNotExist(err) {
+		t.Errorf("backups rotated more than once within %v", stateBackupInterval)
+	}
+
+	fs := store.(*FileStore)
+	fs.mu.Lock()
+	fs.lastBackup = time.Now().Add(-stateBackupInterval)
+	fs.mu.Unlock()
+	if err := store.WriteState("foo", []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBackup(path, 2); err != nil {
+		t.Errorf("backups not rotated after %v: %v", stateBackupInterval, err)
+	}
+}
+
+func TestFileStoreChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	store, err := NewFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteState("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { health.SetStateRestoreHealth(nil) })
+
+	// Corrupt the state file in a way that still parses, keeping it
+	// older than its checksum, as a disk error would.
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Replace(bs, []byte("YmFy"), []byte("YmF6"), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := store.ReadState("foo"); err != nil || string(bs) != "bar" {
+		t.Errorf("ReadState(foo) = %q, %v; want restored %q", bs, err, "bar")
+	}
+	if err := health.StateRestoreHealth(); err == nil {
+		t.Error("no restore warning after checksum mismatch")
+	}
+	health.SetStateRestoreHealth(nil)
+
+	// A state file newer than its checksum was written by something
+	// else, like an older version, and is used as is.
+	if err := os.WriteFile(path, []byte(`{"foo":"cXV4"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(checksumPath(path), old, old); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := store.ReadState("foo"); err != nil || string(bs) != "qux" {
+		t.Errorf("ReadState(foo) = %q, %v; want %q", bs, err, "qux")
+	}
+	if err := health.StateRestoreHealth(); err != nil {
+		t.Errorf("restore warning for a state file written by an older version: %v", err)
+	}
+}
@@ -148,6 +148,60 @@ type Secret struct {
 	Data map[string][]byte `json:"data,omitempty"`
 }
 
+// Service is a named abstraction of software service (for example, mysql)
+// consisting of local port (for example 3306) that the proxy listens on, and
+// the selector that determines which pods will answer requests sent through
+// the proxy.
+type Service struct {
+	TypeMeta   `json:",inline"`
+	ObjectMeta `json:"metadata"`
+
+	// Spec defines the behavior of a service.
+	// +optional
+	Spec ServiceSpec `json:"spec,omitempty"`
+}
+
+// ServiceSpec describes the attributes that a user creates on a service.
+type ServiceSpec struct {
+	// Ports is the list of ports that are exposed by this service.
+	// +optional
+	Ports []ServicePort `json:"ports,omitempty"`
+
+	// ClusterIP is the IP address of the service and is usually assigned
+	// randomly. "None" means the service is headless and has no
+	// ClusterIP.
+	// +optional
+	ClusterIP string `json:"clusterIP,omitempty"`
+
+	// Type determines how the Service is exposed: "ClusterIP",
+	// "NodePort", "LoadBalancer" or "ExternalName".
+	// +optional
+	Type string `json:"type,omitempty"`
+}
+
+// ServicePort contains information on service's port.
+type ServicePort struct {
+	// The name of this port within the service.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// The IP protocol for this port. Supports "TCP", "UDP", and "SCTP".
+	// Default is TCP.
+	// +optional
+	Protocol string `json:"protocol,omitempty"`
+
+	// The port that will be exposed by this service.
+	Port int32 `json:"port"`
+}
+
+// ServiceList holds a list of services.
+type ServiceList struct {
+	TypeMeta `json:",inline"`
+
+	// List of services.
+	Items []Service `json:"items"`
+}
+
 // Status is a return value for calls that don't return other objects.
 type Status struct {
 	TypeMeta `json:",inline"`
@@ -168,3 +168,12 @@ func (c *Client) CreateSecret(ctx context.Context, s *Secret) error {
 func (c *Client) UpdateSecret(ctx context.Context, s *Secret) error {
 	return c.doRequest(ctx, "PUT", c.secretURL(s.Name), s, nil)
 }
+
+// ListServices lists the services in the client's namespace.
+func (c *Client) ListServices(ctx context.Context) ([]Service, error) {
+	var l ServiceList
+	if err := c.doRequest(ctx, "GET", fmt.Sprintf("%s/api/v1/namespaces/%s/services", c.url, c.ns), nil, &l); err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
@@ -46,6 +46,7 @@
 	"tailscale.com/smallzstd"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/crashreport"
 	"tailscale.com/util/racebuild"
 	"tailscale.com/util/winutil"
 	"tailscale.com/version"
@@ -93,6 +94,10 @@ type Policy struct {
 	Logtail *logtail.Logger
 	// PublicID is the logger's instance identifier.
 	PublicID logtail.PublicID
+	// CrashDir is the directory of crash reports (see package
+	// crashreport) found in the logs of previous runs, or empty if
+	// the collection doesn't keep them.
+	CrashDir string
 }
 
 // NewConfig creates a Config with collection and a newly generated PrivateID.
@@ -564,6 +569,22 @@ func New(collection string) *Policy {
 		}
 	}
 
+	// Look for a crash in the previous run's logs before filch starts
+	// rearranging them for upload.
+	var crashDir string
+	var newCrash *crashreport.Report
+	if collection == logtail.CollectionNode {
+		crashDir = filepath.Join(dir, "crashes")
+		if r := crashreport.FindInLogs(filchPrefix+".log1.txt", filchPrefix+".log2.txt"); r != nil {
+			isNew, err := crashreport.Save(crashDir, r)
+			if err != nil {
+				earlyLogf("crashreport.Save: %v", err)
+			} else if isNew {
+				newCrash = r
+			}
+		}
+	}
+
 	filchBuf, filchErr := filch.New(filchPrefix, filchOptions)
 	if filchBuf != nil {
 		c.Buffer = filchBuf
@@ -598,10 +619,14 @@ func New(collection string) *Policy {
 	if earlyErrBuf.Len() != 0 {
 		log.Printf("%s", earlyErrBuf.Bytes())
 	}
+	if r := newCrash; r != nil {
+		log.Printf("previous run crashed (crash report %s, v%s): %s", r.ID, r.Version, r.Reason)
+	}
 
 	return &Policy{
 		Logtail:  lw,
 		PublicID: newc.PublicID,
+		CrashDir: crashDir,
 	}
 }
 
@@ -654,7 +679,6 @@ func NewLogtailTransport(host string) *http.Transport {
 	tr := http.DefaultTransport.(*http.Transport).Clone()
 
 	tr.Proxy = tshttpproxy.ProxyFromEnvironment
-	tshttpproxy.SetTransportGetProxyConnectHeader(tr)
 
 	// We do our own zstd compression on uploads, and responses never contain any payload,
 	// so don't send "Accept-Encoding: gzip" to save a few bytes on the wire, since there
@@ -724,6 +748,7 @@ func NewLogtailTransport(host string) *http.Transport {
 	}
 
 	tr.TLSClientConfig = tlsdial.Config(host, tr.TLSClientConfig)
+	tshttpproxy.SetTransportConnectAuth(tr, logger.WithPrefix(log.Printf, "logtail: "))
 
 	return tr
 }
@@ -23,8 +23,8 @@
 
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/interfaces"
-	"tailscale.com/syncs"
 	tslogger "tailscale.com/types/logger"
+	"tailscale.com/types/preftype"
 	"tailscale.com/wgengine/monitor"
 )
 
@@ -314,12 +314,32 @@ func (l *Logger) drainPending(scratch []byte) (res []byte) {
 	return buf.Bytes()
 }
 
+// discardPending drops all the logs in the buffer.
+func (l *Logger) discardPending() {
+	for {
+		b, err := l.buffer.TryReadLine()
+		if err != nil || b == nil {
+			return
+		}
+	}
+}
+
 // This is the goroutine that repeatedly uploads logs in the background.
 func (l *Logger) uploading(ctx context.Context) {
 	defer close(l.shutdownDone)
 
 	scratch := make([]byte, 4096) // reusable buffer to write into
 	for {
+		if held := telemetryHold(); held != nil {
+			select {
+			case <-held:
+			case <-l.shutdownStart:
+				return
+			}
+			if Telemetry() != preftype.TelemetryFull {
+				l.discardPending()
+			}
+		}
 		body := l.drainPending(scratch)
 		origlen := -1 // sentinel value: uncompressed
 		// Don't attempt to compress tiny bodies; not worth the CPU cycles.
@@ -446,18 +466,88 @@ func (l *Logger) Flush() error {
 	return nil
 }
 
-// logtailDisabled is whether logtail uploads to logcatcher are disabled.
-var logtailDisabled syncs.AtomicBool
+// telemetryPref and telemetryLimit hold preftype.TelemetryLevel
+// values: the level requested by the node's preferences, and the
+// most restrictive level imposed for the lifetime of the process.
+var telemetryPref, telemetryLimit uint32
+
+var (
+	telemetryMu sync.Mutex
+	// telemetryHeld is non-nil while HoldTelemetry is in effect,
+	// and is closed by SetTelemetryPref.
+	telemetryHeld chan struct{}
+)
 
 // Disable disables logtail uploads for the lifetime of the process.
 func Disable() {
-	logtailDisabled.Set(true)
+	RestrictTelemetry(preftype.TelemetryNone)
 }
 
-func (l *Logger) send(jsonBlob []byte) (int, error) {
-	if logtailDisabled.Get() {
-		return len(jsonBlob), nil
+// RestrictTelemetry restricts uploads to at most what level l permits,
+// for the lifetime of the process. It's used for settings that
+// outrank the node's preferences, such as tailscaled's
+// --no-logs-no-support flag. Calls can only restrict uploads further.
+func RestrictTelemetry(l preftype.TelemetryLevel) {
+	for {
+		old := atomic.LoadUint32(&telemetryLimit)
+		if uint32(l) <= old || atomic.CompareAndSwapUint32(&telemetryLimit, old, uint32(l)) {
+			return
+		}
+	}
+}
+
+// SetTelemetryPref sets the telemetry level requested by the node's
+// preferences. The effective level is the more restrictive of it and
+// any set by RestrictTelemetry. It ends any HoldTelemetry.
+func SetTelemetryPref(l preftype.TelemetryLevel) {
+	atomic.StoreUint32(&telemetryPref, uint32(l))
+	telemetryMu.Lock()
+	defer telemetryMu.Unlock()
+	if telemetryHeld != nil {
+		close(telemetryHeld)
+		telemetryHeld = nil
 	}
+}
+
+// HoldTelemetry is for processes whose preferences are read after
+// logging starts. Until SetTelemetryPref is next called, Loggers keep
+// what they log, as far as RestrictTelemetry allows, rather than
+// uploading it. If SetTelemetryPref then doesn't allow full telemetry,
+// what they kept is discarded, never uploaded.
+func HoldTelemetry() {
+	telemetryMu.Lock()
+	defer telemetryMu.Unlock()
+	if telemetryHeld == nil {
+		telemetryHeld = make(chan struct{})
+	}
+}
+
+// telemetryHold returns a channel that's closed when HoldTelemetry
+// ends, or nil if it isn't in effect.
+func telemetryHold() <-chan struct{} {
+	telemetryMu.Lock()
+	defer telemetryMu.Unlock()
+	return telemetryHeld
+}
+
+// Telemetry returns the effective telemetry level, which applies to
+// all Loggers in the process.
+func Telemetry() preftype.TelemetryLevel {
+	l := atomic.LoadUint32(&telemetryPref)
+	if lim := atomic.LoadUint32(&telemetryLimit); lim > l {
+		l = lim
+	}
+	return preftype.TelemetryLevel(l)
+}
+
+// TelemetryRestricted reports whether RestrictTelemetry has restricted
+// the process to less than full telemetry, in which case the node's
+// preferences can't raise it.
+func TelemetryRestricted() bool {
+	return atomic.LoadUint32(&telemetryLimit) != uint32(preftype.TelemetryFull)
+}
+
+func (l *Logger) send(jsonBlob []byte) (int, error) {
 	n, err := l.buffer.Write(jsonBlob)
 	if l.drainLogs == nil {
 		select {
@@ -659,13 +749,47 @@ func (l *Logger) Write(buf []byte) (int, error) {
 			l.stderr.Write(withNL)
 		}
 	}
+	var b []byte
 	l.writeLock.Lock()
-	b := l.encode(buf, level)
+	defer l.writeLock.Unlock()
+	switch Telemetry() {
+	case preftype.TelemetryFull:
+		b = l.encode(buf, level)
+	case preftype.TelemetryHealthOnly:
+		b = l.encodeMetricsOnly()
+	}
+	if b == nil {
+		return len(buf), nil
+	}
 	_, err := l.send(b)
-	l.writeLock.Unlock()
 	return len(buf), err
 }
 
+// encodeMetricsOnly returns a log entry carrying only the client
+// metrics delta, without any log text, for use at
+// preftype.TelemetryHealthOnly. It returns nil if there's nothing to
+// upload.
+func (l *Logger) encodeMetricsOnly() []byte {
+	if l.metricsDelta == nil {
+		return nil
+	}
+	d := l.metricsDelta()
+	if d == "" {
+		return nil
+	}
+	b := make([]byte, 0, len(d)+len(`{"logtail": {"client_time": "2006-01-02T15:04:05.999999999Z07:00"}, "metrics": ""}`)+1)
+	b = append(b, '{')
+	if !l.skipClientTime {
+		b = append(b, `"logtail": {"client_time": "`...)
+		b = l.timeNow().AppendFormat(b, time.RFC3339Nano)
+		b = append(b, `"}, `...)
+	}
+	b = append(b, `"metrics": "`...)
+	b = append(b, d...)
+	b = append(b, "\"}\n"...)
+	return b
+}
+
 var (
 	openBracketV = []byte("[v")
 	v1           = []byte("[v1] ")
@@ -17,6 +17,7 @@
 	"time"
 
 	"tailscale.com/tstest"
+	"tailscale.com/types/preftype"
 )
 
 func TestFastShutdown(t *testing.T) {
@@ -402,3 +403,129 @@ func TestEncode(t *testing.T) {
 		}
 	}
 }
+
+func TestTelemetryLevels(t *testing.T) {
+	defer func() {
+		telemetryPref, telemetryLimit = 0, 0
+	}()
+	tests := []struct {
+		pref, limit preftype.TelemetryLevel
+		metrics     string
+		want        string
+	}{
+		{
+			pref: preftype.TelemetryFull,
+			want: `{"logtail": {"client_time": "1970-01-01T00:02:03.000000456Z","proc_id": 7,"proc_seq": 1}, "text": "some text"}` + "\n",
+		},
+		{
+			pref: preftype.TelemetryHealthOnly,
+			want: "",
+		},
+		{
+			pref:    preftype.TelemetryHealthOnly,
+			metrics: "N0deadbeef",
+			want:    `{"logtail": {"client_time": "1970-01-01T00:02:03.000000456Z"}, "metrics": "N0deadbeef"}` + "\n",
+		},
+		{
+			pref:    preftype.TelemetryNone,
+			metrics: "N0deadbeef",
+			want:    "",
+		},
+		{
+			pref:    preftype.TelemetryFull,
+			limit:   preftype.TelemetryNone,
+			metrics: "N0deadbeef",
+			want:    "",
+		},
+	}
+	for _, tt := range tests {
+		telemetryPref, telemetryLimit = 0, 0
+		SetTelemetryPref(tt.pref)
+		RestrictTelemetry(tt.limit)
+		buf := new(simpleMemBuf)
+		lg := &Logger{
+			timeNow:      func() time.Time { return time.Unix(123, 456).UTC() },
+			buffer:       buf,
+			procID:       7,
+			procSequence: 1,
+			metricsDelta: func() string { return tt.metrics },
+		}
+		io.WriteString(lg, "some text")
+		if got := buf.buf.String(); got != tt.want {
+			t.Errorf("pref=%v limit=%v metrics=%q:\n got: %#q\nwant: %#q\n", tt.pref, tt.limit, tt.metrics, got, tt.want)
+		}
+	}
+
+	telemetryPref, telemetryLimit = 0, 0
+	RestrictTelemetry(preftype.TelemetryHealthOnly)
+	RestrictTelemetry(preftype.TelemetryFull)
+	if got := Telemetry(); got != preftype.TelemetryHealthOnly {
+		t.Errorf("RestrictTelemetry loosened the limit; Telemetry = %v", got)
+	}
+	if !TelemetryRestricted() {
+		t.Error("TelemetryRestricted = false; want true")
+	}
+}
+
+func TestDrainPendingRawStderr(t *testing.T) {
+	shutdown := make(chan struct{})
+	close(shutdown) // so drainPending doesn't wait for more logs
+	lg := &Logger{
+		timeNow:       func() time.Time { return time.Unix(123, 456).UTC() },
+		buffer:        NewMemoryBuffer(1024),
+		stderr:        io.Discard,
+		shutdownStart: shutdown,
+	}
+	// As written to stderr by a crash in a previous run.
+	lg.buffer.Write([]byte("panic: oh no\n"))
+	got := lg.drainPending(nil)
+	if !strings.Contains(string(got), "panic: oh no") {
+		t.Fatalf("raw stderr not uploaded; got %q", got)
+	}
+	if !json.Valid(got) {
+		t.Errorf("raw stderr not wrapped as JSON: %q", got)
+	}
+}
+
+func TestHoldTelemetry(t *testing.T) {
+	defer func() {
+		telemetryPref, telemetryLimit = 0, 0
+		SetTelemetryPref(preftype.TelemetryFull)
+	}()
+	for _, level := range []preftype.TelemetryLevel{preftype.TelemetryFull, preftype.TelemetryNone} {
+		telemetryPref, telemetryLimit = 0, 0
+		HoldTelemetry()
+		uploaded := make(chan string, 10)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			uploaded <- string(body)
+		}))
+		lg := NewLogger(Config{BaseURL: ts.URL}, t.Logf)
+		io.WriteString(lg, "before prefs")
+		select {
+		case got := <-uploaded:
+			t.Fatalf("uploaded while held: %q", got)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		SetTelemetryPref(level)
+		io.WriteString(lg, "after prefs")
+		wait := 5 * time.Second
+		if level != preftype.TelemetryFull {
+			wait = 500 * time.Millisecond // for nothing to be uploaded
+		}
+		var got string
+		select {
+		case got = <-uploaded:
+		case <-time.After(wait):
+		}
+		if level == preftype.TelemetryFull && !strings.Contains(got, "before prefs") {
+			t.Errorf("at %v, held log not uploaded; got %q", level, got)
+		}
+		if level != preftype.TelemetryFull && got != "" {
+			t.Errorf("at %v, uploaded %q", level, got)
+		}
+		lg.Shutdown(context.Background())
+		ts.Close()
+	}
+}
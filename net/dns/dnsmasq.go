@@ -0,0 +1,253 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+const (
+	// dnsmasqSnippet is the name of the file we add to dnsmasq's
+	// conf-dir. It only points dnsmasq at dnsmasqServersFile, which
+	// dnsmasq rereads on SIGHUP, unlike its conf-dir.
+	dnsmasqSnippet = "tailscale.conf"
+
+	// dnsmasqServersFile holds our server= lines. On OpenWrt, /var is
+	// a tmpfs, as is the usual conf-dir, so neither outlives a reboot.
+	dnsmasqServersFile = "/var/run/tailscale-dnsmasq.servers"
+)
+
+// dnsmasqManager is an OSConfigurator for routers, such as OpenWrt,
+// where a local dnsmasq is the resolver for both the router and its
+// LAN. Rather than replacing resolv.conf, which would take the LAN's
+// names away, it forwards Tailscale's domains from dnsmasq to our
+// nameservers.
+//
+// dnsmasq can't set search domains for its clients, so they're
+// dropped; on a router, the LAN's DHCP options are what provide them.
+type dnsmasqManager struct {
+	logf    logger.Logf
+	fs      wholeFileFS
+	confDir string
+
+	// reload makes dnsmasq reread dnsmasqServersFile.
+	reload func() error
+	// restart makes dnsmasq reread its conf-dir, which is only needed
+	// when the snippet comes or goes.
+	restart func() error
+}
+
+func newDNSMasqManager(logf logger.Logf, confDir string) *dnsmasqManager {
+	return &dnsmasqManager{
+		logf:    logf,
+		fs:      directFS{},
+		confDir: confDir,
+		reload:  signalDNSMasq,
+		restart: restartDNSMasq,
+	}
+}
+
+func (m *dnsmasqManager) snippetPath() string {
+	return filepath.Join(m.confDir, dnsmasqSnippet)
+}
+
+// dnsmasqServers returns the contents of dnsmasqServersFile for cfg.
+func dnsmasqServers(cfg OSConfig) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by tailscaled; do not edit.\n")
+	domains := make([]string, 0, len(cfg.MatchDomains))
+	for _, d := range cfg.MatchDomains {
+		domains = append(domains, d.WithoutTrailingDot())
+	}
+	if len(domains) == 0 && len(cfg.Nameservers) > 0 {
+		// A plain server= line would only be added to the servers
+		// from dnsmasq's resolv-file. The domain "#" matches all
+		// names that no more specific server= does, making ours the
+		// default.
+		domains = []string{"#"}
+	}
+	for _, d := range domains {
+		for _, ns := range cfg.Nameservers {
+			fmt.Fprintf(&buf, "server=/%s/%s\n", d, ns)
+		}
+	}
+	return buf.Bytes()
+}
+
+func (m *dnsmasqManager) SetDNS(config OSConfig) error {
+	if config.IsZero() || len(config.Nameservers) == 0 {
+		return m.removeConfig()
+	}
+	if err := m.fs.WriteFile(dnsmasqServersFile, dnsmasqServers(config), 0644); err != nil {
+		return err
+	}
+
+	snippet := []byte("# Generated by tailscaled; do not edit.\nservers-file=" + dnsmasqServersFile + "\n")
+	if old, err := m.fs.ReadFile(m.snippetPath()); err == nil && bytes.Equal(old, snippet) {
+		return m.reload()
+	}
+	if err := m.fs.WriteFile(m.snippetPath(), snippet, 0644); err != nil {
+		return err
+	}
+	m.logf("dns: added %s, restarting dnsmasq", m.snippetPath())
+	return m.restart()
+}
+
+// removeConfig removes our snippet and empties dnsmasqServersFile, so
+// that dnsmasq forgets our servers without a restart. The empty file
+// is left behind, in case dnsmasq is later restarted by something
+// other than us before it notices the snippet is gone.
+func (m *dnsmasqManager) removeConfig() error {
+	if _, err := m.fs.Stat(dnsmasqServersFile); os.IsNotExist(err) {
+		return nil
+	}
+	if err := m.fs.Remove(m.snippetPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := m.fs.Truncate(dnsmasqServersFile); err != nil {
+		return err
+	}
+	return m.reload()
+}
+
+func (m *dnsmasqManager) SupportsSplitDNS() bool {
+	return true
+}
+
+func (m *dnsmasqManager) GetBaseConfig() (OSConfig, error) {
+	return OSConfig{}, ErrGetBaseConfigNotSupported
+}
+
+func (m *dnsmasqManager) Close() error {
+	return m.removeConfig()
+}
+
+// resolvIsLocalhost reports whether the resolv.conf in bs only sends
+// queries to a resolver on this machine, as OpenWrt's does.
+func resolvIsLocalhost(bs []byte) bool {
+	cfg, err := readResolv(bytes.NewReader(bs))
+	if err != nil || len(cfg.Nameservers) == 0 {
+		return false
+	}
+	for _, ns := range cfg.Nameservers {
+		if !ns.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+// findDNSMasq returns the PID and conf-dir of a running dnsmasq, or
+// ok=false if there's no dnsmasq with a conf-dir.
+func findDNSMasq() (pid int, confDir string, ok bool) {
+	ents, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, "", false
+	}
+	for _, ent := range ents {
+		pid, err := strconv.Atoi(ent.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", ent.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if len(args) == 0 || filepath.Base(args[0]) != "dnsmasq" {
+			continue
+		}
+		if dir := dnsmasqConfDir(args[1:]); dir != "" {
+			return pid, dir, true
+		}
+	}
+	return 0, "", false
+}
+
+// dnsmasqConfDir returns the first conf-dir set by dnsmasq's command
+// line args, or by the config file they name, or "" if there's none.
+func dnsmasqConfDir(args []string) string {
+	confFile := "/etc/dnsmasq.conf"
+	for i, arg := range args {
+		switch {
+		case arg == "-C" || arg == "--conf-file":
+			if i+1 < len(args) {
+				confFile = args[i+1]
+			}
+		case strings.HasPrefix(arg, "--conf-file="):
+			confFile = strings.TrimPrefix(arg, "--conf-file=")
+		case strings.HasPrefix(arg, "-C"):
+			confFile = strings.TrimPrefix(arg, "-C")
+		case arg == "-7" || arg == "--conf-dir":
+			if i+1 < len(args) {
+				return confDirPath(args[i+1])
+			}
+		case strings.HasPrefix(arg, "--conf-dir="):
+			return confDirPath(strings.TrimPrefix(arg, "--conf-dir="))
+		case strings.HasPrefix(arg, "-7"):
+			return confDirPath(strings.TrimPrefix(arg, "-7"))
+		}
+	}
+	f, err := os.Open(confFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "conf-dir=") {
+			return confDirPath(strings.TrimPrefix(line, "conf-dir="))
+		}
+	}
+	return ""
+}
+
+// confDirPath returns the directory of a conf-dir value, which may be
+// followed by file name filters. Any include filter is assumed to
+// allow dnsmasqSnippet's .conf extension.
+func confDirPath(v string) string {
+	dir, _, _ := strings.Cut(v, ",")
+	return strings.TrimSpace(dir)
+}
+
+func signalDNSMasq() error {
+	pid, _, ok := findDNSMasq()
+	if !ok {
+		return errors.New("dnsmasq is not running")
+	}
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
+
+func restartDNSMasq() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var cmd *exec.Cmd
+	if _, err := os.Stat("/etc/init.d/dnsmasq"); err == nil {
+		cmd = exec.CommandContext(ctx, "/etc/init.d/dnsmasq", "restart")
+	} else {
+		cmd = exec.CommandContext(ctx, "systemctl", "restart", "dnsmasq.service")
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("running %s: %v: %s", cmd, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+func TestDNSMasqManager(t *testing.T) {
+	tmp := t.TempDir()
+	for _, dir := range []string{"tmp/dnsmasq.d", "var/run"} {
+		if err := os.MkdirAll(filepath.Join(tmp, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := directFS{prefix: tmp}
+	var reloads, restarts int
+	m := &dnsmasqManager{
+		logf:    t.Logf,
+		fs:      fs,
+		confDir: "/tmp/dnsmasq.d",
+		reload:  func() error { reloads++; return nil },
+		restart: func() error { restarts++; return nil },
+	}
+	readFile := func(name string) string {
+		t.Helper()
+		b, err := fs.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if err := m.SetDNS(OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		SearchDomains: []dnsname.FQDN{"foo.ts.net."},
+		MatchDomains:  []dnsname.FQDN{"ts.net.", "corp.example."},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	const wantSplit = "# Generated by tailscaled; do not edit.\n" +
+		"server=/ts.net/100.100.100.100\n" +
+		"server=/corp.example/100.100.100.100\n"
+	if got := readFile(dnsmasqServersFile); got != wantSplit {
+		t.Errorf("split servers file:\n got: %q\nwant: %q", got, wantSplit)
+	}
+	if got, want := readFile("/tmp/dnsmasq.d/tailscale.conf"), "servers-file="+dnsmasqServersFile; !strings.Contains(got, want) {
+		t.Errorf("snippet = %q; want it to contain %q", got, want)
+	}
+	if restarts != 1 || reloads != 0 {
+		t.Errorf("after first SetDNS, restarts=%d reloads=%d; want 1, 0", restarts, reloads)
+	}
+
+	if err := m.SetDNS(OSConfig{
+		Nameservers: []netaddr.IP{netaddr.MustParseIP("8.8.8.8"), netaddr.MustParseIP("2001:4860:4860::8888")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	const wantGlobal = "# Generated by tailscaled; do not edit.\n" +
+		"server=/#/8.8.8.8\n" +
+		"server=/#/2001:4860:4860::8888\n"
+	if got := readFile(dnsmasqServersFile); got != wantGlobal {
+		t.Errorf("global servers file:\n got: %q\nwant: %q", got, wantGlobal)
+	}
+	if restarts != 1 || reloads != 1 {
+		t.Errorf("after second SetDNS, restarts=%d reloads=%d; want 1, 1", restarts, reloads)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/tmp/dnsmasq.d/tailscale.conf"); !os.IsNotExist(err) {
+		t.Errorf("snippet still present after Close: %v", err)
+	}
+	if got := readFile(dnsmasqServersFile); got != "" {
+		t.Errorf("servers file after Close = %q; want empty", got)
+	}
+	if reloads != 2 {
+		t.Errorf("after Close, reloads=%d; want 2", reloads)
+	}
+}
+
+func TestDNSMasqConfDir(t *testing.T) {
+	tmp := t.TempDir()
+	conf := filepath.Join(tmp, "dnsmasq.conf.cfg01411c")
+	if err := os.WriteFile(conf, []byte("# auto-generated config file from /etc/config/dhcp\nconf-file=/etc/dnsmasq.conf\nconf-dir=/tmp/dnsmasq.cfg01411c.d,*.conf\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-C", conf, "-k", "-x", "/var/run/dnsmasq/dnsmasq.cfg01411c.pid"}, "/tmp/dnsmasq.cfg01411c.d"},
+		{[]string{"--conf-file=" + conf}, "/tmp/dnsmasq.cfg01411c.d"},
+		{[]string{"-C" + conf}, "/tmp/dnsmasq.cfg01411c.d"},
+		{[]string{"--conf-dir=/etc/dnsmasq.d,.dpkg-dist", "-C", conf}, "/etc/dnsmasq.d"},
+		{[]string{"--conf-dir", "/etc/dnsmasq.d,.dpkg-dist", "-C", conf}, "/etc/dnsmasq.d"},
+		{[]string{"-7", "/etc/dnsmasq.d"}, "/etc/dnsmasq.d"},
+		{[]string{"-7/etc/dnsmasq.d,*.conf"}, "/etc/dnsmasq.d"},
+		{[]string{"-C", filepath.Join(tmp, "missing")}, ""},
+	}
+	for _, tt := range tests {
+		if got := dnsmasqConfDir(tt.args); got != tt.want {
+			t.Errorf("dnsmasqConfDir(%q) = %q; want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -16,6 +16,7 @@
 	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/envknob"
 	"tailscale.com/health"
 	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/packet"
@@ -137,6 +138,10 @@ func (m *Manager) Set(cfg Config) error {
 	return nil
 }
 
+// ndots, if set, is the ndots threshold quad-100 uses when applying
+// search domains; see resolver.Config.NDots.
+var ndots, _ = envknob.LookupInt("TS_DNS_NDOTS")
+
 // compileConfig converts cfg into a quad-100 resolver configuration
 // and an OS-level configuration.
 func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig, err error) {
@@ -152,8 +157,21 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 			routes[suffix] = resolvers
 		}
 	}
-	// Similarly, the OS always gets search paths.
+	// Similarly, the OS always gets search paths. Quad-100 applies
+	// the ones it's authoritative for itself too, as some OSes don't
+	// apply them consistently (or at all) to single-label names.
 	ocfg.SearchDomains = cfg.SearchDomains
+	for _, d := range cfg.SearchDomains {
+		for _, local := range rcfg.LocalDomains {
+			if local.Contains(d) {
+				rcfg.SearchDomains = append(rcfg.SearchDomains, d)
+				break
+			}
+		}
+	}
+	if len(rcfg.SearchDomains) > 0 {
+		rcfg.NDots = ndots
+	}
 
 	// Deal with trivial configs first.
 	switch {
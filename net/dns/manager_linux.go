@@ -34,6 +34,7 @@ func NewOSConfigurator(logf logger.Logf, interfaceName string) (ret OSConfigurat
 		nmIsUsingResolved: nmIsUsingResolved,
 		nmVersionBetween:  nmVersionBetween,
 		resolvconfStyle:   resolvconfStyle,
+		dnsmasqConfDir:    dnsmasqConfDirOfRunning,
 	}
 	mode, err := dnsMode(logf, env)
 	if err != nil {
@@ -50,6 +51,8 @@ func NewOSConfigurator(logf logger.Logf, interfaceName string) (ret OSConfigurat
 		return newDebianResolvconfManager(logf)
 	case "openresolv":
 		return newOpenresolvManager()
+	case "dnsmasq":
+		return newDNSMasqManager(logf, env.dnsmasqConfDir()), nil
 	default:
 		logf("[unexpected] detected unknown DNS mode %q, using direct manager as last resort", mode)
 		return newDirectManagerOnFS(logf, env.fs), nil
@@ -64,6 +67,7 @@ type newOSConfigEnv struct {
 	nmVersionBetween          func(v1, v2 string) (safe bool, err error)
 	resolvconfStyle           func() string
 	isResolvconfDebianVersion func() bool
+	dnsmasqConfDir            func() string // or "" if dnsmasq isn't running
 }
 
 func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
@@ -247,10 +251,25 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 		return "systemd-resolved", nil
 	default:
 		dbg("rc", "unknown")
+		// On OpenWrt and similar routers, resolv.conf points at a
+		// local dnsmasq that also serves the LAN. Overwriting
+		// resolv.conf would only change the router's own lookups,
+		// so program dnsmasq instead.
+		if resolvIsLocalhost(bs) && env.dnsmasqConfDir() != "" {
+			dbg("dnsmasq", "yes")
+			return "dnsmasq", nil
+		}
 		return "direct", nil
 	}
 }
 
+// dnsmasqConfDirOfRunning returns the conf-dir of the running dnsmasq,
+// or "" if there's none.
+func dnsmasqConfDirOfRunning() string {
+	_, dir, _ := findDNSMasq()
+	return dir
+}
+
 func nmVersionBetween(first, last string) (bool, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
@@ -28,6 +28,20 @@ func TestLinuxDNSMode(t *testing.T) {
 			wantLog: "dns: [rc=unknown ret=direct]",
 			want:    "direct",
 		},
+		{
+			name: "openwrt_dnsmasq",
+			env: env(
+				resolvDotConf("search lan", "nameserver 127.0.0.1", "nameserver ::1"),
+				dnsmasqRunning("/tmp/dnsmasq.d")),
+			wantLog: "dns: [rc=unknown dnsmasq=yes ret=dnsmasq]",
+			want:    "dnsmasq",
+		},
+		{
+			name:    "localhost_resolver_not_dnsmasq",
+			env:     env(resolvDotConf("nameserver 127.0.0.1")),
+			wantLog: "dns: [rc=unknown ret=direct]",
+			want:    "direct",
+		},
 		{
 			name: "network_manager",
 			env: env(
@@ -312,6 +326,7 @@ type envBuilder struct {
 	nmUsingResolved bool
 	nmVersion       string
 	resolvconfStyle string
+	dnsmasqConfDir  string
 }
 
 type envOption interface {
@@ -356,6 +371,7 @@ func env(opts ...envOption) newOSConfigEnv {
 			return !outside, nil
 		},
 		resolvconfStyle: func() string { return b.resolvconfStyle },
+		dnsmasqConfDir:  func() string { return b.dnsmasqConfDir },
 	}
 }
 
@@ -395,6 +411,12 @@ func nmRunning(version string, usingResolved bool) envOption {
 	})
 }
 
+func dnsmasqRunning(confDir string) envOption {
+	return envOpt(func(b *envBuilder) {
+		b.dnsmasqConfDir = confDir
+	})
+}
+
 func resolvconf(s string) envOption {
 	return envOpt(func(b *envBuilder) {
 		b.resolvconfStyle = s
@@ -481,13 +481,21 @@ func (f *forwarder) sendDoH(ctx context.Context, urlBase string, c *http.Client,
 	return res, err
 }
 
-var verboseDNSForward = envknob.Bool("TS_DEBUG_DNS_FORWARD_SEND")
+// logComponent is the "dns" component of "tailscale debug loglevel".
+// At LevelDebug, the forwarder logs each query it sends upstream, as
+// it does from the start with TS_DEBUG_DNS_FORWARD_SEND set.
+var logComponent = logger.NewComponent("dns", func() logger.Level {
+	if envknob.Bool("TS_DEBUG_DNS_FORWARD_SEND") {
+		return logger.LevelDebug
+	}
+	return logger.LevelInfo
+}())
 
 // send sends packet to dst. It is best effort.
 //
 // send expects the reply to have the same txid as txidOut.
 func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDelay) (ret []byte, err error) {
-	if verboseDNSForward {
+	if logComponent.Enabled(logger.LevelDebug) {
 		f.logf("forwarder.send(%q) ...", rr.name.Addr)
 		defer func() {
 			f.logf("forwarder.send(%q) = %v, %v", rr.name.Addr, len(ret), err)
@@ -73,6 +73,15 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// SearchDomains are the DNS suffixes, within LocalDomains, that
+	// the resolver itself appends to short names, like a stub
+	// resolver would: a query for a name with fewer than NDots dots
+	// is answered as if for the first name+suffix in Hosts, so
+	// that "db1" resolves the same on every OS.
+	SearchDomains []dnsname.FQDN
+	// NDots is the ndots threshold for SearchDomains, as in
+	// resolv.conf(5). If zero, 1 is used.
+	NDots int
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -80,6 +89,9 @@ type Config struct {
 func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	w.WriteString("{Routes:")
 	WriteRoutes(w, c.Routes)
+	if len(c.SearchDomains) > 0 {
+		fmt.Fprintf(w, " SearchDomains:%v NDots:%v", c.SearchDomains, c.NDots)
+	}
 	fmt.Fprintf(w, " Hosts:%v LocalDomains:[", len(c.Hosts))
 	space := false
 	arpa := 0
@@ -190,10 +202,12 @@ type Resolver struct {
 	wg sync.WaitGroup
 
 	// mu guards the following fields from being updated while used.
-	mu           sync.Mutex
-	localDomains []dnsname.FQDN
-	hostToIP     map[dnsname.FQDN][]netaddr.IP
-	ipToHost     map[netaddr.IP]dnsname.FQDN
+	mu            sync.Mutex
+	localDomains  []dnsname.FQDN
+	searchDomains []dnsname.FQDN
+	ndots         int
+	hostToIP      map[dnsname.FQDN][]netaddr.IP
+	ipToHost      map[netaddr.IP]dnsname.FQDN
 }
 
 type ForwardLinkSelector interface {
@@ -241,6 +255,11 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.localDomains = cfg.LocalDomains
+	r.searchDomains = cfg.SearchDomains
+	r.ndots = cfg.NDots
+	if r.ndots == 0 {
+		r.ndots = 1
+	}
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
 	return nil
@@ -628,6 +647,31 @@ func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (netaddr.IP,
 	}
 }
 
+// expandSearch returns the name to resolve in place of name: if name
+// has fewer than ndots dots, the first of name+suffix for the search
+// domains that's in the local hosts, and otherwise name itself.
+//
+// Names that only exist upstream aren't searched for; an OS that
+// applies the search domains itself still finds those.
+func (r *Resolver) expandSearch(name dnsname.FQDN) dnsname.FQDN {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.searchDomains) == 0 || name == "." || name.NumLabels()-1 >= r.ndots {
+		return name
+	}
+	for _, suffix := range r.searchDomains {
+		fqdn, err := dnsname.ToFQDN(name.WithoutTrailingDot() + "." + suffix.WithoutTrailingDot())
+		if err != nil {
+			continue
+		}
+		if _, ok := r.hostToIP[fqdn]; ok {
+			metricDNSResolveLocalSearch.Add(1)
+			return fqdn
+		}
+	}
+	return name
+}
+
 // parseViaDomain synthesizes an IP address for quad-A DNS requests of the form
 // `<IPv4-address>.via-<X>` and the deprecated form `via-<X>.<IPv4-address>`,
 // where X is a decimal, or hex-encoded number with a '0x' prefix.
@@ -1178,7 +1222,7 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		return r.respondReverse(query, name, parser.response())
 	}
 
-	ip, rcode := r.resolveLocal(name, parser.Question.Type)
+	ip, rcode := r.resolveLocal(r.expandSearch(name), parser.Question.Type)
 	if rcode == dns.RCodeRefused {
 		return nil, errNotOurName // sentinel error return value: it requests forwarding
 	}
@@ -1266,6 +1310,7 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSResolveLocalErrorOnion   = clientmetric.NewCounter("dns_resolve_local_error_onion")
 	metricDNSResolveLocalErrorMissing = clientmetric.NewCounter("dns_resolve_local_error_missing")
 	metricDNSResolveLocalErrorRefused = clientmetric.NewCounter("dns_resolve_local_error_refused")
+	metricDNSResolveLocalSearch       = clientmetric.NewCounter("dns_resolve_local_search")
 	metricDNSResolveLocalOKA          = clientmetric.NewCounter("dns_resolve_local_ok_a")
 	metricDNSResolveLocalOKAAAA       = clientmetric.NewCounter("dns_resolve_local_ok_aaaa")
 	metricDNSResolveLocalOKAll        = clientmetric.NewCounter("dns_resolve_local_ok_all")
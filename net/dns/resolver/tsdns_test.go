@@ -365,6 +365,41 @@ func TestResolveLocal(t *testing.T) {
 	}
 }
 
+func TestExpandSearch(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.Hosts = map[dnsname.FQDN][]netaddr.IP{
+		"test1.ipn.dev.":    {testipv4},
+		"db1.prod.ipn.dev.": {testipv4},
+	}
+	cfg.SearchDomains = []dnsname.FQDN{"ipn.dev."}
+
+	tests := []struct {
+		name  string
+		ndots int
+		qname dnsname.FQDN
+		want  dnsname.FQDN
+	}{
+		{"short", 0, "test1.", "test1.ipn.dev."},
+		{"short_missing", 0, "test3.", "test3."},
+		{"absolute", 0, "test1.ipn.dev.", "test1.ipn.dev."},
+		{"dotted_below_ndots", 2, "db1.prod.", "db1.prod.ipn.dev."},
+		{"dotted_at_ndots", 0, "db1.prod.", "db1.prod."},
+		{"root", 0, ".", "."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.NDots = tt.ndots
+			r.SetConfig(cfg)
+			if got := r.expandSearch(tt.qname); got != tt.want {
+				t.Errorf("expandSearch(%q) = %q; want %q", tt.qname, got, tt.want)
+			}
+		})
+	}
+}
+
 func TestResolveLocalReverse(t *testing.T) {
 	r := newResolver(t)
 	defer r.Close()
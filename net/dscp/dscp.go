@@ -0,0 +1,42 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dscp marks outgoing UDP packets with DSCP (Differentiated
+// Services) values and reads the TOS byte of incoming ones, on the
+// platforms that allow doing so per packet.
+package dscp
+
+import "net"
+
+// AF41 is the DSCP value for interactive traffic, such as video calls.
+// Wi-Fi's WMM maps it to its video access category, which gets
+// priority over best-effort traffic.
+const AF41 = 34
+
+// Supported reports whether WriteTo marks packets and ReadFrom returns
+// their TOS byte on this platform.
+func Supported() bool { return supported }
+
+// OfTOS returns the DSCP value in the IP TOS byte tos (the byte without
+// its two ECN bits).
+func OfTOS(tos byte) uint8 { return tos >> 2 }
+
+// WriteTo writes b to the IPv4 address addr on pc, marked with the DSCP
+// value d. If marking isn't supported, the packet is written unmarked.
+func WriteTo(pc *net.UDPConn, b []byte, addr *net.UDPAddr, d uint8) (int, error) {
+	return writeTo(pc, b, addr, d)
+}
+
+// EnableReceiveTOS asks the kernel to report the TOS byte of packets
+// arriving on pc, to be returned by ReadFrom.
+func EnableReceiveTOS(pc *net.UDPConn) error {
+	return enableReceiveTOS(pc)
+}
+
+// ReadFrom is like pc.ReadFromUDP, but also returns the packet's IP TOS
+// byte, if EnableReceiveTOS was successful. TOS values are only
+// reported for IPv4 packets.
+func ReadFrom(pc *net.UDPConn, b []byte) (n int, addr *net.UDPAddr, tos byte, haveTOS bool, err error) {
+	return readFrom(pc, b)
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dscp
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const supported = true
+
+// tosOOB holds, for each DSCP value, the IP_TOS control message that
+// marks a packet with it. They're built once, as writeTo is on the
+// packet send path.
+var tosOOB = func() (m [64][]byte) {
+	for d := range m {
+		oob := make([]byte, unix.CmsgSpace(4))
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		h.Level = unix.IPPROTO_IP
+		h.Type = unix.IP_TOS
+		h.SetLen(unix.CmsgLen(4))
+		*(*int32)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = int32(d) << 2
+		m[d] = oob
+	}
+	return m
+}()
+
+func writeTo(pc *net.UDPConn, b []byte, addr *net.UDPAddr, d uint8) (int, error) {
+	// An IP_TOS control message sets the TOS byte of just this
+	// packet, leaving the rest of the socket's traffic alone.
+	n, _, err := pc.WriteMsgUDP(b, tosOOB[d&63], addr)
+	return n, err
+}
+
+func enableReceiveTOS(pc *net.UDPConn) error {
+	rc, err := pc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func readFrom(pc *net.UDPConn, b []byte) (n int, addr *net.UDPAddr, tos byte, haveTOS bool, err error) {
+	var oob [64]byte
+	n, oobn, _, addr, err := pc.ReadMsgUDP(b, oob[:])
+	if err != nil || oobn == 0 {
+		return n, addr, 0, false, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, addr, 0, false, nil
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS && len(m.Data) > 0 {
+			return n, addr, m.Data[0], true, nil
+		}
+	}
+	return n, addr, 0, false, nil
+}
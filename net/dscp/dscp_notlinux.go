@@ -0,0 +1,28 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package dscp
+
+import (
+	"errors"
+	"net"
+)
+
+const supported = false
+
+func writeTo(pc *net.UDPConn, b []byte, addr *net.UDPAddr, d uint8) (int, error) {
+	return pc.WriteToUDP(b, addr)
+}
+
+func enableReceiveTOS(pc *net.UDPConn) error {
+	return errors.New("receiving TOS values not supported on this platform")
+}
+
+func readFrom(pc *net.UDPConn, b []byte) (n int, addr *net.UDPAddr, tos byte, haveTOS bool, err error) {
+	n, addr, err = pc.ReadFromUDP(b)
+	return n, addr, 0, false, err
+}
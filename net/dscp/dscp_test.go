@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dscp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteReadTOS(t *testing.T) {
+	if !Supported() {
+		t.Skip("DSCP marking not supported on this platform")
+	}
+	rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rx.Close()
+	if err := EnableReceiveTOS(rx); err != nil {
+		t.Fatalf("EnableReceiveTOS: %v", err)
+	}
+	tx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+
+	dst := rx.LocalAddr().(*net.UDPAddr)
+	for _, d := range []uint8{AF41, 0} {
+		if d == 0 {
+			if _, err := tx.WriteToUDP([]byte("plain"), dst); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := WriteTo(tx, []byte("marked"), dst, d); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		rx.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 100)
+		n, _, tos, ok, err := ReadFrom(rx, buf)
+		if err != nil {
+			t.Fatalf("ReadFrom: %v", err)
+		}
+		if !ok {
+			t.Fatalf("ReadFrom(%q) returned no TOS", buf[:n])
+		}
+		if got := OfTOS(tos); got != d {
+			t.Errorf("packet %q arrived with DSCP %d; want %d", buf[:n], got, d)
+		}
+	}
+}
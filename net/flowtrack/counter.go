@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowtrack
+
+import "sync"
+
+// Counts are the packets and bytes of a flow in each direction.
+type Counts struct {
+	TxPackets uint64 // sent from the local end
+	TxBytes   uint64
+	RxPackets uint64 // received by the local end
+	RxBytes   uint64
+}
+
+// DefaultMaxFlows is the default number of flows a Counter tracks.
+const DefaultMaxFlows = 4096
+
+// Counter accumulates the Counts of flows, keyed by their Tuple from the
+// local end: Src is the local address and Dst the remote one.
+//
+// The zero value is valid to use. It is safe for concurrent access.
+type Counter struct {
+	// MaxFlows is the maximum number of flows tracked before the
+	// least recently active is forgotten. Zero means DefaultMaxFlows.
+	MaxFlows int
+
+	mu    sync.Mutex
+	flows Cache // of *Counts
+}
+
+// Add counts a packet of size bytes of flow t, as seen from the local
+// end. The packet was sent by the local end if tx, or else received by it.
+func (c *Counter) Add(t Tuple, tx bool, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var fc *Counts
+	if v, ok := c.flows.Get(t); ok {
+		fc = v.(*Counts)
+	} else {
+		if c.flows.MaxEntries == 0 {
+			c.flows.MaxEntries = c.MaxFlows
+			if c.flows.MaxEntries == 0 {
+				c.flows.MaxEntries = DefaultMaxFlows
+			}
+		}
+		fc = new(Counts)
+		c.flows.Add(t, fc)
+	}
+	if tx {
+		fc.TxPackets++
+		fc.TxBytes += uint64(bytes)
+	} else {
+		fc.RxPackets++
+		fc.RxBytes += uint64(bytes)
+	}
+}
+
+// Flows returns the Counts of each tracked flow since it was first
+// seen.
+func (c *Counter) Flows() map[Tuple]Counts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make(map[Tuple]Counts, c.flows.Len())
+	for t, ele := range c.flows.m {
+		ret[t] = *ele.Value.(*entry).value.(*Counts)
+	}
+	return ret
+}
@@ -81,3 +81,30 @@ func TestCache(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestCounter(t *testing.T) {
+	c := &Counter{MaxFlows: 2}
+	k1 := Tuple{Src: netaddr.MustParseIPPort("100.64.0.1:1"), Dst: netaddr.MustParseIPPort("100.64.0.2:2")}
+	k2 := Tuple{Src: netaddr.MustParseIPPort("100.64.0.1:1"), Dst: netaddr.MustParseIPPort("100.64.0.3:3")}
+	k3 := Tuple{Src: netaddr.MustParseIPPort("100.64.0.1:1"), Dst: netaddr.MustParseIPPort("100.64.0.4:4")}
+
+	c.Add(k1, true, 100)
+	c.Add(k1, false, 50)
+	c.Add(k1, true, 10)
+	c.Add(k2, false, 1)
+	got := c.Flows()
+	want := map[Tuple]Counts{
+		k1: {TxPackets: 2, TxBytes: 110, RxPackets: 1, RxBytes: 50},
+		k2: {RxPackets: 1, RxBytes: 1},
+	}
+	if len(got) != len(want) || got[k1] != want[k1] || got[k2] != want[k2] {
+		t.Fatalf("Flows = %v; want %v", got, want)
+	}
+
+	// k1 was active least recently, so it's forgotten.
+	c.Add(k3, true, 5)
+	got = c.Flows()
+	if _, ok := got[k1]; ok || len(got) != 2 {
+		t.Fatalf("after eviction, Flows = %v; want k2 and k3", got)
+	}
+}
@@ -32,6 +32,36 @@
 	EndpointIndependentFirewall
 )
 
+var firewallTypeNames = map[FirewallType]string{
+	AddressAndPortDependentFirewall: "address-and-port-dependent",
+	AddressDependentFirewall:        "address-dependent",
+	EndpointIndependentFirewall:     "endpoint-independent",
+}
+
+func (s FirewallType) String() string {
+	if name, ok := firewallTypeNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("FirewallType(%d)", int(s))
+}
+
+func (s FirewallType) MarshalText() ([]byte, error) {
+	if _, ok := firewallTypeNames[s]; !ok {
+		return nil, fmt.Errorf("unknown firewall type %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+func (s *FirewallType) UnmarshalText(b []byte) error {
+	for v, name := range firewallTypeNames {
+		if name == string(b) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown firewall type %q", b)
+}
+
 // fwKey is the lookup key for a firewall session. While it contains a
 // 4-tuple ({src,dst} {ip,port}), some FirewallTypes will zero out
 // some fields, so in practice the key is either a 2-tuple (src only),
@@ -49,6 +49,36 @@ type mapping struct {
 	AddressAndPortDependentNAT
 )
 
+var natTypeNames = map[NATType]string{
+	EndpointIndependentNAT:     "endpoint-independent",
+	AddressDependentNAT:        "address-dependent",
+	AddressAndPortDependentNAT: "address-and-port-dependent",
+}
+
+func (t NATType) String() string {
+	if s, ok := natTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("NATType(%d)", int(t))
+}
+
+func (t NATType) MarshalText() ([]byte, error) {
+	if _, ok := natTypeNames[t]; !ok {
+		return nil, fmt.Errorf("unknown NAT type %d", int(t))
+	}
+	return []byte(t.String()), nil
+}
+
+func (t *NATType) UnmarshalText(b []byte) error {
+	for v, s := range natTypeNames {
+		if s == string(b) {
+			*t = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown NAT type %q", b)
+}
+
 // natKey is the lookup key for a NAT session. While it contains a
 // 4-tuple ({src,dst} {ip,port}), some NATTypes will zero out some
 // fields, so in practice the key is either a 2-tuple (src only),
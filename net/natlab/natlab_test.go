@@ -6,7 +6,11 @@
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -507,3 +511,68 @@ func testNAT(t *testing.T, n *SNAT44, lanIf, wanIf *Interface, tests []natTest)
 		}
 	}
 }
+
+func TestLoadScenarios(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "scenarios.json")
+	want := DefaultScenarios()
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadScenarios(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadScenarios round trip:\n got: %s\nwant: %s", mustJSON(t, got), b)
+	}
+
+	if err := os.WriteFile(file, []byte(`[{"Name":"x","M1":{"NAT":"full-cone"}}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadScenarios(file); err == nil {
+		t.Error("LoadScenarios accepted an unknown NAT type")
+	}
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestScenarioBuild(t *testing.T) {
+	for _, s := range DefaultScenarios() {
+		topo := s.Build()
+		if s.M1.NAT != nil && !topo.M1IP.IsPrivate() {
+			t.Errorf("%s: M1 behind NAT has IP %v; want a LAN IP", s.Name, topo.M1IP)
+		}
+		if s.M2.NAT == nil && topo.M2IP.IsPrivate() {
+			t.Errorf("%s: M2 on the internet has IP %v", s.Name, topo.M2IP)
+		}
+	}
+}
+
+func TestLossy(t *testing.T) {
+	run := func() (dropped []int) {
+		l := &Lossy{Loss: 0.25, Seed: 42}
+		for i := 0; i < 1000; i++ {
+			if l.HandleIn(&Packet{}, nil) == nil {
+				dropped = append(dropped, i)
+			}
+		}
+		return dropped
+	}
+	a, b := run(), run()
+	if !reflect.DeepEqual(a, b) {
+		t.Error("Lossy with the same seed dropped different packets")
+	}
+	if len(a) < 200 || len(a) > 300 {
+		t.Errorf("dropped %d of 1000 packets at 25%% loss", len(a))
+	}
+}
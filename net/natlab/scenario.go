@@ -0,0 +1,242 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+
+	"inet.af/netaddr"
+)
+
+// A Scenario describes a simulated network with two nodes, each
+// possibly behind a NAT and firewall, and a STUN (and DERP) server on
+// the internet, for testing NAT traversal between the nodes.
+//
+// Scenarios can be loaded from JSON with LoadScenarios, to check how
+// NAT traversal copes with a particular network.
+type Scenario struct {
+	Name   string
+	M1, M2 Node
+
+	// Seed seeds the packet loss of the nodes, so that a run of a
+	// lossy Scenario drops the same sequence of packets each time,
+	// as far as the goroutines delivering them allow.
+	Seed int64 `json:",omitempty"`
+
+	// WantDirect is whether NAT traversal is expected to find a
+	// direct path between the nodes, rather than staying on DERP.
+	WantDirect bool
+}
+
+// Node describes how a node in a Scenario is connected to the
+// internet.
+type Node struct {
+	// NAT, if non-nil, puts the node on its own LAN behind a NAT of
+	// this type. If nil, it's directly on the internet.
+	NAT *NATType `json:",omitempty"`
+	// Firewall, if non-nil, gives the node a stateful firewall of
+	// this type, and its NAT too, if it has one.
+	Firewall *FirewallType `json:",omitempty"`
+	// Loss is the fraction of the node's packets, in [0, 1), to drop
+	// in each direction.
+	Loss float64 `json:",omitempty"`
+}
+
+// Topology is the network built from a Scenario.
+type Topology struct {
+	STUN, M1, M2       *Machine
+	STUNIP, M1IP, M2IP netaddr.IP
+}
+
+// Build builds the simulated network described by s.
+func (s Scenario) Build() *Topology {
+	inet := NewInternet()
+	stun := &Machine{Name: "stun"}
+	t := &Topology{
+		STUN:   stun,
+		STUNIP: stun.Attach("eth0", inet).V4(),
+	}
+	t.M1, t.M1IP = s.M1.build("m1", 1, inet, s.Seed)
+	t.M2, t.M2IP = s.M2.build("m2", 2, inet, s.Seed+1)
+	return t
+}
+
+// Loss returns the expected fraction of packets sent from M1 to M2
+// that are dropped on the way.
+func (s Scenario) Loss() float64 {
+	return 1 - (1-s.M1.Loss)*(1-s.M2.Loss)
+}
+
+func (n Node) build(name string, lan int, inet *Network, seed int64) (*Machine, netaddr.IP) {
+	m := &Machine{Name: name}
+	if n.Firewall != nil {
+		m.PacketHandler = &Firewall{Type: *n.Firewall}
+	}
+	if n.Loss > 0 {
+		m.PacketHandler = &Lossy{
+			Loss:          n.Loss,
+			Seed:          seed,
+			PacketHandler: m.PacketHandler,
+		}
+	}
+	if n.NAT == nil {
+		return m, m.Attach("eth0", inet).V4()
+	}
+
+	nat := &Machine{Name: fmt.Sprintf("nat%d", lan)}
+	lanNet := &Network{
+		Name:    fmt.Sprintf("lan%d", lan),
+		Prefix4: mustPrefix(fmt.Sprintf("192.168.%d.0/24", lan)),
+	}
+	wanIf := nat.Attach("wan", inet)
+	lanIf := nat.Attach(lanNet.Name, lanNet)
+	lanNet.SetDefaultGateway(lanIf)
+	snat := &SNAT44{
+		Machine:           nat,
+		ExternalInterface: wanIf,
+		Type:              *n.NAT,
+	}
+	if n.Firewall != nil {
+		snat.Firewall = &Firewall{
+			Type:             *n.Firewall,
+			TrustedInterface: lanIf,
+		}
+	}
+	nat.PacketHandler = snat
+	return m, m.Attach("eth0", lanNet).V4()
+}
+
+// DefaultScenarios returns the Scenarios that Tailscale's NAT
+// traversal is tested against.
+func DefaultScenarios() []Scenario {
+	eim := EndpointIndependentNAT
+	apdm := AddressAndPortDependentNAT
+	eif := EndpointIndependentFirewall
+	apdf := AddressAndPortDependentFirewall
+	return []Scenario{
+		{
+			Name:       "simple_internet",
+			WantDirect: true,
+		},
+		{
+			Name:       "facing_easy_firewalls",
+			M1:         Node{Firewall: &apdf},
+			M2:         Node{Firewall: &apdf},
+			WantDirect: true,
+		},
+		{
+			Name:       "facing_nats",
+			M1:         Node{NAT: &eim, Firewall: &apdf},
+			M2:         Node{NAT: &eim, Firewall: &apdf},
+			WantDirect: true,
+		},
+		{
+			// The hard side's mapping for the peer can't be learned
+			// from STUN, but the easy side's NAT lets the hard side's
+			// pings in, and its pongs go back out the same way.
+			Name:       "hard_nat_to_open_nat",
+			M1:         Node{NAT: &apdm, Firewall: &apdf},
+			M2:         Node{NAT: &eim, Firewall: &eif},
+			WantDirect: true,
+		},
+		{
+			Name:       "facing_hard_nats",
+			M1:         Node{NAT: &apdm, Firewall: &apdf},
+			M2:         Node{NAT: &apdm, Firewall: &apdf},
+			WantDirect: false,
+		},
+		{
+			Name:       "lossy_nats",
+			M1:         Node{NAT: &eim, Firewall: &apdf, Loss: 0.1},
+			M2:         Node{NAT: &eim, Firewall: &apdf, Loss: 0.1},
+			Seed:       1,
+			WantDirect: true,
+		},
+	}
+}
+
+// LoadScenarios reads a JSON array of Scenarios from file.
+func LoadScenarios(file string) ([]Scenario, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ss []Scenario
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return nil, fmt.Errorf("parsing scenarios in %s: %w", file, err)
+	}
+	for i, s := range ss {
+		if s.Name == "" {
+			return nil, fmt.Errorf("scenario %d in %s has no Name", i, file)
+		}
+		for _, n := range []Node{s.M1, s.M2} {
+			if n.Loss < 0 || n.Loss >= 1 {
+				return nil, fmt.Errorf("scenario %q: loss %v out of range [0, 1)", s.Name, n.Loss)
+			}
+		}
+	}
+	return ss, nil
+}
+
+// Lossy is a PacketHandler that drops a random fraction of the
+// packets arriving at and departing from a Machine, and hands the
+// rest to an optional inner PacketHandler.
+type Lossy struct {
+	// Loss is the fraction of packets, in [0, 1], to drop.
+	Loss float64
+	// Seed seeds the random drop decisions.
+	Seed int64
+	// PacketHandler, if non-nil, handles the packets that aren't
+	// dropped. If nil, they're handled as by a Machine without a
+	// PacketHandler.
+	PacketHandler PacketHandler
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (l *Lossy) drop(p *Packet) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rnd == nil {
+		l.rnd = rand.New(rand.NewSource(l.Seed))
+	}
+	if l.rnd.Float64() < l.Loss {
+		p.Trace("lossy drop")
+		return true
+	}
+	return false
+}
+
+func (l *Lossy) HandleIn(p *Packet, iif *Interface) *Packet {
+	if l.drop(p) {
+		return nil
+	}
+	if l.PacketHandler != nil {
+		return l.PacketHandler.HandleIn(p, iif)
+	}
+	return p
+}
+
+func (l *Lossy) HandleOut(p *Packet, oif *Interface) *Packet {
+	if l.drop(p) {
+		return nil
+	}
+	if l.PacketHandler != nil {
+		return l.PacketHandler.HandleOut(p, oif)
+	}
+	return p
+}
+
+func (l *Lossy) HandleForward(p *Packet, iif, oif *Interface) *Packet {
+	if l.PacketHandler != nil {
+		return l.PacketHandler.HandleForward(p, iif, oif)
+	}
+	return nil
+}
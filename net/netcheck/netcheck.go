@@ -25,6 +25,7 @@
 	"inet.af/netaddr"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/envknob"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/neterror"
 	"tailscale.com/net/netns"
@@ -97,6 +98,12 @@ type Report struct {
 	// Empty means not checked.
 	PCP opt.Bool
 
+	// DSCPPreserved is whether the DSCP marking of IPv4 STUN
+	// probes (see Client.DSCP) reached a STUN server intact.
+	// Empty means not checked, or that no server reported what it
+	// received.
+	DSCPPreserved opt.Bool
+
 	PreferredDERP   int                   // or 0 for unknown
 	RegionLatency   map[int]time.Duration // keyed by DERP Region ID
 	RegionV4Latency map[int]time.Duration // keyed by DERP Region ID
@@ -105,6 +112,10 @@ type Report struct {
 	GlobalV4 string // ip:port of global IPv4
 	GlobalV6 string // [ip]:port of global IPv6
 
+	// Full is whether every region was probed, rather than just the
+	// fastest few of the previous report.
+	Full bool
+
 	// TODO: update Clone when adding new fields
 }
 
@@ -168,6 +179,12 @@ type Client struct {
 	// If nil, portmap discovery is not done.
 	PortMapper *portmapper.Client // lazily initialized on first use
 
+	// DSCP, if non-zero, is the DSCP value to mark IPv4 STUN probes
+	// with, to check whether the path preserves it. Probes are only
+	// marked if the IPv4 STUNConn is a *net.UDPConn or implements
+	// DSCPConn.
+	DSCP uint8
+
 	mu       sync.Mutex            // guards following
 	nextFull bool                  // do a full region scan, even if last != nil
 	prev     map[time.Time]*Report // some previous reports
@@ -183,6 +200,14 @@ type STUNConn interface {
 	ReadFrom([]byte) (int, net.Addr, error)
 }
 
+// DSCPConn is the interface a STUNConn implements to have the Client
+// mark its probes with Client.DSCP.
+type DSCPConn interface {
+	// WriteToDSCP is like WriteTo, but marks the packet with DSCP
+	// value dscp.
+	WriteToDSCP(b []byte, addr net.Addr, dscp uint8) (int, error)
+}
+
 func (c *Client) enoughRegions() int {
 	if c.Verbose {
 		// Abuse verbose a bit here so netcheck can show all region latencies
@@ -267,6 +292,15 @@ func (c *Client) ReceiveSTUNPacket(pkt []byte, src netaddr.IPPort) {
 	onDone, ok := rs.inFlight[tx]
 	if ok {
 		delete(rs.inFlight, tx)
+		if tos, haveTOS := stun.ParseReceivedTOS(pkt); haveTOS && c.DSCP != 0 && src.IP().Is4() {
+			// One intact probe is enough: it's the local
+			// network, where WMM applies, that all probes share.
+			if dscp.OfTOS(tos) == c.DSCP {
+				rs.report.DSCPPreserved.Set(true)
+			} else if rs.report.DSCPPreserved == "" {
+				rs.report.DSCPPreserved.Set(false)
+			}
+		}
 	}
 	rs.mu.Unlock()
 	if ok {
@@ -786,6 +820,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 		metricNumGetReportFull.Add(1)
 	}
 	rs.incremental = last != nil
+	rs.report.Full = !rs.incremental
 	c.mu.Unlock()
 
 	defer func() {
@@ -1097,6 +1132,9 @@ func (c *Client) logConciseReport(r *Report, dm *tailcfg.DERPMap) {
 		} else {
 			fmt.Fprintf(w, " portmap=?")
 		}
+		if r.DSCPPreserved != "" {
+			fmt.Fprintf(w, " dscp=%v", r.DSCPPreserved)
+		}
 		if r.GlobalV4 != "" {
 			fmt.Fprintf(w, " v4a=%v", r.GlobalV4)
 		}
@@ -1257,7 +1295,7 @@ func (rs *reportState) runProbe(ctx context.Context, dm *tailcfg.DERPMap, probe
 	switch probe.proto {
 	case probeIPv4:
 		metricSTUNSend4.Add(1)
-		n, err := rs.pc4.WriteTo(req, addr)
+		n, err := c.writeSTUN4(rs.pc4, req, addr)
 		if n == len(req) && err == nil || neterror.TreatAsLostUDP(err) {
 			rs.mu.Lock()
 			rs.report.IPv4CanSend = true
@@ -1277,6 +1315,20 @@ func (rs *reportState) runProbe(ctx context.Context, dm *tailcfg.DERPMap, probe
 	c.vlogf("sent to %v", addr)
 }
 
+// writeSTUN4 writes the IPv4 STUN probe b to addr on pc, marked with
+// c.DSCP if set and pc supports it.
+func (c *Client) writeSTUN4(pc STUNConn, b []byte, addr *net.UDPAddr) (int, error) {
+	if c.DSCP != 0 {
+		switch pc := pc.(type) {
+		case DSCPConn:
+			return pc.WriteToDSCP(b, addr, c.DSCP)
+		case *net.UDPConn:
+			return dscp.WriteTo(pc, b, addr, c.DSCP)
+		}
+	}
+	return pc.WriteTo(b, addr)
+}
+
 // proto is 4 or 6
 // If it returns nil, the node is skipped.
 func (c *Client) nodeAddr(ctx context.Context, n *tailcfg.DERPNode, proto probeProto) *net.UDPAddr {
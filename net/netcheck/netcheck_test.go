@@ -17,6 +17,7 @@
 	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
@@ -78,6 +79,31 @@ func TestBasic(t *testing.T) {
 	}
 }
 
+func TestDSCPPreserved(t *testing.T) {
+	if !dscp.Supported() {
+		t.Skip("DSCP marking not supported on this platform")
+	}
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+
+	c := &Client{
+		Logf:        t.Logf,
+		UDPBindAddr: "127.0.0.1:0",
+		DSCP:        dscp.AF41,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	r, err := c.GetReport(ctx, stuntest.DERPMapOf(stunAddr.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.DSCPPreserved; got != "true" {
+		t.Errorf("DSCPPreserved = %q; want true over loopback", got)
+	}
+}
+
 func TestWorksWhenUDPBlocked(t *testing.T) {
 	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
 	if err != nil {
@@ -105,6 +131,7 @@ func TestWorksWhenUDPBlocked(t *testing.T) {
 	r.PCP = ""
 
 	want := newReport()
+	want.Full = true // the first report probes every region
 
 	// The IPv4CanSend flag gets set differently across platforms.
 	// On Windows this test detects false, while on Linux detects true.
@@ -0,0 +1,304 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netcheck
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// scoreboardRetention is how long a Scoreboard keeps history.
+	scoreboardRetention = 7 * 24 * time.Hour
+
+	// scoreboardRecent is the period a Scoreboard's trends compare
+	// against the rest of its history.
+	scoreboardRecent = 3 * time.Hour
+
+	// scoreboardSaveInterval is how often a Scoreboard with new
+	// samples writes them to disk.
+	scoreboardSaveInterval = 10 * time.Minute
+)
+
+// healthBucket is an hour of a region's history.
+type healthBucket struct {
+	Hour      int64 `json:"h"` // Unix time of the start of the hour
+	Checks    int   `json:"c"` // full reports while the region was in the DERP map
+	Reachable int   `json:"r"` // of Checks, those in which the region replied
+	Latency   int64 `json:"l"` // sum of the region's latencies, in microseconds
+	Latencies int   `json:"n"` // number of latencies in Latency
+}
+
+func (b *healthBucket) add(o healthBucket) {
+	b.Checks += o.Checks
+	b.Reachable += o.Reachable
+	b.Latency += o.Latency
+	b.Latencies += o.Latencies
+}
+
+// scoreboardFile is the on-disk form of a Scoreboard.
+type scoreboardFile struct {
+	Version int
+	Regions map[int][]healthBucket
+}
+
+// A Scoreboard keeps hourly per-region latency and availability samples
+// from netcheck Reports for a week, optionally on disk, so that a
+// region's degradation can be told apart from the local network's.
+//
+// The zero value is valid to use and keeps history only in memory.
+type Scoreboard struct {
+	mu       sync.Mutex
+	logf     logger.Logf // set with path
+	path     string      // or empty to not persist
+	dm       *tailcfg.DERPMap
+	regions  map[int][]healthBucket // each sorted by Hour
+	dirty    bool
+	lastSave time.Time
+}
+
+// SetPath makes s persist its history to path, a JSON file, loading the
+// history already there. Load and save errors are logged to logf.
+func (s *Scoreboard) SetPath(path string, logf logger.Logf) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if logf == nil {
+		logf = logger.Discard
+	}
+	s.path = path
+	s.logf = logf
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var f scoreboardFile
+	if err == nil {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		s.logf("netcheck: loading DERP health history: %v", err)
+		return
+	}
+	if s.regions == nil {
+		s.regions = map[int][]healthBucket{}
+	}
+	for id, bs := range f.Regions {
+		for _, b := range bs {
+			s.addLocked(id, b)
+		}
+	}
+}
+
+// Record adds the results of r, a report made with DERP map dm, to the
+// hour of s's history containing now.
+func (s *Scoreboard) Record(now time.Time, r *Report, dm *tailcfg.DERPMap) {
+	if r == nil || dm == nil {
+		return
+	}
+	hour := now.Truncate(time.Hour).Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dm = dm
+	if s.regions == nil {
+		s.regions = map[int][]healthBucket{}
+	}
+	for id, reg := range dm.Regions {
+		b := healthBucket{Hour: hour}
+		d, ok := r.RegionLatency[id]
+		if ok {
+			b.Latency = d.Microseconds()
+			b.Latencies = 1
+		}
+		// Incremental reports only probe the fastest regions, so
+		// only full ones say anything about the rest being down.
+		if r.Full && !reg.Avoid {
+			b.Checks = 1
+			if ok {
+				b.Reachable = 1
+			}
+		}
+		if b.Checks > 0 || b.Latencies > 0 {
+			s.addLocked(id, b)
+		}
+	}
+	s.dirty = true
+
+	cutoff := now.Add(-scoreboardRetention).Unix()
+	for id, bs := range s.regions {
+		i := 0
+		for i < len(bs) && bs[i].Hour < cutoff {
+			i++
+		}
+		if i == len(bs) {
+			delete(s.regions, id)
+		} else if i > 0 {
+			s.regions[id] = append([]healthBucket(nil), bs[i:]...)
+		}
+	}
+	if s.path != "" && now.Sub(s.lastSave) >= scoreboardSaveInterval {
+		s.saveLocked(now)
+	}
+}
+
+// addLocked adds b to the history of region id.
+//
+// s.mu must be held.
+func (s *Scoreboard) addLocked(id int, b healthBucket) {
+	bs := s.regions[id]
+	i := sort.Search(len(bs), func(i int) bool { return bs[i].Hour >= b.Hour })
+	if i < len(bs) && bs[i].Hour == b.Hour {
+		bs[i].add(b)
+		return
+	}
+	bs = append(bs, healthBucket{})
+	copy(bs[i+1:], bs[i:])
+	bs[i] = b
+	s.regions[id] = bs
+}
+
+// s.mu must be held.
+func (s *Scoreboard) saveLocked(now time.Time) {
+	s.lastSave = now
+	data, err := json.Marshal(scoreboardFile{Version: 1, Regions: s.regions})
+	if err == nil {
+		err = atomicfile.WriteFile(s.path, data, 0600)
+	}
+	if err != nil {
+		s.logf("netcheck: saving DERP health history: %v", err)
+		return
+	}
+	s.dirty = false
+}
+
+// Flush writes s's history to disk, if it persists it and has recorded
+// anything since it last did.
+func (s *Scoreboard) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path != "" && s.dirty {
+		s.saveLocked(time.Now())
+	}
+}
+
+// RegionHealth summarizes a Scoreboard's history of a DERP region.
+type RegionHealth struct {
+	RegionID   int
+	RegionCode string
+	RegionName string
+
+	// Recent, Day and Week summarize the last 3 hours, 24 hours and 7
+	// days.
+	Recent HealthWindow
+	Day    HealthWindow
+	Week   HealthWindow
+
+	// Trend is how Recent compares with the rest of the week: "worse",
+	// "better" or "stable", or empty if there isn't enough history.
+	Trend string
+}
+
+// HealthWindow summarizes a Scoreboard's history of a DERP region over
+// a period.
+type HealthWindow struct {
+	// Checks is the number of full reports made, and Availability
+	// the fraction of them that heard back from the region.
+	Checks       int
+	Availability float64
+
+	// Latency is the mean latency to the region, or zero if unknown.
+	Latency time.Duration
+}
+
+// Health summarizes the history of each region in the most recently
+// recorded DERP map as of now, sorted by region ID.
+func (s *Scoreboard) Health(now time.Time) []RegionHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dm == nil {
+		return nil
+	}
+	recentCutoff := now.Add(-scoreboardRecent).Truncate(time.Hour).Unix()
+	dayCutoff := now.Add(-24 * time.Hour).Truncate(time.Hour).Unix()
+	ret := make([]RegionHealth, 0, len(s.dm.Regions))
+	for id, reg := range s.dm.Regions {
+		var recent, day, week, older healthBucket
+		for _, b := range s.regions[id] {
+			week.add(b)
+			if b.Hour >= dayCutoff {
+				day.add(b)
+			}
+			if b.Hour >= recentCutoff {
+				recent.add(b)
+			} else {
+				older.add(b)
+			}
+		}
+		ret = append(ret, RegionHealth{
+			RegionID:   id,
+			RegionCode: reg.RegionCode,
+			RegionName: reg.RegionName,
+			Recent:     recent.window(),
+			Day:        day.window(),
+			Week:       week.window(),
+			Trend:      healthTrend(recent.window(), older.window()),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RegionID < ret[j].RegionID })
+	return ret
+}
+
+func (b healthBucket) window() HealthWindow {
+	w := HealthWindow{Checks: b.Checks}
+	if b.Checks > 0 {
+		w.Availability = float64(b.Reachable) / float64(b.Checks)
+	}
+	if b.Latencies > 0 {
+		w.Latency = time.Duration(b.Latency/int64(b.Latencies)) * time.Microsecond
+	}
+	return w
+}
+
+// healthTrend compares a region's recent results with its older ones,
+// returning "worse", "better", "stable", or the empty string if either
+// has too few samples to tell.
+func healthTrend(recent, older HealthWindow) string {
+	const (
+		minRecent    = 3                     // full reports, ~15 minutes' worth
+		minOlder     = 12                    // full reports, ~an hour's worth
+		availChange  = 0.25                  // change in availability that counts
+		latencyRatio = 1.5                   // change in latency that counts...
+		latencyMin   = 20 * time.Millisecond // ...if it's also at least this much
+	)
+	if recent.Checks < minRecent || older.Checks < minOlder {
+		return ""
+	}
+	switch {
+	case recent.Availability < older.Availability-availChange:
+		return "worse"
+	case recent.Availability > older.Availability+availChange:
+		return "better"
+	}
+	if recent.Latency == 0 || older.Latency == 0 {
+		return "stable"
+	}
+	switch {
+	case float64(recent.Latency) > float64(older.Latency)*latencyRatio && recent.Latency-older.Latency >= latencyMin:
+		return "worse"
+	case float64(older.Latency) > float64(recent.Latency)*latencyRatio && older.Latency-recent.Latency >= latencyMin:
+		return "better"
+	}
+	return "stable"
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netcheck
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestScoreboard(t *testing.T) {
+	dm := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "one"},
+			2: {RegionID: 2, RegionCode: "two"},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "derp-health.json")
+	var s Scoreboard
+	s.SetPath(path, t.Logf)
+
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(8 * time.Hour)
+	for now := start; now.Before(end); now = now.Add(5 * time.Minute) {
+		r := &Report{
+			Full:          true,
+			RegionLatency: map[int]time.Duration{1: 10 * time.Millisecond},
+		}
+		if end.Sub(now) > scoreboardRecent {
+			r.RegionLatency[2] = 20 * time.Millisecond
+		}
+		s.Record(now, r, dm)
+		// Incremental reports count towards latency only.
+		s.Record(now, &Report{RegionLatency: map[int]time.Duration{1: 30 * time.Millisecond}}, dm)
+	}
+
+	h := s.Health(end)
+	if len(h) != 2 {
+		t.Fatalf("got %d regions; want 2", len(h))
+	}
+	if got, want := h[0].Trend, "stable"; got != want {
+		t.Errorf("region 1 trend = %q; want %q", got, want)
+	}
+	if got, want := h[0].Week.Latency, 20*time.Millisecond; got != want {
+		t.Errorf("region 1 latency = %v; want %v", got, want)
+	}
+	if got, want := h[0].Week.Checks, 96; got != want {
+		t.Errorf("region 1 checks = %v; want %v", got, want)
+	}
+	if got, want := h[1].Trend, "worse"; got != want {
+		t.Errorf("region 2 trend = %q; want %q", got, want)
+	}
+	if got := h[1].Recent.Availability; got != 0 {
+		t.Errorf("region 2 recent availability = %v; want 0", got)
+	}
+
+	s.Flush()
+	var s2 Scoreboard
+	s2.SetPath(path, t.Logf)
+	s2.Record(end, &Report{}, dm)
+	h2 := s2.Health(end)
+	if got, want := h2[1].Week, h[1].Week; got != want {
+		t.Errorf("reloaded region 2 = %+v; want %+v", got, want)
+	}
+
+	// History older than a week is forgotten.
+	s2.Record(end.Add(scoreboardRetention+time.Hour), &Report{}, dm)
+	if h := s2.Health(end.Add(scoreboardRetention + time.Hour)); h[0].Week.Checks != 0 {
+		t.Errorf("after a week, region 1 = %+v; want empty", h[0].Week)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ping times TCP and HTTPS requests to a host layer by layer:
+// how long the TCP connection takes to establish, the TLS handshake to
+// complete, and the server to send the first byte of its response. That
+// tells network path problems (slow connects) apart from application
+// problems (slow first bytes).
+package ping
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DialFunc dials a TCP connection to addr, a "host:port".
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Result is the timing of a TCP or HTTPS ping.
+type Result struct {
+	// Connect is how long the TCP connection took to establish.
+	Connect time.Duration
+
+	// TLSHandshake is how long the TLS handshake took, after
+	// connecting. It's zero for TCP pings.
+	TLSHandshake time.Duration
+
+	// FirstByte is how long the server took to send the first byte of
+	// its response, after the request was sent. It's zero for TCP
+	// pings.
+	FirstByte time.Duration
+
+	// Total is how long the whole ping took.
+	Total time.Duration
+
+	// StatusCode is the HTTP response status code, for HTTPS pings.
+	StatusCode int
+
+	// CertErr is the error verifying the server's certificate for
+	// the requested name, if any. The timings are still measured if
+	// verification fails.
+	CertErr error
+}
+
+// TCP times establishing a TCP connection to addr with dial.
+func TCP(ctx context.Context, dial DialFunc, addr string) (*Result, error) {
+	start := time.Now()
+	c, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d := time.Since(start)
+	c.Close()
+	return &Result{Connect: d, Total: d}, nil
+}
+
+// HTTPS times an HTTPS HEAD request for "/" to addr with dial. The server
+// name serverName is sent in the TLS handshake and the HTTP Host header,
+// and its certificate is verified for it.
+func HTTPS(ctx context.Context, dial DialFunc, addr, serverName string) (*Result, error) {
+	res := new(Result)
+	start := time.Now()
+	c, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	res.Connect = time.Since(start)
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+
+	conf := &tls.Config{
+		ServerName: serverName,
+		NextProtos: []string{"http/1.1"},
+		// Verified below, so a bad certificate is reported without
+		// losing the timings.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			res.CertErr = verifyCert(cs, serverName)
+			return nil
+		},
+	}
+	tlsStart := time.Now()
+	tc := tls.Client(c, conf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	res.TLSHandshake = time.Since(tlsStart)
+
+	reqStart := time.Now()
+	if _, err := fmt.Fprintf(tc, "HEAD / HTTP/1.1\r\nHost: %s\r\nUser-Agent: tailscale-ping\r\nConnection: close\r\n\r\n", serverName); err != nil {
+		return nil, fmt.Errorf("writing request: %w", err)
+	}
+	br := bufio.NewReader(tc)
+	if _, err := br.Peek(1); err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	res.FirstByte = time.Since(reqStart)
+	hres, err := http.ReadResponse(br, &http.Request{Method: "HEAD"})
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	hres.Body.Close()
+	res.StatusCode = hres.StatusCode
+	res.Total = time.Since(start)
+	return res, nil
+}
+
+func verifyCert(cs tls.ConnectionState, serverName string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var dialer net.Dialer
+
+func TestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := TCP(ctx, dialer.DialContext, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Connect <= 0 || res.Total != res.Connect || res.TLSHandshake != 0 {
+		t.Errorf("bad result: %+v", res)
+	}
+
+	ln.Close()
+	if _, err := TCP(ctx, dialer.DialContext, ln.Addr().String()); err == nil {
+		t.Error("TCP ping of closed port succeeded")
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.Host != "peer.example.ts.net" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr := strings.TrimPrefix(ts.URL, "https://")
+	res, err := HTTPS(ctx, dialer.DialContext, addr, "peer.example.ts.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusTeapot {
+		t.Errorf("StatusCode = %v; want %v", res.StatusCode, http.StatusTeapot)
+	}
+	if res.Connect <= 0 || res.TLSHandshake <= 0 || res.FirstByte <= 0 || res.Total < res.Connect+res.TLSHandshake+res.FirstByte {
+		t.Errorf("bad timings: %+v", res)
+	}
+	if res.CertErr == nil {
+		t.Error("no CertErr for the test server's self-signed certificate")
+	}
+}
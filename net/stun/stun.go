@@ -24,6 +24,12 @@
 	// like an easy mistake for a server to make.
 	// And servers appear to send it.
 	attrXorMappedAddressAlt = 0x8020
+	// attrReceivedTOS is a Tailscale-specific
+	// comprehension-optional attribute in which our
+	// STUN servers report the IP TOS byte of the
+	// request, so clients can tell whether their DSCP
+	// markings survived the path.
+	attrReceivedTOS = 0x80a1
 
 	software       = "tailnode" // notably: 8 bytes long, so no padding
 	bindingRequest = "\x00\x01"
@@ -190,6 +196,41 @@ func Response(txID TxID, ip net.IP, port uint16) []byte {
 	return b
 }
 
+// ResponseWithReceivedTOS is like Response, but also reports tos, the
+// IP TOS byte the request arrived with.
+func ResponseWithReceivedTOS(txID TxID, ip net.IP, port uint16, tos byte) []byte {
+	b := Response(txID, ip, port)
+	if b == nil {
+		return nil
+	}
+	b = appendU16(b, attrReceivedTOS)
+	b = appendU16(b, 1)
+	b = append(b, tos, 0, 0, 0) // padded to 4 bytes
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen))
+	return b
+}
+
+// ParseReceivedTOS returns the IP TOS byte that the STUN server reports
+// the request for binding response b arrived with. It reports false if
+// b isn't a binding response or the server didn't report one.
+func ParseReceivedTOS(b []byte) (tos byte, ok bool) {
+	if !Is(b) || b[0] != 0x01 || b[1] != 0x01 {
+		return 0, false
+	}
+	attrsLen := int(binary.BigEndian.Uint16(b[2:4]))
+	b = b[headerLen:]
+	if attrsLen > len(b) {
+		return 0, false
+	}
+	foreachAttr(b[:attrsLen], func(attrType uint16, a []byte) error {
+		if attrType == attrReceivedTOS && len(a) == 1 {
+			tos, ok = a[0], true
+		}
+		return nil
+	})
+	return tos, ok
+}
+
 // ParseResponse parses a successful binding response STUN packet.
 // The IP address is extracted from the XOR-MAPPED-ADDRESS attribute.
 // The returned addr slice is owned by the caller and does not alias b.
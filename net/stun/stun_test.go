@@ -275,3 +275,22 @@ func TestResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestResponseWithReceivedTOS(t *testing.T) {
+	tx := stun.NewTxID()
+	ip := net.ParseIP("1.2.3.4").To4()
+	res := stun.ResponseWithReceivedTOS(tx, ip, 1234, 0x88)
+	tx2, ip2, port2, err := stun.ParseResponse(res)
+	if err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+	if tx2 != tx || !bytes.Equal(ip2, ip) || port2 != 1234 {
+		t.Errorf("ParseResponse = %x, %v, %v; want %x, %v, 1234", tx2, net.IP(ip2), port2, tx, ip)
+	}
+	if tos, ok := stun.ParseReceivedTOS(res); !ok || tos != 0x88 {
+		t.Errorf("ParseReceivedTOS = %#x, %v; want 0x88, true", tos, ok)
+	}
+	if tos, ok := stun.ParseReceivedTOS(stun.Response(tx, ip, 1234)); ok {
+		t.Errorf("ParseReceivedTOS of plain response = %#x, true; want false", tos)
+	}
+}
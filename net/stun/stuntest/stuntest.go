@@ -15,6 +15,7 @@
 	"testing"
 
 	"inet.af/netaddr"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/stun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/nettype"
@@ -55,9 +56,29 @@ func ServeWithPacketListener(t testing.TB, ln nettype.PacketListener) (addr *net
 func runSTUN(t testing.TB, pc net.PacketConn, stats *stunStats, done chan<- struct{}) {
 	defer close(done)
 
+	// Report the TOS byte of requests, as our DERP servers do, where
+	// it's possible.
+	uc, _ := pc.(*net.UDPConn)
+	if uc != nil && dscp.EnableReceiveTOS(uc) != nil {
+		uc = nil
+	}
+
 	var buf [64 << 10]byte
 	for {
-		n, addr, err := pc.ReadFrom(buf[:])
+		var (
+			n       int
+			addr    net.Addr
+			tos     byte
+			haveTOS bool
+			err     error
+		)
+		if uc != nil {
+			var ua *net.UDPAddr
+			n, ua, tos, haveTOS, err = dscp.ReadFrom(uc, buf[:])
+			addr = ua
+		} else {
+			n, addr, err = pc.ReadFrom(buf[:])
+		}
 		if err != nil {
 			// TODO: when we switch to Go 1.16, replace this with errors.Is(err, net.ErrClosed)
 			if strings.Contains(err.Error(), "closed network connection") {
@@ -85,6 +106,9 @@ func runSTUN(t testing.TB, pc net.PacketConn, stats *stunStats, done chan<- stru
 		stats.mu.Unlock()
 
 		res := stun.Response(txid, ua.IP, uint16(ua.Port))
+		if haveTOS {
+			res = stun.ResponseWithReceivedTOS(txid, ua.IP, uint16(ua.Port), tos)
+		}
 		if _, err := pc.WriteTo(res, addr); err != nil {
 			t.Logf("STUN server write failed: %v", err)
 		}
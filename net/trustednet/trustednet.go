@@ -0,0 +1,249 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package trustednet detects whether the machine is on a network the user
+// has said they trust, identified by its Wi-Fi SSID, DNS search domain, or
+// the MAC address of its default gateway.
+package trustednet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/util/dnsname"
+)
+
+// Rule prefixes. A rule is one of these followed by the value to match,
+// such as "ssid:Office" or "gateway:00:11:22:33:44:55".
+const (
+	prefixSSID    = "ssid:"
+	prefixDNS     = "dns:"
+	prefixGateway = "gateway:"
+)
+
+// ParseRule reports whether s is a valid trusted network rule: one of
+// "ssid:<Wi-Fi network name>", "dns:<DNS search domain>" or
+// "gateway:<default gateway MAC address>".
+func ParseRule(s string) error {
+	switch {
+	case strings.HasPrefix(s, prefixSSID):
+		if len(s) == len(prefixSSID) {
+			return fmt.Errorf("trusted network %q: empty SSID", s)
+		}
+	case strings.HasPrefix(s, prefixDNS):
+		if len(s) == len(prefixDNS) {
+			return fmt.Errorf("trusted network %q: empty domain", s)
+		}
+		if _, err := dnsname.ToFQDN(s[len(prefixDNS):]); err != nil {
+			return fmt.Errorf("trusted network %q: %w", s, err)
+		}
+	case strings.HasPrefix(s, prefixGateway):
+		if normalizeMAC(s[len(prefixGateway):]) == "" {
+			return fmt.Errorf("trusted network %q: invalid MAC address", s)
+		}
+	default:
+		return fmt.Errorf("trusted network %q: want ssid:, dns: or gateway: prefix", s)
+	}
+	return nil
+}
+
+// Env describes the network the machine is currently on. Zero values mean
+// unknown or not applicable.
+type Env struct {
+	SSID        string   // current Wi-Fi network name
+	DNSSuffixes []string // DNS search domains or, on Windows, interfaces' DNS suffixes, without trailing dots
+	GatewayMAC  string   // default gateway's MAC address, in net.HardwareAddr.String form
+}
+
+// Match returns the first of rules that matches env.
+func Match(rules []string, env Env) (rule string, ok bool) {
+	for _, r := range rules {
+		switch {
+		case strings.HasPrefix(r, prefixSSID):
+			if env.SSID != "" && env.SSID == r[len(prefixSSID):] {
+				return r, true
+			}
+		case strings.HasPrefix(r, prefixDNS):
+			want := strings.TrimSuffix(r[len(prefixDNS):], ".")
+			for _, s := range env.DNSSuffixes {
+				if strings.EqualFold(s, want) {
+					return r, true
+				}
+			}
+		case strings.HasPrefix(r, prefixGateway):
+			mac := normalizeMAC(r[len(prefixGateway):])
+			if mac != "" && mac == env.GatewayMAC {
+				return r, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Detect returns a best-effort description of the current network.
+// It may run external commands, so shouldn't be called with locks held.
+func Detect() Env {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var env Env
+	env.SSID = detectSSID(ctx)
+	env.DNSSuffixes = detectDNSSuffixes()
+	if gw, _, ok := interfaces.LikelyHomeRouterIP(); ok {
+		env.GatewayMAC = gatewayMAC(ctx, gw)
+	}
+	return env
+}
+
+func output(ctx context.Context, name string, args ...string) []byte {
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func detectSSID(ctx context.Context) string {
+	switch runtime.GOOS {
+	case "linux":
+		if out := bytes.TrimSpace(output(ctx, "iwgetid", "-r")); len(out) > 0 {
+			return string(out)
+		}
+		// "yes:MyNetwork" for the active connection.
+		for _, line := range strings.Split(string(output(ctx, "nmcli", "-t", "-f", "active,ssid", "dev", "wifi")), "\n") {
+			if strings.HasPrefix(line, "yes:") {
+				return strings.TrimPrefix(line, "yes:")
+			}
+		}
+	case "darwin":
+		out := output(ctx, "/System/Library/PrivateFrameworks/Apple80211.framework/Versions/Current/Resources/airport", "-I")
+		return fieldValue(out, "SSID")
+	case "windows":
+		return fieldValue(output(ctx, "netsh", "wlan", "show", "interfaces"), "SSID")
+	}
+	return ""
+}
+
+// fieldValue returns the value of the first "key: value" line in b
+// whose key is key, with surrounding spaces trimmed.
+func fieldValue(b []byte, key string) string {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), ":")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// parseResolvConfSearch returns the domains from the "search" and
+// "domain" lines of the resolv.conf(5) contents b.
+func parseResolvConfSearch(b []byte) []string {
+	var ret []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 2 || (f[0] != "search" && f[0] != "domain") {
+			continue
+		}
+		for _, d := range f[1:] {
+			ret = append(ret, strings.TrimSuffix(d, "."))
+		}
+	}
+	return ret
+}
+
+func gatewayMAC(ctx context.Context, gw netaddr.IP) string {
+	var mac string
+	if runtime.GOOS == "linux" {
+		b, err := os.ReadFile("/proc/net/arp")
+		if err != nil {
+			return ""
+		}
+		mac = parseProcNetARP(b, gw)
+	} else {
+		// "arp -n" on macOS and "arp -a" on Windows both print the
+		// MAC as a field of the line mentioning the IP.
+		flag := "-n"
+		if runtime.GOOS == "windows" {
+			flag = "-a"
+		}
+		mac = findMAC(output(ctx, "arp", flag, gw.String()), gw)
+	}
+	return normalizeMAC(mac)
+}
+
+// normalizeMAC returns the 6-byte MAC address s in net.HardwareAddr.String
+// form, or the empty string if s isn't one. Unlike net.ParseMAC, it
+// accepts the single hex digit octets printed by macOS's arp, as in
+// "0:11:22:3:4:5".
+func normalizeMAC(s string) string {
+	sep := ":"
+	if strings.Contains(s, "-") {
+		sep = "-"
+	}
+	f := strings.Split(s, sep)
+	if len(f) != 6 {
+		return ""
+	}
+	for i, o := range f {
+		if len(o) == 1 {
+			f[i] = "0" + o
+		}
+	}
+	hw, err := net.ParseMAC(strings.Join(f, ":"))
+	if err != nil || len(hw) != 6 {
+		return ""
+	}
+	return hw.String()
+}
+
+// parseProcNetARP returns the hardware address of ip from the Linux
+// /proc/net/arp contents b.
+func parseProcNetARP(b []byte, ip netaddr.IP) string {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		// IP address  HW type  Flags  HW address  Mask  Device
+		f := strings.Fields(sc.Text())
+		if len(f) >= 4 && f[0] == ip.String() {
+			return f[3]
+		}
+	}
+	return ""
+}
+
+// findMAC returns the first field that parses as a MAC address on a line
+// of b that has ip (possibly in parentheses) as a field.
+func findMAC(b []byte, ip netaddr.IP) string {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		hasIP := false
+		for _, v := range f {
+			if strings.Trim(v, "()") == ip.String() {
+				hasIP = true
+				break
+			}
+		}
+		if !hasIP {
+			continue
+		}
+		for _, v := range f {
+			if normalizeMAC(v) != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
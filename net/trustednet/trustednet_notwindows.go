@@ -0,0 +1,19 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package trustednet
+
+import "os"
+
+// detectDNSSuffixes returns the search domains from resolv.conf.
+func detectDNSSuffixes() []string {
+	b, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	return parseResolvConfSearch(b)
+}
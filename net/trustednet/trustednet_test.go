@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trustednet
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, s := range []string{"ssid:Office Wi-Fi", "dns:corp.example.com", "dns:corp.example.com.", "gateway:00:11:22:aa:BB:cc", "gateway:00-11-22-aa-bb-cc"} {
+		if err := ParseRule(s); err != nil {
+			t.Errorf("ParseRule(%q) = %v; want nil", s, err)
+		}
+	}
+	for _, s := range []string{"", "Office", "ssid:", "dns:", "dns:bad..name", "gateway:nope", "mac:00:11:22:33:44:55"} {
+		if err := ParseRule(s); err == nil {
+			t.Errorf("ParseRule(%q) = nil; want error", s)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	env := Env{
+		SSID:        "Office",
+		DNSSuffixes: []string{"lan", "Corp.Example.com"},
+		GatewayMAC:  "00:11:22:aa:bb:cc",
+	}
+	tests := []struct {
+		rules []string
+		env   Env
+		want  string
+	}{
+		{nil, env, ""},
+		{[]string{"ssid:Home"}, env, ""},
+		{[]string{"ssid:Home", "ssid:Office"}, env, "ssid:Office"},
+		{[]string{"ssid:office"}, env, ""},
+		{[]string{"dns:corp.example.com."}, env, "dns:corp.example.com."},
+		{[]string{"gateway:00-11-22-AA-BB-CC"}, env, "gateway:00-11-22-AA-BB-CC"},
+		{[]string{"gateway:00:11:22:aa:bb:cd"}, env, ""},
+		{[]string{"ssid:Office", "dns:lan"}, Env{}, ""},
+	}
+	for _, tt := range tests {
+		got, ok := Match(tt.rules, tt.env)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("Match(%q) = %q, %v; want %q", tt.rules, got, ok, tt.want)
+		}
+	}
+}
+
+func TestParsers(t *testing.T) {
+	resolv := []byte("# generated\nnameserver 192.168.1.1\nsearch lan corp.example.com.\ndomain home.arpa\n")
+	if got, want := parseResolvConfSearch(resolv), []string{"lan", "corp.example.com", "home.arpa"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseResolvConfSearch = %q; want %q", got, want)
+	}
+
+	gw := netaddr.MustParseIP("192.168.1.1")
+	arp := []byte(`IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.10     0x1         0x2         aa:aa:aa:aa:aa:aa     *        wlan0
+192.168.1.1      0x1         0x2         00:11:22:aa:bb:cc     *        wlan0
+`)
+	if got, want := parseProcNetARP(arp, gw), "00:11:22:aa:bb:cc"; got != want {
+		t.Errorf("parseProcNetARP = %q; want %q", got, want)
+	}
+
+	macArp := []byte("? (192.168.1.1) at 0:11:22:a:bb:cc on en0 ifscope [ethernet]\n")
+	if got, want := normalizeMAC(findMAC(macArp, gw)), "00:11:22:0a:bb:cc"; got != want {
+		t.Errorf("macOS arp MAC = %q; want %q", got, want)
+	}
+	winArp := []byte("Interface: 192.168.1.20 --- 0x5\n  192.168.1.10          aa-aa-aa-aa-aa-aa     dynamic\n  Internet Address      Physical Address      Type\n  192.168.1.1           00-11-22-aa-bb-cc     dynamic\n")
+	if got, want := normalizeMAC(findMAC(winArp, gw)), "00:11:22:aa:bb:cc"; got != want {
+		t.Errorf("Windows arp MAC = %q; want %q", got, want)
+	}
+
+	netsh := []byte("    Name                   : Wi-Fi\n    SSID                   : Office Wi-Fi\n    BSSID                  : 00:11:22:33:44:55\n")
+	if got, want := fieldValue(netsh, "SSID"), "Office Wi-Fi"; got != want {
+		t.Errorf("fieldValue = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trustednet
+
+import (
+	"strings"
+
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"tailscale.com/net/interfaces"
+)
+
+// detectDNSSuffixes returns the DNS suffixes of the interfaces that
+// are up, other than Tailscale's: each one's connection-specific
+// suffix (usually from DHCP) and its suffix search list. These are
+// what "ipconfig /all" shows.
+func detectDNSSuffixes() []string {
+	ifs, err := interfaces.NonTailscaleInterfaces()
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	seen := map[string]bool{}
+	add := func(s string) {
+		s = strings.TrimSuffix(s, ".")
+		if s != "" && !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	for _, iface := range ifs {
+		if iface.OperStatus != winipcfg.IfOperStatusUp {
+			continue
+		}
+		add(iface.DNSSuffix())
+		for suf := iface.FirstDNSSuffix; suf != nil; suf = suf.Next {
+			add(suf.String())
+		}
+	}
+	return ret
+}
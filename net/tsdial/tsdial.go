@@ -43,6 +43,11 @@ type Dialer struct {
 	// If nil, it's not used.
 	NetstackDialTCP func(context.Context, netaddr.IPPort) (net.Conn, error)
 
+	// SystemDialFunc, if non-nil, replaces the OS dialer that
+	// SystemDial uses, for running in network environments where the
+	// host's own network stack can't reach control.
+	SystemDialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	peerDialControlFuncAtomic atomic.Value // of func() func(network, address string, c syscall.RawConn) error
 
 	peerClientOnce sync.Once
@@ -278,14 +283,20 @@ func (d *Dialer) SystemDial(ctx context.Context, network, addr string) (net.Conn
 		return nil, net.ErrClosed
 	}
 
-	d.netnsDialerOnce.Do(func() {
-		logf := d.Logf
-		if logf == nil {
-			logf = logger.Discard
-		}
-		d.netnsDialer = netns.NewDialer(logf)
-	})
-	c, err := d.netnsDialer.DialContext(ctx, network, addr)
+	var c net.Conn
+	var err error
+	if d.SystemDialFunc != nil {
+		c, err = d.SystemDialFunc(ctx, network, addr)
+	} else {
+		d.netnsDialerOnce.Do(func() {
+			logf := d.Logf
+			if logf == nil {
+				logf = logger.Discard
+			}
+			d.netnsDialer = netns.NewDialer(logf)
+		})
+		c, err = d.netnsDialer.DialContext(ctx, network, addr)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -7,11 +7,20 @@
 package tshttpproxy
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
+
+	"tailscale.com/types/logger"
 )
 
 // InvalidateCache invalidates the package-level cache for ProxyFromEnvironment.
@@ -41,7 +50,25 @@ func setNoProxyUntil(d time.Duration) {
 // For example, WPAD PAC files on Windows.
 var sysProxyFromEnv func(*http.Request) (*url.URL, error)
 
+// sysPolicyProxy, if non-nil, returns the proxy explicitly configured
+// by a system administrator (for example, via Windows Group Policy),
+// or the empty string if there isn't one. An explicitly configured
+// proxy takes precedence over the environment and autodetection.
+var sysPolicyProxy func() string
+
+// ProxyFromEnvironment returns the proxy to use for req, if any.
+//
+// In order of precedence, it uses the proxy from system policy (see
+// PolicyProxy), the standard HTTPS_PROXY, HTTP_PROXY, and NO_PROXY
+// environment variables, and then the platform's own proxy settings,
+// such as WinHTTP's on Windows.
 func ProxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	if u, err := PolicyProxy(); err != nil {
+		return nil, err
+	} else if u != nil && !isLoopbackRequest(req) {
+		return u, nil
+	}
+
 	mu.Lock()
 	noProxyTime := noProxyUntil
 	mu.Unlock()
@@ -64,6 +91,60 @@ func ProxyFromEnvironment(req *http.Request) (*url.URL, error) {
 	return nil, err
 }
 
+// PolicyProxy returns the proxy explicitly configured by system
+// policy, or nil if there isn't one. On Windows, the policy is the
+// "HTTPSProxy" string value, in Tailscale's registry policy key, of a
+// proxy URL or host:port.
+func PolicyProxy() (*url.URL, error) {
+	if sysPolicyProxy == nil {
+		return nil, nil
+	}
+	v := strings.TrimSpace(sysPolicyProxy())
+	if v == "" {
+		return nil, nil
+	}
+	u, err := parseProxy(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q in system policy: %w", v, err)
+	}
+	return u, nil
+}
+
+// parseProxy parses v, a proxy specified as either a URL or a bare
+// host:port, which is assumed to be an HTTP proxy.
+func parseProxy(v string) (*url.URL, error) {
+	if !strings.Contains(v, "://") {
+		v = "http://" + v
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no proxy host")
+	}
+	return u, nil
+}
+
+// isLoopbackRequest reports whether req is to localhost, which is
+// never proxied.
+func isLoopbackRequest(req *http.Request) bool {
+	if req.URL == nil {
+		return false
+	}
+	host := req.URL.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 var sysAuthHeader func(*url.URL) (string, error)
 
 // GetAuthHeader returns the Authorization header value to send to proxy u.
@@ -87,6 +168,228 @@ func GetAuthHeader(u *url.URL) (string, error) {
 	return "", nil
 }
 
+// sysNewAuthSession, if non-nil, returns a platform-specific
+// authSession for proxy u, such as NTLM or Negotiate on Windows.
+var sysNewAuthSession func(u *url.URL) authSession
+
+// authSession is a platform's implementation of a possibly
+// multi-step proxy authentication exchange.
+type authSession interface {
+	// respond returns the next Proxy-Authorization value given the
+	// Proxy-Authenticate challenges of a 407 response, or the empty
+	// string if it can't continue the exchange.
+	respond(challenges []string) (string, error)
+	close()
+}
+
+// ConnectAuth is the state of a proxy authentication exchange for a
+// single CONNECT request. Some schemes, like NTLM, take multiple
+// round trips on the same connection, in which case the caller sends
+// the CONNECT again for each 407 response that Respond answers.
+//
+// It's used by callers that send their own CONNECT requests, such as
+// the DERP client. The zero value is not valid; use NewConnectAuth.
+type ConnectAuth struct {
+	u    *url.URL
+	sess authSession // or nil
+	legs int
+}
+
+// maxAuthLegs is the maximum number of CONNECT requests a ConnectAuth
+// participates in. NTLM, the chattiest supported scheme, needs three.
+const maxAuthLegs = 3
+
+// NewConnectAuth returns a new ConnectAuth for proxy u. The caller
+// must call Close when done with it.
+func NewConnectAuth(u *url.URL) *ConnectAuth {
+	a := &ConnectAuth{u: u}
+	if sysNewAuthSession != nil && u.User == nil {
+		a.sess = sysNewAuthSession(u)
+	}
+	return a
+}
+
+// Initial returns the Proxy-Authorization header value to send with
+// the first CONNECT request, or the empty string for none.
+func (a *ConnectAuth) Initial() (string, error) {
+	a.legs++
+	return GetAuthHeader(a.u)
+}
+
+// Respond returns the Proxy-Authorization header value to send with
+// the next CONNECT request in response to res, a 407 response to the
+// previous one. It returns the empty string if authentication can't
+// proceed, in which case the caller should give up.
+func (a *ConnectAuth) Respond(res *http.Response) (string, error) {
+	if a.sess == nil || res.StatusCode != http.StatusProxyAuthRequired || a.legs >= maxAuthLegs {
+		return "", nil
+	}
+	a.legs++
+	return a.sess.respond(res.Header.Values("Proxy-Authenticate"))
+}
+
+// Close releases any resources associated with a.
+func (a *ConnectAuth) Close() {
+	if a.sess != nil {
+		a.sess.close()
+	}
+}
+
+// Connect asks the HTTP proxy pu, which c is connected to, to open a
+// tunnel to target (a "host:port") with CONNECT requests, answering
+// its authentication challenges with a ConnectAuth. It returns nil once
+// the tunnel is open, after which c carries the tunneled traffic.
+//
+// If ctx is done before then, c is closed.
+func Connect(ctx context.Context, c net.Conn, pu *url.URL, target string, logf logger.Logf) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			c.Close()
+		}
+	}()
+
+	auth := NewConnectAuth(pu)
+	defer auth.Close()
+	authVal, err := auth.Initial()
+	if err != nil {
+		logf("error getting proxy auth header for %v: %v", pu, err)
+	}
+
+	br := bufio.NewReader(c)
+	for {
+		var authHeader string
+		if authVal != "" {
+			authHeader = fmt.Sprintf("Proxy-Authorization: %s\r\n", authVal)
+		}
+		if _, err := fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", target, pu.Hostname(), authHeader); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logf("CONNECT dial to %s: %v", target, err)
+			return err
+		}
+		logf("CONNECT dial to %s: %v", target, res.Status)
+		if res.StatusCode == 200 {
+			return nil
+		}
+		// Connection-oriented schemes like NTLM need the next leg
+		// on the same connection, so only continue if the proxy
+		// kept it open.
+		authVal = ""
+		if res.StatusCode == http.StatusProxyAuthRequired && !res.Close {
+			if _, err := io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10)); err == nil {
+				authVal, err = auth.Respond(res)
+				if err != nil {
+					logf("error responding to proxy auth challenge from %v: %v", pu, err)
+				}
+			}
+		}
+		res.Body.Close()
+		if authVal == "" {
+			return fmt.Errorf("invalid response status from HTTP proxy %s on CONNECT to %s: %v", pu, target, res.Status)
+		}
+	}
+}
+
+// SetTransportConnectAuth makes tr open the CONNECT tunnels for its
+// https:// requests itself, with Connect, rather than leaving them to
+// net/http, whose single CONNECT request can't complete multi-step
+// authentication schemes like NTLM and Negotiate. tr.Proxy still picks
+// the proxy, and http:// requests are still proxied by net/http.
+//
+// It wraps tr.Proxy, tr.DialContext and tr.DialTLSContext, so it must
+// be called after they're set.
+func SetTransportConnectAuth(tr *http.Transport, logf logger.Logf) {
+	proxy := tr.Proxy
+	if proxy == nil {
+		return
+	}
+	dial := tr.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	// tlsClient is what net/http would do with a conn to host
+	// without a DialTLSContext. It's also used for proxies, as
+	// net/http does, but with their own server name.
+	tlsClient := func(ctx context.Context, c net.Conn, host string, isProxy bool) (net.Conn, error) {
+		conf := tr.TLSClientConfig.Clone()
+		if conf == nil {
+			conf = new(tls.Config)
+		}
+		if conf.ServerName == "" || isProxy {
+			conf.ServerName = host
+		}
+		tc := tls.Client(c, conf)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+	dialTLS := tr.DialTLSContext
+	if dialTLS == nil {
+		dialTLS = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			host, _, _ := net.SplitHostPort(addr)
+			return tlsClient(ctx, c, host, false)
+		}
+	}
+
+	tr.Proxy = func(req *http.Request) (*url.URL, error) {
+		if req.URL.Scheme == "https" {
+			return nil, nil // tunneled by DialTLSContext
+		}
+		return proxy(req)
+	}
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		pu, err := proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}, Header: make(http.Header)})
+		if err != nil {
+			return nil, err
+		}
+		if pu == nil {
+			return dialTLS(ctx, network, addr)
+		}
+		port := pu.Port()
+		if port == "" {
+			port = "80"
+			if pu.Scheme == "https" {
+				port = "443"
+			}
+		}
+		c, err := dial(ctx, "tcp", net.JoinHostPort(pu.Hostname(), port))
+		if err != nil {
+			return nil, err
+		}
+		if pu.Scheme == "https" {
+			if c, err = tlsClient(ctx, c, pu.Hostname(), true); err != nil {
+				return nil, err
+			}
+		}
+		if err := Connect(ctx, c, pu, addr, logf); err != nil {
+			c.Close()
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		return tlsClient(ctx, c, host, false)
+	}
+}
+
 var condSetTransportGetProxyConnectHeader func(*http.Transport)
 
 // SetTarnsportGetProxyConnectHeader sets the provided Transport's
@@ -5,6 +5,13 @@
 package tshttpproxy
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"runtime"
 	"strings"
@@ -51,3 +58,212 @@ func TestGetAuthHeaderBasicAuth(t *testing.T) {
 		t.Fatalf("GetAuthHeader(%q) = %q; want %q", proxyURL, got, want)
 	}
 }
+
+func TestPolicyProxy(t *testing.T) {
+	old := sysPolicyProxy
+	defer func() { sysPolicyProxy = old }()
+
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{policy: "", want: ""},
+		{policy: "proxy.corp:3128", want: "http://proxy.corp:3128"},
+		{policy: " https://proxy.corp ", want: "https://proxy.corp"},
+		{policy: "socks5://proxy.corp:1080", wantErr: true},
+		{policy: "http://", wantErr: true},
+	}
+	for _, tt := range tests {
+		sysPolicyProxy = func() string { return tt.policy }
+		u, err := PolicyProxy()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("PolicyProxy(%q) error = %v; want error %v", tt.policy, err, tt.wantErr)
+			continue
+		}
+		var got string
+		if u != nil {
+			got = u.String()
+		}
+		if got != tt.want {
+			t.Errorf("PolicyProxy(%q) = %q; want %q", tt.policy, got, tt.want)
+		}
+	}
+
+	sysPolicyProxy = func() string { return "proxy.corp:3128" }
+	for _, tt := range []struct {
+		url  string
+		want string
+	}{
+		{"https://controlplane.tailscale.com/key", "http://proxy.corp:3128"},
+		{"http://127.0.0.1:8080/", ""},
+		{"http://localhost/", ""},
+	} {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := ProxyFromEnvironment(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if u != nil {
+			got = u.String()
+		}
+		if got != tt.want {
+			t.Errorf("ProxyFromEnvironment(%q) = %q; want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+type fakeAuthSession struct {
+	challenges []string
+	closed     bool
+}
+
+func (s *fakeAuthSession) respond(challenges []string) (string, error) {
+	s.challenges = append(s.challenges, challenges...)
+	return "Fake " + challenges[0], nil
+}
+
+func (s *fakeAuthSession) close() { s.closed = true }
+
+func TestConnectAuth(t *testing.T) {
+	old := sysNewAuthSession
+	defer func() { sysNewAuthSession = old }()
+	sess := new(fakeAuthSession)
+	sysNewAuthSession = func(*url.URL) authSession { return sess }
+
+	u, _ := url.Parse("http://proxy.corp:3128")
+	a := NewConnectAuth(u)
+	if _, err := a.Initial(); err != nil {
+		t.Fatal(err)
+	}
+	challenge := func(v string) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusProxyAuthRequired,
+			Header:     http.Header{"Proxy-Authenticate": {v}},
+		}
+	}
+	for i, want := range []string{"Fake leg1", "Fake leg2", ""} {
+		got, err := a.Respond(challenge("leg" + string(rune('1'+i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("leg %d: Respond = %q; want %q", i+2, got, want)
+		}
+	}
+	if got, _ := a.Respond(&http.Response{StatusCode: http.StatusForbidden}); got != "" {
+		t.Errorf("Respond to 403 = %q; want empty", got)
+	}
+	a.Close()
+	if !sess.closed {
+		t.Error("session not closed")
+	}
+}
+
+// ntlmProxy is a CONNECT-only proxy that needs two legs of
+// authentication on the same connection, as NTLM does.
+func ntlmProxy(t *testing.T) (proxyURL *url.URL, connects func() int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	nconnect := make(chan int, 1)
+	nconnect <- 0
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil || req.Method != "CONNECT" {
+						return
+					}
+					nconnect <- <-nconnect + 1
+					if req.Header.Get("Proxy-Authorization") != "Fake NTLM challenge" {
+						io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM challenge\r\nContent-Length: 0\r\n\r\n")
+						continue
+					}
+					dst, err := net.Dial("tcp", req.Host)
+					if err != nil {
+						return
+					}
+					defer dst.Close()
+					io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+					go io.Copy(dst, br)
+					io.Copy(c, dst)
+					return
+				}
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}, func() int {
+		n := <-nconnect
+		nconnect <- n
+		return n
+	}
+}
+
+func TestSetTransportConnectAuth(t *testing.T) {
+	old := sysNewAuthSession
+	defer func() { sysNewAuthSession = old }()
+	sysNewAuthSession = func(*url.URL) authSession { return new(fakeAuthSession) }
+	oldHeader := sysAuthHeader
+	defer func() { sysAuthHeader = oldHeader }()
+	sysAuthHeader = nil
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	pu, connects := ntlmProxy(t)
+
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyURL(pu)
+	SetTransportConnectAuth(tr, t.Logf)
+	defer tr.CloseIdleConnections()
+	res, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "ok" {
+		t.Errorf("body = %q; want ok", body)
+	}
+	if got := connects(); got != 2 {
+		t.Errorf("proxy got %d CONNECTs; want 2", got)
+	}
+}
+
+func TestConnectGivesUp(t *testing.T) {
+	old := sysNewAuthSession
+	defer func() { sysNewAuthSession = old }()
+	sysNewAuthSession = nil // no multi-step auth available
+	oldHeader := sysAuthHeader
+	defer func() { sysAuthHeader = oldHeader }()
+	sysAuthHeader = nil
+
+	pu, connects := ntlmProxy(t)
+	c, err := net.Dial("tcp", pu.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = Connect(context.Background(), c, pu, "example.com:443", t.Logf)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprint(http.StatusProxyAuthRequired)) {
+		t.Errorf("Connect = %v; want 407 error", err)
+	}
+	if got := connects(); got != 1 {
+		t.Errorf("proxy got %d CONNECTs; want 1", got)
+	}
+}
@@ -19,11 +19,14 @@
 	"time"
 	"unsafe"
 
+	"github.com/alexbrainman/sspi"
 	"github.com/alexbrainman/sspi/negotiate"
+	"github.com/alexbrainman/sspi/ntlm"
 	"golang.org/x/sys/windows"
 	"tailscale.com/hostinfo"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/cmpver"
+	"tailscale.com/util/winutil"
 )
 
 var (
@@ -36,6 +39,8 @@
 func init() {
 	sysProxyFromEnv = proxyFromWinHTTPOrCache
 	sysAuthHeader = sysAuthHeaderWindows
+	sysNewAuthSession = newSSPIAuthSession
+	sysPolicyProxy = func() string { return winutil.GetPolicyString("HTTPSProxy", "") }
 }
 
 var cachedProxy struct {
@@ -263,3 +268,124 @@ func sysAuthHeaderWindows(u *url.URL) (string, error) {
 
 	return "Negotiate " + base64.StdEncoding.EncodeToString(token), nil
 }
+
+// sspiAuthSession is an authSession that answers Negotiate or NTLM
+// challenges using the current user's credentials.
+type sspiAuthSession struct {
+	spn    string
+	scheme string // "Negotiate" or "NTLM", once chosen
+
+	creds   *sspi.Credentials
+	negCtx  *negotiate.ClientContext
+	ntlmCtx *ntlm.ClientContext
+}
+
+func newSSPIAuthSession(u *url.URL) authSession {
+	return &sspiAuthSession{spn: "HTTP/" + u.Hostname()}
+}
+
+// challengeToken returns the token in challenges for scheme. The found
+// result reports whether scheme was offered at all; the token is nil
+// if it was offered without one, as in the first leg.
+func challengeToken(challenges []string, scheme string) (token []byte, found bool, err error) {
+	for _, c := range challenges {
+		name, rest, _ := strings.Cut(strings.TrimSpace(c), " ")
+		if !strings.EqualFold(name, scheme) {
+			continue
+		}
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			return nil, true, nil
+		}
+		token, err = base64.StdEncoding.DecodeString(rest)
+		return token, true, err
+	}
+	return nil, false, nil
+}
+
+func (s *sspiAuthSession) respond(challenges []string) (string, error) {
+	if s.scheme == "" {
+		for _, scheme := range []string{"Negotiate", "NTLM"} {
+			if _, ok, _ := challengeToken(challenges, scheme); ok {
+				s.scheme = scheme
+				break
+			}
+		}
+		if s.scheme == "" {
+			return "", nil
+		}
+	}
+	in, ok, err := challengeToken(challenges, s.scheme)
+	if err != nil {
+		return "", fmt.Errorf("decoding %s challenge: %w", s.scheme, err)
+	}
+	if !ok {
+		return "", nil
+	}
+	var out []byte
+	if in == nil || (s.negCtx == nil && s.ntlmCtx == nil) {
+		// (Re)start the exchange.
+		s.close()
+		out, err = s.start()
+	} else {
+		out, err = s.update(in)
+	}
+	if err != nil || len(out) == 0 {
+		return "", err
+	}
+	return s.scheme + " " + base64.StdEncoding.EncodeToString(out), nil
+}
+
+func (s *sspiAuthSession) start() (out []byte, err error) {
+	switch s.scheme {
+	case "Negotiate":
+		s.creds, err = negotiate.AcquireCurrentUserCredentials()
+		if err != nil {
+			return nil, fmt.Errorf("negotiate.AcquireCurrentUserCredentials: %w", err)
+		}
+		s.negCtx, out, err = negotiate.NewClientContext(s.creds, s.spn)
+		if err != nil {
+			return nil, fmt.Errorf("negotiate.NewClientContext: %w", err)
+		}
+	default:
+		s.creds, err = ntlm.AcquireCurrentUserCredentials()
+		if err != nil {
+			return nil, fmt.Errorf("ntlm.AcquireCurrentUserCredentials: %w", err)
+		}
+		s.ntlmCtx, out, err = ntlm.NewClientContext(s.creds)
+		if err != nil {
+			return nil, fmt.Errorf("ntlm.NewClientContext: %w", err)
+		}
+	}
+	return out, nil
+}
+
+func (s *sspiAuthSession) update(in []byte) (out []byte, err error) {
+	if s.negCtx != nil {
+		_, out, err = s.negCtx.Update(in)
+		if err != nil {
+			return nil, fmt.Errorf("negotiate update: %w", err)
+		}
+		return out, nil
+	}
+	out, err = s.ntlmCtx.Update(in)
+	if err != nil {
+		return nil, fmt.Errorf("ntlm update: %w", err)
+	}
+	return out, nil
+}
+
+func (s *sspiAuthSession) close() {
+	if s.negCtx != nil {
+		s.negCtx.Release()
+		s.negCtx = nil
+	}
+	if s.ntlmCtx != nil {
+		s.ntlmCtx.Release()
+		s.ntlmCtx = nil
+	}
+	if s.creds != nil {
+		s.creds.Release()
+		s.creds = nil
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+// An Impairment makes a Wrapper degrade the packets to and from a peer
+// the way a bad network would, to reproduce problems reported on one.
+// It's a debugging aid; see Wrapper.SetImpairment.
+type Impairment struct {
+	Loss    float64       // fraction of packets dropped, from 0 to 1
+	Latency time.Duration // delay added to each packet
+	Jitter  time.Duration // extra delay, chosen uniformly from [0, Jitter)
+
+	// Seed seeds the random drops and jitter, so that the same
+	// traffic is impaired the same way each time.
+	Seed int64
+}
+
+// maxImpairDelay bounds Impairment.Latency+Jitter, and
+// maxImpairDelayed the number of packets delayed at once, so a typo
+// can't hold onto unbounded memory.
+const (
+	maxImpairDelay   = 10 * time.Second
+	maxImpairDelayed = 4096
+)
+
+// IsZero reports whether im leaves packets alone.
+func (im Impairment) IsZero() bool {
+	return im.Loss == 0 && im.Latency == 0 && im.Jitter == 0
+}
+
+// Validate reports whether im is in range.
+func (im Impairment) Validate() error {
+	if im.Loss < 0 || im.Loss > 1 {
+		return errors.New("loss must be between 0 and 1")
+	}
+	if im.Latency < 0 || im.Jitter < 0 {
+		return errors.New("latency and jitter can't be negative")
+	}
+	if im.Latency+im.Jitter > maxImpairDelay {
+		return fmt.Errorf("latency plus jitter can't exceed %v", maxImpairDelay)
+	}
+	return nil
+}
+
+func (im Impairment) String() string {
+	var parts []string
+	if im.Loss > 0 {
+		parts = append(parts, fmt.Sprintf("loss=%g%%", im.Loss*100))
+	}
+	if im.Latency > 0 {
+		parts = append(parts, fmt.Sprintf("latency=%v", im.Latency))
+	}
+	if im.Jitter > 0 {
+		parts = append(parts, fmt.Sprintf("jitter=%v", im.Jitter))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// impairer applies an Impairment.
+type impairer struct {
+	Impairment
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// decide returns whether to drop a packet, and otherwise how long to
+// delay it.
+func (im *impairer) decide() (drop bool, delay time.Duration) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.Loss > 0 && im.rnd.Float64() < im.Loss {
+		return true, 0
+	}
+	delay = im.Latency
+	if im.Jitter > 0 {
+		delay += time.Duration(im.rnd.Int63n(int64(im.Jitter)))
+	}
+	return false, delay
+}
+
+// SetImpairment makes t impair the packets it carries to and from peer,
+// a peer's Tailscale IP or an address routed through a peer, in both
+// directions. The zero IP sets the impairment for all peers without
+// their own. A zero im removes peer's impairment.
+func (t *Wrapper) SetImpairment(peer netaddr.IP, im Impairment) error {
+	if err := im.Validate(); err != nil {
+		return err
+	}
+	t.impairMu.Lock()
+	defer t.impairMu.Unlock()
+	old, _ := t.impairments.Load().(map[netaddr.IP]*impairer)
+	m := make(map[netaddr.IP]*impairer, len(old)+1)
+	for ip, v := range old {
+		m[ip] = v
+	}
+	if im.IsZero() {
+		delete(m, peer)
+	} else {
+		m[peer] = &impairer{Impairment: im, rnd: rand.New(rand.NewSource(im.Seed))}
+	}
+	t.impairments.Store(m)
+	return nil
+}
+
+// Impairments returns the impairments set by SetImpairment, by peer.
+func (t *Wrapper) Impairments() map[netaddr.IP]Impairment {
+	m, _ := t.impairments.Load().(map[netaddr.IP]*impairer)
+	ret := make(map[netaddr.IP]Impairment, len(m))
+	for ip, v := range m {
+		ret[ip] = v.Impairment
+	}
+	return ret
+}
+
+// impairerFor returns the impairer for packets to or from the remote
+// address ip, or nil if there is none.
+func (t *Wrapper) impairerFor(ip netaddr.IP) *impairer {
+	m, _ := t.impairments.Load().(map[netaddr.IP]*impairer)
+	if len(m) == 0 {
+		return nil
+	}
+	if im, ok := m[ip]; ok {
+		return im
+	}
+	return m[netaddr.IP{}]
+}
+
+// impair reports whether the packet pkt, to or from the remote address
+// ip, has been taken over by its impairment: dropped, or copied and
+// passed to resend after a delay.
+func (t *Wrapper) impair(ip netaddr.IP, pkt []byte, resend func([]byte)) bool {
+	im := t.impairerFor(ip)
+	if im == nil {
+		return false
+	}
+	drop, delay := im.decide()
+	if drop {
+		metricPacketDropImpair.Add(1)
+		return true
+	}
+	if delay <= 0 {
+		return false
+	}
+	if atomic.AddInt32(&t.impairDelayed, 1) > maxImpairDelayed {
+		atomic.AddInt32(&t.impairDelayed, -1)
+		metricPacketDropImpair.Add(1)
+		return true
+	}
+	pkt = append([]byte(nil), pkt...)
+	time.AfterFunc(delay, func() {
+		defer atomic.AddInt32(&t.impairDelayed, -1)
+		resend(pkt)
+	})
+	return true
+}
+
+// impairInbound is impair for the inbound packet in buf at offset.
+func (t *Wrapper) impairInbound(buf []byte, offset int) bool {
+	if m, _ := t.impairments.Load().(map[netaddr.IP]*impairer); len(m) == 0 {
+		return false // fast path; don't parse the packet
+	}
+	p := parsedPacketPool.Get().(*packet.Parsed)
+	defer parsedPacketPool.Put(p)
+	p.Decode(buf[offset:])
+	return t.impair(p.Src.IP(), buf[offset:], func(pkt []byte) {
+		b := make([]byte, PacketStartOffset+len(pkt))
+		copy(b[PacketStartOffset:], pkt)
+		t.write(b, PacketStartOffset)
+	})
+}
+
+// impairOutbound is impair for the outbound packet p.
+func (t *Wrapper) impairOutbound(p *packet.Parsed) bool {
+	return t.impair(p.Dst.IP(), p.Buffer(), func(pkt []byte) {
+		t.sendOutbound(tunReadResult{data: pkt, injected: true, impaired: true})
+	})
+}
@@ -52,7 +52,7 @@ func New(logf logger.Logf, tunName string) (tun.Device, string, error) {
 		}
 		dev, err = createTAP(tapName, bridgeName)
 	} else {
-		dev, err = tun.CreateTUN(tunName, tunMTU)
+		dev, err = createTUN(logf, tunName, tunMTU)
 	}
 	if err != nil {
 		return nil, "", err
@@ -7,7 +7,14 @@
 
 package tstun
 
-import "golang.zx2c4.com/wireguard/tun"
+import (
+	"golang.zx2c4.com/wireguard/tun"
+	"tailscale.com/types/logger"
+)
+
+func createTUN(logf logger.Logf, name string, mtu int) (tun.Device, error) {
+	return tun.CreateTUN(name, mtu)
+}
 
 func interfaceName(dev tun.Device) (string, error) {
 	return dev.Name()
@@ -5,9 +5,19 @@
 package tstun
 
 import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
 )
 
 func init() {
@@ -19,10 +29,190 @@ func init() {
 	tun.WintunStaticRequestedGUID = &guid
 }
 
+// luidDevice is implemented by *tun.NativeTun and *recreatingTUN.
+type luidDevice interface {
+	LUID() uint64
+}
+
 func interfaceName(dev tun.Device) (string, error) {
-	guid, err := winipcfg.LUID(dev.(*tun.NativeTun).LUID()).GUID()
+	ld, ok := dev.(luidDevice)
+	if !ok {
+		return "", errors.New("not a Wintun device")
+	}
+	guid, err := winipcfg.LUID(ld.LUID()).GUID()
 	if err != nil {
 		return "", err
 	}
 	return guid.String(), nil
 }
+
+// createTUN creates a Wintun adapter that's recreated automatically if it
+// dies.
+func createTUN(logf logger.Logf, name string, mtu int) (tun.Device, error) {
+	dev, err := tun.CreateTUN(name, mtu)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &recreatingTUN{
+		logf:   logger.WithPrefix(logf, "wintun: "),
+		name:   name,
+		mtu:    mtu,
+		events: make(chan tun.Event, 10),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	t.setDevLocked(dev.(*tun.NativeTun))
+	return t, nil
+}
+
+// recreatingTUN is a tun.Device for a Wintun adapter that replaces the
+// adapter with a new one when it dies underneath us, such as when the
+// Wintun driver is upgraded or after some sleep/resume driver bugs,
+// instead of leaving tailscaled with a stale handle until the service is
+// restarted.
+//
+// Recreating the adapter loses its addresses and routes. The router
+// restores them from a callback registered with SetRecreateCallback.
+type recreatingTUN struct {
+	logf   logger.Logf
+	name   string
+	mtu    int
+	events chan tun.Event
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+	dev    atomic.Value // of *tun.NativeTun
+	wg     sync.WaitGroup
+
+	mu         sync.Mutex // serializes recreation; guards following
+	closed     bool
+	onRecreate func()
+}
+
+func (t *recreatingTUN) native() *tun.NativeTun {
+	return t.dev.Load().(*tun.NativeTun)
+}
+
+// setDevLocked makes dev the current adapter. t.mu must be held, except
+// during construction.
+func (t *recreatingTUN) setDevLocked(dev *tun.NativeTun) {
+	t.dev.Store(dev)
+	t.wg.Add(1)
+	go t.forwardEvents(dev)
+}
+
+// forwardEvents forwards dev's events to t.events until dev or t is
+// closed.
+func (t *recreatingTUN) forwardEvents(dev *tun.NativeTun) {
+	defer t.wg.Done()
+	for ev := range dev.Events() {
+		select {
+		case t.events <- ev:
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// SetRecreateCallback sets f to be called, in its own goroutine, each time
+// the adapter has been recreated.
+func (t *recreatingTUN) SetRecreateCallback(f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onRecreate = f
+}
+
+// recreateAfter handles the error err returned by dev. It reports whether
+// the caller should retry its operation: true if dev has been replaced by
+// a new adapter, either by this call or a concurrent one, and false if t
+// is closed.
+func (t *recreatingTUN) recreateAfter(dev *tun.NativeTun, err error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.native() != dev {
+		return true
+	}
+	t.logf("adapter failed: %v; recreating", err)
+	metricWintunDied.Add(1)
+	// Closing the old adapter unblocks any concurrent Read on it,
+	// which then waits on t.mu and retries with the new one.
+	dev.Close()
+
+	bo := backoff.NewBackoff("wintun-recreate", t.logf, 30*time.Second)
+	for {
+		nd, err := tun.CreateTUN(t.name, t.mtu)
+		if err == nil {
+			if err = waitInterfaceUp(nd, 90*time.Second, t.logf); err != nil {
+				nd.Close()
+			}
+		}
+		if err == nil {
+			t.setDevLocked(nd.(*tun.NativeTun))
+			metricWintunRecreated.Add(1)
+			t.logf("adapter recreated")
+			if f := t.onRecreate; f != nil {
+				go f()
+			}
+			return true
+		}
+		if t.ctx.Err() != nil {
+			return false
+		}
+		bo.BackOff(t.ctx, err)
+		if t.ctx.Err() != nil {
+			return false
+		}
+	}
+}
+
+func (t *recreatingTUN) Read(buf []byte, offset int) (int, error) {
+	for {
+		dev := t.native()
+		n, err := dev.Read(buf, offset)
+		if err == nil || !t.recreateAfter(dev, err) {
+			return n, err
+		}
+	}
+}
+
+func (t *recreatingTUN) Write(buf []byte, offset int) (int, error) {
+	for {
+		dev := t.native()
+		n, err := dev.Write(buf, offset)
+		if err == nil || !t.recreateAfter(dev, err) {
+			return n, err
+		}
+	}
+}
+
+func (t *recreatingTUN) Close() error {
+	t.cancel() // stop any in-progress recreation
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.mu.Unlock()
+	err := t.native().Close()
+	t.wg.Wait()
+	close(t.events)
+	return err
+}
+
+func (t *recreatingTUN) File() *os.File                  { return nil }
+func (t *recreatingTUN) Flush() error                    { return nil }
+func (t *recreatingTUN) Events() chan tun.Event          { return t.events }
+func (t *recreatingTUN) Name() (string, error)           { return t.native().Name() }
+func (t *recreatingTUN) MTU() (int, error)               { return t.native().MTU() }
+func (t *recreatingTUN) ForceMTU(mtu int)                { t.native().ForceMTU(mtu) }
+func (t *recreatingTUN) LUID() uint64                    { return t.native().LUID() }
+func (t *recreatingTUN) RunningVersion() (uint32, error) { return t.native().RunningVersion() }
+
+var (
+	metricWintunDied      = clientmetric.NewCounter("tstun_wintun_adapter_died")
+	metricWintunRecreated = clientmetric.NewCounter("tstun_wintun_adapter_recreated")
+)
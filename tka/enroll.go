@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"tailscale.com/types/key"
+)
+
+// An Enrollment is a node key and the signature authorizing it, made on
+// a machine holding a trusted key so that another machine, which may
+// never be able to reach it, can join the locked tailnet with them.
+//
+// Since it contains a private key, an Enrollment is only moved between
+// machines in sealed form; see Seal and OpenEnrollment.
+type Enrollment struct {
+	NodeKey key.NodePrivate
+
+	// Signature is the serialized NodeKeySignature of NodeKey's public
+	// key.
+	Signature []byte
+}
+
+// NewEnrollment generates a new node key and signs it with signer.
+func NewEnrollment(signer ed25519.PrivateKey) *Enrollment {
+	nk := key.NewNode()
+	return &Enrollment{
+		NodeKey:   nk,
+		Signature: SignNodeKey(nk.Public(), signer).Serialize(),
+	}
+}
+
+// sealedEnrollmentPrefix starts the text form of a sealed Enrollment,
+// versioning its format.
+const sealedEnrollmentPrefix = "tsenroll1:"
+
+// Seal encrypts e with a key derived from passphrase, returning it in a
+// text form suitable for copying to the machine that will use it.
+func (e *Enrollment) Seal(passphrase []byte) ([]byte, error) {
+	plaintext, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return key.SealWithPassphrase(sealedEnrollmentPrefix, plaintext, passphrase)
+}
+
+// OpenEnrollment decrypts an Enrollment sealed with Seal.
+//
+// It doesn't check that the signature is made by a trusted key, which
+// the machine opening it may not know; only that it's for the node key.
+func OpenEnrollment(sealed, passphrase []byte) (*Enrollment, error) {
+	plaintext, err := key.OpenWithPassphrase(sealedEnrollmentPrefix, "enrollment", sealed, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	e := new(Enrollment)
+	if err := json.Unmarshal(plaintext, e); err != nil {
+		return nil, fmt.Errorf("decoding enrollment: %v", err)
+	}
+	if e.NodeKey.IsZero() {
+		return nil, errors.New("enrollment has no node key")
+	}
+	var s NodeKeySignature
+	if err := s.Unserialize(e.Signature); err != nil {
+		return nil, fmt.Errorf("decoding enrollment signature: %v", err)
+	}
+	if raw := e.NodeKey.Public().Raw32(); !bytes.Equal(s.Pubkey, raw[:]) {
+		return nil, errors.New("enrollment signature is for another node key")
+	}
+	return e, nil
+}
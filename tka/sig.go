@@ -0,0 +1,139 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/blake2s"
+	"tailscale.com/types/key"
+)
+
+// SigKind describes valid NodeKeySignature types.
+type SigKind uint8
+
+// Valid SigKind values. Do NOT reorder.
+const (
+	SigInvalid SigKind = iota
+	// SigDirect describes a signature over a specific node key, made
+	// by a key trusted by the TKA.
+	SigDirect
+)
+
+func (s SigKind) String() string {
+	switch s {
+	case SigInvalid:
+		return "invalid"
+	case SigDirect:
+		return "direct"
+	default:
+		return fmt.Sprintf("Sig?<%d>", int(s))
+	}
+}
+
+// NodeKeySignature authorizes a node key to be used in a tailnet with
+// network-lock enabled: nodes accept peers whose node key carries a
+// signature by a key trusted by the TKA.
+//
+// Because it's just a signature over the node key, it can be made ahead
+// of time on a machine holding a trusted key, and carried to the node
+// that will use it. See Enrollment.
+type NodeKeySignature struct {
+	// SigKind identifies the variety of signature.
+	SigKind SigKind `cbor:"1,keyasint"`
+	// Pubkey is the node key being authorized.
+	Pubkey []byte `cbor:"2,keyasint"`
+	// KeyID identifies the key in the TKA that made Signature.
+	KeyID KeyID `cbor:"3,keyasint"`
+	// Signature is the signature over the SigHash of the other fields.
+	Signature []byte `cbor:"4,keyasint,omitempty"`
+}
+
+// SigHash returns the cryptographic digest which a signature is over.
+//
+// This is the BLAKE2s digest of the serialized signature, sans the
+// Signature field.
+func (s NodeKeySignature) SigHash() [blake2s.Size]byte {
+	dupe := s
+	dupe.Signature = nil
+	return blake2s.Sum256(dupe.Serialize())
+}
+
+// Serialize returns the canonical CBOR encoding of s.
+func (s NodeKeySignature) Serialize() []byte {
+	out := bytes.NewBuffer(make([]byte, 0, 128))
+	encoder, err := cbor.CTAP2EncOptions().EncMode()
+	if err != nil {
+		// Deterministic validation of encoding options, should
+		// never fail.
+		panic(err)
+	}
+	if err := encoder.NewEncoder(out).Encode(s); err != nil {
+		// Writing to a bytes.Buffer should never fail.
+		panic(err)
+	}
+	return out.Bytes()
+}
+
+// Unserialize decodes a NodeKeySignature encoded by Serialize.
+func (s *NodeKeySignature) Unserialize(data []byte) error {
+	dec, err := cbor.DecOptions{
+		DupMapKey:   cbor.DupMapKeyEnforcedAPF,
+		IndefLength: cbor.IndefLengthForbidden,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return dec.Unmarshal(data, s)
+}
+
+// SignNodeKey returns a NodeKeySignature authorizing nodeKey, signed by
+// signer, whose public key must be a key trusted by the TKA for the
+// signature to be accepted.
+func SignNodeKey(nodeKey key.NodePublic, signer ed25519.PrivateKey) NodeKeySignature {
+	raw := nodeKey.Raw32()
+	pub := signer.Public().(ed25519.PublicKey)
+	s := NodeKeySignature{
+		SigKind: SigDirect,
+		Pubkey:  raw[:],
+		KeyID:   Key{Kind: Key25519, Public: pub}.ID(),
+	}
+	sigHash := s.SigHash()
+	s.Signature = ed25519.Sign(signer, sigHash[:])
+	return s
+}
+
+// verifySignature checks that s is a valid signature of nodeKey by
+// verificationKey.
+func (s NodeKeySignature) verifySignature(nodeKey key.NodePublic, verificationKey Key) error {
+	if s.SigKind != SigDirect {
+		return fmt.Errorf("unhandled signature type: %v", s.SigKind)
+	}
+	raw := nodeKey.Raw32()
+	if !bytes.Equal(s.Pubkey, raw[:]) {
+		return errors.New("signature does not authorize nodeKey")
+	}
+	sigHash := s.SigHash()
+	sig := Signature{KeyID: s.KeyID, Signature: s.Signature}
+	return sig.Verify(sigHash, verificationKey)
+}
+
+// NodeKeyAuthorized returns nil if nodeKeySignature, a serialized
+// NodeKeySignature, authorizes nodeKey with a key trusted by a.
+func (a *Authority) NodeKeyAuthorized(nodeKey key.NodePublic, nodeKeySignature []byte) error {
+	var s NodeKeySignature
+	if err := s.Unserialize(nodeKeySignature); err != nil {
+		return fmt.Errorf("unserializing signature: %v", err)
+	}
+	k, err := a.state.GetKey(s.KeyID)
+	if err != nil {
+		return fmt.Errorf("signing key: %w", err)
+	}
+	return s.verifySignature(nodeKey, k)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"testing"
+
+	"tailscale.com/types/key"
+)
+
+func TestNodeKeySignature(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	_, otherPriv := testingKey25519(t, 2)
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{{Kind: Key25519, Public: pub, Votes: 1}},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, priv)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	nk := key.NewNode().Public()
+	sig := SignNodeKey(nk, priv).Serialize()
+	if err := a.NodeKeyAuthorized(nk, sig); err != nil {
+		t.Errorf("NodeKeyAuthorized() failed: %v", err)
+	}
+	if err := a.NodeKeyAuthorized(key.NewNode().Public(), sig); err == nil {
+		t.Error("signature authorized a different node key")
+	}
+	if err := a.NodeKeyAuthorized(nk, SignNodeKey(nk, otherPriv).Serialize()); err == nil {
+		t.Error("signature by an untrusted key was accepted")
+	}
+
+	tampered := SignNodeKey(nk, priv)
+	tampered.Signature[0] ^= 1
+	if err := a.NodeKeyAuthorized(nk, tampered.Serialize()); err == nil {
+		t.Error("tampered signature was accepted")
+	}
+}
+
+func TestEnrollmentSeal(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	e := NewEnrollment(priv)
+	sealed, err := e.Seal([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, e.Signature) {
+		t.Error("sealed enrollment contains the plaintext signature")
+	}
+
+	if _, err := OpenEnrollment(sealed, []byte("hunter3")); err == nil {
+		t.Error("opened with the wrong passphrase")
+	}
+	got, err := OpenEnrollment(sealed, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("OpenEnrollment() failed: %v", err)
+	}
+	if !got.NodeKey.Equal(e.NodeKey) || !bytes.Equal(got.Signature, e.Signature) {
+		t.Errorf("OpenEnrollment() = %+v; want %+v", got, e)
+	}
+
+	var s NodeKeySignature
+	if err := s.Unserialize(got.Signature); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verifySignature(got.NodeKey.Public(), Key{Kind: Key25519, Public: pub}); err != nil {
+		t.Errorf("enrollment signature doesn't verify: %v", err)
+	}
+}
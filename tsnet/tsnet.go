@@ -37,6 +37,7 @@
 	"tailscale.com/net/tsdial"
 	"tailscale.com/smallzstd"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/netstack"
@@ -70,6 +71,25 @@ type Server struct {
 	// log.Printf is used.
 	Logf logger.Logf
 
+	// Logger, if non-nil, is a leveled logger to use instead of Logf.
+	Logger Logger
+
+	// Metrics, if non-nil, is sent the values of the client metrics
+	// periodically while the server runs.
+	Metrics MetricsSink
+
+	// SystemDial, if non-nil, replaces the host's dialer for the
+	// connections the server makes outside of the tailnet: to the
+	// control server and to the log server. (DERP and WireGuard
+	// traffic still uses the host's network stack.)
+	SystemDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// AllowRawICMP, if true, lets ListenPacket return conns for raw
+	// ICMP ("ip4:icmp" and "ip6:ipv6-icmp"), which can send any ICMP
+	// message to peers, such as the probes traceroute uses. Echo-only
+	// "ping4" and "ping6" conns are always allowed.
+	AllowRawICMP bool
+
 	// Ephemeral, if true, specifies that the instance should register
 	// as an Ephemeral node (https://tailscale.com/kb/1111/ephemeral-nodes/).
 	Ephemeral bool
@@ -84,6 +104,7 @@ type Server struct {
 	initOnce         sync.Once
 	initErr          error
 	lb               *ipnlocal.LocalBackend
+	netstack         *netstack.Impl
 	linkMon          *monitor.Mon
 	localAPIListener net.Listener
 	rootPath         string // the state directory
@@ -98,6 +119,31 @@ type Server struct {
 	dialer    *tsdial.Dialer
 }
 
+// Logger is a logger that's told each message's verbosity level. See
+// Server.Logger.
+type Logger interface {
+	// Log logs msg. Level 0 is for normal messages; 1 and higher
+	// are increasingly verbose. The "[v1] "-style level marker
+	// that tailscaled uses is removed from msg.
+	Log(level int, msg string)
+}
+
+// MetricsSink receives a Server's metrics. See Server.Metrics.
+//
+// The metrics are those of tailscale.com/util/clientmetric, which are
+// global to the process, not per Server.
+type MetricsSink interface {
+	// Gauge reports the current value of the named gauge.
+	Gauge(name string, value int64)
+
+	// Counter reports the current total of the named counter.
+	Counter(name string, value int64)
+}
+
+// metricsInterval is how often a Server reports metrics to its
+// MetricsSink.
+const metricsInterval = 15 * time.Second
+
 // Dial connects to the address on the tailnet.
 // It will start the server if it has not been started yet.
 func (s *Server) Dial(ctx context.Context, network, address string) (net.Conn, error) {
@@ -239,7 +285,7 @@ func (s *Server) start() error {
 			}
 			return w
 		},
-		HTTPC: &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost)},
+		HTTPC: &http.Client{Transport: s.logtailTransport()},
 	}
 	s.logtail = logtail.NewLogger(c, logf)
 
@@ -248,7 +294,7 @@ func (s *Server) start() error {
 		return err
 	}
 
-	s.dialer = new(tsdial.Dialer) // mutated below (before used)
+	s.dialer = &tsdial.Dialer{SystemDialFunc: s.SystemDial} // mutated below (before used)
 	eng, err := wgengine.NewUserspaceEngine(logf, wgengine.Config{
 		ListenPort:  0,
 		LinkMonitor: s.linkMon,
@@ -272,6 +318,7 @@ func (s *Server) start() error {
 	if err := ns.Start(); err != nil {
 		return fmt.Errorf("failed to start netstack: %w", err)
 	}
+	s.netstack = ns
 	s.dialer.UseNetstackForIP = func(ip netaddr.IP) bool {
 		_, ok := eng.PeerForIP(ip)
 		return ok
@@ -323,6 +370,9 @@ func (s *Server) start() error {
 		logf("Authkey is set; but state is %v. Ignoring authkey. Re-run with TSNET_FORCE_LOGIN=1 to force use of authkey.", st)
 	}
 	go s.printAuthURLLoop()
+	if s.Metrics != nil {
+		go s.reportMetricsLoop()
+	}
 
 	// Run the localapi handler, to allow fetching LetsEncrypt certs.
 	lah := localapi.NewHandler(lb, logf, logid)
@@ -343,10 +393,22 @@ func (s *Server) start() error {
 	return nil
 }
 
+func (s *Server) logtailTransport() *http.Transport {
+	tr := logpolicy.NewLogtailTransport(logtail.DefaultHost)
+	if s.SystemDial != nil {
+		tr.DialContext = s.SystemDial
+	}
+	return tr
+}
+
 func (s *Server) logf(format string, a ...interface{}) {
 	if s.logtail != nil {
 		s.logtail.Logf(format, a...)
 	}
+	if s.Logger != nil {
+		s.Logger.Log(logLevel(fmt.Sprintf(format, a...)))
+		return
+	}
 	if s.Logf != nil {
 		s.Logf(format, a...)
 		return
@@ -354,6 +416,41 @@ func (s *Server) logf(format string, a ...interface{}) {
 	log.Printf(format, a...)
 }
 
+// logLevel returns the verbosity level of the log message msg, from its
+// "[v1] " or "[v2] " marker if any, and msg without the marker.
+func logLevel(msg string) (level int, _ string) {
+	switch {
+	case strings.Contains(msg, "[v1] "):
+		return 1, strings.Replace(msg, "[v1] ", "", 1)
+	case strings.Contains(msg, "[v2] "):
+		return 2, strings.Replace(msg, "[v2] ", "", 1)
+	}
+	return 0, msg
+}
+
+func (s *Server) reportMetricsLoop() {
+	t := time.NewTicker(metricsInterval)
+	defer t.Stop()
+	for {
+		s.reportMetrics()
+		select {
+		case <-t.C:
+		case <-s.shutdownCtx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) reportMetrics() {
+	for _, m := range clientmetric.Metrics() {
+		if m.Type() == clientmetric.TypeCounter {
+			s.Metrics.Counter(m.Name(), m.Value())
+		} else {
+			s.Metrics.Gauge(m.Name(), m.Value())
+		}
+	}
+}
+
 // printAuthURLLoop loops once every few seconds while the server is still running and
 // is in NeedsLogin state, printing out the auth URL.
 func (s *Server) printAuthURLLoop() {
@@ -506,3 +603,76 @@ type addr struct{
 
 func (a addr) Network() string { return a.ln.key.network }
 func (a addr) String() string  { return a.ln.addr }
+
+// ListenPacket returns a conn for sending and receiving ICMP messages
+// on the Tailscale network, for ping, traceroute and the like. It will
+// start the server if it has not been started yet.
+//
+// The network must be one of:
+//
+//   - "ping4" or "ping6": echo requests and their replies only, like
+//     an unprivileged ping socket. The echo identifier is assigned by
+//     the conn.
+//   - "ip4:icmp" (or "ip4:1") or "ip6:ipv6-icmp" (or "ip6:58"): any
+//     ICMP message, including the errors that traceroute relies on.
+//     These require s.AllowRawICMP.
+//
+// Reads and writes are ICMP messages without an IP header, and only
+// Tailscale peers (including subnet routes and exit nodes) can be
+// written to. The addr is the local Tailscale IP to use, or empty for
+// the node's IP of the network's address family. The returned conn is
+// a *netstack.ICMPConn, which can also set the TTL of written packets.
+//
+// Other raw IP protocols aren't supported.
+func (s *Server) ListenPacket(network, addr string) (net.PacketConn, error) {
+	var is6, raw bool
+	switch network {
+	case "ping4":
+	case "ping6":
+		is6 = true
+	case "ip4:icmp", "ip4:1":
+		raw = true
+	case "ip6:ipv6-icmp", "ip6:58":
+		is6, raw = true, true
+	default:
+		return nil, fmt.Errorf("tsnet: unsupported network %q", network)
+	}
+	if raw && !s.AllowRawICMP {
+		return nil, fmt.Errorf("tsnet: network %q requires Server.AllowRawICMP", network)
+	}
+
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+
+	var local netaddr.IP
+	if addr != "" {
+		var err error
+		local, err = netaddr.ParseIP(addr)
+		if err != nil {
+			return nil, fmt.Errorf("tsnet: %w", err)
+		}
+		if local.Is6() != is6 {
+			return nil, fmt.Errorf("tsnet: address %v is not valid for network %q", local, network)
+		}
+	} else {
+		nm := s.lb.NetMap()
+		if nm == nil {
+			return nil, fmt.Errorf("tsnet: no Tailscale IP yet")
+		}
+		for _, ipp := range nm.Addresses {
+			if ipp.IP().Is6() == is6 {
+				local = ipp.IP()
+				break
+			}
+		}
+		if local.IsZero() {
+			return nil, fmt.Errorf("tsnet: no Tailscale IP for network %q", network)
+		}
+	}
+	c, err := s.netstack.ListenICMP(local, raw)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+	return c, nil
+}
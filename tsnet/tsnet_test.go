@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/net/tsdial"
+	"tailscale.com/util/clientmetric"
+)
+
+type logLine struct {
+	level int
+	msg   string
+}
+
+type testLogger []logLine
+
+func (l *testLogger) Log(level int, msg string) {
+	*l = append(*l, logLine{level, msg})
+}
+
+func TestLogger(t *testing.T) {
+	var got testLogger
+	logfCalled := false
+	s := &Server{
+		Logger: &got,
+		Logf:   func(string, ...any) { logfCalled = true },
+	}
+	s.logf("magicsock: %d peers", 3)
+	s.logf("[v1] magicsock: disco: %v", "pong")
+	s.logf("netcheck: [v2] report: %s", "udp=true")
+
+	want := testLogger{
+		{0, "magicsock: 3 peers"},
+		{1, "magicsock: disco: pong"},
+		{2, "netcheck: report: udp=true"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines %v; want %v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d = %v; want %v", i, got[i], want[i])
+		}
+	}
+	if logfCalled {
+		t.Errorf("Logf called although Logger is set")
+	}
+}
+
+// metricsSink is a MetricsSink that records the last value of each
+// metric.
+type metricsSink struct {
+	mu       sync.Mutex
+	gauges   map[string]int64
+	counters map[string]int64
+	reports  chan struct{} // sent to when a gauge is reported
+}
+
+func (s *metricsSink) Gauge(name string, v int64) {
+	s.mu.Lock()
+	s.gauges[name] = v
+	s.mu.Unlock()
+	select {
+	case s.reports <- struct{}{}:
+	default:
+	}
+}
+
+func (s *metricsSink) Counter(name string, v int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[name] = v
+}
+
+var (
+	testCounter = clientmetric.NewCounter("tsnet_test_counter")
+	testGauge   = clientmetric.NewGauge("tsnet_test_gauge")
+)
+
+func TestMetricsSink(t *testing.T) {
+	testCounter.Add(3)
+	testGauge.Set(7)
+
+	sink := &metricsSink{
+		gauges:   map[string]int64{},
+		counters: map[string]int64{},
+		reports:  make(chan struct{}, 1),
+	}
+	s := &Server{Metrics: sink}
+	var cancel context.CancelFunc
+	s.shutdownCtx, cancel = context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.reportMetricsLoop()
+	}()
+
+	// The loop reports once right away, before its first tick.
+	select {
+	case <-sink.reports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics reported")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reportMetricsLoop didn't return after shutdown")
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if got := sink.counters["tsnet_test_counter"]; got != testCounter.Value() {
+		t.Errorf("counter = %d; want %d", got, testCounter.Value())
+	}
+	if got, ok := sink.gauges["tsnet_test_gauge"]; !ok || got != 7 {
+		t.Errorf("gauge = %d, %v; want 7", got, ok)
+	}
+	if _, ok := sink.gauges["tsnet_test_counter"]; ok {
+		t.Errorf("counter reported as a gauge")
+	}
+}
+
+func TestSystemDial(t *testing.T) {
+	var dialed []string
+	errDial := errors.New("test dial")
+	s := &Server{
+		SystemDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, network+" "+addr)
+			return nil, errDial
+		},
+	}
+	ctx := context.Background()
+
+	// Log uploads.
+	tr := s.logtailTransport()
+	if _, err := tr.DialContext(ctx, "tcp", "log.tailscale.io:443"); err != errDial {
+		t.Errorf("logtail dial = %v; want %v", err, errDial)
+	}
+
+	// Control, through a tsdial.Dialer set up as start does.
+	d := &tsdial.Dialer{SystemDialFunc: s.SystemDial}
+	defer d.Close()
+	if _, err := d.SystemDial(ctx, "tcp", "controlplane.tailscale.com:443"); err != errDial {
+		t.Errorf("control dial = %v; want %v", err, errDial)
+	}
+
+	want := []string{"tcp log.tailscale.io:443", "tcp controlplane.tailscale.com:443"}
+	if len(dialed) != len(want) {
+		t.Fatalf("dialed %q; want %q", dialed, want)
+	}
+	for i := range want {
+		if dialed[i] != want[i] {
+			t.Errorf("dial %d = %q; want %q", i, dialed[i], want[i])
+		}
+	}
+}
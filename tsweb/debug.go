@@ -15,6 +15,7 @@
 	"os"
 	"runtime"
 
+	"tailscale.com/types/logger"
 	"tailscale.com/version"
 )
 
@@ -60,6 +61,7 @@ func Debugger(mux *http.ServeMux) *DebugHandler {
 	ret.URL("/debug/pprof/goroutine?debug=1", "Goroutines (collapsed)")
 	ret.URL("/debug/pprof/goroutine?debug=2", "Goroutines (full)")
 	ret.Handle("gc", "force GC", http.HandlerFunc(gcHandler))
+	ret.Handle("loglevel", "Log component levels", http.HandlerFunc(logLevelHandler))
 	hostname, err := os.Hostname()
 	if err == nil {
 		ret.KV("Machine", hostname)
@@ -139,3 +141,27 @@ func gcHandler(w http.ResponseWriter, r *http.Request) {
 	runtime.GC()
 	w.Write([]byte("Done.\n"))
 }
+
+// logLevelHandler lists the levels of the program's log components
+// (see logger.NewComponent). A POST of "component" and "level" form
+// values, e.g. "component=magicsock&level=debug", sets one first.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		name := r.FormValue("component")
+		c := logger.LookupComponent(name)
+		if c == nil {
+			http.Error(w, fmt.Sprintf("unknown log component %q", name), http.StatusBadRequest)
+			return
+		}
+		l, err := logger.ParseLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.SetLevel(l)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, c := range logger.Components() {
+		fmt.Fprintf(w, "%s=%v\n", c.Name(), c.Level())
+	}
+}
@@ -12,6 +12,8 @@
 	"runtime"
 	"strings"
 	"testing"
+
+	"tailscale.com/types/logger"
 )
 
 func TestDebugger(t *testing.T) {
@@ -207,3 +209,38 @@ func ExampleDebugHandler_Section() {
 		fmt.Fprintf(w, "<code>%#v</code>", r)
 	})
 }
+
+// testLogComponent is registered once per test binary, as registering
+// a name twice panics and tests can run more than once (-count).
+var testLogComponent = logger.NewComponent("tsweb-test", logger.LevelInfo)
+
+func TestDebuggerLogLevel(t *testing.T) {
+	c := testLogComponent
+	c.SetLevel(c.DefaultLevel())
+	mux := http.NewServeMux()
+	Debugger(mux)
+
+	code, body := get(mux, "/debug/loglevel", tsIP)
+	if code != 200 || !strings.Contains(body, "tsweb-test=info\n") {
+		t.Fatalf("GET = %d, %q; want 200 listing tsweb-test=info", code, body)
+	}
+
+	req := httptest.NewRequest("POST", "/debug/loglevel?component=tsweb-test&level=trace", nil)
+	req.RemoteAddr = tsIP + ":1234"
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "tsweb-test=trace\n") {
+		t.Errorf("POST = %d, %q; want 200 listing tsweb-test=trace", rec.Code, rec.Body.String())
+	}
+	if got := c.Level(); got != logger.LevelTrace {
+		t.Errorf("level = %v; want trace", got)
+	}
+
+	req = httptest.NewRequest("POST", "/debug/loglevel?component=nope&level=debug", nil)
+	req.RemoteAddr = tsIP + ":1234"
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != 400 {
+		t.Errorf("POST of unknown component = %d; want 400", rec.Code)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package key
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A Backup holds the private keys that make a machine the same node,
+// for restoring them after losing its state or moving them to a
+// replacement machine.
+//
+// Disco keys aren't included, since they're generated afresh each
+// time tailscaled starts, and neither are network-lock signing keys,
+// which tailscaled doesn't hold.
+//
+// Since it contains private keys, a Backup is only moved around in
+// sealed form; see Seal and OpenBackup.
+type Backup struct {
+	Machine MachinePrivate
+	Node    NodePrivate
+	OldNode NodePrivate // if non-zero, needed to request key rotation
+
+	// NodeKeySignature, if non-empty, is the serialized
+	// tka.NodeKeySignature authorizing Node in a tailnet with
+	// network-lock enabled.
+	NodeKeySignature []byte `json:",omitempty"`
+
+	Created time.Time // when the backup was made
+}
+
+// sealedBackupPrefix starts the text form of a sealed Backup,
+// versioning its format.
+const sealedBackupPrefix = "tskeys1:"
+
+// Seal encrypts b with a key derived from passphrase, returning it in a
+// text form suitable for storing offline.
+func (b *Backup) Seal(passphrase []byte) ([]byte, error) {
+	if b.Machine.IsZero() || b.Node.IsZero() {
+		return nil, errors.New("backup is missing the machine or node key")
+	}
+	plaintext, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return SealWithPassphrase(sealedBackupPrefix, plaintext, passphrase)
+}
+
+// OpenBackup decrypts a Backup sealed with Seal.
+func OpenBackup(sealed, passphrase []byte) (*Backup, error) {
+	plaintext, err := OpenWithPassphrase(sealedBackupPrefix, "key backup", sealed, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	b := new(Backup)
+	if err := json.Unmarshal(plaintext, b); err != nil {
+		return nil, fmt.Errorf("decoding key backup: %v", err)
+	}
+	if b.Machine.IsZero() || b.Node.IsZero() {
+		return nil, errors.New("key backup is missing the machine or node key")
+	}
+	return b, nil
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package key
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBackupSeal(t *testing.T) {
+	b := &Backup{
+		Machine:          NewMachine(),
+		Node:             NewNode(),
+		OldNode:          NewNode(),
+		NodeKeySignature: []byte("sig"),
+		Created:          time.Unix(1660000000, 0).UTC(),
+	}
+	sealed, err := b.Seal([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("privkey:")) {
+		t.Fatal("sealed backup contains a plaintext key")
+	}
+	got, err := OpenBackup(sealed, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Machine.Equal(b.Machine) || !got.Node.Equal(b.Node) || !got.OldNode.Equal(b.OldNode) {
+		t.Error("keys differ after round trip")
+	}
+	if !bytes.Equal(got.NodeKeySignature, b.NodeKeySignature) || !got.Created.Equal(b.Created) {
+		t.Errorf("got %+v; want %+v", got, b)
+	}
+
+	if _, err := OpenBackup(sealed, []byte("wrong")); err == nil {
+		t.Error("opened with the wrong passphrase")
+	}
+	corrupt := bytes.Replace(sealed, []byte(sealedBackupPrefix), []byte("tskeys2:"), 1)
+	if _, err := OpenBackup(corrupt, []byte("hunter2")); err == nil {
+		t.Error("opened a backup of an unknown version")
+	}
+	if _, err := (&Backup{Node: NewNode()}).Seal([]byte("hunter2")); err == nil {
+		t.Error("sealed a backup without a machine key")
+	}
+	if _, err := b.Seal(nil); err == nil {
+		t.Error("sealed with an empty passphrase")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package key
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const passphraseSaltLen = 16
+
+// passphraseKDF derives an XChaCha20-Poly1305 key from passphrase.
+func passphraseKDF(passphrase, salt []byte) []byte {
+	// time = 3, memory = 64MiB, threads = 4, per the argon2 RFC's
+	// second recommended option.
+	return argon2.IDKey(passphrase, salt, 3, 64*1024, 4, chacha20poly1305.KeySize)
+}
+
+// SealWithPassphrase encrypts plaintext with XChaCha20-Poly1305, under
+// a key derived from passphrase with argon2id, for storing or moving
+// private keys offline. It returns prefix followed by the base64 salt,
+// nonce and ciphertext, and a newline.
+//
+// The prefix identifies and versions the contents, and is
+// authenticated along with them.
+func SealWithPassphrase(prefix string, plaintext, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	salt := make([]byte, passphraseSaltLen)
+	rand(salt)
+	aead, err := chacha20poly1305.NewX(passphraseKDF(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand(nonce)
+	raw := append(salt, nonce...)
+	raw = aead.Seal(raw, nonce, plaintext, []byte(prefix))
+	out := []byte(prefix)
+	out = append(out, base64.StdEncoding.EncodeToString(raw)...)
+	return append(out, '\n'), nil
+}
+
+// OpenWithPassphrase decrypts the output of SealWithPassphrase with
+// the same prefix. what describes the contents in errors, such as
+// "key backup".
+//
+// Note the errors in this function deliberately do not echo the
+// contents of sealed or passphrase.
+func OpenWithPassphrase(prefix, what string, sealed, passphrase []byte) ([]byte, error) {
+	sealed = bytes.TrimSpace(sealed)
+	if !bytes.HasPrefix(sealed, []byte(prefix)) {
+		return nil, fmt.Errorf("not a sealed %s, or from a newer version", what)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(sealed[len(prefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("sealed %s isn't valid base64", what)
+	}
+	if len(raw) < passphraseSaltLen+chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("sealed %s too short", what)
+	}
+	salt, raw := raw[:passphraseSaltLen], raw[passphraseSaltLen:]
+	nonce, ciphertext := raw[:chacha20poly1305.NonceSizeX], raw[chacha20poly1305.NonceSizeX:]
+	aead, err := chacha20poly1305.NewX(passphraseKDF(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(prefix))
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupt %s", what)
+	}
+	return plaintext, nil
+}
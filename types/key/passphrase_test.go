@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package key
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealWithPassphrase(t *testing.T) {
+	plaintext := []byte("secret")
+	sealed, err := SealWithPassphrase("test1:", plaintext, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Error("sealed output contains the plaintext")
+	}
+	got, err := OpenWithPassphrase("test1:", "test", sealed, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q; want %q", got, plaintext)
+	}
+
+	if _, err := OpenWithPassphrase("test1:", "test", sealed, []byte("wrong")); err == nil {
+		t.Error("opened with the wrong passphrase")
+	}
+	if _, err := OpenWithPassphrase("test2:", "test", sealed, []byte("hunter2")); err == nil {
+		t.Error("opened with the wrong prefix")
+	}
+	// The prefix is authenticated, so relabeling the contents fails.
+	relabeled := append([]byte("test2:"), sealed[len("test1:"):]...)
+	if _, err := OpenWithPassphrase("test2:", "test", relabeled, []byte("hunter2")); err == nil {
+		t.Error("opened with a substituted prefix")
+	}
+	if _, err := SealWithPassphrase("test1:", plaintext, nil); err == nil {
+		t.Error("sealed with an empty passphrase")
+	}
+}
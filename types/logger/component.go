@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Level is the verbosity of a Component's logging. Higher levels are
+// more verbose and include the lower ones.
+type Level int32
+
+const (
+	LevelInfo  Level = 0 // the default; no debug logging
+	LevelDebug Level = 1 // what a TS_DEBUG_* knob would enable
+	LevelTrace Level = 2 // per-packet or otherwise very chatty logging
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	case LevelTrace:
+		return "trace"
+	}
+	return strconv.Itoa(int(l))
+}
+
+// ParseLevel parses a Level from its name ("info", "debug" or
+// "trace") or number.
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "info":
+		return LevelInfo, nil
+	case "debug":
+		return LevelDebug, nil
+	case "trace":
+		return LevelTrace, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid log level %q; want info, debug or trace", s)
+	}
+	return Level(n), nil
+}
+
+// A Component is a named part of the program, such as "magicsock" or
+// "dns", whose debug logging can be turned up and down at runtime.
+type Component struct {
+	name  string
+	def   Level
+	level int32 // atomic Level
+}
+
+var (
+	componentsMu sync.Mutex
+	components   = map[string]*Component{}
+)
+
+// NewComponent registers and returns the Component name, starting at
+// level def. It's meant to be called once per component, when
+// initializing a package-level variable, and panics if name is
+// already registered.
+func NewComponent(name string, def Level) *Component {
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	if _, dup := components[name]; dup {
+		panic(fmt.Sprintf("duplicate log component %q", name))
+	}
+	c := &Component{name: name, def: def, level: int32(def)}
+	components[name] = c
+	return c
+}
+
+// Name returns c's name.
+func (c *Component) Name() string { return c.name }
+
+// Level returns c's current level.
+func (c *Component) Level() Level { return Level(atomic.LoadInt32(&c.level)) }
+
+// DefaultLevel returns the level c started at.
+func (c *Component) DefaultLevel() Level { return c.def }
+
+// SetLevel sets c's level.
+func (c *Component) SetLevel(l Level) { atomic.StoreInt32(&c.level, int32(l)) }
+
+// Enabled reports whether c logs at level l.
+func (c *Component) Enabled(l Level) bool { return c.Level() >= l }
+
+// Components returns the registered Components, sorted by name.
+func Components() []*Component {
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	ret := make([]*Component, 0, len(components))
+	for _, c := range components {
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+// LookupComponent returns the Component registered as name, or nil.
+func LookupComponent(name string) *Component {
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	return components[name]
+}
+
+// ComponentLevels returns the current level of each registered
+// Component, by name.
+func ComponentLevels() map[string]Level {
+	ret := map[string]Level{}
+	for _, c := range Components() {
+		ret[c.name] = c.Level()
+	}
+	return ret
+}
@@ -308,3 +308,51 @@ func LogfCloser(logf Logf) (newLogf Logf, close func()) {
 	}
 	return newLogf, close
 }
+
+// Ring keeps the most recent lines logged through the Logf returned by
+// its Wrap method, for including in bug reports.
+type Ring struct {
+	mu    sync.Mutex
+	lines []string // circular; next is the oldest once full
+	next  int
+	full  bool
+}
+
+// NewRing returns a Ring that keeps the last n lines.
+func NewRing(n int) *Ring {
+	return &Ring{lines: make([]string, n)}
+}
+
+// Wrap returns a Logf that records each line in r and then passes it
+// on to logf, already formatted, so that each line is only formatted
+// once.
+func (r *Ring) Wrap(logf Logf) Logf {
+	return func(format string, args ...any) {
+		s := fmt.Sprintf(format, args...)
+		line := strings.TrimSuffix(s, "\n")
+		r.mu.Lock()
+		if len(r.lines) > 0 {
+			r.lines[r.next] = time.Now().UTC().Format("2006-01-02T15:04:05.000Z ") + line
+			r.next++
+			if r.next == len(r.lines) {
+				r.next = 0
+				r.full = true
+			}
+		}
+		r.mu.Unlock()
+		logf("%s", s)
+	}
+}
+
+// Lines returns the recorded lines, oldest first. Each line is prefixed
+// with the UTC time it was logged.
+func (r *Ring) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+	ret := make([]string, 0, len(r.lines))
+	ret = append(ret, r.lines[r.next:]...)
+	return append(ret, r.lines[:r.next]...)
+}
@@ -222,3 +222,77 @@ func TestJSON(t *testing.T) {
 		t.Errorf("mismatch\n got: %q\nwant: %q\n", got, want)
 	}
 }
+
+// testComponent is registered once per test binary, as registering a
+// name twice panics and tests can run more than once (-count).
+var testComponent = NewComponent("test-component", LevelDebug)
+
+func TestComponent(t *testing.T) {
+	c := testComponent
+	c.SetLevel(c.DefaultLevel())
+	if LookupComponent("test-component") != c {
+		t.Fatal("LookupComponent didn't find the new component")
+	}
+	if !c.Enabled(LevelDebug) || c.Enabled(LevelTrace) {
+		t.Errorf("at %v, Enabled(debug)=%v Enabled(trace)=%v", c.Level(), c.Enabled(LevelDebug), c.Enabled(LevelTrace))
+	}
+	c.SetLevel(LevelTrace)
+	if got := ComponentLevels()["test-component"]; got != LevelTrace {
+		t.Errorf("ComponentLevels = %v; want trace", got)
+	}
+	if c.DefaultLevel() != LevelDebug {
+		t.Errorf("DefaultLevel = %v; want debug", c.DefaultLevel())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate component didn't panic")
+		}
+	}()
+	NewComponent("test-component", LevelInfo)
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{LevelInfo, LevelDebug, LevelTrace, 3} {
+		got, err := ParseLevel(l.String())
+		if err != nil || got != l {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", l.String(), got, err, l)
+		}
+	}
+	for _, s := range []string{"", "verbose", "-1"} {
+		if _, err := ParseLevel(s); err == nil {
+			t.Errorf("ParseLevel(%q) succeeded; want error", s)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := NewRing(3)
+	var passed []string
+	logf := r.Wrap(func(format string, args ...any) { passed = append(passed, fmt.Sprintf(format, args...)) })
+	text := func() []string {
+		var ret []string
+		for _, l := range r.Lines() {
+			// Strip the timestamp.
+			ret = append(ret, l[len("2006-01-02T15:04:05.000Z "):])
+		}
+		return ret
+	}
+	if got := text(); len(got) != 0 {
+		t.Fatalf("empty ring has lines %q", got)
+	}
+	logf("a %d", 1)
+	logf("b\n")
+	if got, want := fmt.Sprint(text()), "[a 1 b]"; got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	logf("c")
+	logf("d")
+	logf("e")
+	if got, want := fmt.Sprint(text()), "[c d e]"; got != want {
+		t.Errorf("after wrapping, got %v; want %v", got, want)
+	}
+	if got, want := fmt.Sprintf("%q", passed), `["a 1" "b\n" "c" "d" "e"]`; got != want {
+		t.Errorf("passed through %v; want %v", got, want)
+	}
+}
@@ -41,6 +41,10 @@ type NetworkMap struct {
 	PacketFilter []filter.Match
 	SSHPolicy    *tailcfg.SSHPolicy // or nil, if not enabled/allowed
 
+	// NodeCA is the tailnet's private CA for node identity certs,
+	// or nil if the control server doesn't issue them.
+	NodeCA *tailcfg.NodeCA
+
 	// CollectServices reports whether this node's Tailnet has
 	// requested that info about services be included in HostInfo.
 	// If set, Hostinfo.ShieldsUp blocks services collection; that
@@ -11,7 +11,7 @@
 )
 
 // PacketListener defines the ListenPacket method as implemented
-// by net.ListenConfig, net.ListenPacket, and tstest/natlab.
+// by net.ListenConfig, net.ListenPacket, and net/natlab.
 type PacketListener interface {
 	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
 }
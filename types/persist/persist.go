@@ -6,7 +6,9 @@
 package persist
 
 import (
+	"bytes"
 	"fmt"
+	"time"
 
 	"tailscale.com/types/key"
 	"tailscale.com/types/structs"
@@ -34,6 +36,17 @@ type Persist struct {
 	OldPrivateNodeKey key.NodePrivate // needed to request key rotation
 	Provider          string
 	LoginName         string
+
+	// NodeKeyCreated is when control accepted PrivateNodeKey, for
+	// scheduling proactive key rotation. It's zero if unknown, as for
+	// keys from before it was recorded.
+	NodeKeyCreated time.Time
+
+	// NodeKeySignature, if non-empty, is the serialized
+	// tka.NodeKeySignature authorizing PrivateNodeKey in a tailnet
+	// with network-lock enabled, from a pre-signed enrollment. It's
+	// sent to control when registering the key.
+	NodeKeySignature []byte `json:",omitempty"`
 }
 
 func (p *Persist) Equals(p2 *Persist) bool {
@@ -48,7 +61,9 @@ func (p *Persist) Equals(p2 *Persist) bool {
 		p.PrivateNodeKey.Equal(p2.PrivateNodeKey) &&
 		p.OldPrivateNodeKey.Equal(p2.OldPrivateNodeKey) &&
 		p.Provider == p2.Provider &&
-		p.LoginName == p2.LoginName
+		p.LoginName == p2.LoginName &&
+		p.NodeKeyCreated.Equal(p2.NodeKeyCreated) &&
+		bytes.Equal(p.NodeKeySignature, p2.NodeKeySignature)
 }
 
 func (p *Persist) Pretty() string {
@@ -7,6 +7,8 @@
 package persist
 
 import (
+	"time"
+
 	"tailscale.com/types/key"
 	"tailscale.com/types/structs"
 )
@@ -19,6 +21,7 @@ func (src *Persist) Clone() *Persist {
 	}
 	dst := new(Persist)
 	*dst = *src
+	dst.NodeKeySignature = append(src.NodeKeySignature[:0:0], src.NodeKeySignature...)
 	return dst
 }
 
@@ -30,4 +33,6 @@ func (src *Persist) Clone() *Persist {
 	OldPrivateNodeKey               key.NodePrivate
 	Provider                        string
 	LoginName                       string
+	NodeKeyCreated                  time.Time
+	NodeKeySignature                []byte
 }{})
@@ -7,6 +7,7 @@
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"tailscale.com/types/key"
 )
@@ -21,7 +22,7 @@ func fieldsOf(t reflect.Type) (fields []string) {
 }
 
 func TestPersistEqual(t *testing.T) {
-	persistHandles := []string{"LegacyFrontendPrivateMachineKey", "PrivateNodeKey", "OldPrivateNodeKey", "Provider", "LoginName"}
+	persistHandles := []string{"LegacyFrontendPrivateMachineKey", "PrivateNodeKey", "OldPrivateNodeKey", "Provider", "LoginName", "NodeKeyCreated", "NodeKeySignature"}
 	if have := fieldsOf(reflect.TypeOf(Persist{})); !reflect.DeepEqual(have, persistHandles) {
 		t.Errorf("Persist.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, persistHandles)
@@ -29,6 +30,7 @@ func TestPersistEqual(t *testing.T) {
 
 	m1 := key.NewMachine()
 	k1 := key.NewNode()
+	t1 := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
 	tests := []struct {
 		a, b *Persist
 		want bool
@@ -92,6 +94,22 @@ func TestPersistEqual(t *testing.T) {
 			&Persist{LoginName: "foo@tailscale.com"},
 			true,
 		},
+
+		{
+			&Persist{NodeKeyCreated: t1},
+			&Persist{NodeKeyCreated: t1.Add(time.Hour)},
+			false,
+		},
+		{
+			&Persist{NodeKeyCreated: t1},
+			&Persist{NodeKeyCreated: t1.In(time.FixedZone("x", 3600))},
+			true,
+		},
+		{
+			&Persist{NodeKeySignature: []byte{1, 2}},
+			&Persist{NodeKeySignature: []byte{1, 3}},
+			false,
+		},
 	}
 	for i, test := range tests {
 		if got := test.a.Equals(test.b); got != test.want {
@@ -12,6 +12,11 @@
 
 // These numbers are persisted to disk in JSON files and thus can't be
 // renumbered or repurposed.
+//
+// NetfilterOff is also known as routes-only mode: tailscaled only
+// installs routes and leaves firewalling, including the NAT needed by
+// subnet routers and exit nodes, to the system's own firewall manager.
+// It's the only mode available on systems without iptables.
 const (
 	NetfilterOff      NetfilterMode = 0 // remove all tailscale netfilter state
 	NetfilterNoDivert NetfilterMode = 1 // manage tailscale chains, but don't call them
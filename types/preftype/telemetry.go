@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package preftype
+
+import "fmt"
+
+// TelemetryLevel is how much telemetry a node uploads to Tailscale:
+// its logs, its client metrics, and any crash reports, which are
+// uploaded as logs.
+//
+// Higher levels upload less. Tailscale support can't help debug
+// nodes that don't upload logs.
+type TelemetryLevel int
+
+// These numbers are persisted to disk in JSON files and thus can't be
+// renumbered or repurposed.
+const (
+	TelemetryFull       TelemetryLevel = 0 // logs, client metrics and crash reports
+	TelemetryHealthOnly TelemetryLevel = 1 // client metrics only; no log text or crash reports
+	TelemetryNone       TelemetryLevel = 2 // nothing
+)
+
+func (l TelemetryLevel) String() string {
+	switch l {
+	case TelemetryFull:
+		return "full"
+	case TelemetryHealthOnly:
+		return "health-only"
+	case TelemetryNone:
+		return "none"
+	default:
+		return "???"
+	}
+}
+
+// ParseTelemetryLevel parses the String form of a TelemetryLevel.
+func ParseTelemetryLevel(s string) (TelemetryLevel, error) {
+	for _, l := range []TelemetryLevel{TelemetryFull, TelemetryHealthOnly, TelemetryNone} {
+		if s == l.String() {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid telemetry level %q; want one of full, health-only, none", s)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usermsg
+
+// Message IDs. The comment on each lists its parameters.
+const (
+	// Text is a message with no catalog entry, such as an error from
+	// the control server, whose English text is in the "text"
+	// parameter. Frontends can't translate it; they show it as is.
+	Text ID = "text" // text
+
+	PermissionDenied ID = "permission-denied"
+	VersionMismatch  ID = "version-mismatch"   // frontend, backend
+	InUseByUser      ID = "in-use-by-user"     // user
+	InUseByUserPID   ID = "in-use-by-user-pid" // user, pid
+
+	// Health warnings.
+	HealthNetworkDown          ID = "health-network-down"
+	HealthNotRunning           ID = "health-not-running" // state, wantRunning
+	HealthLoginError           ID = "health-login-error" // error
+	HealthNotInMapPoll         ID = "health-not-in-map-poll"
+	HealthNoMapResponse        ID = "health-no-map-response" // duration
+	HealthNoDERPHome           ID = "health-no-derp-home"
+	HealthDERPHomeDisconnected ID = "health-derp-home-disconnected" // region
+	HealthDERPHomeSilent       ID = "health-derp-home-silent"       // region, duration
+	HealthNoUDP4Bind           ID = "health-no-udp4-bind"
+	HealthReceiveFuncStopped   ID = "health-receive-func-stopped" // name
+	HealthSubsystem            ID = "health-subsystem"            // subsystem, error
+	HealthDERPRegionProblem    ID = "health-derp-region-problem"  // region, problem
+	HealthSSHDevPolicy         ID = "health-ssh-dev-policy"
+	HealthSSHNoAccess          ID = "health-ssh-no-access"
+	HealthSSHNoAccessAdmin     ID = "health-ssh-no-access-admin"
+	HealthSSHNoAccessAdminURL  ID = "health-ssh-no-access-admin-url"
+)
+
+// English is the catalog of every message's English text. It's also the
+// text of an Error, and so what ends up in logs.
+var English = Catalog{
+	Text: "{text}",
+
+	PermissionDenied: "permission denied",
+	VersionMismatch:  "version mismatch: frontend={frontend} backend={backend}",
+	InUseByUser:      "Tailscale already in use by {user}",
+	InUseByUserPID:   "Tailscale already in use by {user}, pid {pid}",
+
+	HealthNetworkDown:          "network down",
+	HealthNotRunning:           "state={state}, wantRunning={wantRunning}",
+	HealthLoginError:           "not logged in, last login error={error}",
+	HealthNotInMapPoll:         "not in map poll",
+	HealthNoMapResponse:        "no map response in {duration}",
+	HealthNoDERPHome:           "no DERP home",
+	HealthDERPHomeDisconnected: "not connected to home DERP region {region}",
+	HealthDERPHomeSilent:       "haven't heard from home DERP region {region} in {duration}",
+	HealthNoUDP4Bind:           "no udp4 bind",
+	HealthReceiveFuncStopped:   "{name} is not running",
+	HealthSubsystem:            "{subsystem}: {error}",
+	HealthDERPRegionProblem:    "derp{region}: {problem}",
+	HealthSSHDevPolicy:         "development SSH policy in use",
+	HealthSSHNoAccess:          "Tailscale SSH enabled, but access controls don't allow anyone to access this device. Ask your admin to update your tailnet's ACLs to allow access.",
+	HealthSSHNoAccessAdmin:     "Tailscale SSH enabled, but access controls don't allow anyone to access this device. Update your tailnet's ACLs to allow access.",
+	HealthSSHNoAccessAdminURL:  "Tailscale SSH enabled, but access controls don't allow anyone to access this device. Update your tailnet's ACLs at https://tailscale.com/s/ssh-policy",
+}
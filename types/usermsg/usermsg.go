@@ -0,0 +1,149 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package usermsg defines the structured, user-facing messages that
+// tailscaled sends to GUIs and the CLI, such as health warnings and
+// errors, along with a catalog of their English text.
+//
+// A Message is a stable ID plus named parameters. Frontends that want to
+// show messages in another language translate by ID, rather than by
+// matching on English strings that may change between releases.
+package usermsg
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ID identifies a message in the catalog. Once defined, an ID's meaning
+// and parameters don't change; a message needing different parameters
+// gets a new ID.
+type ID string
+
+// Message is a user-facing message: a catalog ID and its parameters.
+type Message struct {
+	ID     ID
+	Params map[string]string `json:",omitempty"`
+}
+
+// New returns a Message with the given ID and parameters, which are
+// given as alternating names and values.
+func New(id ID, nameValues ...string) Message {
+	m := Message{ID: id}
+	if len(nameValues) > 0 {
+		m.Params = make(map[string]string, len(nameValues)/2)
+		for i := 0; i+1 < len(nameValues); i += 2 {
+			m.Params[nameValues[i]] = nameValues[i+1]
+		}
+	}
+	return m
+}
+
+// IsZero reports whether m is the zero Message.
+func (m Message) IsZero() bool { return m.ID == "" }
+
+// String returns m in English.
+func (m Message) String() string { return m.Format("en") }
+
+// Format returns m in the language lang, a BCP 47 tag such as "en" or
+// "pt-BR". It falls back to the base language ("pt") and then to English
+// if no catalog registered for lang has m.ID.
+func (m Message) Format(lang string) string {
+	tmpl, ok := Lookup(lang, m.ID)
+	if !ok {
+		return m.raw()
+	}
+	if len(m.Params) == 0 {
+		return tmpl
+	}
+	oldnew := make([]string, 0, 2*len(m.Params))
+	for k, v := range m.Params {
+		oldnew = append(oldnew, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(oldnew...).Replace(tmpl)
+}
+
+// raw returns m for an ID missing from every catalog, such as one from a
+// newer tailscaled.
+func (m Message) raw() string {
+	if t, ok := m.Params["text"]; ok && len(m.Params) == 1 {
+		return t
+	}
+	var sb strings.Builder
+	sb.WriteString(string(m.ID))
+	for k, v := range m.Params {
+		sb.WriteString(" " + k + "=" + v)
+	}
+	return sb.String()
+}
+
+// Error is an error carrying a Message. Its Error method returns the
+// English text.
+type Error struct {
+	Message Message
+	Err     error // optional underlying error, returned by Unwrap
+}
+
+// Errorf returns an *Error for the message with the given ID and
+// parameters, given as alternating names and values.
+func Errorf(id ID, nameValues ...string) error {
+	return &Error{Message: New(id, nameValues...)}
+}
+
+func (e *Error) Error() string { return e.Message.String() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// FromError returns the Message carried by err or, if err doesn't wrap
+// an *Error, a Text message with err's text.
+func FromError(err error) Message {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	return New(Text, "text", err.Error())
+}
+
+// Catalog maps message IDs to their text in one language. Parameters are
+// referenced in the text by name in braces, as in "{region}".
+type Catalog map[ID]string
+
+var (
+	mu       sync.RWMutex
+	catalogs = map[string]Catalog{"en": English}
+)
+
+// Register adds or replaces the catalog for lang, a BCP 47 tag such as
+// "de" or "pt-BR". IDs missing from c fall back to English.
+func Register(lang string, c Catalog) {
+	mu.Lock()
+	defer mu.Unlock()
+	catalogs[normalizeLang(lang)] = c
+}
+
+// Lookup returns the text for id in lang, falling back to lang's base
+// language and then to English.
+func Lookup(lang string, id ID) (text string, ok bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	lang = normalizeLang(lang)
+	for {
+		if t, ok := catalogs[lang][id]; ok {
+			return t, true
+		}
+		i := strings.LastIndexByte(lang, '-')
+		if i < 0 {
+			break
+		}
+		lang = lang[:i]
+	}
+	t, ok := English[id]
+	return t, ok
+}
+
+// normalizeLang returns lang in lower case with "-" separators, so
+// "pt_BR" (as in POSIX locales) and "pt-BR" are the same.
+func normalizeLang(lang string) string {
+	return strings.ReplaceAll(strings.ToLower(lang), "_", "-")
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usermsg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	Register("xx", Catalog{
+		HealthNoDERPHome:           "xx no derp home",
+		HealthDERPHomeDisconnected: "xx derp {region} down",
+	})
+	Register("xx-YY", Catalog{
+		HealthNoDERPHome: "xx-YY no derp home",
+	})
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(catalogs, "xx")
+		delete(catalogs, "xx-yy")
+	}()
+
+	tests := []struct {
+		m    Message
+		lang string
+		want string
+	}{
+		{New(HealthNoDERPHome), "en", "no DERP home"},
+		{New(HealthNoDERPHome), "", "no DERP home"},
+		{New(HealthNoDERPHome), "zz", "no DERP home"},
+		{New(HealthNoDERPHome), "xx", "xx no derp home"},
+		{New(HealthNoDERPHome), "xx-YY", "xx-YY no derp home"},
+		{New(HealthNoDERPHome), "xx_yy", "xx-YY no derp home"},
+		{New(HealthDERPHomeDisconnected, "region", "3"), "xx-YY", "xx derp 3 down"},
+		{New(HealthDERPHomeDisconnected, "region", "3"), "en", "not connected to home DERP region 3"},
+		{New(HealthDERPHomeSilent, "region", "1", "duration", "3m0s"), "en", "haven't heard from home DERP region 1 in 3m0s"},
+		{New(Text, "text", "from control"), "xx", "from control"},
+		{New("from-the-future", "text", "hi"), "en", "hi"},
+		{New("from-the-future", "a", "b"), "en", "from-the-future a=b"},
+		{Message{}, "en", ""},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Format(tt.lang); got != tt.want {
+			t.Errorf("%v.Format(%q) = %q; want %q", tt.m.ID, tt.lang, got, tt.want)
+		}
+	}
+}
+
+func TestFromError(t *testing.T) {
+	base := errors.New("boom")
+	err := fmt.Errorf("wrapped: %w", &Error{
+		Message: New(HealthSubsystem, "subsystem", "router", "error", base.Error()),
+		Err:     base,
+	})
+	m := FromError(err)
+	if m.ID != HealthSubsystem || m.Params["subsystem"] != "router" {
+		t.Errorf("FromError = %+v", m)
+	}
+	if !errors.Is(err, base) {
+		t.Error("Error doesn't unwrap to its Err")
+	}
+	if got, want := err.Error(), "wrapped: router: boom"; got != want {
+		t.Errorf("Error() = %q; want %q", got, want)
+	}
+
+	m = FromError(errors.New("plain"))
+	if m.ID != Text || m.String() != "plain" {
+		t.Errorf("FromError(plain) = %+v", m)
+	}
+}
+
+func TestEnglishComplete(t *testing.T) {
+	for id, text := range English {
+		if id == "" || text == "" {
+			t.Errorf("empty English entry %q: %q", id, text)
+		}
+		if strings.Count(text, "{") != strings.Count(text, "}") {
+			t.Errorf("%v: unbalanced braces in %q", id, text)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	j, err := json.Marshal(New(HealthNoDERPHome))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(j), `{"ID":"health-no-derp-home"}`; got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+}
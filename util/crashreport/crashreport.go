@@ -0,0 +1,343 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package crashreport finds the panics and fatal errors of a previous run
+// of a program in its log files, and keeps reports of them in a local
+// directory.
+//
+// It relies on the Go runtime writing the crash to stderr, and stderr
+// having been redirected into the log files (see logtail/filch), so it's
+// found in them on the next start.
+package crashreport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxLogTail is how much of the end of each log file is searched
+	// for a crash.
+	maxLogTail = 1 << 20
+
+	// maxRecentLogs is the maximum number of log lines from before
+	// the crash that a Report keeps.
+	maxRecentLogs = 200
+
+	// maxStack is the maximum size of a Report's Stack.
+	maxStack = 256 << 10
+
+	// maxReports is the number of reports Save keeps; older ones are
+	// deleted.
+	maxReports = 10
+)
+
+// Report is a crash of a previous run of the program.
+type Report struct {
+	// ID identifies the crash. It's derived from the crash output, so
+	// finding the same crash again gives the same ID.
+	ID string
+
+	// Time is when the crash happened, as near as can be told.
+	Time time.Time
+
+	// Version is the version of the program that crashed, if known.
+	Version string `json:",omitempty"`
+
+	// Reason is the line the Go runtime started the crash output with,
+	// such as "panic: runtime error: index out of range [3] with
+	// length 3" or "fatal error: concurrent map writes".
+	Reason string
+
+	// Stack is the rest of the crash output: the goroutine stacks.
+	Stack string
+
+	// RecentLogs are the log lines written before the crash, oldest
+	// first.
+	RecentLogs []string `json:",omitempty"`
+
+	// Uploaded is whether the report has been uploaded.
+	Uploaded bool `json:",omitempty"`
+}
+
+// FindInLogs returns the last crash in the log files at paths, or nil if
+// there isn't one. The files are in the format written by logtail/filch:
+// JSON log entries, interspersed with raw lines written directly to
+// stderr. Only the end of each file is searched.
+func FindInLogs(paths ...string) *Report {
+	type file struct {
+		b       []byte
+		modTime time.Time
+	}
+	var files []file
+	for _, p := range paths {
+		b, modTime, err := readTail(p, maxLogTail)
+		if err == nil && len(b) > 0 {
+			files = append(files, file{b, modTime})
+		}
+	}
+	// Search oldest first, so the last crash found is the latest.
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	var all [][]byte
+	var modTime time.Time
+	for _, f := range files {
+		all = append(all, f.b)
+		modTime = f.modTime
+	}
+	return Find(bytes.Join(all, []byte("\n")), modTime)
+}
+
+// readTail returns up to the last max bytes of the file at path, starting
+// at a line boundary, and the file's modification time.
+func readTail(path string, max int64) ([]byte, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	off := fi.Size() - max
+	if off < 0 {
+		off = 0
+	}
+	b, err := io.ReadAll(io.NewSectionReader(f, off, fi.Size()-off))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if off > 0 {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		}
+	}
+	return b, fi.ModTime(), nil
+}
+
+// logEntry is the part of a logtail JSON log entry that Find uses.
+type logEntry struct {
+	Logtail struct {
+		ClientTime time.Time `json:"client_time"`
+	} `json:"logtail"`
+	Text string `json:"text"`
+}
+
+// isCrashStart reports whether the raw stderr line starts the Go
+// runtime's output for a crash.
+func isCrashStart(line string) bool {
+	return strings.HasPrefix(line, "panic: ") || strings.HasPrefix(line, "fatal error: ")
+}
+
+// Find returns the last crash in log, the contents of a log file last
+// modified at modTime, or nil if there isn't one.
+func Find(log []byte, modTime time.Time) *Report {
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(log))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+
+	start := -1
+	for i := len(lines) - 1; i >= 0; i-- {
+		if isCrashStart(lines[i]) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	// A panic while panicking prints further "panic: " lines; the
+	// first of a run of crash lines is the reason.
+	for start > 0 && isCrashStart(lines[start-1]) {
+		start--
+	}
+
+	r := &Report{
+		Reason: lines[start],
+		Time:   modTime,
+	}
+
+	// The crash output runs until the process's next JSON log entry,
+	// if any (from a later run), or the end.
+	var stack strings.Builder
+	for _, l := range lines[start+1:] {
+		if strings.HasPrefix(l, "{") && json.Valid([]byte(l)) {
+			break
+		}
+		if stack.Len()+len(l)+1 > maxStack {
+			break
+		}
+		stack.WriteString(l)
+		stack.WriteByte('\n')
+	}
+	r.Stack = stack.String()
+
+	// Walk back from the crash for the recent logs and, from the
+	// program's startup log line, its version.
+	var recent []string
+	var lastTime time.Time
+	for i := start - 1; i >= 0; i-- {
+		l := lines[i]
+		if l == "" {
+			continue
+		}
+		text := l
+		if strings.HasPrefix(l, "{") {
+			var e logEntry
+			if err := json.Unmarshal([]byte(l), &e); err == nil {
+				text = strings.TrimSuffix(e.Text, "\n")
+				if lastTime.IsZero() {
+					lastTime = e.Logtail.ClientTime
+				}
+			}
+		}
+		if len(recent) < maxRecentLogs {
+			recent = append(recent, text)
+		}
+		if v, ok := startupVersion(text); ok {
+			r.Version = v
+			break
+		}
+	}
+	for i, j := 0, len(recent)-1; i < j; i, j = i+1, j-1 {
+		recent[i], recent[j] = recent[j], recent[i]
+	}
+	r.RecentLogs = recent
+	if !lastTime.IsZero() && (r.Time.IsZero() || lastTime.Before(r.Time)) {
+		// The last log entry before the crash is a closer bound
+		// than the file's modification time, which later runs
+		// may have bumped.
+		r.Time = lastTime
+	}
+
+	h := sha256.Sum256([]byte(r.Reason + "\n" + r.Stack))
+	r.ID = hex.EncodeToString(h[:8])
+	return r
+}
+
+// startupVersion returns the version from logpolicy's "Program starting"
+// log line, if text is one.
+func startupVersion(text string) (string, bool) {
+	const prefix = "Program starting: v"
+	i := strings.Index(text, prefix)
+	if i < 0 {
+		return "", false
+	}
+	v := text[i+len(prefix):]
+	if j := strings.IndexByte(v, ','); j >= 0 {
+		v = v[:j]
+	}
+	return v, true
+}
+
+const fileExt = ".json"
+
+func reportPath(dir, id string) string {
+	return filepath.Join(dir, "crash-"+id+fileExt)
+}
+
+// Save writes r to dir, unless a report of the same crash is already
+// there, and deletes all but the newest reports. The directory is
+// created if needed. It reports whether r was new.
+func Save(dir string, r *Report) (isNew bool, err error) {
+	if r.ID == "" {
+		return false, errors.New("crash report has no ID")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, err
+	}
+	path := reportPath(dir, r.ID)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
+	if err := write(path, r); err != nil {
+		return false, err
+	}
+	reports, err := List(dir)
+	if err != nil {
+		return true, err
+	}
+	for _, old := range reports[min(len(reports), maxReports):] {
+		os.Remove(reportPath(dir, old.ID))
+	}
+	return true, nil
+}
+
+func write(path string, r *Report) error {
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// List returns the reports in dir, newest first. A missing dir has no
+// reports.
+func List(dir string) ([]*Report, error) {
+	des, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Report
+	for _, de := range des {
+		name := de.Name()
+		if !strings.HasPrefix(name, "crash-") || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		r := new(Report)
+		if err := json.Unmarshal(b, r); err != nil || r.ID == "" {
+			continue
+		}
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Time.After(ret[j].Time) })
+	return ret, nil
+}
+
+// MarkUploaded records that the report id in dir has been uploaded.
+func MarkUploaded(dir, id string) error {
+	path := reportPath(dir, id)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	r := new(Report)
+	if err := json.Unmarshal(b, r); err != nil {
+		return err
+	}
+	r.Uploaded = true
+	return write(path, r)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package crashreport
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const crashLog = `{"logtail": {"client_time": "2022-08-01T10:00:00Z"}, "text": "Program starting: v1.29.0-t1234, Go 1.18.3-ts1: []string{\"tailscaled\"}\n"}
+{"logtail": {"client_time": "2022-08-01T10:00:01Z"}, "text": "LogID: abc\n"}
+{"logtail": {"client_time": "2022-08-01T10:00:02Z"}, "text": "magicsock: doing something\n"}
+panic: runtime error: index out of range [3] with length 3
+
+goroutine 42 [running]:
+tailscale.com/wgengine/magicsock.(*Conn).foo(...)
+	/src/wgengine/magicsock/magicsock.go:123 +0x1d
+created by tailscale.com/wgengine/magicsock.NewConn
+	/src/wgengine/magicsock/magicsock.go:456 +0x2a
+`
+
+func TestFind(t *testing.T) {
+	mtime := time.Date(2022, 8, 1, 11, 0, 0, 0, time.UTC)
+	r := Find([]byte(crashLog), mtime)
+	if r == nil {
+		t.Fatal("no crash found")
+	}
+	if want := "panic: runtime error: index out of range [3] with length 3"; r.Reason != want {
+		t.Errorf("Reason = %q; want %q", r.Reason, want)
+	}
+	if r.Version != "1.29.0-t1234" {
+		t.Errorf("Version = %q", r.Version)
+	}
+	if !strings.HasPrefix(r.Stack, "\ngoroutine 42 [running]:\n") || !strings.Contains(r.Stack, "NewConn") {
+		t.Errorf("Stack = %q", r.Stack)
+	}
+	wantLogs := []string{
+		`Program starting: v1.29.0-t1234, Go 1.18.3-ts1: []string{"tailscaled"}`,
+		"LogID: abc",
+		"magicsock: doing something",
+	}
+	if !reflect.DeepEqual(r.RecentLogs, wantLogs) {
+		t.Errorf("RecentLogs = %q; want %q", r.RecentLogs, wantLogs)
+	}
+	if want := time.Date(2022, 8, 1, 10, 0, 2, 0, time.UTC); !r.Time.Equal(want) {
+		t.Errorf("Time = %v; want %v", r.Time, want)
+	}
+	if r.ID == "" {
+		t.Error("empty ID")
+	}
+
+	// A later run's logs after the crash don't change it.
+	later := crashLog + `{"logtail": {"client_time": "2022-08-01T12:00:00Z"}, "text": "Program starting: v1.29.1, Go 1.18.3-ts1: []string{}\n"}` + "\n"
+	r2 := Find([]byte(later), mtime)
+	if r2 == nil || r2.ID != r.ID || r2.Stack != r.Stack {
+		t.Errorf("with later logs, got %+v; want ID %v", r2, r.ID)
+	}
+
+	if r := Find([]byte(`{"text": "panic: not a real one"}`+"\n"), mtime); r != nil {
+		t.Errorf("found crash in JSON log text: %+v", r)
+	}
+	if r := Find([]byte("fatal error: concurrent map writes\n\ngoroutine 1 [running]:\n"), mtime); r == nil || r.Reason != "fatal error: concurrent map writes" {
+		t.Errorf("fatal error: got %+v", r)
+	}
+}
+
+func TestFindInLogs(t *testing.T) {
+	dir := t.TempDir()
+	p1 := filepath.Join(dir, "tailscaled.log1.txt")
+	p2 := filepath.Join(dir, "tailscaled.log2.txt")
+	if err := os.WriteFile(p1, []byte(crashLog), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p2, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if r := FindInLogs(p1, p2, filepath.Join(dir, "missing")); r == nil || r.Version != "1.29.0-t1234" {
+		t.Errorf("FindInLogs = %+v", r)
+	}
+	if r := FindInLogs(p2); r != nil {
+		t.Errorf("FindInLogs(empty) = %+v", r)
+	}
+}
+
+func TestSaveList(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "crashes")
+	if reports, err := List(dir); err != nil || len(reports) != 0 {
+		t.Fatalf("List of missing dir = %v, %v", reports, err)
+	}
+
+	base := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < maxReports+2; i++ {
+		r := &Report{
+			ID:     fmt.Sprintf("id%02d", i),
+			Time:   base.Add(time.Duration(i) * time.Hour),
+			Reason: "panic: test",
+		}
+		isNew, err := Save(dir, r)
+		if err != nil || !isNew {
+			t.Fatalf("Save(%v) = %v, %v", r.ID, isNew, err)
+		}
+	}
+	if isNew, err := Save(dir, &Report{ID: "id11", Time: base}); err != nil || isNew {
+		t.Errorf("Save of existing report = %v, %v; want false, nil", isNew, err)
+	}
+
+	reports, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != maxReports {
+		t.Fatalf("got %d reports; want %d", len(reports), maxReports)
+	}
+	if reports[0].ID != "id11" || reports[len(reports)-1].ID != "id02" {
+		t.Errorf("reports run %v to %v; want id11 to id02", reports[0].ID, reports[len(reports)-1].ID)
+	}
+
+	if err := MarkUploaded(dir, "id05"); err != nil {
+		t.Fatal(err)
+	}
+	reports, _ = List(dir)
+	for _, r := range reports {
+		if got, want := r.Uploaded, r.ID == "id05"; got != want {
+			t.Errorf("%v: Uploaded = %v; want %v", r.ID, got, want)
+		}
+	}
+}
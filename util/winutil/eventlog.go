@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package winutil
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EventSource is the Windows Event Log source that tailscaled's events
+// are written under, in the Application log. It's also the name of the
+// ETW (TraceLogging) provider that they're written to, whose GUID is
+// derived from the name, as usual for TraceLogging providers.
+const EventSource = "Tailscale"
+
+// EventID identifies a kind of event that tailscaled writes to the
+// Windows Event Log. The values are stable, so that SIEM rules can match
+// on them; don't renumber them. They stay within 1 to 1000, the range
+// of the EventCreate message file the event source is registered with
+// (see InstallEventSource).
+type EventID uint32
+
+const (
+	EventServiceStart EventID = 100 // the Tailscale service started
+	EventServiceStop  EventID = 101 // the Tailscale service stopped
+
+	EventConnected  EventID = 110 // tailscaled entered the Running state
+	EventStopped    EventID = 111 // tailscaled was stopped (tailscale down)
+	EventNeedsLogin EventID = 112 // the node needs to log in
+	EventLogin      EventID = 113 // a user logged in, or the logged-in user changed
+	EventLogout     EventID = 114 // the node logged out
+
+	EventAccessExpired EventID = 115 // the access period set by "tailscale up --duration" ended
+
+	EventPolicyApplied EventID = 120 // a new packet filter or SSH policy from control took effect
+
+	EventRoutesChanged EventID = 130 // the routes via Tailscale changed
+)
+
+// eventNames are the ETW event names of the EventIDs.
+var eventNames = map[EventID]string{
+	EventServiceStart:  "ServiceStart",
+	EventServiceStop:   "ServiceStop",
+	EventConnected:     "Connected",
+	EventStopped:       "Stopped",
+	EventNeedsLogin:    "NeedsLogin",
+	EventLogin:         "Login",
+	EventLogout:        "Logout",
+	EventAccessExpired: "AccessExpired",
+	EventPolicyApplied: "PolicyApplied",
+	EventRoutesChanged: "RoutesChanged",
+}
+
+func (id EventID) String() string {
+	if n, ok := eventNames[id]; ok {
+		return n
+	}
+	return fmt.Sprintf("Event%d", uint32(id))
+}
+
+// LogEvent writes an informational event to the Windows Event Log,
+// describing it with summary and the key/value pairs in fields, which
+// are written one per line after it:
+//
+//	Connected to Tailscale.
+//
+//	User: alice@example.com
+//	Addresses: 100.101.102.103
+//
+// It also writes the event to the ETW provider, named id.String(),
+// with EventID, Summary and fields as its fields.
+//
+// It does nothing on other platforms or if the "EventLog" system
+// policy is set to 0, and skips the Event Log or ETW if it can't be
+// opened.
+func LogEvent(id EventID, summary string, fields ...string) {
+	logEvent(id, summary, fields)
+}
+
+func formatEvent(summary string, fields []string) string {
+	var sb strings.Builder
+	sb.WriteString(summary)
+	if len(fields) > 0 {
+		sb.WriteString("\r\n")
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		sb.WriteString("\r\n")
+		sb.WriteString(fields[i])
+		sb.WriteString(": ")
+		sb.WriteString(fields[i+1])
+	}
+	return sb.String()
+}
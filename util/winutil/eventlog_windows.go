@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package winutil
+
+import (
+	"sync"
+
+	"github.com/Microsoft/go-winio/pkg/etw"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+var (
+	eventLogOnce sync.Once
+	eventLog     *eventlog.Log // or nil if disabled or unavailable
+	etwProvider  *etw.Provider // or nil if disabled or unavailable
+)
+
+func logEvent(id EventID, summary string, fields []string) {
+	eventLogOnce.Do(func() {
+		if GetPolicyInteger("EventLog", 1) == 0 {
+			return
+		}
+		if l, err := eventlog.Open(EventSource); err == nil {
+			eventLog = l
+		}
+		if p, err := etw.NewProvider(EventSource, nil); err == nil {
+			etwProvider = p
+		}
+	})
+	if eventLog != nil {
+		eventLog.Info(uint32(id), formatEvent(summary, fields))
+	}
+	if etwProvider != nil {
+		fo := []etw.FieldOpt{
+			etw.Uint32Field("EventID", uint32(id)),
+			etw.StringField("Summary", summary),
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			fo = append(fo, etw.StringField(fields[i], fields[i+1]))
+		}
+		etwProvider.WriteEvent(id.String(), etw.WithEventOpts(etw.WithLevel(etw.LevelInfo)), fo)
+	}
+}
+
+// eventSourceKey is the registry key, in HKEY_LOCAL_MACHINE, of the
+// EventSource registration.
+const eventSourceKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\` + EventSource
+
+// InstallEventSource registers EventSource with the Windows Event Log,
+// using EventCreate.exe's message file, so the Event Viewer and event
+// collectors show tailscaled's event text as written. It's not an error
+// if it's already registered.
+func InstallEventSource() error {
+	if k, err := registry.OpenKey(registry.LOCAL_MACHINE, eventSourceKey, registry.QUERY_VALUE); err == nil {
+		k.Close()
+		return nil
+	}
+	return eventlog.InstallAsEventCreate(EventSource, eventlog.Error|eventlog.Warning|eventlog.Info)
+}
+
+// RemoveEventSource removes the registration made by InstallEventSource.
+// Events already written stay in the log.
+func RemoveEventSource() error {
+	return eventlog.Remove(EventSource)
+}
@@ -18,3 +18,5 @@ func getRegString(name, defval string) string { return defval }
 func getRegInteger(name string, defval uint64) uint64 { return defval }
 
 func isSIDValidPrincipal(uid string) bool { return false }
+
+func logEvent(id EventID, summary string, fields []string) {}
@@ -263,6 +263,11 @@ func init() {
 	dropBucket = rate.NewLimiter(rate.Every(time.Millisecond), 10)
 }
 
+// logComponent is the "filter" component of "tailscale debug
+// loglevel". At LevelDebug, accepted and dropped packets are logged
+// without rate limits, and at LevelTrace, with hexdumps too.
+var logComponent = logger.NewComponent("filter", logger.LevelInfo)
+
 func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why string) {
 	if !f.loggingAllowed(q) {
 		return
@@ -272,11 +277,16 @@ func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction
 		return
 	}
 
+	unlimited := logComponent.Enabled(logger.LevelDebug)
+	if logComponent.Enabled(logger.LevelTrace) {
+		runflags |= HexdumpDrops | HexdumpAccepts
+	}
+
 	var verdict string
-	if r == Drop && (runflags&LogDrops) != 0 && dropBucket.Allow() {
+	if r == Drop && (runflags&LogDrops) != 0 && (unlimited || dropBucket.Allow()) {
 		verdict = "Drop"
 		runflags &= HexdumpDrops
-	} else if r == Accept && (runflags&LogAccepts) != 0 && acceptBucket.Allow() {
+	} else if r == Accept && (runflags&LogAccepts) != 0 && (unlimited || acceptBucket.Allow()) {
 		verdict = "Accept"
 		runflags &= HexdumpAccepts
 	}
@@ -7,6 +7,8 @@
 package filter
 
 import (
+	"time"
+
 	"inet.af/netaddr"
 	"tailscale.com/types/ipproto"
 )
@@ -28,8 +30,10 @@ func (src *Match) Clone() *Match {
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _MatchCloneNeedsRegeneration = Match(struct {
-	IPProto []ipproto.Proto
-	Srcs    []netaddr.IPPrefix
-	Dsts    []NetPortRange
-	Caps    []CapMatch
+	IPProto     []ipproto.Proto
+	Srcs        []netaddr.IPPrefix
+	Dsts        []NetPortRange
+	Caps        []CapMatch
+	ValidAfter  time.Time
+	ValidBefore time.Time
 }{})
@@ -11,6 +11,7 @@
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"inet.af/netaddr"
@@ -814,6 +815,35 @@ func TestMatchesFromFilterRules(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "validity_window",
+			in: []tailcfg.FilterRule{
+				{
+					IPProto:     []int{int(ipproto.TCP)},
+					SrcIPs:      []string{"100.64.1.1"},
+					DstPorts:    []tailcfg.NetPortRange{{IP: "100.64.2.2", Ports: tailcfg.PortRange{First: 22, Last: 22}}},
+					ValidAfter:  &testValidAfter,
+					ValidBefore: &testValidBefore,
+				},
+			},
+			want: []Match{
+				{
+					IPProto: []ipproto.Proto{ipproto.TCP},
+					Dsts: []NetPortRange{
+						{
+							Net:   netaddr.MustParseIPPrefix("100.64.2.2/32"),
+							Ports: PortRange{22, 22},
+						},
+					},
+					Srcs: []netaddr.IPPrefix{
+						netaddr.MustParseIPPrefix("100.64.1.1/32"),
+					},
+					Caps:        []CapMatch{},
+					ValidAfter:  testValidAfter,
+					ValidBefore: testValidBefore,
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -957,3 +987,95 @@ func TestCaps(t *testing.T) {
 		})
 	}
 }
+
+var (
+	testValidAfter  = time.Date(2022, 8, 1, 9, 0, 0, 0, time.UTC)
+	testValidBefore = time.Date(2022, 8, 1, 17, 0, 0, 0, time.UTC)
+)
+
+func TestActiveMatches(t *testing.T) {
+	always := Match{Srcs: nets("1.1.1.1")}
+	window := Match{Srcs: nets("2.2.2.2"), ValidAfter: testValidAfter, ValidBefore: testValidBefore}
+	expiring := Match{Srcs: nets("3.3.3.3"), ValidBefore: testValidAfter.Add(time.Hour)}
+	ms := []Match{always, window, expiring}
+
+	srcsOf := func(ms []Match) (ret []string) {
+		for _, m := range ms {
+			ret = append(ret, m.Srcs[0].IP().String())
+		}
+		return ret
+	}
+	tests := []struct {
+		name     string
+		now      time.Time
+		wantSrcs []string
+		wantNext time.Time
+	}{
+		{
+			name:     "before",
+			now:      testValidAfter.Add(-time.Minute),
+			wantSrcs: []string{"1.1.1.1", "3.3.3.3"},
+			wantNext: testValidAfter,
+		},
+		{
+			name:     "at_start",
+			now:      testValidAfter,
+			wantSrcs: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"},
+			wantNext: testValidAfter.Add(time.Hour),
+		},
+		{
+			name:     "during",
+			now:      testValidAfter.Add(2 * time.Hour),
+			wantSrcs: []string{"1.1.1.1", "2.2.2.2"},
+			wantNext: testValidBefore,
+		},
+		{
+			name:     "at_end",
+			now:      testValidBefore,
+			wantSrcs: []string{"1.1.1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active, next := ActiveMatches(ms, tt.now)
+			if got := srcsOf(active); !reflect.DeepEqual(got, tt.wantSrcs) {
+				t.Errorf("active = %q; want %q", got, tt.wantSrcs)
+			}
+			if !next.Equal(tt.wantNext) {
+				t.Errorf("next = %v; want %v", next, tt.wantNext)
+			}
+		})
+	}
+
+	if got, next := ActiveMatches([]Match{always}, testValidAfter); len(got) != 1 || !next.IsZero() {
+		t.Errorf("unscheduled = %v, %v; want input and zero time", got, next)
+	}
+}
+
+func TestSourcesTo(t *testing.T) {
+	tcp := []ipproto.Proto{ipproto.TCP}
+	ms := []Match{
+		{IPProto: tcp, Srcs: nets("100.64.0.0/10"), Dsts: netports("100.101.102.103:22")},
+		{IPProto: tcp, Srcs: nets("100.1.1.1", "100.2.2.2"), Dsts: netports("100.101.102.103:8000-9000")},
+		{IPProto: tcp, Srcs: nets("100.2.2.2"), Dsts: netports("0.0.0.0/0:*")},
+		{IPProto: tcp, Srcs: nets("100.3.3.3"), Dsts: netports("100.9.9.9:22")},
+		{IPProto: []ipproto.Proto{ipproto.UDP}, Srcs: nets("100.4.4.4"), Dsts: netports("100.101.102.103:*")},
+	}
+	self := nets("100.101.102.103")
+	tests := []struct {
+		proto ipproto.Proto
+		port  uint16
+		want  []netaddr.IPPrefix
+	}{
+		{ipproto.TCP, 22, nets("100.64.0.0/10", "100.2.2.2")},
+		{ipproto.TCP, 8080, nets("100.1.1.1", "100.2.2.2")},
+		{ipproto.TCP, 443, nets("100.2.2.2")},
+		{ipproto.UDP, 53, nets("100.4.4.4")},
+		{ipproto.SCTP, 53, nil},
+	}
+	for _, tt := range tests {
+		if got := SourcesTo(ms, self, tt.proto, tt.port); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SourcesTo(%v, %v) = %v; want %v", tt.proto, tt.port, got, tt.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
@@ -65,6 +66,93 @@ type Match struct {
 	Srcs    []netaddr.IPPrefix
 	Dsts    []NetPortRange // optional, if Srcs match
 	Caps    []CapMatch     // optional, if Srcs match
+
+	// ValidAfter and ValidBefore, if non-zero, bound when the Match is
+	// in effect. See ActiveMatches.
+	ValidAfter  time.Time // inclusive
+	ValidBefore time.Time // exclusive
+}
+
+// ActiveAt reports whether m is in effect at t.
+func (m *Match) ActiveAt(t time.Time) bool {
+	if !m.ValidAfter.IsZero() && t.Before(m.ValidAfter) {
+		return false
+	}
+	if !m.ValidBefore.IsZero() && !t.Before(m.ValidBefore) {
+		return false
+	}
+	return true
+}
+
+// ActiveMatches returns the subset of ms that is in effect at now, and
+// the earliest time after now at which that subset changes, or the zero
+// time if it never does.
+//
+// If no Match in ms has a validity window, ms itself is returned.
+func ActiveMatches(ms []Match, now time.Time) (active []Match, next time.Time) {
+	scheduled := false
+	for i := range ms {
+		if !ms[i].ValidAfter.IsZero() || !ms[i].ValidBefore.IsZero() {
+			scheduled = true
+			break
+		}
+	}
+	if !scheduled {
+		return ms, time.Time{}
+	}
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	active = make([]Match, 0, len(ms))
+	for i := range ms {
+		m := &ms[i]
+		consider(m.ValidAfter)
+		consider(m.ValidBefore)
+		if m.ActiveAt(now) {
+			active = append(active, *m)
+		}
+	}
+	return active, next
+}
+
+// SourcesTo returns the source prefixes of the matches in ms that let
+// proto traffic reach port on any of dsts, such as this node's
+// addresses, without duplicates, in the order of ms. It's a summary of
+// who can reach a service; it doesn't consider validity windows, so
+// callers should filter ms with ActiveMatches first.
+func SourcesTo(ms []Match, dsts []netaddr.IPPrefix, proto ipproto.Proto, port uint16) []netaddr.IPPrefix {
+	var ret []netaddr.IPPrefix
+	seen := map[netaddr.IPPrefix]bool{}
+	for _, m := range ms {
+		if !protoInList(proto, m.IPProto) || !reachesAny(m.Dsts, dsts, port) {
+			continue
+		}
+		for _, src := range m.Srcs {
+			if !seen[src] {
+				seen[src] = true
+				ret = append(ret, src)
+			}
+		}
+	}
+	return ret
+}
+
+// reachesAny reports whether any of npr includes port on a network
+// overlapping one of dsts.
+func reachesAny(npr []NetPortRange, dsts []netaddr.IPPrefix, port uint16) bool {
+	for _, d := range npr {
+		if !d.Ports.contains(port) {
+			continue
+		}
+		for _, dst := range dsts {
+			if d.Net.Overlaps(dst) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (m Match) String() string {
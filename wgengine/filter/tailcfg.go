@@ -88,6 +88,13 @@ func MatchesFromFilterRules(pf []tailcfg.FilterRule) ([]Match, error) {
 			}
 		}
 
+		if r.ValidAfter != nil {
+			m.ValidAfter = *r.ValidAfter
+		}
+		if r.ValidBefore != nil {
+			m.ValidBefore = *r.ValidBefore
+		}
+
 		mm = append(mm, m)
 	}
 	return mm, erracc
@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"sort"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/flowtrack"
+)
+
+// flowStatsIdle is how long flow accounting stays enabled after the
+// last FlowStats call. Counting costs a little on every packet, so it's
+// only done while someone (like "tailscale top") is looking.
+const flowStatsIdle = time.Minute
+
+func (e *userspaceEngine) FlowStats() []ipnstate.FlowStat {
+	e.mu.Lock()
+	if e.closing {
+		e.mu.Unlock()
+		return nil
+	}
+	e.lastFlowStatsCall = time.Now()
+	fc := e.flowCounter
+	if fc == nil {
+		fc = new(flowtrack.Counter)
+		e.flowCounter = fc
+		e.tundev.SetFlowCounter(fc)
+		if e.flowIdleTimer == nil {
+			e.flowIdleTimer = time.AfterFunc(flowStatsIdle, e.stopIdleFlowStats)
+		} else {
+			e.flowIdleTimer.Reset(flowStatsIdle)
+		}
+	}
+	e.mu.Unlock()
+
+	flows := fc.Flows()
+	ret := make([]ipnstate.FlowStat, 0, len(flows))
+	for t, c := range flows {
+		fs := ipnstate.FlowStat{
+			Proto:     t.Proto,
+			Local:     t.Src,
+			Remote:    t.Dst,
+			TxPackets: c.TxPackets,
+			TxBytes:   c.TxBytes,
+			RxPackets: c.RxPackets,
+			RxBytes:   c.RxBytes,
+		}
+		if pip, ok := e.PeerForIP(t.Dst.IP()); ok && !pip.IsSelf {
+			fs.Peer = pip.Node.Key
+		}
+		ret = append(ret, fs)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].TxBytes+ret[i].RxBytes > ret[j].TxBytes+ret[j].RxBytes
+	})
+	return ret
+}
+
+// stopIdleFlowStats is called by e.flowIdleTimer to stop flow
+// accounting if FlowStats hasn't been called for flowStatsIdle.
+func (e *userspaceEngine) stopIdleFlowStats() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closing || e.flowCounter == nil {
+		return
+	}
+	if d := time.Since(e.lastFlowStatsCall); d < flowStatsIdle {
+		e.flowIdleTimer.Reset(flowStatsIdle - d)
+		return
+	}
+	e.tundev.SetFlowCounter(nil)
+	e.flowCounter = nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"tailscale.com/types/logger"
+)
+
+// wireguard-go starts runtime.NumCPU encryption, decryption and
+// handshake workers each, which then compete for GOMAXPROCS threads.
+// On busy exit nodes and subnet routers, operators may want to
+// confine that work to a subset of the machine's CPUs (for instance,
+// to keep it off the CPUs servicing NIC interrupts). The functions in
+// this file let them do so at startup, via TS_CPU_AFFINITY, or at
+// runtime, via LocalAPI.
+//
+// The Go runtime computes NumCPU once, from the affinity mask the
+// process starts with, so the size of wireguard-go's worker pools can
+// only be set at startup; see ExecWithCPUAffinity. At runtime, only
+// the affinity and GOMAXPROCS can change.
+
+// maxCPU bounds the CPU numbers ParseCPUList accepts. It's the
+// kernel's CPU_SETSIZE, the most CPUs an affinity mask can name.
+const maxCPU = 1024
+
+// ParseCPUList parses a Linux-style CPU list, such as "0-3,6", into
+// a sorted list of unique CPU numbers.
+func ParseCPUList(s string) ([]int, error) {
+	seen := map[int]bool{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(f, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid CPU %q in list %q", lo, s)
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(hi)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU range %q in list %q", f, s)
+			}
+		}
+		if last >= maxCPU {
+			return nil, fmt.Errorf("CPU %d in list %q out of range; max is %d", last, s, maxCPU-1)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			seen[cpu] = true
+		}
+	}
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("empty CPU list %q", s)
+	}
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+var errCPUAffinityUnsupported = errors.New("CPU affinity not supported on " + runtime.GOOS)
+
+// SetCPUAffinity restricts all of the process's threads to the given
+// CPUs. If GOMAXPROCS is larger than len(cpus), it's lowered to match,
+// so the crypto workers don't contend for fewer CPUs than threads.
+//
+// It's only supported on Linux.
+func SetCPUAffinity(cpus []int) error {
+	if len(cpus) == 0 {
+		return errors.New("no CPUs specified")
+	}
+	if err := setCPUAffinity(cpus); err != nil {
+		return err
+	}
+	if runtime.GOMAXPROCS(0) > len(cpus) {
+		SetMaxProcs(len(cpus))
+	}
+	return nil
+}
+
+// SetMaxProcs sets GOMAXPROCS to n, bounding how many of wireguard-go's
+// crypto workers run concurrently. If n <= 0, it's reset to the number
+// of CPUs.
+func SetMaxProcs(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	runtime.GOMAXPROCS(n)
+	updateCPUMetrics()
+}
+
+func updateCPUMetrics() {
+	metricGOMAXPROCS.Set(int64(runtime.GOMAXPROCS(0)))
+	metricNumCPU.Set(int64(runtime.NumCPU()))
+}
+
+// CPUInfo describes how the crypto pipeline is scheduled.
+type CPUInfo struct {
+	NumCPU     int   // number of CPUs usable at startup; wireguard-go's per-stage worker count
+	GOMAXPROCS int   // current maximum number of concurrently running threads
+	Affinity   []int // CPUs the process may run on, or nil if unknown
+}
+
+// GetCPUInfo returns the current CPUInfo.
+func GetCPUInfo() CPUInfo {
+	ci := CPUInfo{
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+	}
+	ci.Affinity, _ = getCPUAffinity()
+	return ci
+}
+
+// envCPUAffinityExeced is set in the environment of a process started
+// by ExecWithCPUAffinity, so that it doesn't re-execute itself again.
+const envCPUAffinityExeced = "TS_INTERNAL_CPU_AFFINITY_EXECED"
+
+// ExecWithCPUAffinity sizes wireguard-go's worker pools to match
+// TS_CPU_AFFINITY. If the knob is set and the process isn't already
+// confined to those CPUs, it restricts the calling thread to them and
+// re-executes the program in place, so that runtime.NumCPU, and with
+// it the number of workers per stage, equals the number of CPUs
+// listed.
+//
+// It should be called early in main, before starting any work. It
+// returns only if there's nothing to do or it fails. It's a no-op
+// on platforms other than Linux.
+func ExecWithCPUAffinity() error {
+	if envCPUAffinity == "" || os.Getenv(envCPUAffinityExeced) != "" {
+		return nil
+	}
+	cpus, err := ParseCPUList(envCPUAffinity)
+	if err != nil {
+		return fmt.Errorf("TS_CPU_AFFINITY: %w", err)
+	}
+	return execWithCPUAffinity(cpus)
+}
+
+var envCPUAffinityOnce sync.Once
+
+// applyEnvCPUAffinity applies the TS_CPU_AFFINITY knob, once per
+// process, and initializes the CPU metrics.
+func applyEnvCPUAffinity(logf logger.Logf) {
+	envCPUAffinityOnce.Do(func() {
+		updateCPUMetrics()
+		if envCPUAffinity == "" {
+			return
+		}
+		cpus, err := ParseCPUList(envCPUAffinity)
+		if err == nil {
+			err = SetCPUAffinity(cpus)
+		}
+		if err != nil {
+			logf("magicsock: TS_CPU_AFFINITY: %v", err)
+			return
+		}
+		logf("magicsock: restricted to CPUs %v, GOMAXPROCS=%d", cpus, runtime.GOMAXPROCS(0))
+	})
+}
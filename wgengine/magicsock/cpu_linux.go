@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+func cpuSet(cpus []int) *unix.CPUSet {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return &set
+}
+
+func setCPUAffinity(cpus []int) error {
+	set := cpuSet(cpus)
+	// Affinity is per thread. New threads inherit it from the thread
+	// that created them, so set it on every existing thread. Go
+	// around twice in case a thread was started by one we hadn't
+	// gotten to yet.
+	for i := 0; i < 2; i++ {
+		tids, err := os.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+		for _, de := range tids {
+			tid, err := strconv.Atoi(de.Name())
+			if err != nil {
+				continue
+			}
+			if err := unix.SchedSetaffinity(tid, set); err != nil && err != unix.ESRCH {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func getCPUAffinity() ([]int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for cpu := 0; cpu < len(set)*64 && len(cpus) < set.Count(); cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+func execWithCPUAffinity(cpus []int) error {
+	if cur, err := getCPUAffinity(); err == nil && len(cur) == len(cpus) {
+		same := true
+		for i := range cur {
+			same = same && cur[i] == cpus[i]
+		}
+		if same {
+			return nil
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// Affinity is inherited across execve, so it's enough to set it
+	// on the thread that execs.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.SchedSetaffinity(0, cpuSet(cpus)); err != nil {
+		return err
+	}
+	env := append(os.Environ(), envCPUAffinityExeced+"=1")
+	return unix.Exec(exe, os.Args, env)
+}
@@ -39,6 +39,7 @@ type D struct {
 			regionID   int
 			lastWrite  time.Time
 			createTime time.Time
+			queued     int
 		}
 		ent := make([]D, 0, len(c.activeDerp))
 		for rid, ad := range c.activeDerp {
@@ -46,6 +47,7 @@ type D struct {
 				regionID:   rid,
 				lastWrite:  *ad.lastWrite,
 				createTime: ad.createTime,
+				queued:     len(ad.writeCh),
 			})
 		}
 		sort.Slice(ent, func(i, j int) bool {
@@ -60,16 +62,26 @@ type D struct {
 			if e.regionID == c.myDerp {
 				home = "🏠"
 			}
-			fmt.Fprintf(w, "<li>%s %d - %v: created %v ago, write %v ago</li>\n",
+			fmt.Fprintf(w, "<li>%s %d - %v: created %v ago, write %v ago, %d/%d writes queued</li>\n",
 				home, e.regionID, html.EscapeString(r.RegionCode),
 				now.Sub(e.createTime).Round(time.Second),
 				now.Sub(e.lastWrite).Round(time.Second),
+				e.queued, bufferedDerpWritesBeforeDrop,
 			)
 		}
 
 	}
 	fmt.Fprintf(w, "</ul>\n")
 
+	ci := GetCPUInfo()
+	fmt.Fprintf(w, "<h2 id=cpu><a href=#cpu>#</a> CPU</h2><ul>")
+	fmt.Fprintf(w, "<li>crypto workers per stage (NumCPU): %d</li>\n", ci.NumCPU)
+	fmt.Fprintf(w, "<li>GOMAXPROCS: %d</li>\n", ci.GOMAXPROCS)
+	if ci.Affinity != nil {
+		fmt.Fprintf(w, "<li>affinity: %v</li>\n", ci.Affinity)
+	}
+	fmt.Fprintf(w, "</ul>\n")
+
 	fmt.Fprintf(w, "<h2 id=ipport><a href=#ipport>#</a> ip:port to endpoint</h2><ul>")
 	{
 		type kv struct {
@@ -33,6 +33,18 @@
 	debugReSTUNStopOnIdle = envknob.Bool("TS_DEBUG_RESTUN_STOP_ON_IDLE")
 	// debugAlwaysDERP disables the use of UDP, forcing all peer communication over DERP.
 	debugAlwaysDERP = envknob.Bool("TS_DEBUG_ALWAYS_USE_DERP")
+	// debugFixedNATKeepAlive disables measuring the NAT mapping
+	// lifetime, so periodic re-STUNs stay at their fixed default
+	// interval.
+	debugFixedNATKeepAlive = envknob.Bool("TS_DEBUG_FIXED_NAT_KEEPALIVE")
+	// debugDisableDSCP disables DSCP marking of disco and
+	// interactive packets.
+	debugDisableDSCP = envknob.Bool("TS_DEBUG_DISABLE_DSCP")
+	// envCPUAffinity, if set, is a CPU list (such as "0-3,6") to
+	// restrict tailscaled's threads to at startup, and to size
+	// wireguard-go's worker pools by; see ExecWithCPUAffinity.
+	// Linux only.
+	envCPUAffinity = envknob.String("TS_CPU_AFFINITY")
 )
 
 // inTest reports whether the running program is a test that set the
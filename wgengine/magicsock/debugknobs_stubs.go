@@ -19,6 +19,9 @@
 	logDerpVerbose                   = false
 	debugReSTUNStopOnIdle            = false
 	debugAlwaysDERP                  = false
+	debugFixedNATKeepAlive           = false
+	debugDisableDSCP                 = false
+	envCPUAffinity                   = ""
 )
 
 func inTest() bool { return false }
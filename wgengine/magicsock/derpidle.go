@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/util/clientmetric"
+)
+
+// derpIdleCheckInterval is how often a Conn with a DERPIdleTimeout
+// checks whether it's been idle long enough to disconnect from DERP.
+const derpIdleCheckInterval = 30 * time.Second
+
+var (
+	metricDERPIdleDisconnects = clientmetric.NewCounter("magicsock_derp_idle_disconnects")
+	metricDERPIdleWakes       = clientmetric.NewCounter("magicsock_derp_idle_wakes")
+
+	// metricDERPIdleSeconds is the total time spent disconnected from
+	// DERP while idle, which is the time the radio could sleep rather
+	// than wake for DERP keep-alives.
+	metricDERPIdleSeconds = clientmetric.NewCounter("magicsock_derp_idle_seconds")
+)
+
+// checkDERPIdle is run every derpIdleCheckInterval by c.derpIdleTimer.
+// It closes all DERP connections if no packets have been sent or
+// received over the tunnel for c.derpIdleTimeout.
+//
+// While a Conn is disconnected like this, peers can't reach it over
+// DERP, so it can't be reached at all except over a direct path that's
+// still open. It reconnects, via wakeDERPLocked, as soon as it has
+// something to send or gets a new network map from control.
+func (c *Conn) checkDERPIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.derpIdleTimer.Reset(derpIdleCheckInterval)
+	if c.derpIdle || len(c.activeDerp) == 0 || c.idleFunc == nil {
+		return
+	}
+	if time.Since(c.derpWokeAt) < c.derpIdleTimeout {
+		// Give whatever woke us a chance to get going.
+		return
+	}
+	idleFor := c.idleFunc()
+	if idleFor < c.derpIdleTimeout {
+		return
+	}
+	c.logf("magicsock: idle for %v; disconnecting from DERP until needed", idleFor.Round(time.Second))
+	c.closeAllDerpLocked("idle-disconnect")
+	c.derpIdle = true
+	c.derpIdleAtomic.Set(true)
+	c.derpIdleSince = time.Now()
+	metricDERPIdleDisconnects.Add(1)
+	health.SetMagicSockDERPIdle(true)
+}
+
+// wakeDERPLocked reconnects to the home DERP region if checkDERPIdle
+// disconnected from it. why is for logging.
+//
+// c.mu must be held.
+func (c *Conn) wakeDERPLocked(why string) {
+	if !c.derpIdle {
+		return
+	}
+	c.derpIdle = false
+	c.derpIdleAtomic.Set(false)
+	c.derpWokeAt = time.Now()
+	d := c.derpWokeAt.Sub(c.derpIdleSince)
+	metricDERPIdleWakes.Add(1)
+	metricDERPIdleSeconds.Add(int64(d / time.Second))
+	health.SetMagicSockDERPIdle(false)
+	c.logf("magicsock: reconnecting to DERP for %s after %v disconnected", why, d.Round(time.Second))
+	c.goDerpConnect(c.myDerp)
+}
+
+// maybeWakeDERP is wakeDERPLocked for callers without c.mu, made cheap
+// for the common case of DERP not being idle.
+func (c *Conn) maybeWakeDERP(why string) {
+	if !c.derpIdleAtomic.Get() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.wakeDERPLocked(why)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/util/clientmetric"
+)
+
+// derpRegionState is what magicsock has observed about its connection
+// to one DERP region, for DERPRegionStatus.
+type derpRegionState struct {
+	connected      bool
+	connectedSince time.Time
+	lastErr        string
+	lastErrTime    time.Time
+	problem        string // last health problem reported by the server
+}
+
+// noteDERPRegionConnected records that the connection to regionID came up
+// (err == nil) or failed with err.
+//
+// c.mu must NOT be held.
+func (c *Conn) noteDERPRegionConnected(regionID int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.derpRegionStateLocked(regionID)
+	if err == nil {
+		if !st.connected {
+			st.connected = true
+			st.connectedSince = time.Now()
+		}
+		st.problem = ""
+		return
+	}
+	st.connected = false
+	st.lastErr = err.Error()
+	st.lastErrTime = time.Now()
+	metricDERPRegionError.Add(1)
+}
+
+// noteDERPRegionClosed records that magicsock stopped using regionID.
+//
+// c.mu must NOT be held.
+func (c *Conn) noteDERPRegionClosed(regionID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.derpRegionStateLocked(regionID)
+	st.connected = false
+	st.problem = ""
+}
+
+// noteDERPRegionProblem records the health problem, if any, that the
+// server for regionID reported.
+//
+// c.mu must NOT be held.
+func (c *Conn) noteDERPRegionProblem(regionID int, problem string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.derpRegionStateLocked(regionID).problem = problem
+}
+
+// c.mu must be held.
+func (c *Conn) derpRegionStateLocked(regionID int) *derpRegionState {
+	st, ok := c.derpRegionState[regionID]
+	if !ok {
+		if c.derpRegionState == nil {
+			c.derpRegionState = map[int]*derpRegionState{}
+		}
+		st = new(derpRegionState)
+		c.derpRegionState[regionID] = st
+	}
+	return st
+}
+
+// DERPRegionStatus returns the state of each region in the current DERP
+// map, sorted by region ID.
+func (c *Conn) DERPRegionStatus() []*ipnstate.DERPRegionStatus {
+	report, _ := c.lastNetCheckReport.Load().(*netcheck.Report)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.derpMap == nil {
+		return nil
+	}
+	ret := make([]*ipnstate.DERPRegionStatus, 0, len(c.derpMap.Regions))
+	for id, r := range c.derpMap.Regions {
+		rs := &ipnstate.DERPRegionStatus{
+			RegionID:   id,
+			RegionCode: r.RegionCode,
+			RegionName: r.RegionName,
+			Home:       id == c.myDerp,
+			Forced:     id == c.myDerp && id == c.derpHomeOverride,
+		}
+		_, rs.Active = c.activeDerp[id]
+		if st, ok := c.derpRegionState[id]; ok {
+			rs.Connected = st.connected && rs.Active
+			if rs.Connected {
+				rs.ConnectedSince = st.connectedSince
+			}
+			rs.LastError = st.lastErr
+			rs.LastErrorTime = st.lastErrTime
+			rs.Problem = st.problem
+		}
+		if report != nil {
+			rs.Latency = report.RegionLatency[id]
+		}
+		ret = append(ret, rs)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RegionID < ret[j].RegionID })
+	return ret
+}
+
+// SetDERPHealthPath makes c keep the history of netcheck's DERP region
+// results in the JSON file at path, so it survives restarts.
+func (c *Conn) SetDERPHealthPath(path string) {
+	c.derpHealth.SetPath(path, c.logf)
+}
+
+// DERPHealth returns the recent and longer-term latency and availability
+// of each region in the current DERP map, sorted by region ID.
+func (c *Conn) DERPHealth() []netcheck.RegionHealth {
+	return c.derpHealth.Health(time.Now())
+}
+
+// SetDERPHomeOverride makes regionID the home DERP region regardless of
+// netcheck's latency measurements, until it's called again. A regionID of
+// zero returns to automatic selection.
+//
+// It's meant for exercising DERP failover on demand.
+func (c *Conn) SetDERPHomeOverride(regionID int) error {
+	c.mu.Lock()
+	if regionID != 0 {
+		if c.derpMap == nil || c.derpMap.Regions[regionID] == nil {
+			c.mu.Unlock()
+			return fmt.Errorf("unknown DERP region %d", regionID)
+		}
+		if c.derpMap.Regions[regionID].Avoid {
+			c.logf("magicsock: forcing home to derp-%d, which the DERP map says to avoid", regionID)
+		}
+		metricDERPHomeForced.Add(1)
+	}
+	c.derpHomeOverride = regionID
+	c.mu.Unlock()
+
+	if regionID != 0 {
+		c.logf("magicsock: forcing DERP home to derp-%d", regionID)
+	} else {
+		c.logf("magicsock: DERP home back to automatic selection")
+	}
+	// Re-run netcheck, which picks the home region and reports it to
+	// control.
+	c.ReSTUN("derp-home-override")
+	return nil
+}
+
+var (
+	metricDERPRegionError = clientmetric.NewCounter("magicsock_derp_region_error")
+	metricDERPHomeForced  = clientmetric.NewCounter("magicsock_derp_home_forced")
+)
@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net"
+
+	"tailscale.com/disco"
+	"tailscale.com/net/dscp"
+	"tailscale.com/net/netcheck"
+)
+
+// Where the platform allows, magicsock marks its IPv4 disco packets
+// and small (likely interactive) WireGuard packets with dscp.AF41, so
+// Wi-Fi networks with WMM give them priority. netcheck's STUN probes
+// are marked too, and packets go out unmarked until a probe arrives
+// with its marking intact, and again whenever one arrives with it
+// stripped.
+
+// dscpInteractiveMaxLen is the size of the largest WireGuard packet
+// that's marked. Keystrokes, voice frames and game updates fit; the
+// full-sized packets of bulk transfers don't.
+const dscpInteractiveMaxLen = 256
+
+// dscpEnabled reports whether magicsock marks packets at all.
+func dscpEnabled() bool {
+	return dscp.Supported() && !debugDisableDSCP
+}
+
+// dscpFor returns the DSCP value to mark IPv4 packet b with, or 0 to
+// send it unmarked.
+func (c *Conn) dscpFor(b []byte) uint8 {
+	if !c.dscpMarking.Get() {
+		return 0
+	}
+	if len(b) <= dscpInteractiveMaxLen || disco.LooksLikeDiscoWrapper(b) {
+		return dscp.AF41
+	}
+	return 0
+}
+
+// updateDSCPMarking starts or stops marking packets depending on
+// whether report found the network preserving the marking of its
+// probes.
+func (c *Conn) updateDSCPMarking(report *netcheck.Report) {
+	if !dscpEnabled() || report.DSCPPreserved == "" {
+		return
+	}
+	c.dscpChecked.Set(true)
+	preserved := report.DSCPPreserved.EqualBool(true)
+	if c.dscpMarking.Swap(preserved) {
+		if preserved {
+			c.logf("magicsock: network preserves DSCP markings; marking interactive packets")
+		} else {
+			c.logf("magicsock: network strips DSCP markings; no longer marking packets")
+		}
+	}
+}
+
+// dscpStatus describes the DSCP marking state for ipnstate.Status.
+func (c *Conn) dscpStatus() string {
+	switch {
+	case !dscpEnabled():
+		return ""
+	case c.dscpMarking.Get():
+		return "marking"
+	case !c.dscpChecked.Get():
+		return "unchecked"
+	}
+	return "stripped"
+}
+
+// WriteToDSCP implements netcheck.DSCPConn. It's like WriteTo, but
+// marks the packet with DSCP value d, when the underlying connection is
+// a *net.UDPConn and the platform supports marking.
+func (c *RebindingUDPConn) WriteToDSCP(b []byte, addr net.Addr, d uint8) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	for {
+		c.mu.Lock()
+		pconn := c.pconn
+		c.mu.Unlock()
+
+		var n int
+		var err error
+		if uc, isUDP := pconn.(*net.UDPConn); ok && isUDP {
+			n, err = dscp.WriteTo(uc, b, ua, d)
+		} else {
+			n, err = pconn.WriteTo(b, addr)
+		}
+		if err != nil {
+			c.mu.Lock()
+			pconn2 := c.pconn
+			c.mu.Unlock()
+
+			if pconn != pconn2 {
+				continue
+			}
+		}
+		return n, err
+	}
+}
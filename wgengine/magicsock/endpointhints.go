@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+)
+
+// An EndpointHint is a peer's direct UDP path as last confirmed by
+// discovery. They're saved across restarts so the paths that worked
+// before are tried first, rather than waiting on discovery to find
+// them again. See Conn.EndpointHints and Conn.SetEndpointHints.
+type EndpointHint struct {
+	Addr    netaddr.IPPort
+	Latency time.Duration
+	At      time.Time // when the path was last confirmed
+}
+
+// EndpointHints returns the peers' currently confirmed direct paths,
+// along with any hints from SetEndpointHints not yet used.
+func (c *Conn) EndpointHints() map[key.NodePublic]EndpointHint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make(map[key.NodePublic]EndpointHint, len(c.endpointHints))
+	for k, h := range c.endpointHints {
+		ret[k] = h
+	}
+	now := mono.Now()
+	c.peerMap.forEachEndpoint(func(ep *endpoint) {
+		ep.mu.Lock()
+		defer ep.mu.Unlock()
+		if ep.bestAddr.IsZero() || now.After(ep.trustBestAddrUntil) {
+			return
+		}
+		ret[ep.publicKey] = EndpointHint{
+			Addr:    ep.bestAddr.IPPort,
+			Latency: ep.bestAddr.latency,
+			At:      ep.bestAddrAt.WallTime(),
+		}
+	})
+	return ret
+}
+
+// SetEndpointHints sets direct paths to try first for peers, usually
+// those EndpointHints returned before a restart. Each hint is used
+// once, when the peer is first added from a network map, and only if
+// its address is still one of the peer's endpoints. Until discovery
+// confirms it, packets for the peer go both to the hinted address and
+// over DERP.
+func (c *Conn) SetEndpointHints(hints map[key.NodePublic]EndpointHint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.endpointHints = make(map[key.NodePublic]EndpointHint, len(hints))
+	for k, h := range hints {
+		if _, ok := c.peerMap.endpointForNodeKey(k); !ok {
+			c.endpointHints[k] = h
+		}
+	}
+}
+
+// useHint makes h's address de's best address, unconfirmed, if de
+// doesn't have one yet.
+func (de *endpoint) useHint(h EndpointHint) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if !de.bestAddr.IsZero() || !de.canP2P() {
+		return
+	}
+	if _, ok := de.endpointState[h.Addr]; !ok {
+		return
+	}
+	de.bestAddr = addrLatency{h.Addr, h.Latency}
+	de.c.logf("[v1] magicsock: disco: node %v %v trying cached endpoint %v from %v", de.publicKey.ShortString(), de.discoShort, h.Addr, h.At.Format(time.RFC3339))
+}
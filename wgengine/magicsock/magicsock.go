@@ -8,6 +8,7 @@
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	crand "crypto/rand"
 	"encoding/binary"
@@ -38,6 +39,7 @@
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dnscache"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/neterror"
@@ -74,6 +76,23 @@ func useDerpRoute() bool {
 	return true // as of 1.21.x
 }
 
+// logComponent is magicsock's "tailscale debug loglevel" component.
+// At LevelDebug it logs active discovery events as they happen, and at
+// LevelTrace, every DERP packet received too. TS_DEBUG_DISCO and
+// TS_DEBUG_DERP set its starting level.
+var logComponent = logger.NewComponent("magicsock", func() logger.Level {
+	switch {
+	case logDerpVerbose:
+		return logger.LevelTrace
+	case debugDisco:
+		return logger.LevelDebug
+	}
+	return logger.LevelInfo
+}())
+
+// discoVerbose reports whether to log active discovery verbosely.
+func discoVerbose() bool { return logComponent.Enabled(logger.LevelDebug) }
+
 // peerInfo is all the information magicsock tracks about a particular
 // peer.
 type peerInfo struct {
@@ -294,11 +313,23 @@ type Conn struct {
 	// (as can happen on darwin after a network link status change).
 	noV4Send syncs.AtomicBool
 
+	// dscpMarking is whether to mark disco and interactive IPv4
+	// packets with a DSCP value; see dscpFor.
+	dscpMarking syncs.AtomicBool
+	// dscpChecked is whether a netcheck has reported on DSCP yet.
+	dscpChecked syncs.AtomicBool
+
 	// networkUp is whether the network is up (some interface is up
 	// with IPv4 or IPv6). It's used to suppress log spam and prevent
 	// new connection that'll fail.
 	networkUp syncs.AtomicBool
 
+	// lowBandwidth is whether the current link is constrained, such
+	// as metered cellular. While it's set, endpoints probe for better
+	// paths less often and DERP servers are asked to pace the
+	// packets they relay to us. See SetLowBandwidth.
+	lowBandwidth syncs.AtomicBool
+
 	// havePrivateKey is whether privateKey is non-zero.
 	havePrivateKey  syncs.AtomicBool
 	publicKeyAtomic atomic.Value // of key.NodePublic (or NodeKey zero value if !havePrivateKey)
@@ -310,6 +341,9 @@ type Conn struct {
 
 	lastNetCheckReport atomic.Value // of *netcheck.Report
 
+	// derpHealth is the history of netcheck's results, for DERPHealth.
+	derpHealth netcheck.Scoreboard
+
 	// port is the preferred port from opts.Port; 0 means auto.
 	port syncs.AtomicUint32
 
@@ -331,6 +365,16 @@ type Conn struct {
 	// scheduled to fire within derpCleanStaleInterval.
 	derpCleanupTimerArmed bool
 
+	// derpIdleTimeout, if non-zero, is how long the tunnel must be
+	// idle before all DERP connections are closed. See
+	// Options.DERPIdleTimeout and checkDERPIdle.
+	derpIdleTimeout time.Duration
+	derpIdleTimer   *time.Timer      // runs checkDERPIdle; nil if derpIdleTimeout is zero
+	derpIdle        bool             // DERP was disconnected for being idle
+	derpIdleAtomic  syncs.AtomicBool // mirrors derpIdle, for the send path
+	derpIdleSince   time.Time        // when derpIdle was last set
+	derpWokeAt      time.Time        // when derpIdle was last cleared
+
 	// periodicReSTUNTimer, when non-nil, is an AfterFunc timer
 	// that will call Conn.doPeriodicSTUN.
 	periodicReSTUNTimer *time.Timer
@@ -376,6 +420,10 @@ type Conn struct {
 	// discoInfo is the state for an active DiscoKey.
 	discoInfo map[key.DiscoPublic]*discoInfo
 
+	// endpointHints are the hints from SetEndpointHints not yet
+	// used, for peers not yet in a network map.
+	endpointHints map[key.NodePublic]EndpointHint
+
 	// netInfoFunc is a callback that provides a tailcfg.NetInfo when
 	// discovered network conditions change.
 	//
@@ -400,6 +448,18 @@ type Conn struct {
 	activeDerp  map[int]activeDerp // DERP regionID -> connection to a node in that region
 	prevDerp    map[int]*syncs.WaitGroupChan
 
+	// derpHomeOverride, if non-zero, is the DERP region ID to use as
+	// home instead of the nearest one. See SetDERPHomeOverride.
+	derpHomeOverride int
+
+	// derpRegionState is the observed connection state of each DERP
+	// region connected to at some point, for DERPRegionStatus.
+	derpRegionState map[int]*derpRegionState
+
+	// natLifetime is the measured NAT mapping lifetime of the
+	// current network, which sets the periodic re-STUN interval.
+	natLifetime natLifetimeState
+
 	// derpRoute contains optional alternate routes to use as an
 	// optimization instead of contacting a peer via their home
 	// DERP connection.  If they sent us a message on a different
@@ -423,6 +483,18 @@ type derpRoute struct {
 	dc     *derphttp.Client // don't use directly; see comment above
 }
 
+// noteDERPRelayUsage adds the bytes a DERP server reports having
+// relayed for us to each peer's total.
+func (c *Conn) noteDERPRelayUsage(m derp.RelayUsageMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range m {
+		if ep, ok := c.peerMap.endpointForNodeKey(u.Dst); ok {
+			atomic.AddInt64(&ep.derpRelayedBytes, u.Bytes)
+		}
+	}
+}
+
 // removeDerpPeerRoute removes a DERP route entry previously added by addDerpPeerRoute.
 func (c *Conn) removeDerpPeerRoute(peer key.NodePublic, derpID int, dc *derphttp.Client) {
 	c.mu.Lock()
@@ -478,6 +550,14 @@ type Options struct {
 	// it's been since a TUN packet was sent or received.
 	IdleFunc func() time.Duration
 
+	// DERPIdleTimeout, if non-zero, is how long IdleFunc must report
+	// the tunnel idle before all DERP connections are closed, to let
+	// battery-powered devices sleep rather than keep them alive. The
+	// home DERP connection is reopened when there's a packet to send
+	// or a new network map. Peers can't reach the node over DERP
+	// meanwhile. It has no effect without an IdleFunc.
+	DERPIdleTimeout time.Duration
+
 	// TestOnlyPacketListener optionally specifies how to create PacketConns.
 	// Only used by tests.
 	TestOnlyPacketListener nettype.PacketListener
@@ -548,6 +628,7 @@ func NewConn(opts Options) (*Conn, error) {
 	c.epFunc = opts.endpointsFunc()
 	c.derpActiveFunc = opts.derpActiveFunc()
 	c.idleFunc = opts.IdleFunc
+	c.derpIdleTimeout = opts.DERPIdleTimeout
 	c.testOnlyPacketListener = opts.TestOnlyPacketListener
 	c.noteRecvActivity = opts.NoteRecvActivity
 	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "), c.onPortMapChanged)
@@ -555,6 +636,7 @@ func NewConn(opts Options) (*Conn, error) {
 		c.portMapper.SetGatewayLookupFunc(opts.LinkMonitor.GatewayAndSelfIP)
 	}
 	c.linkMon = opts.LinkMonitor
+	applyEnvCPUAffinity(c.logf)
 
 	if err := c.initialBind(); err != nil {
 		return nil, err
@@ -568,6 +650,9 @@ func NewConn(opts Options) (*Conn, error) {
 		SkipExternalNetwork: inTest(),
 		PortMapper:          c.portMapper,
 	}
+	if dscpEnabled() {
+		c.netChecker.DSCP = dscp.AF41 // marking starts once a probe arrives intact
+	}
 
 	if c.pconn6 != nil {
 		c.netChecker.GetSTUNConn6 = func() netcheck.STUNConn { return c.pconn6 }
@@ -575,6 +660,12 @@ func NewConn(opts Options) (*Conn, error) {
 
 	c.ignoreSTUNPackets()
 
+	if c.derpIdleTimeout > 0 {
+		c.mu.Lock()
+		c.derpIdleTimer = time.AfterFunc(derpIdleCheckInterval, c.checkDERPIdle)
+		c.mu.Unlock()
+	}
+
 	return c, nil
 }
 
@@ -608,11 +699,10 @@ func (c *Conn) updateEndpoints(why string) {
 				return
 			}
 			if c.shouldDoPeriodicReSTUNLocked() {
-				// Pick a random duration between 20
-				// and 26 seconds (just under 30s, a
-				// common UDP NAT timeout on Linux,
-				// etc)
-				d := tstime.RandomDurationBetween(20*time.Second, 26*time.Second)
+				// Pick a random duration a bit under
+				// the NAT's mapping lifetime (by
+				// default, between 20 and 26 seconds).
+				d := tstime.RandomDurationBetween(c.natKeepAliveIntervalLocked())
 				if t := c.periodicReSTUNTimer; t != nil {
 					if debugReSTUNStopOnIdle {
 						c.logf("resetting existing periodicSTUN to run in %v", d)
@@ -737,9 +827,12 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	}
 
 	c.lastNetCheckReport.Store(report)
+	c.derpHealth.Record(time.Now(), report, dm)
+	c.maybeProbeNATLifetime(report, dm)
 	c.noV4.Set(!report.IPv4)
 	c.noV6.Set(!report.IPv6)
 	c.noV4Send.Set(!report.IPv4CanSend)
+	c.updateDSCPMarking(report)
 
 	ni := &tailcfg.NetInfo{
 		DERPLatency:           map[string]float64{},
@@ -759,6 +852,11 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	ni.WorkingIPv6.Set(report.IPv6)
 	ni.WorkingUDP.Set(report.UDP)
 	ni.PreferredDERP = report.PreferredDERP
+	c.mu.Lock()
+	if c.derpHomeOverride != 0 {
+		ni.PreferredDERP = c.derpHomeOverride
+	}
+	c.mu.Unlock()
 
 	if ni.PreferredDERP == 0 {
 		// Perhaps UDP is blocked. Pick a deterministic but arbitrary
@@ -884,10 +982,32 @@ func (c *Conn) LastRecvActivityOfNodeKey(nk key.NodePublic) string {
 func (c *Conn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if ep, ok := c.cliPingEndpointLocked(peer, res, cb); ok {
+		ep.cliPing(res, cb)
+	}
+}
+
+// VerifyRelay handles a "tailscale ping --verify-relay" CLI query. It
+// bounces a disco.RelayEcho off peer via its DERP home and reports the
+// round trip, and how much of it the peer spent processing the echo.
+func (c *Conn) VerifyRelay(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ep, ok := c.cliPingEndpointLocked(peer, res, cb); ok {
+		ep.cliVerifyRelay(res, cb)
+	}
+}
+
+// cliPingEndpointLocked fills in the node details of res and returns
+// the endpoint for peer. If it fails, it instead reports the failure
+// to cb and returns ok false.
+//
+// c.mu must be held.
+func (c *Conn) cliPingEndpointLocked(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) (ep *endpoint, ok bool) {
 	if c.privateKey.IsZero() {
 		res.Err = "local tailscaled stopped"
 		cb(res)
-		return
+		return nil, false
 	}
 	if len(peer.Addresses) > 0 {
 		res.NodeIP = peer.Addresses[0].IP().String()
@@ -899,13 +1019,13 @@ func (c *Conn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnst
 		res.NodeName, _, _ = strings.Cut(res.NodeName, ".")
 	}
 
-	ep, ok := c.peerMap.endpointForNodeKey(peer.Key)
+	ep, ok = c.peerMap.endpointForNodeKey(peer.Key)
 	if !ok {
 		res.Err = "unknown peer"
 		cb(res)
-		return
+		return nil, false
 	}
-	ep.cliPing(res, cb)
+	return ep, true
 }
 
 // c.mu must be held
@@ -1176,6 +1296,7 @@ func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
 		metricSendDataNetworkDown.Add(1)
 		return errNetworkDown
 	}
+	c.maybeWakeDERP("send")
 	return ep.(*endpoint).send(b)
 }
 
@@ -1214,7 +1335,11 @@ func (c *Conn) sendUDP(ipp netaddr.IPPort, b []byte) (sent bool, err error) {
 func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
 	switch {
 	case addr.IP.To4() != nil:
-		_, err = c.pconn4.WriteTo(b, addr)
+		if d := c.dscpFor(b); d != 0 {
+			_, err = c.pconn4.WriteToDSCP(b, addr, d)
+		} else {
+			_, err = c.pconn4.WriteTo(b, addr)
+		}
 		if err != nil && (c.noV4.Get() || neterror.TreatAsLostUDP(err)) {
 			return false, nil
 		}
@@ -1268,6 +1393,7 @@ func (c *Conn) sendAddr(addr netaddr.IPPort, pubKey key.NodePublic, b []byte) (s
 		return false, errConnClosed
 	case ch <- derpWriteRequest{addr, pubKey, pkt}:
 		metricSendDERPQueued.Add(1)
+		metricSendDERPQueueDepth.Set(int64(len(ch)))
 		return true, nil
 	default:
 		metricSendDERPErrorQueue.Add(1)
@@ -1340,6 +1466,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.NodePublic) cha
 	if !peer.IsZero() {
 		why = peer.ShortString()
 	}
+	c.wakeDERPLocked(why)
 	c.logf("magicsock: adding connection to derp-%v for %v", regionID, why)
 
 	firstDerp := false
@@ -1374,6 +1501,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.NodePublic) cha
 
 	dc.SetCanAckPings(true)
 	dc.NotePreferred(c.myDerp == regionID)
+	dc.SetLowBandwidth(c.lowBandwidth.Get())
 	dc.SetAddressFamilySelector(derpAddrFamSelector{c})
 	dc.DNSCache = dnscache.Get()
 
@@ -1498,6 +1626,7 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 
 	defer health.SetDERPRegionConnectedState(regionID, false)
 	defer health.SetDERPRegionHealth(regionID, "")
+	defer c.noteDERPRegionClosed(regionID)
 
 	// peerPresent is the set of senders we know are present on this
 	// connection, based on messages we've received from the server.
@@ -1510,6 +1639,9 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 		msg, connGen, err := dc.RecvDetail()
 		if err != nil {
 			health.SetDERPRegionConnectedState(regionID, false)
+			if err != derphttp.ErrClientClosed {
+				c.noteDERPRegionConnected(regionID, err)
+			}
 			// Forget that all these peers have routes.
 			for peer := range peerPresent {
 				delete(peerPresent, peer)
@@ -1555,13 +1687,14 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 		case derp.ServerInfoMessage:
 			health.SetDERPRegionConnectedState(regionID, true)
 			health.SetDERPRegionHealth(regionID, "") // until declared otherwise
+			c.noteDERPRegionConnected(regionID, nil)
 			c.logf("magicsock: derp-%d connected; connGen=%v", regionID, connGen)
 			continue
 		case derp.ReceivedPacket:
 			pkt = m
 			res.n = len(m.Data)
 			res.src = m.Source
-			if logDerpVerbose {
+			if logComponent.Enabled(logger.LevelTrace) {
 				c.logf("magicsock: got derp-%v packet: %q", regionID, m.Data)
 			}
 			// If this is a new sender we hadn't seen before, remember it and
@@ -1584,8 +1717,12 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 			continue
 		case derp.HealthMessage:
 			health.SetDERPRegionHealth(regionID, m.Problem)
+			c.noteDERPRegionProblem(regionID, m.Problem)
 		case derp.PeerGoneMessage:
 			c.removeDerpPeerRoute(key.NodePublic(m), regionID, dc)
+		case derp.RelayUsageMessage:
+			c.noteDERPRelayUsage(m)
+			continue
 		default:
 			// Ignore.
 			continue
@@ -1806,7 +1943,7 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey key.NodePublic, dstDi
 	pkt = append(pkt, box...)
 	sent, err = c.sendAddr(dst, dstKey, pkt)
 	if sent {
-		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco) {
+		if logLevel == discoLog || (logLevel == discoVerboseLog && discoVerbose()) {
 			node := "?"
 			if !dstKey.IsZero() {
 				node = dstKey.ShortString()
@@ -1825,6 +1962,10 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey key.NodePublic, dstDi
 			metricSentDiscoPong.Add(1)
 		case *disco.CallMeMaybe:
 			metricSentDiscoCallMeMaybe.Add(1)
+		case *disco.RelayEcho:
+			metricSentDiscoRelayEcho.Add(1)
+		case *disco.RelayEchoReply:
+			metricSentDiscoRelayEchoReply.Add(1)
 		}
 	} else if err == nil {
 		// Can't send. (e.g. no IPv6 locally)
@@ -1861,6 +2002,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, derpNodeSrc ke
 	// packet (which starts with little-endian uint32 1, 2, 3, 4).
 	// Use naked returns for all following paths.
 	isDiscoMsg = true
+	recvAt := mono.Now()
 
 	sender := key.DiscoPublicFromRaw32(mem.B(msg[len(disco.Magic):headerLen]))
 
@@ -1870,7 +2012,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, derpNodeSrc ke
 	if c.closed {
 		return
 	}
-	if debugDisco {
+	if discoVerbose() {
 		c.logf("magicsock: disco: got disco-looking frame from %v", sender.ShortString())
 	}
 	if c.privateKey.IsZero() {
@@ -1879,7 +2021,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, derpNodeSrc ke
 		return
 	}
 	if c.discoPrivate.IsZero() {
-		if debugDisco {
+		if discoVerbose() {
 			c.logf("magicsock: disco: ignoring disco-looking frame, no local key")
 		}
 		return
@@ -1887,7 +2029,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, derpNodeSrc ke
 
 	if !c.peerMap.anyEndpointForDiscoKey(sender) {
 		metricRecvDiscoBadPeer.Add(1)
-		if debugDisco {
+		if discoVerbose() {
 			c.logf("magicsock: disco: ignoring disco-looking frame, don't know endpoint for %v", sender.ShortString())
 		}
 		return
@@ -1911,7 +2053,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, derpNodeSrc ke
 		// Don't log in normal case. Pass on to wireguard, in case
 		// it's actually a wireguard packet (super unlikely,
 		// but).
-		if debugDisco {
+		if discoVerbose() {
 			c.logf("magicsock: disco: failed to open naclbox from %v (wrong rcpt?)", sender)
 		}
 		metricRecvDiscoBadKey.Add(1)
@@ -1919,7 +2061,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, derpNodeSrc ke
 	}
 
 	dm, err := disco.Parse(payload)
-	if debugDisco {
+	if discoVerbose() {
 		c.logf("magicsock: disco: disco.Parse = %T, %v", dm, err)
 	}
 	if err != nil {
@@ -1982,6 +2124,32 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, derpNodeSrc ke
 			ep.publicKey.ShortString(), derpStr(src.String()),
 			len(dm.MyNumber))
 		go ep.handleCallMeMaybe(dm)
+	case *disco.RelayEcho:
+		metricRecvDiscoRelayEcho.Add(1)
+		// Echoes verify a DERP path, so only answer them via DERP
+		// and only to the node that sent them.
+		if !isDERP || derpNodeSrc.IsZero() {
+			c.logf("[unexpected] RelayEcho packets should only come via DERP")
+			return
+		}
+		ep, ok := c.peerMap.endpointForNodeKey(derpNodeSrc)
+		if !ok || ep.discoKey != di.discoKey {
+			return
+		}
+		reply := &disco.RelayEchoReply{
+			TxID:     dm.TxID,
+			PeerTime: mono.Since(recvAt),
+			Payload:  dm.Payload,
+		}
+		go c.sendDiscoMessage(src, derpNodeSrc, di.discoKey, reply, discoLog)
+	case *disco.RelayEchoReply:
+		metricRecvDiscoRelayEchoReply.Add(1)
+		handled := false
+		c.peerMap.forEachEndpointWithDiscoKey(sender, func(ep *endpoint) {
+			if !handled && ep.handleRelayEchoReplyLocked(dm, src) {
+				handled = true
+			}
+		})
 	}
 	return
 }
@@ -2074,7 +2242,7 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netaddr.IPPort, di *discoInf
 		return
 	}
 
-	if !likelyHeartBeat || debugDisco {
+	if !likelyHeartBeat || discoVerbose() {
 		pingNodeSrcStr := dstKey.ShortString()
 		if numNodes > 1 {
 			pingNodeSrcStr = "[one-of-multi]"
@@ -2163,6 +2331,33 @@ func (c *Conn) SetNetworkUp(up bool) {
 	}
 }
 
+// SetLowBandwidth sets whether the current link is constrained, such
+// as metered cellular or an IoT uplink. While it is, disco heartbeats
+// and path upgrade pings are sent less often, and the DERP servers
+// we're connected to are told to pace what they relay to us.
+func (c *Conn) SetLowBandwidth(v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lowBandwidth.Get() == v {
+		return
+	}
+
+	c.logf("magicsock: SetLowBandwidth(%v)", v)
+	c.lowBandwidth.Set(v)
+	for _, ad := range c.activeDerp {
+		go ad.c.SetLowBandwidth(v)
+	}
+}
+
+// probeInterval returns d, an interval between disco probes, stretched
+// by lowBandwidthProbeFactor while the link is low bandwidth.
+func (c *Conn) probeInterval(d time.Duration) time.Duration {
+	if c.lowBandwidth.Get() {
+		return d * lowBandwidthProbeFactor
+	}
+	return d
+}
+
 // SetPreferredPort sets the connection's preferred local port.
 func (c *Conn) SetPreferredPort(port uint16) {
 	if uint16(c.port.Get()) == port {
@@ -2268,6 +2463,10 @@ func (c *Conn) SetDERPMap(dm *tailcfg.DERPMap) {
 	c.derpMapAtomic.Store(dm)
 	old := c.derpMap
 	c.derpMap = dm
+	if c.derpHomeOverride != 0 && (dm == nil || dm.Regions[c.derpHomeOverride] == nil) {
+		c.logf("magicsock: forced DERP home derp-%d no longer in DERP map; back to automatic selection", c.derpHomeOverride)
+		c.derpHomeOverride = 0
+	}
 	if dm == nil {
 		c.closeAllDerpLocked("derp-disabled")
 		return
@@ -2322,6 +2521,9 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 	if c.netMap != nil && nodesEqual(c.netMap.Peers, nm.Peers) {
 		return
 	}
+	// A change to the peers is likely to come with traffic, so
+	// they'd better be able to reach us.
+	c.wakeDERPLocked("netmap")
 
 	numNoDisco := 0
 	for _, n := range nm.Peers {
@@ -2363,7 +2565,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 		}
 		ep.wgEndpoint = n.Key.UntypedHexString()
 		ep.initFakeUDPAddr()
-		if debugDisco { // rather than making a new knob
+		if discoVerbose() { // rather than making a new knob
 			c.logf("magicsock: created endpoint key=%s: disco=%s; %v", n.Key.ShortString(), n.DiscoKey.ShortString(), logger.ArgWriter(func(w *bufio.Writer) {
 				const derpPrefix = "127.3.3.40:"
 				if strings.HasPrefix(n.DERP, derpPrefix) {
@@ -2389,6 +2591,10 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 			}))
 		}
 		ep.updateFromNode(n)
+		if h, ok := c.endpointHints[n.Key]; ok {
+			delete(c.endpointHints, n.Key)
+			ep.useHint(h)
+		}
 		c.peerMap.upsertEndpoint(ep, key.DiscoPublic{})
 	}
 
@@ -2615,11 +2821,44 @@ func (c *connBind) Open(ignoredPort uint16) ([]conn.ReceiveFunc, uint16, error)
 	if runtime.GOOS == "js" {
 		fns = []conn.ReceiveFunc{c.receiveDERP}
 	}
+	for i, fn := range fns {
+		fns[i] = timeRecvHandoff(fn)
+	}
 	// TODO: Combine receiveIPv4 and receiveIPv6 and receiveIP into a single
 	// closure that closes over a *RebindingUDPConn?
 	return fns, c.LocalPort(), nil
 }
 
+// recvHandoffStall is how long wireguard-go may take, after a
+// ReceiveFunc returns a packet, to call it again before
+// timeRecvHandoff counts a stall.
+const recvHandoffStall = time.Millisecond
+
+// timeRecvHandoff wraps fn to count, in
+// metricRecvHandoffStalls, how often wireguard-go is slow to
+// come back for the next packet. Between calls, wireguard-go does
+// nothing but hand the packet to its decryption queue and the peer's
+// inbound queue, blocking while either is full, so a stall means the
+// crypto workers aren't keeping up.
+//
+// Each ReceiveFunc is called from a single goroutine, so the returned
+// func needn't be safe for concurrent use.
+func timeRecvHandoff(fn conn.ReceiveFunc) conn.ReceiveFunc {
+	var last mono.Time // when fn last returned a packet, or zero
+	return func(b []byte) (int, conn.Endpoint, error) {
+		if last != 0 && mono.Since(last) >= recvHandoffStall {
+			metricRecvHandoffStalls.Add(1)
+		}
+		n, ep, err := fn(b)
+		if err == nil {
+			last = mono.Now()
+		} else {
+			last = 0
+		}
+		return n, ep, err
+	}
+}
+
 // SetMark is used by wireguard-go to set a mark bit for packets to avoid routing loops.
 // We handle that ourselves elsewhere.
 func (c *connBind) SetMark(value uint32) error {
@@ -2659,6 +2898,7 @@ func (c *connBind) Closed() bool {
 //
 // Only the first close does anything. Any later closes return nil.
 func (c *Conn) Close() error {
+	c.derpHealth.Flush()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.closed {
@@ -2667,6 +2907,9 @@ func (c *Conn) Close() error {
 	if c.derpCleanupTimerArmed {
 		c.derpCleanupTimer.Stop()
 	}
+	if c.derpIdleTimer != nil {
+		c.derpIdleTimer.Stop()
+	}
 	c.stopPeriodicReSTUNTimerLocked()
 	c.portMapper.Close()
 
@@ -2697,7 +2940,7 @@ func (c *Conn) Close() error {
 }
 
 func (c *Conn) goroutinesRunningLocked() bool {
-	if c.endpointsUpdateActive {
+	if c.endpointsUpdateActive || c.natLifetime.probing {
 		return true
 	}
 	// The goroutine running dc.Connect in derpWriteChanOfAddr may linger
@@ -3221,6 +3464,9 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		}
 		ss.TailscaleIPs = tailscaleIPs
 	})
+	sb.MutateStatus(func(s *ipnstate.Status) {
+		s.DSCP = c.dscpStatus()
+	})
 
 	c.peerMap.forEachEndpoint(func(ep *endpoint) {
 		ps := &ipnstate.PeerStatus{InMagicSock: true}
@@ -3249,6 +3495,7 @@ type endpoint struct {
 	// atomically accessed; declared first for alignment reasons
 	lastRecv              mono.Time
 	numStopAndResetAtomic int64
+	derpRelayedBytes      int64 // total bytes DERP servers report relaying to this peer
 
 	// These fields are initialized once and never modified.
 	c          *Conn
@@ -3275,6 +3522,7 @@ type endpoint struct {
 	isCallMeMaybeEP    map[netaddr.IPPort]bool
 
 	pendingCLIPings []pendingCLIPing // any outstanding "tailscale ping" commands running
+	sentRelayEcho   map[stun.TxID]*sentRelayEcho
 }
 
 type pendingCLIPing struct {
@@ -3317,6 +3565,13 @@ type pendingCLIPing struct {
 	// STUN-derived endpoint valid for. UDP NAT mappings typically
 	// expire at 30 seconds, so this is a few seconds shy of that.
 	endpointsFreshEnoughDuration = 27 * time.Second
+
+	// lowBandwidthProbeFactor is how much longer heartbeatInterval
+	// and upgradeInterval are while the link is low bandwidth. See
+	// Conn.SetLowBandwidth. trustUDPAddrDuration isn't stretched:
+	// it's how long a path is trusted without a pong, and NAT
+	// mappings don't last any longer on a constrained link.
+	lowBandwidthProbeFactor = 4
 )
 
 // Constants that are variable for testing.
@@ -3399,6 +3654,21 @@ type sentPing struct {
 	purpose discoPingPurpose
 }
 
+// sentRelayEcho is an outstanding "tailscale ping --verify-relay".
+type sentRelayEcho struct {
+	to      netaddr.IPPort // DERP address it was sent to
+	at      mono.Time
+	payload []byte
+	timer   *time.Timer // timeout timer
+	res     *ipnstate.PingResult
+	cb      func(*ipnstate.PingResult)
+}
+
+// relayEchoPayloadLen is the number of random bytes sent in a
+// disco.RelayEcho. It's large enough that a relay that mangled or
+// replayed echoes can't go unnoticed.
+const relayEchoPayloadLen = 32
+
 // initFakeUDPAddr populates fakeWGAddr with a globally unique fake UDPAddr.
 // The current implementation just uses the pointer value of de jammed into an IPv6
 // address, but it could also be, say, a counter.
@@ -3497,7 +3767,7 @@ func (de *endpoint) heartbeat() {
 		de.sendPingsLocked(now, true)
 	}
 
-	de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
+	de.heartBeatTimer = time.AfterFunc(de.c.probeInterval(heartbeatInterval), de.heartbeat)
 }
 
 // wantFullPingLocked reports whether we should ping to all our peers looking for
@@ -3520,7 +3790,7 @@ func (de *endpoint) wantFullPingLocked(now mono.Time) bool {
 	if de.bestAddr.latency <= goodEnoughLatency {
 		return false
 	}
-	if now.Sub(de.lastFullPing) >= upgradeInterval {
+	if now.Sub(de.lastFullPing) >= de.c.probeInterval(upgradeInterval) {
 		return true
 	}
 	return false
@@ -3529,7 +3799,7 @@ func (de *endpoint) wantFullPingLocked(now mono.Time) bool {
 func (de *endpoint) noteActiveLocked() {
 	de.lastSend = mono.Now()
 	if de.heartBeatTimer == nil && de.canP2P() {
-		de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
+		de.heartBeatTimer = time.AfterFunc(de.c.probeInterval(heartbeatInterval), de.heartbeat)
 	}
 }
 
@@ -3560,6 +3830,111 @@ func (de *endpoint) cliPing(res *ipnstate.PingResult, cb func(*ipnstate.PingResu
 	de.noteActiveLocked()
 }
 
+// cliVerifyRelay starts a relay verification for "tailscale ping
+// --verify-relay". res is value to call cb with, already partially
+// filled.
+func (de *endpoint) cliVerifyRelay(res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	if !de.canP2P() {
+		res.Err = "peer does not support disco"
+		cb(res)
+		return
+	}
+	if de.derpAddr.IsZero() {
+		res.Err = "peer has no DERP home"
+		cb(res)
+		return
+	}
+	if runtime.GOOS == "js" {
+		res.Err = "relay verification not supported on " + runtime.GOOS
+		cb(res)
+		return
+	}
+
+	payload := make([]byte, relayEchoPayloadLen)
+	if _, err := crand.Read(payload); err != nil {
+		res.Err = err.Error()
+		cb(res)
+		return
+	}
+	txid := stun.NewTxID()
+	if de.sentRelayEcho == nil {
+		de.sentRelayEcho = map[stun.TxID]*sentRelayEcho{}
+	}
+	de.sentRelayEcho[txid] = &sentRelayEcho{
+		to:      de.derpAddr,
+		at:      mono.Now(),
+		payload: payload,
+		timer:   time.AfterFunc(pingTimeoutDuration, func() { de.forgetRelayEcho(txid) }),
+		res:     res,
+		cb:      cb,
+	}
+	derpAddr, discoKey := de.derpAddr, de.discoKey
+	go func() {
+		sent, _ := de.c.sendDiscoMessage(derpAddr, de.publicKey, discoKey, &disco.RelayEcho{
+			TxID:    [12]byte(txid),
+			Payload: payload,
+		}, discoLog)
+		if !sent {
+			de.forgetRelayEcho(txid)
+		}
+	}()
+	de.noteActiveLocked()
+}
+
+// forgetRelayEcho is called by a timer when a relay echo either fails
+// to send or has taken too long to get a reply. As with CLI pings, the
+// CLI's own timeout reports the failure.
+func (de *endpoint) forgetRelayEcho(txid stun.TxID) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if se, ok := de.sentRelayEcho[txid]; ok {
+		se.timer.Stop()
+		delete(de.sentRelayEcho, txid)
+	}
+}
+
+// handleRelayEchoReplyLocked handles a RelayEchoReply to one of de's
+// relay verifications, reporting whether m.TxID was one de sent.
+//
+// It should be called with the Conn.mu held.
+func (de *endpoint) handleRelayEchoReplyLocked(m *disco.RelayEchoReply, src netaddr.IPPort) (knownTxID bool) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	se, ok := de.sentRelayEcho[m.TxID]
+	if !ok {
+		return false
+	}
+	se.timer.Stop()
+	delete(de.sentRelayEcho, m.TxID)
+
+	latency := mono.Since(se.at)
+	res := se.res
+	de.c.populateCLIPingResponseLocked(res, latency, src)
+	switch {
+	case src.IP() != derpMagicIPAddr:
+		res.Err = fmt.Sprintf("relay echo reply arrived via %v, not DERP", src)
+	case !bytes.Equal(m.Payload, se.payload):
+		res.Err = "relay echo reply payload does not match"
+	default:
+		res.RelayVerified = true
+		res.PeerProcessingSeconds = m.PeerTime.Seconds()
+		if m.PeerTime > latency {
+			// Clock weirdness or a confused peer; don't report a
+			// negative relay time.
+			res.PeerProcessingSeconds = latency.Seconds()
+		}
+	}
+	de.c.logf("[v1] magicsock: disco: %v<-%v (%v, %v)  got relay-echo-reply tx=%x latency=%v peer=%v verified=%v",
+		de.c.discoShort, de.discoShort, de.publicKey.ShortString(), derpStr(src.String()),
+		m.TxID[:6], latency.Round(time.Millisecond), m.PeerTime, res.RelayVerified)
+	go se.cb(res)
+	return true
+}
+
 func (de *endpoint) send(b []byte) error {
 	now := mono.Now()
 
@@ -3594,7 +3969,7 @@ func (de *endpoint) pingTimeout(txid stun.TxID) {
 	if !ok {
 		return
 	}
-	if debugDisco || de.bestAddr.IsZero() || mono.Now().After(de.trustBestAddrUntil) {
+	if discoVerbose() || de.bestAddr.IsZero() || mono.Now().After(de.trustBestAddrUntil) {
 		de.c.logf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
 	de.removeSentPingLocked(txid, sp)
@@ -3871,7 +4246,9 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netad
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
 	if !isDerp {
 		thisPong := addrLatency{sp.to, latency}
-		if betterAddr(thisPong, de.bestAddr) {
+		// A bestAddr never confirmed (bestAddrAt zero) is from
+		// SetEndpointHints; any confirmed path beats it.
+		if de.bestAddrAt.IsZero() || betterAddr(thisPong, de.bestAddr) {
 			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
 			de.bestAddr = thisPong
 		}
@@ -4001,6 +4378,7 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	defer de.mu.Unlock()
 
 	ps.Relay = de.c.derpRegionCodeOfIDLocked(int(de.derpAddr.Port()))
+	ps.DERPRelayedBytes = atomic.LoadInt64(&de.derpRelayedBytes)
 
 	if de.lastSend.IsZero() {
 		return
@@ -4032,6 +4410,10 @@ func (de *endpoint) stopAndReset() {
 		de.heartBeatTimer = nil
 	}
 	de.pendingCLIPings = nil
+	for txid, se := range de.sentRelayEcho {
+		se.timer.Stop()
+		delete(de.sentRelayEcho, txid)
+	}
 }
 
 // resetLocked clears all the endpoint's p2p state, reverting it to a
@@ -4134,6 +4516,19 @@ func (s derpAddrFamSelector) PreferIPv6() bool {
 	metricNumPeers     = clientmetric.NewGauge("magicsock_netmap_num_peers")
 	metricNumDERPConns = clientmetric.NewGauge("magicsock_num_derp_conns")
 
+	// metricSendDERPQueueDepth is the depth of the most recently
+	// written-to DERP write queue, just after the write.
+	metricSendDERPQueueDepth = clientmetric.NewGauge("magicsock_send_derp_queue_depth")
+	// metricGOMAXPROCS and metricNumCPU describe how many crypto
+	// workers can run at once, and how many wireguard-go started
+	// for each of encryption, decryption and handshakes.
+	metricGOMAXPROCS = clientmetric.NewGauge("magicsock_gomaxprocs")
+	metricNumCPU     = clientmetric.NewGauge("magicsock_num_cpu")
+	// metricRecvHandoffStalls counts received packets that
+	// wireguard-go was slow to queue for decryption, because its
+	// queues were full. See timeRecvHandoff.
+	metricRecvHandoffStalls = clientmetric.NewCounter("magicsock_recv_handoff_stalls")
+
 	metricRebindCalls     = clientmetric.NewCounter("magicsock_rebind_calls")
 	metricReSTUNCalls     = clientmetric.NewCounter("magicsock_restun_calls")
 	metricUpdateEndpoints = clientmetric.NewCounter("magicsock_update_endpoints")
@@ -4167,6 +4562,9 @@ func (s derpAddrFamSelector) PreferIPv6() bool {
 	metricRecvDiscoBadKey      = clientmetric.NewCounter("magicsock_disco_recv_bad_key")
 	metricRecvDiscoBadParse    = clientmetric.NewCounter("magicsock_disco_recv_bad_parse")
 
+	metricSentDiscoRelayEcho      = clientmetric.NewCounter("magicsock_disco_sent_relayecho")
+	metricSentDiscoRelayEchoReply = clientmetric.NewCounter("magicsock_disco_sent_relayecho_reply")
+
 	metricRecvDiscoUDP                 = clientmetric.NewCounter("magicsock_disco_recv_udp")
 	metricRecvDiscoDERP                = clientmetric.NewCounter("magicsock_disco_recv_derp")
 	metricRecvDiscoPing                = clientmetric.NewCounter("magicsock_disco_recv_ping")
@@ -4174,6 +4572,8 @@ func (s derpAddrFamSelector) PreferIPv6() bool {
 	metricRecvDiscoCallMeMaybe         = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe")
 	metricRecvDiscoCallMeMaybeBadNode  = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_bad_node")
 	metricRecvDiscoCallMeMaybeBadDisco = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_bad_disco")
+	metricRecvDiscoRelayEcho           = clientmetric.NewCounter("magicsock_disco_recv_relayecho")
+	metricRecvDiscoRelayEchoReply      = clientmetric.NewCounter("magicsock_disco_recv_relayecho_reply")
 
 	// metricDERPHomeChange is how many times our DERP home region DI has
 	// changed from non-zero to a different non-zero.
@@ -19,30 +19,39 @@
 	"net/http/httptest"
 	"net/netip"
 	"os"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
 
 	"go4.org/mem"
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 	"inet.af/netaddr"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	"tailscale.com/disco"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/dscp"
+	"tailscale.com/net/natlab"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
-	"tailscale.com/tstest/natlab"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/nettype"
+	"tailscale.com/types/opt"
 	"tailscale.com/util/cibuild"
 	"tailscale.com/util/netconv"
 	"tailscale.com/util/racebuild"
@@ -396,6 +405,45 @@ func pickPort(t testing.TB) uint16 {
 	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
 }
 
+func TestDERPRegionStatus(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "one"},
+			2: {RegionID: 2, RegionCode: "two"},
+		},
+	}
+	c.myDerp = 2
+	c.activeDerp = map[int]activeDerp{1: {}, 2: {}}
+
+	c.noteDERPRegionConnected(1, errors.New("dial failed"))
+	c.noteDERPRegionConnected(2, nil)
+	c.noteDERPRegionProblem(2, "overloaded")
+
+	got := c.DERPRegionStatus()
+	if len(got) != 2 {
+		t.Fatalf("got %d regions; want 2", len(got))
+	}
+	r1, r2 := got[0], got[1]
+	if r1.RegionID != 1 || r1.Home || r1.Connected || !r1.Active || r1.LastError != "dial failed" || r1.LastErrorTime.IsZero() {
+		t.Errorf("region 1 = %+v", r1)
+	}
+	if r2.RegionID != 2 || !r2.Home || r2.Forced || !r2.Connected || r2.ConnectedSince.IsZero() || r2.Problem != "overloaded" {
+		t.Errorf("region 2 = %+v", r2)
+	}
+
+	c.noteDERPRegionClosed(2)
+	delete(c.activeDerp, 2)
+	if r2 := c.DERPRegionStatus()[1]; r2.Connected || r2.Active || r2.Problem != "" {
+		t.Errorf("region 2 after close = %+v", r2)
+	}
+
+	if err := c.SetDERPHomeOverride(3); err == nil {
+		t.Error("SetDERPHomeOverride of unknown region succeeded")
+	}
+}
+
 func TestPickDERPFallback(t *testing.T) {
 	tstest.PanicOnLog()
 	tstest.ResourceCheck(t)
@@ -721,115 +769,35 @@ func TestDiscokeyChange(t *testing.T) {
 }
 
 func TestActiveDiscovery(t *testing.T) {
-	t.Run("simple_internet", func(t *testing.T) {
-		t.Parallel()
-		mstun := &natlab.Machine{Name: "stun"}
-		m1 := &natlab.Machine{Name: "m1"}
-		m2 := &natlab.Machine{Name: "m2"}
-		inet := natlab.NewInternet()
-		sif := mstun.Attach("eth0", inet)
-		m1if := m1.Attach("eth0", inet)
-		m2if := m2.Attach("eth0", inet)
-
-		n := &devices{
-			m1:     m1,
-			m1IP:   m1if.V4(),
-			m2:     m2,
-			m2IP:   m2if.V4(),
-			stun:   mstun,
-			stunIP: sif.V4(),
-		}
-		testActiveDiscovery(t, n)
-	})
-
-	t.Run("facing_easy_firewalls", func(t *testing.T) {
-		mstun := &natlab.Machine{Name: "stun"}
-		m1 := &natlab.Machine{
-			Name:          "m1",
-			PacketHandler: &natlab.Firewall{},
-		}
-		m2 := &natlab.Machine{
-			Name:          "m2",
-			PacketHandler: &natlab.Firewall{},
-		}
-		inet := natlab.NewInternet()
-		sif := mstun.Attach("eth0", inet)
-		m1if := m1.Attach("eth0", inet)
-		m2if := m2.Attach("eth0", inet)
-
-		n := &devices{
-			m1:     m1,
-			m1IP:   m1if.V4(),
-			m2:     m2,
-			m2IP:   m2if.V4(),
-			stun:   mstun,
-			stunIP: sif.V4(),
-		}
-		testActiveDiscovery(t, n)
-	})
-
-	t.Run("facing_nats", func(t *testing.T) {
-		mstun := &natlab.Machine{Name: "stun"}
-		m1 := &natlab.Machine{
-			Name:          "m1",
-			PacketHandler: &natlab.Firewall{},
-		}
-		nat1 := &natlab.Machine{
-			Name: "nat1",
-		}
-		m2 := &natlab.Machine{
-			Name:          "m2",
-			PacketHandler: &natlab.Firewall{},
-		}
-		nat2 := &natlab.Machine{
-			Name: "nat2",
-		}
-
-		inet := natlab.NewInternet()
-		lan1 := &natlab.Network{
-			Name:    "lan1",
-			Prefix4: netaddr.MustParseIPPrefix("192.168.0.0/24"),
-		}
-		lan2 := &natlab.Network{
-			Name:    "lan2",
-			Prefix4: netaddr.MustParseIPPrefix("192.168.1.0/24"),
-		}
-
-		sif := mstun.Attach("eth0", inet)
-		nat1WAN := nat1.Attach("wan", inet)
-		nat1LAN := nat1.Attach("lan1", lan1)
-		nat2WAN := nat2.Attach("wan", inet)
-		nat2LAN := nat2.Attach("lan2", lan2)
-		m1if := m1.Attach("eth0", lan1)
-		m2if := m2.Attach("eth0", lan2)
-		lan1.SetDefaultGateway(nat1LAN)
-		lan2.SetDefaultGateway(nat2LAN)
-
-		nat1.PacketHandler = &natlab.SNAT44{
-			Machine:           nat1,
-			ExternalInterface: nat1WAN,
-			Firewall: &natlab.Firewall{
-				TrustedInterface: nat1LAN,
-			},
-		}
-		nat2.PacketHandler = &natlab.SNAT44{
-			Machine:           nat2,
-			ExternalInterface: nat2WAN,
-			Firewall: &natlab.Firewall{
-				TrustedInterface: nat2LAN,
-			},
-		}
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
 
-		n := &devices{
-			m1:     m1,
-			m1IP:   m1if.V4(),
-			m2:     m2,
-			m2IP:   m2if.V4(),
-			stun:   mstun,
-			stunIP: sif.V4(),
+	scenarios := natlab.DefaultScenarios()
+	// NATLAB_SCENARIOS names a JSON file of more scenarios to check,
+	// such as one describing a network you'd like to deploy on.
+	if f := os.Getenv("NATLAB_SCENARIOS"); f != "" {
+		more, err := natlab.LoadScenarios(f)
+		if err != nil {
+			t.Fatal(err)
 		}
-		testActiveDiscovery(t, n)
-	})
+		scenarios = append(scenarios, more...)
+	}
+	for _, s := range scenarios {
+		s := s
+		t.Run(s.Name, func(t *testing.T) {
+			t.Parallel()
+			topo := s.Build()
+			n := &devices{
+				m1:     topo.M1,
+				m1IP:   topo.M1IP,
+				m2:     topo.M2,
+				m2IP:   topo.M2IP,
+				stun:   topo.STUN,
+				stunIP: topo.STUNIP,
+			}
+			testActiveDiscovery(t, s, n)
+		})
+	}
 }
 
 type devices struct {
@@ -847,8 +815,29 @@ type devices struct {
 // dstM, until cleanup is invoked to stop it. Each ping has 1 second
 // to transit the network. It is a test failure to lose a ping.
 func newPinger(t *testing.T, logf logger.Logf, src, dst *magicStack) (cleanup func()) {
+	return newLossyPinger(t, logf, src, dst, nil)
+}
+
+// pingStats counts the pings sent by a lossy pinger, and how many
+// of them were lost.
+type pingStats struct {
+	sent, lost int64 // atomic
+}
+
+func (ps *pingStats) reset() {
+	atomic.StoreInt64(&ps.sent, 0)
+	atomic.StoreInt64(&ps.lost, 0)
+}
+
+// newLossyPinger is like newPinger, but if stats is non-nil, lost
+// pings are counted in it rather than failing the test.
+func newLossyPinger(t *testing.T, logf logger.Logf, src, dst *magicStack, stats *pingStats) (cleanup func()) {
 	ctx, cancel := context.WithCancel(context.Background())
 	done := make(chan struct{})
+	pingTimeout := 10 * time.Second
+	if stats != nil {
+		pingTimeout = time.Second
+	}
 	one := func() bool {
 		// TODO(danderson): requiring exactly zero packet loss
 		// will probably be too strict for some tests we'd like to
@@ -862,10 +851,17 @@ func newPinger(t *testing.T, logf logger.Logf, src, dst *magicStack) (cleanup fu
 		case <-ctx.Done():
 			return false
 		}
+		if stats != nil {
+			atomic.AddInt64(&stats.sent, 1)
+		}
 		select {
 		case <-dst.tun.Inbound:
 			return true
-		case <-time.After(10 * time.Second):
+		case <-time.After(pingTimeout):
+			if stats != nil {
+				atomic.AddInt64(&stats.lost, 1)
+				return true
+			}
 			// Very generous timeout here because depending on
 			// magicsock setup races, the first handshake might get
 			// eaten by the receiving end (if wireguard-go hasn't been
@@ -911,13 +907,11 @@ func newPinger(t *testing.T, logf logger.Logf, src, dst *magicStack) (cleanup fu
 }
 
 // testActiveDiscovery verifies that two magicStacks tied to the given
-// devices can establish a direct p2p connection with each other. See
-// TestActiveDiscovery for the various configurations of devices that
-// get exercised.
-func testActiveDiscovery(t *testing.T, d *devices) {
-	tstest.PanicOnLog()
-	tstest.ResourceCheck(t)
-
+// devices can establish a direct p2p connection with each other, or
+// stay connected over DERP if s doesn't want a direct one. See
+// natlab.DefaultScenarios for the configurations of devices that get
+// exercised.
+func testActiveDiscovery(t *testing.T, s natlab.Scenario, d *devices) {
 	tlogf, setT := makeNestable(t)
 	setT(t)
 
@@ -945,18 +939,52 @@ func testActiveDiscovery(t *testing.T, d *devices) {
 	m2IP := m2.IP()
 	logf("IPs: %s %s", m1IP, m2IP)
 
-	cleanup = newPinger(t, logf, m1, m2)
+	var stats *pingStats
+	if s.Loss() > 0 {
+		stats = new(pingStats)
+	}
+	cleanup = newLossyPinger(t, logf, m1, m2, stats)
 	defer cleanup()
 
+	if !s.WantDirect {
+		mustRelay(t, logf, m1, m2)
+		logf("starting cleanup")
+		return
+	}
+
 	// Everything is now up and running, active discovery should find
 	// a direct path between our peers. Wait for it to switch away
 	// from DERP.
 	mustDirect(t, logf, m1, m2)
 	mustDirect(t, logf, m2, m1)
 
+	if stats != nil {
+		checkPingLoss(t, logf, stats, s.Loss())
+	}
+
 	logf("starting cleanup")
 }
 
+// checkPingLoss checks that the pings counted in stats from now on,
+// over a direct path, are lost at about the rate want.
+func checkPingLoss(t *testing.T, logf logger.Logf, stats *pingStats, want float64) {
+	const minPings = 100
+	stats.reset()
+	for deadline := time.Now().Add(time.Minute); atomic.LoadInt64(&stats.sent) < minPings; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only sent %d pings; want %d to measure loss", atomic.LoadInt64(&stats.sent), minPings)
+		}
+	}
+	sent, lost := atomic.LoadInt64(&stats.sent), atomic.LoadInt64(&stats.lost)
+	got := float64(lost) / float64(sent)
+	logf("lost %d of %d pings (%.2f); want about %.2f", lost, sent, got, want)
+	// The bounds are loose, as the goroutines delivering packets
+	// make the drops only roughly deterministic.
+	if got < want/4 || got > 2*want {
+		t.Errorf("lost %d of %d pings (%.2f); want about %.2f", lost, sent, got, want)
+	}
+}
+
 func mustDirect(t *testing.T, logf logger.Logf, m1, m2 *magicStack) {
 	lastLog := time.Now().Add(-time.Minute)
 	// See https://github.com/tailscale/tailscale/issues/654
@@ -975,6 +1003,20 @@ func mustDirect(t *testing.T, logf logger.Logf, m1, m2 *magicStack) {
 	t.Errorf("magicsock did not find a direct path from %s to %s", m1, m2)
 }
 
+// mustRelay checks that m1 and m2 don't find a direct path to each
+// other for a while, in a network that's meant to leave them on DERP.
+func mustRelay(t *testing.T, logf logger.Logf, m1, m2 *magicStack) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, p := range [][2]*magicStack{{m1, m2}, {m2, m1}} {
+			if pst := p[0].Status().Peer[p[1].Public()]; pst.CurAddr != "" {
+				t.Errorf("magicsock found a direct path from %s to %s with addr %s; want DERP only", p[0], p[1], pst.CurAddr)
+				return
+			}
+		}
+	}
+	logf("no direct path between %s and %s, as expected", m1, m2)
+}
+
 func testTwoDevicePing(t *testing.T, d *devices) {
 	tstest.PanicOnLog()
 	tstest.ResourceCheck(t)
@@ -1475,6 +1517,69 @@ func TestSetNetworkMapChangingNodeKey(t *testing.T) {
 	}
 }
 
+func TestEndpointHints(t *testing.T) {
+	conn := newTestConn(t)
+	t.Cleanup(func() { conn.Close() })
+	conn.logf = t.Logf
+
+	conn.SetPrivateKey(key.NodePrivateFromRaw32(mem.B([]byte{0: 1, 31: 0})))
+
+	discoKey := key.DiscoPublicFromRaw32(mem.B([]byte{31: 1}))
+	nodeKey1 := key.NodePublicFromRaw32(mem.B([]byte{0: 'N', 1: 'K', 2: '1', 31: 0}))
+	nodeKey2 := key.NodePublicFromRaw32(mem.B([]byte{0: 'N', 1: 'K', 2: '2', 31: 0}))
+	nodeKey3 := key.NodePublicFromRaw32(mem.B([]byte{0: 'N', 1: 'K', 2: '3', 31: 0}))
+	hinted := netaddr.MustParseIPPort("192.168.1.2:345")
+	at := time.Now().Add(-time.Hour).Round(0)
+
+	conn.SetEndpointHints(map[key.NodePublic]EndpointHint{
+		nodeKey1: {Addr: hinted, Latency: time.Millisecond, At: at},
+		nodeKey2: {Addr: netaddr.MustParseIPPort("10.0.0.1:41641"), At: at}, // no longer an endpoint
+		nodeKey3: {Addr: hinted, At: at},                                    // not in netmap
+	})
+	conn.SetNetworkMap(&netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			{
+				Key:       nodeKey1,
+				DiscoKey:  discoKey,
+				Endpoints: []string{"1.2.3.4:567", hinted.String()},
+			},
+			{
+				Key:       nodeKey2,
+				DiscoKey:  key.DiscoPublicFromRaw32(mem.B([]byte{31: 2})),
+				Endpoints: []string{"1.2.3.4:568"},
+			},
+		},
+	})
+
+	de, ok := conn.peerMap.endpointForNodeKey(nodeKey1)
+	if !ok {
+		t.Fatal("no endpoint for key1")
+	}
+	de.mu.Lock()
+	udpAddr, derpAddr := de.addrForSendLocked(mono.Now())
+	de.mu.Unlock()
+	if udpAddr != hinted {
+		t.Errorf("key1 sends to %v; want hinted %v", udpAddr, hinted)
+	}
+	if derpAddr != de.derpAddr {
+		t.Errorf("key1 derp addr = %v; want unconfirmed hint to also use DERP", derpAddr)
+	}
+	de, _ = conn.peerMap.endpointForNodeKey(nodeKey2)
+	if !de.bestAddr.IsZero() {
+		t.Errorf("key2 best addr = %v; want none for stale hint", de.bestAddr)
+	}
+
+	// The unconfirmed hint isn't saved again, but the one for the
+	// peer not yet seen is kept.
+	got := conn.EndpointHints()
+	want := map[key.NodePublic]EndpointHint{
+		nodeKey3: {Addr: hinted, At: at},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EndpointHints = %v; want %v", got, want)
+	}
+}
+
 func TestRebindStress(t *testing.T) {
 	conn := newTestConn(t)
 
@@ -1800,3 +1905,259 @@ func TestBlockForeverConnUnblocks(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{in: "0", want: []int{0}},
+		{in: "0-3", want: []int{0, 1, 2, 3}},
+		{in: "6, 0-2,1", want: []int{0, 1, 2, 6}},
+		{in: "", wantErr: true},
+		{in: "3-1", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "a", wantErr: true},
+		{in: "1023", want: []int{1023}},
+		{in: "1024", wantErr: true},
+		{in: "0-9999999999", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCPUList(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCPUList(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) && !tt.wantErr {
+			t.Errorf("ParseCPUList(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTimeRecvHandoff(t *testing.T) {
+	var fail bool
+	fn := timeRecvHandoff(func(b []byte) (int, conn.Endpoint, error) {
+		if fail {
+			return 0, nil, errors.New("closed")
+		}
+		return len(b), nil, nil
+	})
+	recv := func() {
+		t.Helper()
+		if _, _, err := fn(nil); (err != nil) != fail {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	before := metricRecvHandoffStalls.Value()
+	stalls := func() int64 { return metricRecvHandoffStalls.Value() - before }
+
+	recv()
+	recv()
+	if got := stalls(); got != 0 {
+		t.Fatalf("stalls after fast handoff = %d; want 0", got)
+	}
+	time.Sleep(2 * recvHandoffStall)
+	recv()
+	if got := stalls(); got != 1 {
+		t.Fatalf("stalls after slow handoff = %d; want 1", got)
+	}
+
+	// Time spent after an error isn't a handoff.
+	fail = true
+	recv()
+	fail = false
+	time.Sleep(2 * recvHandoffStall)
+	recv()
+	if got := stalls(); got != 1 {
+		t.Fatalf("stalls after error = %d; want 1", got)
+	}
+}
+
+func TestNATKeepAliveInterval(t *testing.T) {
+	tests := []struct {
+		lifetime time.Duration
+		probed   bool
+		min, max time.Duration
+	}{
+		{0, false, 20 * time.Second, 26 * time.Second},
+		{0, true, 5 * time.Second, 5 * time.Second},
+		{10 * time.Second, true, 6666666666, 8 * time.Second},
+		{30 * time.Second, true, 20 * time.Second, 24 * time.Second},
+		{120 * time.Second, true, 80 * time.Second, 96 * time.Second},
+	}
+	for _, tt := range tests {
+		min, max := natKeepAliveInterval(tt.lifetime, tt.probed)
+		if min != tt.min || max != tt.max {
+			t.Errorf("natKeepAliveInterval(%v, %v) = %v, %v; want %v, %v", tt.lifetime, tt.probed, min, max, tt.min, tt.max)
+		}
+	}
+}
+
+func TestProbeNATLifetime(t *testing.T) {
+	// A STUN server in front of a pretend NAT that expires mappings
+	// idle for more than expiry, giving the next packet from the same
+	// source a new mapped port.
+	const expiry = 150 * time.Millisecond
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		type mapping struct {
+			port     uint16
+			lastSeen time.Time
+		}
+		mappings := map[string]*mapping{}
+		nextPort := uint16(10000)
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			txID, err := stun.ParseBindingRequest(buf[:n])
+			if err != nil {
+				continue
+			}
+			m := mappings[addr.String()]
+			if m == nil || time.Since(m.lastSeen) > expiry {
+				m = &mapping{port: nextPort}
+				nextPort++
+				mappings[addr.String()] = m
+			}
+			m.lastSeen = time.Now()
+			pc.WriteTo(stun.Response(txID, net.IPv4(203, 0, 113, 1), m.port), addr)
+		}
+	}()
+
+	listen := func() (net.PacketConn, error) { return net.ListenPacket("udp4", "127.0.0.1:0") }
+	stunAddr := pc.LocalAddr().(*net.UDPAddr)
+	candidates := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 300 * time.Millisecond, 600 * time.Millisecond}
+	got, err := probeNATLifetime(context.Background(), listen, stunAddr, candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 100 * time.Millisecond; got != want {
+		t.Errorf("lifetime = %v; want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := probeNATLifetime(ctx, listen, stunAddr, candidates); err == nil {
+		t.Error("canceled probe succeeded")
+	}
+}
+
+func TestDERPIdleDisconnect(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.myDerp = 1
+	c.derpIdleTimeout = time.Minute
+	c.derpIdleTimer = time.AfterFunc(time.Hour, func() {})
+	defer c.derpIdleTimer.Stop()
+	var idleFor time.Duration
+	c.idleFunc = func() time.Duration { return idleFor }
+
+	addDERP := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.activeDerp = map[int]activeDerp{
+			1: {
+				c:          derphttp.NewRegionClient(key.NewNode(), t.Logf, func() *tailcfg.DERPRegion { return nil }),
+				cancel:     func() {},
+				lastWrite:  new(time.Time),
+				createTime: time.Now(),
+			},
+		}
+	}
+	derps := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.activeDerp)
+	}
+	addDERP()
+
+	idleFor = 30 * time.Second
+	c.checkDERPIdle()
+	if derps() != 1 || c.derpIdleAtomic.Get() {
+		t.Fatal("disconnected from DERP before the idle timeout")
+	}
+
+	idleFor = 2 * time.Minute
+	c.checkDERPIdle()
+	if derps() != 0 || !c.derpIdleAtomic.Get() {
+		t.Fatal("still connected to DERP after the idle timeout")
+	}
+
+	wakes := metricDERPIdleWakes.Value()
+	c.maybeWakeDERP("test")
+	if c.derpIdleAtomic.Get() {
+		t.Fatal("still idle after waking")
+	}
+	if got := metricDERPIdleWakes.Value() - wakes; got != 1 {
+		t.Errorf("recorded %d wakes; want 1", got)
+	}
+
+	// Right after waking, the DERP connection is kept even though the
+	// tunnel has been idle.
+	addDERP()
+	c.checkDERPIdle()
+	if derps() != 1 {
+		t.Error("disconnected from DERP right after waking")
+	}
+}
+
+func TestDSCPMarking(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	small := make([]byte, dscpInteractiveMaxLen)
+	big := make([]byte, dscpInteractiveMaxLen+1)
+	discoPkt := append([]byte(disco.Magic), big...)
+
+	// Nothing is marked until a probe finds the marking preserved.
+	if got := c.dscpFor(small); got != 0 {
+		t.Errorf("small packet marked %d before any probe; want unmarked", got)
+	}
+	if dscpEnabled() {
+		if got := c.dscpStatus(); got != "unchecked" {
+			t.Errorf("status before any probe = %q; want unchecked", got)
+		}
+	}
+
+	c.dscpMarking.Set(true)
+	if got := c.dscpFor(small); got != dscp.AF41 {
+		t.Errorf("small packet marked %d; want %d", got, dscp.AF41)
+	}
+	if got := c.dscpFor(discoPkt); got != dscp.AF41 {
+		t.Errorf("disco packet marked %d; want %d", got, dscp.AF41)
+	}
+	if got := c.dscpFor(big); got != 0 {
+		t.Errorf("big packet marked %d; want unmarked", got)
+	}
+
+	if !dscpEnabled() {
+		return
+	}
+	for _, tt := range []struct {
+		preserved opt.Bool
+		want      bool
+		status    string
+	}{
+		{"false", false, "stripped"},
+		{"", false, "stripped"}, // not checked; unchanged
+		{"true", true, "marking"},
+	} {
+		c.updateDSCPMarking(&netcheck.Report{DSCPPreserved: tt.preserved})
+		if got := c.dscpMarking.Get(); got != tt.want {
+			t.Errorf("after DSCPPreserved=%q, marking = %v; want %v", tt.preserved, got, tt.want)
+		}
+		if got := c.dscpStatus(); got != tt.status {
+			t.Errorf("after DSCPPreserved=%q, status = %q; want %q", tt.preserved, got, tt.status)
+		}
+		if !tt.want && c.dscpFor(small) != 0 {
+			t.Errorf("after DSCPPreserved=%q, small packet still marked", tt.preserved)
+		}
+	}
+}
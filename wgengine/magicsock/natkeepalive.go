@@ -0,0 +1,303 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/clientmetric"
+)
+
+// NAT keepalive tuning.
+//
+// While a session is active, magicsock re-STUNs periodically so its NAT
+// mapping, and so the endpoints it has told peers about, stay valid.
+// Instead of assuming the common 30 second UDP mapping timeout, it
+// measures how long this network's NAT keeps an idle mapping, and
+// re-STUNs a bit more often than that: less often on NATs that keep
+// mappings for minutes, saving battery, and more often on CGNATs that
+// expire them in seconds.
+
+// natLifetimeCandidates are the idle times that probeNATLifetime checks a
+// NAT mapping survives, in increasing order.
+var natLifetimeCandidates = []time.Duration{
+	10 * time.Second,
+	20 * time.Second,
+	30 * time.Second,
+	60 * time.Second,
+	120 * time.Second,
+}
+
+const (
+	// natLifetimeReprobeInterval is how long a mapping lifetime
+	// measurement is trusted for on the same network.
+	natLifetimeReprobeInterval = time.Hour
+
+	// minNATKeepAlive is the shortest periodic re-STUN interval used,
+	// even on NATs that expire mappings sooner than the shortest
+	// candidate.
+	minNATKeepAlive = 5 * time.Second
+)
+
+// natLifetimeState is what magicsock knows about the current network's
+// NAT mapping lifetime.
+type natLifetimeState struct {
+	probing  bool
+	network  netaddr.IP    // public IPv4 address lifetime was measured on
+	lifetime time.Duration // longest candidate that survived; 0 if none
+	probedAt time.Time     // zero if never measured
+}
+
+// natKeepAliveInterval returns the bounds of the random interval between
+// periodic re-STUNs for a NAT that keeps idle mappings for lifetime, as
+// probed. A zero lifetime with probed false means unknown.
+func natKeepAliveInterval(lifetime time.Duration, probed bool) (min, max time.Duration) {
+	if !probed {
+		// Just under 30s, a common UDP NAT timeout on Linux, etc.
+		return 20 * time.Second, 26 * time.Second
+	}
+	if lifetime == 0 {
+		return minNATKeepAlive, minNATKeepAlive
+	}
+	min, max = lifetime*2/3, lifetime*4/5
+	if min < minNATKeepAlive {
+		min = minNATKeepAlive
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// natKeepAliveIntervalLocked returns the bounds of the random interval
+// between periodic re-STUNs.
+//
+// c.mu must be held.
+func (c *Conn) natKeepAliveIntervalLocked() (min, max time.Duration) {
+	st := &c.natLifetime
+	return natKeepAliveInterval(st.lifetime, !st.probedAt.IsZero())
+}
+
+// maybeProbeNATLifetime starts measuring the NAT mapping lifetime of the
+// network that report describes, if it's not known and not already being
+// measured.
+//
+// c.mu must NOT be held.
+func (c *Conn) maybeProbeNATLifetime(report *netcheck.Report, dm *tailcfg.DERPMap) {
+	if debugFixedNATKeepAlive || runtime.GOOS == "js" || report == nil || !report.UDP || report.GlobalV4 == "" {
+		return
+	}
+	if c.portMapper.HaveMapping() {
+		// The port mapping keeps our endpoint alive, not traffic.
+		return
+	}
+	global, err := netaddr.ParseIPPort(report.GlobalV4)
+	if err != nil {
+		return
+	}
+	stunAddr, ok := stunAddrForRegion(dm, report.PreferredDERP)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := &c.natLifetime
+	if c.closed || st.probing {
+		return
+	}
+	if st.network == global.IP() && !st.probedAt.IsZero() && time.Since(st.probedAt) < natLifetimeReprobeInterval {
+		return
+	}
+	if st.network != global.IP() {
+		// New network; until measured, assume the default.
+		*st = natLifetimeState{network: global.IP()}
+	}
+	st.probing = true
+	metricNATLifetimeProbe.Add(1)
+
+	go func() {
+		lc := netns.Listener(c.logf)
+		listen := func() (net.PacketConn, error) {
+			return lc.ListenPacket(c.connCtx, "udp4", ":0")
+		}
+		lifetime, err := probeNATLifetime(c.connCtx, listen, stunAddr, natLifetimeCandidates)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		st := &c.natLifetime
+		st.probing = false
+		c.muCond.Broadcast()
+		if err != nil {
+			if c.connCtx.Err() == nil {
+				c.logf("magicsock: NAT mapping lifetime probe: %v", err)
+			}
+			return
+		}
+		if st.network != global.IP() {
+			// Network changed during the probe.
+			return
+		}
+		st.lifetime = lifetime
+		st.probedAt = time.Now()
+		min, max := c.natKeepAliveIntervalLocked()
+		c.logf("magicsock: NAT keeps idle UDP mappings at least %v; re-STUNing every %v-%v", lifetime, min, max)
+	}()
+}
+
+// stunAddrForRegion returns the IPv4 address of a STUN server in the DERP
+// region regionID.
+func stunAddrForRegion(dm *tailcfg.DERPMap, regionID int) (*net.UDPAddr, bool) {
+	if dm == nil || dm.Regions[regionID] == nil {
+		return nil, false
+	}
+	for _, n := range dm.Regions[regionID].Nodes {
+		if n.STUNPort < 0 {
+			continue
+		}
+		ip, err := netaddr.ParseIP(n.IPv4)
+		if err != nil || !ip.Is4() {
+			continue
+		}
+		port := n.STUNPort
+		if port == 0 {
+			port = 3478
+		}
+		return netaddr.IPPortFrom(ip, uint16(port)).UDPAddr(), true
+	}
+	return nil, false
+}
+
+// probeNATLifetime measures how long the NAT between here and stunAddr
+// keeps a UDP mapping that sees no traffic. For each of candidates, it
+// learns a fresh socket's mapped address, leaves the socket idle for the
+// candidate time, and checks its mapped address is the same. It returns
+// the longest candidate for which that, and every shorter candidate,
+// held, or zero if none did.
+//
+// The candidates are tested concurrently, so it takes about as long as
+// the longest one.
+func probeNATLifetime(ctx context.Context, listen func() (net.PacketConn, error), stunAddr *net.UDPAddr, candidates []time.Duration) (time.Duration, error) {
+	survived := make([]bool, len(candidates))
+	errs := make([]error, len(candidates))
+	var wg sync.WaitGroup
+	for i, d := range candidates {
+		i, d := i, d
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			survived[i], errs[i] = probeNATMapping(ctx, listen, stunAddr, d)
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var lifetime time.Duration
+	var anyOK bool
+	for i, d := range candidates {
+		if errs[i] != nil {
+			continue
+		}
+		anyOK = true
+		if !survived[i] {
+			break
+		}
+		lifetime = d
+	}
+	if !anyOK {
+		return 0, errs[0]
+	}
+	return lifetime, nil
+}
+
+// probeNATMapping reports whether a new socket's NAT mapping toward
+// stunAddr is unchanged after it's been idle for idle.
+func probeNATMapping(ctx context.Context, listen func() (net.PacketConn, error), stunAddr *net.UDPAddr, idle time.Duration) (bool, error) {
+	pc, err := listen()
+	if err != nil {
+		return false, err
+	}
+	defer pc.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// Unblock reads if ctx is done.
+		select {
+		case <-ctx.Done():
+			pc.Close()
+		case <-stop:
+		}
+	}()
+
+	before, err := stunQuery(ctx, pc, stunAddr)
+	if err != nil {
+		return false, err
+	}
+	t := time.NewTimer(idle)
+	select {
+	case <-ctx.Done():
+		t.Stop()
+		return false, ctx.Err()
+	case <-t.C:
+	}
+	after, err := stunQuery(ctx, pc, stunAddr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		// The STUN server answered before, so assume the
+		// mapping (or NAT state for it) is gone.
+		return false, nil
+	}
+	return before == after, nil
+}
+
+// stunQuery returns pc's address as seen by the STUN server at stunAddr,
+// retrying a few times in case of packet loss.
+func stunQuery(ctx context.Context, pc net.PacketConn, stunAddr *net.UDPAddr) (netaddr.IPPort, error) {
+	const tries = 3
+	buf := make([]byte, 1500)
+	for try := 0; try < tries && ctx.Err() == nil; try++ {
+		txID := stun.NewTxID()
+		if _, err := pc.WriteTo(stun.Request(txID), stunAddr); err != nil {
+			return netaddr.IPPort{}, err
+		}
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				break // timeout; retry
+			}
+			tid, addr, port, err := stun.ParseResponse(buf[:n])
+			if err != nil || tid != txID {
+				continue
+			}
+			ip, ok := netaddr.FromStdIP(net.IP(addr))
+			if !ok {
+				return netaddr.IPPort{}, errors.New("bad address in STUN response")
+			}
+			return netaddr.IPPortFrom(ip, port), nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return netaddr.IPPort{}, err
+	}
+	return netaddr.IPPort{}, fmt.Errorf("no STUN response from %v", stunAddr)
+}
+
+var metricNATLifetimeProbe = clientmetric.NewCounter("magicsock_nat_lifetime_probe")
@@ -0,0 +1,183 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"inet.af/netaddr"
+)
+
+// ListenICMP returns a conn for sending and receiving ICMP messages
+// from local, one of this node's Tailscale IPs, in netstack.
+//
+// If raw is false, the conn is like an unprivileged ping socket: it
+// can only send echo requests, netstack assigns their identifier, and
+// it only receives the matching echo replies. If raw is true, the conn
+// can send any ICMP message and receives every ICMP message to local,
+// including the errors (such as time exceeded) that traceroute needs.
+//
+// Either way, netstack builds the IP header from local, so the source
+// address can't be spoofed, and only destinations that route to a
+// peer can be written to. There's no raw access to TCP and UDP, which
+// netstack itself handles.
+func (ns *Impl) ListenICMP(local netaddr.IP, raw bool) (*ICMPConn, error) {
+	if !ns.isLocalIP(local) {
+		return nil, fmt.Errorf("netstack: %v is not a local Tailscale IP", local)
+	}
+	var (
+		netProto   tcpip.NetworkProtocolNumber
+		transProto tcpip.TransportProtocolNumber
+	)
+	if local.Is4() {
+		netProto, transProto = ipv4.ProtocolNumber, icmp.ProtocolNumber4
+	} else {
+		netProto, transProto = ipv6.ProtocolNumber, icmp.ProtocolNumber6
+	}
+
+	var wq waiter.Queue
+	var ep tcpip.Endpoint
+	var tcpErr tcpip.Error
+	if raw {
+		// Associated raw endpoints get their IP header from
+		// netstack, unlike IPPROTO_RAW ones.
+		ep, tcpErr = ns.ipstack.NewRawEndpoint(transProto, netProto, &wq, true)
+	} else {
+		ep, tcpErr = ns.ipstack.NewEndpoint(transProto, netProto, &wq)
+	}
+	if tcpErr != nil {
+		return nil, fmt.Errorf("netstack: creating ICMP endpoint: %v", tcpErr)
+	}
+	if tcpErr := ep.Bind(tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(local.IPAddr().IP)}); tcpErr != nil {
+		ep.Close()
+		return nil, fmt.Errorf("netstack: binding ICMP endpoint to %v: %v", local, tcpErr)
+	}
+	return &ICMPConn{
+		ns:    ns,
+		ep:    ep,
+		local: local,
+		raw:   raw,
+		pc:    gonet.NewUDPConn(ns.ipstack, &wq, ep),
+	}, nil
+}
+
+// ICMPConn is a net.PacketConn of ICMP messages on the tailnet,
+// returned by Impl.ListenICMP.
+//
+// Reads and writes are ICMP messages, without the IP header. The
+// net.Addr of ReadFrom is a *net.IPAddr; WriteTo accepts a *net.IPAddr
+// or a *net.UDPAddr, whose port is ignored.
+type ICMPConn struct {
+	ns    *Impl
+	ep    tcpip.Endpoint
+	local netaddr.IP
+	raw   bool
+	pc    *gonet.UDPConn
+}
+
+var errNotPeer = errors.New("destination is not a Tailscale peer")
+
+// ReadFrom implements net.PacketConn.
+func (c *ICMPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.pc.ReadFrom(b)
+	if err != nil {
+		return n, nil, err
+	}
+	if c.raw && c.local.Is4() {
+		// Raw IPv4 endpoints include the IP header, as on
+		// Linux. Strip it, so both families read the same.
+		if n == 0 {
+			return 0, nil, errors.New("netstack: short ICMP read")
+		}
+		hl := int(b[0]&0x0f) * 4
+		if hl > n {
+			return 0, nil, errors.New("netstack: short ICMP read")
+		}
+		n = copy(b, b[hl:n])
+	}
+	return n, &net.IPAddr{IP: addr.(*net.UDPAddr).IP}, nil
+}
+
+// WriteTo implements net.PacketConn.
+func (c *ICMPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return 0, c.opError("write", addr, fmt.Errorf("unsupported address type %T", addr))
+	}
+	dst, ok := netaddr.FromStdIP(ip)
+	if !ok || dst.Is4() != c.local.Is4() {
+		return 0, c.opError("write", addr, fmt.Errorf("invalid destination for %v", c.local))
+	}
+	if pip, ok := c.ns.e.PeerForIP(dst); !ok || pip.IsSelf {
+		return 0, c.opError("write", addr, errNotPeer)
+	}
+	return c.pc.WriteTo(b, &net.UDPAddr{IP: dst.IPAddr().IP})
+}
+
+// SetTTL sets the IPv4 TTL or IPv6 hop limit of subsequently
+// written packets.
+func (c *ICMPConn) SetTTL(ttl int) error {
+	opt := tcpip.IPv4TTLOption
+	if c.local.Is6() {
+		opt = tcpip.IPv6HopLimitOption
+	}
+	if err := c.ep.SetSockOptInt(opt, ttl); err != nil {
+		return c.opError("set", nil, errors.New(err.String()))
+	}
+	return nil
+}
+
+// Close implements net.PacketConn.
+func (c *ICMPConn) Close() error { return c.pc.Close() }
+
+// LocalAddr implements net.PacketConn.
+func (c *ICMPConn) LocalAddr() net.Addr { return &net.IPAddr{IP: c.local.IPAddr().IP} }
+
+// SetDeadline implements net.PacketConn.
+func (c *ICMPConn) SetDeadline(t time.Time) error { return c.pc.SetDeadline(t) }
+
+// SetReadDeadline implements net.PacketConn.
+func (c *ICMPConn) SetReadDeadline(t time.Time) error { return c.pc.SetReadDeadline(t) }
+
+// SetWriteDeadline implements net.PacketConn.
+func (c *ICMPConn) SetWriteDeadline(t time.Time) error { return c.pc.SetWriteDeadline(t) }
+
+func (c *ICMPConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    c.network(),
+		Source: c.LocalAddr(),
+		Addr:   addr,
+		Err:    err,
+	}
+}
+
+// network returns the Go network name of c, for errors.
+func (c *ICMPConn) network() string {
+	switch {
+	case c.raw && c.local.Is4():
+		return "ip4:icmp"
+	case c.raw:
+		return "ip6:ipv6-icmp"
+	case c.local.Is4():
+		return "ping4"
+	default:
+		return "ping6"
+	}
+}
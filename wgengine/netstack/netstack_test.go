@@ -5,6 +5,8 @@
 package netstack
 
 import (
+	"errors"
+	"net"
 	"runtime"
 	"testing"
 
@@ -84,3 +86,69 @@ func TestNetstackLeakMode(t *testing.T) {
 		t.Fatalf("refs.leakMode is 0, want a non-zero value")
 	}
 }
+
+// makeNetstack returns an unstarted netstack on a fake TUN device,
+// closed when the test ends.
+func makeNetstack(t *testing.T) (*Impl, *tstun.Wrapper) {
+	t.Helper()
+	tunDev := tstun.NewFake()
+	dialer := new(tsdial.Dialer)
+	logf := func(format string, args ...any) {
+		if !t.Failed() {
+			t.Logf(format, args...)
+		}
+	}
+	eng, err := wgengine.NewUserspaceEngine(logf, wgengine.Config{
+		Tun:    tunDev,
+		Dialer: dialer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(eng.Close)
+	ig, ok := eng.(wgengine.InternalsGetter)
+	if !ok {
+		t.Fatal("not an InternalsGetter")
+	}
+	tunWrap, magicSock, dns, ok := ig.GetInternals()
+	if !ok {
+		t.Fatal("failed to get internals")
+	}
+
+	ns, err := Create(logf, tunWrap, eng, magicSock, dialer, dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	return ns, tunWrap
+}
+
+func TestListenICMP(t *testing.T) {
+	ns, _ := makeNetstack(t)
+	ns.ProcessLocalIPs = true
+	if err := ns.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	self := netaddr.MustParseIP("100.64.0.1")
+	ns.atomicIsLocalIPFunc.Store(func(ip netaddr.IP) bool { return ip == self })
+	ns.addSubnetAddress(self)
+
+	if _, err := ns.ListenICMP(netaddr.MustParseIP("100.64.0.2"), false); err == nil {
+		t.Errorf("ListenICMP on non-local IP succeeded")
+	}
+	for _, raw := range []bool{false, true} {
+		c, err := ns.ListenICMP(self, raw)
+		if err != nil {
+			t.Fatalf("ListenICMP(raw=%v): %v", raw, err)
+		}
+		if err := c.SetTTL(3); err != nil {
+			t.Errorf("SetTTL(raw=%v): %v", raw, err)
+		}
+		// There's no netmap, so no peers to write to.
+		_, err = c.WriteTo([]byte{8, 0, 0, 0, 0, 0, 0, 0}, &net.IPAddr{IP: net.ParseIP("100.64.0.2")})
+		if !errors.Is(err, errNotPeer) {
+			t.Errorf("WriteTo(raw=%v) to non-peer = %v; want errNotPeer", raw, err)
+		}
+		c.Close()
+	}
+}
@@ -17,7 +17,6 @@
 
 	ole "github.com/go-ole/go-ole"
 	"golang.org/x/sys/windows"
-	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 	"inet.af/netaddr"
 	"tailscale.com/health"
@@ -43,7 +42,7 @@
 // ICMP fragmentation-needed messages within tailscaled. This code may
 // address a few rare corner cases, but is unlikely to significantly
 // help with MTU issues compared to a static 1280B implementation.
-func monitorDefaultRoutes(tun *tun.NativeTun) (*winipcfg.RouteChangeCallback, error) {
+func monitorDefaultRoutes(tun windowsTUN) (*winipcfg.RouteChangeCallback, error) {
 	ourLuid := winipcfg.LUID(tun.LUID())
 	lastMtu := uint32(0)
 	doIt := func() error {
@@ -245,7 +244,7 @@ func interfaceFromLUID(luid winipcfg.LUID, flags winipcfg.GAAFlags) (*winipcfg.I
 	return nil, fmt.Errorf("interfaceFromLUID: interface with LUID %v not found", luid)
 }
 
-func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
+func configureInterface(cfg *Config, tun windowsTUN) (retErr error) {
 	const mtu = 0
 	luid := winipcfg.LUID(tun.LUID())
 	iface, err := interfaceFromLUID(luid,
@@ -340,6 +339,13 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
 		}
 	}
 
+	mp, err := getMetricPolicy()
+	if err != nil {
+		// Carry on with whatever parsed; a typo in the policy
+		// shouldn't take down the interface.
+		log.Printf("metric policy: %v", err)
+	}
+
 	var routes []winipcfg.RouteData
 	foundDefault4 := false
 	foundDefault6 := false
@@ -377,7 +383,7 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
 				Mask: ipn.Mask,
 			},
 			NextHop: gateway,
-			Metric:  0,
+			Metric:  mp.metricFor(route),
 		}
 		if net.IP.Equal(r.Destination.IP, gateway) {
 			// no need to add a route for the interface's
@@ -447,6 +453,9 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
 		if foundDefault4 {
 			ipif4.UseAutomaticMetric = false
 			ipif4.Metric = 0
+		} else if mp.interfaceMetric != 0 {
+			ipif4.UseAutomaticMetric = false
+			ipif4.Metric = mp.interfaceMetric
 		}
 		if mtu > 0 {
 			ipif4.NLMTU = uint32(mtu)
@@ -466,6 +475,9 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
 			if foundDefault6 {
 				ipif6.UseAutomaticMetric = false
 				ipif6.Metric = 0
+			} else if mp.interfaceMetric != 0 {
+				ipif6.UseAutomaticMetric = false
+				ipif6.Metric = mp.interfaceMetric
 			}
 			if mtu > 0 {
 				ipif6.NLMTU = uint32(mtu)
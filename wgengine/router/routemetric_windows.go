@@ -0,0 +1,207 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"inet.af/netaddr"
+	"tailscale.com/util/winutil"
+)
+
+// metricPolicy is the admin-configured metrics for the Tailscale
+// interface and its routes. Windows picks among routes to the same
+// prefix by the sum of the route's metric and its interface's metric,
+// lowest first, so lowering these lets Tailscale's routes win against
+// other adapters' routes, such as a corporate VPN's.
+type metricPolicy struct {
+	// interfaceMetric, if non-zero, is the metric to set on the
+	// Tailscale interface instead of letting Windows pick one
+	// automatically. When there's a default route (an exit node is
+	// in use), the interface metric is always 0.
+	interfaceMetric uint32
+
+	// routeMetric is the metric of routes not in routeMetrics.
+	routeMetric uint32
+
+	// routeMetrics are per-prefix route metrics. A route gets the
+	// metric of the narrowest prefix that contains it.
+	routeMetrics map[netaddr.IPPrefix]uint32
+}
+
+// getMetricPolicy reads the metric policy from the InterfaceMetric,
+// RouteMetric and RouteMetrics system policies.
+func getMetricPolicy() (metricPolicy, error) {
+	mp := metricPolicy{
+		interfaceMetric: uint32(winutil.GetPolicyInteger("InterfaceMetric", 0)),
+		routeMetric:     uint32(winutil.GetPolicyInteger("RouteMetric", 0)),
+	}
+	var err error
+	mp.routeMetrics, err = parseRouteMetrics(winutil.GetPolicyString("RouteMetrics", ""))
+	return mp, err
+}
+
+// parseRouteMetrics parses the RouteMetrics policy: a comma-separated
+// list of "prefix=metric", such as "10.0.0.0/8=5,fd7a:115c:a1e0::/48=5".
+func parseRouteMetrics(s string) (map[netaddr.IPPrefix]uint32, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	m := map[netaddr.IPPrefix]uint32{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		ps, ms, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid RouteMetrics entry %q; want prefix=metric", f)
+		}
+		p, err := netaddr.ParseIPPrefix(strings.TrimSpace(ps))
+		if err != nil {
+			return nil, fmt.Errorf("invalid RouteMetrics entry %q: %w", f, err)
+		}
+		metric, err := strconv.ParseUint(strings.TrimSpace(ms), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RouteMetrics entry %q: %w", f, err)
+		}
+		m[p.Masked()] = uint32(metric)
+	}
+	return m, nil
+}
+
+// metricFor returns the metric to program for route.
+func (mp metricPolicy) metricFor(route netaddr.IPPrefix) uint32 {
+	metric := mp.routeMetric
+	bits := -1
+	for p, m := range mp.routeMetrics {
+		if int(p.Bits()) > bits && p.Bits() <= route.Bits() && p.Contains(route.IP()) {
+			metric, bits = m, int(p.Bits())
+		}
+	}
+	return metric
+}
+
+// tableRoute is an entry of the OS routing table.
+type tableRoute struct {
+	prefix netaddr.IPPrefix
+	metric uint32 // route metric plus interface metric
+	ifName string
+	ours   bool // on the Tailscale interface
+}
+
+// routeConflict is a route of another adapter that takes precedence
+// over one of Tailscale's.
+type routeConflict struct {
+	ours   netaddr.IPPrefix
+	theirs netaddr.IPPrefix
+	ifName string
+}
+
+func (c routeConflict) String() string {
+	return fmt.Sprintf("%v overridden by %v via %q", c.ours, c.theirs, c.ifName)
+}
+
+// findRouteConflicts returns, for each prefix in want that's on the
+// Tailscale interface in table, the first other adapter's route that
+// Windows prefers for some of its addresses: a narrower route, or an
+// equally narrow one with no higher metric.
+//
+// For default routes (an exit node), only other adapters' default and
+// split-default (/1) routes count, as more specific routes to the local
+// network are expected.
+func findRouteConflicts(want []netaddr.IPPrefix, table []tableRoute) []routeConflict {
+	ourMetric := map[netaddr.IPPrefix]uint32{}
+	for _, r := range table {
+		if r.ours {
+			ourMetric[r.prefix] = r.metric
+		}
+	}
+	var conflicts []routeConflict
+	for _, p := range want {
+		metric, ok := ourMetric[p]
+		if !ok {
+			// Not programmed (yet); that's for the route
+			// convergence check to report.
+			continue
+		}
+		for _, r := range table {
+			if r.ours || !r.prefix.Overlaps(p) || r.prefix.Bits() < p.Bits() {
+				continue
+			}
+			if p.Bits() == 0 && r.prefix.Bits() > 1 {
+				continue
+			}
+			if r.prefix.Bits() == p.Bits() && r.metric > metric {
+				continue
+			}
+			conflicts = append(conflicts, routeConflict{ours: p, theirs: r.prefix, ifName: r.ifName})
+			break
+		}
+	}
+	return conflicts
+}
+
+var limitedBroadcast = netaddr.MustParseIPPrefix("255.255.255.255/32")
+
+// getRouteTable returns the OS routing table for both address families,
+// skipping routes that are never in contention (loopback, link-local,
+// multicast and broadcast).
+func getRouteTable(ourLUID winipcfg.LUID) ([]tableRoute, error) {
+	ifs, err := winipcfg.GetAdaptersAddresses(windows.AF_UNSPEC, winipcfg.GAAFlagIncludeAllInterfaces)
+	if err != nil {
+		return nil, err
+	}
+	type ifKey struct {
+		luid   winipcfg.LUID
+		family winipcfg.AddressFamily
+	}
+	ifName := map[winipcfg.LUID]string{}
+	for _, ifc := range ifs {
+		ifName[ifc.LUID] = ifc.FriendlyName()
+	}
+	ifMetric := map[ifKey]uint32{}
+
+	var table []tableRoute
+	for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+		routes, err := winipcfg.GetIPForwardTable2(family)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range routes {
+			dst := r.DestinationPrefix.IPNet()
+			p, ok := netaddr.FromStdIPNet(&dst)
+			if !ok {
+				continue
+			}
+			ip := p.IP()
+			if ip.IsLoopback() || ip.IsMulticast() || ip.IsLinkLocalUnicast() || p == limitedBroadcast {
+				continue
+			}
+			k := ifKey{r.InterfaceLUID, family}
+			m, ok := ifMetric[k]
+			if !ok {
+				ipif, err := r.InterfaceLUID.IPInterface(family)
+				if err != nil {
+					continue
+				}
+				m = ipif.Metric
+				ifMetric[k] = m
+			}
+			table = append(table, tableRoute{
+				prefix: p.Masked(),
+				metric: r.Metric + m,
+				ifName: ifName[r.InterfaceLUID],
+				ours:   r.InterfaceLUID == ourLUID,
+			})
+		}
+	}
+	return table, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestMetricPolicy(t *testing.T) {
+	rm, err := parseRouteMetrics(" 10.0.0.0/8=5, 10.1.2.0/24=2,fd7a:115c:a1e0::/48=7 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := metricPolicy{routeMetric: 100, routeMetrics: rm}
+	tests := []struct {
+		route string
+		want  uint32
+	}{
+		{"10.0.0.0/8", 5},
+		{"10.1.0.0/16", 5},
+		{"10.1.2.0/24", 2},
+		{"10.1.2.3/32", 2},
+		{"192.168.0.0/16", 100},
+		{"0.0.0.0/0", 100},
+		{"fd7a:115c:a1e0::/48", 7},
+	}
+	for _, tt := range tests {
+		if got := mp.metricFor(netaddr.MustParseIPPrefix(tt.route)); got != tt.want {
+			t.Errorf("metricFor(%v) = %v; want %v", tt.route, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/8", "10.0.0.0/8=x", "bogus=1", "10.0.0.0/8=99999999999"} {
+		if _, err := parseRouteMetrics(bad); err == nil {
+			t.Errorf("parseRouteMetrics(%q) succeeded; want error", bad)
+		}
+	}
+	if m, err := parseRouteMetrics(""); m != nil || err != nil {
+		t.Errorf("parseRouteMetrics(\"\") = %v, %v; want nil, nil", m, err)
+	}
+}
+
+func TestFindRouteConflicts(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	ours := func(p string, metric uint32) tableRoute {
+		return tableRoute{prefix: pfx(p), metric: metric, ifName: "Tailscale", ours: true}
+	}
+	theirs := func(p string, metric uint32) tableRoute {
+		return tableRoute{prefix: pfx(p), metric: metric, ifName: "Corp VPN"}
+	}
+	tests := []struct {
+		name  string
+		want  []string
+		table []tableRoute
+		out   []routeConflict
+	}{
+		{
+			name:  "none",
+			want:  []string{"10.0.0.0/8"},
+			table: []tableRoute{ours("10.0.0.0/8", 5), theirs("192.168.0.0/16", 1)},
+		},
+		{
+			name:  "narrower",
+			want:  []string{"10.0.0.0/8"},
+			table: []tableRoute{ours("10.0.0.0/8", 5), theirs("10.1.0.0/16", 50)},
+			out:   []routeConflict{{pfx("10.0.0.0/8"), pfx("10.1.0.0/16"), "Corp VPN"}},
+		},
+		{
+			name:  "wider",
+			want:  []string{"10.1.0.0/16"},
+			table: []tableRoute{ours("10.1.0.0/16", 50), theirs("10.0.0.0/8", 1)},
+		},
+		{
+			name:  "same_prefix_lower_metric",
+			want:  []string{"10.0.0.0/8"},
+			table: []tableRoute{ours("10.0.0.0/8", 5), theirs("10.0.0.0/8", 1)},
+			out:   []routeConflict{{pfx("10.0.0.0/8"), pfx("10.0.0.0/8"), "Corp VPN"}},
+		},
+		{
+			name:  "same_prefix_higher_metric",
+			want:  []string{"10.0.0.0/8"},
+			table: []tableRoute{ours("10.0.0.0/8", 5), theirs("10.0.0.0/8", 6)},
+		},
+		{
+			name:  "not_programmed",
+			want:  []string{"10.0.0.0/8"},
+			table: []tableRoute{theirs("10.0.0.0/8", 1)},
+		},
+		{
+			name:  "exit_node_lan",
+			want:  []string{"0.0.0.0/0"},
+			table: []tableRoute{ours("0.0.0.0/0", 0), theirs("192.168.1.0/24", 1), theirs("0.0.0.0/0", 25)},
+		},
+		{
+			name:  "exit_node_split_default",
+			want:  []string{"0.0.0.0/0"},
+			table: []tableRoute{ours("0.0.0.0/0", 0), theirs("0.0.0.0/1", 1), theirs("128.0.0.0/1", 1)},
+			out:   []routeConflict{{pfx("0.0.0.0/0"), pfx("0.0.0.0/1"), "Corp VPN"}},
+		},
+		{
+			name:  "other_family",
+			want:  []string{"fd7a:115c:a1e0::/48"},
+			table: []tableRoute{ours("fd7a:115c:a1e0::/48", 0), theirs("10.0.0.0/8", 0)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []netaddr.IPPrefix
+			for _, s := range tt.want {
+				want = append(want, pfx(s))
+			}
+			got := findRouteConflicts(want, tt.table)
+			if !reflect.DeepEqual(got, tt.out) {
+				t.Errorf("got %v; want %v", got, tt.out)
+			}
+		})
+	}
+}
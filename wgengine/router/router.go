@@ -32,6 +32,18 @@ type Router interface {
 	Close() error
 }
 
+// Verifier is an optional interface implemented by Routers that can
+// check that the OS state from their last Set is still in place.
+// Other programs (or a sysadmin) sometimes remove routes or flush
+// firewall rules out from under us.
+type Verifier interface {
+	// Verify checks that the routes and firewall rules of the last
+	// Set are present. It returns nil if so, or else an error
+	// describing what's missing. If repair is true, it also
+	// reprograms what's missing.
+	Verify(repair bool) error
+}
+
 // New returns a new Router for the current platform, using the
 // provided tun device.
 //
@@ -23,6 +23,7 @@
 	"golang.zx2c4.com/wireguard/tun"
 	"inet.af/netaddr"
 	"tailscale.com/envknob"
+	"tailscale.com/health"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/syncs"
 	"tailscale.com/types/logger"
@@ -104,6 +105,32 @@ type linuxRouter struct {
 	v6Available     bool
 	v6NATAvailable  bool
 
+	// v6FilterAvailable is whether ip6tables is usable, and so
+	// whether IPv6 netfilter rules are managed. It's only false
+	// with v6Available true if netfilter6Err is set.
+	v6FilterAvailable bool
+
+	// netfilterErr is why iptables can't be used, if it can't.
+	// If non-nil, the router only runs in routes-only mode
+	// (netfilterOff), whatever the configured mode.
+	netfilterErr error
+
+	// netfilter6Err is why ip6tables can't be used when iptables
+	// can. If non-nil, IPv4 netfilter is managed as configured but
+	// IPv6 is left to the system's firewall (v6FilterAvailable and
+	// v6NATAvailable are false).
+	netfilter6Err error
+
+	// netfilterFallback is whether the last Set fell back to
+	// routes-only mode because of netfilterErr, to log it only
+	// when that changes.
+	netfilterFallback bool
+
+	// routesOnlyWarning is the last warning logged about what
+	// routes-only mode leaves to the system's firewall, to log
+	// each only once.
+	routesOnlyWarning string
+
 	ipt4 netfilterRunner
 	ipt6 netfilterRunner
 	cmd  commandRunner
@@ -115,9 +142,15 @@ func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, linkMon *monitor.Mo
 		return nil, err
 	}
 
-	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	// Without iptables, we can still run in routes-only mode
+	// (--netfilter-mode=off), leaving all firewalling to the
+	// system's own firewall manager.
+	var netfilterErr error
+	var ipt4 netfilterRunner
+	ipt4, err = iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
-		return nil, err
+		netfilterErr = err
+		ipt4 = noNetfilter{err}
 	}
 
 	v6err := checkIPv6(logf)
@@ -131,22 +164,63 @@ func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, linkMon *monitor.Mo
 	}
 
 	var ipt6 netfilterRunner
+	var netfilter6Err error
 	if supportsV6 {
 		// The iptables package probes for `ip6tables` and errors out
-		// if unavailable. We want that to be a non-fatal error.
+		// if unavailable. We want that to be a non-fatal error, and
+		// to cost only IPv6 netfilter: IPv4's holds the CGNAT
+		// anti-spoofing rules.
 		ipt6, err = iptables.NewWithProtocol(iptables.ProtocolIPv6)
 		if err != nil {
-			return nil, err
+			netfilter6Err = err
+			ipt6 = noNetfilter{err}
 		}
 	}
+	if netfilterErr != nil {
+		logf("netfilter unavailable, so only routes-only mode (--netfilter-mode=off) is supported: %v", netfilterErr)
+	} else if netfilter6Err != nil {
+		logf("IPv6 netfilter unavailable, so IPv6 firewalling is left to the system firewall: %v", netfilter6Err)
+	}
 
 	cmd := osCommandRunner{
 		ambientCapNetAdmin: useAmbientCaps(),
 	}
 
-	return newUserspaceRouterAdvanced(logf, tunname, linkMon, ipt4, ipt6, cmd, supportsV6, supportsV6NAT)
+	r, err := newUserspaceRouterAdvanced(logf, tunname, linkMon, ipt4, ipt6, cmd, supportsV6, supportsV6NAT)
+	if err != nil {
+		return nil, err
+	}
+	lr := r.(*linuxRouter)
+	lr.netfilterErr = netfilterErr
+	if netfilter6Err != nil {
+		lr.setNetfilter6Err(netfilter6Err)
+	}
+	return r, nil
+}
+
+// setNetfilter6Err records that ip6tables can't be used, because of
+// err, so IPv6 netfilter rules aren't managed.
+func (r *linuxRouter) setNetfilter6Err(err error) {
+	r.netfilter6Err = err
+	r.v6FilterAvailable = false
+	r.v6NATAvailable = false
+}
+
+// noNetfilter is the netfilterRunner used when iptables isn't usable.
+// It's never called except by bugs, as the router stays in
+// netfilterOff mode.
+type noNetfilter struct {
+	err error
 }
 
+func (n noNetfilter) Insert(table, chain string, pos int, args ...string) error { return n.err }
+func (n noNetfilter) Append(table, chain string, args ...string) error          { return n.err }
+func (n noNetfilter) Exists(table, chain string, args ...string) (bool, error)  { return false, n.err }
+func (n noNetfilter) Delete(table, chain string, args ...string) error          { return n.err }
+func (n noNetfilter) ClearChain(table, chain string) error                      { return n.err }
+func (n noNetfilter) NewChain(table, chain string) error                        { return n.err }
+func (n noNetfilter) DeleteChain(table, chain string) error                     { return n.err }
+
 func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, linkMon *monitor.Mon, netfilter4, netfilter6 netfilterRunner, cmd commandRunner, supportsV6, supportsV6NAT bool) (Router, error) {
 	r := &linuxRouter{
 		logf:          logf,
@@ -154,8 +228,9 @@ func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, linkMon *monit
 		netfilterMode: netfilterOff,
 		linkMon:       linkMon,
 
-		v6Available:    supportsV6,
-		v6NATAvailable: supportsV6NAT,
+		v6Available:       supportsV6,
+		v6NATAvailable:    supportsV6NAT,
+		v6FilterAvailable: supportsV6,
 
 		ipt4: netfilter4,
 		ipt6: netfilter6,
@@ -288,9 +363,37 @@ func (r *linuxRouter) Set(cfg *Config) error {
 		cfg = &shutdownConfig
 	}
 
-	if err := r.setNetfilterMode(cfg.NetfilterMode); err != nil {
+	// Falling back to routes-only mode isn't a Set error: the
+	// routes still go in, and the caller stops configuring (DNS,
+	// for one) on error. It's reported via health instead.
+	mode := cfg.NetfilterMode
+	var fallbackErr error
+	if mode != netfilterOff && r.netfilterErr != nil {
+		fallbackErr = fmt.Errorf("netfilter mode %q unavailable, using routes-only mode (off): %w", mode, r.netfilterErr)
+		mode = netfilterOff
+	}
+	if (fallbackErr != nil) != r.netfilterFallback {
+		if fallbackErr != nil {
+			r.logf("%v", fallbackErr)
+		}
+		r.netfilterFallback = fallbackErr != nil
+	}
+	if fallbackErr != nil {
+		health.SetNetfilterHealth(fallbackErr)
+	} else if mode != netfilterOff && r.netfilter6Err != nil {
+		health.SetNetfilterHealth(fmt.Errorf("IPv6 netfilter unavailable, so the system firewall must accept IPv6 traffic forwarded to and from %s: %w", r.tunname, r.netfilter6Err))
+	} else {
+		health.SetNetfilterHealth(nil)
+	}
+	if err := r.setNetfilterMode(mode); err != nil {
 		errs = append(errs, err)
 	}
+	if w := routesOnlyWarning(mode, cfg, r.tunname); w != r.routesOnlyWarning {
+		if w != "" {
+			r.logf("%s", w)
+		}
+		r.routesOnlyWarning = w
+	}
 
 	newLocalRoutes, err := cidrDiff("localRoute", r.localRoutes, cfg.LocalRoutes, r.addThrowRoute, r.delThrowRoute, r.logf)
 	if err != nil {
@@ -327,6 +430,226 @@ func (r *linuxRouter) Set(cfg *Config) error {
 	return multierr.New(errs...)
 }
 
+// routesOnlyWarning returns a warning about what the system's firewall
+// must do for cfg to work safely in netfilter mode, or the empty string
+// if there's nothing to warn about.
+//
+// In routes-only mode (netfilterOff), tailscaled installs routes and
+// nothing else, so the system's firewall must drop Tailscale-range
+// traffic spoofed on other interfaces, and for subnet routes and exit
+// nodes must also masquerade traffic forwarded for their clients and
+// accept forwarded traffic on the tunnel.
+func routesOnlyWarning(mode preftype.NetfilterMode, cfg *Config, tunname string) string {
+	if mode != netfilterOff {
+		return ""
+	}
+	w := fmt.Sprintf("routes-only mode (netfilter off): nothing drops traffic from Tailscale addresses (%v) arriving on interfaces other than %s, so the system firewall must, or other hosts can spoof Tailscale peers", tsaddr.CGNATRange(), tunname)
+	if len(cfg.SubnetRoutes) == 0 {
+		return w
+	}
+	exitNode := false
+	for _, r := range cfg.SubnetRoutes {
+		if r.Bits() == 0 {
+			exitNode = true
+		}
+	}
+	what := "subnet routes"
+	if exitNode {
+		what = "exit node"
+	}
+	w += fmt.Sprintf("; for the %s to work, it must also accept traffic forwarded to and from %s", what, tunname)
+	if cfg.SNATSubnetRoutes {
+		w += fmt.Sprintf(" and masquerade (NAT) traffic forwarded from %s", tunname)
+	}
+	return w
+}
+
+// maxVerifyProblems is the maximum number of missing things that
+// Verify names in its error.
+const maxVerifyProblems = 5
+
+// Verify implements the Verifier interface. It checks the routes into
+// the tunnel and, if we manage netfilter, Tailscale's netfilter chains
+// and the hooks into them. IP rules are checked separately, by
+// onIPRuleDeleted.
+func (r *linuxRouter) Verify(repair bool) error {
+	var missing []string
+	routes, err := r.missingRoutes()
+	if err != nil {
+		return fmt.Errorf("checking routes: %w", err)
+	}
+	for _, cidr := range routes {
+		missing = append(missing, "route "+normalizeCIDR(cidr))
+		if repair {
+			if err := r.addRoute(cidr); err != nil {
+				r.logf("restoring route %v: %v", cidr, err)
+			}
+		}
+	}
+
+	nf, err := r.missingNetfilter()
+	if err != nil {
+		return fmt.Errorf("checking netfilter: %w", err)
+	}
+	if len(nf) > 0 {
+		missing = append(missing, nf...)
+		if repair {
+			if err := r.restoreNetfilter(); err != nil {
+				r.logf("restoring netfilter rules: %v", err)
+			}
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	if len(missing) > maxVerifyProblems {
+		n := len(missing) - maxVerifyProblems
+		missing = append(missing[:maxVerifyProblems], fmt.Sprintf("%d more", n))
+	}
+	return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+}
+
+// missingRoutes returns the routes in r.routes that aren't in the OS
+// routing table.
+func (r *linuxRouter) missingRoutes() ([]netaddr.IPPrefix, error) {
+	var ret []netaddr.IPPrefix
+	if r.useIPCommand() {
+		for cidr := range r.routes {
+			if !r.v6Available && cidr.IP().Is6() {
+				continue
+			}
+			ok, err := r.hasRoute([]string{normalizeCIDR(cidr), "dev", r.tunname}, cidr)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				ret = append(ret, cidr)
+			}
+		}
+		return ret, nil
+	}
+
+	linkIndex, err := r.linkIndex()
+	if err != nil {
+		return nil, err
+	}
+	table := r.routeTable()
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	filter := &netlink.Route{LinkIndex: linkIndex, Table: table}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	have := map[netaddr.IPPrefix]bool{}
+	for _, rt := range routes {
+		if rt.Dst == nil {
+			// Default route.
+			if rt.Family == netlink.FAMILY_V6 {
+				have[netaddr.IPPrefixFrom(netaddr.IPv6Unspecified(), 0)] = true
+			} else {
+				have[netaddr.IPPrefixFrom(netaddr.IPv4(0, 0, 0, 0), 0)] = true
+			}
+			continue
+		}
+		if p, ok := netaddr.FromStdIPNet(rt.Dst); ok {
+			have[p.Masked()] = true
+		}
+	}
+	for cidr := range r.routes {
+		if !r.v6Available && cidr.IP().Is6() {
+			continue
+		}
+		if !have[cidr.Masked()] {
+			ret = append(ret, cidr)
+		}
+	}
+	return ret, nil
+}
+
+// missingNetfilter returns descriptions of the hooks into Tailscale's
+// netfilter chains, and of the chains' base rules, that are missing for
+// the current netfilter mode.
+//
+// Only one base rule is checked, in ts-forward, on the assumption that
+// whatever removed it (usually a flush) removed the rest too.
+func (r *linuxRouter) missingNetfilter() ([]string, error) {
+	if r.netfilterMode == netfilterOff {
+		return nil, nil
+	}
+	var ret []string
+	check := func(fam string, ipt netfilterRunner, table, chain string, args ...string) error {
+		ok, err := ipt.Exists(table, chain, args...)
+		if err != nil {
+			return fmt.Errorf("checking for %v in %s/%s/%s: %w", args, fam, table, chain, err)
+		}
+		if !ok {
+			ret = append(ret, fmt.Sprintf("netfilter %s/%s/%s %q", fam, table, chain, strings.Join(args, " ")))
+		}
+		return nil
+	}
+
+	fams := []string{"v4", "v6"}
+	for i, ipt := range r.netfilterFamilies() {
+		if r.netfilterMode == netfilterOn {
+			if err := check(fams[i], ipt, "filter", "INPUT", "-j", "ts-input"); err != nil {
+				return nil, err
+			}
+			if err := check(fams[i], ipt, "filter", "FORWARD", "-j", "ts-forward"); err != nil {
+				return nil, err
+			}
+		}
+		if err := check(fams[i], ipt, "filter", "ts-forward", "-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "ACCEPT"); err != nil {
+			return nil, err
+		}
+	}
+	if r.netfilterMode == netfilterOn {
+		if err := check("v4", r.ipt4, "nat", "POSTROUTING", "-j", "ts-postrouting"); err != nil {
+			return nil, err
+		}
+		if r.v6NATAvailable {
+			if err := check("v6", r.ipt6, "nat", "POSTROUTING", "-j", "ts-postrouting"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ret, nil
+}
+
+// restoreNetfilter rebuilds Tailscale's netfilter chains for the current
+// netfilter mode and router state, recreating the chains if needed.
+func (r *linuxRouter) restoreNetfilter() error {
+	if r.netfilterMode == netfilterOff {
+		return nil
+	}
+	// Same order as setNetfilterMode, for the same iptables-compat
+	// reasons: hooks before the ts-forward rules.
+	if err := r.addNetfilterChains(); err != nil {
+		return err
+	}
+	if r.netfilterMode == netfilterOn {
+		if err := r.addNetfilterHooks(); err != nil {
+			return err
+		}
+	}
+	if err := r.addNetfilterBase(); err != nil {
+		return err
+	}
+	for cidr := range r.addrs {
+		if err := r.addLoopbackRule(cidr.IP()); err != nil {
+			return err
+		}
+	}
+	if r.snatSubnetRoutes {
+		if err := r.addSNATRule(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // setNetfilterMode switches the router to the given netfilter
 // mode. Netfilter state is created or deleted appropriately to
 // reflect the new mode, and r.snatSubnetRoutes is updated to reflect
@@ -508,8 +831,8 @@ func (r *linuxRouter) addLoopbackRule(addr netaddr.IP) error {
 
 	nf := r.ipt4
 	if addr.Is6() {
-		if !r.v6Available {
-			// IPv6 not available, ignore.
+		if !r.v6FilterAvailable {
+			// IPv6 or ip6tables not available, ignore.
 			return nil
 		}
 		nf = r.ipt6
@@ -530,8 +853,8 @@ func (r *linuxRouter) delLoopbackRule(addr netaddr.IP) error {
 
 	nf := r.ipt4
 	if addr.Is6() {
-		if !r.v6Available {
-			// IPv6 not available, ignore.
+		if !r.v6FilterAvailable {
+			// IPv6 or ip6tables not available, ignore.
 			return nil
 		}
 		nf = r.ipt6
@@ -1058,7 +1381,7 @@ func (r *linuxRouter) delIPRulesWithIPCommand() error {
 }
 
 func (r *linuxRouter) netfilterFamilies() []netfilterRunner {
-	if r.v6Available {
+	if r.v6FilterAvailable {
 		return []netfilterRunner{r.ipt4, r.ipt6}
 	}
 	return []netfilterRunner{r.ipt4}
@@ -1103,7 +1426,7 @@ func (r *linuxRouter) addNetfilterBase() error {
 	if err := r.addNetfilterBase4(); err != nil {
 		return err
 	}
-	if r.v6Available {
+	if r.v6FilterAvailable {
 		if err := r.addNetfilterBase6(); err != nil {
 			return err
 		}
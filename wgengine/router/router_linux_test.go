@@ -18,8 +18,10 @@
 	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/tun"
 	"inet.af/netaddr"
+	"tailscale.com/health"
 	"tailscale.com/tstest"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/preftype"
 	"tailscale.com/wgengine/monitor"
 )
 
@@ -359,6 +361,197 @@ func TestRouterStates(t *testing.T) {
 	}
 }
 
+func TestRouterVerify(t *testing.T) {
+	mon, err := monitor.New(logger.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon.Start()
+	defer mon.Close()
+
+	fake := NewFakeOS(t)
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", mon, fake.netfilter4, fake.netfilter6, fake, true, true)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	if err := router.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	err = router.Set(&Config{
+		LocalAddrs:       mustCIDRs("100.101.102.104/10"),
+		Routes:           mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+		SubnetRoutes:     mustCIDRs("192.168.0.0/24"),
+		SNATSubnetRoutes: true,
+		NetfilterMode:    netfilterOn,
+	})
+	if err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+	v := router.(Verifier)
+	if err := v.Verify(false); err != nil {
+		t.Fatalf("Verify after Set: %v", err)
+	}
+	want := fake.String()
+
+	// Something else deletes a route and flushes the filter table.
+	for i, rt := range fake.routes {
+		if strings.HasPrefix(rt, "10.0.0.0/8 ") {
+			fake.routes = append(fake.routes[:i], fake.routes[i+1:]...)
+			break
+		}
+	}
+	for k := range fake.netfilter4.n {
+		if strings.HasPrefix(k, "filter/") {
+			fake.netfilter4.n[k] = nil
+		}
+	}
+
+	err = v.Verify(false)
+	if err == nil {
+		t.Fatal("Verify after drift succeeded")
+	}
+	for _, sub := range []string{"route 10.0.0.0/8", `v4/filter/INPUT "-j ts-input"`, "v4/filter/ts-forward"} {
+		if !strings.Contains(err.Error(), sub) {
+			t.Errorf("Verify error %q doesn't mention %q", err, sub)
+		}
+	}
+	if err := v.Verify(true); err == nil {
+		t.Fatal("Verify(repair) after drift succeeded")
+	}
+	if err := v.Verify(false); err != nil {
+		t.Fatalf("Verify after repair: %v", err)
+	}
+	if diff := cmp.Diff(fake.String(), want); diff != "" {
+		t.Errorf("OS state after repair (-got+want):\n%s", diff)
+	}
+}
+
+func TestRouterWithoutNetfilter(t *testing.T) {
+	mon, err := monitor.New(logger.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon.Start()
+	defer mon.Close()
+
+	fake := NewFakeOS(t)
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", mon, fake.netfilter4, fake.netfilter6, fake, true, true)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	router.(*linuxRouter).netfilterErr = errors.New("iptables not found")
+	health.SetNetfilterHealth(nil)
+	t.Cleanup(func() { health.SetNetfilterHealth(nil) })
+	if err := router.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	err = router.Set(&Config{
+		LocalAddrs:       mustCIDRs("100.101.102.104/10"),
+		Routes:           mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+		SubnetRoutes:     mustCIDRs("192.168.0.0/24"),
+		SNATSubnetRoutes: true,
+		NetfilterMode:    netfilterOn,
+	})
+	if err != nil {
+		t.Errorf("Set with netfilter unavailable = %v; want routes-only mode without error", err)
+	}
+	if err := health.NetfilterHealth(); err == nil || !strings.Contains(err.Error(), "routes-only") {
+		t.Errorf("netfilter health = %v; want routes-only mode warning", err)
+	}
+	got := fake.String()
+	if !strings.Contains(got, "ip route add 10.0.0.0/8 dev tailscale0 table 52") {
+		t.Errorf("routes not installed; OS state:\n%s", got)
+	}
+	if strings.Contains(got, "ts-") {
+		t.Errorf("netfilter rules installed; OS state:\n%s", got)
+	}
+}
+
+func TestRouterWithoutIP6tables(t *testing.T) {
+	mon, err := monitor.New(logger.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon.Start()
+	defer mon.Close()
+
+	fake := NewFakeOS(t)
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", mon, fake.netfilter4, fake.netfilter6, fake, true, true)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	router.(*linuxRouter).setNetfilter6Err(errors.New("ip6tables not found"))
+	health.SetNetfilterHealth(nil)
+	t.Cleanup(func() { health.SetNetfilterHealth(nil) })
+	if err := router.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	err = router.Set(&Config{
+		LocalAddrs:       mustCIDRs("100.101.102.104/10", "fd7a:115c:a1e0::1/128"),
+		Routes:           mustCIDRs("100.100.100.100/32", "fd7a:115c:a1e0::/48"),
+		SubnetRoutes:     mustCIDRs("192.168.0.0/24"),
+		SNATSubnetRoutes: true,
+		NetfilterMode:    netfilterOn,
+	})
+	if err != nil {
+		t.Errorf("Set with ip6tables unavailable = %v; want no error", err)
+	}
+	if err := health.NetfilterHealth(); err == nil || !strings.Contains(err.Error(), "IPv6 netfilter unavailable") {
+		t.Errorf("netfilter health = %v; want IPv6 netfilter warning", err)
+	}
+	got := fake.String()
+	if !strings.Contains(got, "v4/filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP") {
+		t.Errorf("IPv4 CGNAT anti-spoofing rules not installed; OS state:\n%s", got)
+	}
+	if strings.Contains(got, "v6/filter/ts-") {
+		t.Errorf("IPv6 netfilter rules installed; OS state:\n%s", got)
+	}
+	if !strings.Contains(got, "ip route add fd7a:115c:a1e0::/48 dev tailscale0 table 52") {
+		t.Errorf("IPv6 routes not installed; OS state:\n%s", got)
+	}
+}
+
+func TestRoutesOnlyWarning(t *testing.T) {
+	tests := []struct {
+		name string
+		mode preftype.NetfilterMode
+		cfg  Config
+		want string // substring, or empty for no warning
+	}{
+		{
+			name: "netfilter-on",
+			mode: netfilterOn,
+			cfg:  Config{SubnetRoutes: mustCIDRs("192.168.0.0/24"), SNATSubnetRoutes: true},
+		},
+		{
+			name: "no-subnet-routes",
+			mode: netfilterOff,
+			cfg:  Config{Routes: mustCIDRs("100.100.100.100/32")},
+			want: "nothing drops traffic from Tailscale addresses (100.64.0.0/10) arriving on interfaces other than tailscale0",
+		},
+		{
+			name: "subnet-routes",
+			mode: netfilterOff,
+			cfg:  Config{SubnetRoutes: mustCIDRs("192.168.0.0/24")},
+			want: "for the subnet routes to work",
+		},
+		{
+			name: "exit-node-snat",
+			mode: netfilterOff,
+			cfg:  Config{SubnetRoutes: mustCIDRs("0.0.0.0/0", "::/0"), SNATSubnetRoutes: true},
+			want: "for the exit node to work, it must also accept traffic forwarded to and from tailscale0 and masquerade",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := routesOnlyWarning(tt.mode, &tt.cfg, "tailscale0")
+			if (got == "") != (tt.want == "") || !strings.Contains(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 type fakeNetfilter struct {
 	t *testing.T
 	n map[string][]string
@@ -628,6 +821,15 @@ func (o *fakeOS) run(args ...string) error {
 func (o *fakeOS) output(args ...string) ([]byte, error) {
 	want := "ip rule list priority 10000"
 	got := strings.Join(args, " ")
+	if len(args) > 3 && args[0] == "ip" && args[2] == "route" && args[3] == "show" {
+		route := strings.Join(args[4:], " ")
+		for _, el := range o.routes {
+			if el == route {
+				return []byte(route), nil
+			}
+		}
+		return nil, nil
+	}
 	if got != want {
 		o.t.Errorf("unexpected command that wants output: %v", got)
 		return nil, errExec
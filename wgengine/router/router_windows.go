@@ -21,29 +21,52 @@
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 	"inet.af/netaddr"
+	"tailscale.com/health"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dns"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
 	"tailscale.com/wgengine/monitor"
 )
 
+// windowsTUN is the subset of *tun.NativeTun's methods used to configure
+// the interface. It's also implemented by tstun's wrapper that recreates
+// dead Wintun adapters.
+type windowsTUN interface {
+	LUID() uint64
+	MTU() (int, error)
+	ForceMTU(int)
+}
+
 type winRouter struct {
-	logf                func(fmt string, args ...any)
-	linkMon             *monitor.Mon // may be nil
-	nativeTun           *tun.NativeTun
+	logf      func(fmt string, args ...any)
+	linkMon   *monitor.Mon // may be nil
+	nativeTun windowsTUN
+	firewall  *firewallTweaker
+
+	mu                  sync.Mutex
 	routeChangeCallback *winipcfg.RouteChangeCallback
-	firewall            *firewallTweaker
+	lastCfg             *Config // last config passed to Set
+
+	// conflictCallback watches for other adapters' route changes
+	// and conflictTimer debounces the resulting conflict checks.
+	conflictCallback *winipcfg.RouteChangeCallback
+	conflictTimer    *time.Timer
+	lastConflicts    string // last reported conflicts, to log changes only
 }
 
 func newUserspaceRouter(logf logger.Logf, tundev tun.Device, linkMon *monitor.Mon) (Router, error) {
-	nativeTun := tundev.(*tun.NativeTun)
+	nativeTun, ok := tundev.(windowsTUN)
+	if !ok {
+		return nil, fmt.Errorf("unsupported TUN device type %T", tundev)
+	}
 	luid := winipcfg.LUID(nativeTun.LUID())
 	guid, err := luid.GUID()
 	if err != nil {
 		return nil, err
 	}
 
-	return &winRouter{
+	r := &winRouter{
 		logf:      logf,
 		linkMon:   linkMon,
 		nativeTun: nativeTun,
@@ -51,12 +74,45 @@ func newUserspaceRouter(logf logger.Logf, tundev tun.Device, linkMon *monitor.Mo
 			logf:    logger.WithPrefix(logf, "firewall: "),
 			tunGUID: *guid,
 		},
-	}, nil
+	}
+	if rt, ok := tundev.(interface{ SetRecreateCallback(func()) }); ok {
+		rt.SetRecreateCallback(r.adapterRecreated)
+	}
+	return r, nil
+}
+
+// adapterRecreated is called after the Wintun adapter has been replaced
+// with a new one, which has none of the old one's addresses or routes.
+// It restores them from the last config.
+func (r *winRouter) adapterRecreated() {
+	r.mu.Lock()
+	cfg := r.lastCfg
+	if r.routeChangeCallback != nil {
+		r.routeChangeCallback.Unregister()
+		r.routeChangeCallback = nil
+	}
+	cb, err := monitorDefaultRoutes(r.nativeTun)
+	if err != nil {
+		r.logf("monitorDefaultRoutes after adapter recreation: %v", err)
+	} else {
+		r.routeChangeCallback = cb
+	}
+	r.mu.Unlock()
+
+	if cfg == nil {
+		return
+	}
+	r.logf("restoring interface config after adapter recreation")
+	if err := r.Set(cfg); err != nil {
+		r.logf("restoring interface config: %v", err)
+	}
 }
 
 func (r *winRouter) Up() error {
 	r.firewall.clear()
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	var err error
 	t0 := time.Now()
 	r.routeChangeCallback, err = monitorDefaultRoutes(r.nativeTun)
@@ -65,6 +121,14 @@ func (r *winRouter) Up() error {
 		return fmt.Errorf("monitorDefaultRoutes, after %v: %v", d, err)
 	}
 	r.logf("monitorDefaultRoutes done after %v", d)
+
+	r.conflictCallback, err = winipcfg.RegisterRouteChangeCallback(func(winipcfg.MibNotificationType, *winipcfg.MibIPforwardRow2) {
+		r.scheduleConflictCheck()
+	})
+	if err != nil {
+		// Not fatal; conflicts are still checked on each Set.
+		r.logf("watching for conflicting routes: %v", err)
+	}
 	return nil
 }
 
@@ -72,6 +136,20 @@ func (r *winRouter) Set(cfg *Config) error {
 	if cfg == nil {
 		cfg = &shutdownConfig
 	}
+	r.mu.Lock()
+	prev := r.lastCfg
+	r.lastCfg = cfg
+	r.mu.Unlock()
+
+	if prev == nil || !equalPrefixes(prev.Routes, cfg.Routes) {
+		routes := make([]string, len(cfg.Routes))
+		for i, rt := range cfg.Routes {
+			routes[i] = rt.String()
+		}
+		winutil.LogEvent(winutil.EventRoutesChanged, "The routes via Tailscale changed.",
+			"Routes", strings.Join(routes, " "),
+			"DefaultRoute", fmt.Sprint(hasDefaultRoute(cfg.Routes)))
+	}
 
 	var localAddrs []string
 	for _, la := range cfg.LocalAddrs {
@@ -90,9 +168,85 @@ func (r *winRouter) Set(cfg *Config) error {
 		r.logf("flushdns error: %v", err)
 	}
 
+	r.checkRouteConflicts()
 	return nil
 }
 
+// conflictCheckDelay is how long after a route change the router checks
+// for conflicting routes, so a burst of changes (such as a VPN client
+// connecting) is checked once.
+const conflictCheckDelay = 2 * time.Second
+
+// scheduleConflictCheck arranges for checkRouteConflicts to run after
+// conflictCheckDelay, unless it's already scheduled.
+func (r *winRouter) scheduleConflictCheck() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conflictCallback == nil {
+		// Closed.
+		return
+	}
+	if r.conflictTimer == nil {
+		r.conflictTimer = time.AfterFunc(conflictCheckDelay, r.checkRouteConflicts)
+	} else {
+		r.conflictTimer.Reset(conflictCheckDelay)
+	}
+}
+
+// checkRouteConflicts checks whether other adapters' routes take
+// precedence over Tailscale's, and reports them via health.
+func (r *winRouter) checkRouteConflicts() {
+	r.mu.Lock()
+	cfg := r.lastCfg
+	r.mu.Unlock()
+
+	var conflicts []routeConflict
+	if cfg != nil && len(cfg.Routes) > 0 {
+		table, err := getRouteTable(winipcfg.LUID(r.nativeTun.LUID()))
+		if err != nil {
+			r.logf("checking for conflicting routes: %v", err)
+			return
+		}
+		conflicts = findRouteConflicts(cfg.Routes, table)
+	}
+
+	var err error
+	var desc string
+	if len(conflicts) > 0 {
+		strs := make([]string, len(conflicts))
+		for i, c := range conflicts {
+			strs[i] = c.String()
+		}
+		desc = strings.Join(strs, "; ")
+		err = fmt.Errorf("%d Tailscale route(s) are overridden by other network adapters' routes (%s); the InterfaceMetric, RouteMetric and RouteMetrics policies can raise Tailscale's priority", len(conflicts), desc)
+	}
+	health.SetRouteConflictHealth(err)
+
+	r.mu.Lock()
+	changed := desc != r.lastConflicts
+	r.lastConflicts = desc
+	r.mu.Unlock()
+	if changed {
+		if desc == "" {
+			r.logf("no conflicting routes")
+		} else {
+			r.logf("conflicting routes: %s", desc)
+		}
+	}
+}
+
+func equalPrefixes(a, b []netaddr.IPPrefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func hasDefaultRoute(routes []netaddr.IPPrefix) bool {
 	for _, route := range routes {
 		if route.Bits() == 0 {
@@ -105,9 +259,25 @@ func hasDefaultRoute(routes []netaddr.IPPrefix) bool {
 func (r *winRouter) Close() error {
 	r.firewall.clear()
 
-	if r.routeChangeCallback != nil {
-		r.routeChangeCallback.Unregister()
+	r.mu.Lock()
+	routeCB, conflictCB := r.routeChangeCallback, r.conflictCallback
+	r.routeChangeCallback = nil
+	r.conflictCallback = nil
+	if r.conflictTimer != nil {
+		r.conflictTimer.Stop()
+		r.conflictTimer = nil
+	}
+	r.mu.Unlock()
+
+	// Unregister waits for in-flight callbacks, which take r.mu in
+	// scheduleConflictCheck, so it must be called without r.mu held.
+	if routeCB != nil {
+		routeCB.Unregister()
+	}
+	if conflictCB != nil {
+		conflictCB.Unregister()
 	}
+	health.SetRouteConflictHealth(nil)
 
 	return nil
 }
@@ -0,0 +1,142 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/wgengine/router"
+)
+
+const (
+	// routeVerifyInterval is how often the router's OS state is
+	// checked, if the router is a router.Verifier.
+	routeVerifyInterval = 30 * time.Second
+
+	// routeVerifyMaxInterval is how far the check backs off to while
+	// something keeps undoing the router's OS state (such as another
+	// program that manages the firewall), rather than fighting it
+	// every routeVerifyInterval.
+	routeVerifyMaxInterval = 10 * time.Minute
+)
+
+func (e *userspaceEngine) RouteStatus() *ipnstate.RouteStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rs := e.routeStatus
+	return &rs
+}
+
+// routeVerifyDelay returns how long to wait before the next check of
+// the router's OS state, after streak consecutive checks that needed
+// repairs.
+func routeVerifyDelay(streak int) time.Duration {
+	d := routeVerifyInterval
+	for i := 0; i < streak && d < routeVerifyMaxInterval; i++ {
+		d *= 2
+	}
+	if d > routeVerifyMaxInterval {
+		d = routeVerifyMaxInterval
+	}
+	return d
+}
+
+// routerSetLocked records the result err of the router.Set of a new
+// router config. If the router can verify its OS state, it schedules
+// a check right away, and every routeVerifyInterval after that.
+//
+// e.wgLock and e.routerMu must be held.
+func (e *userspaceEngine) routerSetLocked(err error) {
+	e.lastRouterErr = err
+	_, verifier := e.router.(router.Verifier)
+	if err != nil || !verifier {
+		health.SetRouteConvergenceHealth(nil)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.routeStatus = ipnstate.RouteStatus{
+		Converged:  err == nil,
+		Verified:   verifier,
+		LastChange: time.Now(),
+	}
+	if err != nil {
+		e.routeStatus.Problem = err.Error()
+	}
+	e.routeVerifyOn = err == nil && verifier
+	e.routeRepairStreak = 0
+	if e.routeVerifyOn {
+		e.scheduleRouteVerifyLocked(0)
+	} else if e.routeVerifyTimer != nil {
+		e.routeVerifyTimer.Stop()
+	}
+}
+
+// scheduleRouteVerifyLocked arranges for verifyRoutes to run after d,
+// replacing any earlier schedule.
+//
+// e.mu must be held.
+func (e *userspaceEngine) scheduleRouteVerifyLocked(d time.Duration) {
+	if e.closing {
+		return
+	}
+	if e.routeVerifyTimer == nil {
+		e.routeVerifyTimer = time.AfterFunc(d, e.verifyRoutes)
+	} else {
+		e.routeVerifyTimer.Reset(d)
+	}
+}
+
+// verifyRoutes checks the router's OS state, repairing it if
+// anything's missing, updates e.routeStatus and its health, and
+// schedules the next check. It's called by e.routeVerifyTimer.
+//
+// Checking can mean running external commands, so it's done without
+// e.wgLock, which would hold up reconfiguration and status. While
+// checks keep finding things to repair, they back off to
+// routeVerifyMaxInterval.
+func (e *userspaceEngine) verifyRoutes() {
+	e.routerMu.Lock()
+	defer e.routerMu.Unlock()
+
+	e.mu.Lock()
+	on := e.routeVerifyOn && !e.closing
+	e.mu.Unlock()
+	if !on {
+		// Nothing to verify until the next config is set.
+		return
+	}
+
+	v := e.router.(router.Verifier)
+	repaired := false
+	err := v.Verify(true)
+	if err != nil {
+		e.routeLogf("wgengine: router state drifted: %v; repaired", err)
+		repaired = true
+		if err = v.Verify(false); err != nil {
+			e.routeLogf("wgengine: router state still drifted after repair: %v", err)
+		}
+	}
+	health.SetRouteConvergenceHealth(err)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rs := &e.routeStatus
+	rs.LastCheck = time.Now()
+	rs.Converged = err == nil
+	rs.Problem = ""
+	if err != nil {
+		rs.Problem = err.Error()
+	}
+	if repaired {
+		rs.Repairs++
+		e.routeRepairStreak++
+	} else {
+		e.routeRepairStreak = 0
+	}
+	e.scheduleRouteVerifyLocked(routeVerifyDelay(e.routeRepairStreak))
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/dns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/router"
+)
+
+// maxShadowDiffs is how many of the most recent diffs a shadowEngine
+// keeps.
+const maxShadowDiffs = 20
+
+// shadowEngine is a dry-run engine: it's given the same network maps
+// and configs as the real engine, but programs nothing. It only
+// records how each differs from the last applied one, before it's
+// applied, so that a change made by the control server can be
+// checked on a sensitive node before it takes effect. In hold mode
+// (Config.ShadowHold), a network map that changes anything isn't
+// applied at all until it's released.
+//
+// The first network map and config it's given are its baseline, and
+// aren't reported as changes.
+type shadowEngine struct {
+	logf logger.Logf
+
+	mu      sync.Mutex
+	haveNM  bool
+	peers   map[tailcfg.StableNodeID]shadowPeer
+	filter  []filter.Match
+	haveCfg bool
+	routes  []netaddr.IPPrefix
+	addrs   []netaddr.IPPrefix
+	dnsCfg  *dns.Config
+	diffs   []ipnstate.ShadowDiff // oldest first
+}
+
+// shadowPeer is what the shadowEngine compares about a peer.
+type shadowPeer struct {
+	name       string
+	allowedIPs []netaddr.IPPrefix
+}
+
+func newShadowEngine(logf logger.Logf) *shadowEngine {
+	return &shadowEngine{logf: logf}
+}
+
+// checkNetworkMap diffs nm's peers and packet filter against those of
+// the last network map given to setNetworkMap, and records the diff,
+// marked held if hold is set. It reports whether nm is to be held:
+// whether hold is set and nm changes anything.
+func (s *shadowEngine) checkNetworkMap(nm *netmap.NetworkMap, hold bool) bool {
+	if nm == nil {
+		return false
+	}
+	peers := shadowPeers(nm)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.haveNM {
+		return false
+	}
+	d := ipnstate.ShadowDiff{When: time.Now()}
+	for id, p := range peers {
+		old, ok := s.peers[id]
+		switch {
+		case !ok:
+			d.PeersAdded = append(d.PeersAdded, p.name)
+		case !reflect.DeepEqual(old.allowedIPs, p.allowedIPs):
+			d.PeersChanged = append(d.PeersChanged, p.name)
+		}
+	}
+	for id, p := range s.peers {
+		if _, ok := peers[id]; !ok {
+			d.PeersRemoved = append(d.PeersRemoved, p.name)
+		}
+	}
+	sort.Strings(d.PeersAdded)
+	sort.Strings(d.PeersRemoved)
+	sort.Strings(d.PeersChanged)
+	if !reflect.DeepEqual(s.filter, nm.PacketFilter) {
+		d.FilterChanged = true
+		d.FilterRules = len(nm.PacketFilter)
+	}
+	if d.IsEmpty() {
+		return false
+	}
+	d.Held = hold
+	s.addLocked(d)
+	return hold
+}
+
+// setNetworkMap makes nm the network map that later ones are diffed
+// against, as the real engine has applied it.
+func (s *shadowEngine) setNetworkMap(nm *netmap.NetworkMap) {
+	if nm == nil {
+		return
+	}
+	peers := shadowPeers(nm)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.haveNM = true
+	s.peers, s.filter = peers, nm.PacketFilter
+}
+
+func shadowPeers(nm *netmap.NetworkMap) map[tailcfg.StableNodeID]shadowPeer {
+	peers := make(map[tailcfg.StableNodeID]shadowPeer, len(nm.Peers))
+	for _, p := range nm.Peers {
+		peers[p.StableID] = shadowPeer{name: p.Name, allowedIPs: p.AllowedIPs}
+	}
+	return peers
+}
+
+// reconfig diffs the routes, addresses and DNS config of rcfg and
+// dcfg against the previous ones.
+func (s *shadowEngine) reconfig(rcfg *router.Config, dcfg *dns.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.haveCfg {
+		s.haveCfg = true
+		s.routes, s.addrs, s.dnsCfg = rcfg.Routes, rcfg.LocalAddrs, dcfg
+		return
+	}
+	d := ipnstate.ShadowDiff{When: time.Now()}
+	d.RoutesAdded, d.RoutesRemoved = diffPrefixes(s.routes, rcfg.Routes)
+	d.AddrsAdded, d.AddrsRemoved = diffPrefixes(s.addrs, rcfg.LocalAddrs)
+	d.DNSChanged = !reflect.DeepEqual(s.dnsCfg, dcfg)
+	s.routes, s.addrs, s.dnsCfg = rcfg.Routes, rcfg.LocalAddrs, dcfg
+	s.addLocked(d)
+}
+
+// addLocked records d, unless it's empty or the same as the last
+// one, as when a held network map is sent again. s.mu must be held.
+func (s *shadowEngine) addLocked(d ipnstate.ShadowDiff) {
+	if d.IsEmpty() {
+		return
+	}
+	if n := len(s.diffs); n > 0 {
+		last := s.diffs[n-1]
+		last.When = d.When
+		if reflect.DeepEqual(last, d) {
+			return
+		}
+	}
+	s.logf("shadow: %v", d)
+	if len(s.diffs) == maxShadowDiffs {
+		copy(s.diffs, s.diffs[1:])
+		s.diffs = s.diffs[:maxShadowDiffs-1]
+	}
+	s.diffs = append(s.diffs, d)
+}
+
+// getDiffs returns the recorded diffs, oldest first.
+func (s *shadowEngine) getDiffs() []ipnstate.ShadowDiff {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ipnstate.ShadowDiff(nil), s.diffs...)
+}
+
+// diffPrefixes returns the prefixes in new that aren't in old, and
+// those in old that aren't in new.
+func diffPrefixes(old, new []netaddr.IPPrefix) (added, removed []netaddr.IPPrefix) {
+	in := func(pp []netaddr.IPPrefix, p netaddr.IPPrefix) bool {
+		for _, q := range pp {
+			if q == p {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range new {
+		if !in(old, p) {
+			added = append(added, p)
+		}
+	}
+	for _, p := range old {
+		if !in(new, p) {
+			removed = append(removed, p)
+		}
+	}
+	return added, removed
+}
+
+func (e *userspaceEngine) ShadowDiffs() []ipnstate.ShadowDiff {
+	if e.shadow == nil {
+		return nil
+	}
+	return e.shadow.getDiffs()
+}
+
+func (e *userspaceEngine) ShadowHold(nm *netmap.NetworkMap) bool {
+	if e.shadow == nil {
+		return false
+	}
+	return e.shadow.checkNetworkMap(nm, e.shadowHold)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/dns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/router"
+)
+
+func TestShadowEngine(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	node := func(id, name string, ips ...string) *tailcfg.Node {
+		n := &tailcfg.Node{StableID: tailcfg.StableNodeID(id), Name: name}
+		for _, ip := range ips {
+			n.AllowedIPs = append(n.AllowedIPs, pfx(ip))
+		}
+		return n
+	}
+	s := newShadowEngine(t.Logf)
+
+	s.setNetworkMap(&netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			node("a", "a.ts.net.", "100.64.0.1/32"),
+			node("b", "b.ts.net.", "100.64.0.2/32"),
+		},
+	})
+	s.reconfig(&router.Config{
+		LocalAddrs: []netaddr.IPPrefix{pfx("100.64.0.9/32")},
+		Routes:     []netaddr.IPPrefix{pfx("100.64.0.0/10")},
+	}, &dns.Config{})
+	if d := s.getDiffs(); len(d) != 0 {
+		t.Fatalf("baseline recorded diffs: %v", d)
+	}
+
+	// The same again changes nothing.
+	s.reconfig(&router.Config{
+		LocalAddrs: []netaddr.IPPrefix{pfx("100.64.0.9/32")},
+		Routes:     []netaddr.IPPrefix{pfx("100.64.0.0/10")},
+	}, &dns.Config{})
+	if d := s.getDiffs(); len(d) != 0 {
+		t.Fatalf("unchanged config recorded diffs: %v", d)
+	}
+
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			node("b", "b.ts.net.", "100.64.0.2/32", "10.0.0.0/8"),
+			node("c", "c.ts.net.", "100.64.0.3/32"),
+		},
+		PacketFilter: []filter.Match{{}},
+	}
+	if s.checkNetworkMap(nm, false) {
+		t.Fatal("network map held outside hold mode")
+	}
+	s.setNetworkMap(nm)
+	s.reconfig(&router.Config{
+		LocalAddrs: []netaddr.IPPrefix{pfx("100.64.0.9/32")},
+		Routes:     []netaddr.IPPrefix{pfx("100.64.0.0/10"), pfx("10.0.0.0/8")},
+	}, &dns.Config{Hosts: map[dnsname.FQDN][]netaddr.IP{"c.ts.net.": {netaddr.MustParseIP("100.64.0.3")}}})
+
+	diffs := s.getDiffs()
+	if len(diffs) != 2 {
+		t.Fatalf("got %d diffs; want 2: %v", len(diffs), diffs)
+	}
+	nd := diffs[0]
+	if !reflect.DeepEqual(nd.PeersAdded, []string{"c.ts.net."}) ||
+		!reflect.DeepEqual(nd.PeersRemoved, []string{"a.ts.net."}) ||
+		!reflect.DeepEqual(nd.PeersChanged, []string{"b.ts.net."}) {
+		t.Errorf("peer diff = %v", nd)
+	}
+	if !nd.FilterChanged || nd.FilterRules != 1 {
+		t.Errorf("filter diff = %v; want 1 rule", nd)
+	}
+	cd := diffs[1]
+	if !reflect.DeepEqual(cd.RoutesAdded, []netaddr.IPPrefix{pfx("10.0.0.0/8")}) || len(cd.RoutesRemoved) != 0 {
+		t.Errorf("route diff = %v", cd)
+	}
+	if len(cd.AddrsAdded) != 0 || len(cd.AddrsRemoved) != 0 {
+		t.Errorf("addr diff = %v; want none", cd)
+	}
+	if !cd.DNSChanged {
+		t.Errorf("config diff = %v; want DNS change", cd)
+	}
+}
+
+func TestShadowEngineLimit(t *testing.T) {
+	s := newShadowEngine(t.Logf)
+	s.reconfig(&router.Config{}, &dns.Config{})
+	for i := 0; i < maxShadowDiffs+5; i++ {
+		s.reconfig(&router.Config{
+			Routes: []netaddr.IPPrefix{netaddr.IPPrefixFrom(netaddr.IPv4(10, 0, byte(i), 0), 24)},
+		}, &dns.Config{})
+	}
+	diffs := s.getDiffs()
+	if len(diffs) != maxShadowDiffs {
+		t.Fatalf("got %d diffs; want %d", len(diffs), maxShadowDiffs)
+	}
+	if got, want := diffs[len(diffs)-1].RoutesAdded[0], netaddr.MustParseIPPrefix("10.0.24.0/24"); got != want {
+		t.Errorf("newest diff added %v; want %v", got, want)
+	}
+}
+
+func TestShadowEngineHold(t *testing.T) {
+	peer := func(id string) *tailcfg.Node {
+		return &tailcfg.Node{StableID: tailcfg.StableNodeID(id), Name: id + ".ts.net."}
+	}
+	s := newShadowEngine(t.Logf)
+
+	base := &netmap.NetworkMap{Peers: []*tailcfg.Node{peer("a")}}
+	if s.checkNetworkMap(base, true) {
+		t.Fatal("baseline network map held")
+	}
+	s.setNetworkMap(base)
+	if s.checkNetworkMap(&netmap.NetworkMap{Peers: []*tailcfg.Node{peer("a")}}, true) {
+		t.Error("unchanged network map held")
+	}
+
+	// A change is held, and diffed against what was applied each
+	// time it's sent, without being recorded twice.
+	changed := &netmap.NetworkMap{Peers: []*tailcfg.Node{peer("a"), peer("b")}}
+	for i := 0; i < 2; i++ {
+		if !s.checkNetworkMap(changed, true) {
+			t.Fatalf("changed network map not held (try %d)", i)
+		}
+	}
+	diffs := s.getDiffs()
+	if len(diffs) != 1 || !diffs[0].Held || !reflect.DeepEqual(diffs[0].PeersAdded, []string{"b.ts.net."}) {
+		t.Fatalf("diffs = %v; want one held diff adding b", diffs)
+	}
+
+	// Once released and applied, it's the new baseline.
+	s.setNetworkMap(changed)
+	if s.checkNetworkMap(changed, true) {
+		t.Error("applied network map held again")
+	}
+}
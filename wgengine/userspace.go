@@ -36,6 +36,7 @@
 	"tailscale.com/net/tsdial"
 	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/net/tstun"
+	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstime/mono"
 	"tailscale.com/types/dnstype"
@@ -98,9 +99,14 @@ type userspaceEngine struct {
 	dns               *dns.Manager
 	magicConn         *magicsock.Conn
 	linkMon           *monitor.Mon
-	linkMonOwned      bool       // whether we created linkMon (and thus need to close it)
-	linkMonUnregister func()     // unsubscribes from changes; used regardless of linkMonOwned
-	birdClient        BIRDClient // or nil
+	linkMonOwned      bool          // whether we created linkMon (and thus need to close it)
+	linkMonUnregister func()        // unsubscribes from changes; used regardless of linkMonOwned
+	birdClient        BIRDClient    // or nil
+	shadow            *shadowEngine // or nil; see Config.Shadow
+	shadowHold        bool          // see Config.ShadowHold
+
+	// linkExpensive is the last isExpensive passed to LinkChange.
+	linkExpensive syncs.AtomicBool
 
 	testMaybeReconfigHook func() // for tests; if non-nil, fires if maybeReconfigWireguardLocked called
 
@@ -120,6 +126,7 @@ type userspaceEngine struct {
 	lastEngineSigFull   deephash.Sum // of full wireguard config
 	lastEngineSigTrim   deephash.Sum // of trimmed wireguard config
 	lastDNSConfig       *dns.Config
+	lastRouterErr       error
 	lastIsSubnetRouter  bool // was the node a primary subnet router in the last run.
 	recvActivityAt      map[key.NodePublic]mono.Time
 	trimmedNodes        map[key.NodePublic]bool   // set of node keys of peers currently excluded from wireguard config
@@ -128,6 +135,12 @@ type userspaceEngine struct {
 	statusBufioReader   *bufio.Reader // reusable for UAPI
 	lastStatusPollTime  mono.Time     // last time we polled the engine status
 
+	// routerMu serializes calls into router, so the route verifier
+	// (see routestatus.go) can check and repair the router's OS state
+	// without holding wgLock.
+	routerMu  sync.Mutex
+	routeLogf logger.Logf // rate-limited logf for route verification
+
 	mu                  sync.Mutex         // guards following; see lock order comment below
 	netMap              *netmap.NetworkMap // or nil
 	closing             bool               // Close was called (even if we're still closing)
@@ -137,6 +150,13 @@ type userspaceEngine struct {
 	pendOpen            map[flowtrack.Tuple]*pendingOpenFlow // see pendopen.go
 	networkMapCallbacks map[*someHandle]NetworkMapCallback
 	tsIPByIPPort        map[netaddr.IPPort]netaddr.IP // allows registration of IP:ports as belonging to a certain Tailscale IP for whois lookups
+	routeStatus         ipnstate.RouteStatus
+	routeVerifyTimer    *time.Timer // or nil; see routestatus.go
+	routeVerifyOn       bool        // last router.Set succeeded and router is a router.Verifier
+	routeRepairStreak   int         // consecutive route checks that needed repairs
+	flowCounter         *flowtrack.Counter
+	flowIdleTimer       *time.Timer
+	lastFlowStatsCall   time.Time
 
 	// pongCallback is the map of response handlers waiting for disco or TSMP
 	// pong callbacks. The map key is a random slice of bytes.
@@ -146,7 +166,7 @@ type userspaceEngine struct {
 	// value of the ICMP identifer and sequence number concatenated.
 	icmpEchoResponseCallback map[uint32]func()
 
-	// Lock ordering: magicsock.Conn.mu, wgLock, then mu.
+	// Lock ordering: magicsock.Conn.mu, wgLock, routerMu, then mu.
 }
 
 // InternalsGetter is implemented by Engines that can export their internals.
@@ -218,6 +238,22 @@ type Config struct {
 	// BIRDClient, if non-nil, will be used to configure BIRD whenever
 	// this node is a primary subnet router.
 	BIRDClient BIRDClient
+
+	// Shadow, if true, also gives each network map and config to a
+	// no-op shadow engine that logs and records how they differ
+	// from the previous ones (see Engine.ShadowDiffs). It doesn't
+	// change what the engine does.
+	Shadow bool
+
+	// ShadowHold, if true along with Shadow, has Engine.ShadowHold
+	// report each network map that changes anything, so that the
+	// caller holds it back until it's reviewed and released.
+	ShadowHold bool
+
+	// DERPIdleTimeout, if non-zero, is how long the tunnel must be
+	// idle before the engine disconnects from DERP, until it next
+	// has a packet to send. See magicsock.Options.DERPIdleTimeout.
+	DERPIdleTimeout time.Duration
 }
 
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error) {
@@ -304,8 +340,13 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		router:         conf.Router,
 		confListenPort: conf.ListenPort,
 		birdClient:     conf.BIRDClient,
+		routeLogf:      logger.RateLimitedFn(logf, routeVerifyMaxInterval, 1, 4),
 	}
 
+	if conf.Shadow {
+		e.shadow = newShadowEngine(logf)
+		e.shadowHold = conf.ShadowHold
+	}
 	if e.birdClient != nil {
 		// Disable the protocol at start time.
 		if err := e.birdClient.DisableProtocol("tailscale"); err != nil {
@@ -354,6 +395,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		EndpointsFunc:    endpointsFn,
 		DERPActiveFunc:   e.RequestStatus,
 		IdleFunc:         e.tundev.IdleDuration,
+		DERPIdleTimeout:  conf.DERPIdleTimeout,
 		NoteRecvActivity: e.noteRecvActivity,
 		LinkMonitor:      e.linkMon,
 	}
@@ -538,6 +580,26 @@ func (e *userspaceEngine) pollResolver() {
 
 var debugTrimWireguard = envknob.OptBool("TS_DEBUG_TRIM_WIREGUARD")
 
+// lowBandwidthMode opts in to low bandwidth mode (see
+// magicsock.Conn.SetLowBandwidth), which is off by default as it slows
+// down finding direct paths. "always" treats every link as low
+// bandwidth, for devices such as IoT nodes on constrained uplinks that
+// the link monitor can't recognize; "metered" treats links the OS says
+// are metered, such as cellular, as low bandwidth.
+var lowBandwidthMode = envknob.String("TS_LOW_BANDWIDTH")
+
+// wantLowBandwidth reports whether lowBandwidthMode puts a link in low
+// bandwidth mode, given whether it's metered.
+func wantLowBandwidth(isExpensive bool) bool {
+	switch lowBandwidthMode {
+	case "always":
+		return true
+	case "metered":
+		return isExpensive
+	}
+	return false
+}
+
 // forceFullWireguardConfig reports whether we should give wireguard
 // our full network map, even for inactive peers
 //
@@ -828,6 +890,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		panic("dnsCfg must not be nil")
 	}
 
+	if e.shadow != nil {
+		e.shadow.reconfig(routerCfg, dnsCfg)
+	}
 	e.isLocalAddr.Store(tsaddr.NewContainsIPFunc(routerCfg.LocalAddrs))
 
 	e.wgLock.Lock()
@@ -911,7 +976,10 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 
 	if routerChanged {
 		e.logf("wgengine: Reconfig: configuring router")
+		e.routerMu.Lock()
 		err := e.router.Set(routerCfg)
+		e.routerSetLocked(err)
+		e.routerMu.Unlock()
 		health.SetRouterHealth(err)
 		if err != nil {
 			return err
@@ -1149,6 +1217,12 @@ func (e *userspaceEngine) Close() {
 		return
 	}
 	e.closing = true
+	if e.routeVerifyTimer != nil {
+		e.routeVerifyTimer.Stop()
+	}
+	if e.flowIdleTimer != nil {
+		e.flowIdleTimer.Stop()
+	}
 	e.mu.Unlock()
 
 	r := bufio.NewReader(strings.NewReader(""))
@@ -1159,7 +1233,9 @@ func (e *userspaceEngine) Close() {
 		e.linkMon.Close()
 	}
 	e.dns.Down()
+	e.routerMu.Lock()
 	e.router.Close()
+	e.routerMu.Unlock()
 	e.wgdev.Close()
 	e.tundev.Close()
 	if e.birdClient != nil {
@@ -1180,7 +1256,8 @@ func (e *userspaceEngine) GetLinkMonitor() *monitor.Mon {
 // LinkChange signals a network change event. It's currently
 // (2021-03-03) only called on Android. On other platforms, linkMon
 // generates link change events for us.
-func (e *userspaceEngine) LinkChange(_ bool) {
+func (e *userspaceEngine) LinkChange(isExpensive bool) {
+	e.linkExpensive.Set(isExpensive)
 	e.linkMon.InjectEvent()
 }
 
@@ -1196,6 +1273,7 @@ func (e *userspaceEngine) linkChange(changed bool, cur *interfaces.State) {
 
 	health.SetAnyInterfaceUp(up)
 	e.magicConn.SetNetworkUp(up)
+	e.magicConn.SetLowBandwidth(wantLowBandwidth(cur.IsExpensive || e.linkExpensive.Get()))
 	if !up || changed {
 		if err := e.dns.FlushCaches(); err != nil {
 			e.logf("wgengine: dns flush failed after major link change: %v", err)
@@ -1254,6 +1332,9 @@ func (e *userspaceEngine) SetDERPMap(dm *tailcfg.DERPMap) {
 }
 
 func (e *userspaceEngine) SetNetworkMap(nm *netmap.NetworkMap) {
+	if e.shadow != nil {
+		e.shadow.setNetworkMap(nm)
+	}
 	e.magicConn.SetNetworkMap(nm)
 	e.mu.Lock()
 	e.netMap = nm
@@ -1314,6 +1395,8 @@ func (e *userspaceEngine) Ping(ip netaddr.IP, pingType tailcfg.PingType, cb func
 		e.sendTSMPPing(ip, peer, res, cb)
 	case "ICMP":
 		e.sendICMPEchoRequest(ip, peer, res, cb)
+	case "relay":
+		e.magicConn.VerifyRelay(peer, res, cb)
 	}
 }
 
@@ -5,9 +5,11 @@
 package wgengine
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"go4.org/mem"
 	"inet.af/netaddr"
@@ -274,3 +276,96 @@ func BenchmarkGenLocalAddrFunc(b *testing.B) {
 	})
 	b.Logf("x = %v", x)
 }
+
+// driftingRouter is a router.Verifier whose OS state can be made to
+// drift, and to stay drifted despite repairs.
+type driftingRouter struct {
+	router.Router
+	drifted bool
+	stuck   bool
+}
+
+func (r *driftingRouter) Verify(repair bool) error {
+	if !r.drifted {
+		return nil
+	}
+	if repair && !r.stuck {
+		r.drifted = false
+	}
+	return errors.New("missing route 10.0.0.0/8")
+}
+
+func TestUserspaceEngineRouteStatus(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	ue := e.(*userspaceEngine)
+	dr := &driftingRouter{Router: ue.router}
+	ue.router = dr
+
+	ue.wgLock.Lock()
+	ue.routerMu.Lock()
+	ue.routerSetLocked(nil)
+	ue.routerMu.Unlock()
+	ue.wgLock.Unlock()
+	// The first check runs right away, in the background.
+	for i := 0; e.RouteStatus().LastCheck.IsZero(); i++ {
+		if i == 100 {
+			t.Fatal("routes not checked after Set")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rs := e.RouteStatus(); !rs.Converged || !rs.Verified || rs.Repairs != 0 {
+		t.Errorf("after Set: %+v", rs)
+	}
+
+	dr.drifted = true
+	ue.verifyRoutes()
+	if rs := e.RouteStatus(); !rs.Converged || rs.Repairs != 1 || rs.Problem != "" {
+		t.Errorf("after repair: %+v", rs)
+	}
+
+	dr.drifted, dr.stuck = true, true
+	ue.verifyRoutes()
+	if rs := e.RouteStatus(); rs.Converged || rs.Repairs != 2 || rs.Problem == "" {
+		t.Errorf("after failed repair: %+v", rs)
+	}
+
+	if ue.routeRepairStreak != 2 {
+		t.Errorf("repair streak = %d; want 2", ue.routeRepairStreak)
+	}
+
+	ue.wgLock.Lock()
+	ue.routerMu.Lock()
+	ue.routerSetLocked(errors.New("set failed"))
+	ue.routerMu.Unlock()
+	ue.wgLock.Unlock()
+	if rs := e.RouteStatus(); rs.Converged || rs.Problem != "set failed" || rs.Repairs != 0 {
+		t.Errorf("after failed Set: %+v", rs)
+	}
+	// Nothing's verified after a failed Set.
+	ue.verifyRoutes()
+	if rs := e.RouteStatus(); rs.Problem != "set failed" {
+		t.Errorf("verified after failed Set: %+v", rs)
+	}
+}
+
+func TestRouteVerifyDelay(t *testing.T) {
+	tests := []struct {
+		streak int
+		want   time.Duration
+	}{
+		{0, routeVerifyInterval},
+		{1, 2 * routeVerifyInterval},
+		{3, 8 * routeVerifyInterval},
+		{5, routeVerifyMaxInterval},
+		{1000, routeVerifyMaxInterval},
+	}
+	for _, tt := range tests {
+		if got := routeVerifyDelay(tt.streak); got != tt.want {
+			t.Errorf("routeVerifyDelay(%d) = %v; want %v", tt.streak, got, tt.want)
+		}
+	}
+}
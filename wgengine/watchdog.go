@@ -133,6 +133,22 @@ func (e *watchdogEngine) WhoIsIPPort(ipp netaddr.IPPort) (tsIP netaddr.IP, ok bo
 	e.watchdog("UnregisterIPPortIdentity", func() { tsIP, ok = e.wrap.WhoIsIPPort(ipp) })
 	return tsIP, ok
 }
+func (e *watchdogEngine) RouteStatus() (rs *ipnstate.RouteStatus) {
+	e.watchdog("RouteStatus", func() { rs = e.wrap.RouteStatus() })
+	return rs
+}
+func (e *watchdogEngine) FlowStats() (fs []ipnstate.FlowStat) {
+	e.watchdog("FlowStats", func() { fs = e.wrap.FlowStats() })
+	return fs
+}
+func (e *watchdogEngine) ShadowDiffs() (d []ipnstate.ShadowDiff) {
+	e.watchdog("ShadowDiffs", func() { d = e.wrap.ShadowDiffs() })
+	return d
+}
+func (e *watchdogEngine) ShadowHold(nm *netmap.NetworkMap) (hold bool) {
+	e.watchdog("ShadowHold", func() { hold = e.wrap.ShadowHold(nm) })
+	return hold
+}
 func (e *watchdogEngine) Close() {
 	e.watchdog("Close", e.wrap.Close)
 }
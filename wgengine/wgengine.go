@@ -112,7 +112,10 @@ type Engine interface {
 	// LinkChange informs the engine that the system network
 	// link has changed.
 	//
-	// The isExpensive parameter is not used.
+	// isExpensive is whether the link is metered, such as
+	// cellular. If TS_LOW_BANDWIDTH=metered opts in, the engine
+	// then uses less bandwidth probing paths and asks DERP servers
+	// to pace their relaying.
 	//
 	// LinkChange should be called whenever something changed with
 	// the network, no matter how minor.
@@ -172,4 +175,27 @@ type Engine interface {
 	// WhoIsIPPort looks up an IP:port in the temporary registrations,
 	// and returns a matching Tailscale IP, if it exists.
 	WhoIsIPPort(netaddr.IPPort) (netaddr.IP, bool)
+
+	// RouteStatus reports whether the OS routes and firewall rules
+	// of the last router configuration are in place.
+	RouteStatus() *ipnstate.RouteStatus
+
+	// FlowStats returns the traffic of each recent flow through the
+	// packet filter. Flow accounting is only enabled while
+	// FlowStats is being called, so the first call returns nothing
+	// and counts start from then.
+	FlowStats() []ipnstate.FlowStat
+
+	// ShadowDiffs returns the most recent changes seen by the
+	// engine's shadow mode (see Config.Shadow), oldest first, or nil
+	// if it's not in shadow mode.
+	ShadowDiffs() []ipnstate.ShadowDiff
+
+	// ShadowHold diffs nm against the last network map given to
+	// SetNetworkMap, before nm is applied, recording the diff in
+	// shadow mode. It reports whether the caller should hold nm
+	// back rather than apply it: whether nm changes anything and
+	// Config.ShadowHold is set. It's always false outside shadow
+	// mode.
+	ShadowHold(nm *netmap.NetworkMap) bool
 }